@@ -0,0 +1,78 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// parseListener parses a -listen value: an address optionally followed by
+// per-listener ACL overrides in query string form, for example
+// "0.0.0.0:53?allow-recursion=none&deny-query=192.0.2.0/24". Encrypted
+// listeners are written tls://addr or https://addr/path and also take
+// client-cert=request|require. rcvbuf and sndbuf set the socket buffer
+// sizes in bytes.
+func parseListener(spec string, base ACLSet) (*server.ListenerSpec, error) {
+	addr, params, _ := strings.Cut(spec, "?")
+	l := &server.ListenerSpec{Addr: addr, ACLs: base.Clone(), Transport: "udp"}
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		l.Transport, l.Addr = scheme, rest
+		switch scheme {
+		case "tls":
+		case "https":
+			l.Path = "/dns-query"
+			if i := strings.Index(rest, "/"); i >= 0 {
+				l.Addr, l.Path = rest[:i], rest[i:]
+			}
+		default:
+			return nil, fmt.Errorf("invalid -listen %q: unknown transport %q", spec, scheme)
+		}
+	}
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -listen %q: %v", spec, err)
+	}
+	if v, ok := values["client-cert"]; ok {
+		l.ClientCert = v[0]
+		if l.Transport == "udp" || (l.ClientCert != "request" && l.ClientCert != "require") {
+			return nil, fmt.Errorf("invalid -listen %q: client-cert must be request or require on a tls or https listener", spec)
+		}
+		delete(values, "client-cert")
+	}
+	for key, size := range map[string]*int{"rcvbuf": &l.ReadBuffer, "sndbuf": &l.WriteBuffer} {
+		if v, ok := values[key]; ok {
+			n, err := strconv.Atoi(v[0])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid -listen %q: %s must be a positive number of bytes", spec, key)
+			}
+			*size = n
+			delete(values, key)
+		}
+	}
+	if err := l.ACLs.Apply(values); err != nil {
+		return nil, fmt.Errorf("invalid -listen %q: %v", spec, err)
+	}
+	return l, nil
+}
+
+// refusedResponse answers m with REFUSED and no records.
+func refusedResponse(m *Message) *Query {
+	return errorResponse(m, RCodeRefused)
+}
+
+// requiredCapability returns what a client must be allowed to do for m to
+// be processed, apart from recursion which depends on how it is answered.
+func requiredCapability(m *Message) Capability {
+	if m.Header.Opcode == 5 {
+		return CapUpdate
+	}
+	for _, q := range m.Questions {
+		if q.QType == TypeAXFR || q.QType == TypeIXFR {
+			return CapTransfer
+		}
+	}
+	return CapQuery
+}
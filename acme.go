@@ -0,0 +1,385 @@
+package dnsserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var acmeUpdates = NewCounterVec("dns_acme_updates_total", "ACME challenge updates through the ACME API.", "result")
+
+// ACME serves an API compatible with acme-dns that lets ACME clients set
+// the TXT records of DNS-01 challenges in served zones:
+//
+//	POST /register  {"allowfrom": ["192.0.2.0/24"]}
+//	POST /update    {"subdomain": "...", "txt": "..."} with X-Api-User and X-Api-Key
+//	DELETE /update  {"subdomain": "..."}, the same way authenticated
+//	GET /health
+//
+// Each account owns one name, its fulldomain. Accounts registered through
+// the API get a random name below Domain, which the names to validate
+// point to with a CNAME from their _acme-challenge label; accounts added
+// to the file by hand can own _acme-challenge names in served zones
+// directly. As in acme-dns, a name keeps its two latest values, so a name
+// and its wildcard can be validated together. The values are served with
+// a short TTL and removed once Lifetime has passed.
+type ACME struct {
+	// Domain is the name registered accounts get names below; without it
+	// /register is disabled.
+	Domain   string
+	TTL      uint32
+	Lifetime time.Duration
+	// Zones returns the served zones to put the records in.
+	Zones func() *ZoneSet
+
+	path string
+
+	mu       sync.Mutex
+	accounts map[string]*acmeAccount
+	values   map[string][]acmeValue
+	// changed holds the origins of the zones challenges were set in.
+	changed map[string]bool
+}
+
+// acmeAccount is an entry of the accounts file. Passwords are random and
+// long, so they are stored as plain SHA-256 hashes.
+type acmeAccount struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_sha256"`
+	FullDomain   string   `json:"fulldomain"`
+	Subdomain    string   `json:"subdomain"`
+	AllowFrom    []string `json:"allowfrom,omitempty"`
+}
+
+type acmeValue struct {
+	txt     string
+	expires time.Time
+}
+
+// NewACME loads the accounts from path, which registrations are saved to.
+func NewACME(path string) (*ACME, error) {
+	a := &ACME{path: path, accounts: map[string]*acmeAccount{}, values: map[string][]acmeValue{}, changed: map[string]bool{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var accounts []*acmeAccount
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, acct := range accounts {
+		if _, err := parseAllowFrom(acct.AllowFrom); err != nil {
+			return nil, fmt.Errorf("%s: account %s: %v", path, acct.Username, err)
+		}
+		acct.FullDomain = normalizeName(acct.FullDomain)
+		a.accounts[acct.Username] = acct
+	}
+	return a, nil
+}
+
+func (a *ACME) save() error {
+	accounts := make([]*acmeAccount, 0, len(a.accounts))
+	for _, acct := range a.accounts {
+		accounts = append(accounts, acct)
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func (a *ACME) Serve(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /register", a.register)
+	mux.HandleFunc("POST /update", a.update)
+	mux.HandleFunc("DELETE /update", a.update)
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {})
+	logACME.Error("serving the API failed", "addr", ln.Addr().String(), "err", http.Serve(ln, mux))
+}
+
+func acmeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (a *ACME) register(w http.ResponseWriter, r *http.Request) {
+	if a.Domain == "" {
+		acmeError(w, http.StatusForbidden, "registration_disabled")
+		return
+	}
+	var req struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+	if body, _ := io.ReadAll(io.LimitReader(r.Body, 64<<10)); len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			acmeError(w, http.StatusBadRequest, "malformed_json_payload")
+			return
+		}
+	}
+	if _, err := parseAllowFrom(req.AllowFrom); err != nil {
+		acmeError(w, http.StatusBadRequest, "invalid_allowfrom_cidr")
+		return
+	}
+	password := randomToken(30)
+	if req.AllowFrom == nil {
+		req.AllowFrom = []string{}
+	}
+	acct := &acmeAccount{Username: randomUUID(), Subdomain: randomUUID(), AllowFrom: req.AllowFrom}
+	acct.FullDomain = normalizeName(acct.Subdomain + "." + a.Domain)
+	hash := sha256.Sum256([]byte(password))
+	acct.PasswordHash = hex.EncodeToString(hash[:])
+
+	a.mu.Lock()
+	a.accounts[acct.Username] = acct
+	err := a.save()
+	if err != nil {
+		delete(a.accounts, acct.Username)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		logACME.Error("saving accounts failed", "path", a.path, "err", err)
+		acmeError(w, http.StatusInternalServerError, "db_error")
+		return
+	}
+	if auditLog != nil {
+		auditLog.Record(auditRecord{Actor: clientIP(r), Action: "acme-register", Name: fqdn(acct.FullDomain), New: []string{acct.Username}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"username": acct.Username, "password": password, "fulldomain": fqdn(acct.FullDomain),
+		"subdomain": acct.Subdomain, "allowfrom": acct.AllowFrom,
+	})
+}
+
+// update sets a challenge value for POST and removes the values for
+// DELETE.
+func (a *ACME) update(w http.ResponseWriter, r *http.Request) {
+	acct := a.authenticate(r)
+	if acct == nil {
+		acmeUpdates.With("forbidden").Inc()
+		acmeError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	var req struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		acmeError(w, http.StatusBadRequest, "malformed_json_payload")
+		return
+	}
+	if req.Subdomain != acct.Subdomain {
+		acmeUpdates.With("forbidden").Inc()
+		acmeError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	if r.Method == http.MethodPost && !validChallenge(req.TXT) {
+		acmeError(w, http.StatusBadRequest, "bad_txt")
+		return
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	old := a.values[acct.FullDomain]
+	if r.Method == http.MethodPost {
+		// The latest value goes last; only the two latest are kept.
+		values := []acmeValue{{txt: req.TXT, expires: now.Add(a.Lifetime)}}
+		if n := len(old); n > 0 && old[n-1].txt != req.TXT {
+			values = append([]acmeValue{old[n-1]}, values...)
+		}
+		a.values[acct.FullDomain] = values
+	} else {
+		delete(a.values, acct.FullDomain)
+	}
+	err := a.set(a.Zones(), acct.FullDomain)
+	if err != nil {
+		if len(old) > 0 {
+			a.values[acct.FullDomain] = old
+		} else {
+			delete(a.values, acct.FullDomain)
+		}
+	}
+	current := a.values[acct.FullDomain]
+	a.mu.Unlock()
+	if err != nil {
+		acmeUpdates.With("failed").Inc()
+		logACME.Warn("update failed", "user", acct.Username, "name", fqdn(acct.FullDomain), "err", err)
+		acmeError(w, http.StatusBadRequest, "bad_subdomain")
+		return
+	}
+	acmeUpdates.With("ok").Inc()
+	if auditLog != nil {
+		action := "acme-update"
+		if r.Method == http.MethodDelete {
+			action = "acme-remove"
+		}
+		auditLog.Record(auditRecord{Actor: acct.Username, Action: action, Name: fqdn(acct.FullDomain), Type: "TXT",
+			Old: challengeTexts(old), New: challengeTexts(current)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"txt": req.TXT})
+}
+
+// authenticate returns the account the request's X-Api-User and X-Api-Key
+// belong to, if the request comes from where the account allows.
+func (a *ACME) authenticate(r *http.Request) *acmeAccount {
+	a.mu.Lock()
+	acct := a.accounts[r.Header.Get("X-Api-User")]
+	a.mu.Unlock()
+	if acct == nil {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(r.Header.Get("X-Api-Key")))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(acct.PasswordHash)) != 1 {
+		return nil
+	}
+	if len(acct.AllowFrom) == 0 {
+		return acct
+	}
+	prefixes, _ := parseAllowFrom(acct.AllowFrom)
+	ip, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return nil
+	}
+	for _, p := range prefixes {
+		if p.Contains(ip.Unmap()) {
+			return acct
+		}
+	}
+	return nil
+}
+
+// set puts the current values for name into the zone serving it. The
+// caller holds a.mu.
+func (a *ACME) set(zones *ZoneSet, name string) error {
+	z := zones.Find(name)
+	if z == nil {
+		return fmt.Errorf("%s is not in a served zone", fqdn(name))
+	}
+	var rrset []*ResourceRecord
+	for _, v := range a.values[name] {
+		rrset = append(rrset, &ResourceRecord{Name: name, Type: TypeTXT, Class: ClassINET, TTL: a.TTL,
+			RData: append([]byte{byte(len(v.txt))}, v.txt...)})
+	}
+	a.changed[z.Origin] = true
+	return z.SetRRset(name, TypeTXT, rrset)
+}
+
+// Apply puts the challenge values into zones, which a reload is about to
+// serve in place of prev. The zones challenges were set in keep serials
+// above the ones served so far, so secondaries see the change.
+func (a *ACME) Apply(prev, zones *ZoneSet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name := range a.values {
+		if err := a.set(zones, name); err != nil {
+			logACME.Warn("restoring a challenge failed", "name", fqdn(name), "err", err)
+		}
+	}
+	for origin := range a.changed {
+		old, z := prev.Find(origin), zones.Find(origin)
+		if old != nil && z != nil && old.Origin == origin && z.Origin == origin {
+			z.RaiseSerial(old.Serial())
+		}
+	}
+}
+
+// RunCleanup removes values whose lifetime has passed.
+func (a *ACME) RunCleanup(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		a.mu.Lock()
+		for name, values := range a.values {
+			kept := values[:0]
+			for _, v := range values {
+				if now.Before(v.expires) {
+					kept = append(kept, v)
+				}
+			}
+			if len(kept) == len(values) {
+				continue
+			}
+			if len(kept) == 0 {
+				delete(a.values, name)
+			} else {
+				a.values[name] = kept
+			}
+			if err := a.set(a.Zones(), name); err != nil {
+				logACME.Warn("removing an expired challenge failed", "name", fqdn(name), "err", err)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+func challengeTexts(values []acmeValue) []string {
+	var out []string
+	for _, v := range values {
+		out = append(out, v.txt)
+	}
+	return out
+}
+
+// validChallenge reports whether s looks like a DNS-01 key authorization
+// digest: unpadded base64url of a SHA-256 hash.
+func validChallenge(s string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+func parseAllowFrom(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randomUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return strings.Join([]string{h[:8], h[8:12], h[12:16], h[16:20], h[20:]}, "-")
+}
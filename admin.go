@@ -0,0 +1,181 @@
+package dnsserver
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// listenAdmin binds the admin address, which serves pprof profiles, expvar
+// variables, query statistics and zone transactions, and sets the
+// resolver. Profiles expose memory contents and the rest changes what is
+// served, so only loopback addresses are accepted, and -admin-token can
+// require a token for all of it.
+func listenAdmin(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin address %s is not a loopback address", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serveAdmin(ln net.Listener, stats *Stats, firewall *Firewall, token string) {
+	logServer.Error("serving admin endpoint failed", "addr", ln.Addr().String(), "err", http.Serve(ln, adminHandler(stats, firewall, token)))
+}
+
+// adminHandler serves the admin endpoints. Everything it serves needs the
+// token: profiles expose memory, the command line in cmdline and expvar
+// can hold secrets, statistics name clients, and the rest changes what is
+// served. Only the routes on public are exempt.
+func adminHandler(stats *Stats, firewall *Firewall, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/stats", stats)
+	mux.HandleFunc("/schedules", serveSchedules(firewall))
+	transactions.register(mux)
+	mux.HandleFunc("PUT /resolver", setResolver)
+	mux.HandleFunc("POST /resolver/remove", setResolver)
+
+	public := http.NewServeMux()
+	public.HandleFunc("GET /resolver", serveResolver)
+
+	guarded := guardAdmin(token, mux.ServeHTTP)
+	return loopbackHosts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := public.Handler(r); pattern != "" {
+			public.ServeHTTP(w, r)
+			return
+		}
+		guarded(w, r)
+	}))
+}
+
+// A loopback listener still takes requests a browser is made to send. A
+// name an attacker rebinds to 127.0.0.1 reaches it under the attacker's
+// host name, and any page can post to it across origins.
+
+// loopbackHosts refuses requests addressed to a host other than localhost
+// or a loopback address, as rebound names are.
+func loopbackHosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			http.Error(w, fmt.Sprintf("host %q isn't a loopback address", r.Host), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readAdminToken reads the admin token from the file at path, which keeps
+// it out of the process's arguments.
+func readAdminToken(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s: no admin token", path)
+	}
+	return token, nil
+}
+
+// guardAdmin admits requests to h only from the admin host's own origin and, with -admin-token set, only with
+// the token as their bearer token.
+func guardAdmin(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Browsers send the Origin of cross-origin requests; other clients
+		// rarely send one at all.
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				http.Error(w, fmt.Sprintf("cross-origin request from %s", origin), http.StatusForbidden)
+				return
+			}
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// serveResolver reports the resolver queries are forwarded to, if any.
+func serveResolver(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg == nil || cfg.resolver == nil {
+		writeJSON(w, map[string]any{"resolver": nil})
+		return
+	}
+	transport := "udp"
+	if cfg.resolverTCP > 0 {
+		transport = "tcp"
+	}
+	writeJSON(w, map[string]any{"resolver": cfg.resolver.String(), "transport": transport})
+}
+
+// setResolver sets the resolver to the address in the body of a PUT, as
+// -resolver takes it, or with POST /resolver/remove stops forwarding. The change lasts
+// until the next reload, which sets -resolver again.
+func setResolver(w http.ResponseWriter, r *http.Request) {
+	var spec string
+	if r.Method == http.MethodPut {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if spec = strings.TrimSpace(string(body)); spec == "" {
+			http.Error(w, "no resolver given", http.StatusBadRequest)
+			return
+		}
+	}
+	cfg := currentConfig()
+	if cfg == nil {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	next := *cfg
+	next.resolver, next.resolverTCP = nil, 0
+	if spec != "" {
+		addr, params, _ := strings.Cut(spec, "?")
+		resolver, err := resolveUpstream(addr, cfg.settings["resolver-family"])
+		if err == nil {
+			next.resolverTCP, err = parseResolverOptions(params)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid resolver %q: %v", spec, err), http.StatusBadRequest)
+			return
+		}
+		next.resolver = resolver
+	}
+	next.settings = maps.Clone(cfg.settings)
+	next.settings["resolver"] = spec
+	if !liveConfig.CompareAndSwap(cfg, &next) {
+		http.Error(w, "the configuration changed concurrently", http.StatusConflict)
+		return
+	}
+	auditLog.Record(auditRecord{Actor: clientIP(r), Action: "resolver", Old: []string{cfg.settings["resolver"]}, New: []string{spec}})
+	logServer.Info("resolver changed", "old", cfg.settings["resolver"], "new", spec)
+	serveResolver(w, r)
+}
@@ -0,0 +1,50 @@
+package dnsserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	h := adminHandler(NewStats(), nil, "secret")
+	for _, tc := range []struct {
+		method, path string
+		public       bool
+	}{
+		{"GET", "/debug/pprof/", false},
+		{"GET", "/debug/pprof/cmdline", false},
+		{"GET", "/debug/pprof/profile", false},
+		{"GET", "/debug/pprof/symbol", false},
+		{"GET", "/debug/pprof/trace", false},
+		{"GET", "/debug/pprof/heap", false},
+		{"GET", "/debug/vars", false},
+		{"GET", "/stats", false},
+		{"GET", "/schedules", false},
+		{"POST", "/zones/example.com/transactions", false},
+		{"POST", "/transactions/1/add", false},
+		{"POST", "/transactions/1/delete", false},
+		{"POST", "/transactions/1/commit", false},
+		{"POST", "/transactions/1/abandon", false},
+		{"PUT", "/resolver", false},
+		{"POST", "/resolver/remove", false},
+		{"GET", "/resolver", true},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		r.Host = "127.0.0.1:6060"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if unauthorized := w.Code == http.StatusUnauthorized; unauthorized == tc.public {
+			t.Errorf("%s %s without the token: %d", tc.method, tc.path, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/stats", nil)
+	r.Host = "127.0.0.1:6060"
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /stats with the token: %d", w.Code)
+	}
+}
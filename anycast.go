@@ -0,0 +1,195 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An instance in an anycast pool should only draw traffic while it can
+// answer it. -anycast-hook tells the routing daemon announcing the
+// service prefix when to announce and withdraw it:
+//
+//	-anycast-prefix 192.0.2.53/32 -anycast-prefix 2001:db8::53/128 \
+//	    -anycast-hook /etc/dns/bgp-hook
+//	-anycast-prefix 192.0.2.53/32 -anycast-hook http://127.0.0.1:5000/route
+//
+// A command is run with the action, announce or withdraw, followed by the
+// prefixes, and should exit 0 once the daemon took the change; a script
+// for bird might reconfigure a static route with birdc, one for exabgp
+// might write "announce route 192.0.2.53/32 next-hop self" to its API
+// pipe. A URL is sent a JSON POST with the action, the prefixes, the host
+// and the reasons the server isn't ready, if any.
+//
+// The prefixes are announced once the server has been ready, as /readyz
+// says, for -anycast-hold, and withdrawn as soon as it isn't. They are
+// withdrawn at startup, in case a previous run left them announced, and
+// when the server shuts down or drains, -anycast-withdraw-wait before the
+// listeners stop, so routes can move away while queries are still
+// answered. A failed hook is retried until it succeeds. -seccomp forbids
+// running commands, so with it the hook must be a URL.
+
+const (
+	anycastHookTimeout = 10 * time.Second
+	anycastCheckEvery  = time.Second
+)
+
+var (
+	anycastAnnounced    = NewGauge("dns_anycast_announced", "Whether the anycast prefixes are announced.")
+	anycastHookFailures = NewCounterVec("dns_anycast_hook_failures_total", "Anycast hook runs that failed, by action.", "action")
+)
+
+type Anycast struct {
+	Prefixes []netip.Prefix
+	// Hook is a command or an http(s) URL.
+	Hook string
+	// Hold is how long the server must be ready before the prefixes are
+	// announced.
+	Hold time.Duration
+	// Wait is how long to keep answering after withdrawing the prefixes
+	// for the shutdown.
+	Wait   time.Duration
+	Health *Health
+
+	mu        sync.Mutex
+	announced bool
+	// known is false until the hook has run once.
+	known bool
+	// stopped is set once the prefixes are withdrawn for the shutdown.
+	stopped bool
+}
+
+// ParseAnycastPrefixes parses the -anycast-prefix values.
+func ParseAnycastPrefixes(specs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, spec := range specs {
+		p, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -anycast-prefix %q: %v", spec, err)
+		}
+		if p != p.Masked() {
+			return nil, fmt.Errorf("invalid -anycast-prefix %q: host bits set, did you mean %s", spec, p.Masked())
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// Run withdraws the prefixes, then announces and withdraws them as the
+// server's readiness changes.
+func (a *Anycast) Run() {
+	a.set(false, []string{"starting"})
+	var readySince time.Time
+	for {
+		problems := a.Health.problems()
+		now := time.Now()
+		switch {
+		case len(problems) > 0:
+			readySince = time.Time{}
+			a.set(false, problems)
+		case readySince.IsZero():
+			readySince = now
+			fallthrough
+		default:
+			if now.Sub(readySince) >= a.Hold {
+				a.set(true, nil)
+			}
+		}
+		time.Sleep(anycastCheckEvery)
+	}
+}
+
+// Withdraw withdraws the prefixes for the shutdown, for good, and waits
+// for the routes to move away if they were announced.
+func (a *Anycast) Withdraw() {
+	a.mu.Lock()
+	a.stopped = true
+	announced := a.announced
+	a.mu.Unlock()
+	a.set(false, []string{"shutting down"})
+	if announced && a.Wait > 0 {
+		logAnycast.Info("waiting for routes to move away", "wait", a.Wait)
+		time.Sleep(a.Wait)
+	}
+}
+
+// set runs the hook if the prefixes aren't announced or withdrawn as
+// announce says yet.
+func (a *Anycast) set(announce bool, reasons []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.known && a.announced == announce || announce && a.stopped {
+		return
+	}
+	action := "withdraw"
+	if announce {
+		action = "announce"
+	}
+	if err := a.run(action, reasons); err != nil {
+		anycastHookFailures.With(action).Inc()
+		logAnycast.Warn("anycast hook failed", "action", action, "err", err)
+		return
+	}
+	a.known, a.announced = true, announce
+	if announce {
+		anycastAnnounced.Set(1)
+		logAnycast.Info("announced anycast prefixes", "prefixes", strings.Join(a.prefixStrings(), ","))
+	} else {
+		anycastAnnounced.Set(0)
+		logAnycast.Info("withdrew anycast prefixes", "prefixes", strings.Join(a.prefixStrings(), ","), "reasons", strings.Join(reasons, "; "))
+	}
+}
+
+func (a *Anycast) prefixStrings() []string {
+	var s []string
+	for _, p := range a.Prefixes {
+		s = append(s, p.String())
+	}
+	return s
+}
+
+// hookIsURL reports whether an -anycast-hook is a URL rather than a
+// command.
+func hookIsURL(hook string) bool {
+	return strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://")
+}
+
+func (a *Anycast) run(action string, reasons []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), anycastHookTimeout)
+	defer cancel()
+	if hookIsURL(a.Hook) {
+		host, _ := os.Hostname()
+		body, _ := json.Marshal(map[string]any{"action": action, "prefixes": a.prefixStrings(), "host": host, "reasons": reasons})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.Hook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s answered %s", a.Hook, resp.Status)
+		}
+		return nil
+	}
+	args := append([]string{action}, a.prefixStrings()...)
+	out, err := exec.CommandContext(ctx, a.Hook, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s %s: %v: %s", a.Hook, strings.Join(args, " "), err, msg)
+		}
+		return fmt.Errorf("%s %s: %v", a.Hook, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package dnsserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// auditLog records every change to the configuration or the served zones,
+// who made it and the old and new values, one JSON object per line. It is
+// nil when -audit-log isn't set.
+var auditLog *AuditLog
+
+// AuditLog is an append-only file of audit records. With a key, every
+// record ends with an HMAC-SHA256 over the previous record's MAC and its
+// own contents, so editing, removing or reordering records breaks the
+// chain, which the verify-audit subcommand checks.
+type AuditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  []byte
+	seq  uint64
+	prev string
+}
+
+type auditRecord struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Zone   string    `json:"zone,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	Type   string    `json:"type,omitempty"`
+	Old    []string  `json:"old,omitempty"`
+	New    []string  `json:"new,omitempty"`
+}
+
+// openAuditLog opens path for appending, continuing the sequence numbers
+// and MAC chain of the records already in it.
+func openAuditLog(path string, key []byte) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &AuditLog{f: f, key: key}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	var last []byte
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last != nil {
+		body, mac := splitAuditMAC(last)
+		var rec auditRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: last record is damaged: %v", path, err)
+		}
+		l.seq, l.prev = rec.Seq, mac
+	}
+	return l, nil
+}
+
+// Record appends rec, filling in its sequence number and time.
+func (l *AuditLog) Record(rec auditRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec.Seq = l.seq + 1
+	rec.Time = time.Now().UTC()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logAudit.Error("encoding audit record failed", "err", err)
+		return
+	}
+	if l.key != nil {
+		mac := auditMAC(l.key, l.prev, line)
+		line = fmt.Appendf(line[:len(line)-1], `,"mac":%q}`, mac)
+		l.prev = mac
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		logAudit.Error("writing audit record failed", "action", rec.Action, "err", err)
+		return
+	}
+	if err := l.f.Sync(); err != nil {
+		logAudit.Error("syncing audit log failed", "err", err)
+	}
+	l.seq = rec.Seq
+}
+
+func auditMAC(key []byte, prev string, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(prev))
+	h.Write([]byte{'\n'})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitAuditMAC separates the MAC from a signed record, returning the
+// record as it was before the MAC was added.
+func splitAuditMAC(line []byte) (body []byte, mac string) {
+	const suffix = len(`,"mac":"`) + 64 + len(`"}`)
+	if len(line) < suffix || !bytes.HasPrefix(line[len(line)-suffix:], []byte(`,"mac":"`)) {
+		return line, ""
+	}
+	mac = string(line[len(line)-suffix+len(`,"mac":"`) : len(line)-2])
+	body = append(line[:len(line)-suffix:len(line)-suffix], '}')
+	return body, mac
+}
+
+func readAuditKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("%s: key must be at least 16 bytes", path)
+	}
+	return key, nil
+}
+
+// auditSettings records the settings a reload changed.
+func auditSettings(actor string, old, new map[string]string) {
+	names := make([]string, 0, len(new))
+	for name := range new {
+		if old[name] != new[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		auditLog.Record(auditRecord{Actor: actor, Action: "setting", Name: name,
+			Old: nonEmpty(old[name]), New: nonEmpty(new[name])})
+	}
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// auditZones records the zones a reload added or removed and the RRsets
+// it changed in the others.
+func auditZones(actor string, old, new *ZoneSet) {
+	before := map[string]*Zone{}
+	for _, z := range old.Zones() {
+		before[z.Origin] = z
+	}
+	for _, z := range new.Zones() {
+		prev := before[z.Origin]
+		delete(before, z.Origin)
+		if prev == nil {
+			auditLog.Record(auditRecord{Actor: actor, Action: "zone-add", Zone: fqdn(z.Origin),
+				New: []string{fmt.Sprintf("serial %d", z.Serial())}})
+			continue
+		}
+		auditRRsets(actor, z.Origin, prev.rrsetTexts(), z.rrsetTexts())
+	}
+	for _, z := range before {
+		auditLog.Record(auditRecord{Actor: actor, Action: "zone-remove", Zone: fqdn(z.Origin),
+			Old: []string{fmt.Sprintf("serial %d", z.Serial())}})
+	}
+}
+
+// auditRRsets records the differences between two snapshots of a zone.
+func auditRRsets(actor, origin string, old, new map[string]map[uint16][]string) {
+	owners := map[string]bool{}
+	for name := range old {
+		owners[name] = true
+	}
+	for name := range new {
+		owners[name] = true
+	}
+	sorted := make([]string, 0, len(owners))
+	for name := range owners {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return canonicalLess(sorted[i], sorted[j]) })
+	for _, name := range sorted {
+		types := map[uint16]bool{}
+		for t := range old[name] {
+			types[t] = true
+		}
+		for t := range new[name] {
+			types[t] = true
+		}
+		for _, t := range slices.Sorted(maps.Keys(types)) {
+			if !slices.Equal(old[name][t], new[name][t]) {
+				auditLog.Record(auditRecord{Actor: actor, Action: "rrset", Zone: fqdn(origin),
+					Name: fqdn(name), Type: dnswire.TypeString(t), Old: old[name][t], New: new[name][t]})
+			}
+		}
+	}
+}
+
+// rrsetTexts returns the zone's records in presentation form by owner and
+// type, without signatures and denial records, which change on their own.
+func (z *Zone) rrsetTexts() map[string]map[uint16][]string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return rrsetTexts(z.rrsets, nil)
+}
+
+// rrsetTexts converts rrsets, or with only set, just those types.
+func rrsetTexts(rrsets map[string]map[uint16][]*ResourceRecord, only []uint16) map[string]map[uint16][]string {
+	out := map[string]map[uint16][]string{}
+	for name, sets := range rrsets {
+		for t, rrset := range sets {
+			if t == TypeRRSIG || t == TypeNSEC || t == TypeNSEC3 || (only != nil && !slices.Contains(only, t)) {
+				continue
+			}
+			texts := make([]string, len(rrset))
+			for i, rr := range rrset {
+				texts[i] = rrText(rr)
+			}
+			sort.Strings(texts)
+			if out[name] == nil {
+				out[name] = map[uint16][]string{}
+			}
+			out[name][t] = texts
+		}
+	}
+	return out
+}
+
+// rrText formats the TTL and rdata of rr, using the RFC 3597 generic form
+// for types without a more readable one.
+func rrText(rr *ResourceRecord) string {
+	rdata := rr.RData
+	var text string
+	switch rr.Type {
+	case TypeA, TypeAAAA:
+		text = net.IP(rdata).String()
+	case TypeNS, TypeCNAME, TypePTR:
+		text = fqdn(rdataName(rdata, 0))
+	case TypeMX:
+		if len(rdata) > 2 {
+			text = fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), fqdn(rdataName(rdata, 2)))
+		}
+	case TypeTXT:
+		var parts []string
+		for off := 0; off < len(rdata); off += 1 + int(rdata[off]) {
+			end := min(off+1+int(rdata[off]), len(rdata))
+			parts = append(parts, strconv.Quote(string(rdata[off+1:end])))
+		}
+		text = strings.Join(parts, " ")
+	case TypeSOA:
+		p := dnswire.NewReader(rdata, 0)
+		mname, err1 := p.ReadName()
+		rname, err2 := p.ReadName()
+		if err1 == nil && err2 == nil && len(rdata)-p.Offset() == 20 {
+			f := rdata[p.Offset():]
+			text = fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(mname), fqdn(rname),
+				binary.BigEndian.Uint32(f), binary.BigEndian.Uint32(f[4:]), binary.BigEndian.Uint32(f[8:]),
+				binary.BigEndian.Uint32(f[12:]), binary.BigEndian.Uint32(f[16:]))
+		}
+	}
+	if text == "" {
+		text = fmt.Sprintf(`\# %d %x`, len(rdata), rdata)
+	}
+	return fmt.Sprintf("%d %s", rr.TTL, text)
+}
+
+// runVerifyAudit checks the sequence numbers and MAC chain of an audit log.
+func runVerifyAudit(args []string) error {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	keyPath := fs.String("key", "", "The server's -audit-key")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server verify-audit -key file audit.log")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *keyPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	key, err := readAuditKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	var prev string
+	var seq uint64
+	n := 0
+	for scanner.Scan() {
+		n++
+		body, mac := splitAuditMAC(scanner.Bytes())
+		var rec auditRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if mac == "" {
+			return fmt.Errorf("line %d: record %d is not signed", n, rec.Seq)
+		}
+		if seq != 0 && rec.Seq != seq+1 {
+			return fmt.Errorf("line %d: record %d follows record %d", n, rec.Seq, seq)
+		}
+		if !hmac.Equal([]byte(mac), []byte(auditMAC(key, prev, body))) {
+			return fmt.Errorf("line %d: record %d does not match its MAC", n, rec.Seq)
+		}
+		prev, seq = mac, rec.Seq
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("%d records, chain intact\n", n)
+	return nil
+}
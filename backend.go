@@ -0,0 +1,32 @@
+package dnsserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Zone data comes from backends, picked by the source -zone gives:
+// origin=path reads a zone file, and origin=scheme://... hands the source
+// to the backend registered for scheme. Files adding backends to the
+// build, usually behind a build tag so they are opt in, call
+// server.RegisterZoneBackend from init; -plugin loads them from Go
+// plugins.
+
+// loadZoneSource loads the zone at origin from a zone file or a backend.
+func loadZoneSource(origin, source string) (*Zone, error) {
+	scheme, _, ok := strings.Cut(source, "://")
+	if !ok {
+		return LoadZone(origin, source)
+	}
+	b, ok := server.ZoneBackendFor(scheme)
+	if !ok {
+		return nil, fmt.Errorf("no zone backend for %s:// sources", scheme)
+	}
+	records, err := b(origin, source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return NewZone(origin, records)
+}
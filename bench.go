@@ -0,0 +1,371 @@
+package dnsserver
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// The bench subcommand generates query load against a server or an
+// upstream, like dnsperf, from a file with a name and optionally a type on
+// each line:
+//
+//	dns-server bench -target 127.0.0.1:53 -duration 30s names.txt
+//
+// It loops over the names until -duration is up or -queries have been
+// sent and reports the query rate, latency percentiles and error rates.
+//
+// With -self it benchmarks the whole server instead of a running one: it
+// starts this binary forwarding to a mock upstream built into bench, with
+// any arguments after the names file passed on, and can profile it while
+// the load runs. -min-qps and -max-p99 make it fail on a regression:
+//
+//	dns-server bench -self -cpuprofile cpu.out -max-p99 5ms names.txt -max-in-flight 256
+//
+// The message codec has benchmarks of its own, run with go test:
+//
+//	go test -run XXX -bench . ./dnswire
+
+// readBenchNames reads "name [type]" lines, skipping blank lines and
+// comments. The type defaults to A.
+func readBenchNames(path string) ([]*replayQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*replayQuery
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want a name and an optional type", path, n)
+		}
+		qtype := TypeA
+		if len(fields) == 2 {
+			t, ok := dnswire.ParseType(fields[1])
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown type %q", path, n, fields[1])
+			}
+			qtype = t
+		}
+		out = append(out, &replayQuery{name: normalizeName(fields[0]), qtype: qtype})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no names", path)
+	}
+	return out, nil
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:53", "Server to send the queries to")
+	rate := fs.Float64("rate", 0, "Queries per second (0 sends as fast as -concurrency allows)")
+	concurrency := fs.Int("concurrency", 20, "Queries in flight at once")
+	duration := fs.Duration("duration", 10*time.Second, "How long to send queries for")
+	count := fs.Int("queries", 0, "Stop after sending this many queries (0 runs for -duration)")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for each response")
+	self := fs.Bool("self", false, "Start this binary as the server, forwarding to a mock upstream, and send the queries to it; arguments after the names file are passed to the server")
+	upstreamDelay := fs.Duration("upstream-delay", 0, "With -self, how long the mock upstream waits before answering")
+	cpuProfile := fs.String("cpuprofile", "", "With -self, write a CPU profile of the server under load to this file")
+	minQPS := fs.Float64("min-qps", 0, "Fail if fewer queries per second are answered")
+	maxP99 := fs.Duration("max-p99", 0, "Fail if the 99th percentile latency is higher")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server bench [flags] names-file")
+		fmt.Fprintln(fs.Output(), "       dns-server bench -self [flags] names-file [server flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || (fs.NArg() > 1 && !*self) || (*cpuProfile != "" && !*self) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	queries, err := readBenchNames(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var server *benchServer
+	if *self {
+		if server, err = startBenchServer(fs.Args()[1:], *upstreamDelay); err != nil {
+			return err
+		}
+		defer server.stop()
+		*target = server.addr
+	}
+	addr, err := net.ResolveUDPAddr("udp", *target)
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan *replayQuery)
+	results := make(chan *replayResult)
+	var wg sync.WaitGroup
+	for range max(*concurrency, 1) {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for q := range jobs {
+				results <- replayOne(conn, q, *timeout)
+			}
+		}()
+	}
+	start := time.Now()
+	deadline := start.Add(*duration)
+	profiled := make(chan error, 1)
+	if *cpuProfile != "" {
+		go func() { profiled <- server.profile(*cpuProfile, *duration) }()
+	} else {
+		profiled <- nil
+	}
+	go func() {
+		for i := 0; (*count <= 0 || i < *count) && time.Now().Before(deadline); i++ {
+			if *rate > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(i) / *rate * float64(time.Second)))))
+			}
+			jobs <- queries[i%len(queries)]
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var sent, timeouts, failed int
+	rcodes := map[string]int{}
+	var latencies []time.Duration
+	for r := range results {
+		sent++
+		if r.err != nil {
+			if err, ok := r.err.(net.Error); ok && err.Timeout() {
+				timeouts++
+			} else {
+				failed++
+			}
+			continue
+		}
+		rcodes[r.rcode]++
+		latencies = append(latencies, r.took)
+	}
+	elapsed := time.Since(start)
+
+	percent := func(n int) float64 { return 100 * float64(n) / float64(max(sent, 1)) }
+	fmt.Printf("sent=%d\n", sent)
+	fmt.Printf("answered=%d\n", len(latencies))
+	fmt.Printf("timeouts=%d (%.2f%%)\n", timeouts, percent(timeouts))
+	fmt.Printf("errors=%d (%.2f%%)\n", failed, percent(failed))
+	names := make([]string, 0, len(rcodes))
+	for rcode := range rcodes {
+		names = append(names, rcode)
+	}
+	sort.Strings(names)
+	for _, rcode := range names {
+		fmt.Printf("rcode.%s=%d (%.2f%%)\n", rcode, rcodes[rcode], percent(rcodes[rcode]))
+	}
+	fmt.Printf("elapsed=%s\n", elapsed.Round(time.Millisecond))
+	qps := float64(len(latencies)) / elapsed.Seconds()
+	fmt.Printf("qps=%.1f\n", qps)
+	percentile := func(p float64) time.Duration { return latencies[int(float64(len(latencies)-1)*p/100)] }
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		for _, p := range []float64{50, 90, 99, 99.9} {
+			fmt.Printf("latency.p%g=%s\n", p, percentile(p))
+		}
+		fmt.Printf("latency.max=%s\n", latencies[len(latencies)-1])
+	}
+	if err := <-profiled; err != nil {
+		return fmt.Errorf("profiling server: %v", err)
+	}
+
+	switch {
+	case *minQPS > 0 && qps < *minQPS:
+		return fmt.Errorf("answered %.1f queries per second, below -min-qps %.1f", qps, *minQPS)
+	case *maxP99 > 0 && len(latencies) == 0:
+		return fmt.Errorf("no queries answered")
+	case *maxP99 > 0 && percentile(99) > *maxP99:
+		return fmt.Errorf("p99 latency %s above -max-p99 %s", percentile(99), *maxP99)
+	}
+	return nil
+}
+
+// benchServer is a server started by bench -self, with the mock upstream
+// it forwards to.
+type benchServer struct {
+	addr     string
+	admin    string
+	cmd      *exec.Cmd
+	upstream *net.UDPConn
+	// output holds what the server logged, shown if it fails.
+	output bytes.Buffer
+}
+
+// startBenchServer runs this binary as a server on a free loopback port,
+// forwarding to a mock upstream, and waits until it answers.
+func startBenchServer(args []string, upstreamDelay time.Duration) (*benchServer, error) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	go serveMockUpstream(upstream, upstreamDelay)
+
+	s := &benchServer{upstream: upstream}
+	if s.admin, err = freeLoopbackAddr("tcp"); err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	args = append([]string{"-resolver", upstream.LocalAddr().String(), "-admin-addr", s.admin}, args...)
+	if err := s.start(args); err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// start runs this binary with args, listening on a free loopback port,
+// and waits until it answers.
+func (s *benchServer) start(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if s.addr, err = freeLoopbackAddr("udp"); err != nil {
+		return err
+	}
+	s.cmd = exec.Command(exe, append([]string{"-listen", s.addr}, args...)...)
+	s.cmd.Stdout, s.cmd.Stderr = &s.output, &s.output
+	if err := s.cmd.Start(); err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		s.stop()
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		s.stop()
+		return err
+	}
+	defer conn.Close()
+	probe := &replayQuery{name: "bench.invalid", qtype: TypeA}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if replayOne(conn, probe, 100*time.Millisecond).err == nil {
+			return nil
+		}
+		if s.cmd.ProcessState != nil {
+			break
+		}
+	}
+	s.stop()
+	return fmt.Errorf("server did not start answering:\n%s", s.output.String())
+}
+
+// freeLoopbackAddr returns a loopback address with a port the kernel
+// picked as free.
+func freeLoopbackAddr(network string) (string, error) {
+	if network == "udp" {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String(), nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// profile writes a CPU profile of the server covering d to path.
+func (s *benchServer) profile(path string, d time.Duration) error {
+	seconds := max(int(d.Round(time.Second)/time.Second), 1)
+	resp, err := http.Get(fmt.Sprintf("http://%s/debug/pprof/profile?seconds=%d", s.admin, seconds))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *benchServer) stop() {
+	if err := s.cmd.Process.Signal(os.Interrupt); err != nil {
+		s.cmd.Process.Kill()
+	}
+	s.cmd.Wait()
+	if s.upstream != nil {
+		s.upstream.Close()
+	}
+}
+
+// serveMockUpstream answers every query on conn after delay: A queries
+// with 192.0.2.1, anything else with no records.
+func serveMockUpstream(conn *net.UDPConn, delay time.Duration) {
+	buf := make([]byte, 65535)
+	for {
+		n, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m, err := dnswire.ParseLazy(buf[:n])
+		if err != nil || m.Header.QR || m.Header.QDCount != 1 {
+			continue
+		}
+		q, err := m.Question(0)
+		if err != nil {
+			continue
+		}
+		resp := new(Query).SetReply(&Message{Header: m.Header, Questions: []*Question{q}})
+		resp.Header.RA = true
+		if q.QType == TypeA {
+			resp.AddAnswer(&ResourceRecord{Name: q.Name, Type: TypeA, Class: ClassINET, TTL: 60, RData: []byte{192, 0, 2, 1}})
+		}
+		reply, err := resp.Encode()
+		if err != nil {
+			continue
+		}
+		if delay == 0 {
+			conn.WriteToUDP(reply, source)
+			continue
+		}
+		time.AfterFunc(delay, func() { conn.WriteToUDP(reply, source) })
+	}
+}
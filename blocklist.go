@@ -0,0 +1,327 @@
+package dnsserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+var blockedQueries = NewCounterVec("dns_blocked_queries_total", "Queries answered from a blocklist.", "list", "group")
+
+// Names that hosts files map to loopback addresses for the local machine
+// rather than to block anything.
+var hostsLocalNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true,
+	"broadcasthost": true, "ip6-localhost": true, "ip6-loopback": true,
+	"ip6-localnet": true, "ip6-mcastprefix": true, "ip6-allnodes": true,
+	"ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// Blocklist is a set of domains loaded from a file or URL. A domain blocks
+// itself and every name below it.
+type Blocklist struct {
+	Name   string
+	Source string
+	// Schedule, if set, limits when the list applies.
+	Schedule *Schedule
+
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+func (b *Blocklist) Load() error {
+	var r io.ReadCloser
+	if strings.HasPrefix(b.Source, "http://") || strings.HasPrefix(b.Source, "https://") {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(b.Source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("fetching %s: %s", b.Source, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(b.Source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	domains, err := parseBlocklist(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", b.Source, err)
+	}
+	b.mu.Lock()
+	b.domains = domains
+	b.mu.Unlock()
+	return nil
+}
+
+// parseBlocklist reads hosts files ("0.0.0.0 ads.example.com"), plain
+// domain lists and the "||domain^" subset of adblock syntax.
+func parseBlocklist(r io.Reader) (map[string]bool, error) {
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#!"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else {
+			fields = fields[:1]
+		}
+		for _, f := range fields {
+			f = strings.TrimSuffix(strings.TrimPrefix(f, "||"), "^")
+			name := normalizeName(f)
+			if name == "" || hostsLocalNames[name] || strings.ContainsAny(name, "/*$|") {
+				continue
+			}
+			// name is cut from the line, which it would otherwise keep
+			// alive.
+			domains[strings.Clone(name)] = true
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// Set adds name to the list, or removes it if blocked is false.
+func (b *Blocklist) Set(name string, blocked bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.domains == nil {
+		b.domains = map[string]bool{}
+	}
+	if blocked {
+		b.domains[normalizeName(name)] = true
+	} else {
+		delete(b.domains, normalizeName(name))
+	}
+}
+
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.domains)
+}
+
+func (b *Blocklist) Contains(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for {
+		if b.domains[name] {
+			return true
+		}
+		if name == "" {
+			return false
+		}
+		name = parentName(name)
+	}
+}
+
+// Domains blocked and unblocked at runtime through the control socket.
+// They apply to every client, take precedence over the configured lists
+// and survive reloads, but not restarts.
+var (
+	manualBlocks = &Blocklist{Name: "manual"}
+	manualAllows = &Blocklist{Name: "manual-allow"}
+)
+
+// BlockDomain blocks name for every client, or with blocked false,
+// unblocks it even if a configured list contains it.
+func BlockDomain(name string, blocked bool) {
+	manualBlocks.Set(name, blocked)
+	manualAllows.Set(name, !blocked)
+}
+
+type BlockMode string
+
+const (
+	BlockNXDomain BlockMode = "nxdomain"
+	BlockNull     BlockMode = "null"
+	BlockSinkhole BlockMode = "sinkhole"
+)
+
+type clientGroup struct {
+	network *net.IPNet
+	group   string
+}
+
+// Blocker answers queries for blocked names. Clients are assigned to groups
+// by source network or by the group of their TLS client certificate; each
+// group uses its own selection of lists, and clients without a group use the
+// "default" group, or every list if there is none.
+type Blocker struct {
+	Mode       BlockMode
+	SinkholeV4 net.IP
+	SinkholeV6 net.IP
+	TTL        uint32
+
+	lists     []*Blocklist
+	allow     []*Blocklist
+	groups    map[string][]*Blocklist
+	clients   []clientGroup
+	listNames map[string]*Blocklist
+}
+
+func NewBlocker(mode BlockMode) *Blocker {
+	return &Blocker{
+		Mode:      mode,
+		TTL:       60,
+		groups:    map[string][]*Blocklist{},
+		listNames: map[string]*Blocklist{},
+	}
+}
+
+func (b *Blocker) AddList(name, source string) error {
+	if _, ok := b.listNames[name]; ok {
+		return fmt.Errorf("duplicate blocklist %q", name)
+	}
+	l := &Blocklist{Name: name, Source: source}
+	b.lists = append(b.lists, l)
+	b.listNames[name] = l
+	return nil
+}
+
+// AddAllowlist adds a list of domains that are never blocked.
+func (b *Blocker) AddAllowlist(source string) {
+	b.allow = append(b.allow, &Blocklist{Name: "allowlist", Source: source})
+}
+
+func (b *Blocker) AddGroup(name string, lists []string) error {
+	if _, ok := b.groups[name]; !ok {
+		// A group may block nothing.
+		b.groups[name] = nil
+	}
+	for _, ln := range lists {
+		l, ok := b.listNames[ln]
+		if !ok {
+			return fmt.Errorf("group %s: unknown blocklist %q", name, ln)
+		}
+		b.groups[name] = append(b.groups[name], l)
+	}
+	return nil
+}
+
+func (b *Blocker) AssignClients(network, group string) error {
+	if _, ok := b.groups[group]; !ok {
+		return fmt.Errorf("unknown block group %q", group)
+	}
+	nets, err := server.ParseNetworks(network)
+	if err != nil {
+		return err
+	}
+	for _, n := range nets {
+		b.clients = append(b.clients, clientGroup{network: n, group: group})
+	}
+	return nil
+}
+
+// Load fetches every list, keeping the previous contents of any that fail.
+func (b *Blocker) Load() {
+	for _, l := range append(append([]*Blocklist(nil), b.lists...), b.allow...) {
+		if err := l.Load(); err != nil {
+			logBlocklist.Error("loading blocklist failed", "list", l.Name, "source", l.Source, "err", err)
+			webhooks.Fire(eventBlocklistFailed, l.Name, fmt.Sprintf("loading blocklist %s failed: %v", l.Name, err),
+				"source", l.Source, "error", err.Error())
+			continue
+		}
+		logBlocklist.Info("blocklist loaded", "list", l.Name, "source", l.Source, "domains", l.Len())
+	}
+}
+
+func (b *Blocker) groupFor(client net.IP, certGroup string) (string, []*Blocklist) {
+	if lists, ok := b.groups[certGroup]; ok {
+		return certGroup, lists
+	}
+	for _, c := range b.clients {
+		if c.network.Contains(client) {
+			return c.group, b.groups[c.group]
+		}
+	}
+	if lists, ok := b.groups["default"]; ok {
+		return "default", lists
+	}
+	return "default", b.lists
+}
+
+// Check returns the list blocking name for client, if any. certGroup is the
+// group of an authenticated client certificate, or empty.
+func (b *Blocker) Check(client net.IP, certGroup, name string) (*Blocklist, string) {
+	name = normalizeName(name)
+	now := time.Now()
+	group, lists := b.groupFor(client, certGroup)
+	if manualAllows.Contains(name) {
+		return nil, ""
+	}
+	if manualBlocks.Contains(name) {
+		return manualBlocks, group
+	}
+	for _, l := range b.allow {
+		if l.Schedule.Active(now) && l.Contains(name) {
+			return nil, ""
+		}
+	}
+	for _, l := range lists {
+		if l.Schedule.Active(now) && l.Contains(name) {
+			return l, group
+		}
+	}
+	return nil, ""
+}
+
+// Answer returns the blocked response for m, or false if its question is
+// not blocked for client.
+func (b *Blocker) Answer(client net.IP, certGroup string, m *Message) (*Query, bool) {
+	if m.Header.Opcode != 0 || len(m.Questions) != 1 {
+		return nil, false
+	}
+	q := m.Questions[0]
+	list, group := b.Check(client, certGroup, q.Name)
+	if list == nil {
+		return nil, false
+	}
+	blockedQueries.With(list.Name, group).Inc()
+
+	resp := new(Query).SetReply(m)
+	resp.Header.RA = true
+	if b.Mode == BlockNXDomain {
+		resp.Header.RCode = RCodeNameError
+		return resp, true
+	}
+
+	var addr net.IP
+	switch q.QType {
+	case TypeA:
+		addr = net.IPv4zero.To4()
+		if b.Mode == BlockSinkhole && b.SinkholeV4 != nil {
+			addr = b.SinkholeV4.To4()
+		}
+	case TypeAAAA:
+		addr = net.IPv6zero
+		if b.Mode == BlockSinkhole && b.SinkholeV6 != nil {
+			addr = b.SinkholeV6.To16()
+		}
+	}
+	if addr != nil {
+		resp.AddAnswer(&ResourceRecord{Name: q.Name, Type: q.QType, Class: ClassINET, TTL: b.TTL, RData: addr})
+	}
+	return resp, true
+}
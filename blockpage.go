@@ -0,0 +1,176 @@
+package dnsserver
+
+import (
+	"cmp"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+var blockPageRequests = NewCounterVec("dns_block_page_requests_total", "Requests for blocked names answered with the block page.", "list")
+
+// The default block page; -block-page-template replaces it.
+const defaultBlockPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Blocked: {{.Host}}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto">
+<h1>{{.Host}} is blocked</h1>
+<p>This site was blocked by the network's DNS policy{{if .List}}, through the list <b>{{.List}}</b>{{end}}.</p>
+<p>If you think this is a mistake, contact the network administrator and mention the time, {{.Time.Format "2006-01-02 15:04:05 MST"}}.</p>
+</body></html>
+`
+
+// BlockPage answers the web requests that blocked names sinkholed to the
+// server's address make, with a page saying why the site is blocked
+// rather than leaving the browser to time out. Over HTTPS it presents a
+// certificate for the requested name signed by CA, which browsers only
+// accept if the CA is installed on them; without a CA, HTTPS isn't served.
+type BlockPage struct {
+	Template *template.Template
+	CA       *tls.Certificate
+	// Blocker and Profiles return the blocker and profiles in use, to
+	// tell which list blocked a name.
+	Blocker  func() *Blocker
+	Profiles func() *Profiles
+
+	key   *ecdsa.PrivateKey
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+type blockPageData struct {
+	Host   string
+	List   string
+	Group  string
+	Client string
+	Time   time.Time
+}
+
+// blockPageCerts bounds how many certificates are kept for reuse.
+const blockPageCerts = 1024
+
+// NewBlockPage reads the page template, if templateFile is set, and the
+// CA, if caCert is set.
+func NewBlockPage(templateFile, caCert, caKey string) (*BlockPage, error) {
+	p := &BlockPage{certs: map[string]*tls.Certificate{}}
+	var err error
+	if templateFile != "" {
+		p.Template, err = template.ParseFiles(templateFile)
+	} else {
+		p.Template, err = template.New("block page").Parse(defaultBlockPage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if caCert != "" {
+		ca, err := tls.LoadX509KeyPair(caCert, caKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading the block page CA: %v", err)
+		}
+		if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, err
+		}
+		if !ca.Leaf.IsCA {
+			return nil, fmt.Errorf("%s is not a CA certificate", caCert)
+		}
+		p.CA = &ca
+		if p.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *BlockPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeName(host)
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	data := blockPageData{Host: host, Client: client, Time: time.Now()}
+	if b := p.Blocker(); b != nil {
+		ip := net.ParseIP(client)
+		profile := p.Profiles().Match(&server.Client{IP: ip}, nil)
+		if list, group := b.Check(ip, profile.blockGroup(""), host); list != nil {
+			data.List, data.Group = list.Name, group
+		}
+	}
+	logBlocklist.Info("block page served", "host", host, "client", client, "list", data.List, "path", r.URL.Path)
+	blockPageRequests.With(cmp.Or(data.List, "unknown")).Inc()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := p.Template.Execute(w, data); err != nil {
+		logBlocklist.Warn("executing the block page template failed", "err", err)
+	}
+}
+
+// Serve answers HTTP requests on ln, and HTTPS requests if tlsLn isn't
+// nil.
+func (p *BlockPage) Serve(ln, tlsLn net.Listener) {
+	if tlsLn != nil {
+		tlsLn = tls.NewListener(tlsLn, &tls.Config{GetCertificate: p.certificate, MinVersion: tls.VersionTLS12})
+		go p.serve(tlsLn)
+	}
+	if ln != nil {
+		p.serve(ln)
+	}
+}
+
+func (p *BlockPage) serve(ln net.Listener) {
+	srv := &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second, IdleTimeout: time.Minute}
+	logBlocklist.Error("serving the block page failed", "addr", ln.Addr().String(), "err", srv.Serve(ln))
+}
+
+// certificate returns a certificate for the name the client asks for,
+// issued by the CA.
+func (p *BlockPage) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(cmp.Or(hello.ServerName, "blocked.invalid"))
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.certs[name]; ok && now.Before(c.Leaf.NotAfter.Add(-24*time.Hour)) {
+		return c, nil
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(7 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.CA.Leaf, &p.key.PublicKey, p.CA.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{Certificate: [][]byte{der, p.CA.Certificate[0]}, PrivateKey: p.key, Leaf: leaf}
+	if len(p.certs) >= blockPageCerts {
+		clear(p.certs)
+	}
+	p.certs[name] = c
+	return c, nil
+}
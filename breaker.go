@@ -0,0 +1,154 @@
+package dnsserver
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnsclient"
+)
+
+// UpstreamBreakers stop queries to an upstream that keeps failing, so
+// clients get SERVFAIL at once rather than after a timeout, and the
+// upstream isn't buried in retries while it recovers. Once Ratio of at
+// least MinQueries queries within breakerWindow failed, the upstream's
+// circuit opens for Cooldown; then a single probe query is let through,
+// and closes it again if it is answered.
+//
+// Timed out queries are retried once, but only while retries stay within
+// RetryBudget of the queries sent, so retries can't multiply the load on
+// an upstream that is already slow.
+type UpstreamBreakers struct {
+	Ratio       float64
+	MinQueries  int
+	Cooldown    time.Duration
+	RetryBudget float64
+
+	mu        sync.Mutex
+	upstreams map[string]*upstreamCircuit
+}
+
+type upstreamCircuit struct {
+	windowStart   time.Time
+	total, failed int
+	open          bool
+	openUntil     time.Time
+	probing       bool
+	retryTokens   float64
+}
+
+const (
+	breakerWindow = 10 * time.Second
+	// maxRetryTokens bounds the retries saved up while all is well.
+	maxRetryTokens = 10
+)
+
+var (
+	upstreamBreakers *UpstreamBreakers
+
+	breakerOpen    = NewGaugeVec("dns_upstream_circuit_open", "Whether queries to the upstream are stopped because too many failed.", "upstream")
+	breakerTrips   = NewCounterVec("dns_upstream_circuit_trips_total", "Times queries to the upstream were stopped because too many failed.", "upstream")
+	upstreamRetry  = NewCounterVec("dns_upstream_retries_total", "Timed out upstream queries sent again.", "upstream")
+	breakerRefused = NewCounterVec("dns_upstream_circuit_rejected_total", "Queries not sent to the upstream because its circuit was open.", "upstream")
+)
+
+// ErrUpstreamUnavailable is returned for queries not sent because the
+// upstream's circuit is open.
+var ErrUpstreamUnavailable = errors.New("upstream unavailable, too many queries to it failed")
+
+func (b *UpstreamBreakers) circuit(upstream string) *upstreamCircuit {
+	c, ok := b.upstreams[upstream]
+	if !ok {
+		if b.upstreams == nil {
+			b.upstreams = map[string]*upstreamCircuit{}
+		}
+		c = &upstreamCircuit{retryTokens: maxRetryTokens}
+		b.upstreams[upstream] = c
+	}
+	return c
+}
+
+// Allow reports whether a query may be sent to upstream; every query
+// allowed has to be followed by Record.
+func (b *UpstreamBreakers) Allow(upstream string, now time.Time) error {
+	if b == nil || b.Ratio == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(upstream)
+	if c.open && (now.Before(c.openUntil) || c.probing) {
+		breakerRefused.With(upstream).Inc()
+		return ErrUpstreamUnavailable
+	}
+	if c.open {
+		c.probing = true
+	}
+	return nil
+}
+
+// Record counts the outcome of a query sent to upstream.
+func (b *UpstreamBreakers) Record(upstream string, err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(upstream)
+	c.retryTokens = min(c.retryTokens+b.RetryBudget, maxRetryTokens)
+	if b.Ratio == 0 {
+		return
+	}
+	if c.open {
+		if !c.probing {
+			return
+		}
+		c.probing = false
+		if err != nil {
+			c.openUntil = now.Add(b.Cooldown)
+			return
+		}
+		*c = upstreamCircuit{windowStart: now, retryTokens: c.retryTokens}
+		breakerOpen.With(upstream).Set(0)
+		logUpstream.Info("upstream answers again, sending it queries", "upstream", upstream)
+		return
+	}
+	if now.Sub(c.windowStart) >= breakerWindow {
+		c.windowStart, c.total, c.failed = now, 0, 0
+	}
+	c.total++
+	if err == nil {
+		return
+	}
+	c.failed++
+	if c.total >= b.MinQueries && float64(c.failed) >= b.Ratio*float64(c.total) {
+		c.open, c.openUntil = true, now.Add(b.Cooldown)
+		breakerOpen.With(upstream).Set(1)
+		breakerTrips.With(upstream).Inc()
+		logUpstream.Warn("too many queries to upstream failed, stopping them for a while", "upstream", upstream,
+			"failed", c.failed, "queries", c.total, "cooldown", b.Cooldown)
+	}
+}
+
+// Retry reports whether a query to upstream that failed with err should
+// be sent again.
+func (b *UpstreamBreakers) Retry(upstream string, err error) bool {
+	if b == nil || b.RetryBudget == 0 || !isTimeout(err) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(upstream)
+	if c.open || c.retryTokens < 1 {
+		return false
+	}
+	c.retryTokens--
+	upstreamRetry.With(upstream).Inc()
+	return true
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, dnsclient.ErrNoResponse) || errors.As(err, &netErr) && netErr.Timeout()
+}
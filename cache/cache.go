@@ -0,0 +1,150 @@
+// Package cache holds the stores the wire cache keeps encoded responses
+// in, and the registry of cache backends -cache-backend picks from.
+package cache
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores encoded responses by key until their TTL runs out. The
+// wire cache keeps its entries in one, picked by -cache-backend: memory,
+// the default, holds them in the process and null holds nothing. Files
+// adding backends, such as a shared or disk-backed store, call Register
+// from init, as zone backends call server.RegisterZoneBackend.
+type Cache interface {
+	// Get returns the value stored under key, unless it expired by now.
+	// The caller doesn't modify it.
+	Get(key string, now time.Time) ([]byte, bool)
+	// Put stores value under key until now plus ttl. The cache may keep
+	// value; the caller doesn't modify it afterwards.
+	Put(key string, value []byte, ttl time.Duration, now time.Time)
+	// Flush drops every entry and returns how many there were.
+	Flush() int
+	// Len returns how many entries the cache holds.
+	Len() int
+}
+
+// Ranger is implemented by caches that can list their entries, for
+// inspecting them through the control socket.
+type Ranger interface {
+	// Range calls f for each entry that hasn't expired by now, until f
+	// returns false.
+	Range(now time.Time, f func(key string, value []byte, expires time.Time) bool)
+}
+
+// Backend opens a cache holding up to size entries.
+type Backend func(size int) (Cache, error)
+
+var backends = map[string]Backend{
+	"memory": func(size int) (Cache, error) { return NewMemory(size), nil },
+	"null":   func(int) (Cache, error) { return nullCache{}, nil },
+}
+
+// Register makes b available as -cache-backend name.
+func Register(name string, b Backend) {
+	backends[name] = b
+}
+
+// Open opens the cache backend registered as name.
+func Open(name string, size int) (Cache, error) {
+	b, ok := backends[name]
+	if !ok {
+		names := slices.Sorted(maps.Keys(backends))
+		return nil, fmt.Errorf("unknown cache backend %q (have %s)", name, strings.Join(names, ", "))
+	}
+	return b(size)
+}
+
+// Memory is the in-process Cache. Once full, storing an entry evicts
+// another.
+type Memory struct {
+	max int
+
+	mu      sync.RWMutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func NewMemory(max int) *Memory {
+	return &Memory{max: max, entries: map[string]memoryEntry{}}
+}
+
+func (c *Memory) Get(key string, now time.Time) ([]byte, bool) {
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok || now.After(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *Memory) Put(key string, value []byte, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		// Evicting whatever map iteration yields first is close enough to
+		// random, and hot answers come straight back.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+}
+
+func (c *Memory) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	clear(c.entries)
+	return n
+}
+
+func (c *Memory) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+func (c *Memory) Range(now time.Time, f func(key string, value []byte, expires time.Time) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for k, e := range c.entries {
+		if !now.After(e.expires) && !f(k, e.value, e.expires) {
+			return
+		}
+	}
+}
+
+// Shrink evicts fraction of the entries, for the memory budget.
+func (c *Memory) Shrink(fraction float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := int(fraction * float64(len(c.entries)))
+	for k := range c.entries {
+		if n <= 0 {
+			break
+		}
+		delete(c.entries, k)
+		n--
+	}
+}
+
+// nullCache stores nothing, for running with the cache stage in the chain
+// but no caching.
+type nullCache struct{}
+
+func (nullCache) Get(string, time.Time) ([]byte, bool)         { return nil, false }
+func (nullCache) Put(string, []byte, time.Duration, time.Time) {}
+func (nullCache) Flush() int                                   { return 0 }
+func (nullCache) Len() int                                     { return 0 }
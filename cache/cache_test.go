@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name string
+		max  int
+		// put stores each key under its own value for ttl.
+		put  []string
+		ttl  time.Duration
+		at   time.Duration
+		key  string
+		hit  bool
+		size int
+	}{
+		{"hit", 10, []string{"a"}, time.Minute, 0, "a", true, 1},
+		{"miss", 10, []string{"a"}, time.Minute, 0, "b", false, 1},
+		{"until the TTL", 10, []string{"a"}, time.Minute, time.Minute, "a", true, 1},
+		{"expired", 10, []string{"a"}, time.Minute, time.Minute + 1, "a", false, 1},
+		{"replaced", 2, []string{"a", "b", "a"}, time.Minute, 0, "a", true, 2},
+		{"full", 2, []string{"a", "b", "c"}, time.Minute, 0, "c", true, 2},
+	} {
+		c := NewMemory(tc.max)
+		for _, key := range tc.put {
+			c.Put(key, []byte(key), tc.ttl, now)
+		}
+		value, ok := c.Get(tc.key, now.Add(tc.at))
+		if ok != tc.hit || ok && string(value) != tc.key {
+			t.Errorf("%s: Get(%q) = %q, %v; want a hit: %v", tc.name, tc.key, value, ok, tc.hit)
+		}
+		if n := c.Len(); n != tc.size {
+			t.Errorf("%s: Len() = %d, want %d", tc.name, n, tc.size)
+		}
+		if n := c.Flush(); n != tc.size || c.Len() != 0 {
+			t.Errorf("%s: Flush() = %d, leaving %d", tc.name, n, c.Len())
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	Register("test", func(size int) (Cache, error) { return NewMemory(size), nil })
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"memory", true},
+		{"null", true},
+		{"test", true},
+		{"redis", false},
+	} {
+		c, err := Open(tc.name, 10)
+		if (err == nil) != tc.ok {
+			t.Errorf("Open(%q): %v", tc.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		c.Put("a", []byte("a"), time.Minute, time.Now())
+		if _, hit := c.Get("a", time.Now()); hit != (tc.name != "null") {
+			t.Errorf("Open(%q): Get after Put hit: %v", tc.name, hit)
+		}
+	}
+}
+
+// BenchmarkMemory looks up and stores entries in a cache holding as many
+// as it may.
+func BenchmarkMemory(b *testing.B) {
+	const size = 10000
+	now := time.Now()
+	keys := make([]string, size)
+	for i := range keys {
+		keys[i] = "1 www" + strconv.Itoa(i) + ".example.com 1 1 edns 1232"
+	}
+	value := make([]byte, 100)
+	b.Run("get", func(b *testing.B) {
+		c := NewMemory(size)
+		for _, key := range keys {
+			c.Put(key, value, time.Minute, now)
+		}
+		b.ReportAllocs()
+		for i := range b.N {
+			if _, ok := c.Get(keys[i%size], now); !ok {
+				b.Fatal("miss")
+			}
+		}
+	})
+	b.Run("put", func(b *testing.B) {
+		c := NewMemory(size / 2)
+		b.ReportAllocs()
+		for i := range b.N {
+			c.Put(keys[i%size], value, time.Minute, now)
+		}
+	})
+}
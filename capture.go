@@ -0,0 +1,266 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Packet capture writes the DNS messages the server exchanges with clients
+// and upstreams to a pcap file that Wireshark or tcpdump can read. It is
+// started and stopped through the control socket; with -landlock or
+// -chroot the file must be somewhere the server can still write. The server only sees
+// DNS messages, not the segments they arrived in, so every message is
+// written as a UDP datagram between the same addresses, including those
+// carried over TCP, TLS and HTTPS.
+
+const (
+	pcapSnapLen = 65535
+	linkTypeRaw = 101
+)
+
+var activeCapture atomic.Pointer[PacketCapture]
+
+type PacketCapture struct {
+	Path string
+	// QName limits the capture to messages about this name or names
+	// below it.
+	QName string
+	// Client limits the capture to traffic with these clients; upstream
+	// traffic is then left out.
+	Client *net.IPNet
+	// MaxPackets stops the capture after that many packets, if not 0.
+	MaxPackets int
+	Started    time.Time
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	packets int
+	stopped bool
+	timer   *time.Timer
+}
+
+// StartCapture begins writing to path, stopping after maxPackets packets
+// or after d, whichever comes first; 0 means no limit. Only one capture
+// runs at a time.
+func StartCapture(path, qname, client string, maxPackets int, d time.Duration) (*PacketCapture, error) {
+	if running := activeCapture.Load(); running != nil {
+		return nil, fmt.Errorf("a capture to %s is already running", running.Path)
+	}
+	c := &PacketCapture{Path: path, QName: normalizeName(qname), MaxPackets: maxPackets, Started: time.Now()}
+	if client != "" {
+		nets, err := server.ParseNetworks(client)
+		if err != nil || len(nets) != 1 {
+			return nil, fmt.Errorf("invalid client filter %q, want an address or network", client)
+		}
+		c.Client = nets[0]
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	c.file, c.w = f, bufio.NewWriter(f)
+
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	c.w.Write(header[:])
+
+	if !activeCapture.CompareAndSwap(nil, c) {
+		f.Close()
+		return nil, fmt.Errorf("another capture started at the same time")
+	}
+	if d > 0 {
+		c.timer = time.AfterFunc(d, func() { c.Stop() })
+	}
+	logServer.Info("packet capture started", "file", path, "qname", qname, "client", client, "packets", maxPackets, "duration", d)
+	return c, nil
+}
+
+// StopCapture stops the running capture, if any.
+func StopCapture() (*PacketCapture, error) {
+	c := activeCapture.Load()
+	if c == nil {
+		return nil, fmt.Errorf("no capture is running")
+	}
+	return c, c.Stop()
+}
+
+// Stop closes the file. It returns the error of the first write that
+// failed, if any.
+func (c *PacketCapture) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return nil
+	}
+	c.stopped = true
+	activeCapture.CompareAndSwap(c, nil)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	logServer.Info("packet capture stopped", "file", c.Path, "packets", c.packets)
+	return err
+}
+
+func (c *PacketCapture) Packets() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.packets
+}
+
+// captureClient records a message received from or sent to client.
+func captureClient(client *server.Client, msg []byte, fromClient bool) {
+	c := activeCapture.Load()
+	if c == nil || (c.Client != nil && !c.Client.Contains(client.IP)) {
+		return
+	}
+	localIP, localPort := splitAddr(client.Local)
+	if fromClient {
+		c.write(client.IP, client.Port, localIP, localPort, msg)
+	} else {
+		c.write(localIP, localPort, client.IP, client.Port, msg)
+	}
+}
+
+// captureUpstream records a message exchanged with an upstream server.
+func captureUpstream(local, upstream net.Addr, msg []byte, toUpstream bool) {
+	c := activeCapture.Load()
+	if c == nil || c.Client != nil {
+		return
+	}
+	localIP, localPort := splitAddr(local)
+	upstreamIP, upstreamPort := splitAddr(upstream)
+	if toUpstream {
+		c.write(localIP, localPort, upstreamIP, upstreamPort, msg)
+	} else {
+		c.write(upstreamIP, upstreamPort, localIP, localPort, msg)
+	}
+}
+
+func (c *PacketCapture) matches(msg []byte) bool {
+	if c.QName == "" {
+		return true
+	}
+	m, err := dnswire.ParseLazy(msg)
+	if err != nil {
+		return false
+	}
+	q, err := m.Question(0)
+	return err == nil && inZone(normalizeName(q.Name), c.QName)
+}
+
+func (c *PacketCapture) write(src net.IP, srcPort int, dst net.IP, dstPort int, msg []byte) {
+	if !c.matches(msg) {
+		return
+	}
+	packet := ipUDPPacket(src, srcPort, dst, dstPort, msg)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped || (c.MaxPackets > 0 && c.packets >= c.MaxPackets) {
+		return
+	}
+	var header [16]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(packet)))
+	c.w.Write(header[:])
+	c.w.Write(packet)
+	c.packets++
+	if c.MaxPackets > 0 && c.packets >= c.MaxPackets {
+		go c.Stop()
+	}
+}
+
+// ipUDPPacket wraps payload in IP and UDP headers. Both addresses are
+// written as IPv4 if they can be, and as IPv6 otherwise.
+func ipUDPPacket(src net.IP, srcPort int, dst net.IP, dstPort int, payload []byte) []byte {
+	src4, dst4 := src.To4(), dst.To4()
+	if src == nil {
+		src4 = net.IPv4zero.To4()
+	}
+	if dst == nil {
+		dst4 = net.IPv4zero.To4()
+	}
+	v4 := src4 != nil && dst4 != nil
+	ipHeader := 40
+	if v4 {
+		ipHeader = 20
+	}
+	payload = payload[:min(len(payload), pcapSnapLen-ipHeader-8)]
+	udpLen := 8 + len(payload)
+
+	udp := make([]byte, 8, udpLen)
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	udp = append(udp, payload...)
+
+	var ip, pseudo []byte
+	if v4 {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+udpLen))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip))
+		pseudo = append(append(append([]byte(nil), src4...), dst4...), 0, 17, byte(udpLen>>8), byte(udpLen))
+	} else {
+		src16, dst16 := src.To16(), dst.To16()
+		if src16 == nil {
+			src16 = net.IPv6unspecified
+		}
+		if dst16 == nil {
+			dst16 = net.IPv6unspecified
+		}
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+		ip[6] = 17
+		ip[7] = 64
+		copy(ip[8:], src16)
+		copy(ip[24:], dst16)
+		pseudo = append(append(append([]byte(nil), src16...), dst16...), 0, 0, byte(udpLen>>8), byte(udpLen), 0, 0, 0, 17)
+	}
+	sum := internetChecksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(ip, udp...)
+}
+
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
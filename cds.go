@@ -0,0 +1,139 @@
+package dnsserver
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// CDS and CDNSKEY records (RFC 7344) tell a parental agent which DS records
+// the zone wants, so key rollovers don't need a manual registrar update.
+// With parent polling the server also looks up the DS RRset the parent
+// actually serves and withdraws the CDS records once it matches, as the
+// RFC recommends.
+
+var parentDSInSync = NewGaugeVec("dns_parent_ds_in_sync", "Whether the parent's DS RRset matches the zone's key-signing keys (1) or not (0).", "zone")
+
+// desiredKSKs returns the keys the parent should have DS records for: the
+// active KSKs, leaving out ones already scheduled to retire unless that is
+// all there is.
+func (s *ZoneSigner) desiredKSKs(now time.Time) []*SigningKey {
+	var active, staying []*SigningKey
+	for _, k := range s.Keys {
+		if !k.IsKSK() || !k.Active(now) {
+			continue
+		}
+		active = append(active, k)
+		if k.Inactive.IsZero() {
+			staying = append(staying, k)
+		}
+	}
+	if len(staying) > 0 {
+		return staying
+	}
+	return active
+}
+
+// parentMatches reports whether the DS records the parent last served cover
+// exactly the desired keys.
+func (s *ZoneSigner) parentMatches(origin string, keys []*SigningKey) bool {
+	if s.parentDS == nil || len(keys) == 0 {
+		return false
+	}
+	covered := map[*SigningKey]bool{}
+	for _, ds := range s.parentDS {
+		found := false
+		for _, k := range keys {
+			if ds.Matches(origin, k.DNSKEY) {
+				covered[k], found = true, true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(covered) == len(keys)
+}
+
+// cdsRecords returns the CDS and CDNSKEY RRsets to publish at the apex,
+// which are empty once the parent is in sync.
+func (s *ZoneSigner) cdsRecords(origin string, ttl uint32, now time.Time) (cds, cdnskey []*ResourceRecord) {
+	keys := s.desiredKSKs(now)
+	if s.parentMatches(origin, keys) {
+		return nil, nil
+	}
+	for _, k := range keys {
+		ds, err := k.DNSKEY.ToDS(origin, DigestSHA256)
+		if err != nil {
+			logDNSSEC.Error("cannot build CDS", "zone", fqdn(origin), "key", k.DNSKEY.KeyTag(), "err", err)
+			continue
+		}
+		cds = append(cds, &ResourceRecord{Name: origin, Type: TypeCDS, Class: ClassINET, TTL: ttl, RData: ds.RData()})
+		cdnskey = append(cdnskey, &ResourceRecord{Name: origin, Type: TypeCDNSKEY, Class: ClassINET, TTL: ttl, RData: k.DNSKEY.RData()})
+	}
+	return cds, cdnskey
+}
+
+// PollParent periodically fetches the zone's DS RRset through the resolver
+// and republishes CDS/CDNSKEY accordingly, until the zone is retired.
+func (z *Zone) PollParent() {
+	s := z.signer
+	for !z.retired.Load() {
+		if err := z.pollParent(); err != nil {
+			logDNSSEC.Warn("polling parent DS failed", "zone", fqdn(z.Origin), "err", err)
+		}
+		// Spread polls so many zones don't query the parent at once.
+		time.Sleep(s.ParentPoll/2 + rand.N(s.ParentPoll))
+	}
+}
+
+func (z *Zone) pollParent() error {
+	s := z.signer
+	q := dnswire.NewQuery(z.Origin, TypeDS).SetEDNS(ednsUDPSize, true)
+	resp, err := exchange(s.Resolver, q)
+	if err != nil {
+		return err
+	}
+	if resp.Header.RCode != RCodeSuccess {
+		return fmt.Errorf("rcode %d", resp.Header.RCode)
+	}
+	parent := []*DS{}
+	for _, rr := range resp.Answers {
+		if rr.Type != TypeDS || normalizeName(rr.Name) != z.Origin {
+			continue
+		}
+		ds, err := parseDS(rr.RData)
+		if err != nil {
+			return err
+		}
+		parent = append(parent, ds)
+	}
+
+	z.mu.Lock()
+	wasInSync := s.parentMatches(z.Origin, s.desiredKSKs(time.Now()))
+	s.parentDS = parent
+	inSync := s.parentMatches(z.Origin, s.desiredKSKs(time.Now()))
+	if inSync != wasInSync {
+		z.prepareSigned()
+	}
+	z.mu.Unlock()
+
+	if inSync {
+		parentDSInSync.With(fqdn(z.Origin)).Set(1)
+	} else {
+		parentDSInSync.With(fqdn(z.Origin)).Set(0)
+	}
+	if inSync != wasInSync {
+		if inSync {
+			logDNSSEC.Info("parent DS RRset matches the key-signing keys, withdrawing CDS/CDNSKEY", "zone", fqdn(z.Origin))
+		} else {
+			logDNSSEC.Info("parent DS RRset is out of date, publishing CDS/CDNSKEY", "zone", fqdn(z.Origin))
+		}
+		if !s.Online {
+			z.SignAll()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,767 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// defaultChain is the order the stages run in unless -chain says
+// otherwise.
+var defaultChain = []string{"log", "ratelimit", "validate", "tsig", "tenant", "acl", "firewall", "update", "blocklist", "script", "rewrite", "local", "cache", "transfer", "authoritative", "forward"}
+
+// Pipeline answers queries by running them through a chain of stages,
+// chosen by the zone the question falls in.
+type Pipeline struct {
+	Strict      bool
+	FastForward bool
+	// NSID identifies the server to clients asking with the NSID option.
+	NSID []byte
+	// PadBlock is the block size encrypted responses are padded to.
+	PadBlock int
+
+	Limiter         *RateLimiter
+	Authenticator   *Authenticator
+	Firewall        *Firewall
+	Script          *ScriptHook
+	Rewriter        *Rewriter
+	Guard           *ReflectionGuard
+	RRL             *RRL
+	WireCache       *WireCache
+	QueryLog        *QueryLog
+	SlowQueries     *SlowQueryLog
+	Stats           *Stats
+	Servfails       *ServfailMonitor
+	DGA             *DGAMonitor
+	Validator       *Validator
+	Tenants         *Tenants
+	Tracer          *Tracer
+	LatencySuffixes []string
+
+	// mux routes each query to the chain for its zone.
+	mux *ServeMux
+}
+
+// queryState is what the stages know about the query being answered. It
+// is the ResponseWriter they are handed, and stages get at it with
+// stateOf.
+type queryState struct {
+	ResponseWriter
+	p       *Pipeline
+	message *Message
+	start   time.Time
+	cfg     *serverConfig
+	span    *Span
+	qlog    *slog.Logger
+	stages  *queryStages
+
+	auth    *authResult
+	rewrite *rewriteState
+	blocked bool
+	// profile is the client's profile, once profileOf has matched it.
+	profile  *Profile
+	profiled bool
+	// tenant is the query's tenant, once tenantOf has matched it.
+	tenant   *Tenant
+	tenanted bool
+	// zoneAnswer is the response the authoritative stage sent, for the
+	// cache to keep.
+	zoneAnswer *Query
+	// sent and reply are the response and its wire form, once there is
+	// one.
+	sent  *Query
+	reply []byte
+}
+
+// stateOf returns the state of the query w answers. Stages have to pass
+// the ResponseWriter they were given on unchanged.
+func stateOf(w ResponseWriter) *queryState {
+	return w.(*queryState)
+}
+
+// Write keeps reply to be sent once the chain is done with the query, so
+// the stages around the one writing still see it.
+func (q *queryState) Write(reply []byte) error {
+	if q.reply != nil {
+		server.PutBuffer(&q.reply)
+	}
+	q.reply = reply
+	return nil
+}
+
+// profileOf returns the profile of the query, matching it the first time
+// a stage asks; stages after tsig see it matched by key.
+func (q *queryState) profileOf() *Profile {
+	if q.profiled {
+		return q.profile
+	}
+	q.profile, q.profiled = q.cfg.profiles.Match(q.Client(), q.auth), true
+	if q.profile != nil {
+		profileQueries.With(q.profile.Name).Inc()
+		if q.profile.Log == "debug" {
+			q.qlog = forceDebug(q.qlog)
+		}
+		q.span.SetAttr("dns.client.profile", q.profile.Name)
+	}
+	return q.profile
+}
+
+// tenantOf returns the tenant of the query, matching it the first time a
+// stage asks, as profileOf does.
+func (q *queryState) tenantOf() *Tenant {
+	if !q.tenanted {
+		q.tenant, q.tenanted = q.p.Tenants.Match(q.Client(), q.auth), true
+	}
+	return q.tenant
+}
+
+// zones returns the served zones the query may be answered from.
+func (q *queryState) zones() *ZoneSet {
+	return q.p.Tenants.Zones(q.tenantOf(), q.cfg.zones)
+}
+
+// send encodes resp as the answer to the query.
+func (q *queryState) send(resp *Query) {
+	defer q.stages.Time("encode")()
+	encode := q.span.Child("encode", spanKindInternal)
+	// Whether names are compressed is decided first, so the reflection
+	// limits measure the response as it is sent.
+	compress := q.compress(resp)
+	resp = q.p.Guard.Response(resp, q.message, q.Client(), compress, time.Now())
+	resp = withNSID(resp, q.message, q.p.NSID)
+	if !compress {
+		uncompressedResponses.Inc()
+	}
+	resp = truncate(resp, q.MaxSize(), compress)
+	if block := q.padding(); block > 0 {
+		resp = withPadding(resp, block, compress)
+	}
+	wire, err := encodeResponse(*server.GetBuffer(0), resp, compress)
+	if err != nil {
+		q.qlog.Error("encoding response failed", "err", err)
+		q.span.SetError(err)
+		resp = errorResponse(q.message, RCodeServerFailure)
+		if wire, err = resp.AppendTo(wire); err != nil {
+			// The question itself can't be encoded.
+			resp.Questions, resp.Header.QDCount = nil, 0
+			wire, _ = resp.AppendTo(wire)
+		}
+	} else {
+		recordCompression(resp, len(wire))
+	}
+	q.sent = resp
+	q.Write(q.auth.Sign(wire, time.Now()))
+	encode.SetAttr("dns.response.size", len(q.reply))
+	encode.SetAttr("dns.response.truncated", resp.Header.TC)
+	encode.End()
+	q.span.SetAttr("dns.response_code", dnswire.RCodeString(resp.Header.RCode))
+}
+
+// Build assembles the chains specs describe, each a comma separated list
+// of stages optionally preceded by the zone it applies to, as
+// zone=stage,stage. Names outside every zone given go through the chain
+// without one, or the default chain.
+func (p *Pipeline) Build(specs []string) error {
+	p.mux = NewServeMux()
+	for _, spec := range specs {
+		zone, list, ok := strings.Cut(spec, "=")
+		if !ok {
+			zone, list = ".", spec
+		}
+		if h, at := p.mux.Handler(zone); h != nil && at == fqdn(normalizeName(zone)) {
+			return fmt.Errorf("-chain %q: zone %s has a chain already", spec, fqdn(normalizeName(zone)))
+		}
+		h, err := p.chain(strings.Split(list, ","))
+		if err != nil {
+			return fmt.Errorf("-chain %q: %v", spec, err)
+		}
+		p.mux.Handle(zone, h)
+	}
+	if h, _ := p.mux.Handler("."); h == nil {
+		h, _ = p.chain(defaultChain)
+		p.mux.Handle(".", h)
+	}
+	return nil
+}
+
+func (p *Pipeline) chain(names []string) (Handler, error) {
+	builtin := map[string]Middleware{
+		"log":           p.logStage,
+		"ratelimit":     p.rateLimitStage,
+		"validate":      p.validateStage,
+		"tsig":          p.tsigStage,
+		"tenant":        p.tenantStage,
+		"acl":           p.aclStage,
+		"firewall":      p.firewallStage,
+		"update":        p.updateStage,
+		"blocklist":     p.blocklistStage,
+		"script":        p.scriptStage,
+		"rewrite":       p.rewriteStage,
+		"local":         p.localStage,
+		"cache":         p.cacheStage,
+		"transfer":      p.transferStage,
+		"authoritative": p.authoritativeStage,
+		"forward":       p.forwardStage,
+	}
+	stages := make([]Middleware, len(names))
+	validated, updates := -1, false
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		m, ok := builtin[name]
+		if !ok {
+			m, ok = server.Stage(name)
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+		stages[i] = m
+		if name == "validate" && validated < 0 {
+			validated = i
+		}
+		updates = updates || name == "update"
+	}
+	// Messages that failed to parse hold only their header; nothing past
+	// validate expects them.
+	if validated < 0 {
+		return nil, fmt.Errorf("validate is left out")
+	}
+	if !updates {
+		stages = slices.Insert(stages, validated+1, notImplementedUpdates)
+	}
+	var h Handler = HandlerFunc(p.fallback)
+	for i := len(stages) - 1; i >= 0; i-- {
+		h = stages[i](h)
+	}
+	return h, nil
+}
+
+// ServeDNS answers a query through the chain for its zone and sends
+// whatever response the chain left.
+func (p *Pipeline) ServeDNS(w ResponseWriter, message *Message) {
+	q := &queryState{ResponseWriter: w, p: p, message: message, start: time.Now(), cfg: currentConfig(), stages: &queryStages{}}
+	client := w.Client()
+	q.span = p.Tracer.Start("dns.query")
+	defer q.span.End()
+	q.span.SetAttr("client.address", client.IP.String())
+	q.span.SetAttr("network.transport", client.Protocol)
+	q.qlog = logServer.With("client", client.IP.String())
+	if len(message.Questions) > 0 {
+		question := message.Questions[0]
+		q.qlog = q.qlog.With("qname", fqdn(normalizeName(question.Name)), "qtype", dnswire.TypeString(question.QType))
+		if features.Enabled(featureDebugLog, client.IP, normalizeName(question.Name), q.start) {
+			q.qlog = forceDebug(q.qlog)
+		}
+		q.span.SetAttr("dns.question.name", fqdn(normalizeName(question.Name)))
+		q.span.SetAttr("dns.question.type", dnswire.TypeString(question.QType))
+	}
+	q.qlog.Debug("query received", "bytes", len(w.Query()), "id", message.Header.ID)
+
+	p.mux.ServeDNS(q, message)
+
+	p.Stats.Record(client.IP, message, q.sent, q.blocked, q.start)
+	p.Servfails.Record(q.sent)
+	p.DGA.Record(client.IP, message, q.sent)
+	recordNXDomain(message, q.sent, q.cfg.zones, p.LatencySuffixes)
+	if q.sent != nil && len(message.Questions) > 0 {
+		zone := latencyZone(message.Questions[0].Name, q.cfg.zones, p.LatencySuffixes)
+		zoneLatency.With(zone).Observe(time.Since(q.start).Seconds())
+	}
+	recordSizes(client, message, w.Query(), q.reply)
+	if q.reply != nil {
+		if err := w.Write(q.reply); err != nil {
+			q.qlog.Warn("sending response failed", "err", err)
+		}
+	}
+}
+
+// logStage records the query and its response in the query log, the slow
+// query log, query watches, dnstap and packet captures.
+func (p *Pipeline) logStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		client, data := w.Client(), w.Query()
+		dnstapWriter.ClientQuery(client, data, q.start)
+		captureClient(client, data, true)
+		next.ServeDNS(w, m)
+		if profile := q.profileOf(); profile == nil || profile.Log != "off" {
+			p.QueryLog.Record(client, m, q.sent, false, time.Since(q.start))
+			if t := q.tenantOf(); t != nil && t.QueryLog != nil {
+				t.QueryLog.Record(client, m, q.sent, false, time.Since(q.start))
+			}
+		}
+		notifyQueryWatches(client, m, q.sent, false, time.Since(q.start))
+		p.SlowQueries.Record(client, m, q.sent, q.stages, time.Since(q.start))
+		if q.reply != nil {
+			dnstapWriter.ClientResponse(client, data, q.reply, q.start)
+			captureClient(client, q.reply, false)
+		}
+	})
+}
+
+func (p *Pipeline) rateLimitStage(next Handler) Handler {
+	if p.Limiter == nil {
+		return next
+	}
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		if !p.Limiter.Allow(w.Client().IP, time.Now()) {
+			if p.Limiter.cfg.Refuse {
+				stateOf(w).send(refusedResponse(m))
+			}
+			return
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+func (p *Pipeline) validateStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		done := q.stages.Time("validate")
+		err := checkQuery(m, len(w.Query()), p.Strict)
+		done()
+		if err != nil {
+			if err != ErrFormat {
+				q.qlog.Info("bad query", "err", err)
+			}
+			q.span.SetError(err)
+			q.send(errorResponse(m, dnswire.RCodeOf(err)))
+			return
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+// tsigStage checks TSIG and SIG(0) signatures; responses to signed
+// queries are signed in turn.
+func (p *Pipeline) tsigStage(next Handler) Handler {
+	if p.Authenticator == nil {
+		return next
+	}
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		q.auth = p.Authenticator.Check(w.Query(), m, w.Client().IP, time.Now())
+		if q.auth != nil && q.auth.RCode != RCodeSuccess {
+			q.send(errorResponse(m, q.auth.RCode))
+			return
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+// tenantStage counts the queries of each tenant and refuses those over
+// its quota.
+func (p *Pipeline) tenantStage(next Handler) Handler {
+	if p.Tenants == nil {
+		return next
+	}
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		t := q.tenantOf()
+		if t == nil {
+			next.ServeDNS(w, m)
+			return
+		}
+		tenantQueries.With(t.Name).Inc()
+		if !t.Allow(time.Now()) {
+			tenantRefused.With(t.Name).Inc()
+			q.send(refusedResponse(m))
+			return
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+func (p *Pipeline) aclStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		client := w.Client()
+		if !client.ACLs.Permits(requiredCapability(m), client.IP) {
+			stateOf(w).send(refusedResponse(m))
+			return
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+func (p *Pipeline) firewallStage(next Handler) Handler {
+	if p.Firewall == nil {
+		return next
+	}
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		if rule := p.Firewall.Check(w.Client().IP, m, time.Now()); rule != nil {
+			if rule.Action == firewallDeny {
+				q.send(refusedResponse(m))
+				return
+			}
+			q.rewrite = rule.redirect(m)
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+func (p *Pipeline) blocklistStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		if q.cfg.blocker != nil {
+			client := w.Client()
+			done := q.stages.Time("blocklist")
+			resp, ok := q.cfg.blocker.Answer(client.IP, q.profileOf().blockGroup(client.Group), m)
+			done()
+			if ok {
+				q.blocked = true
+				q.send(resp)
+				return
+			}
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+func (p *Pipeline) scriptStage(next Handler) Handler {
+	if p.Script == nil {
+		return next
+	}
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		done := q.stages.Time("script")
+		d := p.Script.Run(w.Client().IP, m)
+		done()
+		switch {
+		case d.Action == scriptDrop:
+			return
+		case d.Response != nil:
+			q.send(d.Response)
+			return
+		case d.Action == scriptRewrite && q.rewrite == nil:
+			// A script rewrite takes the place of the configured rules,
+			// but not of a firewall redirect.
+			q.rewrite = d.rewrite(m)
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+// rewriteStage applies safe search for profiles with it, or else the
+// -rewrite rules, unless the firewall or the script already rewrote the
+// query.
+func (p *Pipeline) rewriteStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		if profile := q.profileOf(); q.rewrite == nil && profile != nil {
+			q.rewrite = safeSearchRequest(m, profile.SafeSearch)
+		}
+		if q.rewrite == nil && p.Rewriter != nil {
+			q.rewrite = p.Rewriter.Request(m)
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+// localStage answers from -local-data and -local-zone.
+func (p *Pipeline) localStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		resp, ok := q.cfg.localData.Answer(m)
+		if !ok {
+			next.ServeDNS(w, m)
+			return
+		}
+		if resp != nil {
+			q.rewrite.Response(resp)
+			q.send(resp)
+		}
+	})
+}
+
+// cacheStage answers questions whose responses only depend on the question
+// from the wire cache, and keeps the authoritative answers to them.
+func (p *Pipeline) cacheStage(next Handler) Handler {
+	if p.WireCache == nil {
+		return next
+	}
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		key, cacheable := p.WireCache.Key(q.zones(), m, w.Client().Stream)
+		if t := q.tenantOf(); t != nil {
+			key = t.Name + "/" + key
+		}
+		if !cacheable || q.auth != nil || p.Guard != nil || q.rewrite != nil || q.padding() > 0 ||
+			q.cfg.noCompression.Names(w.Client().IP) || q.uncompressedByFeature() {
+			next.ServeDNS(w, m)
+			return
+		}
+		done := q.stages.Time("wire_cache")
+		resp, wire := p.WireCache.Get(key, m, q.start)
+		done()
+		if resp == nil {
+			next.ServeDNS(w, m)
+			if q.zoneAnswer != nil && q.sent == q.zoneAnswer {
+				p.WireCache.Put(key, q.reply, q.start)
+			}
+			return
+		}
+		q.span.SetAttr("dns.wire_cache", true)
+		switch p.rateLimit(w.Client(), resp) {
+		case rrlDrop:
+			server.PutBuffer(&wire)
+		case rrlSlip:
+			server.PutBuffer(&wire)
+			q.send(slipResponse(resp))
+		default:
+			q.sent = resp
+			q.Write(wire)
+			q.span.SetAttr("dns.response_code", dnswire.RCodeString(resp.Header.RCode))
+		}
+	})
+}
+
+// rateLimit applies response rate limiting to resp, the answer to client.
+// Only UDP responses are limited: stream clients can't spoof their
+// address, and TCP is where a slipped response sends them to retry.
+func (p *Pipeline) rateLimit(client *server.Client, resp *Query) rrlAction {
+	if p.RRL == nil || client.Stream {
+		return rrlSend
+	}
+	return p.RRL.Check(client.IP, resp, time.Now())
+}
+
+// transferStage streams served zones to AXFR and IXFR clients.
+func (p *Pipeline) transferStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		if len(m.Questions) != 1 || m.Questions[0].QType != TypeAXFR && m.Questions[0].QType != TypeIXFR {
+			next.ServeDNS(w, m)
+			return
+		}
+		q, client := stateOf(w), w.Client()
+		question := m.Questions[0]
+		incremental := question.QType == TypeIXFR
+		// An IXFR query carries the client's SOA in its authority section.
+		var serial uint32
+		var clientSOA bool
+		for _, rr := range m.Authorities {
+			if rr.Type == TypeSOA && len(rr.RData) >= 20 {
+				serial, clientSOA = soaSerial(rr), true
+			}
+		}
+		z := q.zones().Find(question.Name)
+		switch {
+		case z == nil || normalizeName(question.Name) != z.Origin:
+			q.send(errorResponse(m, RCodeNotAuth))
+		case incremental && !clientSOA:
+			q.send(errorResponse(m, RCodeFormatError))
+		case incremental && client.Conn == nil:
+			// Over UDP the client is told the current SOA, and comes back
+			// over TCP if it is behind.
+			resp := new(Query).SetReply(m)
+			resp.Header.AA = true
+			resp.AddAnswer(z.SOA())
+			q.send(resp)
+		case client.Conn == nil:
+			// Transfers need a stream.
+			q.send(errorResponse(m, RCodeNotImplemented))
+		default:
+			done := q.stages.Time("transfer")
+			var records int
+			var err error
+			if incremental {
+				records, err = streamIncremental(client.Conn, m, q.auth, z, serial)
+			} else {
+				records, err = streamTransfer(client.Conn, m, q.auth, z)
+			}
+			done()
+			if err != nil {
+				zoneTransfers.With("failed").Inc()
+				q.qlog.Warn("zone transfer failed", "records", records, "err", err)
+				webhooks.Fire(eventTransferFailed, fqdn(z.Origin), fmt.Sprintf("%s of %s to %s failed: %v", dnswire.TypeString(question.QType), fqdn(z.Origin), client.IP, err),
+					"client", client.IP.String(), "type", dnswire.TypeString(question.QType), "records", strconv.Itoa(records), "error", err.Error())
+				q.span.SetError(err)
+				// The client can't tell where the transfer broke off.
+				client.Conn.Close()
+				return
+			}
+			zoneTransfers.With("ok").Inc()
+			q.qlog.Info("zone transferred", "records", records, "took", time.Since(q.start))
+			q.sent = new(Query).SetReply(m)
+			q.sent.Header.AA = true
+		}
+	})
+}
+
+// authoritativeStage answers from the served zones, passing on questions
+// outside them.
+func (p *Pipeline) authoritativeStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q := stateOf(w)
+		lookup := q.span.Child("zone.lookup", spanKindInternal)
+		done := q.stages.Time("zone")
+		resp, ok := q.zones().Answer(m)
+		done()
+		lookup.SetAttr("authoritative", ok)
+		lookup.End()
+		if !ok {
+			next.ServeDNS(w, m)
+			return
+		}
+		q.rewrite.Response(resp)
+		switch p.rateLimit(w.Client(), resp) {
+		case rrlDrop:
+			return
+		case rrlSlip:
+			q.send(slipResponse(resp))
+			return
+		}
+		q.zoneAnswer = resp
+		q.send(resp)
+	})
+}
+
+// forwardStage sends the questions to -resolver, when there is one.
+func (p *Pipeline) forwardStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		q, client := stateOf(w), w.Client()
+		resolver := q.cfg.resolver
+		if resolver == nil {
+			next.ServeDNS(w, m)
+			return
+		}
+		if !client.ACLs.Permits(CapRecursion, client.IP) {
+			q.send(refusedResponse(m))
+			return
+		}
+
+		if p.FastForward && relayable(m) && q.auth == nil && p.Guard == nil && q.rewrite == nil && p.Validator == nil && q.padding() == 0 &&
+			(spoofDetector == nil || spoofDetector.Linger == 0) && !q.cfg.noCompression.MayApply(client.IP) && !q.uncompressedByFeature() {
+			question := m.Questions[0]
+			upstream := q.span.Child("upstream", spanKindClient)
+			upstream.SetAttr("server.address", resolver.String())
+			upstream.SetAttr("dns.question.name", fqdn(normalizeName(question.Name)))
+			done := q.stages.Time("upstream")
+			use0x20 := (spoofDetector != nil && spoofDetector.Use0x20) ||
+				features.Enabled(feature0x20, client.IP, normalizeName(question.Name), q.start)
+			buf, resp, err := relay(resolver, w.Query(), question, use0x20)
+			done()
+			if err != nil {
+				q.qlog.Warn("querying resolver failed", "resolver", resolver.String(), "err", err)
+				upstream.SetError(err)
+				upstream.End()
+				q.send(errorResponse(m, dnswire.RCodeOf(err)))
+				return
+			}
+			upstream.SetAttr("dns.response_code", dnswire.RCodeString(resp.Header.RCode))
+			upstream.End()
+			// Stream clients can take the whole answer, so a truncated one
+			// is fetched again over TCP below.
+			if !resp.Header.TC || !client.Stream {
+				answers, _ := resp.Answers()
+				q.sent = &Query{Header: *resp.Header, Questions: m.Questions, Answers: answers}
+				q.Write(*buf)
+				q.span.SetAttr("dns.response_code", dnswire.RCodeString(resp.Header.RCode))
+				return
+			}
+			server.PutBuffer(buf)
+		}
+
+		// Each question is asked on its own. The first that can't be
+		// answered fails the query with the rcode its error maps to.
+		var allAnswers, allAuthorities []*ResourceRecord
+		var failure error
+		opt := findOPT(m)
+		wantDNSSEC := opt != nil && opt.TTL&(1<<15) != 0
+		validate := p.Validator != nil && m.Header.Z&headerCD == 0
+		secure := validate
+		for _, question := range m.Questions {
+			singleQuery := new(Query).AddQuestion(question)
+			singleQuery.Header.ID, singleQuery.Header.RD = uint16(rand.Uint32()), m.Header.RD
+			if validate || wantDNSSEC {
+				singleQuery.SetEDNS(4096, true)
+			}
+			upstream := q.span.Child("upstream", spanKindClient)
+			// Queries being looked into ask which resolver instance
+			// answered.
+			askNSID := upstream != nil || q.qlog.Enabled(context.Background(), slog.LevelDebug)
+			if askNSID {
+				singleQuery = withEDNSOption(singleQuery, ednsOptionNSID, nil, 0)
+			}
+			upstream.SetAttr("server.address", resolver.String())
+			upstream.SetAttr("dns.question.name", fqdn(normalizeName(question.Name)))
+			done := q.stages.Time("upstream")
+			use0x20 := (spoofDetector != nil && spoofDetector.Use0x20) ||
+				features.Enabled(feature0x20, client.IP, normalizeName(question.Name), q.start)
+			ressolverResponse, err := exchangeCase(resolver, singleQuery, use0x20)
+			done()
+			if err != nil {
+				q.qlog.Warn("querying resolver failed", "resolver", resolver.String(), "err", err)
+				upstream.SetError(err)
+				upstream.End()
+				allAnswers, allAuthorities, failure = nil, nil, err
+				break
+			}
+			upstream.SetAttr("dns.response_code", dnswire.RCodeString(ressolverResponse.Header.RCode))
+			if nsid := upstreamNSID(ressolverResponse); askNSID && nsid != "" {
+				upstream.SetAttr("dns.upstream.nsid", nsid)
+				q.qlog.Debug("resolver answered", "resolver", resolver.String(), "nsid", nsid)
+			}
+			upstream.End()
+
+			if validate {
+				dnssec := q.span.Child("dnssec", spanKindInternal)
+				done := q.stages.Time("dnssec")
+				ok, err := p.Validator.Validate(resolver, ressolverResponse, time.Now())
+				done()
+				if err != nil {
+					q.qlog.Warn("answer failed DNSSEC validation", "err", err)
+					dnssec.SetAttr("dns.dnssec.status", "bogus")
+					dnssec.SetError(err)
+					dnssec.End()
+					allAnswers, allAuthorities, failure = nil, nil, dnswire.ErrServFail
+					break
+				}
+				status := "insecure"
+				if ok {
+					status = "secure"
+				}
+				dnssec.SetAttr("dns.dnssec.status", status)
+				dnssec.End()
+				secure = secure && ok
+			}
+			if !wantDNSSEC {
+				ressolverResponse.Answers = stripDNSSEC(ressolverResponse.Answers, question.QType)
+				ressolverResponse.Authorities = stripDNSSEC(ressolverResponse.Authorities, 0)
+			}
+			allAnswers = append(allAnswers, ressolverResponse.Answers...)
+			allAuthorities = append(allAuthorities, ressolverResponse.Authorities...)
+			if rcode := ressolverResponse.Header.RCode; rcode != RCodeSuccess {
+				failure = dnswire.RCodeError(rcode)
+				break
+			}
+		}
+
+		finalResponse := new(Query).SetRcode(m, dnswire.RCodeOf(failure)).AddAnswer(allAnswers...).AddAuthority(allAuthorities...)
+		finalResponse.Header.RA = true
+		if opt != nil {
+			finalResponse.SetEDNS(ednsUDPSize, wantDNSSEC)
+		}
+		// Proven NXDOMAIN answers are as secure as any other.
+		if rcode := dnswire.RCodeOf(failure); secure && (rcode == RCodeSuccess || rcode == RCodeNameError) && (wantDNSSEC || m.Header.Z&headerAD != 0) {
+			finalResponse.Header.Z |= headerAD
+		}
+		q.rewrite.Response(finalResponse)
+		q.send(finalResponse)
+	})
+}
+
+// fallback answers whatever reaches the end of the chain.
+func (p *Pipeline) fallback(w ResponseWriter, message *Message) {
+	q := stateOf(w)
+	query := q.cfg.local.Answer(message)
+	q.rewrite.Response(query)
+	q.send(query)
+}
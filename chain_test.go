@@ -0,0 +1,106 @@
+package dnsserver
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// testWriter is the ResponseWriter of a query from 192.0.2.7 over UDP. It
+// keeps the response the pipeline writes.
+type testWriter struct {
+	query []byte
+	reply []byte
+}
+
+func (w *testWriter) Client() *server.Client {
+	return &server.Client{IP: net.ParseIP("192.0.2.7"), Port: 5353, ACLs: NewACLSet(), Protocol: "udp"}
+}
+func (w *testWriter) Query() []byte { return w.query }
+func (w *testWriter) MaxSize() int  { return server.UDPSize }
+func (w *testWriter) Write(reply []byte) error {
+	w.reply = append(w.reply[:0], reply...)
+	return nil
+}
+
+// serveQuery runs a query for name through p and returns the response.
+func serveQuery(t *testing.T, p *Pipeline, name string, qtype uint16) *dnswire.Message {
+	t.Helper()
+	q := new(Query).SetQuestion(name, qtype)
+	q.Header.ID, q.Header.RD = 1, true
+	data, err := q.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := dnswire.ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &testWriter{query: data}
+	p.ServeDNS(w, m)
+	if w.reply == nil {
+		t.Fatalf("%s: no response", name)
+	}
+	resp, err := dnswire.ParseMessage(w.reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestChainOrder(t *testing.T) {
+	var ran []string
+	for _, name := range []string{"test-a", "test-b", "test-c"} {
+		server.RegisterStage(name, func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, m *Message) {
+				ran = append(ran, name)
+				next.ServeDNS(w, m)
+			})
+		})
+	}
+	liveConfig.Store(buildConfig(t))
+	defer liveConfig.Store(nil)
+
+	for _, tc := range []struct {
+		specs []string
+		name  string
+		want  []string
+	}{
+		{[]string{"validate,test-a,test-b,test-c"}, "www.example.com", []string{"test-a", "test-b", "test-c"}},
+		{[]string{"validate,test-c,test-a"}, "www.example.com", []string{"test-c", "test-a"}},
+		{[]string{"test-b,validate,test-a"}, "www.example.com", []string{"test-b", "test-a"}},
+		{[]string{"validate,test-a", "example.com=validate,test-b"}, "www.example.com", []string{"test-b"}},
+		{[]string{"validate,test-a", "example.com=validate,test-b"}, "www.example.org", []string{"test-a"}},
+		{[]string{"validate,test-a", "example.com=validate,test-b", "sub.example.com=validate,test-c,test-b"}, "a.sub.example.com", []string{"test-c", "test-b"}},
+	} {
+		p := &Pipeline{}
+		if err := p.Build(tc.specs); err != nil {
+			t.Fatal(err)
+		}
+		ran = nil
+		serveQuery(t, p, tc.name, TypeA)
+		if !reflect.DeepEqual(ran, tc.want) {
+			t.Errorf("%q, %s: stages ran %v, want %v", tc.specs, tc.name, ran, tc.want)
+		}
+	}
+}
+
+func TestChainBuildErrors(t *testing.T) {
+	for _, tc := range []struct {
+		specs []string
+		err   string
+	}{
+		{[]string{"log,forward"}, "validate is left out"},
+		{[]string{"validate,no-such-stage"}, `unknown stage "no-such-stage"`},
+		{[]string{"example.com=validate", "example.com.=validate,log"}, "has a chain already"},
+	} {
+		err := (&Pipeline{}).Build(tc.specs)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Build(%q) = %v, want an error containing %q", tc.specs, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Command dns-server is a DNS server: an authoritative server for the
+// zones it is given, a forwarder to a resolver for the rest, and the
+// tools for running both. The flags and subcommands are those of
+// dnsserver.Main.
+package main
+
+import dnsserver "github.com/bibektamang7/dns-server"
+
+func main() {
+	dnsserver.Main()
+}
@@ -0,0 +1,221 @@
+package dnsserver
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// The compare subcommand sends the same queries to several servers and
+// reports where their responses differ, for checking a new resolver or
+// blocklist before switching to it:
+//
+//	dns-server compare -target 1.1.1.1:53 -target 9.9.9.9:53 -sample 0.1 queries.log
+//	dns-server compare -target config:old.conf -target config:new.conf queries.log
+//
+// Queries come from a query log, a capture or a names file, as for replay
+// and bench. A config:path target is this binary started with that
+// configuration on a free loopback port, without its other listeners, so
+// two configurations can be compared side by side. Responses differ when
+// their RCODEs or, unless -rcode-only, their answer sets do.
+
+type compareTarget struct {
+	name   string
+	addr   *net.UDPAddr
+	server *benchServer
+
+	failed    int
+	latencies []time.Duration
+}
+
+// compareResult holds the responses of every target to one query.
+type compareResult struct {
+	query   *replayQuery
+	results []*replayResult
+}
+
+// differs reports whether the targets that answered disagree.
+func (c *compareResult) differs(rcodeOnly bool) bool {
+	var first *replayResult
+	for _, r := range c.results {
+		if r.err != nil {
+			continue
+		}
+		if first == nil {
+			first = r
+			continue
+		}
+		if r.rcode != first.rcode || !rcodeOnly && !sameAnswers(r.answers, first.answers) {
+			return true
+		}
+	}
+	return false
+}
+
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	var targetSpecs listFlag
+	fs.Var(&targetSpecs, "target", "Server to send the queries to, as host:port or config:path (repeatable, at least two)")
+	format := fs.String("format", "auto", "Input format: auto, text, json or csv query logs, pcap, or names (a name and optional type per line)")
+	port := fs.Int("port", 0, "For pcap input, only use queries sent to this port (0 uses all)")
+	sample := fs.Float64("sample", 1, "Fraction of the queries to send, picked at random")
+	limit := fs.Int("limit", 0, "Send at most this many queries (0 sends all)")
+	rate := fs.Float64("rate", 100, "Queries per second (0 sends as fast as -concurrency allows)")
+	concurrency := fs.Int("concurrency", 10, "Queries in flight at once")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for each response")
+	rcodeOnly := fs.Bool("rcode-only", false, "Only compare RCODEs, not answers, for upstreams that pick different addresses")
+	show := fs.Int("show", 20, "How many differing responses to print")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server compare -target a -target b [flags] file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || len(targetSpecs) < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var queries []*replayQuery
+	var err error
+	if *format == "names" {
+		queries, err = readBenchNames(fs.Arg(0))
+	} else {
+		queries, err = readReplayQueries(fs.Arg(0), *format, *port)
+	}
+	if err != nil {
+		return err
+	}
+	if *sample < 1 {
+		queries = slices.DeleteFunc(queries, func(*replayQuery) bool { return rand.Float64() >= *sample })
+	}
+	if *limit > 0 && len(queries) > *limit {
+		queries = queries[:*limit]
+	}
+
+	var targets []*compareTarget
+	defer func() {
+		for _, t := range targets {
+			if t.server != nil {
+				t.server.stop()
+			}
+		}
+	}()
+	for _, spec := range targetSpecs {
+		t := &compareTarget{name: spec}
+		addr := spec
+		if path, ok := strings.CutPrefix(spec, "config:"); ok {
+			t.server = &benchServer{}
+			if err := t.server.start([]string{"-config", path, "-metrics-addr=", "-health-addr=", "-admin-addr=",
+				"-control-socket=", "-acme-addr="}); err != nil {
+				return fmt.Errorf("%s: %v", spec, err)
+			}
+			addr = t.server.addr
+		}
+		if t.addr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+			return err
+		}
+		targets = append(targets, t)
+	}
+
+	jobs := make(chan *replayQuery)
+	results := make(chan *compareResult)
+	var wg sync.WaitGroup
+	for range max(*concurrency, 1) {
+		conns := make([]*net.UDPConn, len(targets))
+		for i, t := range targets {
+			if conns[i], err = net.DialUDP("udp", nil, t.addr); err != nil {
+				return err
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range jobs {
+				c := &compareResult{query: q, results: make([]*replayResult, len(conns))}
+				var each sync.WaitGroup
+				for i, conn := range conns {
+					each.Add(1)
+					go func() {
+						defer each.Done()
+						c.results[i] = replayOne(conn, q, *timeout)
+					}()
+				}
+				each.Wait()
+				results <- c
+			}
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+	}
+	start := time.Now()
+	go func() {
+		for i, q := range queries {
+			if *rate > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(i) / *rate * float64(time.Second)))))
+			}
+			jobs <- q
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var compared, differing int
+	for c := range results {
+		answered := 0
+		for i, r := range c.results {
+			if r.err != nil {
+				targets[i].failed++
+				continue
+			}
+			answered++
+			targets[i].latencies = append(targets[i].latencies, r.took)
+		}
+		if answered < 2 {
+			continue
+		}
+		compared++
+		if !c.differs(*rcodeOnly) {
+			continue
+		}
+		differing++
+		if differing > *show {
+			continue
+		}
+		fmt.Printf("differ %s %s:\n", fqdn(c.query.name), dnswire.TypeString(c.query.qtype))
+		for i, r := range c.results {
+			got := "failed: " + fmt.Sprint(r.err)
+			if r.err == nil {
+				got = strings.TrimSpace(r.rcode + " " + strings.Join(r.answers, ", "))
+			}
+			fmt.Printf("  %s: %s\n", targets[i].name, got)
+		}
+	}
+
+	fmt.Printf("queries=%d\n", len(queries))
+	fmt.Printf("compared=%d\n", compared)
+	fmt.Printf("differing=%d\n", differing)
+	for _, t := range targets {
+		fmt.Printf("%s.failed=%d\n", t.name, t.failed)
+		if len(t.latencies) == 0 {
+			continue
+		}
+		slices.Sort(t.latencies)
+		for _, p := range []int{50, 90, 99} {
+			fmt.Printf("%s.latency.p%d=%s\n", t.name, p, t.latencies[(len(t.latencies)-1)*p/100])
+		}
+	}
+	if differing > 0 {
+		return fmt.Errorf("%d of %d responses differ", differing, compared)
+	}
+	return nil
+}
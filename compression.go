@@ -0,0 +1,148 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Some clients mishandle compression pointers, often only in the owner
+// names of certain record types. -no-compression sends them responses
+// with every name written in full:
+//
+//	-no-compression 'clients=10.1.0.0/16,192.0.2.7'
+//	-no-compression 'types=SRV,NAPTR'
+//	-no-compression 'clients=192.0.2.0/24&types=MX'
+//	-no-compression all
+//
+// A response goes out uncompressed if a value matches it: its client is
+// in clients, when given, and it holds a record of one of types, when
+// given. Uncompressed responses are larger, so they are truncated sooner
+// over UDP. Queries the setting may apply to aren't fast forwarded, and
+// clients it names don't get answers from the wire cache. The
+// no-compression feature does the same at runtime for a client network or
+// a zone:
+//
+//	dns-server ctl -client 192.0.2.7 -ttl 1h enable-feature no-compression
+
+var uncompressedResponses = NewCounter("dns_uncompressed_responses_total", "Responses encoded without name compression.")
+
+type compressionRule struct {
+	clients []*net.IPNet
+	types   []uint16
+}
+
+// NoCompression lists the responses to send uncompressed; nil compresses
+// every response.
+type NoCompression []compressionRule
+
+func ParseNoCompression(specs []string) (NoCompression, error) {
+	var n NoCompression
+	for _, spec := range specs {
+		if spec == "all" {
+			n = append(n, compressionRule{})
+			continue
+		}
+		values, err := url.ParseQuery(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -no-compression %q: %v", spec, err)
+		}
+		var rule compressionRule
+		for key, vs := range values {
+			value := strings.Join(vs, ",")
+			switch key {
+			case "clients":
+				if rule.clients, err = server.ParseNetworks(value); err != nil {
+					return nil, fmt.Errorf("invalid -no-compression %q: %v", spec, err)
+				}
+			case "types":
+				for _, item := range strings.Split(value, ",") {
+					t, ok := dnswire.ParseType(strings.TrimSpace(item))
+					if !ok {
+						return nil, fmt.Errorf("invalid -no-compression %q: unknown type %q", spec, item)
+					}
+					rule.types = append(rule.types, t)
+				}
+			default:
+				return nil, fmt.Errorf("invalid -no-compression %q: unknown option %q, want clients or types", spec, key)
+			}
+		}
+		if len(rule.clients)+len(rule.types) == 0 {
+			return nil, fmt.Errorf("invalid -no-compression %q: give clients, types or all", spec)
+		}
+		n = append(n, rule)
+	}
+	return n, nil
+}
+
+func (r compressionRule) hasClient(ip net.IP) bool {
+	return slices.ContainsFunc(r.clients, func(n *net.IPNet) bool { return ip != nil && n.Contains(ip) })
+}
+
+// Applies reports whether the response to a query from ip goes out
+// uncompressed.
+func (n NoCompression) Applies(ip net.IP, resp *Query) bool {
+	for _, r := range n {
+		if len(r.clients) > 0 && !r.hasClient(ip) {
+			continue
+		}
+		if len(r.types) == 0 {
+			return true
+		}
+		for _, section := range [][]*ResourceRecord{resp.Answers, resp.Authorities, resp.Additionals} {
+			if slices.ContainsFunc(section, func(rr *ResourceRecord) bool { return slices.Contains(r.types, rr.Type) }) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MayApply reports whether responses to ip can go out uncompressed.
+func (n NoCompression) MayApply(ip net.IP) bool {
+	return slices.ContainsFunc(n, func(r compressionRule) bool { return len(r.clients) == 0 || r.hasClient(ip) })
+}
+
+// Names reports whether a value names ip among its clients, so its
+// responses can differ from those to other clients.
+func (n NoCompression) Names(ip net.IP) bool {
+	return slices.ContainsFunc(n, func(r compressionRule) bool { return r.hasClient(ip) })
+}
+
+// uncompressedByFeature reports whether the no-compression feature is on
+// for q.
+func (q *queryState) uncompressedByFeature() bool {
+	var name string
+	if len(q.message.Questions) > 0 {
+		name = normalizeName(q.message.Questions[0].Name)
+	}
+	return features.Enabled(featureNoCompression, q.Client().IP, name, q.start)
+}
+
+// compress reports whether resp, the response to q, is sent compressed.
+func (q *queryState) compress(resp *Query) bool {
+	return !q.uncompressedByFeature() && !q.cfg.noCompression.Applies(q.Client().IP, resp)
+}
+
+// encodeResponse appends resp to buf, compressing names if compress is
+// set.
+func encodeResponse(buf []byte, resp *Query, compress bool) ([]byte, error) {
+	if compress {
+		return resp.AppendTo(buf)
+	}
+	return resp.AppendToUncompressed(buf)
+}
+
+// encodedSize returns the length of q in wire form, or 0 if it can't be
+// encoded, encoding it into a pooled buffer.
+func encodedSize(q *Query, compress bool) int {
+	buf := server.GetBuffer(0)
+	defer server.PutBuffer(buf)
+	wire, _ := encodeResponse(*buf, q, compress)
+	return len(wire)
+}
@@ -0,0 +1,244 @@
+package dnsserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// The console subcommand is an interactive shell on a running server's
+// control socket:
+//
+//	$ dns-server console
+//	dns> query example.com MX +dnssec
+//	dns> cache example.com
+//	dns> watch client=192.0.2.0/24 rcode=SERVFAIL
+//	dns> enable-feature debug-log -client 192.0.2.7
+//
+// Queries are answered by the server as if they came from a client on
+// localhost with every permission. watch prints the queries the server
+// answers until interrupted. Every ctl command works too.
+
+const consoleHelp = `commands:
+  query name [type] [+dnssec] [+nsid] [+norec] [+noedns] [+bufsize=N] [+short] [+json]
+                          ask the server, through its whole chain
+  cache [name]            list the cached responses at or below name
+  watch [qname=name] [client=net] [type=type] [rcode=rcode]
+                          follow the queries answered until interrupted
+  stats, list-zones, reload, flush-cache, block domain, unblock domain,
+  set-log-level levels, enable-feature feature, disable-feature id,
+  list-features, capture-start file, capture-stop
+                          as for ctl, with the same flags
+  help, quit
+`
+
+func runConsole(args []string) error {
+	fs := flag.NewFlagSet("console", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "The server's -control-socket")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server console [-socket path]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := newCtlClient(*socket)
+	if _, err := c.call("GET", "/zones", nil); err != nil {
+		return fmt.Errorf("console: %v", err)
+	}
+
+	// The prompt is only shown to people, not to scripts piping commands.
+	prompt := ""
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		prompt = "dns> "
+		fmt.Println(`connected to ` + *socket + `; "help" lists the commands`)
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for fmt.Print(prompt); scanner.Scan(); fmt.Print(prompt) {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		var err error
+		switch words[0] {
+		case "quit", "exit":
+			return nil
+		case "help", "?":
+			fmt.Print(consoleHelp)
+		case "query":
+			err = consoleQuery(c, words[1:])
+		case "cache":
+			err = consoleCache(c, words[1:])
+		case "watch":
+			err = consoleWatch(c, words[1:])
+		case "drain":
+			// Not by accident from an interactive session.
+			err = fmt.Errorf("use ctl drain to shut the server down")
+		default:
+			fs := flag.NewFlagSet(words[0], flag.ContinueOnError)
+			flags := newCtlFlags(fs)
+			var cmdArgs []string
+			if cmdArgs, err = parseCtlArgs(fs, words[1:]); err == nil {
+				err = c.command(words[0], cmdArgs, flags)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+	if prompt != "" {
+		fmt.Println()
+	}
+	return scanner.Err()
+}
+
+func consoleQuery(c *ctlClient, words []string) error {
+	opts := queryOptions{edns: true, bufsize: 1232, recurse: true}
+	name, qtype := "", uint16(0)
+	for _, w := range words {
+		switch {
+		case strings.HasPrefix(w, "+"):
+			if err := opts.set(w[1:]); err != nil {
+				return err
+			}
+		case name == "":
+			name = w
+		case qtype == 0 && isType(w):
+			qtype, _ = dnswire.ParseType(strings.ToUpper(w))
+		default:
+			return fmt.Errorf("unexpected argument %q", w)
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("query needs a name")
+	}
+	if opts.net != "" {
+		return fmt.Errorf("+%s: the console asks the server directly", opts.net)
+	}
+	if qtype == 0 {
+		qtype = TypeA
+	}
+	q := dnswire.NewQuery(name, qtype)
+	q.Header.RD = opts.recurse
+	if opts.edns {
+		q.SetEDNS(opts.bufsize, opts.dnssec)
+		if opts.nsid {
+			q = withEDNSOption(q, ednsOptionNSID, nil, 0)
+		}
+	}
+	wire, err := q.Encode()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://control/query", bytes.NewReader(wire))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	reply, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp, err := dnswire.ParseMessage(reply)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.json:
+		out, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	case opts.short:
+		for _, rr := range resp.Answers {
+			fmt.Println(dnswire.FormatRData(rr.Type, rr.RData))
+		}
+	default:
+		printResponse(os.Stdout, resp)
+	}
+	return nil
+}
+
+func consoleCache(c *ctlClient, words []string) error {
+	if len(words) > 1 {
+		return fmt.Errorf("cache takes at most a name")
+	}
+	name := ""
+	if len(words) == 1 {
+		name = words[0]
+	}
+	body, err := c.call("GET", "/cache?"+url.Values{"name": {name}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var entries []wireCacheEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		answers := "-"
+		if len(e.Answers) > 0 {
+			answers = strings.Join(e.Answers, ", ")
+		}
+		fmt.Printf("%s %s %s limit=%d ttl=%.0fs %s %s\n", e.Name, e.Type, e.Flags, e.Limit, e.TTL, e.RCode, answers)
+	}
+	fmt.Printf("%d entries\n", len(entries))
+	return nil
+}
+
+// consoleWatch prints the queries the server answers until interrupted.
+func consoleWatch(c *ctlClient, words []string) error {
+	filter := url.Values{}
+	for _, w := range words {
+		k, v, ok := strings.Cut(w, "=")
+		switch {
+		case !ok:
+			return fmt.Errorf("want filters as key=value, got %q", w)
+		case k == "qname" || k == "client" || k == "type" || k == "rcode":
+			filter.Set(k, v)
+		default:
+			return fmt.Errorf("unknown filter %q, want qname, client, type or rcode", k)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://control/watch?"+filter.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("%s", strings.TrimSpace(msg.String()))
+	}
+	fmt.Println("watching; interrupt to stop")
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e queryLogEntry
+		if err := dec.Decode(&e); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		os.Stdout.Write(e.text())
+	}
+}
@@ -0,0 +1,500 @@
+package dnsserver
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+const defaultControlSocket = "/run/dns-server.sock"
+
+// Control serves the operational commands on a unix socket as a small
+// REST API: GET /stats, /zones, /features, /cache and /watch, and POST
+// /reload, /flush-cache, /block, /unblock, /log-level, /features,
+// /features/disable, /capture/start, /capture/stop, /drain and /query. The
+// ctl and console subcommands are its clients.
+// Anyone who can connect can reconfigure the server, so the socket is only
+// accessible to its owner. Every change made through it is audited with
+// the connecting user as the actor, where the platform tells who it is.
+type Control struct {
+	// Reload reloads the configuration on behalf of actor.
+	Reload func(actor string) error
+	Stats  *Stats
+	// FlushCache empties the response cache and returns how many entries
+	// it held. It is nil when there is no cache.
+	FlushCache func() int
+	// CacheEntries lists the cached responses for names at or below a
+	// name. It is nil when there is no cache.
+	CacheEntries func(name string) []wireCacheEntry
+	// Query answers an encoded query the way the listeners do.
+	Query func(query []byte) ([]byte, error)
+}
+
+func listenControl(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (c *Control) Serve(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", c.Stats.ServeHTTP)
+	mux.HandleFunc("GET /zones", c.zones)
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.Reload(controlActor(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "configuration reloaded")
+	})
+	mux.HandleFunc("POST /flush-cache", func(w http.ResponseWriter, r *http.Request) {
+		if c.FlushCache == nil {
+			http.Error(w, "no cache configured", http.StatusNotFound)
+			return
+		}
+		n := c.FlushCache()
+		auditLog.Record(auditRecord{Actor: controlActor(r), Action: "flush-cache", Old: []string{fmt.Sprintf("%d entries", n)}})
+		fmt.Fprintf(w, "flushed %d entries\n", n)
+	})
+	mux.HandleFunc("GET /cache", func(w http.ResponseWriter, r *http.Request) {
+		if c.CacheEntries == nil {
+			http.Error(w, "no cache configured", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.CacheEntries(r.FormValue("name")))
+	})
+	mux.HandleFunc("POST /query", func(w http.ResponseWriter, r *http.Request) {
+		query, err := io.ReadAll(io.LimitReader(r.Body, 65535))
+		if err != nil || len(query) == 0 {
+			http.Error(w, "invalid DNS message", http.StatusBadRequest)
+			return
+		}
+		reply, err := c.Query(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(reply)
+	})
+	mux.HandleFunc("GET /watch", c.watch)
+	mux.HandleFunc("POST /block", c.block(true))
+	mux.HandleFunc("POST /unblock", c.block(false))
+	mux.HandleFunc("POST /log-level", c.setLogLevels)
+	mux.HandleFunc("GET /features", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(features.List(time.Now()))
+	})
+	mux.HandleFunc("POST /features", c.enableFeature)
+	mux.HandleFunc("POST /features/disable", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		o := features.Disable(id)
+		if o == nil {
+			http.Error(w, "no such feature override", http.StatusNotFound)
+			return
+		}
+		auditLog.Record(auditRecord{Actor: controlActor(r), Action: "feature-disable", Name: o.Feature, Old: []string{o.Scope()}})
+		logServer.Info("feature override removed", "feature", o.Feature, "scope", o.Scope())
+		fmt.Fprintf(w, "disabled %s for %s\n", o.Feature, o.Scope())
+	})
+	mux.HandleFunc("POST /capture/start", func(w http.ResponseWriter, r *http.Request) {
+		packets, err := strconv.Atoi(cmp.Or(r.FormValue("packets"), "0"))
+		if err != nil {
+			http.Error(w, "invalid packets", http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(cmp.Or(r.FormValue("duration"), "0s"))
+		if err != nil {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		file := r.FormValue("file")
+		if file == "" {
+			http.Error(w, "missing file", http.StatusBadRequest)
+			return
+		}
+		if _, err := StartCapture(file, r.FormValue("qname"), r.FormValue("client"), packets, duration); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		auditLog.Record(auditRecord{Actor: controlActor(r), Action: "capture-start", New: []string{file}})
+		fmt.Fprintln(w, "capturing to", file)
+	})
+	mux.HandleFunc("POST /capture/stop", func(w http.ResponseWriter, r *http.Request) {
+		c, err := StopCapture()
+		if c == nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditLog.Record(auditRecord{Actor: controlActor(r), Action: "capture-stop", Old: []string{c.Path}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "captured %d packets to %s\n", c.Packets(), c.Path)
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		logServer.Info("drain requested")
+		auditLog.Record(auditRecord{Actor: controlActor(r), Action: "drain"})
+		shutdown.Request()
+		fmt.Fprintln(w, "draining")
+	})
+	srv := &http.Server{
+		Handler: mux,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, controlPeerKey{}, controlPeer(conn))
+		},
+	}
+	logServer.Error("serving control socket failed", "err", srv.Serve(ln))
+}
+
+type controlPeerKey struct{}
+
+// controlActor names who sent r for the audit log.
+func controlActor(r *http.Request) string {
+	if peer, _ := r.Context().Value(controlPeerKey{}).(string); peer != "" {
+		return "control socket: " + peer
+	}
+	return "control socket"
+}
+
+// setLogLevels changes the log levels, with a ttl only for that long.
+func (c *Control) setLogLevels(w http.ResponseWriter, r *http.Request) {
+	ttl, err := time.ParseDuration(cmp.Or(r.FormValue("ttl"), "0s"))
+	if err != nil || ttl < 0 || ttl > maxFeatureTTL {
+		http.Error(w, "invalid ttl", http.StatusBadRequest)
+		return
+	}
+	levels := r.FormValue("levels")
+	old := logLevels.Load()
+	if err := setLogLevels(levels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditLog.Record(auditRecord{Actor: controlActor(r), Action: "log-level", Old: []string{old.spec}, New: []string{levels}})
+	logServer.Info("log levels changed", "levels", levels, "ttl", ttl)
+	if ttl == 0 {
+		fmt.Fprintln(w, "log levels set to", levels)
+		return
+	}
+	// Unless they were changed again in the meantime, the old levels come
+	// back once the ttl is over.
+	set := logLevels.Load()
+	time.AfterFunc(ttl, func() {
+		if logLevels.CompareAndSwap(set, old) {
+			auditLog.Record(auditRecord{Actor: "expiry", Action: "log-level", Old: []string{levels}, New: []string{old.spec}})
+			logServer.Info("log levels restored", "levels", old.spec)
+		}
+	})
+	fmt.Fprintf(w, "log levels set to %s for %v\n", levels, ttl)
+}
+
+func (c *Control) enableFeature(w http.ResponseWriter, r *http.Request) {
+	ttl, err := time.ParseDuration(cmp.Or(r.FormValue("ttl"), "0s"))
+	if err != nil {
+		http.Error(w, "invalid ttl", http.StatusBadRequest)
+		return
+	}
+	o, err := features.Enable(r.FormValue("feature"), r.FormValue("zone"), r.FormValue("client"), ttl, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditLog.Record(auditRecord{Actor: controlActor(r), Action: "feature-enable", Name: o.Feature,
+		New: []string{o.Scope(), "until " + o.Expires.UTC().Format(time.RFC3339)}})
+	logServer.Info("feature override added", "feature", o.Feature, "scope", o.Scope(), "expires", o.Expires)
+	fmt.Fprintf(w, "enabled %s for %s until %s (id %d)\n", o.Feature, o.Scope(), o.Expires.Format(time.RFC3339), o.ID)
+}
+
+// watch streams the queries answered, as JSON query log entries, until
+// the client goes away.
+func (c *Control) watch(w http.ResponseWriter, r *http.Request) {
+	qw, err := WatchQueries(r.FormValue("qname"), r.FormValue("client"), r.FormValue("type"), r.FormValue("rcode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer qw.Stop()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-qw.C:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// controlClientInfo describes the client of queries made through the
+// control socket. Whoever can connect to it controls the server, so it may
+// do anything a client can.
+func controlClientInfo() *server.Client {
+	acls := NewACLSet()
+	for _, c := range server.Capabilities {
+		acls.Set(c, false, "any")
+	}
+	return &server.Client{IP: net.IPv4(127, 0, 0, 1), ACLs: acls, Stream: true, Protocol: "control"}
+}
+
+type zoneInfo struct {
+	Origin string `json:"origin"`
+	Serial uint32 `json:"serial"`
+	Signed bool   `json:"signed"`
+}
+
+func (c *Control) zones(w http.ResponseWriter, _ *http.Request) {
+	var out []zoneInfo
+	for _, z := range currentConfig().zones.Zones() {
+		out = append(out, zoneInfo{fqdn(z.Origin), z.Serial(), z.signer != nil})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (c *Control) block(blocked bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := normalizeName(r.FormValue("domain"))
+		if name == "" {
+			http.Error(w, "missing domain", http.StatusBadRequest)
+			return
+		}
+		BlockDomain(name, blocked)
+		action := "unblock"
+		if blocked {
+			action = "block"
+		}
+		auditLog.Record(auditRecord{Actor: controlActor(r), Action: action, Name: fqdn(name)})
+		logBlocklist.Info("domain block changed", "domain", fqdn(name), "blocked", blocked)
+		if blocked {
+			fmt.Fprintln(w, "blocked", fqdn(name))
+		} else {
+			fmt.Fprintln(w, "unblocked", fqdn(name))
+		}
+	}
+}
+
+// ctlFlags are the options of the ctl commands.
+type ctlFlags struct {
+	top      *int
+	qname    *string
+	client   *string
+	zone     *string
+	ttl      *time.Duration
+	packets  *int
+	duration *time.Duration
+}
+
+func newCtlFlags(fs *flag.FlagSet) *ctlFlags {
+	return &ctlFlags{
+		top:      fs.Int("top", 10, "For stats, how many domains and clients to list"),
+		qname:    fs.String("qname", "", "For capture-start, only capture messages about this name and names below it"),
+		client:   fs.String("client", "", "For capture-start, only capture traffic with this client address or network; for enable-feature, only enable it for them"),
+		zone:     fs.String("zone", "", "For enable-feature, only enable it for names at or below this zone"),
+		ttl:      fs.Duration("ttl", 0, "For enable-feature, how long until it turns itself off (default 15m); for set-log-level, how long until the old levels return"),
+		packets:  fs.Int("packets", 0, "For capture-start, stop after this many packets"),
+		duration: fs.Duration("duration", 0, "For capture-start, stop after this long"),
+	}
+}
+
+// parseCtlArgs parses args with fs, returning the words between the flags.
+func parseCtlArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return words, nil
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// runCtl sends one command to a running server's control socket.
+func runCtl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "The server's -control-socket")
+	flags := newCtlFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server ctl [-socket path] command [argument]")
+		fmt.Fprintln(fs.Output(), "commands: reload, flush-cache, stats, list-zones, block domain, unblock domain, set-log-level levels,")
+		fmt.Fprintln(fs.Output(), "  enable-feature "+strings.Join(knownFeatures, "|")+", disable-feature id, list-features,")
+		fmt.Fprintln(fs.Output(), "  capture-start file, capture-stop, drain")
+		fs.PrintDefaults()
+	}
+	// Flags may also follow the command and its argument.
+	words, _ := parseCtlArgs(fs, args)
+	if len(words) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return newCtlClient(*socket).command(words[0], words[1:], flags)
+}
+
+// ctlClient calls the control API of a running server.
+type ctlClient struct {
+	http *http.Client
+}
+
+func newCtlClient(socket string) *ctlClient {
+	return &ctlClient{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+func (c *ctlClient) call(method, path string, form url.Values) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://control"+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+func (c *ctlClient) do(req *http.Request) ([]byte, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// command runs one ctl command and prints what it returns.
+func (c *ctlClient) command(cmd string, cmdArgs []string, f *ctlFlags) error {
+	arg := func() (string, error) {
+		if len(cmdArgs) != 1 {
+			return "", fmt.Errorf("%s takes one argument", cmd)
+		}
+		return cmdArgs[0], nil
+	}
+
+	var body []byte
+	var err error
+	switch cmd {
+	case "reload", "flush-cache", "drain":
+		body, err = c.call("POST", "/"+cmd, nil)
+	case "capture-start":
+		var file string
+		if file, err = arg(); err == nil {
+			if file, err = filepath.Abs(file); err == nil {
+				body, err = c.call("POST", "/capture/start", url.Values{
+					"file": {file}, "qname": {*f.qname}, "client": {*f.client},
+					"packets": {strconv.Itoa(*f.packets)}, "duration": {f.duration.String()},
+				})
+			}
+		}
+	case "capture-stop":
+		body, err = c.call("POST", "/capture/stop", nil)
+	case "block", "unblock":
+		var domain string
+		if domain, err = arg(); err == nil {
+			body, err = c.call("POST", "/"+cmd, url.Values{"domain": {domain}})
+		}
+	case "set-log-level":
+		var levels string
+		if levels, err = arg(); err == nil {
+			body, err = c.call("POST", "/log-level", url.Values{"levels": {levels}, "ttl": {f.ttl.String()}})
+		}
+	case "enable-feature":
+		var feature string
+		if feature, err = arg(); err == nil {
+			body, err = c.call("POST", "/features", url.Values{
+				"feature": {feature}, "zone": {*f.zone}, "client": {*f.client}, "ttl": {f.ttl.String()},
+			})
+		}
+	case "disable-feature":
+		var id string
+		if id, err = arg(); err == nil {
+			body, err = c.call("POST", "/features/disable", url.Values{"id": {id}})
+		}
+	case "list-features":
+		if body, err = c.call("GET", "/features", nil); err == nil {
+			var overrides []*FeatureOverride
+			if err := json.Unmarshal(body, &overrides); err != nil {
+				return err
+			}
+			for _, o := range overrides {
+				fmt.Printf("%d %s %s until %s\n", o.ID, o.Feature, o.Scope(), o.Expires.Format(time.RFC3339))
+			}
+			return nil
+		}
+	case "stats":
+		if body, err = c.call("GET", "/stats?top="+strconv.Itoa(*f.top), nil); err == nil {
+			var snap StatsSnapshot
+			if err := json.Unmarshal(body, &snap); err != nil {
+				return err
+			}
+			printStats(snap)
+			return nil
+		}
+	case "list-zones":
+		if body, err = c.call("GET", "/zones", nil); err == nil {
+			var zones []zoneInfo
+			if err := json.Unmarshal(body, &zones); err != nil {
+				return err
+			}
+			for _, z := range zones {
+				signed := ""
+				if z.Signed {
+					signed = " signed"
+				}
+				fmt.Printf("%s serial=%d%s\n", z.Origin, z.Serial, signed)
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(body)
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// controlPeer describes the process on the other end of a control socket
+// connection.
+func controlPeer(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return ""
+	}
+	uid := strconv.Itoa(int(cred.Uid))
+	if u, err := user.LookupId(uid); err == nil {
+		return fmt.Sprintf("%s (uid %s, pid %d)", u.Username, uid, cred.Pid)
+	}
+	return fmt.Sprintf("uid %s, pid %d", uid, cred.Pid)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package dnsserver
+
+import "net"
+
+func controlPeer(conn net.Conn) string {
+	return ""
+}
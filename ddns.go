@@ -0,0 +1,212 @@
+package dnsserver
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// Served zones take RFC 2136 dynamic updates, as the update subcommand
+// sends them, from clients -allow-update admits that sign them with TSIG
+// or SIG(0). Each update is checked against its prerequisites and made
+// whole or not at all, under the zone lock. Like transactions, the changes
+// last until the zone is reloaded.
+//
+// Deletions of the apex SOA and NS records are ignored, as RFC 2136
+// section 3.4.2 has them; other changes the zone can't take, such as
+// adding those records or a CNAME beside other data, refuse the update.
+
+const opcodeUpdate = 5
+
+var dynamicUpdates = NewCounterVec("dns_updates_total", "Dynamic updates received, by response code.", "rcode")
+
+// updateStage applies UPDATE messages to the served zones and passes on
+// everything else.
+func (p *Pipeline) updateStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		if m.Header.Opcode != opcodeUpdate {
+			next.ServeDNS(w, m)
+			return
+		}
+		q := stateOf(w)
+		done := q.stages.Time("update")
+		rcode := q.update(m)
+		done()
+		dynamicUpdates.With(dnswire.RCodeString(rcode)).Inc()
+		q.send(errorResponse(m, rcode))
+	})
+}
+
+// notImplementedUpdates answers UPDATE messages with NOTIMP, for chains
+// without the update stage, whose other stages would take them for
+// queries.
+func notImplementedUpdates(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		if m.Header.Opcode == opcodeUpdate {
+			stateOf(w).send(errorResponse(m, RCodeNotImplemented))
+			return
+		}
+		next.ServeDNS(w, m)
+	})
+}
+
+// update applies the update m and returns the response code.
+func (q *queryState) update(m *Message) uint8 {
+	if q.auth == nil {
+		q.qlog.Warn("unsigned update refused")
+		return RCodeRefused
+	}
+	// The zone section takes the place of the question.
+	if len(m.Questions) != 1 || m.Questions[0].QType != TypeSOA {
+		return RCodeFormatError
+	}
+	origin := normalizeName(m.Questions[0].Name)
+	z := q.zones().Find(origin)
+	if z == nil || z.Origin != origin {
+		return RCodeNotAuth
+	}
+	edits, err := updateEdits(z, m.Authorities)
+	if err != nil {
+		return dnswire.RCodeOf(err)
+	}
+	old := z.rrsetTexts()
+	serial, err := z.applyIf(func() error { return z.prerequisites(m.Answers) }, edits)
+	var rcode dnswire.RCodeError
+	switch {
+	case errors.As(err, &rcode):
+		q.qlog.Info("update prerequisite failed", "zone", fqdn(z.Origin), "signer", q.auth.Signer, "rcode", dnswire.RCodeString(uint8(rcode)))
+		return uint8(rcode)
+	case err != nil:
+		q.qlog.Warn("update refused", "zone", fqdn(z.Origin), "signer", q.auth.Signer, "err", err)
+		return RCodeRefused
+	}
+	auditRRsets(q.auth.Signer+" from "+q.Client().IP.String(), z.Origin, old, z.rrsetTexts())
+	q.qlog.Info("zone updated", "zone", fqdn(z.Origin), "signer", q.auth.Signer, "edits", len(edits), "serial", serial, "took", time.Since(q.start))
+	return RCodeSuccess
+}
+
+// metaType reports whether t is a type that only appears in questions or
+// stands for no record, such as ANY and AXFR.
+func metaType(t uint16) bool {
+	return t == TypeOPT || t >= 128 && t <= 255
+}
+
+// updateEdits checks the update section of an update to z and returns its
+// changes as edits (RFC 2136 section 3.4).
+func updateEdits(z *Zone, rrs []*ResourceRecord) ([]ZoneEdit, error) {
+	edits := make([]ZoneEdit, 0, len(rrs))
+	for _, rr := range rrs {
+		name := normalizeName(rr.Name)
+		if !inZone(name, z.Origin) {
+			return nil, dnswire.RCodeError(RCodeNotZone)
+		}
+		switch {
+		case rr.Class == ClassINET && !metaType(rr.Type):
+			// The message is pooled, and its records read from a
+			// buffer the next query reuses. Compressed names in the
+			// rdata were expanded when it was parsed, so the copy
+			// stands on its own.
+			added := *rr
+			added.RData = bytes.Clone(rr.RData)
+			edits = append(edits, ZoneEdit{Add: true, Record: &added})
+			continue
+		case rr.Class == ClassANY && rr.TTL == 0 && len(rr.RData) == 0 && (rr.Type == TypeANY || !metaType(rr.Type)):
+		case rr.Class == ClassNONE && rr.TTL == 0 && len(rr.RData) > 0 && !metaType(rr.Type):
+		default:
+			return nil, ErrFormat
+		}
+		if name == z.Origin && (rr.Type == TypeSOA || rr.Type == TypeNS) {
+			continue
+		}
+		del := *rr
+		if rr.Class == ClassANY {
+			// Class ANY deletes the RRset, or with type ANY every RRset
+			// at the name.
+			del.RData = nil
+			if rr.Type == TypeANY {
+				del.Type = 0
+			}
+		}
+		edits = append(edits, ZoneEdit{Record: &del})
+	}
+	return edits, nil
+}
+
+// prerequisites checks the prerequisite section of an update to z (RFC
+// 2136 section 3.2), returning an RCodeError if it doesn't hold. The
+// caller holds z.mu.
+func (z *Zone) prerequisites(rrs []*ResourceRecord) error {
+	// Value dependent prerequisites list whole RRsets, which are compared
+	// once they are gathered.
+	want := map[string]map[uint16][][]byte{}
+	for _, rr := range rrs {
+		name := normalizeName(rr.Name)
+		if rr.TTL != 0 {
+			return ErrFormat
+		}
+		if !inZone(name, z.Origin) {
+			return dnswire.RCodeError(RCodeNotZone)
+		}
+		sets := z.rrsets[name]
+		switch rr.Class {
+		case ClassANY, ClassNONE:
+			if len(rr.RData) != 0 || rr.Type != TypeANY && metaType(rr.Type) {
+				return ErrFormat
+			}
+			exists := len(sets) > 0
+			if rr.Type != TypeANY {
+				exists = len(sets[rr.Type]) > 0
+			}
+			switch {
+			case rr.Class == ClassANY && !exists && rr.Type == TypeANY:
+				return ErrNXDomain
+			case rr.Class == ClassANY && !exists:
+				return dnswire.RCodeError(RCodeNXRRSet)
+			case rr.Class == ClassNONE && exists && rr.Type == TypeANY:
+				return dnswire.RCodeError(RCodeYXDomain)
+			case rr.Class == ClassNONE && exists:
+				return dnswire.RCodeError(RCodeYXRRSet)
+			}
+		case ClassINET:
+			if metaType(rr.Type) {
+				return ErrFormat
+			}
+			if want[name] == nil {
+				want[name] = map[uint16][][]byte{}
+			}
+			want[name][rr.Type] = append(want[name][rr.Type], rr.RData)
+		default:
+			return ErrFormat
+		}
+	}
+	for name, types := range want {
+		for t, rdatas := range types {
+			if !sameRData(z.rrsets[name][t], rdatas) {
+				return dnswire.RCodeError(RCodeNXRRSet)
+			}
+		}
+	}
+	return nil
+}
+
+// sameRData reports whether rrset holds exactly the records rdatas, in any
+// order and counting repeats once.
+func sameRData(rrset []*ResourceRecord, rdatas [][]byte) bool {
+	if len(rrset) == 0 {
+		return false
+	}
+	for _, rdata := range rdatas {
+		if !slices.ContainsFunc(rrset, func(rr *ResourceRecord) bool { return bytes.Equal(rr.RData, rdata) }) {
+			return false
+		}
+	}
+	for _, rr := range rrset {
+		if !slices.ContainsFunc(rdatas, func(rdata []byte) bool { return bytes.Equal(rr.RData, rdata) }) {
+			return false
+		}
+	}
+	return true
+}
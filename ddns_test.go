@@ -0,0 +1,60 @@
+package dnsserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 300
+@    IN SOA ns1 hostmaster ( 2024010101 3600 600 86400 60 )
+     IN NS ns1
+ns1  IN A 192.0.2.1
+www  IN A 192.0.2.10
+mail IN MX 10 www
+`
+
+// testZone returns example.com as testZoneFile has it.
+func testZone(t testing.TB) *Zone {
+	t.Helper()
+	records, err := ParseZone(strings.NewReader(testZoneFile), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := NewZone("example.com", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestUpdateCompressedRData(t *testing.T) {
+	// An update adding alias.example.com CNAME www.example.com, with the
+	// owner and the target both pointing at the zone name at offset 12.
+	data := []byte{0, 1, 0x28, 0, 0, 1, 0, 0, 0, 1, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 6, 0, 1,
+		5, 'a', 'l', 'i', 'a', 's', 0xc0, 12, 0, 5, 0, 1, 0, 0, 1, 0x2c, 0, 6, 3, 'w', 'w', 'w', 0xc0, 12}
+	m, err := dnswire.ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := testZone(t)
+	edits, err := updateEdits(z, m.Authorities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The buffer goes on to hold the next query.
+	clear(data)
+	if _, err := z.Apply(edits); err != nil {
+		t.Fatal(err)
+	}
+	rrset := z.rrsets["alias.example.com"][TypeCNAME]
+	if len(rrset) != 1 {
+		t.Fatalf("alias.example.com has %d CNAME records, want 1", len(rrset))
+	}
+	if got := dnswire.FormatRData(TypeCNAME, rrset[0].RData); got != "www.example.com." {
+		t.Errorf("stored CNAME is %q, want www.example.com.", got)
+	}
+}
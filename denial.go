@@ -0,0 +1,394 @@
+package dnsserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+type NSEC3Params struct {
+	Iterations uint16
+	Salt       []byte
+	// OptOut leaves insecure delegations out of the chain (RFC 5155 section 6).
+	OptOut bool
+}
+
+type nsec3Entry struct {
+	hash   []byte
+	bitmap []byte
+	rrset  []*ResourceRecord
+}
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.Sum(append(canonicalName(name), salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return h[:]
+}
+
+func (z *Zone) hashedOwner(hash []byte) string {
+	label := strings.ToLower(base32Hex.EncodeToString(hash))
+	if z.Origin == "" {
+		return label
+	}
+	return label + "." + z.Origin
+}
+
+// typesAt lists the authoritative types present at name, leaving out the
+// child side data at delegation points and the DNSSEC meta types.
+func (z *Zone) typesAt(name string) []uint16 {
+	var types []uint16
+	for t := range z.rrsets[name] {
+		if t == TypeRRSIG || t == TypeNSEC {
+			continue
+		}
+		if z.isDelegation(name) && t != TypeNS && t != TypeDS {
+			continue
+		}
+		types = append(types, t)
+	}
+	return types
+}
+
+func (z *Zone) insecureDelegation(name string) bool {
+	return z.isDelegation(name) && len(z.rrsets[name][TypeDS]) == 0
+}
+
+// buildDenialChain creates the NSEC or NSEC3 chain for a signed zone. The
+// caller holds z.mu. With white lies nothing is precomputed: denial
+// records are synthesized per query instead, so the zone can't be walked.
+func (z *Zone) buildDenialChain() {
+	z.nsec3 = nil
+	for _, sets := range z.rrsets {
+		delete(sets, TypeNSEC)
+	}
+	delete(z.rrsets[z.Origin], TypeNSEC3PARAM)
+
+	params := z.signer.NSEC3
+	if params != nil {
+		z.rrsets[z.Origin][TypeNSEC3PARAM] = []*ResourceRecord{{
+			Name:  z.Origin,
+			Type:  TypeNSEC3PARAM,
+			Class: ClassINET,
+			TTL:   0,
+			RData: nsec3ParamRData(params),
+		}}
+	}
+	if z.signer.WhiteLies {
+		return
+	}
+
+	if params == nil {
+		for i, name := range z.names {
+			next := z.names[(i+1)%len(z.names)]
+			z.rrsets[name][TypeNSEC] = []*ResourceRecord{z.newNSEC(name, next, append(z.typesAt(name), TypeRRSIG, TypeNSEC))}
+		}
+		return
+	}
+
+	// The NSEC3 chain covers every authoritative name and empty
+	// non-terminal, minus insecure delegations under opt-out.
+	for name := range z.exists {
+		if !inZone(name, z.Origin) || z.occluded(name) || (params.OptOut && z.insecureDelegation(name)) {
+			continue
+		}
+		types := z.typesAt(name)
+		if len(types) > 0 && !z.insecureDelegation(name) {
+			types = append(types, TypeRRSIG)
+		}
+		z.nsec3 = append(z.nsec3, &nsec3Entry{
+			hash:   nsec3Hash(name, params.Salt, params.Iterations),
+			bitmap: typeBitmap(types),
+		})
+	}
+	sort.Slice(z.nsec3, func(i, j int) bool { return bytes.Compare(z.nsec3[i].hash, z.nsec3[j].hash) < 0 })
+	for i, e := range z.nsec3 {
+		next := z.nsec3[(i+1)%len(z.nsec3)].hash
+		e.rrset = []*ResourceRecord{z.newNSEC3(e.hash, next, e.bitmap)}
+	}
+}
+
+func (z *Zone) newNSEC(owner, next string, types []uint16) *ResourceRecord {
+	return &ResourceRecord{
+		Name:  owner,
+		Type:  TypeNSEC,
+		Class: ClassINET,
+		TTL:   z.negativeTTL(),
+		RData: append(appendName(nil, next), typeBitmap(types)...),
+	}
+}
+
+func (z *Zone) newNSEC3(hash, next, bitmap []byte) *ResourceRecord {
+	params := z.signer.NSEC3
+	var flags byte
+	if params.OptOut {
+		flags = 1
+	}
+	rdata := []byte{1, flags}
+	rdata = binary.BigEndian.AppendUint16(rdata, params.Iterations)
+	rdata = append(rdata, byte(len(params.Salt)))
+	rdata = append(rdata, params.Salt...)
+	rdata = append(rdata, byte(len(next)))
+	rdata = append(rdata, next...)
+	rdata = append(rdata, bitmap...)
+	return &ResourceRecord{
+		Name:  z.hashedOwner(hash),
+		Type:  TypeNSEC3,
+		Class: ClassINET,
+		TTL:   z.negativeTTL(),
+		RData: rdata,
+	}
+}
+
+func nsec3ParamRData(params *NSEC3Params) []byte {
+	rdata := []byte{1, 0}
+	rdata = binary.BigEndian.AppendUint16(rdata, params.Iterations)
+	rdata = append(rdata, byte(len(params.Salt)))
+	return append(rdata, params.Salt...)
+}
+
+// proveNXDomain returns the records denying name and any wildcard that
+// could have synthesized it.
+func (z *Zone) proveNXDomain(name string) []*ResourceRecord {
+	ce := z.closestEncloser(name)
+	if z.signer.NSEC3 != nil {
+		out := z.nsec3Matching(ce)
+		out = appendDistinct(out, z.nsec3Covering(nextCloser(name, ce)))
+		return appendDistinct(out, z.nsec3Covering(wildcardName(ce)))
+	}
+	out := z.nsecCovering(name)
+	return appendDistinct(out, z.nsecCovering(wildcardName(ce)))
+}
+
+// proveNoData denies the queried type at name, or at the wildcard that
+// matched it.
+func (z *Zone) proveNoData(name, wildcard string) []*ResourceRecord {
+	if z.signer.NSEC3 != nil {
+		if wildcard == "" {
+			return z.nsec3Matching(name)
+		}
+		ce := parentName(wildcard)
+		out := z.nsec3Matching(ce)
+		out = appendDistinct(out, z.nsec3Covering(nextCloser(name, ce)))
+		return appendDistinct(out, z.nsec3Matching(wildcard))
+	}
+	if wildcard == "" {
+		return z.nsecMatching(name)
+	}
+	return appendDistinct(z.nsecCovering(name), z.nsecMatching(wildcard))
+}
+
+// proveWildcardAnswer shows that name itself does not exist, so the
+// wildcard expansion in the answer is legitimate.
+func (z *Zone) proveWildcardAnswer(name string) []*ResourceRecord {
+	if z.signer.NSEC3 != nil {
+		return z.nsec3Covering(nextCloser(name, z.closestEncloser(name)))
+	}
+	return z.nsecCovering(name)
+}
+
+// proveNoDS shows that the delegation at cut is insecure.
+func (z *Zone) proveNoDS(cut string) []*ResourceRecord {
+	if z.signer.NSEC3 == nil {
+		return z.nsecMatching(cut)
+	}
+	if out := z.nsec3Matching(cut); len(out) > 0 || z.signer.WhiteLies {
+		return out
+	}
+	// Opt-out: prove the closest provable encloser and cover the next
+	// closer name with an opt-out NSEC3.
+	ce := parentName(cut)
+	for ce != z.Origin && z.nsec3Find(ce) == nil {
+		ce = parentName(ce)
+	}
+	out := z.nsec3Matching(ce)
+	return appendDistinct(out, z.nsec3Covering(nextCloser(cut, ce)))
+}
+
+// nsecMatching returns the NSEC owned by name, or the one covering it
+// when name is an empty non-terminal.
+func (z *Zone) nsecMatching(name string) []*ResourceRecord {
+	if z.signer.WhiteLies {
+		var types []uint16
+		if _, ok := z.rrsets[name]; ok {
+			types = z.typesAt(name)
+		}
+		return z.signedLie(z.newNSEC(name, "\x00."+name, append(types, TypeRRSIG, TypeNSEC)))
+	}
+	if nsec := z.rrsets[name][TypeNSEC]; len(nsec) > 0 {
+		return z.withSigs(nsec, name, true)
+	}
+	return z.nsecCovering(name)
+}
+
+func (z *Zone) nsecCovering(name string) []*ResourceRecord {
+	if z.signer.WhiteLies {
+		return z.signedLie(z.newNSEC(predecessor(name), "\x00."+name, []uint16{TypeRRSIG, TypeNSEC}))
+	}
+	if len(z.names) == 0 {
+		return nil
+	}
+	i := sort.Search(len(z.names), func(i int) bool { return !canonicalLess(z.names[i], name) })
+	if i < len(z.names) && z.names[i] == name {
+		return z.nsecMatching(name)
+	}
+	if i == 0 {
+		i = len(z.names)
+	}
+	owner := z.names[i-1]
+	return z.withSigs(z.rrsets[owner][TypeNSEC], owner, true)
+}
+
+func (z *Zone) nsec3Find(name string) *nsec3Entry {
+	params := z.signer.NSEC3
+	hash := nsec3Hash(name, params.Salt, params.Iterations)
+	i := sort.Search(len(z.nsec3), func(i int) bool { return bytes.Compare(z.nsec3[i].hash, hash) >= 0 })
+	if i < len(z.nsec3) && bytes.Equal(z.nsec3[i].hash, hash) {
+		return z.nsec3[i]
+	}
+	return nil
+}
+
+func (z *Zone) nsec3Matching(name string) []*ResourceRecord {
+	params := z.signer.NSEC3
+	if z.signer.WhiteLies {
+		hash := nsec3Hash(name, params.Salt, params.Iterations)
+		types := z.typesAt(name)
+		if len(types) > 0 {
+			types = append(types, TypeRRSIG)
+		}
+		return z.signedLie(z.newNSEC3(hash, incrementHash(hash), typeBitmap(types)))
+	}
+	if e := z.nsec3Find(name); e != nil {
+		return z.withSigs(e.rrset, e.rrset[0].Name, true)
+	}
+	return nil
+}
+
+func (z *Zone) nsec3Covering(name string) []*ResourceRecord {
+	params := z.signer.NSEC3
+	hash := nsec3Hash(name, params.Salt, params.Iterations)
+	if z.signer.WhiteLies {
+		return z.signedLie(z.newNSEC3(decrementHash(hash), incrementHash(hash), nil))
+	}
+	if len(z.nsec3) == 0 {
+		return nil
+	}
+	i := sort.Search(len(z.nsec3), func(i int) bool { return bytes.Compare(z.nsec3[i].hash, hash) >= 0 })
+	if i == 0 {
+		i = len(z.nsec3)
+	}
+	e := z.nsec3[i-1]
+	return z.withSigs(e.rrset, e.rrset[0].Name, true)
+}
+
+func (z *Zone) signedLie(rr *ResourceRecord) []*ResourceRecord {
+	rrset := []*ResourceRecord{rr}
+	return append(rrset, z.signer.signOnce(z, rrset)...)
+}
+
+// predecessor returns a name sorting just before name, for minimally
+// covering NSEC records (RFC 4470 section 3.1.2).
+func predecessor(name string) string {
+	first, rest, _ := strings.Cut(name, ".")
+	if first == "" || name == "" {
+		return name
+	}
+	b := []byte(first)
+	last := b[len(b)-1]
+	if last == 0 {
+		b = b[:len(b)-1]
+	} else {
+		b[len(b)-1] = last - 1
+		for len(b) < 63 {
+			b = append(b, 0xFF)
+		}
+	}
+	if len(b) == 0 {
+		return rest
+	}
+	if rest == "" {
+		return string(b)
+	}
+	return string(b) + "." + rest
+}
+
+func incrementHash(hash []byte) []byte {
+	out := append([]byte(nil), hash...)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			break
+		}
+	}
+	return out
+}
+
+func decrementHash(hash []byte) []byte {
+	out := append([]byte(nil), hash...)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]--
+		if out[i] != 0xFF {
+			break
+		}
+	}
+	return out
+}
+
+// nextCloser is the ancestor of name one label below the closest encloser.
+func nextCloser(name, ce string) string {
+	for parentName(name) != ce && name != "" {
+		name = parentName(name)
+	}
+	return name
+}
+
+func appendDistinct(out, more []*ResourceRecord) []*ResourceRecord {
+	for _, rr := range more {
+		dup := false
+		for _, have := range out {
+			if have.Type == rr.Type && have.Name == rr.Name && bytes.Equal(have.RData, rr.RData) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// typeBitmap encodes types as an NSEC type bit map (RFC 4034 section 4.1.2).
+func typeBitmap(types []uint16) []byte {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	var out []byte
+	var window [32]byte
+	cur, length := -1, 0
+	flush := func() {
+		if cur >= 0 {
+			out = append(out, byte(cur), byte(length))
+			out = append(out, window[:length]...)
+		}
+	}
+	for _, t := range types {
+		w := int(t >> 8)
+		if w != cur {
+			flush()
+			cur, length, window = w, 0, [32]byte{}
+		}
+		b := int(t&0xFF) / 8
+		window[b] |= 0x80 >> (t & 7)
+		if b+1 > length {
+			length = b + 1
+		}
+	}
+	flush()
+	return out
+}
@@ -0,0 +1,147 @@
+package dnsserver
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Malware using a domain generation algorithm looks for its command
+// server among many random looking names, nearly all of which don't
+// exist. DGAMonitor flags clients that, within a window, get many NXDOMAIN
+// answers that make up much of their traffic, for names whose labels are
+// random by their Shannon entropy.
+
+var (
+	nxdomainResponses = NewCounterVec("dns_nxdomain_responses_total", "NXDOMAIN responses, by the served zone or -latency-zone suffix the name falls under.", "zone")
+	nxdomainEntropy   = NewHistogramVec("dns_nxdomain_label_entropy_bits", "Shannon entropy per character of the longest label of names answered with NXDOMAIN.", []float64{1, 1.5, 2, 2.5, 3, 3.5, 4, 4.5})
+	dgaAlerts         = NewCounter("dns_dga_alerts_total", "Clients flagged as looking like malware generating domain names.")
+	dgaSuspects       = NewGauge("dns_dga_suspect_clients", "Clients flagged as looking like domain generating malware in the last window.")
+)
+
+// dgaMinLabel is the shortest label whose entropy says anything; shorter
+// ones count as not random.
+const dgaMinLabel = 7
+
+// maxDGAClients bounds how many clients are tracked in a window.
+const maxDGAClients = 100000
+
+type DGAMonitor struct {
+	Window time.Duration
+	// MinNXDomain is how many NXDOMAIN answers a client needs in a
+	// window, Ratio the fraction of its queries they must be, and Entropy
+	// the mean entropy, in bits per character, their names must reach.
+	MinNXDomain int
+	Ratio       float64
+	Entropy     float64
+
+	mu       sync.Mutex
+	clients  map[string]*dgaClient
+	suspects map[string]bool
+}
+
+type dgaClient struct {
+	queries, nxdomain int
+	entropy           float64
+	examples          []string
+}
+
+// labelEntropy returns the Shannon entropy, in bits per character, of the
+// longest label of name other than the top-level one, and that label.
+func labelEntropy(name string) (float64, string) {
+	labels := strings.Split(normalizeName(name), ".")
+	label := ""
+	for _, l := range labels[:max(len(labels)-1, 1)] {
+		if len(l) > len(label) {
+			label = l
+		}
+	}
+	if label == "" {
+		return 0, ""
+	}
+	var counts [256]int
+	for i := 0; i < len(label); i++ {
+		counts[label[i]]++
+	}
+	var h float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(label))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h, label
+}
+
+// recordNXDomain counts resp in the NXDOMAIN metrics, if it is one.
+func recordNXDomain(m *Message, resp *Query, zones *ZoneSet, suffixes []string) {
+	if resp == nil || resp.Header.RCode != RCodeNameError || len(m.Questions) == 0 {
+		return
+	}
+	name := normalizeName(m.Questions[0].Name)
+	nxdomainResponses.With(latencyZone(name, zones, suffixes)).Inc()
+	if h, label := labelEntropy(name); len(label) >= dgaMinLabel {
+		nxdomainEntropy.With().Observe(h)
+	}
+}
+
+func (d *DGAMonitor) Record(client net.IP, m *Message, resp *Query) {
+	if d == nil || resp == nil || len(m.Questions) == 0 {
+		return
+	}
+	key := client.String()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[key]
+	if !ok {
+		if len(d.clients) >= maxDGAClients {
+			return
+		}
+		if d.clients == nil {
+			d.clients = map[string]*dgaClient{}
+		}
+		c = &dgaClient{}
+		d.clients[key] = c
+	}
+	c.queries++
+	if resp.Header.RCode != RCodeNameError {
+		return
+	}
+	c.nxdomain++
+	if h, label := labelEntropy(m.Questions[0].Name); len(label) >= dgaMinLabel {
+		c.entropy += h
+		if len(c.examples) < 5 {
+			c.examples = append(c.examples, fqdn(normalizeName(m.Questions[0].Name)))
+		}
+	}
+}
+
+func (d *DGAMonitor) Run() {
+	for range time.Tick(d.Window) {
+		d.mu.Lock()
+		clients, previous := d.clients, d.suspects
+		d.clients, d.suspects = nil, map[string]bool{}
+		for addr, c := range clients {
+			entropy := c.entropy / float64(max(c.nxdomain, 1))
+			if c.nxdomain < d.MinNXDomain || float64(c.nxdomain) < d.Ratio*float64(c.queries) || entropy < d.Entropy {
+				continue
+			}
+			d.suspects[addr] = true
+			if previous[addr] {
+				continue
+			}
+			dgaAlerts.Inc()
+			logServer.Warn("client looks like malware generating domain names", "client", addr, "nxdomain", c.nxdomain,
+				"queries", c.queries, "entropy", fmt.Sprintf("%.2f", entropy), "examples", strings.Join(c.examples, " "))
+			webhooks.Fire(eventDGASuspect, addr,
+				fmt.Sprintf("%s got %d NXDOMAIN answers out of %d queries in %s for random looking names", addr, c.nxdomain, c.queries, d.Window),
+				"nxdomain", fmt.Sprint(c.nxdomain), "queries", fmt.Sprint(c.queries), "entropy", fmt.Sprintf("%.2f", entropy),
+				"examples", strings.Join(c.examples, " "))
+		}
+		dgaSuspects.Set(float64(len(d.suspects)))
+		d.mu.Unlock()
+	}
+}
@@ -0,0 +1,161 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DHCPLeases maps client addresses to the MAC addresses a DHCP server
+// leased them to, read from its lease file: dnsmasq's dnsmasq.leases, ISC
+// dhcpd's dhcpd.leases or Kea's CSV lease file. The file is read again
+// when it changes.
+type DHCPLeases struct {
+	Path string
+
+	mu      sync.Mutex
+	macs    map[string]string
+	modTime time.Time
+	checked time.Time
+}
+
+// leaseCheckInterval is how often the lease file is checked for changes.
+const leaseCheckInterval = 10 * time.Second
+
+func NewDHCPLeases(path string) (*DHCPLeases, error) {
+	d := &DHCPLeases{Path: path}
+	if err := d.refresh(time.Now()); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// MAC returns the MAC address ip is leased to, or "".
+func (d *DHCPLeases) MAC(ip net.IP, now time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.checked) >= leaseCheckInterval {
+		if err := d.refresh(now); err != nil {
+			logServer.Warn("reading DHCP leases failed, keeping the previous ones", "path", d.Path, "err", err)
+		}
+	}
+	return d.macs[ip.String()]
+}
+
+func (d *DHCPLeases) refresh(now time.Time) error {
+	d.checked = now
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if d.macs != nil && fi.ModTime().Equal(d.modTime) {
+		return nil
+	}
+	macs, err := parseLeases(f)
+	if err != nil {
+		return err
+	}
+	d.macs, d.modTime = macs, fi.ModTime()
+	return nil
+}
+
+// parseLeases reads a lease file in any of the formats DHCPLeases knows.
+func parseLeases(r io.Reader) (map[string]string, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(64)
+	switch {
+	case strings.HasPrefix(string(head), "address,hwaddr"):
+		return parseKeaLeases(br)
+	case strings.Contains(string(head), "lease ") || strings.HasPrefix(string(head), "#"):
+		return parseISCLeases(br)
+	}
+	return parseDnsmasqLeases(br)
+}
+
+// parseDnsmasqLeases reads lines of "expiry mac address hostname
+// client-id".
+func parseDnsmasqLeases(r io.Reader) (map[string]string, error) {
+	macs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		addLease(macs, fields[2], fields[1])
+	}
+	return macs, scanner.Err()
+}
+
+// parseISCLeases reads lease blocks; later blocks for an address replace
+// earlier ones, as dhcpd appends to the file.
+func parseISCLeases(r io.Reader) (map[string]string, error) {
+	macs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	var ip, mac string
+	free := false
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		switch {
+		case len(fields) >= 2 && fields[0] == "lease":
+			ip, mac, free = fields[1], "", false
+		case len(fields) == 3 && fields[0] == "hardware":
+			mac = fields[2]
+		case len(fields) == 3 && fields[0] == "binding" && fields[1] == "state":
+			free = fields[2] != "active"
+		case len(fields) == 1 && fields[0] == "}" && ip != "":
+			if free {
+				delete(macs, ip)
+			} else {
+				addLease(macs, ip, mac)
+			}
+			ip = ""
+		}
+	}
+	return macs, scanner.Err()
+}
+
+// parseKeaLeases reads Kea's memfile CSV, whose header names the columns.
+func parseKeaLeases(r io.Reader) (map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	addrCol, macCol := slices.Index(header, "address"), slices.Index(header, "hwaddr")
+	macs := map[string]string{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return macs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) > max(addrCol, macCol) {
+			addLease(macs, rec[addrCol], rec[macCol])
+		}
+	}
+}
+
+func addLease(macs map[string]string, addr, mac string) {
+	ip := net.ParseIP(addr)
+	hw, err := net.ParseMAC(mac)
+	if ip == nil || err != nil {
+		return
+	}
+	macs[ip.String()] = hw.String()
+}
@@ -0,0 +1,440 @@
+// Package dnsclient sends DNS queries to a server over UDP, TCP, DNS over
+// TLS (RFC 7858) or DNS over HTTPS (RFC 8484).
+package dnsclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// DefaultTimeout bounds each attempt of a Client without a Timeout.
+const DefaultTimeout = 5 * time.Second
+
+// Client exchanges DNS messages with one server. The zero Client has no
+// server; set Addr and it queries over UDP with DefaultTimeout.
+type Client struct {
+	// Net is the transport: udp, tcp, tls or https. Over UDP, truncated
+	// responses are asked for again over TCP.
+	Net string
+	// Addr is the server's host:port, or for https its DoH URL.
+	Addr string
+	// Timeout bounds each attempt, as well as any deadline of the context.
+	Timeout time.Duration
+	// Retries is how many more times a UDP query is sent when no answer
+	// comes in time.
+	Retries int
+	// UDPSize, if set, is the EDNS payload size advertised with queries
+	// that don't carry an OPT record.
+	UDPSize uint16
+	// PadBlock, if set, pads tls and https queries carrying an OPT record
+	// to a multiple of this many bytes with the EDNS padding option (RFC
+	// 7830); RFC 8467 recommends 128.
+	PadBlock int
+	// TLSConfig is used for tls, and for https when HTTPClient is nil.
+	TLSConfig *tls.Config
+	// TLSPins, if set, are SHA-256 hashes of SubjectPublicKeyInfos, one of
+	// which the server's verified certificate chain must contain (RFC
+	// 7858's out-of-band key-pinned profile). The certificate is still
+	// checked against TLSConfig.ServerName if there is one and
+	// InsecureSkipVerify isn't set; otherwise the pins alone authenticate
+	// the server and must match its own certificate.
+	TLSPins [][]byte
+	// Opportunistic lets tls and https exchanges go ahead with a server
+	// that can't be authenticated, after reporting why to AuthFailed (RFC
+	// 8310's opportunistic profile). Otherwise they fail closed.
+	Opportunistic bool
+	AuthFailed    func(err error)
+	// HTTPClient sends DoH requests; nil uses one built from TLSConfig.
+	HTTPClient *http.Client
+
+	// Check vets each UDP response before it is accepted; an error has it
+	// ignored, and the client keeps waiting for the real one. Without
+	// Check, responses have to match the query's ID and question.
+	Check func(q *dnswire.Query, resp *dnswire.LazyMessage) error
+	// Sent and Received, if set, see each message on the wire: the local
+	// and remote addresses, and when the query went out.
+	Sent     func(network string, local, remote net.Addr, query []byte, at time.Time)
+	Received func(network string, local, remote net.Addr, query, resp []byte, queried time.Time)
+	// Linger, if set, is handed the socket of a UDP exchange once its
+	// response is accepted. It reports whether it took the socket over;
+	// if so it closes it.
+	Linger func(conn *net.UDPConn, q *dnswire.Query, resp *dnswire.Message) bool
+
+	httpOnce   sync.Once
+	httpClient *http.Client
+	tlsOnce    sync.Once
+	tls        *tls.Config
+}
+
+// ErrNoResponse is returned when a UDP query got no acceptable answer.
+var ErrNoResponse = errors.New("no response")
+
+// Exchange sends q and returns the response.
+func (c *Client) Exchange(ctx context.Context, q *dnswire.Query) (*dnswire.Message, error) {
+	if c.UDPSize > 0 && !hasOPT(q) {
+		withOPT := *q
+		q = withOPT.SetEDNS(c.UDPSize, false)
+	}
+	if c.PadBlock > 0 && (c.Net == "tls" || c.Net == "https") {
+		q = pad(q, c.PadBlock)
+	}
+	data, err := q.AppendTo(nil)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Net {
+	case "", "udp":
+		resp, err := c.exchangeUDP(ctx, q, data)
+		if err != nil || !resp.Header.TC {
+			return resp, err
+		}
+		return c.exchangeStream(ctx, "tcp", data)
+	case "tcp", "tls":
+		return c.exchangeStream(ctx, c.Net, data)
+	case "https":
+		return c.exchangeHTTPS(ctx, data)
+	}
+	return nil, fmt.Errorf("unknown transport %q", c.Net)
+}
+
+func hasOPT(q *dnswire.Query) bool {
+	for _, rr := range q.Additionals {
+		if rr.Type == dnswire.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+// pad returns q with a padding option filling it up to a multiple of
+// block bytes, if it has an OPT record to carry one.
+func pad(q *dnswire.Query, block int) *dnswire.Query {
+	data, err := q.AppendTo(nil)
+	if err != nil || !hasOPT(q) {
+		return q
+	}
+	n := (block - (len(data)+4)%block) % block
+	padded := *q
+	padded.Additionals = make([]*dnswire.ResourceRecord, len(q.Additionals))
+	for i, rr := range q.Additionals {
+		if rr.Type == dnswire.TypeOPT {
+			opt := *rr
+			opt.RData = binary.BigEndian.AppendUint16(append([]byte(nil), rr.RData...), optionPadding)
+			opt.RData = binary.BigEndian.AppendUint16(opt.RData, uint16(n))
+			opt.RData = append(opt.RData, make([]byte, n)...)
+			rr = &opt
+		}
+		padded.Additionals[i] = rr
+	}
+	return &padded
+}
+
+// optionPadding is the EDNS padding option's code.
+const optionPadding = 12
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultTimeout
+}
+
+// deadline returns when an attempt starting now has to be done by.
+func (c *Client) deadline(ctx context.Context) time.Time {
+	d := time.Now().Add(c.timeout())
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
+
+// UDP responses are read into pooled buffers big enough for any of them.
+var readBuffers = sync.Pool{New: func() any { return new([65535]byte) }}
+
+func (c *Client) exchangeUDP(ctx context.Context, q *dnswire.Query, data []byte) (*dnswire.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	udp := conn.(*net.UDPConn)
+	kept := false
+	defer func() {
+		if !kept {
+			conn.Close()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	buf := readBuffers.Get().(*[65535]byte)
+	defer readBuffers.Put(buf)
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		conn.SetDeadline(c.deadline(ctx))
+		queried := time.Now()
+		if c.Sent != nil {
+			c.Sent("udp", conn.LocalAddr(), conn.RemoteAddr(), data, queried)
+		}
+		if _, err := conn.Write(data); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf[:])
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			lazy, err := dnswire.ParseLazy(buf[:n])
+			if err != nil {
+				continue
+			}
+			if err := c.check(q, lazy); err != nil {
+				continue // not ours, keep waiting until the deadline
+			}
+			// The records would point into buf, which goes back to the pool.
+			lazy.Detach()
+			resp, err := lazy.Message()
+			if err != nil {
+				return nil, err
+			}
+			if c.Received != nil {
+				c.Received("udp", conn.LocalAddr(), conn.RemoteAddr(), data, buf[:n], queried)
+			}
+			if !resp.Header.TC && c.Linger != nil {
+				stop()
+				kept = c.Linger(udp, q, resp)
+			}
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("querying %s: %w", c.Addr, ErrNoResponse)
+}
+
+func (c *Client) check(q *dnswire.Query, resp *dnswire.LazyMessage) error {
+	if c.Check != nil {
+		return c.Check(q, resp)
+	}
+	if resp.Header.ID != q.Header.ID || int(resp.Header.QDCount) != len(q.Questions) {
+		return fmt.Errorf("response doesn't match the query")
+	}
+	for i, qq := range q.Questions {
+		rq, err := resp.Question(i)
+		if err != nil || rq.QType != qq.QType || rq.QClass != qq.QClass || !strings.EqualFold(rq.Name, qq.Name) {
+			return fmt.Errorf("response doesn't match the query")
+		}
+	}
+	return nil
+}
+
+// exchangeStream sends data over a new TCP or TLS connection.
+func (c *Client) exchangeStream(ctx context.Context, network string, data []byte) (*dnswire.Message, error) {
+	ctx, cancel := context.WithDeadline(ctx, c.deadline(ctx))
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if network == "tls" {
+		d := tls.Dialer{Config: c.tlsConfig()}
+		conn, err = d.DialContext(ctx, "tcp", c.Addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", c.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	msg = append(msg, data...)
+	queried := time.Now()
+	if c.Sent != nil {
+		c.Sent(network, conn.LocalAddr(), conn.RemoteAddr(), data, queried)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if c.Received != nil {
+		c.Received(network, conn.LocalAddr(), conn.RemoteAddr(), data, resp, queried)
+	}
+	m, err := dnswire.ParseMessage(resp)
+	if err != nil {
+		return nil, err
+	}
+	if m.Header.ID != binary.BigEndian.Uint16(data[0:2]) {
+		return nil, fmt.Errorf("%s response id mismatch", network)
+	}
+	return m, nil
+}
+
+// exchangeHTTPS POSTs data to the DoH endpoint. The ID is sent as it is,
+// rather than as 0, so the response can be matched like any other.
+func (c *Client) exchangeHTTPS(ctx context.Context, data []byte) (*dnswire.Message, error) {
+	ctx, cancel := context.WithDeadline(ctx, c.deadline(ctx))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Addr, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	queried := time.Now()
+	if c.Sent != nil {
+		c.Sent("https", nil, nil, data, queried)
+	}
+	resp, err := c.http().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", c.Addr, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if c.Received != nil {
+		c.Received("https", nil, nil, data, body, queried)
+	}
+	m, err := dnswire.ParseMessage(body)
+	if err != nil {
+		return nil, err
+	}
+	if m.Header.ID != binary.BigEndian.Uint16(data[0:2]) {
+		return nil, fmt.Errorf("https response id mismatch")
+	}
+	return m, nil
+}
+
+func (c *Client) http() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	c.httpOnce.Do(func() {
+		c.httpClient = &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   c.tlsConfig(),
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}}
+	})
+	return c.httpClient
+}
+
+// ParseSPKIPin decodes a pin as written in configurations, the base64
+// SHA-256 hash of a SubjectPublicKeyInfo.
+func ParseSPKIPin(s string) ([]byte, error) {
+	pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "pin-sha256:"))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid SPKI pin %q, want a base64 SHA-256 hash", s)
+	}
+	return pin, nil
+}
+
+// tlsConfig returns TLSConfig, made to check TLSPins and to only report
+// failures in opportunistic mode.
+func (c *Client) tlsConfig() *tls.Config {
+	c.tlsOnce.Do(func() {
+		c.tls = c.TLSConfig
+		if len(c.TLSPins) == 0 && !c.Opportunistic {
+			return
+		}
+		cfg := &tls.Config{}
+		if c.TLSConfig != nil {
+			cfg = c.TLSConfig.Clone()
+		}
+		name, roots := cfg.ServerName, cfg.RootCAs
+		if cfg.InsecureSkipVerify {
+			name = ""
+		}
+		// The handshake's own verification can't be told to only report
+		// failures, or to accept a pinned key alone.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			err := c.authenticate(cs, name, roots)
+			if err != nil && c.Opportunistic {
+				if c.AuthFailed != nil {
+					c.AuthFailed(err)
+				}
+				return nil
+			}
+			return err
+		}
+		c.tls = cfg
+	})
+	return c.tls
+}
+
+// authenticate checks the server's certificate chain against name, if it
+// isn't empty, and the pins. The pins are matched against the chains that
+// verified, or, with no name to verify against, the server's own
+// certificate: the other certificates it sends prove nothing, as anyone
+// can send them.
+func (c *Client) authenticate(cs tls.ConnectionState, name string, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("the server sent no certificate")
+	}
+	if name == "" && len(c.TLSPins) == 0 {
+		return errors.New("no server name or SPKI pins to authenticate the server with")
+	}
+	pinnable := cs.PeerCertificates[:1]
+	if name != "" {
+		opts := x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		chains, err := cs.PeerCertificates[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+		pinnable = nil
+		for _, chain := range chains {
+			pinnable = append(pinnable, chain...)
+		}
+	}
+	if len(c.TLSPins) == 0 {
+		return nil
+	}
+	for _, cert := range pinnable {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range c.TLSPins {
+			if bytes.Equal(pin, sum[:]) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no certificate of the server matches the SPKI pins")
+}
@@ -0,0 +1,145 @@
+package dnsclient
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// startServer serves answers for every name on a loopback UDP and TCP
+// port until the test ends. Over UDP, names below tc. are answered
+// truncated, with no records.
+func startServer(t *testing.T) string {
+	t.Helper()
+	h := server.HandlerFunc(func(w server.ResponseWriter, r *dnswire.Message) {
+		resp := new(dnswire.Query).SetReply(r)
+		if strings.HasSuffix(r.Questions[0].Name, ".tc") && !w.Client().Stream {
+			resp.Header.TC = true
+		} else {
+			resp.AddAnswer(&dnswire.ResourceRecord{Name: r.Questions[0].Name, Type: dnswire.TypeA, Class: dnswire.ClassINET, TTL: 60, RData: []byte{192, 0, 2, 1}})
+		}
+		if reply, err := resp.AppendTo(*server.GetBuffer(0)); err == nil {
+			w.Write(reply)
+		}
+	})
+	ready := make(chan net.Addr, 1)
+	s := &server.Server{
+		Handler:   h,
+		Log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Listeners: []*server.Listener{{Spec: &server.ListenerSpec{Addr: "127.0.0.1:0", ACLs: server.NewACLSet(), Transport: "udp"}}},
+		Ready: func(addrs []net.Addr) error {
+			ready <- addrs[0]
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.ListenAndServe(ctx)
+	t.Cleanup(func() {
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return (<-ready).String()
+}
+
+func TestExchange(t *testing.T) {
+	addr := startServer(t)
+	for _, tc := range []struct {
+		net, name string
+		// stream is the transport the answer should come over.
+		stream string
+	}{
+		{"udp", "www.example.com", "udp"},
+		{"", "www.example.com", "udp"},
+		{"tcp", "www.example.com", "tcp"},
+		{"udp", "big.tc", "tcp"},
+		{"tcp", "big.tc", "tcp"},
+	} {
+		var network string
+		c := &Client{Net: tc.net, Addr: addr, Timeout: 5 * time.Second,
+			Received: func(n string, _, _ net.Addr, _, _ []byte, _ time.Time) { network = n }}
+		q := new(dnswire.Query).SetQuestion(tc.name, dnswire.TypeA)
+		q.Header.ID, q.Header.RD = 1234, true
+		resp, err := c.Exchange(context.Background(), q)
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.net, tc.name, err)
+			continue
+		}
+		if resp.Header.ID != 1234 || resp.Header.TC || len(resp.Answers) != 1 {
+			t.Errorf("%s %s: got ID %d, TC %v, %d answers", tc.net, tc.name, resp.Header.ID, resp.Header.TC, len(resp.Answers))
+		}
+		if network != tc.stream {
+			t.Errorf("%s %s: answered over %q, want %q", tc.net, tc.name, network, tc.stream)
+		}
+	}
+}
+
+func TestExchangeIgnoresMismatchedResponse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m, err := dnswire.ParseMessage(buf[:n])
+		if err != nil {
+			return
+		}
+		// A spoofed answer with the wrong ID first, then the real one.
+		for _, id := range []uint16{m.Header.ID + 1, m.Header.ID} {
+			resp := new(dnswire.Query).SetReply(m)
+			resp.Header.ID = id
+			data, _ := resp.Encode()
+			conn.WriteTo(data, from)
+		}
+	}()
+
+	c := &Client{Addr: conn.LocalAddr().String(), Timeout: 5 * time.Second}
+	q := new(dnswire.Query).SetQuestion("www.example.com", dnswire.TypeA)
+	q.Header.ID = 7
+	resp, err := c.Exchange(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.ID != 7 {
+		t.Errorf("accepted the response with ID %d", resp.Header.ID)
+	}
+}
+
+func TestPad(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		block int
+		edns  bool
+	}{
+		{"www.example.com", 128, true},
+		{"a.very.long.name.with.many.labels.example.com", 128, true},
+		{"www.example.com", 468, true},
+		{"www.example.com", 128, false},
+	} {
+		q := new(dnswire.Query).SetQuestion(tc.name, dnswire.TypeA)
+		if tc.edns {
+			q.SetEDNS(1232, false)
+		}
+		data, err := pad(q, tc.block).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if padded := len(data)%tc.block == 0; padded != tc.edns {
+			t.Errorf("%s, block %d, EDNS %v: padded to %d bytes", tc.name, tc.block, tc.edns, len(data))
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package dnsserver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+const (
+	AlgRSASHA256       uint8 = 8
+	AlgRSASHA512       uint8 = 10
+	AlgECDSAP256SHA256 uint8 = 13
+	AlgECDSAP384SHA384 uint8 = 14
+	AlgED25519         uint8 = 15
+)
+
+const (
+	DigestSHA1   uint8 = 1
+	DigestSHA256 uint8 = 2
+	DigestSHA384 uint8 = 4
+)
+
+const (
+	DNSKEYFlagZone   uint16 = 0x0100
+	DNSKEYFlagRevoke uint16 = 0x0080
+	DNSKEYFlagSEP    uint16 = 0x0001
+)
+
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func parseDNSKEY(rdata []byte) (*DNSKEY, error) {
+	if len(rdata) < 4 {
+		return nil, fmt.Errorf("dnskey rdata too short")
+	}
+	return &DNSKEY{
+		Flags:     binary.BigEndian.Uint16(rdata[0:2]),
+		Protocol:  rdata[2],
+		Algorithm: rdata[3],
+		PublicKey: append([]byte(nil), rdata[4:]...),
+	}, nil
+}
+
+func (k *DNSKEY) RData() []byte {
+	buf := make([]byte, 4, 4+len(k.PublicKey))
+	binary.BigEndian.PutUint16(buf[0:2], k.Flags)
+	buf[2] = k.Protocol
+	buf[3] = k.Algorithm
+	return append(buf, k.PublicKey...)
+}
+
+// KeyTag implements the checksum from RFC 4034 appendix B.
+func (k *DNSKEY) KeyTag() uint16 {
+	rdata := k.RData()
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+func (k *DNSKEY) ToDS(owner string, digestType uint8) (*DS, error) {
+	h, err := dsHash(digestType)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(canonicalName(owner))
+	h.Write(k.RData())
+	return &DS{
+		KeyTag:     k.KeyTag(),
+		Algorithm:  k.Algorithm,
+		DigestType: digestType,
+		Digest:     h.Sum(nil),
+	}, nil
+}
+
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func parseDS(rdata []byte) (*DS, error) {
+	if len(rdata) < 4 {
+		return nil, fmt.Errorf("ds rdata too short")
+	}
+	return &DS{
+		KeyTag:     binary.BigEndian.Uint16(rdata[0:2]),
+		Algorithm:  rdata[2],
+		DigestType: rdata[3],
+		Digest:     append([]byte(nil), rdata[4:]...),
+	}, nil
+}
+
+func (ds *DS) RData() []byte {
+	buf := make([]byte, 4, 4+len(ds.Digest))
+	binary.BigEndian.PutUint16(buf[0:2], ds.KeyTag)
+	buf[2] = ds.Algorithm
+	buf[3] = ds.DigestType
+	return append(buf, ds.Digest...)
+}
+
+// Matches reports whether key, published at owner, is the key this DS refers to.
+func (ds *DS) Matches(owner string, key *DNSKEY) bool {
+	if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+		return false
+	}
+	other, err := key.ToDS(owner, ds.DigestType)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ds.Digest, other.Digest)
+}
+
+func dsHash(digestType uint8) (interface {
+	Write([]byte) (int, error)
+	Sum([]byte) []byte
+}, error) {
+	switch digestType {
+	case DigestSHA1:
+		return sha1.New(), nil
+	case DigestSHA256:
+		return sha256.New(), nil
+	case DigestSHA384:
+		return sha512.New384(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest type %d", digestType)
+}
+
+type RRSIG struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OrigTTL     uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+func parseRRSIG(rdata []byte) (*RRSIG, error) {
+	if len(rdata) < 18 {
+		return nil, fmt.Errorf("rrsig rdata too short")
+	}
+	sig := &RRSIG{
+		TypeCovered: binary.BigEndian.Uint16(rdata[0:2]),
+		Algorithm:   rdata[2],
+		Labels:      rdata[3],
+		OrigTTL:     binary.BigEndian.Uint32(rdata[4:8]),
+		Expiration:  binary.BigEndian.Uint32(rdata[8:12]),
+		Inception:   binary.BigEndian.Uint32(rdata[12:16]),
+		KeyTag:      binary.BigEndian.Uint16(rdata[16:18]),
+	}
+	p := dnswire.NewReader(rdata, 18)
+	name, err := p.ReadName()
+	if err != nil {
+		return nil, err
+	}
+	sig.SignerName = name
+	sig.Signature = append([]byte(nil), rdata[p.Offset():]...)
+	return sig, nil
+}
+
+// header returns the RRSIG RDATA without the signature, which is the
+// prefix of the data covered by the signature.
+func (sig *RRSIG) header() []byte {
+	buf := make([]byte, 18)
+	binary.BigEndian.PutUint16(buf[0:2], sig.TypeCovered)
+	buf[2] = sig.Algorithm
+	buf[3] = sig.Labels
+	binary.BigEndian.PutUint32(buf[4:8], sig.OrigTTL)
+	binary.BigEndian.PutUint32(buf[8:12], sig.Expiration)
+	binary.BigEndian.PutUint32(buf[12:16], sig.Inception)
+	binary.BigEndian.PutUint16(buf[16:18], sig.KeyTag)
+	return append(buf, canonicalName(sig.SignerName)...)
+}
+
+func (sig *RRSIG) RData() []byte {
+	return append(sig.header(), sig.Signature...)
+}
+
+// ValidAt checks the validity period using serial number arithmetic
+// (RFC 4034 section 3.1.5), so timestamps survive the 2106 wrap.
+func (sig *RRSIG) ValidAt(t time.Time) bool {
+	now := uint32(t.Unix())
+	return int32(now-sig.Inception) >= 0 && int32(sig.Expiration-now) >= 0
+}
+
+// canonicalName returns the uncompressed, lowercased wire form of name.
+func canonicalName(name string) []byte {
+	var buf []byte
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0)
+}
+
+func countLabels(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
+
+// signedData builds the octets covered by sig over rrset, following RFC 4034
+// section 6 canonical form and ordering.
+func signedData(sig *RRSIG, rrset []*ResourceRecord) ([]byte, error) {
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("empty rrset")
+	}
+	owner := strings.ToLower(rrset[0].Name)
+	if n := countLabels(owner); int(sig.Labels) < n {
+		labels := strings.Split(owner, ".")
+		owner = "*." + strings.Join(labels[n-int(sig.Labels):], ".")
+	} else if int(sig.Labels) > n {
+		return nil, fmt.Errorf("rrsig labels %d exceed owner labels %d", sig.Labels, n)
+	}
+	ownerWire := canonicalName(owner)
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdatas = append(rdatas, canonicalRData(rr.Type, rr.RData))
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	buf := sig.header()
+	tmp := make([]byte, 10)
+	var prev []byte
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, prev) {
+			continue
+		}
+		prev = rdata
+		buf = append(buf, ownerWire...)
+		binary.BigEndian.PutUint16(tmp[0:2], rrset[0].Type)
+		binary.BigEndian.PutUint16(tmp[2:4], rrset[0].Class)
+		binary.BigEndian.PutUint32(tmp[4:8], sig.OrigTTL)
+		binary.BigEndian.PutUint16(tmp[8:10], uint16(len(rdata)))
+		buf = append(buf, tmp...)
+		buf = append(buf, rdata...)
+	}
+	return buf, nil
+}
+
+// canonicalRData lowercases embedded domain names for the record types
+// listed in RFC 4034 section 6.2 that we carry uncompressed.
+func canonicalRData(rrtype uint16, rdata []byte) []byte {
+	switch rrtype {
+	case TypeNS, TypeCNAME, TypePTR:
+		p := dnswire.NewReader(rdata, 0)
+		if name, err := p.ReadName(); err == nil && p.Offset() == len(rdata) {
+			return canonicalName(name)
+		}
+	case TypeMX:
+		if len(rdata) > 2 {
+			p := dnswire.NewReader(rdata, 2)
+			if name, err := p.ReadName(); err == nil && p.Offset() == len(rdata) {
+				return append(append([]byte(nil), rdata[:2]...), canonicalName(name)...)
+			}
+		}
+	case TypeSOA:
+		p := dnswire.NewReader(rdata, 0)
+		mname, err := p.ReadName()
+		if err != nil {
+			break
+		}
+		rname, err := p.ReadName()
+		if err != nil || len(rdata)-p.Offset() != 20 {
+			break
+		}
+		out := canonicalName(mname)
+		out = append(out, canonicalName(rname)...)
+		return append(out, rdata[p.Offset():]...)
+	}
+	return rdata
+}
+
+// VerifyRRSIG checks that sig over rrset was produced by key.
+func VerifyRRSIG(sig *RRSIG, key *DNSKEY, rrset []*ResourceRecord) error {
+	if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm {
+		return fmt.Errorf("rrsig does not match key %d", key.KeyTag())
+	}
+	if key.Protocol != 3 || key.Flags&DNSKEYFlagZone == 0 {
+		return fmt.Errorf("key %d is not a zone key", key.KeyTag())
+	}
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		return err
+	}
+	return verifySignature(sig.Algorithm, key.PublicKey, data, sig.Signature)
+}
+
+// verifySignature checks signature over data with a DNSKEY-format public
+// key of the given algorithm.
+func verifySignature(alg uint8, publicKey, data, signature []byte) error {
+	switch alg {
+	case AlgRSASHA256, AlgRSASHA512:
+		pub, err := rsaPublicKey(publicKey)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA256
+		if alg == AlgRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), signature)
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if alg == AlgECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+		size := curve.Params().BitSize / 8
+		if len(publicKey) != 2*size || len(signature) != 2*size {
+			return fmt.Errorf("bad ecdsa key or signature length")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(publicKey[:size]),
+			Y:     new(big.Int).SetBytes(publicKey[size:]),
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return fmt.Errorf("ecdsa signature verification failed")
+		}
+		return nil
+	case AlgED25519:
+		if len(publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("bad ed25519 key length")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(publicKey), data, signature) {
+			return fmt.Errorf("ed25519 signature verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+func rsaPublicKey(raw []byte) (*rsa.PublicKey, error) {
+	if len(raw) < 3 {
+		return nil, fmt.Errorf("rsa key too short")
+	}
+	explen, off := int(raw[0]), 1
+	if explen == 0 {
+		explen, off = int(binary.BigEndian.Uint16(raw[1:3])), 3
+	}
+	if explen == 0 || explen > 4 || off+explen >= len(raw) {
+		return nil, fmt.Errorf("unsupported rsa exponent")
+	}
+	var e int
+	for _, b := range raw[off : off+explen] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(raw[off+explen:]), E: e}, nil
+}
+
+// splitRRSets groups records by owner and type, separating out RRSIGs by
+// the type they cover.
+func splitRRSets(rrs []*ResourceRecord) (map[string][]*ResourceRecord, map[string][]*RRSIG) {
+	sets := map[string][]*ResourceRecord{}
+	sigs := map[string][]*RRSIG{}
+	for _, rr := range rrs {
+		if rr.Type == TypeRRSIG {
+			sig, err := parseRRSIG(rr.RData)
+			if err != nil {
+				continue
+			}
+			key := rrsetKey(rr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey(rr.Name, rr.Type)
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+func rrsetKey(name string, rrtype uint16) string {
+	return fmt.Sprintf("%s/%d", strings.ToLower(strings.TrimSuffix(name, ".")), rrtype)
+}
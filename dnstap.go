@@ -0,0 +1,307 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// dnstap (https://dnstap.info) events are protobuf messages sent as Frame
+// Streams data frames. Both formats are simple enough to write by hand,
+// which saves pulling in a protobuf library for one message type.
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types and fields.
+const (
+	fstrmAccept      = 0x01
+	fstrmStart       = 0x02
+	fstrmReady       = 0x04
+	fstrmContentType = 0x01
+)
+
+// dnstap Message.Type values.
+const (
+	dnstapResolverQuery    = 3
+	dnstapResolverResponse = 4
+	dnstapClientQuery      = 5
+	dnstapClientResponse   = 6
+)
+
+var dnstapProtocols = map[string]uint64{"udp": 1, "tcp": 2, "tls": 3, "https": 4}
+
+var (
+	dnstapDropped = NewCounter("dns_dnstap_dropped_total", "dnstap events dropped because the collector was unreachable or too slow.")
+	dnstapWriter  *DnstapWriter
+)
+
+// DnstapWriter streams events to a collector over a unix or TCP socket,
+// reconnecting when the connection breaks. Events that can't be sent are
+// dropped rather than slowing down query processing.
+type DnstapWriter struct {
+	Network  string
+	Address  string
+	Identity string
+	Version  string
+
+	events chan []byte
+}
+
+// NewDnstapWriter parses target, unix:/path or tcp:host:port, and starts
+// sending to it.
+func NewDnstapWriter(target, identity, version string) (*DnstapWriter, error) {
+	network, address, ok := strings.Cut(target, ":")
+	if !ok || (network != "unix" && network != "tcp") || address == "" {
+		return nil, fmt.Errorf("invalid dnstap target %q, want unix:/path or tcp:host:port", target)
+	}
+	w := &DnstapWriter{Network: network, Address: address, Identity: identity, Version: version, events: make(chan []byte, 1024)}
+	go w.run()
+	return w, nil
+}
+
+type dnstapEvent struct {
+	Type         uint64
+	Protocol     string
+	QueryAddr    net.IP
+	QueryPort    int
+	ResponseAddr net.IP
+	ResponsePort int
+	QueryTime    time.Time
+	ResponseTime time.Time
+	Query        []byte
+	Response     []byte
+}
+
+func (w *DnstapWriter) send(e *dnstapEvent) {
+	select {
+	case w.events <- w.encode(e):
+	default:
+		dnstapDropped.Inc()
+	}
+}
+
+// ClientQuery records a query received from client.
+func (w *DnstapWriter) ClientQuery(client *server.Client, query []byte, at time.Time) {
+	if w == nil {
+		return
+	}
+	w.send(&dnstapEvent{Type: dnstapClientQuery, Protocol: client.Protocol, QueryAddr: client.IP, QueryPort: client.Port, QueryTime: at, Query: query})
+}
+
+// ClientResponse records the response sent to client.
+func (w *DnstapWriter) ClientResponse(client *server.Client, query, response []byte, queryTime time.Time) {
+	if w == nil {
+		return
+	}
+	w.send(&dnstapEvent{Type: dnstapClientResponse, Protocol: client.Protocol, QueryAddr: client.IP, QueryPort: client.Port,
+		QueryTime: queryTime, ResponseTime: time.Now(), Query: query, Response: response})
+}
+
+// ResolverQuery records a query sent upstream from local to addr.
+func (w *DnstapWriter) ResolverQuery(protocol string, local, addr net.Addr, query []byte, at time.Time) {
+	if w == nil {
+		return
+	}
+	e := &dnstapEvent{Type: dnstapResolverQuery, Protocol: protocol, QueryTime: at, Query: query}
+	e.QueryAddr, e.QueryPort = splitAddr(local)
+	e.ResponseAddr, e.ResponsePort = splitAddr(addr)
+	w.send(e)
+}
+
+// ResolverResponse records the upstream response to a ResolverQuery.
+func (w *DnstapWriter) ResolverResponse(protocol string, local, addr net.Addr, query, response []byte, queryTime time.Time) {
+	if w == nil {
+		return
+	}
+	e := &dnstapEvent{Type: dnstapResolverResponse, Protocol: protocol, QueryTime: queryTime, ResponseTime: time.Now(), Query: query, Response: response}
+	e.QueryAddr, e.QueryPort = splitAddr(local)
+	e.ResponseAddr, e.ResponsePort = splitAddr(addr)
+	w.send(e)
+}
+
+// Flush waits, at most timeout, for queued events to be sent.
+func (w *DnstapWriter) Flush(timeout time.Duration) {
+	if w == nil {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for len(w.events) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// encode returns the Dnstap protobuf message for e.
+func (w *DnstapWriter) encode(e *dnstapEvent) []byte {
+	var m []byte
+	m = pbVarint(m, 1, e.Type)
+	if ip := e.QueryAddr; ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			m = pbVarint(m, 2, 1)
+			ip = ip4
+		} else {
+			m = pbVarint(m, 2, 2)
+		}
+		m = pbBytes(m, 4, ip)
+		m = pbVarint(m, 6, uint64(e.QueryPort))
+	}
+	if proto, ok := dnstapProtocols[e.Protocol]; ok {
+		m = pbVarint(m, 3, proto)
+	}
+	if ip := e.ResponseAddr; ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		m = pbBytes(m, 5, ip)
+		m = pbVarint(m, 7, uint64(e.ResponsePort))
+	}
+	if !e.QueryTime.IsZero() {
+		m = pbVarint(m, 8, uint64(e.QueryTime.Unix()))
+		m = pbFixed32(m, 9, uint32(e.QueryTime.Nanosecond()))
+	}
+	if e.Query != nil {
+		m = pbBytes(m, 10, e.Query)
+	}
+	if !e.ResponseTime.IsZero() {
+		m = pbVarint(m, 12, uint64(e.ResponseTime.Unix()))
+		m = pbFixed32(m, 13, uint32(e.ResponseTime.Nanosecond()))
+	}
+	if e.Response != nil {
+		m = pbBytes(m, 14, e.Response)
+	}
+
+	var d []byte
+	if w.Identity != "" {
+		d = pbBytes(d, 1, []byte(w.Identity))
+	}
+	if w.Version != "" {
+		d = pbBytes(d, 2, []byte(w.Version))
+	}
+	d = pbBytes(d, 14, m)
+	return pbVarint(d, 15, 1) // type MESSAGE
+}
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func pbFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func (w *DnstapWriter) run() {
+	backoff := time.Second
+	for {
+		conn, err := w.connect()
+		if err != nil {
+			logDnstap.Warn("connecting to collector failed", "addr", w.Address, "err", err)
+			w.discard(backoff)
+			backoff = min(2*backoff, time.Minute)
+			continue
+		}
+		logDnstap.Info("connected to collector", "addr", w.Address)
+		backoff = time.Second
+		for frame := range w.events {
+			conn.SetWriteDeadline(time.Now().Add(exchangeTimeout))
+			if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame)))); err == nil {
+				_, err = conn.Write(frame)
+			}
+			if err != nil {
+				logDnstap.Warn("sending to collector failed", "addr", w.Address, "err", err)
+				dnstapDropped.Inc()
+				break
+			}
+		}
+		conn.Close()
+	}
+}
+
+// discard drops the events that arrive while there is no collector.
+func (w *DnstapWriter) discard(d time.Duration) {
+	timeout := time.After(d)
+	for {
+		select {
+		case <-w.events:
+			dnstapDropped.Inc()
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// connect opens a bidirectional Frame Streams connection: READY, answered
+// by ACCEPT, then START.
+func (w *DnstapWriter) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(w.Network, w.Address, exchangeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(exchangeTimeout))
+	if _, err := conn.Write(fstrmControl(fstrmReady)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, err := readFstrmControl(conn)
+	if err == nil && typ != fstrmAccept {
+		err = fmt.Errorf("expected ACCEPT control frame, got type %d", typ)
+	}
+	if err == nil {
+		_, err = conn.Write(fstrmControl(fstrmStart))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// fstrmControl builds a control frame of the given type carrying the
+// dnstap content type.
+func fstrmControl(typ uint32) []byte {
+	body := binary.BigEndian.AppendUint32(nil, typ)
+	body = binary.BigEndian.AppendUint32(body, fstrmContentType)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(dnstapContentType)))
+	body = append(body, dnstapContentType...)
+	frame := binary.BigEndian.AppendUint32(nil, 0) // escape
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	return append(frame, body...)
+}
+
+func readFstrmControl(r io.Reader) (uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[4:])
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 || n < 4 || n > 512 {
+		return 0, fmt.Errorf("malformed control frame")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(body), nil
+}
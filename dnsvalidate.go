@@ -0,0 +1,378 @@
+package dnsserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// With -dnssec-validate the server validates the answers it forwards, as a
+// validating stub: it doesn't recurse, but fetches the DNSKEY and DS
+// records linking the zone signing an answer to a trust anchor through
+// -resolver. Clients that can't validate themselves, and ask with AD or
+// DO, get AD on answers whose every RRset is secure; bogus answers are
+// answered with SERVFAIL.
+//
+// Negative answers and wildcard expansions from signed zones must come
+// with the NSEC or NSEC3 records proving them. Unsigned records, and
+// negative answers without proofs, are passed on without AD only if the
+// DS records from the closest trust anchor down show they are in an
+// unsigned zone: a delegation without DS records, proven by the parent's
+// NSEC or NSEC3 records. Anything else is bogus, so an attacker can't
+// strip the signatures off an answer from a signed zone.
+
+// The AD and CD flags are the low bits of Header.Z.
+const (
+	headerAD = 1 << 1
+	headerCD = 1
+)
+
+// errInsecure is returned for zones no chain of DS records leads to from
+// a trust anchor.
+var errInsecure = errors.New("no chain of trust to the zone")
+
+var validationResults = NewCounterVec("dns_dnssec_validation_total", "Forwarded answers by DNSSEC validation result: secure, insecure or bogus.", "result")
+
+type Validator struct {
+	Anchors *TrustAnchorStore
+
+	mu   sync.Mutex
+	keys map[string]*zoneKeys
+	// cuts holds what the DS lookups for names below trust anchors
+	// found: nil for secure cuts and names that aren't cuts, errInsecure
+	// for insecure cuts or why the lookup failed.
+	cuts map[string]*zoneCut
+}
+
+// zoneKeys are the validated keys of a zone, or why there are none.
+type zoneKeys struct {
+	keys    []*DNSKEY
+	err     error
+	expires time.Time
+}
+
+type zoneCut struct {
+	err     error
+	expires time.Time
+}
+
+// cutTTL is how long what a DS lookup found is kept.
+const cutTTL = 10 * time.Minute
+
+// Validate reports whether resp, from resolver, is secure; the error
+// says why it is bogus.
+func (v *Validator) Validate(resolver *net.UDPAddr, resp *Message, now time.Time) (bool, error) {
+	secure, err := v.validate(resolver, resp, now)
+	switch {
+	case err != nil:
+		validationResults.With("bogus").Inc()
+	case secure:
+		validationResults.With("secure").Inc()
+	default:
+		validationResults.With("insecure").Inc()
+	}
+	return secure, err
+}
+
+func (v *Validator) validate(resolver *net.UDPAddr, resp *Message, now time.Time) (bool, error) {
+	rcode := resp.Header.RCode
+	if len(resp.Questions) == 0 || rcode != RCodeSuccess && rcode != RCodeNameError {
+		return false, nil
+	}
+	question := resp.Questions[0]
+	proofs, err := v.proofs(resolver, resp.Authorities, "", now)
+	if err != nil {
+		return false, err
+	}
+
+	secure := true
+	sets, sigs := splitRRSets(resp.Answers)
+	for key, rrset := range sets {
+		owner := normalizeName(rrset[0].Name)
+		where := fmt.Sprintf("%s %s", fqdn(owner), dnswire.TypeString(rrset[0].Type))
+		rrsigs := sigs[key]
+		if len(rrsigs) == 0 {
+			if err := v.zoneStatus(resolver, owner, now); !errors.Is(err, errInsecure) {
+				return false, fmt.Errorf("%s: unsigned in a signed zone%s", where, because(err))
+			}
+			secure = false
+			continue
+		}
+		sig, err := v.verify(resolver, rrset, rrsigs, now)
+		if errors.Is(err, errInsecure) {
+			secure = false
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", where, err)
+		}
+		if labels := int(sig.Labels); labels < countLabels(owner) {
+			switch proofs.wildcardAnswer(owner, labels) {
+			case unproven:
+				return false, fmt.Errorf("%s: expanded from a wildcard without proof the name doesn't exist", where)
+			case provenInsecure:
+				secure = false
+			}
+		}
+	}
+
+	// The answer is negative for the name its CNAMEs lead to, if there
+	// are no records of the type asked for there.
+	name := normalizeName(question.Name)
+	for seen := 0; seen < len(sets); seen++ {
+		cname := sets[rrsetKey(name, TypeCNAME)]
+		if len(cname) == 0 || question.QType == TypeCNAME {
+			break
+		}
+		name = normalizeName(rdataName(cname[0].RData, 0))
+	}
+	if rcode == RCodeSuccess && (len(sets[rrsetKey(name, question.QType)]) > 0 || question.QType == TypeANY && len(sets) > 0) {
+		return secure, nil
+	}
+	negative, d := "no data", proofs.noData(name, question.QType)
+	if rcode == RCodeNameError {
+		negative, d = "NXDOMAIN", proofs.nameError(name)
+	}
+	switch d {
+	case proven:
+		return secure, nil
+	case provenInsecure:
+		return false, nil
+	}
+	if err := v.zoneStatus(resolver, name, now); !errors.Is(err, errInsecure) {
+		return false, fmt.Errorf("%s %s: %s without proof from a signed zone%s", fqdn(name), dnswire.TypeString(question.QType), negative, because(err))
+	}
+	return false, nil
+}
+
+// because words err as the reason a failure is bogus, if there is one.
+func because(err error) string {
+	if err == nil {
+		return ""
+	}
+	return ": " + err.Error()
+}
+
+// zoneStatus returns nil if name is in a signed zone, errInsecure if the
+// DS records down from the closest trust anchor lead to an unsigned one,
+// or why that can't be told.
+func (v *Validator) zoneStatus(resolver *net.UDPAddr, name string, now time.Time) error {
+	anchor := name
+	for len(v.Anchors.Anchors(anchor)) == 0 && len(v.Anchors.Trusted(anchor)) == 0 {
+		if anchor == "" {
+			return errInsecure
+		}
+		anchor = parentName(anchor)
+	}
+	labels := strings.Split(name, ".")
+	for i := countLabels(name) - countLabels(anchor) - 1; i >= 0; i-- {
+		if err := v.cut(resolver, strings.Join(labels[i:], "."), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns nil if name is a secure zone cut or no cut at all, and
+// errInsecure if it is an insecure one.
+func (v *Validator) cut(resolver *net.UDPAddr, name string, now time.Time) error {
+	v.mu.Lock()
+	zc, ok := v.cuts[name]
+	v.mu.Unlock()
+	if ok && now.Before(zc.expires) {
+		return zc.err
+	}
+	_, err := v.fetchDS(resolver, name, now)
+	ttl := cutTTL
+	if err != nil && !errors.Is(err, errInsecure) {
+		ttl = time.Minute
+	}
+	v.mu.Lock()
+	if v.cuts == nil {
+		v.cuts = map[string]*zoneCut{}
+	}
+	v.cuts[name] = &zoneCut{err: err, expires: now.Add(ttl)}
+	v.mu.Unlock()
+	return err
+}
+
+// verify checks that one of sigs over rrset verifies with a validated key
+// of its signer, and returns it; its Labels tell whether the rrset was
+// expanded from a wildcard.
+func (v *Validator) verify(resolver *net.UDPAddr, rrset []*ResourceRecord, sigs []*RRSIG, now time.Time) (*RRSIG, error) {
+	owner := normalizeName(rrset[0].Name)
+	err := fmt.Errorf("no valid signature")
+	for _, sig := range sigs {
+		signer := normalizeName(sig.SignerName)
+		// A DS rrset is signed by the parent zone, anything else by the
+		// zone it is in; this also keeps the chain from looping.
+		if !inZone(owner, signer) || rrset[0].Type == TypeDS && owner == signer {
+			err = fmt.Errorf("signed by %s, which can't sign it", fqdn(signer))
+			continue
+		}
+		if !sig.ValidAt(now) {
+			err = fmt.Errorf("signature by key %d of %s has expired or isn't valid yet", sig.KeyTag, fqdn(signer))
+			continue
+		}
+		keys, kerr := v.zoneKeys(resolver, signer, now)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		for _, k := range keys {
+			if VerifyRRSIG(sig, k, rrset) == nil {
+				return sig, nil
+			}
+		}
+		err = fmt.Errorf("no key of %s verifies the signature", fqdn(signer))
+	}
+	return nil, err
+}
+
+// zoneKeys returns the DNSKEYs of zone, once its DNSKEY rrset is signed
+// by a trust anchor or by a key its parent's DS records vouch for.
+func (v *Validator) zoneKeys(resolver *net.UDPAddr, zone string, now time.Time) ([]*DNSKEY, error) {
+	v.mu.Lock()
+	zk, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && now.Before(zk.expires) {
+		return zk.keys, zk.err
+	}
+	keys, ttl, err := v.fetchKeys(resolver, zone, now)
+	if err != nil {
+		// Failures are kept briefly, so a broken zone isn't asked for its
+		// keys on every query.
+		ttl = time.Minute
+		logDNSSEC.Debug("no validated keys", "zone", fqdn(zone), "err", err)
+	}
+	v.mu.Lock()
+	if v.keys == nil {
+		v.keys = map[string]*zoneKeys{}
+	}
+	v.keys[zone] = &zoneKeys{keys: keys, err: err, expires: now.Add(ttl)}
+	v.mu.Unlock()
+	return keys, err
+}
+
+func (v *Validator) fetchKeys(resolver *net.UDPAddr, zone string, now time.Time) ([]*DNSKEY, time.Duration, error) {
+	resp, err := exchange(resolver, dnswire.NewQuery(fqdn(zone), TypeDNSKEY).SetEDNS(4096, true))
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetching the DNSKEYs of %s: %v", fqdn(zone), err)
+	}
+	sets, sigs := splitRRSets(resp.Answers)
+	rrset, rrsigs := sets[rrsetKey(zone, TypeDNSKEY)], sigs[rrsetKey(zone, TypeDNSKEY)]
+	var keys []*DNSKEY
+	ttl := time.Hour
+	for _, rr := range rrset {
+		if k, err := parseDNSKEY(rr.RData); err == nil && k.Flags&DNSKEYFlagRevoke == 0 {
+			keys = append(keys, k)
+		}
+		ttl = min(ttl, time.Duration(rr.TTL)*time.Second)
+	}
+
+	// trusted reports whether key is vouched for and signs the DNSKEY rrset.
+	var trusted func(*DNSKEY) bool
+	if len(v.Anchors.Anchors(zone)) > 0 || len(v.Anchors.Trusted(zone)) > 0 {
+		trusted = func(k *DNSKEY) bool { return v.Anchors.Trusts(zone, k) }
+	} else {
+		if zone == "" {
+			return nil, ttl, errInsecure
+		}
+		ds, err := v.fetchDS(resolver, zone, now)
+		if err != nil {
+			return nil, ttl, err
+		}
+		if len(ds) == 0 {
+			return nil, ttl, fmt.Errorf("%s signs records, but its parent has no delegation to it", fqdn(zone))
+		}
+		trusted = func(k *DNSKEY) bool {
+			for _, d := range ds {
+				if d.Matches(fqdn(zone), k) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	for _, k := range keys {
+		if !trusted(k) {
+			continue
+		}
+		for _, sig := range rrsigs {
+			if sig.ValidAt(now) && VerifyRRSIG(sig, k, rrset) == nil {
+				return keys, max(ttl, time.Minute), nil
+			}
+		}
+	}
+	return nil, ttl, fmt.Errorf("the DNSKEYs of %s aren't signed by a trusted key", fqdn(zone))
+}
+
+// fetchDS returns the validated DS records of zone. It returns none if
+// zone proves not to be a zone cut, and errInsecure if it is one without
+// DS records or has an unsigned parent.
+func (v *Validator) fetchDS(resolver *net.UDPAddr, zone string, now time.Time) ([]*DS, error) {
+	resp, err := exchange(resolver, dnswire.NewQuery(fqdn(zone), TypeDS).SetEDNS(4096, true))
+	if err != nil {
+		return nil, fmt.Errorf("fetching the DS records of %s: %v", fqdn(zone), err)
+	}
+	sets, sigs := splitRRSets(resp.Answers)
+	rrset := sets[rrsetKey(zone, TypeDS)]
+	if len(rrset) == 0 {
+		return nil, v.noDS(resolver, zone, resp, now)
+	}
+	if _, err := v.verify(resolver, rrset, sigs[rrsetKey(zone, TypeDS)], now); err != nil {
+		return nil, fmt.Errorf("DS records of %s: %w", fqdn(zone), err)
+	}
+	var ds []*DS
+	for _, rr := range rrset {
+		if d, err := parseDS(rr.RData); err == nil {
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
+
+// noDS checks the answer without DS records resp gave for zone: nil if
+// zone proves not to be a zone cut, errInsecure if it proves to be an
+// insecure one.
+func (v *Validator) noDS(resolver *net.UDPAddr, zone string, resp *Message, now time.Time) error {
+	proofs, err := v.proofs(resolver, resp.Authorities, zone, now)
+	if err != nil {
+		return fmt.Errorf("DS records of %s: %w", fqdn(zone), err)
+	}
+	switch cut, d := proofs.noDS(zone); {
+	case d == provenInsecure, d == proven && cut:
+		return errInsecure
+	case d == proven:
+		return nil
+	}
+	// Without a proof, there are no DS records only if the parent isn't
+	// signed either.
+	if zone == "" {
+		return errInsecure
+	}
+	if err := v.zoneStatus(resolver, parentName(zone), now); err != nil {
+		return err
+	}
+	return fmt.Errorf("no DS records for %s and no proof there are none", fqdn(zone))
+}
+
+// stripDNSSEC drops the RRSIG, NSEC and NSEC3 records from rrs, for
+// clients that didn't ask for them, keeping those of type qtype.
+func stripDNSSEC(rrs []*ResourceRecord, qtype uint16) []*ResourceRecord {
+	var out []*ResourceRecord
+	for _, rr := range rrs {
+		switch {
+		case rr.Type == qtype:
+		case rr.Type == TypeRRSIG, rr.Type == TypeNSEC, rr.Type == TypeNSEC3:
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+package dnsserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// testSigner returns a signer for zone with one new ECDSA key.
+func testSigner(t *testing.T) *ZoneSigner {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := append(priv.X.FillBytes(make([]byte, 32)), priv.Y.FillBytes(make([]byte, 32))...)
+	key := &DNSKEY{Flags: DNSKEYFlagZone | DNSKEYFlagSEP, Protocol: 3, Algorithm: AlgECDSAP256SHA256, PublicKey: pub}
+	return &ZoneSigner{Keys: []*SigningKey{{DNSKEY: key, Private: priv}}}
+}
+
+// testRR returns a record parsed from its presentation form.
+func testRR(t *testing.T, name string, rrtype uint16, rdata string) *ResourceRecord {
+	t.Helper()
+	b, err := dnswire.ParseRData(rrtype, rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ResourceRecord{Name: name, Type: rrtype, Class: ClassINET, TTL: 300, RData: b}
+}
+
+func TestValidateCompressedCNAME(t *testing.T) {
+	signer, now := testSigner(t), time.Now()
+	sign := func(rr *ResourceRecord) []*ResourceRecord {
+		sigs, err := signer.sign("example.com", []*ResourceRecord{rr}, now.Add(-time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append([]*ResourceRecord{rr}, sigs...)
+	}
+	cname := testRR(t, "www.example.com", TypeCNAME, "web.example.com.")
+	a := testRR(t, "web.example.com", TypeA, "192.0.2.1")
+	resp := &Query{Header: Header{ID: 1, QR: true, RD: true, RA: true}}
+	// The CNAME goes last, so shortening its rdata below moves no name
+	// that others point to.
+	resp.SetQuestion("www.example.com", TypeA).AddAnswer(sign(a)...).AddAnswer(sign(cname)...)
+	data, err := resp.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compress the CNAME target against the question, as upstream
+	// servers do: web, then a pointer to example.com at offset 16.
+	plain := append([]byte{0, 17}, cname.RData...)
+	i := bytes.Index(data, plain)
+	if i < 0 {
+		t.Fatal("no CNAME rdata in the encoded answer")
+	}
+	compressed := []byte{0, 6, 3, 'w', 'e', 'b', 0xc0, 16}
+	data = append(append(data[:i:i], compressed...), data[i+len(plain):]...)
+
+	m, err := dnswire.ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Validator{keys: map[string]*zoneKeys{
+		"example.com": {keys: []*DNSKEY{signer.Keys[0].DNSKEY}, expires: now.Add(time.Hour)},
+	}}
+	secure, err := v.validate(nil, m, now)
+	if err != nil || !secure {
+		t.Errorf("validate = %v, %v; want a secure answer", secure, err)
+	}
+}
@@ -0,0 +1,94 @@
+package dnswire
+
+import (
+	"math/rand/v2"
+	"strings"
+)
+
+// The builders below keep the header counts in step with the sections,
+// so messages put together with them encode as they read.
+
+// NewQuery returns a query for name and qtype in class IN, with a random
+// ID and recursion desired. The name may be given with its final dot.
+func NewQuery(name string, qtype uint16) *Query {
+	q := &Query{Header: Header{ID: uint16(rand.Uint32()), RD: true}}
+	return q.SetQuestion(name, qtype)
+}
+
+// SetQuestion makes name and qtype in class IN q's only question.
+func (q *Query) SetQuestion(name string, qtype uint16) *Query {
+	q.Questions = nil
+	return q.AddQuestion(&Question{Name: strings.TrimSuffix(name, "."), QType: qtype, QClass: ClassINET})
+}
+
+// SetReply makes q the response to request: it takes the ID, opcode, RD
+// bit and questions of request and sets QR. The rcode is cleared; AA, RA
+// and the records q already holds are kept.
+func (q *Query) SetReply(request *Message) *Query {
+	q.Header.ID = request.Header.ID
+	q.Header.QR = true
+	q.Header.Opcode = request.Header.Opcode
+	q.Header.RD = request.Header.RD
+	q.Header.RCode = 0
+	q.Questions = request.Questions
+	q.Header.QDCount = uint16(len(q.Questions))
+	return q
+}
+
+// SetRcode makes q the response to request with the given rcode.
+func (q *Query) SetRcode(request *Message, rcode uint8) *Query {
+	q.SetReply(request)
+	q.Header.RCode = rcode
+	return q
+}
+
+func (q *Query) AddQuestion(questions ...*Question) *Query {
+	q.Questions = add(q.Questions, questions)
+	q.Header.QDCount = uint16(len(q.Questions))
+	return q
+}
+
+func (q *Query) AddAnswer(rrs ...*ResourceRecord) *Query {
+	q.Answers = add(q.Answers, rrs)
+	q.Header.ANCount = uint16(len(q.Answers))
+	return q
+}
+
+func (q *Query) AddAuthority(rrs ...*ResourceRecord) *Query {
+	q.Authorities = add(q.Authorities, rrs)
+	q.Header.NSCount = uint16(len(q.Authorities))
+	return q
+}
+
+func (q *Query) AddAdditional(rrs ...*ResourceRecord) *Query {
+	q.Additionals = add(q.Additionals, rrs)
+	q.Header.ARCount = uint16(len(q.Additionals))
+	return q
+}
+
+// add appends items to section. An empty section takes items over as they
+// are, capped so appending later copies rather than writing into the
+// caller's array.
+func add[T any](section, items []T) []T {
+	if len(section) == 0 {
+		return items[:len(items):len(items)]
+	}
+	return append(section, items...)
+}
+
+// SetEDNS gives q an OPT record advertising udpSize, with the DO bit set
+// when do is true, in place of any it had.
+func (q *Query) SetEDNS(udpSize uint16, do bool) *Query {
+	var ttl uint32
+	if do {
+		ttl |= 1 << 15
+	}
+	additionals := q.Additionals[:0:0]
+	for _, rr := range q.Additionals {
+		if rr.Type != TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	q.Additionals = additionals
+	return q.AddAdditional(&ResourceRecord{Type: TypeOPT, Class: udpSize, TTL: ttl})
+}
@@ -0,0 +1,52 @@
+package dnswire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RCodeError is a failure that has a response code to answer it with.
+// Errors wrapping one, as the parsers' do, are answered with its code.
+type RCodeError uint8
+
+const (
+	ErrFormat         = RCodeError(RCodeFormatError)
+	ErrServFail       = RCodeError(RCodeServerFailure)
+	ErrNXDomain       = RCodeError(RCodeNameError)
+	ErrNotImplemented = RCodeError(RCodeNotImplemented)
+	ErrRefused        = RCodeError(RCodeRefused)
+)
+
+var rcodeErrors = map[RCodeError]string{
+	ErrFormat:         "format error",
+	ErrServFail:       "server failure",
+	ErrNXDomain:       "no such domain",
+	ErrNotImplemented: "not implemented",
+	ErrRefused:        "refused",
+}
+
+func (e RCodeError) Error() string {
+	if s, ok := rcodeErrors[e]; ok {
+		return s
+	}
+	return RCodeString(uint8(e))
+}
+
+// RCodeOf returns the response code err should be answered with:
+// NOERROR for nil, the code of the RCodeError it wraps, or SERVFAIL for
+// anything else.
+func RCodeOf(err error) uint8 {
+	if err == nil {
+		return RCodeSuccess
+	}
+	var rc RCodeError
+	if errors.As(err, &rc) {
+		return uint8(rc)
+	}
+	return RCodeServerFailure
+}
+
+// malformed marks err, met while parsing, as a format error.
+func malformed(err error) error {
+	return fmt.Errorf("%w: %v", ErrFormat, err)
+}
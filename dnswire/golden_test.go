@@ -0,0 +1,172 @@
+package dnswire
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testdata/golden holds packets captured from the server, each NAME.bin
+// next to NAME.json, the message it decodes to. axfr-1 and axfr-2 are the
+// two messages of one zone transfer; the second has no question, so its
+// names only point into its own records. After a change to the JSON form,
+// rewrite the decoded messages with
+//
+//	go test -run Golden -update ./dnswire
+
+var update = flag.Bool("update", false, "rewrite the decoded messages in testdata/golden")
+
+func marshalGolden(t *testing.T, m *Message) []byte {
+	t.Helper()
+	out, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		t.Fatalf("marshalling: %v", err)
+	}
+	return append(out, '\n')
+}
+
+func TestGolden(t *testing.T) {
+	packets, err := filepath.Glob("testdata/golden/*.bin")
+	if err != nil || len(packets) == 0 {
+		t.Fatalf("no packets in testdata/golden: %v", err)
+	}
+	for _, path := range packets {
+		name := strings.TrimSuffix(filepath.Base(path), ".bin")
+		t.Run(name, func(t *testing.T) {
+			wire, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := ParseMessage(wire)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			if m.Size != len(wire) {
+				t.Errorf("parsed %d of %d bytes", m.Size, len(wire))
+			}
+			decoded := marshalGolden(t, m)
+			goldenPath := strings.TrimSuffix(path, ".bin") + ".json"
+			if *update {
+				if err := os.WriteFile(goldenPath, decoded, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, golden) {
+				t.Fatalf("decodes to\n%s\nwant\n%s", decoded, golden)
+			}
+
+			// The server wrote these packets with this encoder, so
+			// encoding them again gives back the same bytes.
+			if again, err := queryOf(m).AppendTo(nil); err != nil {
+				t.Errorf("encoding: %v", err)
+			} else if !bytes.Equal(again, wire) {
+				t.Errorf("encodes to %d bytes that differ from the %d captured", len(again), len(wire))
+			}
+			for _, compress := range []bool{true, false} {
+				again, err := queryOf(m).appendTo(nil, compress)
+				if err != nil {
+					t.Fatalf("encoding, compressed %v: %v", compress, err)
+				}
+				m2, err := ParseMessage(again)
+				if err != nil {
+					t.Fatalf("parsing what was encoded, compressed %v: %v", compress, err)
+				}
+				if diff := sameMessage(m2, queryOf(m)); diff != "" {
+					t.Errorf("compressed %v: %s", compress, diff)
+				}
+			}
+
+			// The decoded form encodes to the same message too.
+			var fromJSON Message
+			if err := json.Unmarshal(golden, &fromJSON); err != nil {
+				t.Fatalf("unmarshalling %s: %v", goldenPath, err)
+			}
+			again, err := queryOf(&fromJSON).AppendTo(nil)
+			if err != nil {
+				t.Fatalf("encoding %s: %v", goldenPath, err)
+			}
+			m2, err := ParseMessage(again)
+			if err != nil {
+				t.Fatalf("parsing %s encoded: %v", goldenPath, err)
+			}
+			if diff := sameMessage(m2, queryOf(m)); diff != "" {
+				t.Errorf("%s: %s", goldenPath, diff)
+			}
+		})
+	}
+}
+
+// goldenQueries returns the golden packets decoded, by name.
+func goldenQueries(tb testing.TB) map[string]*Query {
+	tb.Helper()
+	packets, err := filepath.Glob("testdata/golden/*.bin")
+	if err != nil || len(packets) == 0 {
+		tb.Fatalf("no packets in testdata/golden: %v", err)
+	}
+	queries := map[string]*Query{}
+	for _, path := range packets {
+		wire, err := os.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		m, err := ParseMessage(wire)
+		if err != nil {
+			tb.Fatalf("%s: %v", path, err)
+		}
+		queries[strings.TrimSuffix(filepath.Base(path), ".bin")] = queryOf(m)
+	}
+	return queries
+}
+
+// TestEncodeAllocs checks that encoding messages of the sizes the server
+// answers queries with into a reused buffer allocates nothing, names
+// included. Zone transfer messages hold more names than maxPooledNames,
+// so their compression maps are grown afresh, as BenchmarkEncodeGolden
+// shows.
+func TestEncodeAllocs(t *testing.T) {
+	for name, q := range goldenQueries(t) {
+		if strings.HasPrefix(name, "axfr") {
+			continue
+		}
+		buf := make([]byte, 0, 65535)
+		allocs := testing.AllocsPerRun(100, func() {
+			var err error
+			if buf, err = q.AppendTo(buf[:0]); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs > 0 {
+			t.Errorf("%s: encoding %d bytes made %v allocations", name, len(buf), allocs)
+		}
+	}
+}
+
+// BenchmarkEncodeGolden encodes each golden packet, from a one-record
+// answer to a zone transfer message, into a reused buffer.
+func BenchmarkEncodeGolden(b *testing.B) {
+	queries := goldenQueries(b)
+	for _, name := range slices.Sorted(maps.Keys(queries)) {
+		q := queries[name]
+		b.Run(name, func(b *testing.B) {
+			buf := make([]byte, 0, 65535)
+			b.ReportAllocs()
+			for range b.N {
+				var err error
+				if buf, err = q.AppendTo(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(int64(len(buf)))
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package dnswire
+
+import (
+	"hash/maphash"
+	"strings"
+	"sync/atomic"
+)
+
+// Names are interned in a fixed-size table indexed by their hash. A name
+// found in its slot is shared rather than allocated again, so popular
+// names, which keep finding themselves there, are parsed without
+// allocating and share one copy across messages, caches and zones. A
+// different name hashing to the slot takes it over, which bounds the table
+// without any bookkeeping.
+const internSlots = 4096
+
+var (
+	internSeed  = maphash.MakeSeed()
+	internTable [internSlots]atomic.Pointer[string]
+)
+
+// internBytes returns b as a string, shared with earlier names equal to it
+// while they hold the slot.
+func internBytes(b []byte) string {
+	slot := &internTable[maphash.Bytes(internSeed, b)%internSlots]
+	if p := slot.Load(); p != nil && *p == string(b) {
+		return *p
+	}
+	s := string(b)
+	slot.Store(&s)
+	return s
+}
+
+// Intern returns s shared with equal names in the table, including those
+// ReadName returned. s is copied if it isn't there, so a name cut from a
+// longer line doesn't keep the line alive.
+func Intern(s string) string {
+	slot := &internTable[maphash.String(internSeed, s)%internSlots]
+	if p := slot.Load(); p != nil && *p == s {
+		return *p
+	}
+	s = strings.Clone(s)
+	slot.Store(&s)
+	return s
+}
@@ -0,0 +1,171 @@
+package dnswire
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Messages, their headers, questions and records have one JSON form,
+// shared by everything that shows them outside the wire:
+//
+//	{"header": {"id": 4660, "qr": true, "opcode": 0, "aa": false, "tc": false,
+//	            "rd": true, "ra": true, "z": 0, "rcode": "NOERROR"},
+//	 "question": [{"name": "example.com.", "type": "A", "class": "IN"}],
+//	 "answer": [{"name": "example.com.", "type": "A", "class": "IN",
+//	             "ttl": 300, "data": "192.0.2.1"}]}
+//
+// Names are absolute, types, classes and rcodes go by their mnemonics,
+// and record data is in the presentation form of FormatRData. The section
+// counts are left out of the header, as they follow from the sections;
+// decoding a message sets them.
+
+type headerJSON struct {
+	ID     uint16 `json:"id"`
+	QR     bool   `json:"qr"`
+	Opcode uint8  `json:"opcode"`
+	AA     bool   `json:"aa"`
+	TC     bool   `json:"tc"`
+	RD     bool   `json:"rd"`
+	RA     bool   `json:"ra"`
+	Z      uint8  `json:"z"`
+	RCode  string `json:"rcode"`
+}
+
+func (h *Header) MarshalJSON() ([]byte, error) {
+	return json.Marshal(headerJSON{
+		ID: h.ID, QR: h.QR, Opcode: h.Opcode, AA: h.AA, TC: h.TC, RD: h.RD, RA: h.RA, Z: h.Z,
+		RCode: RCodeString(h.RCode),
+	})
+}
+
+func (h *Header) UnmarshalJSON(data []byte) error {
+	var j headerJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	rcode, ok := ParseRCode(j.RCode)
+	if !ok {
+		return fmt.Errorf("unknown rcode %q", j.RCode)
+	}
+	*h = Header{ID: j.ID, QR: j.QR, Opcode: j.Opcode, AA: j.AA, TC: j.TC, RD: j.RD, RA: j.RA, Z: j.Z, RCode: rcode}
+	return nil
+}
+
+type questionJSON struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+func (q *Question) MarshalJSON() ([]byte, error) {
+	return json.Marshal(questionJSON{Name: absolute(q.Name), Type: TypeString(q.QType), Class: ClassString(q.QClass)})
+}
+
+func (q *Question) UnmarshalJSON(data []byte) error {
+	var j questionJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	qtype, qclass, err := parseTypeClass(j.Type, j.Class)
+	if err != nil {
+		return err
+	}
+	*q = Question{Name: relative(j.Name), QType: qtype, QClass: qclass}
+	return nil
+}
+
+type recordJSON struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	TTL   uint32 `json:"ttl"`
+	Data  string `json:"data"`
+}
+
+func (rr *ResourceRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(recordJSON{
+		Name: absolute(rr.Name), Type: TypeString(rr.Type), Class: ClassString(rr.Class), TTL: rr.TTL,
+		Data: FormatRData(rr.Type, rr.RData),
+	})
+}
+
+func (rr *ResourceRecord) UnmarshalJSON(data []byte) error {
+	var j recordJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	rrtype, class, err := parseTypeClass(j.Type, j.Class)
+	if err != nil {
+		return err
+	}
+	rdata, err := ParseRData(rrtype, j.Data)
+	if err != nil {
+		return err
+	}
+	*rr = ResourceRecord{Name: relative(j.Name), Type: rrtype, Class: class, TTL: j.TTL, RData: rdata}
+	return nil
+}
+
+type messageJSON struct {
+	Header     *Header           `json:"header"`
+	Question   []*Question       `json:"question,omitempty"`
+	Answer     []*ResourceRecord `json:"answer,omitempty"`
+	Authority  []*ResourceRecord `json:"authority,omitempty"`
+	Additional []*ResourceRecord `json:"additional,omitempty"`
+}
+
+func (q *Query) MarshalJSON() ([]byte, error) {
+	return json.Marshal(messageJSON{&q.Header, q.Questions, q.Answers, q.Authorities, q.Additionals})
+}
+
+func (q *Query) UnmarshalJSON(data []byte) error {
+	j := messageJSON{Header: new(Header)}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*q = Query{Header: *j.Header}
+	q.AddQuestion(j.Question...).AddAnswer(j.Answer...).AddAuthority(j.Authority...).AddAdditional(j.Additional...)
+	return nil
+}
+
+func (m *Message) MarshalJSON() ([]byte, error) {
+	h := m.Header
+	if h == nil {
+		h = new(Header)
+	}
+	return json.Marshal(messageJSON{h, m.Questions, m.Answers, m.Authorities, m.Additionals})
+}
+
+// UnmarshalJSON decodes a message as if it was parsed, though it has no
+// Size and isn't pooled.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var q Query
+	if err := q.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*m = Message{Header: &q.Header, Questions: q.Questions, Answers: q.Answers, Authorities: q.Authorities, Additionals: q.Additionals}
+	return nil
+}
+
+func parseTypeClass(typ, class string) (uint16, uint16, error) {
+	t, ok := ParseType(typ)
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown type %q", typ)
+	}
+	c, ok := ParseClass(class)
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown class %q", class)
+	}
+	return t, c, nil
+}
+
+// absolute and relative convert between the names messages hold, without
+// the final dot, and the absolute names of the JSON form.
+func absolute(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+func relative(name string) string {
+	return strings.TrimSuffix(name, ".")
+}
@@ -0,0 +1,160 @@
+package dnswire
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// LazyMessage is a DNS message parsed only as far as finding where each
+// question and record starts. Names and rdata are decoded when asked for,
+// so paths that look at the header and question and pass the bytes on,
+// like forwarding, don't pay for decoding every record. The message must
+// not change while the LazyMessage is in use.
+type LazyMessage struct {
+	Header *Header
+	data   []byte
+	// offsets holds where each question and then each record starts, in
+	// message order.
+	offsets []int
+}
+
+// ParseLazy checks that data is a well-formed message and indexes it.
+// Compression pointers are only checked when the names are decoded.
+// Errors wrap ErrFormat.
+func ParseLazy(data []byte) (*LazyMessage, error) {
+	m, err := parseLazy(data)
+	if err != nil {
+		return nil, malformed(err)
+	}
+	return m, nil
+}
+
+func parseLazy(data []byte) (*LazyMessage, error) {
+	h := &Header{}
+	if err := h.unpack(data); err != nil {
+		return nil, err
+	}
+	qd, rrs := int(h.QDCount), int(h.ANCount)+int(h.NSCount)+int(h.ARCount)
+	if minSize := 12 + 5*qd + 11*rrs; minSize > len(data) {
+		return nil, fmt.Errorf("header counts need at least %d bytes, message has %d", minSize, len(data))
+	}
+
+	m := &LazyMessage{Header: h, data: data, offsets: make([]int, 0, qd+rrs)}
+	p := &Reader{data: data, off: 12}
+	for i := 0; i < qd+rrs; i++ {
+		m.offsets = append(m.offsets, p.off)
+		if err := p.SkipName(); err != nil {
+			return nil, err
+		}
+		if i < qd {
+			if _, err := p.ReadBytes(4); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// type, class and TTL
+		if _, err := p.ReadBytes(8); err != nil {
+			return nil, err
+		}
+		rdlen, err := p.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.ReadBytes(int(rdlen)); err != nil {
+			return nil, fmt.Errorf("truncated rdata: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// SkipName moves past the name at p.off without decoding it.
+func (p *Reader) SkipName() error {
+	for length := 1; ; {
+		c, err := p.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == 0:
+			return nil
+		case c&0xC0 == 0xC0:
+			_, err := p.ReadByte()
+			return err
+		case c&0xC0 != 0:
+			return fmt.Errorf("unsupported label type %#x", c&0xC0)
+		}
+		length += int(c) + 1
+		if length > MaxNameLength {
+			return fmt.Errorf("name longer than %d octets", MaxNameLength)
+		}
+		if _, err := p.ReadBytes(int(c)); err != nil {
+			return fmt.Errorf("truncate label")
+		}
+	}
+}
+
+// Bytes returns the message the LazyMessage was parsed from.
+func (m *LazyMessage) Bytes() []byte {
+	return m.data
+}
+
+// Detach copies the message out of the buffer it was parsed from, so the
+// buffer can be reused.
+func (m *LazyMessage) Detach() {
+	m.data = bytes.Clone(m.data)
+}
+
+// Question decodes question i.
+func (m *LazyMessage) Question(i int) (*Question, error) {
+	if i < 0 || i >= int(m.Header.QDCount) {
+		return nil, fmt.Errorf("no question %d", i)
+	}
+	return (&Reader{data: m.data, off: m.offsets[i]}).ReadQuestion()
+}
+
+// Answers decodes the answer section.
+func (m *LazyMessage) Answers() ([]*ResourceRecord, error) {
+	first := int(m.Header.QDCount)
+	return m.records(first, first+int(m.Header.ANCount))
+}
+
+func (m *LazyMessage) records(from, to int) ([]*ResourceRecord, error) {
+	if from == to {
+		return nil, nil
+	}
+	rrs := make([]*ResourceRecord, 0, to-from)
+	for _, off := range m.offsets[from:to] {
+		rr, err := (&Reader{data: m.data, off: off}).ReadResourceRecord()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// Message decodes the whole message. Its rdata points into the bytes the
+// LazyMessage was parsed from, except where compressed names in it were
+// expanded.
+func (m *LazyMessage) Message() (*Message, error) {
+	msg := &Message{Header: m.Header}
+	qd, an, ns := int(m.Header.QDCount), int(m.Header.ANCount), int(m.Header.NSCount)
+	for i := range qd {
+		q, err := m.Question(i)
+		if err != nil {
+			return nil, err
+		}
+		msg.Questions = append(msg.Questions, q)
+	}
+	var err error
+	if msg.Answers, err = m.records(qd, qd+an); err != nil {
+		return nil, err
+	}
+	if msg.Authorities, err = m.records(qd+an, qd+an+ns); err != nil {
+		return nil, err
+	}
+	if msg.Additionals, err = m.records(qd+an+ns, len(m.offsets)); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,284 @@
+// Package dnswire encodes and decodes DNS messages (RFC 1035): headers,
+// questions and resource records, with name compression, lazy parsing
+// and pooled messages for hot paths. Record data is kept in wire form.
+package dnswire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type Query struct {
+	Header      Header
+	Questions   []*Question
+	Answers     []*ResourceRecord
+	Authorities []*ResourceRecord
+	Additionals []*ResourceRecord
+}
+
+// Encode returns q in wire form.
+func (q *Query) Encode() ([]byte, error) {
+	return q.AppendTo(make([]byte, 0, 512))
+}
+
+// AppendTo appends q in wire form to buf, compressing names, so a whole
+// response can be encoded into one pooled buffer. The header counts have
+// to match the sections, and names and rdata have to fit their length
+// fields. On error buf is returned unchanged.
+func (q *Query) AppendTo(buf []byte) ([]byte, error) {
+	return q.appendTo(buf, true)
+}
+
+// AppendToUncompressed is AppendTo writing every name in full, for
+// clients that mishandle compression pointers.
+func (q *Query) AppendToUncompressed(buf []byte) ([]byte, error) {
+	return q.appendTo(buf, false)
+}
+
+func (q *Query) appendTo(buf []byte, compress bool) ([]byte, error) {
+	if err := q.checkCounts(); err != nil {
+		return buf, err
+	}
+	start := len(buf)
+	var c *Compression
+	if compress {
+		c = NewCompression(start)
+		defer c.Release()
+	}
+	buf, err := q.Header.AppendTo(buf)
+	for _, question := range q.Questions {
+		if err != nil {
+			break
+		}
+		buf, err = question.AppendTo(buf, c)
+	}
+	for _, section := range [][]*ResourceRecord{q.Answers, q.Authorities, q.Additionals} {
+		for _, rr := range section {
+			if err != nil {
+				break
+			}
+			buf, err = rr.AppendTo(buf, c)
+		}
+	}
+	if err != nil {
+		return buf[:start], err
+	}
+	return buf, nil
+}
+
+func (q *Query) checkCounts() error {
+	h := &q.Header
+	for _, c := range []struct {
+		section string
+		count   uint16
+		len     int
+	}{
+		{"question", h.QDCount, len(q.Questions)},
+		{"answer", h.ANCount, len(q.Answers)},
+		{"authority", h.NSCount, len(q.Authorities)},
+		{"additional", h.ARCount, len(q.Additionals)},
+	} {
+		if int(c.count) != c.len {
+			return fmt.Errorf("header counts %d %s records, the section holds %d", c.count, c.section, c.len)
+		}
+	}
+	return nil
+}
+
+type ResourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	RData []byte
+}
+
+// AppendTo appends rr in wire form to buf, compressing its owner name with
+// c, which may be nil.
+func (rr *ResourceRecord) AppendTo(buf []byte, c *Compression) ([]byte, error) {
+	if len(rr.RData) > 0xFFFF {
+		return buf, fmt.Errorf("%s %s rdata is %d octets, more than 65535", strings.TrimSuffix(rr.Name, ".")+".", TypeString(rr.Type), len(rr.RData))
+	}
+	buf, err := AppendName(buf, rr.Name, c)
+	if err != nil {
+		return buf, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, rr.Type)
+	buf = binary.BigEndian.AppendUint16(buf, rr.Class)
+	buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rr.RData)))
+	return append(buf, rr.RData...), nil
+}
+
+type Encoder interface {
+	Encode() ([]byte, error)
+}
+
+type Question struct {
+	Name   string
+	QType  uint16
+	QClass uint16
+}
+
+// Compression records where names were written in a message, so later
+// occurrences can point back at them. base is where the message starts in
+// the buffer.
+type Compression struct {
+	base    int
+	offsets map[string]uint16
+}
+
+// The maps are pooled, as encoding every response would otherwise grow a
+// fresh one. Maps that held more than maxPooledNames names, as a zone
+// transfer's do, are left to the GC.
+var compressionPool = sync.Pool{New: func() any { return &Compression{offsets: map[string]uint16{}} }}
+
+const maxPooledNames = 256
+
+// NewCompression returns an empty Compression for a message starting at
+// base in the buffer it is encoded into. Release hands it back once the
+// message is encoded.
+func NewCompression(base int) *Compression {
+	c := compressionPool.Get().(*Compression)
+	c.base = base
+	return c
+}
+
+func (c *Compression) Release() {
+	if len(c.offsets) > maxPooledNames {
+		return
+	}
+	// Clearing also drops the names, which belong to the message.
+	clear(c.offsets)
+	compressionPool.Put(c)
+}
+
+// forget drops the suffixes of name up to last, which AppendName recorded
+// before finding name can't be encoded, so nothing points at the bytes it
+// takes back. None of them were recorded before, or AppendName would have
+// pointed at them.
+func (c *Compression) forget(name, last string) {
+	if c == nil {
+		return
+	}
+	for suffix := name; ; {
+		delete(c.offsets, suffix)
+		if len(suffix) <= len(last) {
+			return
+		}
+		_, suffix, _ = strings.Cut(suffix, ".")
+	}
+}
+
+// maxPointer is the largest offset a compression pointer can hold.
+const maxPointer = 0x3FFF
+
+// AppendName appends name in wire form to buf, compressed against the names
+// in c unless c is nil.
+func AppendName(buf []byte, name string, c *Compression) ([]byte, error) {
+	if name == "" {
+		return append(buf, 0), nil
+	}
+	if len(name)+2 > MaxNameLength {
+		return buf, fmt.Errorf("name %q longer than %d octets", name, MaxNameLength)
+	}
+
+	start := len(buf)
+	// Every suffix is a substring of name, so looking them up doesn't
+	// allocate.
+	for suffix := name; ; {
+		if c != nil {
+			if pos, ok := c.offsets[suffix]; ok {
+				return binary.BigEndian.AppendUint16(buf, 0xC000|pos), nil
+			}
+			// Suffixes past maxPointer can't be pointed at, so they aren't
+			// recorded.
+			if pos := len(buf) - c.base; pos <= maxPointer {
+				c.offsets[suffix] = uint16(pos)
+			}
+		}
+
+		label, rest, more := strings.Cut(suffix, ".")
+		switch {
+		case label == "":
+			c.forget(name, suffix)
+			return buf[:start], fmt.Errorf("name %q has an empty label", name)
+		case len(label) > MaxLabelLength:
+			c.forget(name, suffix)
+			return buf[:start], fmt.Errorf("name %q has a label longer than %d octets", name, MaxLabelLength)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+		if !more {
+			break
+		}
+		suffix = rest
+	}
+
+	return append(buf, 0), nil
+}
+
+// AppendTo appends q in wire form to buf, compressing its name with c,
+// which may be nil.
+func (q *Question) AppendTo(buf []byte, c *Compression) ([]byte, error) {
+	buf, err := AppendName(buf, q.Name, c)
+	if err != nil {
+		return buf, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, q.QType)
+	return binary.BigEndian.AppendUint16(buf, q.QClass), nil
+}
+
+type Header struct {
+	ID      uint16
+	QR      bool
+	Opcode  uint8
+	AA      bool
+	TC      bool
+	RD      bool
+	RA      bool
+	Z       uint8
+	RCode   uint8
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+func (h *Header) Encode() ([]byte, error) {
+	return h.AppendTo(make([]byte, 0, 12))
+}
+
+// AppendTo appends h in wire form to buf. It never fails; the error is
+// there so it matches the other AppendTo methods.
+func (h *Header) AppendTo(buf []byte) ([]byte, error) {
+	var flags uint16
+	if h.QR {
+		flags |= 1 << 15
+	}
+	flags |= (uint16(h.Opcode) & 0xF) << 11
+	if h.AA {
+		flags |= 1 << 10
+	}
+	if h.TC {
+		flags |= 1 << 9
+	}
+	if h.RD {
+		flags |= 1 << 8
+	}
+	if h.RA {
+		flags |= 1 << 7
+	}
+	flags |= (uint16(h.Z) & 0x7) << 4
+	flags |= (uint16(h.RCode) & 0xF)
+
+	buf = binary.BigEndian.AppendUint16(buf, h.ID)
+	buf = binary.BigEndian.AppendUint16(buf, flags)
+	buf = binary.BigEndian.AppendUint16(buf, h.QDCount)
+	buf = binary.BigEndian.AppendUint16(buf, h.ANCount)
+	buf = binary.BigEndian.AppendUint16(buf, h.NSCount)
+	buf = binary.BigEndian.AppendUint16(buf, h.ARCount)
+	return buf, nil
+}
@@ -0,0 +1,382 @@
+package dnswire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// sameMessage reports how m differs from q, or "" if it doesn't. Empty
+// and nil rdata are the same.
+func sameMessage(m *Message, q *Query) string {
+	if *m.Header != q.Header {
+		return fmt.Sprintf("header %+v, want %+v", *m.Header, q.Header)
+	}
+	if len(m.Questions) != len(q.Questions) {
+		return fmt.Sprintf("%d questions, want %d", len(m.Questions), len(q.Questions))
+	}
+	for i, got := range m.Questions {
+		if *got != *q.Questions[i] {
+			return fmt.Sprintf("question %d is %+v, want %+v", i, *got, *q.Questions[i])
+		}
+	}
+	for _, s := range []struct {
+		name      string
+		got, want []*ResourceRecord
+	}{
+		{"answer", m.Answers, q.Answers},
+		{"authority", m.Authorities, q.Authorities},
+		{"additional", m.Additionals, q.Additionals},
+	} {
+		if len(s.got) != len(s.want) {
+			return fmt.Sprintf("%d %s records, want %d", len(s.got), s.name, len(s.want))
+		}
+		for i, got := range s.got {
+			want := s.want[i]
+			if got.Name != want.Name || got.Type != want.Type || got.Class != want.Class || got.TTL != want.TTL || !bytes.Equal(got.RData, want.RData) {
+				return fmt.Sprintf("%s record %d is %+v, want %+v", s.name, i, *got, *want)
+			}
+		}
+	}
+	return ""
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for name, q := range sampleQueries(t) {
+		for _, compress := range []bool{true, false} {
+			wire, err := q.appendTo(nil, compress)
+			if err != nil {
+				t.Fatalf("%s: encoding: %v", name, err)
+			}
+			m, err := ParseMessage(wire)
+			if err != nil {
+				t.Fatalf("%s: parsing what was encoded: %v", name, err)
+			}
+			if diff := sameMessage(m, q); diff != "" {
+				t.Errorf("%s, compressed %v: %s", name, compress, diff)
+			}
+			if m.Size != len(wire) {
+				t.Errorf("%s: parsed %d of %d bytes", name, m.Size, len(wire))
+			}
+		}
+	}
+}
+
+// TestEncodeLarge encodes a message bigger than compression pointers can
+// reach: names past 0x3FFF are written in full and still decode.
+func TestEncodeLarge(t *testing.T) {
+	q := NewQuery("big.example.com", TypeTXT)
+	q.Header.QR = true
+	for i := range 600 {
+		q.AddAnswer(&ResourceRecord{Name: fmt.Sprintf("host%d.big.example.com", i), Type: TypeTXT, Class: ClassINET, TTL: 60, RData: []byte("\x10" + strings.Repeat("x", 16))})
+	}
+	wire, err := q.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wire) <= maxPointer {
+		t.Fatalf("message is only %d bytes", len(wire))
+	}
+	m, err := ParseMessage(wire)
+	if err != nil {
+		t.Fatalf("parsing what was encoded: %v", err)
+	}
+	if diff := sameMessage(m, q); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// checkName reads the name at off in msg, failing unless every pointer in
+// it points backwards, within maxPointer and past the header. It returns
+// the name and where it ends.
+func checkName(t *testing.T, msg []byte, off int) (string, int) {
+	t.Helper()
+	var labels []string
+	end := -1
+	for pos := off; ; {
+		if pos >= len(msg) {
+			t.Fatalf("name at %d runs past the message", off)
+		}
+		n := int(msg[pos])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = pos + 1
+			}
+			return strings.Join(labels, "."), end
+		case n&0xC0 == 0xC0:
+			if pos+1 >= len(msg) {
+				t.Fatalf("pointer at %d runs past the message", pos)
+			}
+			target := int(binary.BigEndian.Uint16(msg[pos:]) & 0x3FFF)
+			switch {
+			case target >= pos:
+				t.Fatalf("pointer at %d points forward to %d", pos, target)
+			case target > maxPointer:
+				t.Fatalf("pointer at %d points past %#x to %d", pos, maxPointer, target)
+			case target < 12:
+				t.Fatalf("pointer at %d points into the header at %d", pos, target)
+			}
+			if end < 0 {
+				end = pos + 2
+			}
+			pos = target
+		case n&0xC0 != 0:
+			t.Fatalf("reserved label type %#x at %d", n, pos)
+		default:
+			if pos+1+n > len(msg) {
+				t.Fatalf("label at %d runs past the message", pos)
+			}
+			labels = append(labels, string(msg[pos+1:pos+1+n]))
+			pos += 1 + n
+		}
+	}
+}
+
+// checkPointers walks the names in msg, the encoding of q, checking that
+// each decodes to the name q holds there. Without compress every name
+// must be written in full.
+func checkPointers(t *testing.T, msg []byte, q *Query, compress bool) {
+	t.Helper()
+	pos := 12
+	check := func(where, want string) {
+		t.Helper()
+		got, end := checkName(t, msg, pos)
+		if got != want {
+			t.Fatalf("%s at %d decodes to %q, want %q", where, pos, got, want)
+		}
+		full := len(want) + 2
+		if want == "" {
+			full = 1
+		}
+		if !compress && end-pos != full {
+			t.Fatalf("%s at %d takes %d bytes, not the %d of the full name", where, pos, end-pos, full)
+		}
+		pos = end
+	}
+	for i, question := range q.Questions {
+		check(fmt.Sprintf("question %d", i), question.Name)
+		pos += 4
+	}
+	for _, section := range [][]*ResourceRecord{q.Answers, q.Authorities, q.Additionals} {
+		for _, rr := range section {
+			check(fmt.Sprintf("%s %s", rr.Name, TypeString(rr.Type)), rr.Name)
+			pos += 10 + len(rr.RData)
+		}
+	}
+	if pos != len(msg) {
+		t.Fatalf("the records end at %d of %d bytes", pos, len(msg))
+	}
+}
+
+// pointerQueries returns messages whose names share suffixes in every way
+// compression has to handle, including one past what pointers can reach.
+func pointerQueries(t *testing.T) map[string]*Query {
+	queries := sampleQueries(t)
+
+	// Names built from few labels repeat whole names, suffixes and
+	// labels that aren't suffixes.
+	rng := rand.New(rand.NewPCG(1, 2))
+	labels := []string{"a", "b", "www", "mail", "example", "com", "net", "x"}
+	random := NewQuery("example.com", TypeANY)
+	for range 2000 {
+		name := make([]string, 1+rng.IntN(6))
+		for i := range name {
+			name[i] = labels[rng.IntN(len(labels))]
+		}
+		random.AddAnswer(&ResourceRecord{Name: strings.Join(name, "."), Type: TypeA, Class: ClassINET, TTL: 60, RData: []byte{192, 0, 2, 1}})
+	}
+	random.AddAdditional(&ResourceRecord{Type: TypeOPT, Class: 1232})
+	queries["random"] = random
+
+	// Names first seen past maxPointer are written in full and never
+	// pointed at, while those seen earlier still are.
+	large := NewQuery("big.example.com", TypeTXT)
+	for i := range 1200 {
+		large.AddAnswer(&ResourceRecord{Name: fmt.Sprintf("host%d.big.example.com", i%700), Type: TypeTXT, Class: ClassINET, TTL: 60, RData: []byte("\x08xxxxxxxx")})
+	}
+	queries["large"] = large
+
+	// Labels of the longest length and names of the longest length.
+	long := NewQuery(strings.Repeat("x", 63)+".example.com", TypeA)
+	longName := strings.Repeat("abcdefghi.", 24) + "example.com"
+	for _, name := range []string{longName, "a." + longName[2:], strings.Repeat("x", 63) + ".example.com", "example.com", "com", ""} {
+		long.AddAnswer(&ResourceRecord{Name: name, Type: TypeA, Class: ClassINET, RData: []byte{192, 0, 2, 1}})
+	}
+	queries["long"] = long
+	return queries
+}
+
+// TestCompressionPointers checks every name written in every message, both
+// compressed and uncompressed.
+func TestCompressionPointers(t *testing.T) {
+	for name, q := range pointerQueries(t) {
+		for _, compress := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/compressed=%v", name, compress), func(t *testing.T) {
+				msg, err := q.appendTo(nil, compress)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkPointers(t, msg, q, compress)
+				if name == "large" && len(msg) <= maxPointer {
+					t.Fatalf("message is only %d bytes", len(msg))
+				}
+
+				// Pointers are relative to the message, not the buffer
+				// it is appended to.
+				prefixed, err := q.appendTo([]byte("prefix"), compress)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(prefixed[len("prefix"):], msg) {
+					t.Fatal("encodes differently after a prefix")
+				}
+			})
+		}
+	}
+}
+
+// TestAppendNameAfterError checks that a name that fails to encode leaves
+// nothing in the compression map for later names to point at.
+func TestAppendNameAfterError(t *testing.T) {
+	for _, bad := range []string{"a..example.com", "ok." + strings.Repeat("x", 64) + ".example.com", "example.com."} {
+		c := NewCompression(0)
+		buf := make([]byte, 12)
+		buf, err := AppendName(buf, "example.com", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf, err = AppendName(buf, bad, c); err == nil {
+			t.Fatalf("%q encoded without an error", bad)
+		}
+		if _, err := AppendName(buf, bad, c); err == nil {
+			t.Errorf("%q encoded without an error the second time", bad)
+		}
+		buf, err = AppendName(buf, "www.example.com", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := checkName(t, buf, 12+len("example.com")+2); got != "www.example.com" {
+			t.Errorf("after %q, www.example.com decodes to %q", bad, got)
+		}
+		c.Release()
+	}
+}
+
+func TestEncodeCountMismatch(t *testing.T) {
+	rr := &ResourceRecord{Name: "example.com", Type: TypeA, Class: ClassINET, RData: []byte{192, 0, 2, 1}}
+	for _, tt := range []struct {
+		section string
+		change  func(q *Query)
+	}{
+		{"question", func(q *Query) { q.Header.QDCount++ }},
+		{"question", func(q *Query) { q.Questions = nil }},
+		{"answer", func(q *Query) { q.Answers = append(q.Answers, rr) }},
+		{"answer", func(q *Query) { q.Header.ANCount = 0 }},
+		{"authority", func(q *Query) { q.Header.NSCount = 5 }},
+		{"authority", func(q *Query) { q.Authorities = nil }},
+		{"additional", func(q *Query) { q.Header.ARCount++ }},
+		{"additional", func(q *Query) { q.Additionals = nil }},
+	} {
+		q := NewQuery("example.com", TypeA).AddAnswer(rr).AddAuthority(rr).AddAdditional(rr)
+		tt.change(q)
+		buf := []byte("prefix")
+		out, err := q.AppendTo(buf)
+		if err == nil || !strings.Contains(err.Error(), tt.section) {
+			t.Errorf("%s count mismatch: got error %v", tt.section, err)
+		}
+		if string(out) != "prefix" {
+			t.Errorf("%s count mismatch: buffer changed to %q", tt.section, out)
+		}
+	}
+}
+
+// TestEncodeErrorLeavesBuffer checks that a record that can't be encoded
+// leaves the buffer as it was.
+func TestEncodeErrorLeavesBuffer(t *testing.T) {
+	for name, rr := range map[string]*ResourceRecord{
+		"empty label": {Name: "a..example.com", Type: TypeA, Class: ClassINET},
+		"long label":  {Name: strings.Repeat("x", 64) + ".example.com", Type: TypeA, Class: ClassINET},
+		"long name":   {Name: strings.Repeat("abcdefghi.", 26) + "com", Type: TypeA, Class: ClassINET},
+		"long rdata":  {Name: "example.com", Type: TypeTXT, Class: ClassINET, RData: make([]byte, 0x10000)},
+	} {
+		q := NewQuery("example.com", TypeA).AddAnswer(rr)
+		out, err := q.AppendTo([]byte("prefix"))
+		if err == nil {
+			t.Errorf("%s: encoded without an error", name)
+		}
+		if string(out) != "prefix" {
+			t.Errorf("%s: buffer changed to %q", name, out)
+		}
+	}
+}
+
+// BenchmarkEncode encodes a typical referral-sized response into a
+// reused buffer, as the server does for every answer.
+func BenchmarkEncode(b *testing.B) {
+	q := sampleQueries(b)["response"]
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	for range b.N {
+		var err error
+		if buf, err = q.AppendTo(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(len(buf)))
+}
+
+// BenchmarkAppendName writes the names of a typical response, most
+// sharing a suffix, with a pooled compression map and without one. Name
+// encoding shouldn't allocate either way.
+func BenchmarkAppendName(b *testing.B) {
+	names := []string{
+		"www.example.com", "web.cdn.example.com", "example.com",
+		"ns1.example.com", "ns2.example.com", "a.b.c.d.e.f.g.example.com",
+		"mail.example.org", "",
+	}
+	b.Run("compressed", func(b *testing.B) {
+		buf := make([]byte, 0, 512)
+		b.ReportAllocs()
+		for range b.N {
+			c := NewCompression(0)
+			buf = buf[:12]
+			for _, name := range names {
+				var err error
+				if buf, err = AppendName(buf, name, c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			c.Release()
+		}
+	})
+	b.Run("uncompressed", func(b *testing.B) {
+		buf := make([]byte, 0, 512)
+		b.ReportAllocs()
+		for range b.N {
+			buf = buf[:12]
+			for _, name := range names {
+				var err error
+				if buf, err = AppendName(buf, name, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("long", func(b *testing.B) {
+		name := strings.Repeat("label.", 40) + "example"
+		buf := make([]byte, 0, 512)
+		b.ReportAllocs()
+		for range b.N {
+			c := NewCompression(0)
+			var err error
+			if buf, err = AppendName(buf[:12], name, c); err != nil {
+				b.Fatal(err)
+			}
+			c.Release()
+		}
+	})
+}
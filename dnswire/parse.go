@@ -0,0 +1,431 @@
+package dnswire
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type Message struct {
+	Header      *Header
+	Questions   []*Question
+	Answers     []*ResourceRecord
+	Authorities []*ResourceRecord
+	Additionals []*ResourceRecord
+	// Size is how many bytes of the input the message took up, 0 for a
+	// message that wasn't parsed. Anything past it is trailing data.
+	Size int
+
+	// sections is set when the message came from the pool.
+	sections *messageSections
+}
+
+// ParseMessage decodes data. Record data points into data, except that of
+// types whose names may be compressed, which is copied out with the names
+// expanded if any are. Errors wrap ErrFormat.
+func ParseMessage(data []byte) (*Message, error) {
+	return new(messageSections).parse(data)
+}
+
+// messageSections is a Message together with the header, questions and
+// records it points to, allocated in one piece and reusable as a whole.
+type messageSections struct {
+	msg       Message
+	header    Header
+	questions []Question
+	records   []ResourceRecord
+	qptrs     []*Question
+	rptrs     []*ResourceRecord
+}
+
+func (s *messageSections) parse(data []byte) (*Message, error) {
+	m, err := s.parseSections(data)
+	if err != nil {
+		return nil, malformed(err)
+	}
+	return m, nil
+}
+
+func (s *messageSections) parseSections(data []byte) (*Message, error) {
+	if err := s.header.unpack(data); err != nil {
+		return nil, err
+	}
+	h := &s.header
+	// Every question takes at least 5 bytes and every record 11, so
+	// counts that can't fit are rejected before anything is parsed.
+	minSize := 12 + 5*int(h.QDCount) + 11*(int(h.ANCount)+int(h.NSCount)+int(h.ARCount))
+	if minSize > len(data) {
+		return nil, fmt.Errorf("header counts need at least %d bytes, message has %d", minSize, len(data))
+	}
+
+	p := &Reader{data: data, off: 12}
+	m := &s.msg
+	m.Header = h
+
+	// The counts fit the message, so allocating for them up front is
+	// bounded by its size. Each section gets its own slice, while the
+	// questions and records themselves share one backing array each.
+	if h.QDCount > 0 {
+		s.questions = resize(s.questions, int(h.QDCount))
+		s.qptrs = resize(s.qptrs, int(h.QDCount))
+		for i := range s.questions {
+			if err := p.parseQuestion(&s.questions[i]); err != nil {
+				return nil, err
+			}
+			s.qptrs[i] = &s.questions[i]
+		}
+		m.Questions = s.qptrs
+	}
+
+	counts := []uint16{h.ANCount, h.NSCount, h.ARCount}
+	sections := []*[]*ResourceRecord{&m.Answers, &m.Authorities, &m.Additionals}
+	s.records = resize(s.records, int(h.ANCount)+int(h.NSCount)+int(h.ARCount))
+	s.rptrs = resize(s.rptrs, len(s.records))
+	n := 0
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		for j := n; j < n+int(count); j++ {
+			if err := p.parseResourceRecord(&s.records[j]); err != nil {
+				return nil, err
+			}
+			s.rptrs[j] = &s.records[j]
+		}
+		*sections[i] = s.rptrs[n : n+int(count) : n+int(count)]
+		n += int(count)
+	}
+
+	m.Size = p.off
+	return m, nil
+}
+
+// resize returns s with length n, reusing its array if it is big enough.
+func resize[T any](s []T, n int) []T {
+	if cap(s) >= n {
+		return s[:n]
+	}
+	return make([]T, n)
+}
+
+// Reader decodes the fields of a message or of record data in order.
+type Reader struct {
+	data []byte
+	off  int
+}
+
+// NewReader returns a Reader of data starting at off. Names in data can
+// only be decoded if data is the whole message.
+func NewReader(data []byte, off int) *Reader {
+	return &Reader{data: data, off: off}
+}
+
+// Offset returns where the next read starts.
+func (p *Reader) Offset() int {
+	return p.off
+}
+
+// need returns an error unless n more bytes can be read.
+func (p *Reader) need(n int) error {
+	if p.off+n > len(p.data) {
+		return fmt.Errorf("message truncated at offset %d", p.off)
+	}
+	return nil
+}
+
+func (p *Reader) ReadByte() (byte, error) {
+	if err := p.need(1); err != nil {
+		return 0, err
+	}
+	b := p.data[p.off]
+	p.off++
+	return b, nil
+}
+
+func (p *Reader) ReadUint16() (uint16, error) {
+	if err := p.need(2); err != nil {
+		return 0, err
+	}
+	v := binary.BigEndian.Uint16(p.data[p.off:])
+	p.off += 2
+	return v, nil
+}
+
+func (p *Reader) ReadUint32() (uint32, error) {
+	if err := p.need(4); err != nil {
+		return 0, err
+	}
+	v := binary.BigEndian.Uint32(p.data[p.off:])
+	p.off += 4
+	return v, nil
+}
+
+func (p *Reader) ReadBytes(n int) ([]byte, error) {
+	if err := p.need(n); err != nil {
+		return nil, err
+	}
+	b := p.data[p.off : p.off+n]
+	p.off += n
+	return b, nil
+}
+
+func ParseHeader(data []byte) (*Header, error) {
+	h := &Header{}
+	if err := h.unpack(data); err != nil {
+		return nil, malformed(err)
+	}
+	return h, nil
+}
+
+func (h *Header) unpack(data []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("too short for DNS header")
+	}
+
+	h.ID = binary.BigEndian.Uint16(data[0:2])
+	flags := binary.BigEndian.Uint16(data[2:4])
+	h.QR = (flags>>15)&1 == 1
+	h.Opcode = uint8((flags >> 11) & 0xF)
+	h.AA = (flags>>10)&1 == 1
+	h.TC = (flags>>9)&1 == 1
+	h.RD = (flags>>8)&1 == 1
+	h.RA = (flags>>7)&1 == 1
+	h.Z = uint8((flags >> 4) & 0x7)
+	h.RCode = uint8(flags & 0xF)
+
+	h.QDCount = binary.BigEndian.Uint16(data[4:6])
+	h.ANCount = binary.BigEndian.Uint16(data[6:8])
+	h.NSCount = binary.BigEndian.Uint16(data[8:10])
+	h.ARCount = binary.BigEndian.Uint16(data[10:12])
+
+	return nil
+}
+
+func (p *Reader) ReadQuestion() (*Question, error) {
+	q := &Question{}
+	if err := p.parseQuestion(q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (p *Reader) parseQuestion(q *Question) error {
+	var err error
+	if q.Name, err = p.ReadName(); err != nil {
+		return err
+	}
+	if q.QType, err = p.ReadUint16(); err != nil {
+		return err
+	}
+	q.QClass, err = p.ReadUint16()
+	return err
+}
+
+func (p *Reader) ReadResourceRecord() (*ResourceRecord, error) {
+	rr := &ResourceRecord{}
+	if err := p.parseResourceRecord(rr); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+func (p *Reader) parseResourceRecord(rr *ResourceRecord) error {
+	var err error
+	if rr.Name, err = p.ReadName(); err != nil {
+		return err
+	}
+	if rr.Type, err = p.ReadUint16(); err != nil {
+		return err
+	}
+	if rr.Class, err = p.ReadUint16(); err != nil {
+		return err
+	}
+	if rr.TTL, err = p.ReadUint32(); err != nil {
+		return err
+	}
+	rdlen, err := p.ReadUint16()
+	if err != nil {
+		return err
+	}
+	start := p.off
+	if rr.RData, err = p.ReadBytes(int(rdlen)); err != nil {
+		return fmt.Errorf("truncated rdata: %v", err)
+	}
+	if layout, ok := rdataNames[rr.Type]; ok && compressedNames(rr.RData, layout) {
+		if rr.RData, err = p.expandRData(start, int(rdlen), layout); err != nil {
+			return fmt.Errorf("%s rdata: %v", TypeString(rr.Type), err)
+		}
+	}
+	return nil
+}
+
+// rdataNames holds the layout of the rdata of the types whose names may be
+// compressed (RFC 3597 section 4): n is a name, s a character-string and a
+// digit that many octets of other fields. Anything past the layout is kept
+// as it is.
+var rdataNames = map[uint16]string{
+	TypeNS:    "n",
+	3:         "n", // MD
+	4:         "n", // MF
+	TypeCNAME: "n",
+	TypeSOA:   "nn",
+	7:         "n", // MB
+	8:         "n", // MG
+	9:         "n", // MR
+	TypePTR:   "n",
+	14:        "nn", // MINFO
+	TypeMX:    "2n",
+	17:        "nn", // RP
+	18:        "2n", // AFSDB
+	21:        "2n", // RT
+	TypeSIG:   "99n",
+	26:        "2nn", // PX
+	30:        "n",   // NXT
+	TypeSRV:   "6n",
+	35:        "22sssn", // NAPTR
+}
+
+// compressedNames reports whether any name laid out in rdata is
+// compressed. Rdata that doesn't fit its layout is left for the code
+// reading it to reject.
+func compressedNames(rdata []byte, layout string) bool {
+	off := 0
+	for _, f := range []byte(layout) {
+		switch f {
+		case 'n':
+			for off < len(rdata) && rdata[off] != 0 {
+				if rdata[off]&0xC0 != 0 {
+					return true
+				}
+				off += int(rdata[off]) + 1
+			}
+			off++
+		case 's':
+			if off < len(rdata) {
+				off += int(rdata[off])
+			}
+			off++
+		default:
+			off += int(f - '0')
+		}
+		if off > len(rdata) {
+			return false
+		}
+	}
+	return false
+}
+
+// expandRData returns the n octets of rdata at start with the names in
+// layout decompressed, reading pointers against the whole message. Names
+// copied into the rdata of another message would otherwise point at
+// whatever is at the same offset there.
+func (p *Reader) expandRData(start, n int, layout string) ([]byte, error) {
+	r := &Reader{data: p.data[:start+n], off: start}
+	buf := make([]byte, 0, n+MaxNameLength)
+	for _, f := range []byte(layout) {
+		var field []byte
+		var err error
+		switch f {
+		case 'n':
+			var name string
+			if name, err = r.ReadName(); err == nil {
+				buf, err = AppendName(buf, name, nil)
+			}
+		case 's':
+			var length byte
+			if length, err = r.ReadByte(); err == nil {
+				buf = append(buf, length)
+				field, err = r.ReadBytes(int(length))
+			}
+		default:
+			field, err = r.ReadBytes(int(f - '0'))
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, field...)
+	}
+	return append(buf, p.data[r.off:start+n]...), nil
+}
+
+// maxCompressionJumps bounds the pointers followed for one name. A name
+// has at most 127 labels and a pointer only makes sense after at least one
+// of them, so anything beyond this is a crafted packet.
+const maxCompressionJumps = 126
+
+// MaxNameLength and MaxLabelLength are the longest a name and each of its
+// labels may be in wire form (RFC 1035 2.3.4).
+const (
+	MaxNameLength  = 255
+	MaxLabelLength = 63
+)
+
+// ReadName decodes the name at p.off, following compression pointers. The
+// first pointer must point before the name starts and every later one
+// before where the previous one pointed. Pointing back from the pointer
+// itself isn't enough: two pointers can each do that and still send the
+// name round in a loop. Jumps and the decoded length are capped as well.
+func (p *Reader) ReadName() (string, error) {
+	// The name is assembled in presentation form, without the trailing
+	// dot, and interned from there.
+	var buf [MaxNameLength]byte
+	name := buf[:0]
+	off := p.off
+	end := -1      // where parsing resumes once the name is read
+	limit := p.off // the next pointer must point before this
+	jumps := 0
+	length := 1 // the root label
+
+	for {
+		if off >= len(p.data) {
+			return "", fmt.Errorf("name out of range")
+		}
+		c := int(p.data[off])
+
+		switch c & 0xC0 {
+		case 0xC0:
+			if off+1 >= len(p.data) {
+				return "", fmt.Errorf("truncated pointer")
+			}
+			ptr := (c&0x3F)<<8 | int(p.data[off+1])
+			if ptr >= limit {
+				return "", fmt.Errorf("compression pointer at offset %d does not point before %d", off, limit)
+			}
+			limit = ptr
+			jumps++
+			if jumps > maxCompressionJumps {
+				return "", fmt.Errorf("too many compression pointers")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = ptr
+			continue
+		case 0x00:
+		default:
+			return "", fmt.Errorf("unsupported label type %#x", c&0xC0)
+		}
+
+		off++
+		if c == 0 {
+			break
+		}
+		if off+c > len(p.data) {
+			return "", fmt.Errorf("truncate label")
+		}
+		length += c + 1
+		if length > MaxNameLength {
+			return "", fmt.Errorf("name longer than %d octets", MaxNameLength)
+		}
+		if len(name) > 0 {
+			name = append(name, '.')
+		}
+		name = append(name, p.data[off:off+c]...)
+		off += c
+	}
+
+	if end < 0 {
+		end = off
+	}
+	p.off = end
+	return internBytes(name), nil
+}
@@ -0,0 +1,357 @@
+package dnswire
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sampleQueries returns well-formed messages covering every section,
+// compressed names, EDNS and record data of several types.
+func sampleQueries(tb testing.TB) map[string]*Query {
+	tb.Helper()
+	rdata := func(rrtype uint16, s string) []byte {
+		b, err := ParseRData(rrtype, s)
+		if err != nil {
+			tb.Fatalf("ParseRData(%s, %q): %v", TypeString(rrtype), s, err)
+		}
+		return b
+	}
+	rr := func(name string, rrtype uint16, s string) *ResourceRecord {
+		return &ResourceRecord{Name: name, Type: rrtype, Class: ClassINET, TTL: 3600, RData: rdata(rrtype, s)}
+	}
+
+	query := NewQuery("www.example.com", TypeA)
+	edns := NewQuery("example.com", TypeMX).SetEDNS(1232, true)
+	response := &Query{Header: Header{ID: 0x1234, QR: true, AA: true, RD: true}}
+	response.SetQuestion("www.example.com", TypeA).
+		AddAnswer(rr("www.example.com", TypeCNAME, "web.example.com."), rr("web.example.com", TypeA, "192.0.2.10")).
+		AddAuthority(rr("example.com", TypeNS, "ns1.example.com."), rr("example.com", TypeNS, "ns2.example.com.")).
+		AddAdditional(rr("ns1.example.com", TypeA, "192.0.2.1"), rr("ns2.example.com", TypeAAAA, "2001:db8::2"))
+	response.SetEDNS(4096, false)
+	nxdomain := &Query{Header: Header{ID: 7, QR: true, AA: true, RCode: RCodeNameError}}
+	nxdomain.SetQuestion("nope.example.com", TypeAAAA).
+		AddAuthority(rr("example.com", TypeSOA, "ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300"))
+	txt := &Query{Header: Header{ID: 9, QR: true}}
+	txt.SetQuestion("big.example.com", TypeTXT).
+		AddAnswer(rr("big.example.com", TypeTXT, `"`+strings.Repeat("a", 255)+`" "`+strings.Repeat("b", 200)+`"`)).
+		AddAnswer(rr("big.example.com", TypeTXT, `"v=spf1 -all"`))
+	root := &Query{Header: Header{ID: 11, QR: true, RD: true, RA: true}}
+	root.SetQuestion("", TypeNS).AddAnswer(rr("", TypeNS, "a.root-servers.net."))
+
+	return map[string]*Query{
+		"query": query, "edns": edns, "response": response, "nxdomain": nxdomain, "txt": txt, "root": root,
+	}
+}
+
+// sampleMessages returns the sampleQueries encoded.
+func sampleMessages(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	out := map[string][]byte{}
+	for name, q := range sampleQueries(tb) {
+		data, err := q.Encode()
+		if err != nil {
+			tb.Fatalf("encoding %s: %v", name, err)
+		}
+		out[name] = data
+	}
+	return out
+}
+
+// malformedMessages are packets the parser must reject without panicking.
+var malformedMessages = map[string][]byte{
+	"empty":          {},
+	"short header":   {0x12, 0x34, 0x01, 0x00, 0x00},
+	"counts too big": {0, 1, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	"pointer loop": {0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0xc0, 12, 0, 1, 0, 1},
+	// Each pointer points back from itself, but the two take turns.
+	"two-pointer loop": {0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		3, 'a', 3, 'b', 0xc0, 14, 0xc0, 12, 0, 1, 0, 1},
+	"forward pointer": {0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0xc0, 18, 0, 1, 0, 1, 3, 'c', 'o', 'm', 0},
+	"label overrun": {0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		63, 'a', 'b', 0, 1, 0, 1},
+	"bad label type": {0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0x40, 'a', 0, 0, 1, 0, 1},
+	"rdata overrun": {0, 1, 0x80, 0, 0, 0, 0, 1, 0, 0, 0, 0,
+		0, 0, 1, 0, 1, 0, 0, 0, 60, 0xff, 0xff, 1, 2, 3, 4},
+	"truncated pointer": {0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0xc0},
+	"rdata name overrun": {0, 1, 0x80, 0, 0, 0, 0, 1, 0, 0, 0, 0,
+		0, 0, 5, 0, 1, 0, 0, 0, 60, 0, 1, 0xc0, 12},
+}
+
+func TestParseMalformed(t *testing.T) {
+	for name, data := range malformedMessages {
+		if _, err := ParseMessage(data); !errors.Is(err, ErrFormat) {
+			t.Errorf("%s: ParseMessage returned %v, want a format error", name, err)
+		}
+	}
+}
+
+// TestParseTruncated cuts valid messages at every byte offset: each
+// prefix must be rejected with an error rather than a panic.
+func TestParseTruncated(t *testing.T) {
+	for name, data := range sampleMessages(t) {
+		if _, err := ParseMessage(data); err != nil {
+			t.Fatalf("%s: parsing the whole message: %v", name, err)
+		}
+		for n := range len(data) {
+			prefix := data[:n:n]
+			if _, err := ParseMessage(prefix); !errors.Is(err, ErrFormat) {
+				t.Errorf("%s cut to %d of %d bytes: ParseMessage returned %v, want a format error", name, n, len(data), err)
+			}
+			if _, err := ParseLazy(prefix); !errors.Is(err, ErrFormat) {
+				t.Errorf("%s cut to %d of %d bytes: ParseLazy returned %v, want a format error", name, n, len(data), err)
+			}
+			if m, err := ParsePooled(prefix); !errors.Is(err, ErrFormat) {
+				m.Release()
+				t.Errorf("%s cut to %d of %d bytes: ParsePooled returned %v, want a format error", name, n, len(data), err)
+			}
+			if n >= 12 {
+				if _, err := ParseHeader(prefix); err != nil {
+					t.Errorf("%s cut to %d bytes: ParseHeader failed with a whole header: %v", name, n, err)
+				}
+			} else if _, err := ParseHeader(prefix); err == nil {
+				t.Errorf("%s cut to %d bytes: ParseHeader accepted a partial header", name, n)
+			}
+		}
+	}
+}
+
+// compressedAnswer answers www.example.com with a CNAME and an MX record
+// whose rdata names point into the question, as upstream servers write
+// them.
+var compressedAnswer = []byte{0, 1, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0,
+	3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1,
+	0xc0, 12, 0, 5, 0, 1, 0, 0, 1, 0x2c, 0, 6, 3, 'w', 'e', 'b', 0xc0, 16,
+	0xc0, 12, 0, 15, 0, 1, 0, 0, 1, 0x2c, 0, 4, 0, 10, 0xc0, 16}
+
+func TestParseCompressedRData(t *testing.T) {
+	want := []string{"web.example.com.", "10 example.com."}
+	check := func(stage string, data []byte) {
+		t.Helper()
+		m, err := ParseMessage(data)
+		if err != nil {
+			t.Fatalf("%s: %v", stage, err)
+		}
+		for i, rr := range m.Answers {
+			if got := FormatRData(rr.Type, rr.RData); got != want[i] {
+				t.Errorf("%s: answer %d is %q, want %q", stage, i, got, want[i])
+			}
+		}
+	}
+	check("parsing", compressedAnswer)
+
+	// Encoded into another message, with or without compression, the
+	// expanded names still read the same, wherever the question ends up.
+	m, _ := ParseMessage(compressedAnswer)
+	q := queryOf(m)
+	q.Questions = []*Question{{Name: "other.example.org", QType: TypeA, QClass: ClassINET}}
+	data, err := q.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("re-encoding", data)
+	if data, err = q.AppendToUncompressed(nil); err != nil {
+		t.Fatal(err)
+	}
+	check("re-encoding uncompressed", data)
+}
+
+// queryOf turns a parsed message back into one that can be encoded.
+func queryOf(m *Message) *Query {
+	return &Query{Header: *m.Header, Questions: m.Questions, Answers: m.Answers, Authorities: m.Authorities, Additionals: m.Additionals}
+}
+
+// FuzzParseMessage is seeded with the messages above and with responses
+// captured from the server in testdata/fuzz/FuzzParseMessage.
+func FuzzParseMessage(f *testing.F) {
+	for _, data := range sampleMessages(f) {
+		f.Add(data)
+	}
+	for _, data := range malformedMessages {
+		f.Add(data)
+	}
+	f.Add(compressedAnswer)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParseMessage(data)
+		lazy, lerr := ParseLazy(data)
+		if err != nil {
+			return
+		}
+		// The lazy parser checks less, so it may only be more lenient.
+		if lerr != nil {
+			t.Fatalf("ParseMessage accepted what ParseLazy rejected: %v", lerr)
+		}
+		if lm, err := lazy.Message(); err != nil {
+			t.Fatalf("lazy decoding failed where ParseMessage didn't: %v", err)
+		} else if !reflect.DeepEqual(queryOf(lm), queryOf(m)) {
+			t.Fatalf("lazy decoding differs:\n%+v\n%+v", lm, m)
+		}
+		pooled, err := ParsePooled(data)
+		if err != nil {
+			t.Fatalf("ParsePooled failed where ParseMessage didn't: %v", err)
+		}
+		pooled.Release()
+
+		// Whatever parses encodes, unless a name holds a dot or a byte
+		// that only fits a binary label, and parses back the same.
+		wire, err := queryOf(m).Encode()
+		if err != nil {
+			return
+		}
+		again, err := ParseMessage(wire)
+		if err != nil {
+			t.Fatalf("parsing re-encoded message: %v", err)
+		}
+		if !reflect.DeepEqual(queryOf(again), queryOf(m)) {
+			t.Fatalf("re-encoded message differs:\n%+v\n%+v", again, m)
+		}
+	})
+}
+
+func TestReadNamePointers(t *testing.T) {
+	// com at 0, example.com at 5 and www.example.com at 15.
+	chain := []byte{3, 'c', 'o', 'm', 0, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0xc0, 0, 3, 'w', 'w', 'w', 0xc0, 5}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		off  int
+		want string // empty for an error
+	}{
+		{"one pointer", chain, 5, "example.com"},
+		{"two pointers", chain, 15, "www.example.com"},
+		{"pointer to itself", []byte{0xc0, 0}, 0, ""},
+		{"pointer into the name", []byte{1, 'a', 0xc0, 0}, 0, ""},
+		{"two-pointer loop", []byte{3, 'a', 3, 'b', 0xc0, 2, 0xc0, 0}, 6, ""},
+	} {
+		name, err := NewReader(tc.data, tc.off).ReadName()
+		if tc.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "does not point before") {
+				t.Errorf("%s: got %q, %v; want a pointer error", tc.name, name, err)
+			}
+		} else if err != nil || name != tc.want {
+			t.Errorf("%s: got %q, %v; want %q", tc.name, name, err, tc.want)
+		}
+	}
+}
+
+func FuzzReadName(f *testing.F) {
+	f.Add([]byte{3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}, 0)
+	f.Add([]byte{3, 'c', 'o', 'm', 0, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0xc0, 0}, 5)
+	f.Add([]byte{0xc0, 0}, 0)
+	f.Add([]byte{0xc0, 2, 0xc0, 0}, 2)
+	f.Add([]byte{1, 'a', 0xc0, 0}, 0)
+	f.Add([]byte{3, 'a', 3, 'b', 0xc0, 2, 0xc0, 0}, 6)
+	f.Fuzz(func(t *testing.T, data []byte, off int) {
+		if off < 0 || off > len(data) {
+			return
+		}
+		p := NewReader(data, off)
+		name, err := p.ReadName()
+		if err != nil {
+			return
+		}
+		if p.Offset() <= off || p.Offset() > len(data) {
+			t.Fatalf("offset %d after reading a name at %d of %d bytes", p.Offset(), off, len(data))
+		}
+		if len(name) > MaxNameLength {
+			t.Fatalf("decoded a %d byte name", len(name))
+		}
+		// SkipName moves past the same bytes.
+		s := NewReader(data, off)
+		if err := s.SkipName(); err != nil || s.Offset() != p.Offset() {
+			t.Fatalf("SkipName ended at %d (%v), ReadName at %d", s.Offset(), err, p.Offset())
+		}
+	})
+}
+
+func FuzzEncodeRoundTrip(f *testing.F) {
+	f.Add("www.example.com", TypeA, ClassINET, uint32(300), []byte{192, 0, 2, 1}, true)
+	f.Add("", TypeNS, ClassINET, uint32(0), []byte{1, 'a', 0}, false)
+	f.Add("a.b.c.d.e.f.example", TypeTXT, uint16(3), uint32(1<<31), []byte("\x05hello"), true)
+	f.Fuzz(func(t *testing.T, name string, rrtype, class uint16, ttl uint32, rdata []byte, compress bool) {
+		q := &Query{Header: Header{ID: 1, QR: true, RCode: RCodeSuccess}}
+		rr := &ResourceRecord{Name: name, Type: rrtype, Class: class, TTL: ttl, RData: rdata}
+		q.SetQuestion(name, rrtype)
+		q.AddAnswer(rr).AddAuthority(rr).AddAdditional(rr)
+		var wire []byte
+		var err error
+		if compress {
+			wire, err = q.AppendTo(nil)
+		} else {
+			wire, err = q.AppendToUncompressed(nil)
+		}
+		if err != nil {
+			return
+		}
+		// Pointers in rdata are expanded against the message they land
+		// in, so such rdata doesn't read back the same.
+		if layout, ok := rdataNames[rrtype]; ok && compressedNames(rdata, layout) {
+			return
+		}
+		m, err := ParseMessage(wire)
+		if err != nil {
+			t.Fatalf("parsing what was encoded: %v", err)
+		}
+		// Labels holding dots can't survive the trip; everything else must.
+		if strings.Contains(name, "..") || strings.HasPrefix(name, ".") {
+			t.Fatalf("encoded name %q with an empty label", name)
+		}
+		want := strings.TrimSuffix(name, ".")
+		if m.Questions[0].Name != want {
+			t.Fatalf("question name %q, want %q", m.Questions[0].Name, want)
+		}
+		for _, got := range [][]*ResourceRecord{m.Answers, m.Authorities, m.Additionals} {
+			if len(got) != 1 {
+				t.Fatalf("got %d records in a section, want 1", len(got))
+			}
+			g := got[0]
+			if g.Name != want || g.Type != rrtype || g.Class != class || g.TTL != ttl || !bytes.Equal(g.RData, rdata) {
+				t.Fatalf("record %+v, want %+v", g, rr)
+			}
+		}
+	})
+}
+
+// BenchmarkParse parses the same response fully, pooled and lazily.
+func BenchmarkParse(b *testing.B) {
+	data := sampleMessages(b)["response"]
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			if _, err := ParseMessage(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			m, err := ParsePooled(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			m.Release()
+		}
+	})
+	b.Run("lazy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			m, err := ParseLazy(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := m.Question(0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package dnswire
+
+import "sync"
+
+// Parsed queries are pooled too, with the arrays behind their sections.
+// Arrays grown past maxPooledRecords by an unusually large message are
+// dropped rather than kept around.
+var messagePool = sync.Pool{New: func() any { return new(messageSections) }}
+
+const maxPooledRecords = 64
+
+// ParsePooled is ParseMessage with the message taken from a pool. Release
+// returns it.
+func ParsePooled(data []byte) (*Message, error) {
+	s := messagePool.Get().(*messageSections)
+	m, err := s.parse(data)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	m.sections = s
+	return m, nil
+}
+
+// Release returns a message from ParsePooled to the pool; other
+// messages are left to the GC. Neither m nor its questions and records may
+// be used afterwards, so whatever outlives the query has to be copied.
+func (m *Message) Release() {
+	if m != nil && m.sections != nil {
+		m.sections.release()
+	}
+}
+
+// release zeroes everything, so pooled sections neither hold on to the
+// previous query's buffer nor leak its records into the next one.
+func (s *messageSections) release() {
+	clear(s.questions)
+	clear(s.records)
+	clear(s.qptrs)
+	clear(s.rptrs)
+	if cap(s.questions) > maxPooledRecords {
+		s.questions, s.qptrs = nil, nil
+	}
+	if cap(s.records) > maxPooledRecords {
+		s.records, s.rptrs = nil, nil
+	}
+	s.msg, s.header = Message{}, Header{}
+	messagePool.Put(s)
+}
@@ -0,0 +1,119 @@
+package dnswire
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestPooledConcurrent parses, checks and releases messages from many
+// goroutines at once, so that under go test -race a message handed out
+// while another query still used its arrays, or records left over from
+// the previous query, show up.
+func TestPooledConcurrent(t *testing.T) {
+	queries := sampleQueries(t)
+	type sample struct {
+		name string
+		q    *Query
+		wire []byte
+	}
+	var samples []sample
+	for name, q := range queries {
+		wire, err := q.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, sample{name, q, wire})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				s := samples[(g+i)%len(samples)]
+				// Each goroutine parses its own copy, as the server does
+				// with its read buffers.
+				m, err := ParsePooled(bytes.Clone(s.wire))
+				if err != nil {
+					errs <- fmt.Errorf("%s: %v", s.name, err)
+					return
+				}
+				if diff := sameMessage(m, s.q); diff != "" {
+					errs <- fmt.Errorf("%s: pooled message %s", s.name, diff)
+					return
+				}
+				m.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestPooledReleaseClears checks that a released message doesn't leak its
+// records into the next one parsed from the pool.
+func TestPooledReleaseClears(t *testing.T) {
+	msgs := sampleMessages(t)
+	big, err := ParsePooled(msgs["response"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	big.Release()
+	for range 10 {
+		m, err := ParsePooled(msgs["query"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Answers)+len(m.Authorities)+len(m.Additionals) != 0 {
+			t.Fatalf("query parsed from the pool has records: %+v", m)
+		}
+		m.Release()
+	}
+}
+
+// TestCompressionConcurrent encodes from many goroutines, each with
+// compression maps from the pool, and checks every result parses back
+// as the message encoded.
+func TestCompressionConcurrent(t *testing.T) {
+	queries := sampleQueries(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 0, 512)
+			for range 200 {
+				for name, q := range queries {
+					wire, err := q.AppendTo(buf[:0])
+					if err != nil {
+						errs <- fmt.Errorf("%s: %v", name, err)
+						return
+					}
+					m, err := ParseMessage(wire)
+					if err != nil {
+						errs <- fmt.Errorf("%s: %v", name, err)
+						return
+					}
+					if diff := sameMessage(m, q); diff != "" {
+						errs <- fmt.Errorf("%s: %s", name, diff)
+						return
+					}
+					buf = wire
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
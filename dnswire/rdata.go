@@ -0,0 +1,472 @@
+package dnswire
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatRData returns rdata of type rrtype in presentation form (RFC 1035
+// section 5.1), with absolute names. Types without a form here, and rdata
+// that isn't valid for its type, are written in the generic form of RFC
+// 3597: \# and the length, then the data in hex.
+func FormatRData(rrtype uint16, rdata []byte) string {
+	if s, ok := formatRData(rrtype, rdata); ok {
+		return s
+	}
+	if len(rdata) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %x`, len(rdata), rdata)
+}
+
+func formatRData(rrtype uint16, rdata []byte) (string, bool) {
+	p := NewReader(rdata, 0)
+	var fields []string
+	name := func() bool {
+		n, err := p.ReadName()
+		fields = append(fields, strings.TrimSuffix(n, ".")+".")
+		return err == nil
+	}
+	number := func(size int) bool {
+		var n uint32
+		var err error
+		switch size {
+		case 1:
+			var v byte
+			v, err = p.ReadByte()
+			n = uint32(v)
+		case 2:
+			var v uint16
+			v, err = p.ReadUint16()
+			n = uint32(v)
+		default:
+			n, err = p.ReadUint32()
+		}
+		fields = append(fields, strconv.FormatUint(uint64(n), 10))
+		return err == nil
+	}
+	// rest writes the remaining octets, which must be some, with encode.
+	rest := func(encode func([]byte) string) bool {
+		b, err := p.ReadBytes(len(rdata) - p.Offset())
+		fields = append(fields, encode(b))
+		return err == nil && len(b) > 0
+	}
+	// counted writes octets preceded by their length, as the salt and hash
+	// of NSEC3, or "-" if there are none.
+	counted := func(encode func([]byte) string) bool {
+		length, err := p.ReadByte()
+		var b []byte
+		if err == nil {
+			b, err = p.ReadBytes(int(length))
+		}
+		if len(b) == 0 {
+			fields = append(fields, "-")
+		} else {
+			fields = append(fields, encode(b))
+		}
+		return err == nil
+	}
+	signatureTime := func() bool {
+		t, err := p.ReadUint32()
+		fields = append(fields, time.Unix(int64(t), 0).UTC().Format(signatureTimeLayout))
+		return err == nil
+	}
+	types := func() bool {
+		b, err := p.ReadBytes(len(rdata) - p.Offset())
+		if err == nil {
+			var names []string
+			names, err = formatTypeBitmap(b)
+			fields = append(fields, names...)
+		}
+		return err == nil
+	}
+	ok := true
+	switch rrtype {
+	case TypeA, TypeAAAA:
+		addr, valid := netip.AddrFromSlice(rdata)
+		if !valid || (rrtype == TypeA) != addr.Is4() {
+			return "", false
+		}
+		return addr.String(), true
+	case TypeNS, TypeCNAME, TypePTR:
+		ok = name()
+	case TypeMX:
+		ok = number(2) && name()
+	case TypeSRV:
+		ok = number(2) && number(2) && number(2) && name()
+	case TypeSOA:
+		ok = name() && name() && number(4) && number(4) && number(4) && number(4) && number(4)
+	case TypeTXT:
+		for ok && p.Offset() < len(rdata) {
+			length, err := p.ReadByte()
+			var s []byte
+			if err == nil {
+				s, err = p.ReadBytes(int(length))
+			}
+			fields = append(fields, quoteString(s))
+			ok = err == nil
+		}
+		ok = ok && len(fields) > 0
+	case TypeDS:
+		ok = number(2) && number(1) && number(1) && rest(upperHex)
+	case TypeDNSKEY:
+		ok = number(2) && number(1) && number(1) && rest(base64.StdEncoding.EncodeToString)
+	case TypeRRSIG:
+		covered, err := p.ReadUint16()
+		fields = append(fields, TypeString(covered))
+		ok = err == nil && number(1) && number(1) && number(4) && signatureTime() && signatureTime() &&
+			number(2) && name() && rest(base64.StdEncoding.EncodeToString)
+	case TypeNSEC:
+		ok = name() && types()
+	case TypeNSEC3:
+		// Unlike the salt, the next hashed owner is never empty.
+		ok = number(1) && number(1) && number(2) && counted(upperHex) &&
+			counted(base32Hex.EncodeToString) && fields[len(fields)-1] != "-" && types()
+	case TypeNSEC3PARAM:
+		ok = number(1) && number(1) && number(2) && counted(upperHex)
+	default:
+		return "", false
+	}
+	if !ok || p.Offset() != len(rdata) {
+		return "", false
+	}
+	return strings.Join(fields, " "), true
+}
+
+// signatureTimeLayout is how RRSIG inception and expiration times are
+// written (RFC 4034 section 3.2).
+const signatureTimeLayout = "20060102150405"
+
+// base32Hex encodes the hashed owner names of NSEC3 records (RFC 5155
+// section 3.3).
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func upperHex(b []byte) string {
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// formatTypeBitmap returns the types in the type bitmap of an NSEC or
+// NSEC3 record (RFC 4034 section 4.1.2).
+func formatTypeBitmap(b []byte) ([]string, error) {
+	var names []string
+	last := -1
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] == 0 || b[1] > 32 || len(b) < 2+int(b[1]) || int(b[0]) <= last {
+			return nil, fmt.Errorf("invalid type bitmap")
+		}
+		window, bits := int(b[0]), b[2:2+int(b[1])]
+		for i, octet := range bits {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					names = append(names, TypeString(uint16(window<<8|i<<3|bit)))
+				}
+			}
+		}
+		last, b = window, b[2+len(bits):]
+	}
+	return names, nil
+}
+
+// appendTypeBitmap appends the type bitmap of the types named.
+func appendTypeBitmap(buf []byte, names []string) ([]byte, error) {
+	var windows [256][32]byte
+	var used [256]int
+	for _, name := range names {
+		t, ok := ParseType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", name)
+		}
+		window, octet := t>>8, t&0xff>>3
+		windows[window][octet] |= 0x80 >> (t & 7)
+		used[window] = max(used[window], int(octet)+1)
+	}
+	for window, n := range used {
+		if n > 0 {
+			buf = append(buf, byte(window), byte(n))
+			buf = append(buf, windows[window][:n]...)
+		}
+	}
+	return buf, nil
+}
+
+// quoteString quotes a character-string, escaping quotes and backslashes
+// and writing anything unprintable as \DDD.
+func quoteString(s []byte) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// ParseRData reads rdata of type rrtype from the forms FormatRData writes.
+// The generic form is accepted for any type.
+func ParseRData(rrtype uint16, s string) ([]byte, error) {
+	if rest, ok := strings.CutPrefix(strings.TrimSpace(s), `\#`); ok {
+		return parseGenericRData(rest)
+	}
+	if rrtype == TypeTXT {
+		return parseTXT(s)
+	}
+	fields := strings.Fields(s)
+	switch rrtype {
+	case TypeDS, TypeDNSKEY, TypeRRSIG, TypeNSEC, TypeNSEC3, TypeNSEC3PARAM:
+		return parseDNSSECRData(rrtype, s, fields)
+	}
+	want := map[uint16]int{TypeA: 1, TypeAAAA: 1, TypeNS: 1, TypeCNAME: 1, TypePTR: 1, TypeMX: 2, TypeSRV: 4, TypeSOA: 7}[rrtype]
+	if want == 0 {
+		return nil, fmt.Errorf("%s rdata has no presentation form here, use \\# length hex", TypeString(rrtype))
+	}
+	if len(fields) != want {
+		return nil, fmt.Errorf("%s rdata has %d fields, want %d", TypeString(rrtype), len(fields), want)
+	}
+	var buf []byte
+	var err error
+	name := func(f string) {
+		if err == nil {
+			buf, err = AppendName(buf, strings.TrimSuffix(f, "."), nil)
+		}
+	}
+	number := func(f string, bits int) {
+		if err != nil {
+			return
+		}
+		var n uint64
+		if n, err = strconv.ParseUint(f, 10, bits); err != nil {
+			return
+		}
+		if bits == 16 {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		} else {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+	}
+	switch rrtype {
+	case TypeA, TypeAAAA:
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || (rrtype == TypeA) != addr.Is4() {
+			return nil, fmt.Errorf("invalid %s address %q", TypeString(rrtype), fields[0])
+		}
+		return addr.AsSlice(), nil
+	case TypeNS, TypeCNAME, TypePTR:
+		name(fields[0])
+	case TypeMX:
+		number(fields[0], 16)
+		name(fields[1])
+	case TypeSRV:
+		number(fields[0], 16)
+		number(fields[1], 16)
+		number(fields[2], 16)
+		name(fields[3])
+	case TypeSOA:
+		name(fields[0])
+		name(fields[1])
+		for _, f := range fields[2:] {
+			number(f, 32)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s rdata %q: %v", TypeString(rrtype), s, err)
+	}
+	return buf, nil
+}
+
+// parseDNSSECRData reads the rdata of the DNSSEC types. Their last field,
+// a digest, key, signature or type list, may be split across several.
+func parseDNSSECRData(rrtype uint16, s string, fields []string) ([]byte, error) {
+	want := map[uint16]int{TypeDS: 4, TypeDNSKEY: 4, TypeRRSIG: 9, TypeNSEC: 1, TypeNSEC3: 5, TypeNSEC3PARAM: 4}[rrtype]
+	if len(fields) < want || rrtype == TypeNSEC3PARAM && len(fields) > want {
+		return nil, fmt.Errorf("%s rdata has %d fields, want %d", TypeString(rrtype), len(fields), want)
+	}
+	var buf []byte
+	var err error
+	number := func(f string, bits int) {
+		if err != nil {
+			return
+		}
+		var n uint64
+		if n, err = strconv.ParseUint(f, 10, bits); err != nil {
+			return
+		}
+		switch bits {
+		case 8:
+			buf = append(buf, byte(n))
+		case 16:
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		default:
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+	}
+	// rest appends the remaining fields, joined, as decode reads them.
+	rest := func(fields []string, decode func(string) ([]byte, error)) {
+		if err != nil {
+			return
+		}
+		var b []byte
+		if b, err = decode(strings.Join(fields, "")); err == nil && len(b) == 0 {
+			err = fmt.Errorf("no data")
+		}
+		buf = append(buf, b...)
+	}
+	// counted appends octets preceded by their length; "-" stands for none.
+	counted := func(f string, decode func(string) ([]byte, error)) {
+		if err != nil {
+			return
+		}
+		var b []byte
+		if f != "-" {
+			b, err = decode(f)
+		}
+		if err == nil && len(b) > 255 {
+			err = fmt.Errorf("%q is longer than 255 octets", f)
+		}
+		buf = append(buf, byte(len(b)))
+		buf = append(buf, b...)
+	}
+	signatureTime := func(f string) {
+		if err != nil {
+			return
+		}
+		// Times are also written as seconds since the epoch.
+		if len(f) != len(signatureTimeLayout) {
+			number(f, 32)
+			return
+		}
+		var t time.Time
+		if t, err = time.Parse(signatureTimeLayout, f); err == nil {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(t.Unix()))
+		}
+	}
+	types := func(names []string) {
+		if err == nil {
+			buf, err = appendTypeBitmap(buf, names)
+		}
+	}
+	switch rrtype {
+	case TypeDS:
+		number(fields[0], 16)
+		number(fields[1], 8)
+		number(fields[2], 8)
+		rest(fields[3:], hex.DecodeString)
+	case TypeDNSKEY:
+		number(fields[0], 16)
+		number(fields[1], 8)
+		number(fields[2], 8)
+		rest(fields[3:], base64.StdEncoding.DecodeString)
+	case TypeRRSIG:
+		covered, ok := ParseType(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid RRSIG rdata %q: unknown type %q", s, fields[0])
+		}
+		buf = binary.BigEndian.AppendUint16(buf, covered)
+		number(fields[1], 8)
+		number(fields[2], 8)
+		number(fields[3], 32)
+		signatureTime(fields[4])
+		signatureTime(fields[5])
+		number(fields[6], 16)
+		if err == nil {
+			buf, err = AppendName(buf, strings.TrimSuffix(fields[7], "."), nil)
+		}
+		rest(fields[8:], base64.StdEncoding.DecodeString)
+	case TypeNSEC:
+		buf, err = AppendName(buf, strings.TrimSuffix(fields[0], "."), nil)
+		types(fields[1:])
+	case TypeNSEC3, TypeNSEC3PARAM:
+		number(fields[0], 8)
+		number(fields[1], 8)
+		number(fields[2], 16)
+		counted(fields[3], hex.DecodeString)
+		if rrtype == TypeNSEC3 {
+			if fields[4] == "-" {
+				return nil, fmt.Errorf("invalid NSEC3 rdata %q: no next hashed owner name", s)
+			}
+			counted(strings.ToUpper(fields[4]), base32Hex.DecodeString)
+			types(fields[5:])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s rdata %q: %v", TypeString(rrtype), s, err)
+	}
+	return buf, nil
+}
+
+func parseGenericRData(s string) ([]byte, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf(`\# needs a length`)
+	}
+	length, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid \# length %q`, fields[0])
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf(`invalid \# data: %v`, err)
+	}
+	if len(data) != int(length) {
+		return nil, fmt.Errorf(`\# length is %d, data has %d octets`, length, len(data))
+	}
+	return data, nil
+}
+
+// parseTXT reads quoted character-strings, as quoteString writes them.
+func parseTXT(s string) ([]byte, error) {
+	var buf []byte
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] != '"' {
+			return nil, fmt.Errorf("TXT strings have to be quoted")
+		}
+		var str []byte
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) {
+				i++
+				c = s[i]
+				if c >= '0' && c <= '9' {
+					if i+3 > len(s) {
+						return nil, fmt.Errorf("short \\DDD escape")
+					}
+					n, err := strconv.ParseUint(s[i:i+3], 10, 8)
+					if err != nil {
+						return nil, fmt.Errorf("invalid \\DDD escape %q", s[i-1:i+3])
+					}
+					c = byte(n)
+					i += 2
+				}
+			}
+			str = append(str, c)
+		}
+		if i == len(s) {
+			return nil, fmt.Errorf("unterminated TXT string")
+		}
+		if len(str) > 255 {
+			return nil, fmt.Errorf("TXT string is %d octets, more than 255", len(str))
+		}
+		buf = append(buf, byte(len(str)))
+		buf = append(buf, str...)
+		s = s[i+1:]
+	}
+	if buf == nil {
+		return nil, fmt.Errorf("TXT rdata needs a string")
+	}
+	return buf, nil
+}
@@ -0,0 +1,66 @@
+package dnswire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestDNSSECRDataRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		rrtype uint16
+		text   string
+	}{
+		{TypeDS, "60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"},
+		{TypeDNSKEY, "257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ=="},
+		{TypeRRSIG, "A 13 3 3600 20261101000000 20261018000000 12345 example.com. dGVzdCBzaWduYXR1cmU="},
+		{TypeNSEC, "host.example.com. A MX RRSIG NSEC TYPE1234"},
+		{TypeNSEC, "example.com."},
+		{TypeNSEC3, "1 1 12 AABBCCDD 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR A RRSIG"},
+		{TypeNSEC3PARAM, "1 0 0 -"},
+	} {
+		rdata, err := ParseRData(tc.rrtype, tc.text)
+		if err != nil {
+			t.Errorf("ParseRData(%s, %q): %v", TypeString(tc.rrtype), tc.text, err)
+			continue
+		}
+		if got := FormatRData(tc.rrtype, rdata); got != tc.text {
+			t.Errorf("FormatRData(%s) = %q, want %q", TypeString(tc.rrtype), got, tc.text)
+		}
+	}
+}
+
+func TestNSECTypeBitmap(t *testing.T) {
+	// RFC 4034 section 4.3.
+	rdata, err := ParseRData(TypeNSEC, "host.example.com. A MX RRSIG NSEC TYPE1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hex.DecodeString("04686f7374076578616d706c6503636f6d00" +
+		"0006400100000003" + "041b" + strings.Repeat("00", 26) + "20")
+	if !bytes.Equal(rdata, want) {
+		t.Errorf("rdata is %x, want %x", rdata, want)
+	}
+}
+
+func TestDNSSECRDataMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		rrtype uint16
+		rdata  string
+	}{
+		// A DS record without a digest.
+		{TypeDS, "ec450501"},
+		// A type bitmap window with no octets.
+		{TypeNSEC, "00" + "0000"},
+		// Type bitmap windows out of order.
+		{TypeNSEC, "00" + "040120" + "000140"},
+		// An NSEC3 record with an empty next hashed owner name.
+		{TypeNSEC3, "0101000c00" + "00"},
+	} {
+		rdata, _ := hex.DecodeString(tc.rdata)
+		if got := FormatRData(tc.rrtype, rdata); !strings.HasPrefix(got, `\# `) {
+			t.Errorf("FormatRData(%s, %s) = %q, want the generic form", TypeString(tc.rrtype), tc.rdata, got)
+		}
+	}
+}
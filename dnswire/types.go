@@ -0,0 +1,168 @@
+package dnswire
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeA          uint16 = 1
+	TypeNS         uint16 = 2
+	TypeCNAME      uint16 = 5
+	TypeSOA        uint16 = 6
+	TypePTR        uint16 = 12
+	TypeMX         uint16 = 15
+	TypeTXT        uint16 = 16
+	TypeSIG        uint16 = 24
+	TypeKEY        uint16 = 25
+	TypeAAAA       uint16 = 28
+	TypeSRV        uint16 = 33
+	TypeOPT        uint16 = 41
+	TypeDS         uint16 = 43
+	TypeRRSIG      uint16 = 46
+	TypeNSEC       uint16 = 47
+	TypeDNSKEY     uint16 = 48
+	TypeNSEC3      uint16 = 50
+	TypeNSEC3PARAM uint16 = 51
+	TypeCDS        uint16 = 59
+	TypeCDNSKEY    uint16 = 60
+	TypeTSIG       uint16 = 250
+	TypeIXFR       uint16 = 251
+	TypeAXFR       uint16 = 252
+	TypeANY        uint16 = 255
+)
+
+const (
+	ClassINET uint16 = 1
+	// ClassNONE marks deletions and prerequisites in updates (RFC 2136).
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+const (
+	RCodeSuccess        uint8 = 0
+	RCodeFormatError    uint8 = 1
+	RCodeServerFailure  uint8 = 2
+	RCodeNameError      uint8 = 3
+	RCodeNotImplemented uint8 = 4
+	RCodeRefused        uint8 = 5
+	RCodeYXDomain       uint8 = 6
+	RCodeYXRRSet        uint8 = 7
+	RCodeNXRRSet        uint8 = 8
+	RCodeNotAuth        uint8 = 9
+	RCodeNotZone        uint8 = 10
+)
+
+var typeNames = map[uint16]string{
+	TypeA:          "A",
+	TypeNS:         "NS",
+	TypeCNAME:      "CNAME",
+	TypeSOA:        "SOA",
+	TypePTR:        "PTR",
+	TypeMX:         "MX",
+	TypeTXT:        "TXT",
+	TypeSIG:        "SIG",
+	TypeKEY:        "KEY",
+	TypeAAAA:       "AAAA",
+	TypeSRV:        "SRV",
+	TypeOPT:        "OPT",
+	TypeDS:         "DS",
+	TypeRRSIG:      "RRSIG",
+	TypeNSEC:       "NSEC",
+	TypeDNSKEY:     "DNSKEY",
+	TypeNSEC3:      "NSEC3",
+	TypeNSEC3PARAM: "NSEC3PARAM",
+	TypeCDS:        "CDS",
+	TypeCDNSKEY:    "CDNSKEY",
+	TypeTSIG:       "TSIG",
+	TypeIXFR:       "IXFR",
+	TypeAXFR:       "AXFR",
+	TypeANY:        "ANY",
+}
+
+func TypeString(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+var rcodeNames = map[uint8]string{
+	RCodeSuccess:        "NOERROR",
+	RCodeFormatError:    "FORMERR",
+	RCodeServerFailure:  "SERVFAIL",
+	RCodeNameError:      "NXDOMAIN",
+	RCodeNotImplemented: "NOTIMP",
+	RCodeRefused:        "REFUSED",
+	RCodeYXDomain:       "YXDOMAIN",
+	RCodeYXRRSet:        "YXRRSET",
+	RCodeNXRRSet:        "NXRRSET",
+	RCodeNotAuth:        "NOTAUTH",
+	RCodeNotZone:        "NOTZONE",
+}
+
+func RCodeString(rcode uint8) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func ParseRCode(s string) (uint8, bool) {
+	s = strings.ToUpper(s)
+	for rcode, name := range rcodeNames {
+		if name == s {
+			return rcode, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(s, "RCODE"); ok {
+		if n, err := strconv.ParseUint(rest, 10, 4); err == nil {
+			return uint8(n), true
+		}
+	}
+	return 0, false
+}
+
+var classNames = map[uint16]string{
+	ClassINET: "IN",
+	ClassNONE: "NONE",
+	ClassANY:  "ANY",
+}
+
+func ClassString(class uint16) string {
+	if name, ok := classNames[class]; ok {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+func ParseClass(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for class, name := range classNames {
+		if name == s {
+			return class, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(s, "CLASS"); ok {
+		if n, err := strconv.ParseUint(rest, 10, 16); err == nil {
+			return uint16(n), true
+		}
+	}
+	return 0, false
+}
+
+func ParseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == s {
+			return t, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(s, "TYPE"); ok {
+		if n, err := strconv.ParseUint(rest, 10, 16); err == nil {
+			return uint16(n), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,303 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// The doctor subcommand takes the server's flags and, instead of serving,
+// checks the configuration and the environment the server would run in:
+//
+//	dns-server doctor -config /etc/dns-server.conf
+
+// rootServers are the IPv4 addresses of the root name servers.
+var rootServers = map[string]string{
+	"a.root-servers.net": "198.41.0.4",
+	"b.root-servers.net": "170.247.170.2",
+	"c.root-servers.net": "192.33.4.12",
+	"d.root-servers.net": "199.7.91.13",
+	"e.root-servers.net": "192.203.230.10",
+	"f.root-servers.net": "192.5.5.241",
+	"g.root-servers.net": "192.112.36.4",
+	"h.root-servers.net": "198.97.190.53",
+	"i.root-servers.net": "192.36.148.17",
+	"j.root-servers.net": "192.58.128.30",
+	"k.root-servers.net": "193.0.14.129",
+	"l.root-servers.net": "199.7.83.42",
+	"m.root-servers.net": "202.12.27.33",
+}
+
+const (
+	ntpServer    = "pool.ntp.org:123"
+	maxClockSkew = 10 * time.Second
+	// dnssecCheckName is a delegation whose signed DS RRset the DNSSEC
+	// check validates against the root keys.
+	dnssecCheckName = "com"
+)
+
+type doctor struct {
+	checks, failed int
+}
+
+func (d *doctor) report(check, result, detail string) {
+	d.checks++
+	if result == "FAIL" {
+		d.failed++
+	}
+	fmt.Printf("%-4s  %-28s %s\n", result, check, detail)
+}
+
+func (d *doctor) check(check string, err error, detail string) {
+	if err != nil {
+		d.report(check, "FAIL", err.Error())
+	} else {
+		d.report(check, "PASS", detail)
+	}
+}
+
+// runDoctor prints a pass/fail report and returns the exit status. configErr
+// is why reading the settings failed, if it did; build loads the rest of the
+// configuration; addrs are the HTTP addresses the server would listen on.
+func runDoctor(configErr error, build func() (*serverConfig, error), addrs []string) int {
+	d := &doctor{}
+	var cfg *serverConfig
+	err := configErr
+	if err == nil {
+		cfg, err = build()
+	}
+	if err == nil {
+		d.check("configuration", nil, fmt.Sprintf("%d listeners, %d zones", len(cfg.listeners), cfg.zones.Len()))
+		for _, l := range cfg.listeners {
+			networks := []string{"tcp"}
+			if l.Transport == "udp" {
+				networks = []string{"udp", "tcp"}
+			}
+			for _, network := range networks {
+				d.check(fmt.Sprintf("bind %s %s", network, l.Addr), bindable(network, l.Addr), "available")
+			}
+		}
+		for _, addr := range addrs {
+			d.check("bind tcp "+addr, bindable("tcp", addr), "available")
+		}
+	} else {
+		d.check("configuration", err, "")
+	}
+
+	switch {
+	case cfg == nil:
+		d.report("upstream", "SKIP", "the configuration is invalid")
+	case cfg.resolver == nil:
+		d.report("upstream", "SKIP", "no -resolver configured")
+	default:
+		q := healthQuery("", TypeNS)
+		start := time.Now()
+		if cfg.resolverTCP > 0 {
+			d.report("upstream udp "+cfg.resolver.String(), "SKIP", "the resolver is queried over TCP")
+		} else {
+			_, err := checkedExchange(func() (*Message, error) { return exchange(cfg.resolver, q) })
+			d.check("upstream udp "+cfg.resolver.String(), err, fmt.Sprintf("answered in %v", time.Since(start).Round(time.Microsecond)))
+		}
+		start = time.Now()
+		_, err := checkedExchange(func() (*Message, error) {
+			return upstreamClient(cfg.resolver, "tcp").Exchange(context.Background(), q)
+		})
+		d.check("upstream tcp "+cfg.resolver.String(), err, fmt.Sprintf("answered in %v", time.Since(start).Round(time.Microsecond)))
+	}
+
+	server, took, err := checkRoot()
+	d.check("root servers", err, fmt.Sprintf("%s answered in %v", server, took.Round(time.Microsecond)))
+
+	switch {
+	case cfg == nil:
+		d.report("dnssec", "SKIP", "the configuration is invalid")
+	case cfg.resolver == nil:
+		d.report("dnssec", "SKIP", "no -resolver configured")
+	default:
+		d.check("dnssec", checkDNSSEC(cfg.resolver, time.Now()),
+			fmt.Sprintf("the root keys and %s DS validate", fqdn(dnssecCheckName)))
+	}
+
+	if offset, err := clockOffset(ntpServer); err != nil {
+		d.check("clock", fmt.Errorf("asking %s: %v", ntpServer, err), "")
+	} else if offset > maxClockSkew || offset < -maxClockSkew {
+		d.check("clock", fmt.Errorf("off by %v according to %s", offset.Round(time.Millisecond), ntpServer), "")
+	} else {
+		d.check("clock", nil, fmt.Sprintf("off by %v", offset.Round(time.Millisecond)))
+	}
+
+	if d.failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", d.failed, d.checks)
+		return 1
+	}
+	return 0
+}
+
+// bindable reports whether the server could listen on addr.
+func bindable(network, addr string) error {
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// checkedExchange runs exchange and fails unless the answer is NOERROR.
+func checkedExchange(exchange func() (*Message, error)) (*Message, error) {
+	resp, err := exchange()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.RCode != RCodeSuccess {
+		return nil, fmt.Errorf("answered %s", dnswire.RCodeString(resp.Header.RCode))
+	}
+	return resp, nil
+}
+
+// checkRoot asks every root server for the root NS RRset, returning the
+// first to give an authoritative answer.
+func checkRoot() (string, time.Duration, error) {
+	type result struct {
+		server string
+		took   time.Duration
+		err    error
+	}
+	results := make(chan result, len(rootServers))
+	for name, ip := range rootServers {
+		go func() {
+			q := dnswire.NewQuery("", TypeNS)
+			q.Header.RD = false
+			start := time.Now()
+			resp, err := checkedExchange(func() (*Message, error) {
+				return exchange(&net.UDPAddr{IP: net.ParseIP(ip), Port: 53}, q)
+			})
+			if err == nil && !resp.Header.AA {
+				err = fmt.Errorf("answer is not authoritative")
+			}
+			results <- result{name, time.Since(start), err}
+		}()
+	}
+	var last error
+	for range rootServers {
+		r := <-results
+		if r.err == nil {
+			return r.server, r.took, nil
+		}
+		last = r.err
+	}
+	return "", 0, fmt.Errorf("no root server answered, last error: %v", last)
+}
+
+// checkDNSSEC validates the root DNSKEY RRset against the built-in trust
+// anchors and a DS RRset against the root keys, all as returned by the
+// resolver.
+func checkDNSSEC(resolver *net.UDPAddr, now time.Time) error {
+	var anchors []*TrustAnchor
+	for _, line := range builtinRootAnchors {
+		ta, err := parseTrustAnchor(line)
+		if err != nil {
+			return err
+		}
+		anchors = append(anchors, ta)
+	}
+
+	rootKeys, err := validatedRRset(resolver, "", TypeDNSKEY, now, func(rrset []*ResourceRecord) []*DNSKEY {
+		var trusted []*DNSKEY
+		for _, rr := range rrset {
+			k, err := parseDNSKEY(rr.RData)
+			if err != nil {
+				continue
+			}
+			for _, ta := range anchors {
+				if ta.Matches(k) {
+					trusted = append(trusted, k)
+				}
+			}
+		}
+		return trusted
+	})
+	if err != nil {
+		return err
+	}
+	var keys []*DNSKEY
+	for _, rr := range rootKeys {
+		if k, err := parseDNSKEY(rr.RData); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	_, err = validatedRRset(resolver, dnssecCheckName, TypeDS, now, func([]*ResourceRecord) []*DNSKEY { return keys })
+	return err
+}
+
+// validatedRRset looks up name and rrtype with DNSSEC records and checks
+// the answer is signed by one of the keys signers picks.
+func validatedRRset(resolver *net.UDPAddr, name string, rrtype uint16, now time.Time, signers func([]*ResourceRecord) []*DNSKEY) ([]*ResourceRecord, error) {
+	q := dnswire.NewQuery(name, rrtype).SetEDNS(4096, true)
+	resp, err := checkedExchange(func() (*Message, error) { return exchange(resolver, q) })
+	if err != nil {
+		return nil, err
+	}
+	sets, sigs := splitRRSets(resp.Answers)
+	rrset := sets[rrsetKey(name, rrtype)]
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("no %s %s records", fqdn(name), dnswire.TypeString(rrtype))
+	}
+	rrsigs := sigs[rrsetKey(name, rrtype)]
+	if len(rrsigs) == 0 {
+		return nil, fmt.Errorf("%s %s came without signatures; the resolver may strip DNSSEC records", fqdn(name), dnswire.TypeString(rrtype))
+	}
+	keys := signers(rrset)
+	for _, sig := range rrsigs {
+		for _, k := range keys {
+			if sig.ValidAt(now) && VerifyRRSIG(sig, k, rrset) == nil {
+				return rrset, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s %s is not signed by a trusted key", fqdn(name), dnswire.TypeString(rrtype))
+}
+
+// clockOffset asks an NTP server how far the local clock is off.
+func clockOffset(server string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, exchangeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(exchangeTimeout))
+
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3 // version 4, client mode
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	if n < 48 || resp[0]&7 != 4 || resp[1] == 0 {
+		return 0, fmt.Errorf("invalid response")
+	}
+	serverReceived, serverSent := ntpTime(resp[32:]), ntpTime(resp[40:])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	const unixEpoch = 2208988800 // seconds from 1900 to 1970
+	secs, frac := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+	return time.Unix(int64(secs)-unixEpoch, int64(uint64(frac)*1e9>>32))
+}
@@ -0,0 +1,348 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnsclient"
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+const exchangeTimeout = 5 * time.Second
+
+// ednsUDPSize is the payload size we advertise, per the DNS flag day 2020
+// recommendation.
+const ednsUDPSize = server.UDPSize
+
+// newEDNS returns an OPT pseudo-record advertising udpSize, with the DO bit
+// set when do is true.
+func newEDNS(udpSize uint16, do bool) *ResourceRecord {
+	var ttl uint32
+	if do {
+		ttl |= 1 << 15
+	}
+	return &ResourceRecord{Name: "", Type: TypeOPT, Class: udpSize, TTL: ttl}
+}
+
+func findOPT(m *Message) *ResourceRecord {
+	for _, rr := range m.Additionals {
+		if rr.Type == TypeOPT {
+			return rr
+		}
+	}
+	return nil
+}
+
+// exchange sends q to addr over UDP and retries over TCP when the answer
+// comes back truncated. Responses that don't match q are counted as
+// possible spoofing attempts and ignored.
+func exchange(addr *net.UDPAddr, q *Query) (*Message, error) {
+	return exchangeCase(addr, q, spoofDetector != nil && spoofDetector.Use0x20)
+}
+
+// exchangeCase is exchange with 0x20 encoding of the question names turned
+// on or off.
+func exchangeCase(addr *net.UDPAddr, q *Query, use0x20 bool) (*Message, error) {
+	sent := q
+	if use0x20 {
+		encoded := *q
+		encoded.Questions = make([]*Question, len(q.Questions))
+		for i, question := range q.Questions {
+			encoded.Questions[i] = &Question{Name: randomizeCase(question.Name), QType: question.QType, QClass: question.QClass}
+		}
+		sent = &encoded
+	}
+	upstream := addr.String()
+	if err := upstreamBreakers.Allow(upstream, time.Now()); err != nil {
+		return nil, err
+	}
+	queried := time.Now()
+	resp, err := exchangeUpstream(addr, sent)
+	if err != nil && upstreamBreakers.Retry(upstream, err) {
+		queried = time.Now()
+		resp, err = exchangeUpstream(addr, sent)
+	}
+	upstreamBreakers.Record(upstream, err, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	upstreamLatency.With(upstream).Observe(time.Since(queried).Seconds())
+	if sent != q {
+		restoreCase(resp, sent, q)
+	}
+	return resp, nil
+}
+
+// exchangeUpstream sends q to addr over UDP, or over the pipelined TCP
+// connections if it is to be queried over TCP.
+func exchangeUpstream(addr *net.UDPAddr, q *Query) (*Message, error) {
+	u := tcpUpstreamFor(addr)
+	if u == nil {
+		return upstreamClient(addr, "udp").Exchange(context.Background(), q)
+	}
+	data, err := q.AppendTo(nil)
+	if err != nil {
+		return nil, err
+	}
+	wire, err := u.Exchange(data)
+	if err != nil {
+		return nil, err
+	}
+	return dnswire.ParseMessage(wire)
+}
+
+// upstreamClient returns a client for addr whose traffic is tapped and
+// captured, and whose UDP responses go through the spoof detector.
+func upstreamClient(addr *net.UDPAddr, network string) *dnsclient.Client {
+	upstream := addr.String()
+	return &dnsclient.Client{
+		Net:     network,
+		Addr:    upstream,
+		Timeout: exchangeTimeout,
+		Check: func(q *Query, resp *LazyMessage) error {
+			if kind := checkResponse(q, resp); kind != "" {
+				spoofDetector.record(upstream, kind)
+				return fmt.Errorf("suspicious response: %s", kind)
+			}
+			return nil
+		},
+		Sent: func(network string, local, remote net.Addr, query []byte, at time.Time) {
+			dnstapWriter.ResolverQuery(network, local, remote, query, at)
+			captureUpstream(local, remote, query, true)
+		},
+		Received: func(network string, local, remote net.Addr, query, resp []byte, queried time.Time) {
+			dnstapWriter.ResolverResponse(network, local, remote, query, resp, queried)
+			captureUpstream(local, remote, resp, false)
+		},
+		Linger: func(conn *net.UDPConn, q *Query, resp *Message) bool {
+			if spoofDetector == nil || spoofDetector.Linger == 0 {
+				return false
+			}
+			go spoofDetector.linger(conn, upstream, q, answerKey(resp))
+			return true
+		},
+	}
+}
+
+// relayable reports whether m can be relayed upstream as it is: a single
+// question, no records apart from an OPT record without options, which
+// would otherwise carry cookies or client subnets meant for us.
+func relayable(m *Message) bool {
+	if len(m.Questions) != 1 || len(m.Answers) > 0 || len(m.Authorities) > 0 || len(m.Additionals) > 1 {
+		return false
+	}
+	opt := findOPT(m)
+	return len(m.Additionals) == 0 || (opt != nil && len(opt.RData) == 0)
+}
+
+// relay forwards the query in data, whose question is q, to addr over UDP
+// as it is, with only a fresh ID and, if use0x20 is set, the case of the
+// name randomized. It returns the response, in a buffer from
+// server.GetBuffer for the caller to put back, with the query's ID and
+// question restored: neither is decoded and re-encoded. A truncated
+// response is returned as such.
+func relay(addr *net.UDPAddr, data []byte, q *Question, use0x20 bool) (*[]byte, *LazyMessage, error) {
+	upstream := addr.String()
+	if err := upstreamBreakers.Allow(upstream, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	wire, resp, err := relayOnce(addr, data, q, use0x20)
+	if err != nil && upstreamBreakers.Retry(upstream, err) {
+		wire, resp, err = relayOnce(addr, data, q, use0x20)
+	}
+	upstreamBreakers.Record(upstream, err, time.Now())
+	return wire, resp, err
+}
+
+func relayOnce(addr *net.UDPAddr, data []byte, q *Question, use0x20 bool) (*[]byte, *LazyMessage, error) {
+	nameEnd := 12
+	for nameEnd < len(data) && data[nameEnd] != 0 && data[nameEnd]&0xC0 == 0 {
+		nameEnd += int(data[nameEnd]) + 1
+	}
+	if nameEnd+5 > len(data) || data[nameEnd] != 0 {
+		return nil, nil, fmt.Errorf("question name is compressed or runs past the query")
+	}
+	nameEnd++
+
+	wire := server.GetBuffer(len(data))
+	defer server.PutBuffer(wire)
+	out := *wire
+	copy(out, data)
+	sent := &Query{Header: Header{ID: uint16(rand.Uint32())}, Questions: []*Question{q}}
+	binary.BigEndian.PutUint16(out, sent.Header.ID)
+	if use0x20 {
+		// The name lines up with its presentation form from offset 13,
+		// as in WireCache.Get.
+		name := randomizeCase(strings.TrimSuffix(q.Name, "."))
+		for i := 0; i < len(name); i++ {
+			if name[i] != '.' {
+				out[13+i] = name[i]
+			}
+		}
+		sent.Questions = []*Question{{Name: name, QType: q.QType, QClass: q.QClass}}
+	}
+	upstream := addr.String()
+
+	if u := tcpUpstreamFor(addr); u != nil {
+		queried := time.Now()
+		reply, err := u.Exchange(out)
+		if err != nil {
+			return nil, nil, err
+		}
+		read := server.GetBuffer(len(reply))
+		resp := *read
+		copy(resp, reply)
+		lazy, err := dnswire.ParseLazy(resp)
+		if err == nil {
+			if kind := checkResponse(sent, lazy); kind != "" {
+				spoofDetector.record(upstream, kind)
+				err = fmt.Errorf("suspicious response: %s", kind)
+			}
+		}
+		if err != nil {
+			server.PutBuffer(read)
+			return nil, nil, err
+		}
+		upstreamLatency.With(upstream).Observe(time.Since(queried).Seconds())
+		copy(resp, data[:2])
+		copy(resp[12:nameEnd], data[12:nameEnd])
+		lazy.Header.ID = binary.BigEndian.Uint16(data)
+		return read, lazy, nil
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(exchangeTimeout))
+
+	queried := time.Now()
+	dnstapWriter.ResolverQuery("udp", conn.LocalAddr(), addr, out, queried)
+	captureUpstream(conn.LocalAddr(), addr, out, true)
+	if _, err := conn.Write(out); err != nil {
+		return nil, nil, err
+	}
+
+	read := server.GetBuffer(65535)
+	for {
+		n, err := conn.Read(*read)
+		if err != nil {
+			server.PutBuffer(read)
+			return nil, nil, err
+		}
+		resp := (*read)[:n]
+		lazy, err := dnswire.ParseLazy(resp)
+		if err != nil {
+			continue
+		}
+		if kind := checkResponse(sent, lazy); kind != "" {
+			spoofDetector.record(upstream, kind)
+			continue // not ours, keep waiting until the deadline
+		}
+		dnstapWriter.ResolverResponse("udp", conn.LocalAddr(), addr, out, resp, queried)
+		captureUpstream(conn.LocalAddr(), addr, resp, false)
+		upstreamLatency.With(upstream).Observe(time.Since(queried).Seconds())
+
+		copy(resp, data[:2])
+		copy(resp[12:nameEnd], data[12:nameEnd])
+		lazy.Header.ID = binary.BigEndian.Uint16(data)
+		*read = resp
+		return read, lazy, nil
+	}
+}
+
+// restoreCase undoes 0x20 encoding in resp so callers see the names as
+// they asked for them.
+func restoreCase(resp *Message, sent, q *Query) {
+	resp.Questions = q.Questions
+	for _, rr := range resp.Answers {
+		for i, question := range sent.Questions {
+			if rr.Name == question.Name {
+				rr.Name = q.Questions[i].Name
+			}
+		}
+	}
+}
+
+// truncate fits resp into limit bytes by dropping whole RRsets, with
+// their signatures, from the end: additional records first, then
+// authority and then answer records, so a client never gets part of an
+// RRset. Anything but additional data sets TC, and so does glue left out
+// of a referral (RFC 2181 section 9, RFC 9471).
+func truncate(resp *Query, limit int, compress bool) *Query {
+	if encodedSize(resp, compress) <= limit {
+		return resp
+	}
+	tc := *resp
+	referral := !resp.Header.AA && len(resp.Answers) == 0 &&
+		slices.ContainsFunc(resp.Authorities, func(rr *ResourceRecord) bool { return rr.Type == TypeNS })
+	for i, section := range []*[]*ResourceRecord{&tc.Additionals, &tc.Authorities, &tc.Answers} {
+		*section = slices.Clone(*section)
+		for encodedSize(&tc, compress) > limit {
+			rest, dropped := dropLastRRSet(*section)
+			if dropped == nil {
+				break
+			}
+			*section = rest
+			tc.Header.ANCount, tc.Header.NSCount, tc.Header.ARCount =
+				uint16(len(tc.Answers)), uint16(len(tc.Authorities)), uint16(len(tc.Additionals))
+			if i > 0 || referral && (dropped.Type == TypeA || dropped.Type == TypeAAAA) {
+				tc.Header.TC = true
+			}
+		}
+	}
+	if encodedSize(&tc, compress) > limit {
+		return truncated(resp)
+	}
+	return &tc
+}
+
+// dropLastRRSet removes the RRset of the last record in rrs, and the
+// RRSIGs covering it, and returns that record. The OPT record stays.
+func dropLastRRSet(rrs []*ResourceRecord) ([]*ResourceRecord, *ResourceRecord) {
+	i := len(rrs) - 1
+	for i >= 0 && rrs[i].Type == TypeOPT {
+		i--
+	}
+	if i < 0 {
+		return rrs, nil
+	}
+	last := rrs[i]
+	key := rrsetKey(last.Name, coveredType(last))
+	return slices.DeleteFunc(rrs, func(rr *ResourceRecord) bool {
+		return rr.Type != TypeOPT && rrsetKey(rr.Name, coveredType(rr)) == key
+	}), last
+}
+
+// coveredType returns the type of the RRset rr belongs to: for an RRSIG
+// the type it covers.
+func coveredType(rr *ResourceRecord) uint16 {
+	if rr.Type == TypeRRSIG && len(rr.RData) >= 2 {
+		return binary.BigEndian.Uint16(rr.RData)
+	}
+	return rr.Type
+}
+
+// truncated returns resp with TC set and only the OPT record left.
+func truncated(resp *Query) *Query {
+	tc := *resp
+	tc.Header.TC = true
+	tc.Answers, tc.Authorities = nil, nil
+	tc.Additionals = nil
+	for _, rr := range resp.Additionals {
+		if rr.Type == TypeOPT {
+			tc.Additionals = append(tc.Additionals, rr)
+		}
+	}
+	tc.Header.ANCount, tc.Header.NSCount = 0, 0
+	tc.Header.ARCount = uint16(len(tc.Additionals))
+	return &tc
+}
@@ -0,0 +1,180 @@
+package dnsserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Features are behaviors switched on at runtime through the control
+// socket, for every query or only for queries at or below a zone or from a
+// client network. Every override expires, so a debug mode left on by
+// mistake turns itself off.
+const (
+	// featureDebugLog logs the matching queries at debug level whatever
+	// the server's log level.
+	featureDebugLog = "debug-log"
+	// featureQueryLog adds the matching queries to the query log even if
+	// -query-log-zone leaves them out, or logs them to the server log if
+	// there is no query log.
+	featureQueryLog = "query-log"
+	// feature0x20 is experimental: it applies 0x20 encoding to the
+	// matching queries sent upstream, to try it before enabling -0x20.
+	feature0x20 = "0x20"
+	// featureNoCompression sends the responses to the matching queries
+	// without name compression, as -no-compression does.
+	featureNoCompression = "no-compression"
+
+	defaultFeatureTTL = 15 * time.Minute
+	maxFeatureTTL     = 24 * time.Hour
+)
+
+var knownFeatures = []string{featureDebugLog, featureQueryLog, feature0x20, featureNoCompression}
+
+type FeatureOverride struct {
+	ID      int       `json:"id"`
+	Feature string    `json:"feature"`
+	Zone    string    `json:"zone,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Expires time.Time `json:"expires"`
+
+	zone    string
+	network *net.IPNet
+}
+
+func (o *FeatureOverride) matches(client net.IP, qname string, now time.Time) bool {
+	return now.Before(o.Expires) && (o.network == nil || (client != nil && o.network.Contains(client))) &&
+		(o.Zone == "" || inZone(qname, o.zone))
+}
+
+// Scope describes which queries the override applies to.
+func (o *FeatureOverride) Scope() string {
+	switch {
+	case o.Zone != "" && o.Client != "":
+		return fmt.Sprintf("zone %s, client %s", o.Zone, o.Client)
+	case o.Zone != "":
+		return "zone " + o.Zone
+	case o.Client != "":
+		return "client " + o.Client
+	}
+	return "all queries"
+}
+
+type Features struct {
+	mu        sync.RWMutex
+	nextID    int
+	overrides []*FeatureOverride
+	// active is the number of overrides, so queries skip the lock when
+	// there are none.
+	active atomic.Int32
+}
+
+var features = &Features{}
+
+// Enable switches feature on for ttl, for queries at or below zone and from
+// client, a network or address; either may be empty to match all.
+func (f *Features) Enable(feature, zone, client string, ttl time.Duration, now time.Time) (*FeatureOverride, error) {
+	if !slices.Contains(knownFeatures, feature) {
+		return nil, fmt.Errorf("unknown feature %q, want one of %v", feature, knownFeatures)
+	}
+	if ttl <= 0 {
+		ttl = defaultFeatureTTL
+	}
+	if ttl > maxFeatureTTL {
+		return nil, fmt.Errorf("ttl %v is longer than the maximum of %v", ttl, maxFeatureTTL)
+	}
+	o := &FeatureOverride{Feature: feature, Expires: now.Add(ttl)}
+	if zone != "" {
+		o.zone = normalizeName(zone)
+		o.Zone = fqdn(o.zone)
+	}
+	if client != "" {
+		networks, err := server.ParseNetworks(client)
+		if err != nil || len(networks) != 1 {
+			return nil, fmt.Errorf("invalid client %q", client)
+		}
+		o.network = networks[0]
+		o.Client = o.network.String()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(now)
+	f.nextID++
+	o.ID = f.nextID
+	f.overrides = append(f.overrides, o)
+	f.active.Store(int32(len(f.overrides)))
+	time.AfterFunc(ttl, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.expire(time.Now())
+	})
+	return o, nil
+}
+
+// Disable removes the override with id, returning it if there was one.
+func (f *Features) Disable(id int) *FeatureOverride {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, o := range f.overrides {
+		if o.ID == id {
+			f.overrides = slices.Delete(f.overrides, i, i+1)
+			f.active.Store(int32(len(f.overrides)))
+			return o
+		}
+	}
+	return nil
+}
+
+// List returns the overrides that haven't expired.
+func (f *Features) List(now time.Time) []*FeatureOverride {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(now)
+	return slices.Clone(f.overrides)
+}
+
+// expire drops the overrides that expired. The caller holds f.mu.
+func (f *Features) expire(now time.Time) {
+	f.overrides = slices.DeleteFunc(f.overrides, func(o *FeatureOverride) bool {
+		if now.Before(o.Expires) {
+			return false
+		}
+		logServer.Info("feature override expired", "feature", o.Feature, "scope", o.Scope())
+		return true
+	})
+	f.active.Store(int32(len(f.overrides)))
+}
+
+// Enabled reports whether feature is on for a query for qname from client,
+// which may be nil if it isn't known.
+func (f *Features) Enabled(feature string, client net.IP, qname string, now time.Time) bool {
+	if f.active.Load() == 0 {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, o := range f.overrides {
+		if o.Feature == feature && o.matches(client, qname, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// forceDebug returns a logger like l that logs at every level.
+func forceDebug(l *slog.Logger) *slog.Logger {
+	h, ok := l.Handler().(*logHandler)
+	if !ok {
+		return l
+	}
+	forced := *h
+	forced.debug = true
+	return slog.New(&forced)
+}
@@ -0,0 +1,242 @@
+package dnsserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Firewall rules are checked in order before a query is resolved:
+//
+//	deny type=ANY
+//	deny name=evil.example client=10.0.0.0/8
+//	redirect name=/^(www\.)?social\.example$/ to=blocked.example.com
+//	log client=192.0.2.0/24 time=22:00-06:00
+//	deny name=games.example schedule=school
+//	allow client=localhost
+//
+// A rule matches when all of its conditions do. name= matches the name and
+// everything below it, or a regex when written between slashes. type= and
+// client= take comma separated lists; time= is a local time range that may
+// wrap past midnight, and schedule= names a -schedule. log rules print the query and carry on; the first
+// allow, deny (REFUSED) or redirect rule to match ends the evaluation.
+
+var firewallMatches = NewCounterVec("dns_firewall_matches_total", "Queries matched by firewall rules.", "rule", "action")
+
+type firewallAction string
+
+const (
+	firewallAllow    firewallAction = "allow"
+	firewallDeny     firewallAction = "deny"
+	firewallLog      firewallAction = "log"
+	firewallRedirect firewallAction = "redirect"
+)
+
+type FirewallRule struct {
+	Spec   string
+	Action firewallAction
+
+	Types   []uint16
+	Name    string
+	re      *regexp.Regexp
+	Clients []*net.IPNet
+	// From and To are minutes since midnight; the rule applies from From
+	// up to but not including To.
+	From, To int
+	timed    bool
+	Schedule string
+	Target   string
+}
+
+func ParseFirewallRule(spec string) (*FirewallRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty firewall rule")
+	}
+	r := &FirewallRule{Spec: strings.Join(fields, " "), Action: firewallAction(fields[0])}
+	switch r.Action {
+	case firewallAllow, firewallDeny, firewallLog, firewallRedirect:
+	default:
+		return nil, fmt.Errorf("firewall %q: unknown action %q", spec, fields[0])
+	}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("firewall %q: want key=value, got %q", spec, field)
+		}
+		switch key {
+		case "type":
+			for _, name := range strings.Split(value, ",") {
+				t, ok := dnswire.ParseType(strings.ToUpper(name))
+				if !ok {
+					return nil, fmt.Errorf("firewall %q: unknown type %q", spec, name)
+				}
+				r.Types = append(r.Types, t)
+			}
+		case "name":
+			if len(value) > 1 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+				re, err := regexp.Compile("(?i)" + value[1:len(value)-1])
+				if err != nil {
+					return nil, fmt.Errorf("firewall %q: %v", spec, err)
+				}
+				r.re = re
+			} else {
+				r.Name = normalizeName(value)
+			}
+		case "client":
+			nets, err := server.ParseNetworks(value)
+			if err != nil {
+				return nil, fmt.Errorf("firewall %q: %v", spec, err)
+			}
+			r.Clients = nets
+		case "time":
+			from, to, ok := strings.Cut(value, "-")
+			var err error
+			if r.From, err = parseClock(from); err == nil && ok {
+				r.To, err = parseClock(to)
+			}
+			if err != nil || !ok {
+				return nil, fmt.Errorf("firewall %q: want time=HH:MM-HH:MM", spec)
+			}
+			r.timed = true
+		case "schedule":
+			r.Schedule = value
+		case "to":
+			if r.Action != firewallRedirect {
+				return nil, fmt.Errorf("firewall %q: only redirect rules take to=", spec)
+			}
+			r.Target = normalizeName(value)
+		default:
+			return nil, fmt.Errorf("firewall %q: unknown condition %q", spec, key)
+		}
+	}
+	if r.Action == firewallRedirect && r.Target == "" {
+		return nil, fmt.Errorf("firewall %q: redirect needs to=NAME", spec)
+	}
+	return r, nil
+}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	min, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 24 || min < 0 || min > 59 || hour*60+min > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + min, nil
+}
+
+func (r *FirewallRule) matches(client net.IP, q *Question, now time.Time) bool {
+	if len(r.Types) > 0 {
+		found := false
+		for _, t := range r.Types {
+			found = found || t == q.QType
+		}
+		if !found {
+			return false
+		}
+	}
+	name := normalizeName(q.Name)
+	if r.re != nil && !r.re.MatchString(name) {
+		return false
+	}
+	if r.re == nil && r.Name != "" && !inZone(name, r.Name) {
+		return false
+	}
+	if len(r.Clients) > 0 {
+		found := false
+		for _, n := range r.Clients {
+			found = found || n.Contains(client)
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Schedule != "" {
+		// A schedule a reload removed no longer applies.
+		if s := currentConfig().schedules[r.Schedule]; s == nil || !s.Active(now) {
+			return false
+		}
+	}
+	if r.timed {
+		minute := now.Hour()*60 + now.Minute()
+		if r.From <= r.To {
+			return minute >= r.From && minute < r.To
+		}
+		return minute >= r.From || minute < r.To
+	}
+	return true
+}
+
+type Firewall struct {
+	Rules []*FirewallRule
+}
+
+func (fw *Firewall) Add(spec string) error {
+	r, err := ParseFirewallRule(spec)
+	if err != nil {
+		return err
+	}
+	fw.Rules = append(fw.Rules, r)
+	return nil
+}
+
+// LoadFile adds the rules in path, one per line; # starts a comment.
+func (fw *Firewall) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if err := fw.Add(text); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Check evaluates the rules against the first question of m and returns
+// the terminating rule that matched, or nil if the query may go ahead
+// without changes. Rules only look at standard queries.
+func (fw *Firewall) Check(client net.IP, m *Message, now time.Time) *FirewallRule {
+	if fw == nil || m.Header.Opcode != 0 || len(m.Questions) == 0 {
+		return nil
+	}
+	q := m.Questions[0]
+	for i, r := range fw.Rules {
+		if !r.matches(client, q, now) {
+			continue
+		}
+		firewallMatches.With(strconv.Itoa(i+1), string(r.Action)).Inc()
+		if r.Action == firewallLog {
+			logFirewall.Info("rule matched", "rule", r.Spec, "client", client.String(), "qname", fqdn(normalizeName(q.Name)), "qtype", dnswire.TypeString(q.QType))
+			continue
+		}
+		if r.Action == firewallAllow {
+			return nil
+		}
+		return r
+	}
+	return nil
+}
+
+// redirect sends m's question to the rule's target, mapping the answers
+// back to the name the client asked for.
+func (r *FirewallRule) redirect(m *Message) *rewriteState {
+	rule := &RewriteRule{Kind: "name", Match: matchExact, From: normalizeName(m.Questions[0].Name), To: r.Target}
+	return (&Rewriter{Rules: []*RewriteRule{rule}}).Request(m)
+}
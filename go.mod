@@ -1,3 +1,5 @@
 module github.com/bibektamang7/dns-server
 
-go 1.22.2
+go 1.23
+
+require github.com/yuin/gopher-lua v1.1.2
@@ -0,0 +1,203 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// Health tracks what load balancers and orchestrators need to know: the
+// process answers /healthz as long as it runs, and /readyz once the
+// listeners are bound, the zones are loaded, any -warm-up is done, the
+// server answers a query sent to itself and at least one upstream
+// resolver answers.
+type Health struct {
+	Interval time.Duration
+
+	mu sync.Mutex
+	// selfAddr is a UDP listener address the server queries itself on.
+	selfAddr    string
+	listening   bool
+	zonesLoaded bool
+	warmingUp   bool
+	self        error
+	upstream    map[string]error
+}
+
+// SetListening records that the listeners are bound and starts the self
+// and upstream checks.
+func (h *Health) SetListening(selfAddr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listening, h.selfAddr = true, selfAddr
+	go h.run()
+}
+
+// upstreams returns the resolvers to probe; none means recursion isn't
+// needed for readiness.
+func (h *Health) upstreams() []*net.UDPAddr {
+	if cfg := currentConfig(); cfg != nil && cfg.resolver != nil {
+		return []*net.UDPAddr{cfg.resolver}
+	}
+	return nil
+}
+
+func (h *Health) SetZonesLoaded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.zonesLoaded = true
+}
+
+// SetWarmingUp records whether the caches are being warmed up.
+func (h *Health) SetWarmingUp(warming bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.warmingUp = warming
+}
+
+func (h *Health) run() {
+	for {
+		var self error
+		if h.selfAddr != "" {
+			self = h.checkSelf()
+		}
+		upstream := map[string]error{}
+		for _, addr := range h.upstreams() {
+			upstream[addr.String()] = h.checkUpstream(addr)
+		}
+		h.mu.Lock()
+		previous := h.upstream
+		h.self, h.upstream = self, upstream
+		h.mu.Unlock()
+		down, up := upstreamChanges(previous, upstream)
+		for _, addr := range down {
+			webhooks.Fire(eventUpstreamDown, addr, fmt.Sprintf("upstream %s stopped answering: %v", addr, upstream[addr]),
+				"upstream", addr, "error", upstream[addr].Error())
+		}
+		for _, addr := range up {
+			webhooks.Fire(eventUpstreamUp, addr, fmt.Sprintf("upstream %s answers again", addr), "upstream", addr)
+		}
+		time.Sleep(h.Interval)
+	}
+}
+
+func healthQuery(name string, qtype uint16) *Query {
+	return dnswire.NewQuery(name, qtype)
+}
+
+// checkSelf sends a query to the server's own listener. Any response, even
+// REFUSED, shows the query path works.
+func (h *Health) checkSelf() error {
+	host, port, err := net.SplitHostPort(h.selfAddr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(host, port), healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	q := healthQuery("", TypeSOA)
+	data, err := q.Encode()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	resp, err := dnswire.ParseLazy(buf[:n])
+	if err != nil {
+		return err
+	}
+	if resp.Header.ID != q.Header.ID || !resp.Header.QR {
+		return fmt.Errorf("unexpected response")
+	}
+	return nil
+}
+
+func (h *Health) checkUpstream(addr *net.UDPAddr) error {
+	resp, err := exchange(addr, healthQuery("", TypeNS))
+	if err != nil {
+		return err
+	}
+	if resp.Header.RCode != RCodeSuccess {
+		return fmt.Errorf("answered %s", dnswire.RCodeString(resp.Header.RCode))
+	}
+	return nil
+}
+
+// problems lists why the server isn't ready, if it isn't.
+func (h *Health) problems() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []string
+	if shutdown.Stopping() {
+		return []string{"shutting down"}
+	}
+	if !h.listening {
+		out = append(out, "listeners not bound yet")
+	}
+	if !h.zonesLoaded {
+		out = append(out, "zones not loaded yet")
+	}
+	if h.warmingUp {
+		out = append(out, "warming up the caches")
+	}
+	if !h.listening {
+		return out
+	}
+	if h.upstream == nil {
+		return append(out, "checks not run yet")
+	}
+	if h.self != nil {
+		out = append(out, fmt.Sprintf("self query: %v", h.self))
+	}
+	if len(h.upstreams()) > 0 {
+		var failed []string
+		for addr, err := range h.upstream {
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("upstream %s: %v", addr, err))
+			}
+		}
+		if len(failed) == len(h.upstream) {
+			sort.Strings(failed)
+			out = append(out, failed...)
+		}
+	}
+	return out
+}
+
+// Register adds /healthz and /readyz to mux.
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if problems := h.problems(); len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,748 @@
+package dnsserver
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// The import subcommand converts a BIND named.conf or an unbound.conf into
+// a -config file:
+//
+//	dns-server import -out-dir /etc/dns-server named.conf > dns-server.conf
+//
+// It carries over served zones, forwarders, listen addresses, ACLs, TSIG
+// keys and response policy zones. RPZ zones and unbound's blocking
+// local-zones become domain lists in -out-dir, loaded as blocklists and
+// allowlists. Whatever has no equivalent is kept as a "# not imported:"
+// comment, so nothing is dropped silently.
+
+type importer struct {
+	outDir  string
+	dir     string // base of relative paths in the source
+	lines   []string
+	skipped int
+
+	acls     map[string][]string // named BIND address match lists
+	allow    map[Capability][]string
+	deny     map[Capability][]string
+	resolver string
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "Format of the file: bind or unbound (default: unbound if the file name contains it, else bind)")
+	outDir := fs.String("out-dir", ".", "Directory to write the domain lists converted from RPZ zones and local-zones to")
+	output := fs.String("o", "", "Write the configuration to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server import [flags] named.conf|unbound.conf")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = "bind"
+		if strings.Contains(strings.ToLower(filepath.Base(path)), "unbound") {
+			*format = "unbound"
+		}
+	}
+
+	imp := &importer{
+		outDir: *outDir,
+		acls:   map[string][]string{},
+		allow:  map[Capability][]string{},
+		deny:   map[Capability][]string{},
+	}
+	var err error
+	switch *format {
+	case "bind", "named":
+		err = imp.bind(path)
+	case "unbound":
+		err = imp.unbound(path)
+	default:
+		return fmt.Errorf("import: unknown format %q, want bind or unbound", *format)
+	}
+	if err != nil {
+		return fmt.Errorf("import: %v", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	fmt.Fprintf(w, "# Imported from %s by dns-server import.\n", path)
+	for _, line := range imp.finish() {
+		fmt.Fprintln(w, line)
+	}
+	if imp.skipped > 0 {
+		fmt.Fprintf(os.Stderr, "import: %d constructs not imported, see the \"# not imported\" comments\n", imp.skipped)
+	}
+	return nil
+}
+
+func (imp *importer) set(name, value string) {
+	imp.lines = append(imp.lines, name+" "+value)
+}
+
+func (imp *importer) skip(format string, args ...any) {
+	imp.lines = append(imp.lines, "# not imported: "+fmt.Sprintf(format, args...))
+	imp.skipped++
+}
+
+// path resolves a file named in the source against its directory option.
+func (imp *importer) path(p string) string {
+	if imp.dir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(imp.dir, p)
+}
+
+// forwarder takes the first upstream as -resolver; the server has one.
+func (imp *importer) forwarder(addr string) {
+	if imp.resolver != "" {
+		imp.skip("forwarder %s (only the first, %s, is used)", addr, imp.resolver)
+		return
+	}
+	imp.resolver = addr
+	imp.set("resolver", addr)
+}
+
+// finish appends the ACLs, which both formats build up piecemeal.
+func (imp *importer) finish() []string {
+	for _, c := range server.Capabilities {
+		if list := slices.Compact(imp.allow[c]); len(list) > 0 {
+			imp.set("allow-"+string(c), strings.Join(list, ","))
+		}
+		if list := slices.Compact(imp.deny[c]); len(list) > 0 {
+			imp.set("deny-"+string(c), strings.Join(list, ","))
+		}
+	}
+	return imp.lines
+}
+
+// writeList writes names to a domain list in the output directory.
+func (imp *importer) writeList(name string, names []string) (string, error) {
+	if err := os.MkdirAll(imp.outDir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(imp.outDir, name+".list")
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s, converted by dns-server import\n", name)
+	for _, n := range names {
+		b.WriteString(n + "\n")
+	}
+	return path, os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// rpz converts a response policy zone to a blocklist and an allowlist.
+// Rules answering NXDOMAIN, NODATA or dropping block their name and
+// everything below it; passthru rules allow it. Other actions, and the
+// IP and nameserver triggers, have no equivalent.
+func (imp *importer) rpz(origin, file string) error {
+	data, err := os.ReadFile(imp.path(file))
+	if err != nil {
+		return err
+	}
+	lines, err := tokenizeZone(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	origin = normalizeName(origin)
+	zoneOrigin, owner := origin, origin
+	var blocked, allowed []string
+	other := 0
+	for _, l := range lines {
+		tokens := l.tokens
+		if strings.EqualFold(tokens[0], "$ORIGIN") && len(tokens) > 1 {
+			zoneOrigin = absName(tokens[1], origin)
+			continue
+		}
+		if strings.HasPrefix(tokens[0], "$") {
+			continue
+		}
+		if !l.blankOwner {
+			owner, tokens = absName(tokens[0], zoneOrigin), tokens[1:]
+		}
+		for len(tokens) > 0 && !isType(tokens[0]) {
+			tokens = tokens[1:] // TTL and class
+		}
+		if len(tokens) == 0 || owner == origin {
+			continue
+		}
+		name, ok := strings.CutSuffix(owner, "."+origin)
+		if !ok {
+			continue
+		}
+		if !strings.EqualFold(tokens[0], "CNAME") || len(tokens) < 2 || strings.Contains(name, ".rpz-") {
+			other++
+			continue
+		}
+		name = strings.TrimPrefix(name, "*.")
+		switch strings.ToLower(tokens[1]) {
+		case ".", "*.", "rpz-drop.":
+			blocked = append(blocked, name)
+		case "rpz-passthru.":
+			allowed = append(allowed, name)
+		default:
+			other++
+		}
+	}
+	slices.Sort(blocked)
+	slices.Sort(allowed)
+	if len(blocked) > 0 {
+		path, err := imp.writeList(origin, slices.Compact(blocked))
+		if err != nil {
+			return err
+		}
+		imp.set("blocklist", origin+"="+path)
+	}
+	if len(allowed) > 0 {
+		path, err := imp.writeList(origin+"-passthru", slices.Compact(allowed))
+		if err != nil {
+			return err
+		}
+		imp.set("allowlist", path)
+	}
+	if other > 0 {
+		imp.skip("%d rules of response policy zone %s with actions other than NXDOMAIN, NODATA, drop and passthru", other, origin)
+	}
+	return nil
+}
+
+// A bindStmt is a statement of named.conf: words, an optional block of
+// statements and the terminating semicolon.
+type bindStmt struct {
+	words []string
+	block []*bindStmt
+}
+
+func (s *bindStmt) String() string {
+	str := strings.Join(s.words, " ")
+	if s.block != nil {
+		str += " { ... }"
+	}
+	return str
+}
+
+// arg returns the i-th word, or "".
+func (s *bindStmt) arg(i int) string {
+	if i < len(s.words) {
+		return s.words[i]
+	}
+	return ""
+}
+
+// find returns the first statement of the block named name.
+func (s *bindStmt) find(name string) *bindStmt {
+	for _, c := range s.block {
+		if c.arg(0) == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func tokenizeBind(data string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(data[i:], "//"):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(data[i:], "/*"):
+			end := strings.Index(data[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += end + 4
+		case c == '"':
+			end := strings.IndexByte(data[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, data[i+1:i+1+end])
+			i += end + 2
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(data) && !strings.ContainsRune(" \t\r\n{};\"", rune(data[j])) {
+				j++
+			}
+			tokens = append(tokens, data[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseBind reads statements up to a closing brace or the end of tokens
+// and returns them with the tokens left.
+func parseBind(tokens []string, nested bool) ([]*bindStmt, []string, error) {
+	var stmts []*bindStmt
+	cur := &bindStmt{}
+	for len(tokens) > 0 {
+		tok := tokens[0]
+		tokens = tokens[1:]
+		switch tok {
+		case ";":
+			if len(cur.words) > 0 || cur.block != nil {
+				stmts = append(stmts, cur)
+			}
+			cur = &bindStmt{}
+		case "{":
+			block, rest, err := parseBind(tokens, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			if block == nil {
+				block = []*bindStmt{}
+			}
+			cur.block, tokens = block, rest
+		case "}":
+			if !nested {
+				return nil, nil, fmt.Errorf("unexpected }")
+			}
+			if len(cur.words) > 0 {
+				stmts = append(stmts, cur)
+			}
+			return stmts, tokens, nil
+		default:
+			cur.words = append(cur.words, tok)
+		}
+	}
+	if nested {
+		return nil, nil, fmt.Errorf("missing }")
+	}
+	if len(cur.words) > 0 {
+		return nil, nil, fmt.Errorf("missing ; after %s", cur)
+	}
+	return stmts, nil, nil
+}
+
+// readBind parses a named.conf, following include statements.
+func readBind(path string) ([]*bindStmt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := tokenizeBind(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	stmts, _, err := parseBind(tokens, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var all []*bindStmt
+	for _, s := range stmts {
+		if s.arg(0) != "include" {
+			all = append(all, s)
+			continue
+		}
+		included, err := readBind(s.arg(1))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, included...)
+	}
+	return all, nil
+}
+
+func (imp *importer) bind(path string) error {
+	stmts, err := readBind(path)
+	if err != nil {
+		return err
+	}
+	// ACLs may be used before they are defined, and the options say where
+	// zone files are and which zones are response policy zones.
+	rpzZones := map[string]bool{}
+	for _, s := range stmts {
+		switch s.arg(0) {
+		case "acl":
+			for _, e := range s.block {
+				imp.acls[s.arg(1)] = append(imp.acls[s.arg(1)], strings.Join(e.words, " "))
+			}
+		case "options":
+			if d := s.find("directory"); d != nil {
+				imp.dir = d.arg(1)
+			}
+			if rp := s.find("response-policy"); rp != nil {
+				for _, z := range rp.block {
+					if z.arg(0) == "zone" {
+						rpzZones[normalizeName(z.arg(1))] = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, s := range stmts {
+		switch s.arg(0) {
+		case "acl":
+		case "options":
+			imp.bindOptions(s)
+		case "key":
+			imp.bindKey(s)
+		case "zone":
+			if err := imp.bindZone(s, rpzZones); err != nil {
+				return err
+			}
+		default:
+			imp.skip("%s", s)
+		}
+	}
+	return nil
+}
+
+func (imp *importer) bindOptions(s *bindStmt) {
+	for _, o := range s.block {
+		switch o.arg(0) {
+		case "directory", "response-policy", "forward":
+		case "forwarders":
+			for _, f := range o.block {
+				addr := f.arg(0)
+				if f.arg(1) == "port" {
+					imp.forwarder(net.JoinHostPort(addr, f.arg(2)))
+				} else if net.ParseIP(addr) != nil {
+					imp.forwarder(net.JoinHostPort(addr, "53"))
+				} else {
+					imp.skip("forwarder %s", f)
+				}
+			}
+		case "allow-query", "allow-recursion", "allow-transfer", "allow-update":
+			imp.bindACL(Capability(strings.TrimPrefix(o.arg(0), "allow-")), o.block)
+		case "recursion":
+			if o.arg(1) == "no" {
+				imp.allow[CapRecursion] = []string{"none"}
+			}
+		case "listen-on", "listen-on-v6":
+			port := "53"
+			if o.arg(1) == "port" {
+				port = o.arg(2)
+			}
+			for _, a := range o.block {
+				addr := a.arg(0)
+				switch {
+				case addr == "any" && o.arg(0) == "listen-on":
+					addr = "0.0.0.0"
+				case addr == "any":
+					addr = "::"
+				case net.ParseIP(addr) == nil:
+					imp.skip("%s address %s", o.arg(0), a)
+					continue
+				}
+				imp.set("listen", net.JoinHostPort(addr, port))
+			}
+		default:
+			imp.skip("option %s", o)
+		}
+	}
+}
+
+// bindACL adds an address match list to the ACLs of a capability. The
+// server checks the deny list first rather than taking the first match,
+// which comes to the same for the usual lists of negated exceptions
+// followed by what is allowed.
+func (imp *importer) bindACL(c Capability, elems []*bindStmt) {
+	var expand func(elem string, negated bool, depth int)
+	expand = func(elem string, negated bool, depth int) {
+		if rest, ok := strings.CutPrefix(elem, "!"); ok {
+			elem, negated = strings.TrimSpace(rest), !negated
+		}
+		add := func(v string) {
+			if negated {
+				imp.deny[c] = append(imp.deny[c], v)
+			} else {
+				imp.allow[c] = append(imp.allow[c], v)
+			}
+		}
+		switch {
+		case elem == "any" || elem == "none" || elem == "localhost":
+			add(elem)
+		case elem == "localnets":
+			add("private")
+			imp.skip("localnets in allow-%s, taken as private networks", c)
+		case imp.acls[elem] != nil && depth < 8:
+			for _, e := range imp.acls[elem] {
+				expand(e, negated, depth+1)
+			}
+		default:
+			if strings.HasPrefix(elem, "key ") {
+				imp.skip("key %s in allow-%s, see -require-auth", strings.TrimPrefix(elem, "key "), c)
+				return
+			}
+			if _, err := server.ParseNetworks(elem); err != nil {
+				imp.skip("%q in allow-%s", elem, c)
+				return
+			}
+			add(elem)
+		}
+	}
+	for _, e := range elems {
+		if e.block != nil {
+			imp.skip("nested address match list in allow-%s", c)
+			continue
+		}
+		expand(strings.Join(e.words, " "), false, 0)
+	}
+}
+
+func (imp *importer) bindKey(s *bindStmt) {
+	alg, secret := "", ""
+	if a := s.find("algorithm"); a != nil {
+		alg = strings.ToLower(a.arg(1))
+	}
+	if sec := s.find("secret"); sec != nil {
+		secret = sec.arg(1)
+	}
+	if _, ok := tsigAlgorithms[alg]; !ok || secret == "" {
+		imp.skip("key %s with algorithm %q", s.arg(1), alg)
+		return
+	}
+	imp.set("tsig-key", alg+":"+s.arg(1)+":"+secret)
+}
+
+func (imp *importer) bindZone(s *bindStmt, rpzZones map[string]bool) error {
+	name := normalizeName(s.arg(1))
+	typ, file := "", ""
+	if t := s.find("type"); t != nil {
+		typ = t.arg(1)
+	}
+	if f := s.find("file"); f != nil {
+		file = f.arg(1)
+	}
+	switch {
+	case typ == "hint":
+		// The server forwards instead of resolving from the root.
+		return nil
+	case (typ == "master" || typ == "primary") && file != "":
+		if rpzZones[name] {
+			return imp.rpz(name, file)
+		}
+		imp.set("zone", name+"="+imp.path(file))
+	default:
+		imp.skip("zone %s of type %s", fqdn(name), typ)
+		return nil
+	}
+	for _, o := range s.block {
+		switch o.arg(0) {
+		case "type", "file", "notify":
+		default:
+			imp.skip("zone %s option %s", fqdn(name), o)
+		}
+	}
+	return nil
+}
+
+// An unboundOption is a "name: value" line of unbound.conf, under the
+// clause it belongs to.
+type unboundOption struct {
+	clause, name, value string
+}
+
+func readUnbound(path string) ([]unboundOption, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var opts []unboundOption
+	clause := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// A # starts a comment only at the start of a word, as in
+		// forward-addr: 192.0.2.1@853#dns.example.
+		for i := 0; i < len(line); i++ {
+			if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') && strings.Count(line[:i], "\"")%2 == 0 {
+				line = line[:i]
+				break
+			}
+		}
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case name == "include":
+			included, err := readUnbound(strings.Trim(value, "\""))
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, included...)
+		case value == "":
+			clause = name
+			opts = append(opts, unboundOption{clause: clause})
+		default:
+			opts = append(opts, unboundOption{clause, name, value})
+		}
+	}
+	return opts, scanner.Err()
+}
+
+func (imp *importer) unbound(path string) error {
+	opts, err := readUnbound(path)
+	if err != nil {
+		return err
+	}
+	// unbound only answers localhost unless access-control says otherwise.
+	imp.allow[CapRecursion] = []string{"localhost"}
+	var interfaces []string
+	port := "53"
+	var blocked, allowed []string
+
+	// Clauses other than server: are handled once all their options are
+	// read; zone is what they have gathered so far.
+	type zone struct {
+		clause, name, file string
+		addrs              []string
+		tls                bool
+	}
+	var zones []*zone
+	for _, o := range opts {
+		if o.name == "" {
+			if o.clause != "server" {
+				zones = append(zones, &zone{clause: o.clause})
+			}
+			continue
+		}
+		value := strings.Trim(o.value, "\"")
+		if o.clause == "" {
+			imp.skip("%s: %s outside a clause", o.name, o.value)
+			continue
+		}
+		if o.clause != "server" {
+			z := zones[len(zones)-1]
+			switch {
+			case o.name == "name":
+				z.name = value
+			case o.name == "zonefile":
+				z.file = value
+			case o.clause == "forward-zone" && o.name == "forward-addr" && z.name == ".":
+				z.addrs = append(z.addrs, value)
+			case o.clause == "forward-zone" && o.name == "forward-tls-upstream":
+				z.tls = value == "yes"
+			default:
+				imp.skip("%s: %s", strings.Join(strings.Fields(o.clause+" "+z.name+" "+o.name), " "), o.value)
+			}
+			continue
+		}
+
+		fields := strings.Fields(o.value)
+		switch o.name {
+		case "interface":
+			interfaces = append(interfaces, value)
+		case "port":
+			port = value
+		case "directory":
+			imp.dir = value
+		case "access-control":
+			if len(fields) != 2 {
+				imp.skip("access-control: %s", o.value)
+				continue
+			}
+			switch fields[1] {
+			case "allow", "allow_snoop", "allow_setrd":
+				imp.allow[CapRecursion] = append(imp.allow[CapRecursion], fields[0])
+			case "deny", "refuse":
+				imp.deny[CapQuery] = append(imp.deny[CapQuery], fields[0])
+			default:
+				imp.skip("access-control: %s", o.value)
+			}
+		case "local-zone":
+			if len(fields) != 2 {
+				imp.skip("local-zone: %s", o.value)
+				continue
+			}
+			name := normalizeName(strings.Trim(fields[0], "\""))
+			switch fields[1] {
+			case "always_nxdomain", "always_refuse", "refuse", "deny", "static", "always_null":
+				blocked = append(blocked, name)
+			case "always_transparent", "transparent", "typetransparent":
+				allowed = append(allowed, name)
+			default:
+				imp.skip("local-zone: %s", o.value)
+			}
+		default:
+			imp.skip("server %s: %s", o.name, o.value)
+		}
+	}
+
+	for _, ifc := range interfaces {
+		host, p, ok := strings.Cut(ifc, "@")
+		if !ok {
+			p = port
+		}
+		if net.ParseIP(host) == nil {
+			imp.skip("interface %s", ifc)
+			continue
+		}
+		imp.set("listen", net.JoinHostPort(host, p))
+	}
+	for _, z := range zones {
+		name := normalizeName(z.name)
+		switch {
+		case z.clause == "forward-zone" && z.name == ".":
+			for _, a := range z.addrs {
+				// Upstreams are asked over plain DNS.
+				addr, authName, _ := strings.Cut(a, "#")
+				host, p, ok := strings.Cut(addr, "@")
+				if !ok {
+					p = "53"
+				}
+				if z.tls || authName != "" {
+					imp.skip("DNS over TLS forwarder %s", a)
+					continue
+				}
+				imp.forwarder(net.JoinHostPort(host, p))
+			}
+		case z.clause == "auth-zone" && z.file != "":
+			imp.set("zone", name+"="+imp.path(z.file))
+		case z.clause == "rpz" && z.file != "":
+			if err := imp.rpz(name, z.file); err != nil {
+				return err
+			}
+		case z.name != "":
+			imp.skip("%s %s", z.clause, fqdn(name))
+		}
+	}
+	if len(blocked) > 0 {
+		path, err := imp.writeList("local-zones", blocked)
+		if err != nil {
+			return err
+		}
+		imp.set("blocklist", "local-zones="+path)
+	}
+	if len(allowed) > 0 {
+		path, err := imp.writeList("local-zones-transparent", allowed)
+		if err != nil {
+			return err
+		}
+		imp.set("allowlist", path)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package dnsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var algorithmNames = map[uint8]string{
+	AlgRSASHA256:       "RSASHA256",
+	AlgRSASHA512:       "RSASHA512",
+	AlgECDSAP256SHA256: "ECDSAP256SHA256",
+	AlgECDSAP384SHA384: "ECDSAP384SHA384",
+	AlgED25519:         "ED25519",
+}
+
+func parseAlgorithm(s string) (uint8, error) {
+	for alg, name := range algorithmNames {
+		if strings.EqualFold(s, name) || s == fmt.Sprint(alg) {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported algorithm %q", s)
+}
+
+func GenerateSigningKey(alg uint8, ksk bool, bits int) (*SigningKey, error) {
+	flags := DNSKEYFlagZone
+	if ksk {
+		flags |= DNSKEYFlagSEP
+	}
+	k := &SigningKey{DNSKEY: &DNSKEY{Flags: flags, Protocol: 3, Algorithm: alg}}
+
+	switch alg {
+	case AlgRSASHA256, AlgRSASHA512:
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, err
+		}
+		exp := big.NewInt(int64(priv.E)).Bytes()
+		k.DNSKEY.PublicKey = append([]byte{byte(len(exp))}, exp...)
+		k.DNSKEY.PublicKey = append(k.DNSKEY.PublicKey, priv.N.Bytes()...)
+		k.Private = priv
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		curve := elliptic.P256()
+		if alg == AlgECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		size := curve.Params().BitSize / 8
+		k.DNSKEY.PublicKey = append(priv.X.FillBytes(make([]byte, size)), priv.Y.FillBytes(make([]byte, size))...)
+		k.Private = priv
+	case AlgED25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k.DNSKEY.PublicKey = pub
+		k.Private = priv
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %d", alg)
+	}
+	return k, nil
+}
+
+func keyBaseName(dir, zone string, k *SigningKey) string {
+	return filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", fqdn(normalizeName(zone)), k.DNSKEY.Algorithm, k.DNSKEY.KeyTag()))
+}
+
+// WriteKeyPair stores k as BIND compatible .key and .private files.
+func WriteKeyPair(dir, zone string, k *SigningKey) (string, error) {
+	base := keyBaseName(dir, zone, k)
+	kind := "zone-signing"
+	if k.IsKSK() {
+		kind = "key-signing"
+	}
+	pub := fmt.Sprintf("; This is a %s key, keyid %d, for %s\n%s IN DNSKEY %d %d %d %s\n",
+		kind, k.DNSKEY.KeyTag(), fqdn(zone), fqdn(zone),
+		k.DNSKEY.Flags, k.DNSKEY.Protocol, k.DNSKEY.Algorithm,
+		base64.StdEncoding.EncodeToString(k.DNSKEY.PublicKey))
+	if err := os.WriteFile(base+".key", []byte(pub), 0o644); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Private-key-format: v1.3\nAlgorithm: %d (%s)\n", k.DNSKEY.Algorithm, algorithmNames[k.DNSKEY.Algorithm])
+	field := func(name string, v []byte) {
+		fmt.Fprintf(&b, "%s: %s\n", name, base64.StdEncoding.EncodeToString(v))
+	}
+	switch priv := k.Private.(type) {
+	case *rsa.PrivateKey:
+		priv.Precompute()
+		field("Modulus", priv.N.Bytes())
+		field("PublicExponent", big.NewInt(int64(priv.E)).Bytes())
+		field("PrivateExponent", priv.D.Bytes())
+		field("Prime1", priv.Primes[0].Bytes())
+		field("Prime2", priv.Primes[1].Bytes())
+		field("Exponent1", priv.Precomputed.Dp.Bytes())
+		field("Exponent2", priv.Precomputed.Dq.Bytes())
+		field("Coefficient", priv.Precomputed.Qinv.Bytes())
+	case *ecdsa.PrivateKey:
+		field("PrivateKey", priv.D.FillBytes(make([]byte, priv.Curve.Params().BitSize/8)))
+	case ed25519.PrivateKey:
+		field("PrivateKey", priv.Seed())
+	}
+	for _, name := range []string{"Created", "Publish", "Activate", "Inactive", "Delete"} {
+		if t := k.timings()[name]; !t.IsZero() {
+			fmt.Fprintf(&b, "%s: %s\n", name, t.UTC().Format(keyTimeFormat))
+		}
+	}
+	if err := os.WriteFile(base+".private", []byte(b.String()), 0o600); err != nil {
+		return "", err
+	}
+	return base, nil
+}
+
+func dsString(zone string, k *SigningKey) (string, error) {
+	ds, err := k.DNSKEY.ToDS(zone, DigestSHA256)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s IN DS %d %d %d %s", fqdn(zone), ds.KeyTag, ds.Algorithm, ds.DigestType,
+		strings.ToUpper(hex.EncodeToString(ds.Digest))), nil
+}
+
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	zone := fs.String("zone", "", "Zone the key is for")
+	dir := fs.String("dir", ".", "Directory to write the key pair to")
+	algName := fs.String("alg", "ECDSAP256SHA256", "Algorithm name or number")
+	bits := fs.Int("bits", 2048, "Key size for RSA algorithms")
+	ksk := fs.Bool("ksk", false, "Generate a key-signing key (sets the SEP flag)")
+	fs.Parse(args)
+
+	if *zone == "" {
+		return fmt.Errorf("keygen: -zone is required")
+	}
+	alg, err := parseAlgorithm(*algName)
+	if err != nil {
+		return err
+	}
+	k, err := GenerateSigningKey(alg, *ksk, *bits)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	k.Created, k.Publish, k.Activate = now, now, now
+
+	base, err := WriteKeyPair(*dir, *zone, k)
+	if err != nil {
+		return err
+	}
+	fmt.Println(filepath.Base(base))
+	if *ksk {
+		ds, err := dsString(*zone, k)
+		if err != nil {
+			return err
+		}
+		fmt.Println(ds)
+	}
+	return nil
+}
+
+func runDS(args []string) error {
+	fs := flag.NewFlagSet("ds", flag.ExitOnError)
+	zone := fs.String("zone", "", "Zone to print DS records for")
+	dir := fs.String("dir", ".", "Directory holding the zone's keys")
+	fs.Parse(args)
+
+	if *zone == "" {
+		return fmt.Errorf("ds: -zone is required")
+	}
+	keys, err := LoadSigningKeys(*dir, *zone)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, k := range keys {
+		if !k.IsKSK() || !k.Published(now) {
+			continue
+		}
+		ds, err := dsString(*zone, k)
+		if err != nil {
+			return err
+		}
+		fmt.Println(ds)
+	}
+	return nil
+}
+
+// runRollover schedules a successor for the zone's current ZSK (pre-publish
+// method) or KSK (double-signature method). With -lifetime it only acts
+// when the current key is older than that, so it can run from cron.
+func runRollover(args []string) error {
+	fs := flag.NewFlagSet("rollover", flag.ExitOnError)
+	zone := fs.String("zone", "", "Zone to roll a key for")
+	dir := fs.String("dir", ".", "Directory holding the zone's keys")
+	kind := fs.String("type", "zsk", "Which key to roll: zsk or ksk")
+	delay := fs.Duration("delay", 7*24*time.Hour, "Propagation delay: how long the old and new keys overlap")
+	lifetime := fs.Duration("lifetime", 0, "Only roll when the active key has been in use for longer than this")
+	fs.Parse(args)
+
+	if *zone == "" {
+		return fmt.Errorf("rollover: -zone is required")
+	}
+	if *kind != "zsk" && *kind != "ksk" {
+		return fmt.Errorf("rollover: -type must be zsk or ksk")
+	}
+	keys, err := LoadSigningKeys(*dir, *zone)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var current *SigningKey
+	for _, k := range keys {
+		if k.IsKSK() != (*kind == "ksk") {
+			continue
+		}
+		if !k.Inactive.IsZero() {
+			if k.Inactive.After(now) {
+				fmt.Printf("a %s rollover is already in progress for %s\n", *kind, fqdn(*zone))
+				return nil
+			}
+			continue
+		}
+		if k.Active(now) {
+			current = k
+		}
+	}
+	if current == nil {
+		return fmt.Errorf("rollover: no active %s for %s", *kind, fqdn(*zone))
+	}
+	since := current.Activate
+	if since.IsZero() {
+		since = current.Created
+	}
+	if *lifetime > 0 && !since.IsZero() && now.Sub(since) < *lifetime {
+		return nil
+	}
+
+	next, err := GenerateSigningKey(current.DNSKEY.Algorithm, *kind == "ksk", rsaBits(current))
+	if err != nil {
+		return err
+	}
+	next.Created, next.Publish = now, now
+	if *kind == "zsk" {
+		// Pre-publish: the new key is visible for a full delay before it
+		// signs, and the old key stays published until its signatures
+		// have aged out of caches.
+		next.Activate = now.Add(*delay)
+		current.Inactive = next.Activate
+		current.Delete = current.Inactive.Add(*delay)
+	} else {
+		// Double signature: both keys sign the DNSKEY set until the parent
+		// has switched to the new DS and the old one has expired.
+		next.Activate = now
+		current.Inactive = now.Add(*delay)
+		current.Delete = current.Inactive
+	}
+
+	if _, err := WriteKeyPair(*dir, *zone, current); err != nil {
+		return err
+	}
+	base, err := WriteKeyPair(*dir, *zone, next)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s published, active from %s; key %d retires at %s\n",
+		filepath.Base(base), next.Activate.Format(time.RFC3339), current.DNSKEY.KeyTag(), current.Inactive.Format(time.RFC3339))
+	if *kind == "ksk" {
+		ds, err := dsString(*zone, next)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("submit the new DS to the parent before %s:\n%s\n", current.Inactive.Format(time.RFC3339), ds)
+	}
+	return nil
+}
+
+func rsaBits(k *SigningKey) int {
+	if priv, ok := k.Private.(*rsa.PrivateKey); ok {
+		return priv.N.BitLen()
+	}
+	return 2048
+}
@@ -0,0 +1,29 @@
+package dnsserver
+
+// latencyBuckets are the histogram bounds for DNS response times, in
+// seconds.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+var (
+	upstreamLatency = NewHistogramVec("dns_upstream_response_seconds", "Time upstream servers took to answer.", latencyBuckets, "upstream")
+	zoneLatency     = NewHistogramVec("dns_query_duration_seconds", "Time taken to answer queries, by the served zone or -latency-zone suffix they fall under.", latencyBuckets, "zone")
+)
+
+// latencyZone returns the zone label for a query for name: the closest
+// enclosing served zone or suffix, or "other". Suffixes keep the number of
+// labels bounded for names answered from upstream.
+func latencyZone(name string, zones *ZoneSet, suffixes []string) string {
+	best, found := "", false
+	if z := zones.Find(name); z != nil {
+		best, found = z.Origin, true
+	}
+	for _, s := range suffixes {
+		if inZone(name, s) && (!found || len(s) > len(best)) {
+			best, found = s, true
+		}
+	}
+	if !found {
+		return "other"
+	}
+	return fqdn(best)
+}
@@ -0,0 +1,55 @@
+package dnsserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// loadTLSConfig loads the server certificate and, if clientCA is set, the
+// CAs client certificates are verified against.
+func loadTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCA)
+		}
+	}
+	return cfg, nil
+}
+
+// listenerTLSConfig returns the TLS configuration for l, asking for client
+// certificates as configured.
+func listenerTLSConfig(base *tls.Config, l *server.ListenerSpec) (*tls.Config, error) {
+	if base == nil {
+		return nil, fmt.Errorf("%s://%s needs -tls-cert and -tls-key", l.Transport, l.Addr)
+	}
+	cfg := base.Clone()
+	switch l.ClientCert {
+	case "request":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if l.ClientCert != "" && cfg.ClientCAs == nil {
+		return nil, fmt.Errorf("%s://%s: client-cert needs -tls-client-ca", l.Transport, l.Addr)
+	}
+	if l.Transport == "https" {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		cfg.NextProtos = []string{"dot"}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,85 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Local records answer the queries that reach the end of the chain, which
+// are those for names outside the served zones when there is no -resolver:
+//
+//	-local-record router.lan=192.168.1.1
+//	-local-record 'nas.lan=192.168.1.10,fd00::10?ttl=3600'
+//	-local-ttl 300
+//
+// Names without local records are answered NXDOMAIN, and names with only
+// records of other types with no answers.
+
+type LocalRecords struct {
+	// TTL is the TTL of records not given one of their own.
+	TTL   uint32
+	names map[string][]*ResourceRecord
+}
+
+// Add adds the records of a -local-record value, name=addresses?ttl=N.
+func (l *LocalRecords) Add(spec string) error {
+	name, rest, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid -local-record %q: want name=addresses", spec)
+	}
+	addrs, params, _ := strings.Cut(rest, "?")
+	ttl := l.TTL
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return fmt.Errorf("invalid -local-record %q: %v", spec, err)
+	}
+	for key := range values {
+		if key != "ttl" {
+			return fmt.Errorf("invalid -local-record %q: unknown option %q", spec, key)
+		}
+		n, err := strconv.ParseUint(values.Get(key), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid -local-record %q: invalid ttl: %v", spec, err)
+		}
+		ttl = uint32(n)
+	}
+	name = normalizeName(name)
+	for _, a := range strings.Split(addrs, ",") {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip == nil {
+			return fmt.Errorf("invalid -local-record %q: invalid address %q", spec, a)
+		}
+		rr := &ResourceRecord{Name: fqdn(name), Type: TypeAAAA, Class: ClassINET, TTL: ttl, RData: ip.To16()}
+		if ip4 := ip.To4(); ip4 != nil {
+			rr.Type, rr.RData = TypeA, ip4
+		}
+		if l.names == nil {
+			l.names = map[string][]*ResourceRecord{}
+		}
+		l.names[name] = append(l.names[name], rr)
+	}
+	return nil
+}
+
+// Answer answers m from the local records.
+func (l *LocalRecords) Answer(m *Message) *Query {
+	resp := new(Query).SetReply(m)
+	for _, q := range m.Questions {
+		records, ok := l.names[normalizeName(q.Name)]
+		if !ok {
+			resp.Header.RCode = RCodeNameError
+			continue
+		}
+		for _, rr := range records {
+			if q.QClass == ClassINET && (q.QType == rr.Type || q.QType == TypeANY) {
+				answer := *rr
+				answer.Name = q.Name
+				resp.AddAnswer(&answer)
+			}
+		}
+	}
+	return resp
+}
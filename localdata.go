@@ -0,0 +1,135 @@
+package dnsserver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Local data and local zones override names the way unbound's local-data
+// and local-zone do, without a zone file, before the cache and forwarding:
+//
+//	local-data: "printer.lan A 192.168.1.50"
+//	local-data: 'printer.lan 600 TXT "second floor"'
+//	local-zone: "example.com refuse"
+//	local-zone: "lan static"
+//
+// Local data is a record in zone file syntax. A local zone applies to the
+// names at and below it, the longest one matching, and is one of:
+//
+//	transparent         answer from local data, NODATA for names with
+//	                    local data of other types, forward other names
+//	typetransparent     like transparent, but forward other types too
+//	static              answer from local data, NXDOMAIN or NODATA otherwise
+//	redirect            answer every name from the zone's own local data
+//	refuse, deny        answer from local data, otherwise REFUSED or drop
+//	always_transparent  ignore local data and forward
+//	always_refuse       REFUSED even with local data
+//	always_nxdomain     NXDOMAIN even with local data
+//
+// Names with local data outside any local zone are transparent.
+
+var localZoneTypes = []string{"transparent", "typetransparent", "static", "redirect", "refuse", "deny",
+	"always_transparent", "always_refuse", "always_nxdomain"}
+
+type LocalData struct {
+	records map[string][]*ResourceRecord
+	zones   map[string]string
+}
+
+// unquote strips the quotes unbound configurations put around values.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// AddData adds the record of a -local-data value.
+func (l *LocalData) AddData(spec string) error {
+	records, err := ParseZone(strings.NewReader(unquote(spec)), ".")
+	if err != nil {
+		return fmt.Errorf("invalid -local-data %q: %v", spec, err)
+	}
+	if len(records) != 1 {
+		return fmt.Errorf("invalid -local-data %q: want one record", spec)
+	}
+	rr := records[0]
+	if l.records == nil {
+		l.records = map[string][]*ResourceRecord{}
+	}
+	l.records[rr.Name] = append(l.records[rr.Name], rr)
+	return nil
+}
+
+// AddZone adds a -local-zone value, the zone and its type.
+func (l *LocalData) AddZone(spec string) error {
+	fields := strings.Fields(unquote(spec))
+	if len(fields) != 2 || !slices.Contains(localZoneTypes, fields[1]) {
+		return fmt.Errorf("invalid -local-zone %q: want a zone and one of %s", spec, strings.Join(localZoneTypes, ", "))
+	}
+	if l.zones == nil {
+		l.zones = map[string]string{}
+	}
+	l.zones[normalizeName(fields[0])] = fields[1]
+	return nil
+}
+
+// zone returns the local zone name falls in and its type.
+func (l *LocalData) zone(name string) (string, string) {
+	for zone := name; ; {
+		if kind, ok := l.zones[zone]; ok {
+			return zone, kind
+		}
+		if zone == "" {
+			return "", "transparent"
+		}
+		_, zone, _ = strings.Cut(zone, ".")
+	}
+}
+
+// Answer answers m from the local data, or returns false if m is to be
+// resolved as usual. A nil response with true means m is dropped.
+func (l *LocalData) Answer(m *Message) (*Query, bool) {
+	if l == nil || len(l.records)+len(l.zones) == 0 || len(m.Questions) != 1 || m.Questions[0].QClass != ClassINET {
+		return nil, false
+	}
+	q := m.Questions[0]
+	name := normalizeName(q.Name)
+	zone, kind := l.zone(name)
+	switch kind {
+	case "always_transparent":
+		return nil, false
+	case "always_refuse":
+		return refusedResponse(m), true
+	case "always_nxdomain":
+		return errorResponse(m, RCodeNameError), true
+	}
+
+	records, exists := l.records[name]
+	if kind == "redirect" {
+		records, exists = l.records[zone]
+	}
+	resp := new(Query).SetReply(m)
+	resp.Header.AA, resp.Header.RA = true, true
+	for _, rr := range records {
+		if rr.Type == q.QType || rr.Type == TypeCNAME || q.QType == TypeANY {
+			answer := *rr
+			answer.Name = q.Name
+			resp.AddAnswer(&answer)
+		}
+	}
+	switch {
+	case len(resp.Answers) > 0 || exists && kind != "typetransparent":
+		return resp, true
+	case kind == "static" || kind == "redirect":
+		resp.Header.RCode = RCodeNameError
+		return resp, true
+	case kind == "refuse":
+		return refusedResponse(m), true
+	case kind == "deny":
+		return nil, true
+	}
+	return nil, false
+}
@@ -0,0 +1,145 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// Every component logs through its own logger, which tags records with
+// the component name. The output handler and the levels are set once at
+// startup by setupLogging; loggers created before that, like the package
+// level ones below, pick the settings up because they look them up for
+// each record. The levels can be changed later with setLogLevels.
+
+var (
+	logOutput slog.Handler = slog.NewTextHandler(io.Discard, nil)
+	logLevels atomic.Pointer[logLevelSet]
+)
+
+type logLevelSet struct {
+	level      slog.Level
+	components map[string]slog.Level
+	// spec is the string the levels were set from.
+	spec string
+}
+
+func init() {
+	logLevels.Store(&logLevelSet{level: slog.LevelInfo, spec: "info"})
+}
+
+var (
+	logServer      = newLogger("server")
+	logListener    = newLogger("listener")
+	logUpstream    = newLogger("upstream")
+	logDnstap      = newLogger("dnstap")
+	logTracing     = newLogger("tracing")
+	logPush        = newLogger("push")
+	logWebhook     = newLogger("webhook")
+	logBlocklist   = newLogger("blocklist")
+	logFirewall    = newLogger("firewall")
+	logScript      = newLogger("script")
+	logQueryLog    = newLogger("querylog")
+	logSlowQuery   = newLogger("slowquery")
+	logRateLimit   = newLogger("ratelimit")
+	logRRL         = newLogger("rrl")
+	logDNSSEC      = newLogger("dnssec")
+	logTrustAnchor = newLogger("trustanchor")
+	logSandbox     = newLogger("sandbox")
+	logAudit       = newLogger("audit")
+	logACME        = newLogger("acme")
+	logAnycast     = newLogger("anycast")
+)
+
+// setupLogging configures where and how much is logged. levels is a
+// default level optionally followed by per-component ones, for example
+// "warn,rrl=debug". It must be called before anything is logged.
+func setupLogging(w io.Writer, format, levels string) error {
+	if err := setLogLevels(levels); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case "text":
+		logOutput = slog.NewTextHandler(w, opts)
+	case "json":
+		logOutput = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, want text or json", format)
+	}
+	return nil
+}
+
+// setLogLevels replaces the levels set so far, in the format setupLogging
+// takes.
+func setLogLevels(levels string) error {
+	set := &logLevelSet{level: slog.LevelInfo, components: map[string]slog.Level{}, spec: levels}
+	for _, item := range strings.Split(levels, ",") {
+		component, name, ok := strings.Cut(item, "=")
+		if !ok {
+			component, name = "", item
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+			return fmt.Errorf("invalid log level %q", item)
+		}
+		if component == "" {
+			set.level = level
+		} else {
+			set.components[strings.TrimSpace(component)] = level
+		}
+	}
+	logLevels.Store(set)
+	return nil
+}
+
+func newLogger(component string) *slog.Logger {
+	return slog.New(&logHandler{component: component})
+}
+
+// logHandler applies the component's level and forwards records to the
+// configured output.
+type logHandler struct {
+	component string
+	// debug logs every level, for queries with the debug-log feature.
+	debug bool
+	// wrap holds the WithAttrs and WithGroup calls made on the logger, to
+	// be replayed on the output handler.
+	wrap []func(slog.Handler) slog.Handler
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if h.debug {
+		return true
+	}
+	set := logLevels.Load()
+	min, ok := set.components[h.component]
+	if !ok {
+		min = set.level
+	}
+	return level >= min
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := logOutput.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	for _, wrap := range h.wrap {
+		out = wrap(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *logHandler) with(wrap func(slog.Handler) slog.Handler) *logHandler {
+	return &logHandler{component: h.component, debug: h.debug, wrap: append(h.wrap[:len(h.wrap):len(h.wrap)], wrap)}
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
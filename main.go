@@ -1,552 +1,929 @@
-package main
+// Package dnsserver is the dns-server program: its flags, subcommands and
+// the stages it answers queries with. cmd/dns-server runs it; the message
+// codec and the server it is built on are the dnswire and server
+// packages.
+package dnsserver
 
 import (
-	"encoding/binary"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
-)
-
-type Query struct {
-	Header    Header
-	Questions []*Question
-	Answers   []*ResourceRecord
-}
+	"syscall"
+	"time"
 
-func (q *Query) Encode() []byte {
-	buf := []byte{}
-	headerBytes := q.Header.Encode()
-	buf = append(buf, headerBytes...)
+	"github.com/bibektamang7/dns-server/cache"
+	"github.com/bibektamang7/dns-server/metrics"
+	"github.com/bibektamang7/dns-server/server"
+)
 
-	offsetMap := map[string]int{}
+// listFlag collects the values of a flag that may be given more than once.
+type listFlag []string
 
-	for _, question := range q.Questions {
-		question.Encode(&buf, offsetMap)
-	}
-	for _, ans := range q.Answers {
-		ans.Encode(&buf, offsetMap)
-	}
-	return buf
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
 }
 
-type ResourceRecord struct {
-	Name  string
-	Type  uint16
-	Class uint16
-	TTL   uint32
-	RData []byte
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
 
-func (rr *ResourceRecord) Encode(buf *[]byte, offsetMap map[string]int) {
-	encodeName(rr.Name, buf, offsetMap)
-
-	tmp := make([]byte, 10)
-	binary.BigEndian.PutUint16(tmp[0:2], rr.Type)
-	binary.BigEndian.PutUint16(tmp[2:4], rr.Class)
-	binary.BigEndian.PutUint32(tmp[4:8], rr.TTL)
-	binary.BigEndian.PutUint16(tmp[8:10], uint16(len(rr.RData)))
-
-	*buf = append(*buf, tmp...)
-	*buf = append(*buf, rr.RData...)
+// loadZones loads the zones specs name, signing those with keys in
+// keyDir. Their background work waits for ZoneSet.Start.
+func loadZones(specs []string, keyDir string, newSigner func([]*SigningKey) *ZoneSigner) (*ZoneSet, error) {
+	zones := NewZoneSet()
+	zones.keyDir = keyDir
+	for _, spec := range specs {
+		origin, source, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -zone %q, want origin=path", spec)
+		}
+		z, err := loadZoneSource(origin, source)
+		if err != nil {
+			return nil, err
+		}
+		if keyDir != "" {
+			keys, err := LoadSigningKeys(keyDir, z.Origin)
+			if err != nil {
+				return nil, err
+			}
+			if len(keys) > 0 {
+				z.SetSigner(newSigner(keys))
+			}
+		}
+		zones.Add(z)
+	}
+	return zones, nil
 }
 
-type Encoder interface {
-	Encode() []byte
+func newBlocker(mode BlockMode, sinkholeV4, sinkholeV6 string, lists, allowlists, groups, clients []string) (*Blocker, error) {
+	switch mode {
+	case BlockNXDomain, BlockNull:
+	case BlockSinkhole:
+		if sinkholeV4 == "" && sinkholeV6 == "" {
+			return nil, fmt.Errorf("-block-mode sinkhole needs -sinkhole-ipv4 or -sinkhole-ipv6")
+		}
+	default:
+		return nil, fmt.Errorf("invalid -block-mode %q", mode)
+	}
+	b := NewBlocker(mode)
+	for _, addr := range []struct {
+		flag string
+		s    string
+		ip   *net.IP
+	}{{"-sinkhole-ipv4", sinkholeV4, &b.SinkholeV4}, {"-sinkhole-ipv6", sinkholeV6, &b.SinkholeV6}} {
+		if addr.s == "" {
+			continue
+		}
+		if *addr.ip = net.ParseIP(addr.s); *addr.ip == nil {
+			return nil, fmt.Errorf("invalid %s %q", addr.flag, addr.s)
+		}
+	}
+	for _, spec := range lists {
+		name, source, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -blocklist %q, want name=source", spec)
+		}
+		if err := b.AddList(name, source); err != nil {
+			return nil, err
+		}
+	}
+	for _, source := range allowlists {
+		b.AddAllowlist(source)
+	}
+	for _, spec := range groups {
+		name, names, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -block-group %q, want group=list1,list2", spec)
+		}
+		if err := b.AddGroup(name, strings.Split(names, ",")); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range clients {
+		networks, group, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -block-client %q, want networks=group", spec)
+		}
+		if err := b.AssignClients(networks, group); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
 }
 
-type Question struct {
-	Name   string
-	QType  uint16
-	QClass uint16
+var subcommands = map[string]func(args []string) error{
+	"keygen":       runKeygen,
+	"ds":           runDS,
+	"rollover":     runRollover,
+	"stats":        runStats,
+	"ctl":          runCtl,
+	"console":      runConsole,
+	"replay":       runReplay,
+	"compare":      runCompare,
+	"bench":        runBench,
+	"query":        runQuery,
+	"import":       runImport,
+	"update":       runUpdate,
+	"service":      runService,
+	"verify-audit": runVerifyAudit,
 }
 
-func encodeName(name string, buf *[]byte, offsetMap map[string]int) {
-	if name == "" {
-		*buf = append(*buf, 0)
-		return
-	}
-
-	labels := strings.Split(name, ".")
-	for i := 0; i < len(labels); i++ {
-		suffix := strings.Join(labels[i:], ".")
-		if pos, ok := offsetMap[suffix]; ok {
-			pointer := 0xC000 | pos
-			p := make([]byte, 2)
-			binary.BigEndian.PutUint16(p, uint16(pointer))
-			*buf = append(*buf, p...)
+// Main runs dns-server with the process's arguments, serving until it is
+// told to stop, or runs the subcommand they name.
+func Main() {
+	// doctor takes the server's flags, so unlike the other subcommands it
+	// runs once they are parsed.
+	args := os.Args[1:]
+	doctorMode := len(args) > 0 && args[0] == "doctor"
+	if doctorMode {
+		args = args[1:]
+	} else if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 			return
 		}
-
-		offsetMap[suffix] = len(*buf)
-		label := labels[i]
-
-		*buf = append(*buf, byte(len(label)))
-		*buf = append(*buf, []byte(label)...)
 	}
 
-	*buf = append(*buf, 0)
-}
-
-func (q *Question) Encode(buf *[]byte, offsetMap map[string]int) {
-
-	encodeName(q.Name, buf, offsetMap)
-
-	qType := make([]byte, 2)
-	qClass := make([]byte, 2)
-
-	binary.BigEndian.PutUint16(qType, q.QType)
-	binary.BigEndian.PutUint16(qClass, q.QClass)
-
-	*buf = append(*buf, qType...)
-	*buf = append(*buf, qClass...)
-
-}
-
-type Header struct {
-	ID      uint16
-	QR      bool
-	Opcode  uint8
-	AA      bool
-	TC      bool
-	RD      bool
-	RA      bool
-	Z       uint8
-	RCode   uint8
-	QDCount uint16
-	ANCount uint16
-	NSCount uint16
-	ARCount uint16
-}
+	logLevel := flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error, optionally followed by per-component levels like rrl=debug")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	windowsServiceName := flag.String("windows-service", "", "Run under the Windows service control manager as this service; set by the service install subcommand")
+	configPath := flag.String("config", "", "Read settings from this file, one flag per line without the dash; SIGHUP reloads zones, the resolver, ACLs, listener ACLs, blocklists and TLS certificates from it")
+	var rf reloadableFlags
+	rf.register(flag.CommandLine)
+	trustAnchorFile := flag.String("trust-anchors", "", "File with additional DS/DNSKEY trust anchors")
+	padBlock := flag.Int("edns-padding", 468, "Pad responses over TLS and HTTPS to queries with the EDNS padding option to a multiple of this many bytes (0 disables)")
+	dnssecValidate := flag.Bool("dnssec-validate", false, "Validate DNSSEC on forwarded answers, fetching DNSKEY and DS records through -resolver: bogus answers get SERVFAIL, secure ones AD for clients asking with AD or DO")
+	trustAnchorState := flag.String("trust-anchor-state", "", "File to persist RFC 5011 trust anchor state in")
+	signMode := flag.String("dnssec-sign", "load", "When to sign served zones: load or online")
+	sigValidity := flag.Duration("dnssec-validity", 14*24*time.Hour, "Validity period of generated RRSIGs")
+	sigRefresh := flag.Duration("dnssec-refresh", 5*24*time.Hour, "Re-sign RRsets whose signatures expire within this window")
+	sigJitter := flag.Duration("dnssec-jitter", 12*time.Hour, "Random amount subtracted from signature expiry to spread re-signing")
+	useNSEC3 := flag.Bool("nsec3", false, "Use NSEC3 instead of NSEC for authenticated denial of existence")
+	nsec3Iterations := flag.Uint("nsec3-iterations", 0, "Additional NSEC3 hash iterations (RFC 9276 recommends 0)")
+	nsec3Salt := flag.String("nsec3-salt", "", "NSEC3 salt in hex (RFC 9276 recommends none)")
+	nsec3OptOut := flag.Bool("nsec3-optout", false, "Leave insecure delegations out of the NSEC3 chain")
+	publishCDS := flag.Bool("cds", false, "Publish CDS/CDNSKEY records for the key-signing keys the parent should have DS records for")
+	parentPoll := flag.Duration("parent-poll", 0, "Check the parent's DS records through -resolver this often and withdraw CDS/CDNSKEY once they match (0 disables)")
+	whiteLies := flag.Bool("dnssec-white-lies", false, "Synthesize minimally covering NSEC/NSEC3 records per query to prevent zone walking")
+	rrlRate := flag.Int("rrl-responses-per-second", 0, "Limit identical authoritative responses per client network (0 disables RRL)")
+	rrlNXRate := flag.Int("rrl-nxdomains-per-second", -1, "RRL limit for NXDOMAIN responses (default: same as responses)")
+	rrlErrRate := flag.Int("rrl-errors-per-second", -1, "RRL limit for error responses (default: same as responses)")
+	rrlWindow := flag.Duration("rrl-window", 15*time.Second, "How long RRL remembers over-limit clients")
+	rrlSlipEvery := flag.Int("rrl-slip", 2, "Send every Nth rate limited response truncated instead of dropping it (0 never)")
+	rrlV4Prefix := flag.Int("rrl-ipv4-prefix", 24, "Prefix length grouping IPv4 clients for RRL")
+	rrlV6Prefix := flag.Int("rrl-ipv6-prefix", 56, "Prefix length grouping IPv6 clients for RRL")
+	rrlLogOnly := flag.Bool("rrl-log-only", false, "Only log what RRL would limit")
+	rlQPS := flag.Float64("ratelimit-qps", 0, "Queries per second allowed from a single client address (0 disables)")
+	rlBurst := flag.Int("ratelimit-burst", 0, "Burst size for the per-client limit (default: one second's worth)")
+	rlPrefixQPS := flag.Float64("ratelimit-prefix-qps", 0, "Queries per second allowed from a client network (0 disables)")
+	rlPrefixBurst := flag.Int("ratelimit-prefix-burst", 0, "Burst size for the per-network limit (default: one second's worth)")
+	rlV4Prefix := flag.Int("ratelimit-ipv4-prefix", 24, "Prefix length grouping IPv4 clients for the per-network limit")
+	rlV6Prefix := flag.Int("ratelimit-ipv6-prefix", 56, "Prefix length grouping IPv6 clients for the per-network limit")
+	rlAction := flag.String("ratelimit-action", "refuse", "What to do with over-limit queries: refuse or drop")
+	maxInFlight := flag.Int("max-in-flight", 1024, "Most queries answered at once; more are shed by -overload-policy (0 for no limit)")
+	overloadPolicy := flag.String("overload-policy", "drop", "What to do with queries over -max-in-flight: drop or refuse")
+	rcvBuf := flag.Int("rcvbuf", 0, "Kernel receive buffer size (SO_RCVBUF) of listening sockets in bytes, unless set per listener with rcvbuf= (0 keeps the OS default)")
+	sndBuf := flag.Int("sndbuf", 0, "Kernel send buffer size (SO_SNDBUF) of listening sockets in bytes, unless set per listener with sndbuf= (0 keeps the OS default)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address, e.g. 127.0.0.1:9153")
+	var webhookSpecs listFlag
+	flag.Var(&webhookSpecs, "webhook", "POST operational events to this URL, optionally only some, as upstream-down,servfail-spike=https://... (repeatable); events: "+strings.Join(webhookEvents, ", "))
+	webhookTemplate := flag.String("webhook-template", "", "File with a text/template for webhook payloads, executed on .Event, .Time, .Host, .Subject, .Message and .Details; json encodes a value")
+	servfailAlertRatio := flag.Float64("servfail-alert-ratio", 0.2, "Fire servfail-spike when at least this fraction of responses in a minute are SERVFAIL")
+	dgaNXDomain := flag.Int("dga-alert-nxdomain", 0, "Flag clients that get at least this many NXDOMAIN answers in a minute for random looking names, as malware generating domain names does (0 disables)")
+	dgaRatio := flag.Float64("dga-alert-ratio", 0.5, "Fraction of a client's queries in the minute the NXDOMAIN answers must be for -dga-alert-nxdomain")
+	dgaEntropy := flag.Float64("dga-alert-entropy", 3.0, "Mean Shannon entropy, in bits per character, above which the names of -dga-alert-nxdomain look random")
+	statsdAddr := flag.String("statsd-addr", "", "Push metrics to this statsd server over UDP, e.g. 127.0.0.1:8125")
+	graphiteAddr := flag.String("graphite-addr", "", "Push metrics to this graphite server's plaintext port, e.g. 127.0.0.1:2003")
+	metricsPrefix := flag.String("metrics-prefix", "dns", "Prefix of the metric paths pushed to statsd and graphite")
+	metricsPushInterval := flag.Duration("metrics-push-interval", 10*time.Second, "How often to push metrics to statsd and graphite")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "How long to wait for in-flight queries and connections on SIGTERM or SIGINT")
+	healthAddr := flag.String("health-addr", "", "Serve /healthz and /readyz on this address; they are also served on -metrics-addr")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "How often readiness checks query the server itself and the resolver")
+	warmUpList := flag.String("warm-up", "", "File of names, each optionally followed by the types to query, to query at startup before reporting ready, warming up the caches")
+	warmUpConcurrency := flag.Int("warm-up-concurrency", 8, "Warm-up queries in flight at once")
+	warmUpTimeout := flag.Duration("warm-up-timeout", time.Minute, "How long readiness waits for the -warm-up queries")
+	var anycastPrefixes listFlag
+	flag.Var(&anycastPrefixes, "anycast-prefix", "Anycast prefix to announce while the server is ready and withdraw otherwise through -anycast-hook, e.g. 192.0.2.53/32 (repeatable)")
+	anycastHook := flag.String("anycast-hook", "", "Command run with announce or withdraw and the -anycast-prefix prefixes, or an http(s) URL POSTed them as JSON")
+	anycastHold := flag.Duration("anycast-hold", 30*time.Second, "How long the server must be ready before -anycast-prefix is announced")
+	anycastWithdrawWait := flag.Duration("anycast-withdraw-wait", 0, "How long to keep answering after withdrawing -anycast-prefix on shutdown or drain")
+	controlSocket := flag.String("control-socket", "", "Serve the control API used by the ctl and console subcommands on this unix socket, e.g. "+defaultControlSocket)
+	acmeAddr := flag.String("acme-addr", "", "Serve the acme-dns compatible API for DNS-01 challenges on this address, e.g. 127.0.0.1:8053")
+	acmeAccounts := flag.String("acme-accounts", "acme-accounts.json", "File holding the ACME API accounts; registrations are saved to it")
+	acmeDomain := flag.String("acme-domain", "", "Name in a served zone that accounts registered through the ACME API get names below (empty disables registration)")
+	acmeTTL := flag.Duration("acme-ttl", time.Minute, "TTL of ACME challenge records")
+	acmeLifetime := flag.Duration("acme-lifetime", time.Hour, "How long ACME challenge records are served before they are removed")
+	blockPageAddr := flag.String("block-page-addr", "", "Serve a page saying why a name is blocked over HTTP on this address, the -sinkhole-ipv4 or -sinkhole-ipv6 address with port 80")
+	blockPageTLSAddr := flag.String("block-page-tls-addr", "", "Serve the block page over HTTPS on this address, usually the sinkhole address with port 443; needs -block-page-ca-cert")
+	blockPageCACert := flag.String("block-page-ca-cert", "", "PEM file with the CA certificate signing the block page's certificates, which clients must trust")
+	blockPageCAKey := flag.String("block-page-ca-key", "", "PEM file with the key of -block-page-ca-cert")
+	blockPageTemplate := flag.String("block-page-template", "", "File with an html/template for the block page, executed on .Host, .List, .Group, .Client and .Time")
+	adminAddr := flag.String("admin-addr", "", "Serve pprof profiles, expvar variables, query statistics, the state of schedules, zone transactions and the resolver on this loopback address, e.g. 127.0.0.1:6060")
+	adminToken := flag.String("admin-token", "", "Bearer token every admin endpoint but GET /resolver requires")
+	adminTokenFile := flag.String("admin-token-file", "", "File holding -admin-token, which unlike the flag doesn't show in the process's arguments")
+	blocklistRefresh := flag.Duration("blocklist-refresh", 24*time.Hour, "How often to reload blocklists")
+	var rewriteSpecs listFlag
+	flag.Var(&rewriteSpecs, "rewrite", "Rewrite rule, e.g. \"name suffix staging.example example.com\" (repeatable)")
+	rewriteFile := flag.String("rewrite-file", "", "File with rewrite rules, one per line")
+	var firewallSpecs listFlag
+	flag.Var(&firewallSpecs, "firewall", "Firewall rule, e.g. \"deny type=ANY client=192.0.2.0/24\" (repeatable, checked in order)")
+	firewallFile := flag.String("firewall-file", "", "File with firewall rules, one per line")
+	scriptPath := flag.String("script", "", "Lua policy script whose query function is called for every query")
+	scriptTimeout := flag.Duration("script-timeout", 50*time.Millisecond, "How long the policy script may run per query")
+	cookies := flag.Bool("cookies", false, "Answer DNS cookies (RFC 7873) with server cookies")
+	requireCookies := flag.Bool("require-cookies", false, "Only count a valid server cookie, not an earlier TCP connection, as proof a UDP client isn't spoofed; implies -cookies")
+	maxUnverified := flag.Int("udp-unverified-max-size", 0, "Truncate UDP responses larger than this to clients that haven't recently used TCP or sent a valid cookie (0 disables)")
+	maxAnyTXT := flag.Int("udp-any-txt-max-size", 0, "Truncate UDP responses to ANY and TXT queries larger than this (0 disables)")
+	use0x20 := flag.Bool("0x20", false, "Randomize the letter case of names sent upstream and reject answers that don't echo it (needs case preserving upstreams)")
+	spoofLinger := flag.Duration("spoof-linger", 0, "Keep listening this long after an upstream answer to detect conflicting duplicate responses")
+	spoofAlert := flag.Int("spoof-alert-threshold", 0, "Log an alert when an upstream sends this many suspicious responses within a minute (0 disables)")
+	breakerRatio := flag.Float64("upstream-breaker-ratio", 0, "Stop querying the resolver for -upstream-breaker-cooldown once this fraction of at least -upstream-breaker-min-queries queries in 10 seconds failed, answering SERVFAIL at once (0 disables)")
+	breakerMin := flag.Int("upstream-breaker-min-queries", 20, "Queries in 10 seconds needed before -upstream-breaker-ratio applies")
+	breakerCooldown := flag.Duration("upstream-breaker-cooldown", 30*time.Second, "How long to stop querying a failing resolver before trying it again")
+	retryBudget := flag.Float64("upstream-retry-budget", 0, "Send timed out queries to the resolver again, as long as retries stay below this fraction of the queries sent (0 disables)")
+	fastForward := flag.Bool("fast-forward", false, "Relay single-question queries to -resolver as they are, with only the ID swapped, and its responses back without decoding and re-encoding them")
+	var chainSpecs listFlag
+	flag.Var(&chainSpecs, "chain", "Stages queries go through, in order, as stage,stage or for names at and below a zone as zone=stage,stage (repeatable); default "+strings.Join(defaultChain, ","))
+	strict := flag.Bool("strict", false, "Answer FORMERR to queries with anything unusual: several questions, answer records, trailing data")
+	var tsigKeys, sig0KeyFiles, authSpecs listFlag
+	flag.Var(&tsigKeys, "tsig-key", "TSIG key clients may sign with, as [algorithm:]name:base64secret (repeatable)")
+	var tsigKeyFiles listFlag
+	flag.Var(&tsigKeyFiles, "tsig-key-file", "File of TSIG keys in -tsig-key form, one per line, which unlike the flag don't show in the process's arguments (repeatable)")
+	flag.Var(&sig0KeyFiles, "sig0-keys", "File of KEY records whose owners may sign queries with SIG(0) (repeatable)")
+	flag.Var(&authSpecs, "require-auth", "Require TSIG or SIG(0) signed queries from these networks, optionally only by some keys, as networks[=key1,key2] (repeatable)")
+	var sandbox SandboxConfig
+	var landlockRead, landlockWrite listFlag
+	flag.StringVar(&sandbox.User, "user", "", "User to switch to after binding the listening sockets")
+	flag.StringVar(&sandbox.Group, "group", "", "Group to switch to after binding (default: the -user's primary group)")
+	flag.StringVar(&sandbox.Chroot, "chroot", "", "Directory to chroot into after binding; files read later, like blocklists, are looked up inside it")
+	flag.BoolVar(&sandbox.Seccomp, "seccomp", false, "Make syscalls the server never needs, like execve, ptrace and mount, fail (Linux)")
+	flag.BoolVar(&sandbox.Landlock, "landlock", false, "Restrict filesystem access to /etc, blocklist files, the trust anchor state, the query logs, the ACME accounts and -landlock-read/-landlock-write paths (Linux, needs CGO_ENABLED=0)")
+	flag.Var(&landlockRead, "landlock-read", "Path the server may read below when -landlock is set (repeatable)")
+	flag.Var(&landlockWrite, "landlock-write", "Path the server may write below when -landlock is set (repeatable)")
+	minimal := flag.Bool("minimal-responses", false, "Leave additional data out of authoritative answers unless it is required")
+	memoryBudget := flag.Int("memory-budget-mb", 0, "Shed load and evict caches as the process nears this much memory, in MiB (0 disables)")
+	wireCacheSize := flag.Int("wire-cache", 0, "Keep up to this many encoded authoritative responses to reuse for repeated questions (0 disables)")
+	cacheBackend := flag.String("cache-backend", "memory", "Where -wire-cache keeps its responses: memory, null, or a backend built in")
+	auditLogPath := flag.String("audit-log", "", "Append a record of every configuration and zone change, and who made it, to this file")
+	auditKeyPath := flag.String("audit-key", "", "Sign audit records with the HMAC key in this file, chaining each to the one before")
+	queryLogPath := flag.String("query-log", "", "Log every query to this file, or - for standard output")
+	queryLogFormat := flag.String("query-log-format", "text", "Query log format: text, json or csv")
+	queryLogMaxSize := flag.Int64("query-log-max-size", 100, "Rotate the query log once it reaches this many megabytes (0 disables rotation)")
+	queryLogKeep := flag.Int("query-log-keep", 5, "Number of rotated query logs to keep")
+	slowQueryThreshold := flag.Duration("slow-query-threshold", 0, "Log queries that take longer than this to answer, with the time spent in each stage (0 disables)")
+	var queryLogZones listFlag
+	dnstapTarget := flag.String("dnstap", "", "Send dnstap events for client and resolver traffic to unix:/path or tcp:host:port")
+	hostname, _ := os.Hostname()
+	dnstapIdentity := flag.String("dnstap-identity", hostname, "Identity sent with dnstap events")
+	nsid := flag.String("nsid", "", "Identify the server with this NSID (RFC 5001) to clients that ask, e.g. the host name or anycast site (empty disables)")
+	dnstapVersion := flag.String("dnstap-version", "dns-server", "Version sent with dnstap events")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "Export query traces to this OTLP/HTTP traces URL, e.g. http://127.0.0.1:4318/v1/traces")
+	traceSample := flag.Float64("trace-sample", 1, "Fraction of queries to trace")
+	traceService := flag.String("trace-service", "dns-server", "Service name reported with traces")
+	var latencyZones listFlag
+	flag.Var(&latencyZones, "latency-zone", "Break query latency metrics down by this suffix, in addition to the served zones (repeatable)")
+	var plugins listFlag
+	flag.Var(&plugins, "plugin", "Load zone backends and stages from this Go plugin (repeatable)")
+	flag.Var(&queryLogZones, "query-log-zone", "Only log queries at or below this name, or with a - prefix, don't log them (repeatable)")
+	var tenantSpecs listFlag
+	flag.Var(&tenantSpecs, "tenant", "Serve a tenant its own zones with a quota and query log, as name?listener=addr&key=k&cert-group=g&zones=a.example,b.example&qps=N&burst=N&query-log=path (repeatable)")
+	flag.CommandLine.Parse(args)
+	var configErr error
+	if *configPath != "" {
+		if configErr = applyConfigFile(flag.CommandLine, *configPath); configErr != nil && !doctorMode {
+			log.Fatal(configErr)
+		}
+	}
 
-func (h *Header) Encode() []byte {
-	var flags uint16
-	if h.QR {
-		flags |= 1 << 15
+	var logWriter io.Writer = os.Stderr
+	if *windowsServiceName != "" {
+		w, err := startWindowsService(*windowsServiceName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logWriter = w
+		log.SetOutput(w)
+		defer stopWindowsService()
 	}
-	flags |= (uint16(h.Opcode) & 0xF) << 11
-	if h.AA {
-		flags |= 1 << 10
+	if err := setupLogging(logWriter, *logFormat, *logLevel); err != nil {
+		log.Fatal(err)
 	}
-	if h.TC {
-		flags |= 1 << 9
+	for _, path := range plugins {
+		if err := loadPlugin(path); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if h.RD {
-		flags |= 1 << 8
+	if *auditLogPath != "" && !doctorMode {
+		var key []byte
+		var err error
+		if *auditKeyPath != "" {
+			if key, err = readAuditKey(*auditKeyPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if auditLog, err = openAuditLog(*auditLogPath, key); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *signMode != "load" && *signMode != "online" {
+		log.Fatalf("invalid -dnssec-sign %q", *signMode)
 	}
-	if h.RA {
-		flags |= 1 << 7
+	var nsec3 *NSEC3Params
+	if *useNSEC3 {
+		salt, err := hex.DecodeString(*nsec3Salt)
+		if err != nil || len(salt) > 255 {
+			log.Fatalf("invalid -nsec3-salt %q", *nsec3Salt)
+		}
+		if *nsec3Iterations > 100 {
+			log.Fatalf("-nsec3-iterations %d is too high, validators treat such zones as insecure", *nsec3Iterations)
+		}
+		nsec3 = &NSEC3Params{Iterations: uint16(*nsec3Iterations), Salt: salt, OptOut: *nsec3OptOut}
+	}
+	var rewriter *Rewriter
+	if len(rewriteSpecs) > 0 || *rewriteFile != "" {
+		rewriter = &Rewriter{}
+		for _, spec := range rewriteSpecs {
+			if err := rewriter.Add(spec); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *rewriteFile != "" {
+			if err := rewriter.LoadFile(*rewriteFile); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
-	flags |= (uint16(h.Z) & 0x7) << 4
-	flags |= (uint16(h.RCode) & 0xF)
 
-	buf := make([]byte, 12)
+	var firewall *Firewall
+	if len(firewallSpecs) > 0 || *firewallFile != "" {
+		firewall = &Firewall{}
+		for _, spec := range firewallSpecs {
+			if err := firewall.Add(spec); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *firewallFile != "" {
+			if err := firewall.LoadFile(*firewallFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
-	binary.BigEndian.PutUint16(buf[0:2], h.ID)
-	binary.BigEndian.PutUint16(buf[2:4], flags)
-	binary.BigEndian.PutUint16(buf[4:6], h.QDCount)
-	binary.BigEndian.PutUint16(buf[6:8], h.ANCount)
-	binary.BigEndian.PutUint16(buf[8:10], h.NSCount)
-	binary.BigEndian.PutUint16(buf[10:12], h.ARCount)
+	var script *ScriptHook
+	if *scriptPath != "" {
+		s, err := LoadScript(*scriptPath, *scriptTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		script = s
+	}
 
-	return buf
-}
+	var authenticator *Authenticator
+	if len(tsigKeys) > 0 || len(tsigKeyFiles) > 0 || len(sig0KeyFiles) > 0 || len(authSpecs) > 0 {
+		authenticator = NewAuthenticator()
+		for _, spec := range tsigKeys {
+			k, err := parseTSIGKey(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			authenticator.AddTSIGKey(k)
+		}
+		for _, path := range tsigKeyFiles {
+			keys, err := readTSIGKeys(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, k := range keys {
+				authenticator.AddTSIGKey(k)
+			}
+		}
+		for _, path := range sig0KeyFiles {
+			if err := authenticator.LoadSIG0Keys(path); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, spec := range authSpecs {
+			if err := authenticator.Require(spec); err != nil {
+				log.Fatalf("invalid -require-auth %q: %v", spec, err)
+			}
+		}
+	}
 
-type Message struct {
-	Header      *Header
-	Questions   []*Question
-	Answers     []*ResourceRecord
-	Authorities []*ResourceRecord
-	Additionals []*ResourceRecord
-}
+	if *rlAction != "refuse" && *rlAction != "drop" {
+		log.Fatalf("invalid -ratelimit-action %q", *rlAction)
+	}
+	var limiter *RateLimiter
+	if *rlQPS > 0 || *rlPrefixQPS > 0 {
+		limiter = NewRateLimiter(RateLimitConfig{
+			ClientQPS:   *rlQPS,
+			ClientBurst: *rlBurst,
+			PrefixQPS:   *rlPrefixQPS,
+			PrefixBurst: *rlPrefixBurst,
+			IPv4Prefix:  *rlV4Prefix,
+			IPv6Prefix:  *rlV6Prefix,
+			Refuse:      *rlAction == "refuse",
+		})
+	}
 
-func ParseMessage(data []byte) (*Message, error) {
-	h, err := parseHeader(data)
+	queryLimit, err := newQueryLimit(*maxInFlight, *overloadPolicy)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
-	p := &parser{data: data, off: 12}
-	m := &Message{Header: h}
 
-	for i := 0; i < int(h.QDCount); i++ {
-		q, err := p.readQuestion()
-		if err != nil {
-			return nil, err
+	newSigner := func(keys []*SigningKey, resolver *net.UDPAddr) *ZoneSigner {
+		return &ZoneSigner{
+			Keys:       keys,
+			Validity:   *sigValidity,
+			Refresh:    *sigRefresh,
+			Jitter:     *sigJitter,
+			Online:     *signMode == "online",
+			NSEC3:      nsec3,
+			WhiteLies:  *whiteLies,
+			PublishCDS: *publishCDS,
+			ParentPoll: *parentPoll,
+			Resolver:   resolver,
 		}
-		m.Questions = append(m.Questions, q)
+	}
+	if doctorMode {
+		var addrs []string
+		for _, addr := range []string{*adminAddr, *metricsAddr, *healthAddr, *acmeAddr, *blockPageAddr, *blockPageTLSAddr} {
+			if addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+		os.Exit(runDoctor(configErr, func() (*serverConfig, error) {
+			return rf.build(*minimal, newSigner)
+		}, addrs))
 	}
 
-	for i := 0; i < int(h.ANCount); i++ {
-		rr, err := p.readResourceRecord()
+	stats := NewStats()
+	if *adminAddr != "" {
+		token := *adminToken
+		if *adminTokenFile != "" {
+			if token != "" {
+				log.Fatal("-admin-token and -admin-token-file can't both be set")
+			}
+			var err error
+			if token, err = readAdminToken(*adminTokenFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		ln, err := listenAdmin(*adminAddr)
 		if err != nil {
-			return nil, err
+			log.Fatal(err)
 		}
-		m.Answers = append(m.Answers, rr)
+		go serveAdmin(ln, stats, firewall, token)
 	}
 
-	for i := 0; i < int(h.NSCount); i++ {
-		rr, err := p.readResourceRecord()
+	var pushers []*MetricsPusher
+	for _, push := range []struct{ protocol, addr string }{{"statsd", *statsdAddr}, {"graphite", *graphiteAddr}} {
+		if push.addr == "" {
+			continue
+		}
+		p, err := NewMetricsPusher(push.protocol, push.addr, *metricsPrefix, *metricsPushInterval)
 		if err != nil {
-			return nil, err
+			log.Fatal(err)
 		}
-		m.Authorities = append(m.Authorities, rr)
+		pushers = append(pushers, p)
+		go p.Run()
 	}
-	for i := 0; i < int(h.ARCount); i++ {
-		rr, err := p.readResourceRecord()
+
+	var servfails *ServfailMonitor
+	if len(webhookSpecs) > 0 {
+		w, err := NewWebhooks(webhookSpecs, *webhookTemplate)
 		if err != nil {
-			return nil, err
+			log.Fatal(err)
 		}
-		m.Additionals = append(m.Additionals, rr)
+		webhooks = w
+		servfails = &ServfailMonitor{Window: time.Minute, Ratio: *servfailAlertRatio, MinQueries: 20}
+		go servfails.Run()
 	}
-
-	return m, nil
-}
-
-type parser struct {
-	data []byte
-	off  int
-}
-
-func (p *parser) readByte() byte {
-	b := p.data[p.off]
-	p.off++
-	return b
-}
-
-func (p *parser) readUint16() uint16 {
-	v := binary.BigEndian.Uint16(p.data[p.off:])
-	p.off += 2
-	return v
-}
-
-func (p *parser) readUint32() uint32 {
-	v := binary.BigEndian.Uint32(p.data[p.off:])
-	p.off += 4
-	return v
-}
-
-func parseHeader(data []byte) (*Header, error) {
-	if len(data) < 12 {
-		return nil, fmt.Errorf("too short for DNS header")
-	}
-
-	h := &Header{}
-	h.ID = binary.BigEndian.Uint16(data[0:2])
-	flags := binary.BigEndian.Uint16(data[2:4])
-	h.QR = (flags>>15)&1 == 1
-	h.Opcode = uint8((flags >> 11) & 0xF)
-	h.AA = (flags>>10)&1 == 1
-	h.TC = (flags>>9)&1 == 1
-	h.RD = (flags>>8)&1 == 1
-	h.RA = (flags>>7)&1 == 1
-	h.Z = uint8((flags >> 4) & 0x7)
-	h.RCode = uint8(flags & 0xF)
-
-	h.QDCount = binary.BigEndian.Uint16(data[4:6])
-	h.ANCount = binary.BigEndian.Uint16(data[6:8])
-	h.NSCount = binary.BigEndian.Uint16(data[8:10])
-	h.ARCount = binary.BigEndian.Uint16(data[10:12])
-
-	return h, nil
-}
-
-func (p *parser) readQuestion() (*Question, error) {
-	name, err := p.readName()
-	if err != nil {
-		return nil, err
+	var dga *DGAMonitor
+	if *dgaNXDomain > 0 {
+		dga = &DGAMonitor{Window: time.Minute, MinNXDomain: *dgaNXDomain, Ratio: *dgaRatio, Entropy: *dgaEntropy}
+		go dga.Run()
 	}
 
-	return &Question{
-		Name:   name,
-		QType:  p.readUint16(),
-		QClass: p.readUint16(),
-	}, nil
-
-}
-
-func (p *parser) readResourceRecord() (*ResourceRecord, error) {
-	name, err := p.readName()
-	if err != nil {
-		return nil, err
+	health := &Health{Interval: *healthInterval}
+	var anycast *Anycast
+	if len(anycastPrefixes) > 0 {
+		prefixes, err := ParseAnycastPrefixes(anycastPrefixes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *anycastHook == "" {
+			log.Fatal("-anycast-prefix needs -anycast-hook")
+		}
+		if sandbox.Seccomp && !hookIsURL(*anycastHook) {
+			log.Fatal("-seccomp keeps the server from running the -anycast-hook command; give an http(s) URL or drop -seccomp")
+		}
+		anycast = &Anycast{Prefixes: prefixes, Hook: *anycastHook, Hold: *anycastHold, Wait: *anycastWithdrawWait, Health: health}
+		go anycast.Run()
 	}
-
-	rr := &ResourceRecord{
-		Name:  name,
-		Type:  p.readUint16(),
-		Class: p.readUint16(),
-		TTL:   p.readUint32(),
+	if *metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Default)
+			health.Register(mux)
+			log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+		}()
 	}
-
-	rdlen := p.readUint16()
-
-	if p.off+int(rdlen) > len(p.data) {
-		return nil, fmt.Errorf("truncated rdata")
+	if *healthAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			health.Register(mux)
+			log.Fatal(http.ListenAndServe(*healthAddr, mux))
+		}()
 	}
 
-	rr.RData = p.data[p.off : p.off+int(rdlen)]
-	p.off += int(rdlen)
-	return rr, nil
-}
+	if *use0x20 || *spoofLinger > 0 || *spoofAlert > 0 {
+		spoofDetector = &SpoofDetector{Use0x20: *use0x20, Linger: *spoofLinger, AlertThreshold: *spoofAlert}
+	}
 
-func (p *parser) readName() (string, error) {
-	return p.readNameWithJumps(make(map[int]bool))
-}
+	if *breakerRatio > 0 || *retryBudget > 0 {
+		upstreamBreakers = &UpstreamBreakers{Ratio: *breakerRatio, MinQueries: *breakerMin, Cooldown: *breakerCooldown, RetryBudget: *retryBudget}
+	}
 
-func (p *parser) readNameWithJumps(visited map[int]bool) (string, error) {
-	var labels []string
+	if *dnstapTarget != "" {
+		w, err := NewDnstapWriter(*dnstapTarget, *dnstapIdentity, *dnstapVersion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dnstapWriter = w
+	}
 
-	originalOff := p.off // for the sake of compression!
+	var tracer *Tracer
+	if *otlpEndpoint != "" {
+		tracer = NewTracer(*otlpEndpoint, *traceService, *traceSample)
+	}
 
-	jumped := false // track if we've followed a pointer
+	var guard *ReflectionGuard
+	if *cookies || *requireCookies || *maxUnverified > 0 || *maxAnyTXT > 0 {
+		guard = NewReflectionGuard()
+		guard.Cookies = *cookies || *requireCookies
+		guard.RequireCookie = *requireCookies
+		guard.MaxUnverified = *maxUnverified
+		guard.MaxAnyTXT = *maxAnyTXT
+	}
 
-	for {
-		if p.off >= len(p.data) {
-			return "", fmt.Errorf("name out of range")
+	var wireCache *WireCache
+	if *wireCacheSize > 0 {
+		store, err := cache.Open(*cacheBackend, *wireCacheSize)
+		if err != nil {
+			log.Fatal(err)
 		}
+		wireCache = NewWireCache(store)
+	}
+	if *memoryBudget > 0 {
+		budget := &MemoryBudget{Limit: uint64(*memoryBudget) << 20, Cache: wireCache, Queries: queryLimit}
+		go budget.run()
+	}
 
-		if visited[p.off] {
-			return "", fmt.Errorf("compression loop detected at offset %d", p.off)
+	var rrl *RRL
+	if *rrlRate > 0 {
+		if *rrlNXRate < 0 {
+			*rrlNXRate = *rrlRate
 		}
-		length := int(p.data[p.off])
-		p.off++
-
-		if length&0xC0 == 0xC0 {
-			if p.off >= len(p.data) {
-				return "", fmt.Errorf("truncated pointer")
-			}
-			ptr := ((length & 0x3F) << 8) | int(p.data[p.off])
-			p.off++
+		if *rrlErrRate < 0 {
+			*rrlErrRate = *rrlRate
+		}
+		rrl = NewRRL(RRLConfig{
+			ResponsesPerSecond: *rrlRate,
+			NXDomainsPerSecond: *rrlNXRate,
+			ErrorsPerSecond:    *rrlErrRate,
+			Window:             *rrlWindow,
+			Slip:               *rrlSlipEvery,
+			IPv4Prefix:         *rrlV4Prefix,
+			IPv6Prefix:         *rrlV6Prefix,
+			LogOnly:            *rrlLogOnly,
+		})
+	}
 
-			if ptr >= len(p.data) {
-				return "", fmt.Errorf("pointer out of range %d", ptr)
+	cfg, err := rf.build(*minimal, newSigner)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if firewall != nil {
+		for _, r := range firewall.Rules {
+			if _, err := cfg.schedules.Lookup(r.Schedule); err != nil {
+				log.Fatalf("firewall %q: %v", r.Spec, err)
 			}
+		}
+	}
+	liveConfig.Store(cfg)
+	cfg.zones.Start()
 
-			visited[originalOff] = true
+	var acme *ACME
+	if *acmeAddr != "" {
+		acme, err = NewACME(*acmeAccounts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		acme.Domain, acme.TTL, acme.Lifetime = normalizeName(*acmeDomain), uint32(acmeTTL.Seconds()), *acmeLifetime
+		acme.Zones = func() *ZoneSet { return currentConfig().zones }
+		if acme.Domain != "" && cfg.zones.Find(acme.Domain) == nil {
+			log.Fatalf("-acme-domain %s is not in a served zone", fqdn(acme.Domain))
+		}
+		ln, err := net.Listen("tcp", *acmeAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go acme.Serve(ln)
+		go acme.RunCleanup(min(*acmeLifetime, time.Minute))
+	}
 
-			sub := &parser{data: p.data, off: ptr}
-			name, err := sub.readNameWithJumps(visited)
-			if err != nil {
-				return "", err
+	if *blockPageAddr != "" || *blockPageTLSAddr != "" {
+		if *blockPageTLSAddr != "" && *blockPageCACert == "" {
+			log.Fatal("-block-page-tls-addr needs -block-page-ca-cert and -block-page-ca-key")
+		}
+		page, err := NewBlockPage(*blockPageTemplate, *blockPageCACert, *blockPageCAKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		page.Blocker = func() *Blocker { return currentConfig().blocker }
+		page.Profiles = func() *Profiles { return currentConfig().profiles }
+		if cfg.blocker == nil || cfg.blocker.Mode != BlockSinkhole {
+			logBlocklist.Warn("the block page is only reached by clients with -block-mode sinkhole")
+		}
+		var ln, tlsLn net.Listener
+		for _, l := range []struct {
+			addr string
+			ln   *net.Listener
+		}{{*blockPageAddr, &ln}, {*blockPageTLSAddr, &tlsLn}} {
+			if l.addr == "" {
+				continue
 			}
-
-			if name != "" {
-				labels = append(labels, name)
+			if *l.ln, err = net.Listen("tcp", l.addr); err != nil {
+				log.Fatal(err)
 			}
+		}
+		go page.Serve(ln, tlsLn)
+	}
 
-			if !jumped {
-				jumped = true // mark that we've followed a pointer
+	// reload reads the configuration again, on SIGHUP or through the
+	// control socket.
+	reload := func(actor string) error {
+		next, err := reloadFlags(*configPath)
+		prev := currentConfig()
+		var cfg *serverConfig
+		if err == nil {
+			cfg, err = next.build(*minimal, newSigner)
+		}
+		if err == nil && acme != nil {
+			acme.Apply(prev.zones, cfg.zones)
+		}
+		if err == nil {
+			err = prev.replace(cfg)
+		}
+		if err != nil {
+			logServer.Error("reloading configuration failed, keeping the current one", "err", err)
+			webhooks.Fire(eventReloadFailed, "", fmt.Sprintf("reloading the configuration failed: %v", err), "error", err.Error())
+			return err
+		}
+		logServer.Info("configuration reloaded", "zones", cfg.zones.Len())
+		if auditLog != nil {
+			auditLog.Record(auditRecord{Actor: actor, Action: "reload"})
+			auditSettings(actor, prev.settings, cfg.settings)
+			auditZones(actor, prev.zones, cfg.zones)
+		}
+		return nil
+	}
+	health.SetZonesLoaded()
+	go func() {
+		for range time.Tick(*blocklistRefresh) {
+			if b := currentConfig().blocker; b != nil {
+				b.Load()
 			}
-			break //compression pointer always terminates current label sequence
 		}
+	}()
 
-		if length > 63 {
-			return "", fmt.Errorf("label too long %d", length)
+	anchors, err := NewTrustAnchorStore(*trustAnchorState)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *trustAnchorFile != "" {
+		if err := anchors.LoadFile(*trustAnchorFile); err != nil {
+			log.Fatal(err)
 		}
-		if length == 0 {
-			break // terminator case
+	}
+	go anchors.RunRefresh(func() *net.UDPAddr { return currentConfig().resolver })
+
+	var queryLog *QueryLog
+	// queryLogFile is closed on shutdown. It stays nil when the log goes
+	// to stdout, which isn't the server's to close.
+	var queryLogFile io.Closer
+	if *queryLogPath != "" {
+		var queryLogOut io.Writer = os.Stdout
+		if *queryLogPath != "-" {
+			f, err := openRotatingFile(*queryLogPath, *queryLogMaxSize<<20, *queryLogKeep)
+			if err != nil {
+				log.Fatal(err)
+			}
+			queryLogOut, queryLogFile = f, f
 		}
-
-		if p.off+length > len(p.data) {
-			return "", fmt.Errorf("truncate label")
+		queryLog, err = NewQueryLog(queryLogOut, *queryLogFormat, queryLogZones)
+		if err != nil {
+			log.Fatal(err)
 		}
-		label := string(p.data[p.off : p.off+length])
-		p.off += length
-		labels = append(labels, label)
 	}
 
-	return strings.Join(labels, "."), nil
-
-}
-
-func answerQuestion(q *Question) *ResourceRecord {
-	return &ResourceRecord{
-		Name:  q.Name,
-		Type:  1,
-		Class: 1,
-		TTL:   60,
-		RData: []byte{8, 8, 8, 8},
+	var tenants *Tenants
+	if len(tenantSpecs) > 0 {
+		tenants = &Tenants{}
+		for _, spec := range tenantSpecs {
+			t, err := ParseTenant(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := tenants.Add(t, *queryLogFormat, *queryLogMaxSize<<20, *queryLogKeep); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
-}
 
-func main() {
-	fmt.Println("Logs from your program will appear here!")
-	addr := flag.String("resolver", "", "The address of DNS resolver to use")
+	var slowQueries *SlowQueryLog
+	if *slowQueryThreshold > 0 {
+		slowQueries = &SlowQueryLog{Threshold: *slowQueryThreshold}
+	}
 
-	flag.Parse()
+	latencySuffixes := make([]string, len(latencyZones))
+	for i, z := range latencyZones {
+		latencySuffixes[i] = normalizeName(z)
+	}
 
-	resAddr, err := net.ResolveUDPAddr("udp", *addr)
-	if err != nil {
-		fmt.Println("failed to resolve resolver address UDP")
-		return
+	var validator *Validator
+	if *dnssecValidate {
+		validator = &Validator{Anchors: anchors}
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		log.Fatal(err)
-		return
+	pipeline := &Pipeline{
+		Strict:          *strict,
+		FastForward:     *fastForward,
+		NSID:            []byte(*nsid),
+		PadBlock:        *padBlock,
+		Limiter:         limiter,
+		Authenticator:   authenticator,
+		Firewall:        firewall,
+		Script:          script,
+		Rewriter:        rewriter,
+		Guard:           guard,
+		RRL:             rrl,
+		WireCache:       wireCache,
+		QueryLog:        queryLog,
+		SlowQueries:     slowQueries,
+		Stats:           stats,
+		Servfails:       servfails,
+		DGA:             dga,
+		Validator:       validator,
+		Tenants:         tenants,
+		Tracer:          tracer,
+		LatencySuffixes: latencySuffixes,
 	}
-	udpConn, err := net.ListenUDP("upd", udpAddr)
-	if err != nil {
-		fmt.Println("Failed to bind to addresss: ", err)
-		return
+	if err := pipeline.Build(chainSpecs); err != nil {
+		log.Fatal(err)
 	}
-
-	defer udpConn.Close()
-
-	buf := make([]byte, 512)
-
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
+	srv := &Server{Handler: pipeline, Limit: queryLimit, Log: logServer}
+	if *controlSocket != "" {
+		ln, err := listenControl(*controlSocket)
 		if err != nil {
-			fmt.Println("Error receiving data:", err)
-			break
+			log.Fatal(err)
 		}
-		receivedData := string(buf[:size])
-		fmt.Printf("Received %d bytes from %s: %s\n", size, source, receivedData)
-
-		message, err := ParseMessage(buf[:size])
-		if err != nil {
-			fmt.Println("something went wrong parsing message, %w", err)
-		}
-
-		var responseCode uint8 = 0
-
-		if message.Header.Opcode != 0 {
-			responseCode = 4
-		}
-
-		if resAddr != nil && responseCode == 0 {
-			var allAnswers []*ResourceRecord
-
-			for _, question := range message.Questions {
-				singleQuery := Query{
-					Header: Header{
-						ID:      message.Header.ID,
-						QR:      false,
-						Opcode:  message.Header.Opcode,
-						AA:      false,
-						TC:      false,
-						RD:      message.Header.RD,
-						RA:      false,
-						Z:       0,
-						RCode:   0,
-						QDCount: 1,
-						ANCount: 0,
-						NSCount: 0,
-						ARCount: 0,
-					},
-					Questions: []*Question{question},
-					Answers:   []*ResourceRecord{},
-				}
-				quryData := singleQuery.Encode()
-
-				conn, err := net.DialUDP("udp", nil, resAddr)
-				if err != nil {
-					fmt.Println("failed to dial resolver")
+		control := &Control{Reload: reload, Stats: stats}
+		if wireCache != nil {
+			control.FlushCache = wireCache.Flush
+			control.CacheEntries = func(name string) []wireCacheEntry { return wireCache.Entries(name, time.Now()) }
+		}
+		control.Query = func(query []byte) ([]byte, error) { return srv.Exchange(query, controlClientInfo()) }
+		go control.Serve(ln)
+	}
+	for i, l := range cfg.listeners {
+		listener := &Listener{
+			Spec: l,
+			// Look the configuration up per query so reloaded ACLs and
+			// certificates are used.
+			Config: func() (*server.ListenerSpec, CertGroups) {
+				cfg := currentConfig()
+				return cfg.listeners[i], cfg.certGroups
+			},
+			Buffers: server.SocketBuffers{Read: cmp.Or(l.ReadBuffer, *rcvBuf), Write: cmp.Or(l.WriteBuffer, *sndBuf)},
+			Log:     logListener,
+		}
+		if l.Transport != "udp" {
+			listener.TLSConfig = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return currentConfig().tlsConfigs[i], nil
+			}}
+		}
+		srv.Listeners = append(srv.Listeners, listener)
+	}
+	// Everything is bound by the time Ready is called, so privileges can
+	// be dropped before the first packet is parsed.
+	srv.Ready = func(addrs []net.Addr) error {
+		if sandbox.enabled() {
+			if sandbox.Landlock {
+				sandbox.ReadPaths = append([]string{"/etc"}, landlockRead...)
+				// Everything a reload reads again.
+				sources := append([]string(nil), rf.allowlists...)
+				for _, specs := range []listFlag{rf.blocklists, rf.zones} {
+					for _, spec := range specs {
+						_, src, _ := strings.Cut(spec, "=")
+						sources = append(sources, src)
+					}
 				}
-
-				_, err = conn.Write(quryData)
-				if err != nil {
-					fmt.Println("unable to send query to resolver")
-					conn.Close()
-					continue
+				for _, path := range []string{*configPath, rf.keyDir, rf.tlsCert, rf.tlsKey, rf.tlsClientCA, rf.dhcpLeases} {
+					if path != "" {
+						sources = append(sources, path)
+					}
 				}
-
-				responseData := make([]byte, 512)
-				n, err := conn.Read(responseData)
-
-				conn.Close()
-				if err != nil {
-					fmt.Println("failed to read from connection")
-					continue
+				for _, src := range sources {
+					if !strings.Contains(src, "://") {
+						sandbox.ReadPaths = append(sandbox.ReadPaths, src)
+					}
 				}
-
-				ressolverResponse , err := ParseMessage(responseData[:n])
-				if err != nil {
-					fmt.Println("failed to parse messsage")
-					continue
+				accounts := ""
+				if acme != nil {
+					accounts = *acmeAccounts
 				}
-
-				allAnswers = append(allAnswers, ressolverResponse.Answers...)
-
+				sandbox.WritePaths = writePaths(landlockWrite, *queryLogPath, tenants, *trustAnchorState, accounts)
 			}
-
-			finalResponse := Query {
-				Header: Header{
-					ID: message.Header.ID,
-					QR: true,
-					Opcode: message.Header.Opcode,
-					AA: false,
-					TC: false, 
-					RD: message.Header.RD,
-					RA: true,
-					Z:0,
-					RCode: 0,
-					QDCount: uint16(len(message.Questions)),
-					ANCount: uint16(len(allAnswers)),
-					NSCount: 0,
-					ARCount: 0,
-				},
-				Questions: message.Questions,
-				Answers: allAnswers,
+			if err := sandbox.Apply(); err != nil {
+				return err
 			}
-			responseBytes := finalResponse.Encode()
-			_, err := udpConn.WriteToUDP(responseBytes, source)
-
-			if err != nil {
-				fmt.Println("failed to write response to source")
+		}
+		for i, l := range cfg.listeners {
+			if l.Transport == "udp" {
+				health.SetListening(addrs[i].String())
+				break
 			}
-			continue
 		}
+		return nil
+	}
 
-		header := Header{
-			ID:      message.Header.ID,
-			QR:      true,
-			Opcode:  message.Header.Opcode,
-			AA:      false,
-			TC:      false,
-			RD:      message.Header.RD,
-			RA:      false,
-			Z:       0,
-			RCode:   responseCode,
-			QDCount: uint16(len(message.Questions)),
-			ANCount: uint16(len(message.Questions)),
-			NSCount: 0,
-			ARCount: 0,
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			reload("SIGHUP")
 		}
-
-		// 	Name:  message.Questions[0].Name,
-		// 	Type:  1,
-		// 	Class: 1,
-		// 	TTL:   60,
-		// 	RData: []byte{8, 8, 8, 8},
-		// }
-		//
-		// question := Question{
-		// 	Name:   message.Questions[0].Name,
-		// 	QType:  1,
-		// 	QClass: 1,
-		// }
-
-		answers := []*ResourceRecord{}
-		for _, question := range message.Questions {
-			answer := answerQuestion(question)
-			answers = append(answers, answer)
+	}()
+	ctx, stop := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case sig := <-signals:
+			logServer.Info("shutting down", "signal", sig.String())
+		case <-shutdown.Requested():
+			logServer.Info("shutting down", "signal", "request")
 		}
-
-		query := Query{
-			Header:    header,
-			Questions: message.Questions,
-			Answers:   answers,
+		if anycast != nil {
+			anycast.Withdraw()
 		}
+		shutdown.Begin()
+		stop()
+	}()
 
-		response := query.Encode()
-
-		_, err = udpConn.WriteToUDP(response, source)
-
+	if *warmUpList != "" {
+		names, err := readWarmUpNames(*warmUpList)
 		if err != nil {
-			fmt.Println("Failed to send response: ", err)
+			log.Fatal(err)
 		}
+		w := &WarmUp{Names: names, Concurrency: *warmUpConcurrency, Timeout: *warmUpTimeout, Health: health}
+		w.Start(srv)
+	}
+	if err := srv.ListenAndServe(ctx); err != ErrServerClosed {
+		log.Fatal(err)
+	}
+	drainCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	if err := srv.Shutdown(drainCtx); err != nil {
+		logServer.Warn("gave up waiting for in-flight queries", "timeout", *shutdownTimeout)
+	}
+	cancel()
+
+	dnstapWriter.Flush(time.Second)
+	tracer.Flush()
+	for _, p := range pushers {
+		p.Push()
+	}
+	if queryLogFile != nil {
+		queryLogFile.Close()
+	}
+	if *controlSocket != "" {
+		os.Remove(*controlSocket)
 	}
+	logServer.Info("stopped")
 }
@@ -0,0 +1,71 @@
+package dnsserver
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+var memoryPressure = NewGauge("dns_memory_pressure", "Memory in use as a fraction of -memory-budget-mb.")
+
+const (
+	memoryCheckInterval = time.Second
+	// Above memoryHigh, caches are halved and half of the in-flight
+	// slots held back; above memoryCritical, caches are emptied and three
+	// quarters of the slots held back.
+	memoryHigh     = 0.8
+	memoryCritical = 1.0
+)
+
+// MemoryBudget watches the memory the process holds against a budget and
+// sheds load before the kernel kills it: it evicts caches and lowers the
+// number of queries answered at once. The budget is also the GC's soft
+// memory limit, so the collector runs harder as it nears it.
+type MemoryBudget struct {
+	Limit   uint64
+	Cache   *WireCache
+	Queries *QueryLimit
+
+	level int
+}
+
+func (b *MemoryBudget) run() {
+	debug.SetMemoryLimit(int64(b.Limit))
+	for range time.Tick(memoryCheckInterval) {
+		b.check()
+	}
+}
+
+func (b *MemoryBudget) check() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	used := stats.Sys - stats.HeapReleased
+	pressure := float64(used) / float64(b.Limit)
+	memoryPressure.Set(pressure)
+
+	level := 0
+	switch {
+	case pressure >= memoryCritical:
+		level = 2
+	case pressure >= memoryHigh:
+		level = 1
+	}
+	if level != b.level {
+		if level > b.level {
+			logServer.Warn("memory pressure rising, shedding load", "used_mb", used>>20, "budget_mb", b.Limit>>20)
+		} else {
+			logServer.Info("memory pressure easing", "used_mb", used>>20, "budget_mb", b.Limit>>20)
+		}
+		b.level = level
+	}
+	switch level {
+	case 2:
+		b.Cache.Shrink(1)
+		b.Queries.HoldBack(0.75)
+	case 1:
+		b.Cache.Shrink(0.5)
+		b.Queries.HoldBack(0.5)
+	default:
+		b.Queries.HoldBack(0)
+	}
+}
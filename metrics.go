@@ -0,0 +1,13 @@
+package dnsserver
+
+import "github.com/bibektamang7/dns-server/metrics"
+
+// The metrics registry lives in the metrics package, which the server
+// package registers with too. The server refers to it by these names.
+var (
+	NewCounter      = metrics.NewCounter
+	NewCounterVec   = metrics.NewCounterVec
+	NewGauge        = metrics.NewGauge
+	NewGaugeVec     = metrics.NewGaugeVec
+	NewHistogramVec = metrics.NewHistogramVec
+)
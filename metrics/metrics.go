@@ -0,0 +1,349 @@
+// Package metrics is a minimal metrics registry exposed in the Prometheus
+// text format. The New functions register what they create with Default.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	write(w io.Writer)
+	// samples reports the current values, for the push exporters.
+	samples(add func(Sample))
+}
+
+// Sample is one value of a metric, as the push exporters send it. Labels
+// alternates label names and values.
+type Sample struct {
+	Name    string
+	Labels  []string
+	Value   float64
+	Counter bool
+}
+
+// Registry holds metrics and writes them out.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry the New functions register with.
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	list := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range list {
+		m.write(w)
+	}
+}
+
+func (r *Registry) Samples() []Sample {
+	r.mu.Lock()
+	list := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	var out []Sample
+	for _, m := range list {
+		m.samples(func(s Sample) { out = append(out, s) })
+	}
+	return out
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WritePrometheus(w)
+}
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n uint64)  { c.v.Add(n) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+func (g *Gauge) Add(d float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*Counter
+	// labelValues holds the label values behind each key of values.
+	labelValues map[string][]string
+}
+
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{name: name, help: help, labels: labels, values: map[string]*Counter{}, labelValues: map[string][]string{}}
+	Default.register(v)
+	return v
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	key := labelString(v.labels, values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.values[key]
+	if !ok {
+		c = &Counter{}
+		v.values[key] = c
+		v.labelValues[key] = values
+	}
+	return c
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, key, v.values[key].Value())
+	}
+}
+
+func (v *CounterVec) samples(add func(Sample)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		add(Sample{v.name, labelPairs(v.labels, v.labelValues[key]), float64(v.values[key].Value()), true})
+	}
+}
+
+type GaugeVec struct {
+	name, help string
+	labels     []string
+
+	mu          sync.Mutex
+	values      map[string]*Gauge
+	labelValues map[string][]string
+}
+
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{name: name, help: help, labels: labels, values: map[string]*Gauge{}, labelValues: map[string][]string{}}
+	Default.register(v)
+	return v
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	key := labelString(v.labels, values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	g, ok := v.values[key]
+	if !ok {
+		g = &Gauge{}
+		v.values[key] = g
+		v.labelValues[key] = values
+	}
+	return g
+}
+
+func (v *GaugeVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", v.name, v.help, v.name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %g\n", v.name, key, v.values[key].Value())
+	}
+}
+
+func (v *GaugeVec) samples(add func(Sample)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		add(Sample{v.name, labelPairs(v.labels, v.labelValues[key]), v.values[key].Value(), false})
+	}
+}
+
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+// NewGaugeFunc exports the value returned by fn at scrape time.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.fn())
+}
+
+func (g *gaugeFunc) samples(add func(Sample)) {
+	add(Sample{Name: g.name, Value: g.fn()})
+}
+
+// Histogram counts observations in cumulative buckets by upper bound.
+type Histogram struct {
+	bounds []float64
+	// counts has one more entry than bounds, for +Inf.
+	counts []atomic.Uint64
+	sum    Gauge
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+}
+
+// cumulative returns the count of observations up to each bound, and then
+// the total.
+func (h *Histogram) cumulative() []uint64 {
+	out := make([]uint64, len(h.counts))
+	var total uint64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		out[i] = total
+	}
+	return out
+}
+
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	bounds     []float64
+
+	mu          sync.Mutex
+	values      map[string]*Histogram
+	labelValues map[string][]string
+}
+
+// NewHistogramVec registers a histogram with the given bucket upper
+// bounds, which must be sorted.
+func NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, labels: labels, bounds: bounds,
+		values: map[string]*Histogram{}, labelValues: map[string][]string{}}
+	Default.register(v)
+	return v
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := labelString(v.labels, values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.values[key]
+	if !ok {
+		h = &Histogram{bounds: v.bounds, counts: make([]atomic.Uint64, len(v.bounds)+1)}
+		v.values[key] = h
+		v.labelValues[key] = values
+	}
+	return h
+}
+
+// bucketLabels returns the le label of each bucket.
+func (v *HistogramVec) bucketLabels() []string {
+	out := make([]string, len(v.bounds)+1)
+	for i, b := range v.bounds {
+		out[i] = strconv.FormatFloat(b, 'f', -1, 64)
+	}
+	out[len(v.bounds)] = "+Inf"
+	return out
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	le := v.bucketLabels()
+	names := append(v.labels[:len(v.labels):len(v.labels)], "le")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		h, values := v.values[key], v.labelValues[key]
+		counts := h.cumulative()
+		for i, n := range counts {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelString(names, append(values[:len(values):len(values)], le[i])), n)
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", v.name, key, h.sum.Value())
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, key, counts[len(counts)-1])
+	}
+}
+
+func (v *HistogramVec) samples(add func(Sample)) {
+	le := v.bucketLabels()
+	names := append(v.labels[:len(v.labels):len(v.labels)], "le")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		h, values := v.values[key], v.labelValues[key]
+		counts := h.cumulative()
+		for i, n := range counts {
+			add(Sample{v.name + "_bucket", labelPairs(names, append(values[:len(values):len(values)], le[i])), float64(n), true})
+		}
+		add(Sample{v.name + "_sum", labelPairs(v.labels, values), h.sum.Value(), true})
+		add(Sample{v.name + "_count", labelPairs(v.labels, values), float64(counts[len(counts)-1]), true})
+	}
+}
+
+func labelPairs(names, values []string) []string {
+	var out []string
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		out = append(out, name, v)
+	}
+	return out
+}
+
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = fmt.Sprintf("%s=%q", name, v)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withRegistry points Default at a fresh registry for the test.
+func withRegistry(t *testing.T) *Registry {
+	t.Helper()
+	old := Default
+	Default = &Registry{}
+	t.Cleanup(func() { Default = old })
+	return Default
+}
+
+func TestWritePrometheus(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		add  func()
+		want string
+	}{
+		{
+			"counter",
+			func() { NewCounter("queries_total", "Queries.").Add(3) },
+			"# HELP queries_total Queries.\n# TYPE queries_total counter\nqueries_total 3\n",
+		},
+		{
+			"counter vec",
+			func() {
+				v := NewCounterVec("responses_total", "Responses.", "rcode")
+				v.With("SERVFAIL").Inc()
+				v.With("NOERROR").Add(2)
+			},
+			"# HELP responses_total Responses.\n# TYPE responses_total counter\n" +
+				`responses_total{rcode="NOERROR"} 2` + "\n" + `responses_total{rcode="SERVFAIL"} 1` + "\n",
+		},
+		{
+			"gauge",
+			func() {
+				g := NewGauge("cache_entries", "Entries.")
+				g.Set(5)
+				g.Add(-1.5)
+			},
+			"# HELP cache_entries Entries.\n# TYPE cache_entries gauge\ncache_entries 3.5\n",
+		},
+		{
+			"gauge func",
+			func() { NewGaugeFunc("uptime_seconds", "Uptime.", func() float64 { return 42 }) },
+			"# HELP uptime_seconds Uptime.\n# TYPE uptime_seconds gauge\nuptime_seconds 42\n",
+		},
+		{
+			"histogram",
+			func() {
+				h := NewHistogramVec("latency_seconds", "Latency.", []float64{0.01, 0.1}, "upstream").With("a")
+				h.Observe(0.005)
+				h.Observe(0.05)
+				h.Observe(1)
+			},
+			"# HELP latency_seconds Latency.\n# TYPE latency_seconds histogram\n" +
+				`latency_seconds_bucket{upstream="a",le="0.01"} 1` + "\n" +
+				`latency_seconds_bucket{upstream="a",le="0.1"} 2` + "\n" +
+				`latency_seconds_bucket{upstream="a",le="+Inf"} 3` + "\n" +
+				`latency_seconds_sum{upstream="a"} 1.055` + "\n" +
+				`latency_seconds_count{upstream="a"} 3` + "\n",
+		},
+	} {
+		r := withRegistry(t)
+		tc.add()
+		var b strings.Builder
+		r.WritePrometheus(&b)
+		if b.String() != tc.want {
+			t.Errorf("%s: wrote\n%s\nwant\n%s", tc.name, b.String(), tc.want)
+		}
+	}
+}
+
+func TestSamples(t *testing.T) {
+	r := withRegistry(t)
+	NewCounterVec("responses_total", "Responses.", "rcode").With("NOERROR").Add(2)
+	NewGauge("cache_entries", "Entries.").Set(7)
+	want := []Sample{
+		{Name: "responses_total", Labels: []string{"rcode", "NOERROR"}, Value: 2, Counter: true},
+		{Name: "cache_entries", Value: 7},
+	}
+	if got := r.Samples(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Samples() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package dnsserver
+
+import (
+	"strings"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Message size metrics help tune the EDNS buffer size: how large queries
+// and responses get over each transport, what UDP payload sizes clients
+// advertise, how many clients don't use EDNS at all, and how often
+// answers are truncated. Clients with broken EDNS handling show up as
+// queries without an OPT record or with tiny buffers, and as truncations
+// of responses to them.
+
+var (
+	sizeBuckets = []float64{64, 128, 256, 512, 1024, 1232, 1452, 2048, 4096, 8192, 16384, 65535}
+
+	requestSizes       = NewHistogramVec("dns_request_size_bytes", "Sizes of queries received, by transport.", sizeBuckets, "protocol")
+	responseSizes      = NewHistogramVec("dns_response_size_bytes", "Sizes of responses sent, by transport.", sizeBuckets, "protocol")
+	ednsUDPSizes       = NewHistogramVec("dns_edns_udp_size_bytes", "UDP payload sizes advertised in the OPT record of queries over UDP.", []float64{512, 1024, 1232, 1400, 1452, 2048, 4096, 8192, 65535})
+	queriesWithoutEDNS = NewCounterVec("dns_queries_without_edns_total", "Queries without an OPT record, by transport.", "protocol")
+	truncatedResponses = NewCounterVec("dns_truncated_responses_total", "Responses sent with TC set, by transport and whether the query had EDNS.", "protocol", "edns")
+	compressionSaved   = NewCounter("dns_compression_saved_bytes_total", "Bytes name compression saved in the responses encoded.")
+	compressionRatio   = NewHistogramVec("dns_compression_ratio", "Size of encoded responses relative to their size without name compression.", []float64{0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1})
+)
+
+// recordSizes records the size metrics of query m, received as query, and
+// of reply, which is nil if none is sent.
+func recordSizes(client *server.Client, m *Message, query, reply []byte) {
+	requestSizes.With(client.Protocol).Observe(float64(len(query)))
+	edns := "no"
+	if opt := findOPT(m); opt != nil {
+		edns = "yes"
+		if client.Protocol == "udp" {
+			ednsUDPSizes.With().Observe(float64(opt.Class))
+		}
+	} else if m.Size > 0 {
+		queriesWithoutEDNS.With(client.Protocol).Inc()
+	}
+	if reply == nil {
+		return
+	}
+	responseSizes.With(client.Protocol).Observe(float64(len(reply)))
+	if len(reply) > 2 && reply[2]&0x02 != 0 {
+		truncatedResponses.With(client.Protocol, edns).Inc()
+	}
+}
+
+// recordCompression records how much smaller compression made resp,
+// encoded in size bytes.
+func recordCompression(resp *Query, size int) {
+	full := 12
+	for _, q := range resp.Questions {
+		full += nameWireLen(q.Name) + 4
+	}
+	for _, section := range [][]*ResourceRecord{resp.Answers, resp.Authorities, resp.Additionals} {
+		for _, rr := range section {
+			full += nameWireLen(rr.Name) + 10 + len(rr.RData)
+		}
+	}
+	if full > size {
+		compressionSaved.Add(uint64(full - size))
+	}
+	compressionRatio.With().Observe(min(float64(size)/float64(full), 1))
+}
+
+// nameWireLen returns the length of name encoded without compression.
+func nameWireLen(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 1
+	}
+	return len(name) + 2
+}
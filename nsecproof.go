@@ -0,0 +1,387 @@
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// The validator checks the NSEC and NSEC3 records a signed zone sends
+// with negative answers, wildcard expansions and DS lookups (RFC 4035
+// section 5.4, RFC 5155 section 8), once their signatures verify.
+
+// maxNSEC3Iterations is the most extra NSEC3 iterations hashed; denials
+// using more are taken as insecure, as RFC 9276 section 3.2 allows.
+const maxNSEC3Iterations = 150
+
+// denial is what a set of proofs shows about a name.
+type denial int
+
+const (
+	unproven denial = iota
+	proven
+	// provenInsecure is a denial that may hide an unsigned delegation, by
+	// NSEC3 opt-out, or that wasn't checked, as it takes too many
+	// iterations.
+	provenInsecure
+)
+
+type nsecRecord struct {
+	owner, next string
+	bitmap      []byte
+}
+
+type nsec3Record struct {
+	zone       string
+	hash, next []byte
+	iterations uint16
+	salt       []byte
+	optOut     bool
+	bitmap     []byte
+}
+
+// proofSet holds the NSEC and NSEC3 records of a response whose signatures
+// verified.
+type proofSet struct {
+	nsec  []*nsecRecord
+	nsec3 []*nsec3Record
+	// costly is set if NSEC3 records were left out for their iterations.
+	costly bool
+}
+
+// proofs returns the NSEC and NSEC3 records in rrs whose signatures verify.
+// With below set, only those signed by a zone above it count, as for the
+// DS records of below. A proof signed by a zone that proves bogus makes
+// the response bogus; unsigned ones and those from insecure zones are
+// left out.
+func (v *Validator) proofs(resolver *net.UDPAddr, rrs []*ResourceRecord, below string, now time.Time) (*proofSet, error) {
+	p := new(proofSet)
+	sets, sigs := splitRRSets(rrs)
+	for key, rrset := range sets {
+		rrtype := rrset[0].Type
+		if rrtype != TypeNSEC && rrtype != TypeNSEC3 {
+			continue
+		}
+		var rrsigs []*RRSIG
+		for _, sig := range sigs[key] {
+			signer := normalizeName(sig.SignerName)
+			if below == "" || signer != below && inZone(below, signer) {
+				rrsigs = append(rrsigs, sig)
+			}
+		}
+		if len(rrsigs) == 0 {
+			continue
+		}
+		if _, err := v.verify(resolver, rrset, rrsigs, now); errors.Is(err, errInsecure) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", fqdn(normalizeName(rrset[0].Name)), dnswire.TypeString(rrtype), err)
+		}
+		for _, rr := range rrset {
+			if rrtype == TypeNSEC {
+				if r, err := parseNSEC(rr); err == nil {
+					p.nsec = append(p.nsec, r)
+				}
+				continue
+			}
+			r, err := parseNSEC3(rr)
+			switch {
+			case err != nil:
+			case r.iterations > maxNSEC3Iterations:
+				p.costly = true
+			default:
+				p.nsec3 = append(p.nsec3, r)
+			}
+		}
+	}
+	return p, nil
+}
+
+func parseNSEC(rr *ResourceRecord) (*nsecRecord, error) {
+	r := dnswire.NewReader(rr.RData, 0)
+	next, err := r.ReadName()
+	if err != nil {
+		return nil, err
+	}
+	return &nsecRecord{owner: normalizeName(rr.Name), next: normalizeName(next), bitmap: rr.RData[r.Offset():]}, nil
+}
+
+func parseNSEC3(rr *ResourceRecord) (*nsec3Record, error) {
+	rdata := rr.RData
+	if len(rdata) < 5 || rdata[0] != 1 {
+		return nil, fmt.Errorf("unsupported nsec3")
+	}
+	saltLen := int(rdata[4])
+	if len(rdata) < 6+saltLen {
+		return nil, fmt.Errorf("nsec3 rdata too short")
+	}
+	nextLen := int(rdata[5+saltLen])
+	if len(rdata) < 6+saltLen+nextLen {
+		return nil, fmt.Errorf("nsec3 rdata too short")
+	}
+	owner := normalizeName(rr.Name)
+	label, zone, _ := strings.Cut(owner, ".")
+	hash, err := base32Hex.DecodeString(strings.ToUpper(label))
+	if err != nil {
+		return nil, fmt.Errorf("nsec3 owner %s: %v", fqdn(owner), err)
+	}
+	return &nsec3Record{
+		zone:       zone,
+		hash:       hash,
+		next:       rdata[6+saltLen : 6+saltLen+nextLen],
+		iterations: binary.BigEndian.Uint16(rdata[2:4]),
+		salt:       rdata[5 : 5+saltLen],
+		optOut:     rdata[1]&1 != 0,
+		bitmap:     rdata[6+saltLen+nextLen:],
+	}, nil
+}
+
+// bitmapHas reports whether an NSEC type bit map lists t.
+func bitmapHas(bitmap []byte, t uint16) bool {
+	for len(bitmap) >= 2 {
+		window, length := bitmap[0], int(bitmap[1])
+		if len(bitmap) < 2+length {
+			return false
+		}
+		if window == byte(t>>8) {
+			i := int(t&0xFF) / 8
+			return i < length && bitmap[2+i]&(0x80>>(t&7)) != 0
+		}
+		bitmap = bitmap[2+length:]
+	}
+	return false
+}
+
+// delegation reports whether a bit map is that of a zone cut seen from
+// the parent, which proves nothing about the names below it.
+func delegation(bitmap []byte) bool {
+	return bitmapHas(bitmap, TypeNS) && !bitmapHas(bitmap, TypeSOA)
+}
+
+// lacks reports whether a bit map shows neither t nor a CNAME at its name.
+func lacks(bitmap []byte, t uint16) bool {
+	return !bitmapHas(bitmap, t) && !bitmapHas(bitmap, TypeCNAME) && (t == TypeDS || !delegation(bitmap))
+}
+
+func (r *nsecRecord) covers(name string) bool {
+	if name == r.owner || !canonicalLess(r.owner, name) || delegation(r.bitmap) && inZone(name, r.owner) {
+		return false
+	}
+	// The last NSEC of a zone points back at its apex.
+	if canonicalLess(r.next, r.owner) {
+		return inZone(name, r.next)
+	}
+	return canonicalLess(name, r.next)
+}
+
+func (r *nsec3Record) hashOf(name string) []byte {
+	return nsec3Hash(name, r.salt, r.iterations)
+}
+
+func (r *nsec3Record) matches(name string) bool {
+	return inZone(name, r.zone) && bytes.Equal(r.hashOf(name), r.hash)
+}
+
+func (r *nsec3Record) covers(name string) bool {
+	if !inZone(name, r.zone) {
+		return false
+	}
+	h := r.hashOf(name)
+	if bytes.Compare(r.hash, r.next) < 0 {
+		return bytes.Compare(r.hash, h) < 0 && bytes.Compare(h, r.next) < 0
+	}
+	// The last NSEC3 of a zone wraps around to the first hash.
+	return bytes.Compare(r.hash, h) < 0 || bytes.Compare(h, r.next) < 0
+}
+
+func (p *proofSet) nsecAt(name string) *nsecRecord {
+	for _, r := range p.nsec {
+		if r.owner == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func (p *proofSet) nsecCovering(name string) *nsecRecord {
+	for _, r := range p.nsec {
+		if r.covers(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (p *proofSet) nsec3At(name string) *nsec3Record {
+	for _, r := range p.nsec3 {
+		if r.matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (p *proofSet) nsec3Covering(name string) *nsec3Record {
+	for _, r := range p.nsec3 {
+		if r.covers(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// nsecEncloser is the closest encloser of name, which r covers: the
+// deepest ancestor name shares with the names either side of it.
+func nsecEncloser(name string, r *nsecRecord) string {
+	ce := commonAncestor(name, r.owner)
+	if next := commonAncestor(name, r.next); len(next) > len(ce) {
+		ce = next
+	}
+	return ce
+}
+
+func commonAncestor(a, b string) string {
+	for !inZone(a, b) {
+		b = parentName(b)
+	}
+	return b
+}
+
+// nsec3Encloser proves the closest encloser of name (RFC 5155 section
+// 8.3): an ancestor with an NSEC3 whose next closer name is covered. It
+// returns the encloser and the NSEC3 covering the next closer name.
+func (p *proofSet) nsec3Encloser(name string) (string, *nsec3Record) {
+	for ce := name; ce != ""; {
+		ce = parentName(ce)
+		if p.nsec3At(ce) == nil {
+			continue
+		}
+		if r := p.nsec3Covering(nextCloser(name, ce)); r != nil {
+			return ce, r
+		}
+		break
+	}
+	return "", nil
+}
+
+// result is d, or provenInsecure if NSEC3 records that might have proven
+// it were left out.
+func (p *proofSet) result(d denial) denial {
+	if d == unproven && p.costly {
+		return provenInsecure
+	}
+	return d
+}
+
+// nameError checks the proof that name doesn't exist and that no wildcard
+// could have answered for it.
+func (p *proofSet) nameError(name string) denial {
+	if r := p.nsecCovering(name); r != nil && p.nsecCovering(wildcardName(nsecEncloser(name, r))) != nil {
+		return proven
+	}
+	if ce, r := p.nsec3Encloser(name); r != nil {
+		if r.optOut {
+			return provenInsecure
+		}
+		if p.nsec3Covering(wildcardName(ce)) != nil {
+			return proven
+		}
+	}
+	return p.result(unproven)
+}
+
+// noData checks the proof that name, or the wildcard that matches it, has
+// no records of type t.
+func (p *proofSet) noData(name string, t uint16) denial {
+	if r := p.nsecAt(name); r != nil {
+		if lacks(r.bitmap, t) {
+			return proven
+		}
+		return unproven
+	}
+	if r := p.nsecCovering(name); r != nil {
+		// An empty non-terminal, or a wildcard without t.
+		if inZone(r.next, name) {
+			return proven
+		}
+		if w := p.nsecAt(wildcardName(nsecEncloser(name, r))); w != nil && lacks(w.bitmap, t) {
+			return proven
+		}
+	}
+	if r := p.nsec3At(name); r != nil {
+		if lacks(r.bitmap, t) {
+			return proven
+		}
+		return unproven
+	}
+	if ce, r := p.nsec3Encloser(name); r != nil {
+		if t == TypeDS && r.optOut {
+			return provenInsecure
+		}
+		if w := p.nsec3At(wildcardName(ce)); w != nil && lacks(w.bitmap, t) {
+			return proven
+		}
+	}
+	return p.result(unproven)
+}
+
+// wildcardAnswer checks the proof that name, answered by a wildcard
+// labels labels long, doesn't exist itself.
+func (p *proofSet) wildcardAnswer(name string, labels int) denial {
+	if p.nsecCovering(name) != nil {
+		return proven
+	}
+	ce := name
+	for countLabels(ce) > labels {
+		ce = parentName(ce)
+	}
+	if r := p.nsec3Covering(nextCloser(name, ce)); r != nil {
+		if r.optOut {
+			return provenInsecure
+		}
+		return proven
+	}
+	return p.result(unproven)
+}
+
+// noDS checks the proof that name has no DS records, and reports whether
+// it is a zone cut. Denials that may hide an insecure cut count as one.
+func (p *proofSet) noDS(name string) (bool, denial) {
+	if bitmap, ok := p.bitmapAt(name); ok {
+		// The child's NSEC at its apex proves nothing about the DS
+		// records its parent holds.
+		if bitmapHas(bitmap, TypeSOA) || bitmapHas(bitmap, TypeDS) {
+			return false, unproven
+		}
+		return bitmapHas(bitmap, TypeNS), proven
+	}
+	// A name that doesn't exist isn't a zone cut.
+	if p.nsecCovering(name) != nil {
+		return false, proven
+	}
+	if _, r := p.nsec3Encloser(name); r != nil {
+		if r.optOut {
+			return true, provenInsecure
+		}
+		return false, proven
+	}
+	d := p.result(unproven)
+	return d == provenInsecure, d
+}
+
+// bitmapAt returns the type bit map of the NSEC or NSEC3 at name.
+func (p *proofSet) bitmapAt(name string) ([]byte, bool) {
+	if r := p.nsecAt(name); r != nil {
+		return r.bitmap, true
+	}
+	if r := p.nsec3At(name); r != nil {
+		return r.bitmap, true
+	}
+	return nil, false
+}
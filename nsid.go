@@ -0,0 +1,54 @@
+package dnsserver
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// NSID (RFC 5001) lets a client ask which server answered it, which tells
+// the instances behind an anycast address apart. The server answers with
+// -nsid to queries that ask, and asks its resolver for its own NSID when
+// a query is traced or debug logged.
+
+const ednsOptionNSID = 3
+
+// withNSID adds id to resp if m, the query it answers, asks for the
+// server's NSID.
+func withNSID(resp *Query, m *Message, id []byte) *Query {
+	opt := findOPT(m)
+	// A request is an empty option, which ednsOption returns as empty
+	// rather than nil.
+	if len(id) == 0 || opt == nil || ednsOption(opt.RData, ednsOptionNSID) == nil {
+		return resp
+	}
+	var extRCode uint8
+	for _, rr := range resp.Additionals {
+		if rr.Type == TypeOPT {
+			extRCode = uint8(rr.TTL >> 24)
+		}
+	}
+	return withEDNSOption(resp, ednsOptionNSID, id, extRCode)
+}
+
+// formatNSID shows an NSID as dig does: in hex, followed by the text if it
+// is printable.
+func formatNSID(id []byte) string {
+	s := hex.EncodeToString(id)
+	if strings.IndexFunc(string(id), func(r rune) bool { return r < ' ' || r > '~' }) < 0 {
+		s += ` ("` + string(id) + `")`
+	}
+	return s
+}
+
+// upstreamNSID returns the NSID in resp, formatted, or "".
+func upstreamNSID(resp *Message) string {
+	opt := findOPT(resp)
+	if opt == nil {
+		return ""
+	}
+	id := ednsOption(opt.RData, ednsOptionNSID)
+	if len(id) == 0 {
+		return ""
+	}
+	return formatNSID(id)
+}
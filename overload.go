@@ -0,0 +1,16 @@
+package dnsserver
+
+import (
+	"fmt"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// newQueryLimit returns the limit -max-in-flight and -overload-policy
+// set.
+func newQueryLimit(max int, policy string) (*QueryLimit, error) {
+	if policy != "drop" && policy != "refuse" {
+		return nil, fmt.Errorf("invalid -overload-policy %q, want drop or refuse", policy)
+	}
+	return server.NewQueryLimit(max, policy == "refuse"), nil
+}
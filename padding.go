@@ -0,0 +1,45 @@
+package dnsserver
+
+// EDNS padding (RFC 7830) rounds encrypted messages up to a multiple of a
+// block size, so their length says less about the names asked for.
+// Following RFC 8467, responses over TLS and HTTPS to queries that carry
+// the padding option are padded to -edns-padding bytes, and the query
+// command pads its own queries to 128.
+
+const ednsOptionPadding = 12
+
+// padding returns the block size to pad the response to q to, or 0.
+func (q *queryState) padding() int {
+	if q.p.PadBlock <= 0 {
+		return 0
+	}
+	if proto := q.Client().Protocol; proto != "tls" && proto != "https" {
+		return 0
+	}
+	opt := findOPT(q.message)
+	if opt == nil || ednsOption(opt.RData, ednsOptionPadding) == nil {
+		return 0
+	}
+	return q.p.PadBlock
+}
+
+// withPadding pads resp, encoded compressed or not, to a multiple of block
+// bytes.
+func withPadding(resp *Query, block int, compress bool) *Query {
+	wire, err := encodeResponse(nil, resp, compress)
+	if err != nil {
+		return resp
+	}
+	// The option adds 4 bytes, and an OPT record if there is none 11 more.
+	var extRCode uint8
+	size, hasOPT := len(wire)+4, false
+	for _, rr := range resp.Additionals {
+		if rr.Type == TypeOPT {
+			extRCode, hasOPT = uint8(rr.TTL>>24), true
+		}
+	}
+	if !hasOPT {
+		size += 11
+	}
+	return withEDNSOption(resp, ednsOptionPadding, make([]byte, (block-size%block)%block), extRCode)
+}
@@ -0,0 +1,65 @@
+//go:build (linux || darwin || freebsd) && cgo
+
+package dnsserver
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// loadPlugin opens the Go plugin at path and registers the zone backends
+// and stages it exports. Plugins are written against dnswire, built with
+// -buildmode=plugin from the same module version, and export either or
+// both of:
+//
+//	var ZoneBackends = map[string]func(origin, source string) ([]*dnswire.ResourceRecord, error){...}
+//	var Stages = map[string]func(query *dnswire.Message) *dnswire.Query{...}
+//
+// A plugin stage answers the query with the response it returns, or hands
+// it on when that is nil.
+func loadPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	found := false
+	if sym, err := p.Lookup("ZoneBackends"); err == nil {
+		backends, ok := sym.(*map[string]func(origin, source string) ([]*dnswire.ResourceRecord, error))
+		if !ok {
+			return fmt.Errorf("%s: ZoneBackends is a %T", path, sym)
+		}
+		for scheme, b := range *backends {
+			server.RegisterZoneBackend(scheme, b)
+		}
+		found = true
+	}
+	if sym, err := p.Lookup("Stages"); err == nil {
+		stages, ok := sym.(*map[string]func(query *dnswire.Message) *dnswire.Query)
+		if !ok {
+			return fmt.Errorf("%s: Stages is a %T", path, sym)
+		}
+		for name, answer := range *stages {
+			server.RegisterStage(name, pluginStage(answer))
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("%s exports neither ZoneBackends nor Stages", path)
+	}
+	return nil
+}
+
+func pluginStage(answer func(query *dnswire.Message) *dnswire.Query) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, m *Message) {
+			if resp := answer(m); resp != nil {
+				stateOf(w).send(resp)
+				return
+			}
+			next.ServeDNS(w, m)
+		})
+	}
+}
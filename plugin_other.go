@@ -0,0 +1,9 @@
+//go:build !((linux || darwin || freebsd) && cgo)
+
+package dnsserver
+
+import "fmt"
+
+func loadPlugin(path string) error {
+	return fmt.Errorf("loading %s: plugins need a cgo build on linux, darwin or freebsd", path)
+}
@@ -0,0 +1,183 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Profiles give groups of clients their own policy, for example stricter
+// blocking and safe search for children's devices:
+//
+//	-profile 'kids?client=192.168.1.64/26&mac=3c:22:fb:01:02:03&blocklists=ads,adult&safe-search=on'
+//	-profile 'teens?client=192.168.1.128/26&safe-search=google,bing,youtube-strict'
+//	-profile 'admins?key=admin-key&cert-group=ops&blocklists=&log=debug'
+//
+// Clients are matched by network, by the MAC address -dhcp-leases says
+// their address is leased to, by the TSIG key signing the query or by the
+// group of their TLS client certificate. A query gets the first profile
+// it matches, or the profile named "default" if there is one. A profile's
+// blocklists replace the block group the client would otherwise get;
+// safe-search enforces it on every engine that has it or the ones listed
+// (see safesearch.go); log is on, off (the query isn't written to the
+// query log) or debug. A profile with a schedule only applies while it is
+// active.
+
+var profileQueries = NewCounterVec("dns_profile_queries_total", "Queries answered by client profile.", "profile")
+
+type Profile struct {
+	Name       string
+	Networks   []*net.IPNet
+	MACs       []string
+	Keys       []string
+	CertGroups []string
+	// Blocklists is nil if the profile leaves blocking alone, and empty
+	// if it blocks nothing.
+	Blocklists []string
+	// SafeSearch maps the names of search engines to their safe
+	// variants, for profiles enforcing it.
+	SafeSearch map[string]string
+	Log        string
+	// Schedule, if set, limits when the profile applies.
+	Schedule *Schedule
+
+	scheduleName string
+}
+
+// ParseProfile parses a -profile value, a name followed by the clients it
+// matches and its settings in query string form.
+func ParseProfile(spec string) (*Profile, error) {
+	name, params, _ := strings.Cut(spec, "?")
+	p := &Profile{Name: name, Log: "on"}
+	if name == "" {
+		return nil, fmt.Errorf("invalid -profile %q: no name", spec)
+	}
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -profile %q: %v", spec, err)
+	}
+	for key, vs := range values {
+		var items []string
+		for _, v := range vs {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		}
+		switch key {
+		case "client":
+			nets, err := server.ParseNetworks(strings.Join(items, ","))
+			if err != nil {
+				return nil, fmt.Errorf("invalid -profile %q: %v", spec, err)
+			}
+			p.Networks = append(p.Networks, nets...)
+		case "mac":
+			for _, item := range items {
+				mac, err := net.ParseMAC(item)
+				if err != nil {
+					return nil, fmt.Errorf("invalid -profile %q: %v", spec, err)
+				}
+				p.MACs = append(p.MACs, mac.String())
+			}
+		case "key":
+			for _, item := range items {
+				p.Keys = append(p.Keys, normalizeName(item))
+			}
+		case "cert-group":
+			p.CertGroups = append(p.CertGroups, items...)
+		case "blocklists":
+			p.Blocklists = append([]string{}, items...)
+		case "safe-search":
+			if p.SafeSearch, err = parseSafeSearch(items); err != nil {
+				return nil, fmt.Errorf("invalid -profile %q: %v", spec, err)
+			}
+		case "schedule":
+			p.scheduleName = strings.Join(vs, "")
+		case "log":
+			p.Log = strings.Join(vs, "")
+			if p.Log != "on" && p.Log != "off" && p.Log != "debug" {
+				return nil, fmt.Errorf("invalid -profile %q: log must be on, off or debug", spec)
+			}
+		default:
+			return nil, fmt.Errorf("invalid -profile %q: unknown option %q", spec, key)
+		}
+	}
+	return p, nil
+}
+
+// Profiles picks the profile of each query.
+type Profiles struct {
+	list []*Profile
+	def  *Profile
+	// Leases maps client addresses to MAC addresses, for profiles
+	// matching them.
+	Leases *DHCPLeases
+}
+
+// Add adds p, which clients are matched against after the profiles added
+// before it.
+func (ps *Profiles) Add(p *Profile) error {
+	if slices.ContainsFunc(ps.list, func(o *Profile) bool { return o.Name == p.Name }) ||
+		ps.def != nil && p.Name == "default" {
+		return fmt.Errorf("duplicate profile %q", p.Name)
+	}
+	if len(p.MACs) > 0 && ps.Leases == nil {
+		return fmt.Errorf("profile %s matches MAC addresses, which needs -dhcp-leases", p.Name)
+	}
+	if p.Name == "default" {
+		ps.def = p
+		return nil
+	}
+	if len(p.Networks)+len(p.MACs)+len(p.Keys)+len(p.CertGroups) == 0 {
+		return fmt.Errorf("profile %s matches no clients; give it client, mac, key or cert-group", p.Name)
+	}
+	ps.list = append(ps.list, p)
+	return nil
+}
+
+// Match returns the profile of a query from client, signed as auth says,
+// or nil.
+func (ps *Profiles) Match(client *server.Client, auth *authResult) *Profile {
+	if ps == nil {
+		return nil
+	}
+	var mac string
+	now := time.Now()
+	for _, p := range ps.list {
+		if !p.Schedule.Active(now) {
+			continue
+		}
+		if auth != nil && auth.RCode == RCodeSuccess && slices.Contains(p.Keys, normalizeName(auth.Signer)) ||
+			client.Group != "" && slices.Contains(p.CertGroups, client.Group) ||
+			slices.ContainsFunc(p.Networks, func(n *net.IPNet) bool { return n.Contains(client.IP) }) {
+			return p
+		}
+		if len(p.MACs) > 0 {
+			if mac == "" {
+				mac = ps.Leases.MAC(client.IP, now)
+			}
+			if mac != "" && slices.Contains(p.MACs, mac) {
+				return p
+			}
+		}
+	}
+	if ps.def == nil || !ps.def.Schedule.Active(now) {
+		return nil
+	}
+	return ps.def
+}
+
+// blockGroup returns the block group of the client's certificate group,
+// unless p gives the client its own blocklists.
+func (p *Profile) blockGroup(certGroup string) string {
+	if p == nil || p.Blocklists == nil {
+		return certGroup
+	}
+	return p.Name
+}
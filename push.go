@@ -0,0 +1,136 @@
+package dnsserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/metrics"
+)
+
+// MetricsPusher sends the registry's metrics to a statsd or graphite
+// server every Interval, for setups that collect metrics by push rather
+// than by scraping /metrics. A metric's labels become extra path
+// components: dns_blocked_queries_total{list="ads",group="kids"} is pushed
+// as <prefix>.dns_blocked_queries_total.list.ads.group.kids.
+type MetricsPusher struct {
+	// Protocol is statsd (UDP) or graphite (the plaintext protocol over
+	// TCP).
+	Protocol string
+	Addr     string
+	Prefix   string
+	Interval time.Duration
+
+	mu sync.Mutex
+	// last holds the counter values sent last, since statsd counters are
+	// deltas.
+	last map[string]float64
+}
+
+func NewMetricsPusher(protocol, addr, prefix string, interval time.Duration) (*MetricsPusher, error) {
+	if protocol != "statsd" && protocol != "graphite" {
+		return nil, fmt.Errorf("invalid metrics push protocol %q, want statsd or graphite", protocol)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid %s address %q: %v", protocol, addr, err)
+	}
+	return &MetricsPusher{Protocol: protocol, Addr: addr, Prefix: prefix, Interval: interval, last: map[string]float64{}}, nil
+}
+
+func (p *MetricsPusher) Run() {
+	for range time.Tick(p.Interval) {
+		if err := p.Push(); err != nil {
+			logPush.Warn("pushing metrics failed", "protocol", p.Protocol, "addr", p.Addr, "err", err)
+		}
+	}
+}
+
+// Push sends the current values once.
+func (p *MetricsPusher) Push() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var lines []string
+	for _, s := range metrics.Default.Samples() {
+		path := p.path(s)
+		switch {
+		case p.Protocol == "graphite":
+			lines = append(lines, fmt.Sprintf("%s %s %d\n", path, formatValue(s.Value), now.Unix()))
+		case s.Counter:
+			delta := s.Value - p.last[path]
+			if delta < 0 {
+				delta = s.Value
+			}
+			p.last[path] = s.Value
+			lines = append(lines, fmt.Sprintf("%s:%s|c\n", path, formatValue(delta)))
+		default:
+			lines = append(lines, fmt.Sprintf("%s:%s|g\n", path, formatValue(s.Value)))
+		}
+	}
+	if p.Protocol == "graphite" {
+		return p.sendGraphite(lines)
+	}
+	return p.sendStatsd(lines)
+}
+
+func (p *MetricsPusher) path(s metrics.Sample) string {
+	parts := []string{s.Name}
+	if p.Prefix != "" {
+		parts = append([]string{p.Prefix}, parts...)
+	}
+	for _, l := range s.Labels {
+		if l == "" {
+			l = "none"
+		}
+		parts = append(parts, metricPathReplacer.Replace(l))
+	}
+	return strings.Join(parts, ".")
+}
+
+// metricPathReplacer keeps label values from adding path components or
+// breaking the line formats.
+var metricPathReplacer = strings.NewReplacer(".", "_", " ", "_", ":", "_", "|", "_", "/", "_", "\n", "_")
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (p *MetricsPusher) sendGraphite(lines []string) error {
+	conn, err := net.DialTimeout("tcp", p.Addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write([]byte(strings.Join(lines, "")))
+	return err
+}
+
+// statsdPacketSize keeps packets below the usual path MTU.
+const statsdPacketSize = 1400
+
+func (p *MetricsPusher) sendStatsd(lines []string) error {
+	conn, err := net.Dial("udp", p.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line) > statsdPacketSize {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		_, err = conn.Write(buf.Bytes())
+	}
+	return err
+}
@@ -0,0 +1,390 @@
+package dnsserver
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnsclient"
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// The query subcommand is a small dig built on dnswire and dnsclient:
+//
+//	dns-server query example.com A @1.1.1.1 +tcp +dnssec
+//
+// The name, type, class, @server and +options come in any order, like
+// dig's. It prints the response in dig's layout, or with +short only the
+// answer data and with +json the message in its JSON form.
+
+var opcodeNames = map[uint8]string{0: "QUERY", 1: "IQUERY", 2: "STATUS", 4: "NOTIFY", 5: "UPDATE"}
+
+type queryOptions struct {
+	net     string
+	server  string
+	edns    bool
+	bufsize uint16
+	dnssec  bool
+	recurse bool
+	short   bool
+	json    bool
+	nsid    bool
+	retries int
+	// padding is the block size +tls and +https queries are padded to.
+	padding int
+}
+
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	timeout := fs.Duration("timeout", dnsclient.DefaultTimeout, "How long to wait for each attempt")
+	caFile := fs.String("ca", "", "For +tls and +https, verify the server against the CA certificates in this PEM file")
+	insecure := fs.Bool("insecure", false, "For +tls and +https, don't verify the server's certificate")
+	tlsHost := fs.String("tls-host", "", "For +tls and +https, authenticate the server as this name rather than the one or address it is reached at")
+	var pins listFlag
+	fs.Var(&pins, "pin", "For +tls and +https, base64 SHA-256 hash of a SubjectPublicKeyInfo the server's certificate chain must contain (repeatable); with -insecure, the pins alone authenticate the server and must match its own certificate")
+	opportunistic := fs.Bool("opportunistic", false, "For +tls and +https, warn rather than fail when the server can't be authenticated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server query [flags] name [type] [class] [@server] [+option...]")
+		fmt.Fprintln(fs.Output(), "options: +tcp, +tls, +https, +dnssec, +nsid, +[no]rec, +noedns, +bufsize=N, +[no]padding[=N], +retry=N, +short, +json")
+		fs.PrintDefaults()
+	}
+	// Flags may also come between the dig-style arguments.
+	var words []string
+	for rest := args; ; {
+		fs.Parse(rest)
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+
+	opts := queryOptions{edns: true, bufsize: 1232, recurse: true, padding: 128}
+	name, qtype, qclass := "", uint16(0), uint16(0)
+	for _, w := range words {
+		switch {
+		case strings.HasPrefix(w, "@"):
+			opts.server = w[1:]
+		case strings.HasPrefix(w, "+"):
+			if err := opts.set(w[1:]); err != nil {
+				return err
+			}
+		case name != "" && qtype == 0 && isType(w):
+			qtype, _ = dnswire.ParseType(strings.ToUpper(w))
+		case name != "" && qclass == 0 && isClass(w):
+			qclass, _ = dnswire.ParseClass(strings.ToUpper(w))
+		case name == "":
+			name = w
+		default:
+			return fmt.Errorf("query: unexpected argument %q", w)
+		}
+	}
+	if name == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if qtype == 0 {
+		qtype = TypeA
+	}
+
+	q := dnswire.NewQuery(name, qtype)
+	q.Header.RD = opts.recurse
+	if qclass != 0 {
+		q.Questions[0].QClass = qclass
+	}
+	if opts.edns {
+		q.SetEDNS(opts.bufsize, opts.dnssec)
+		if opts.nsid {
+			q = withEDNSOption(q, ednsOptionNSID, nil, 0)
+		}
+	}
+
+	client, err := opts.client(*timeout, *caFile, *insecure)
+	if err == nil && client.TLSConfig != nil {
+		err = opts.authenticate(client, *tlsHost, pins, *opportunistic)
+	}
+	if err != nil {
+		return err
+	}
+	var server string
+	var took time.Duration
+	var size int
+	client.Received = func(network string, local, remote net.Addr, query, resp []byte, queried time.Time) {
+		took, size = time.Since(queried), len(resp)
+		server = client.Addr + "(" + network + ")"
+		if remote != nil {
+			host, port, _ := net.SplitHostPort(remote.String())
+			server = host + "#" + port + "(" + network + ")"
+		}
+	}
+	resp, err := client.Exchange(context.Background(), q)
+	if err != nil {
+		return fmt.Errorf("query: %v", err)
+	}
+
+	switch {
+	case opts.json:
+		out, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	case opts.short:
+		for _, rr := range resp.Answers {
+			fmt.Println(dnswire.FormatRData(rr.Type, rr.RData))
+		}
+	default:
+		printResponse(os.Stdout, resp)
+		fmt.Printf(";; Query time: %d msec\n", took.Milliseconds())
+		fmt.Printf(";; SERVER: %s\n", server)
+		fmt.Printf(";; WHEN: %s\n", time.Now().Format(time.RFC1123))
+		fmt.Printf(";; MSG SIZE  rcvd: %d\n", size)
+	}
+	return nil
+}
+
+func isType(s string) bool {
+	_, ok := dnswire.ParseType(strings.ToUpper(s))
+	return ok
+}
+
+func isClass(s string) bool {
+	_, ok := dnswire.ParseClass(strings.ToUpper(s))
+	return ok
+}
+
+func (o *queryOptions) set(opt string) error {
+	name, value, _ := strings.Cut(opt, "=")
+	switch name {
+	case "tcp", "tls", "https":
+		o.net = name
+	case "notcp":
+		o.net = ""
+	case "dnssec":
+		o.dnssec = true
+	case "rec", "recurse":
+		o.recurse = true
+	case "norec", "norecurse":
+		o.recurse = false
+	case "edns":
+		o.edns = true
+	case "noedns":
+		o.edns = false
+	case "nsid":
+		o.nsid = true
+	case "short":
+		o.short = true
+	case "json":
+		o.json = true
+	case "bufsize":
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("query: invalid +bufsize %q", value)
+		}
+		o.bufsize = uint16(n)
+	case "padding":
+		n, err := strconv.Atoi(cmp.Or(value, "128"))
+		if err != nil || n < 0 || n > 65535 {
+			return fmt.Errorf("query: invalid +padding %q", value)
+		}
+		o.padding = n
+	case "nopadding":
+		o.padding = 0
+	case "retry":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("query: invalid +retry %q", value)
+		}
+		o.retries = n
+	default:
+		return fmt.Errorf("query: unknown option +%s", opt)
+	}
+	return nil
+}
+
+// client returns a client for the server and transport chosen. Without
+// @server it asks the first nameserver of /etc/resolv.conf.
+func (o *queryOptions) client(timeout time.Duration, caFile string, insecure bool) (*dnsclient.Client, error) {
+	server := o.server
+	if server == "" {
+		server = systemNameserver()
+	}
+	network := o.net
+	if strings.HasPrefix(server, "https://") {
+		network = "https"
+	}
+	c := &dnsclient.Client{Net: network, Timeout: timeout, Retries: o.retries, PadBlock: o.padding}
+
+	host := server
+	switch {
+	case network == "https" && strings.HasPrefix(server, "https://"):
+		c.Addr = server
+		host = strings.TrimPrefix(server, "https://")
+		host, _, _ = strings.Cut(host, "/")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	case network == "https":
+		c.Addr = "https://" + server + "/dns-query"
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+	default:
+		port := "53"
+		if network == "tls" {
+			port = "853"
+		}
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			c.Addr, host = server, h
+		} else {
+			c.Addr = net.JoinHostPort(strings.Trim(server, "[]"), port)
+			host = strings.Trim(server, "[]")
+		}
+	}
+
+	if network == "tls" || network == "https" {
+		c.TLSConfig = &tls.Config{ServerName: host, InsecureSkipVerify: insecure}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("query: no certificates in %s", caFile)
+			}
+			c.TLSConfig.RootCAs = pool
+		}
+	}
+	return c, nil
+}
+
+// authenticate sets how the client authenticates an encrypted server.
+func (o *queryOptions) authenticate(c *dnsclient.Client, host string, pins []string, opportunistic bool) error {
+	if host != "" {
+		c.TLSConfig.ServerName = host
+	}
+	for _, s := range pins {
+		pin, err := dnsclient.ParseSPKIPin(s)
+		if err != nil {
+			return fmt.Errorf("query: %v", err)
+		}
+		c.TLSPins = append(c.TLSPins, pin)
+	}
+	c.Opportunistic = opportunistic
+	c.AuthFailed = func(err error) {
+		fmt.Fprintf(os.Stderr, ";; WARNING: the server isn't authenticated: %v\n", err)
+	}
+	return nil
+}
+
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return "127.0.0.1"
+}
+
+// printResponse writes m the way dig does, with the OPT record shown as
+// the pseudosection rather than an additional record.
+func printResponse(w io.Writer, m *Message) {
+	h := m.Header
+	var opt *ResourceRecord
+	var additionals []*ResourceRecord
+	for _, rr := range m.Additionals {
+		if rr.Type == TypeOPT && opt == nil {
+			opt = rr
+			continue
+		}
+		additionals = append(additionals, rr)
+	}
+
+	rcode := uint16(h.RCode)
+	if opt != nil {
+		rcode |= uint16(opt.TTL>>24) << 4
+	}
+	status := "RCODE" + strconv.Itoa(int(rcode))
+	if rcode <= 0xFF {
+		status = dnswire.RCodeString(uint8(rcode))
+	}
+	opcode, ok := opcodeNames[h.Opcode]
+	if !ok {
+		opcode = "OPCODE" + strconv.Itoa(int(h.Opcode))
+	}
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcode, status, h.ID)
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{{h.QR, "qr"}, {h.AA, "aa"}, {h.TC, "tc"}, {h.RD, "rd"}, {h.RA, "ra"}, {h.Z&headerAD != 0, "ad"}, {h.Z&headerCD != 0, "cd"}} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(m.Questions), len(m.Answers), len(m.Authorities), len(m.Additionals))
+
+	if opt != nil {
+		fmt.Fprintf(w, "\n;; OPT PSEUDOSECTION:\n; EDNS: version: %d, flags:", byte(opt.TTL>>16))
+		if opt.TTL&(1<<15) != 0 {
+			fmt.Fprint(w, " do")
+		}
+		fmt.Fprintf(w, "; udp: %d\n", opt.Class)
+		for data := opt.RData; len(data) >= 4; {
+			code, length := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+			data = data[4:]
+			if length > len(data) {
+				length = len(data)
+			}
+			switch code {
+			case ednsOptionNSID:
+				fmt.Fprintf(w, "; NSID: %s\n", formatNSID(data[:length]))
+			case ednsOptionPadding:
+				fmt.Fprintf(w, "; PADDING: %d bytes\n", length)
+			default:
+				fmt.Fprintf(w, "; OPT=%d: %x\n", code, data[:length])
+			}
+			data = data[length:]
+		}
+	}
+
+	fmt.Fprintln(w, "\n;; QUESTION SECTION:")
+	for _, q := range m.Questions {
+		fmt.Fprintf(w, ";%s.\t\t%s\t%s\n", strings.TrimSuffix(q.Name, "."), dnswire.ClassString(q.QClass), dnswire.TypeString(q.QType))
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []*ResourceRecord
+	}{{"ANSWER", m.Answers}, {"AUTHORITY", m.Authorities}, {"ADDITIONAL", additionals}} {
+		if len(section.rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", section.name)
+		for _, rr := range section.rrs {
+			fmt.Fprintf(w, "%s.\t%d\t%s\t%s\t%s\n", strings.TrimSuffix(rr.Name, "."), rr.TTL,
+				dnswire.ClassString(rr.Class), dnswire.TypeString(rr.Type), dnswire.FormatRData(rr.Type, rr.RData))
+		}
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,236 @@
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// QueryLog records every answered query, one line each.
+type QueryLog struct {
+	// Format is text, json or csv.
+	Format string
+	// Zones restricts logging to queries for names at or below them. A
+	// name prefixed with "-" excludes its subtree instead; the longest
+	// match wins, and with no plain entries everything else is logged.
+	Zones []string
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type queryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Protocol string    `json:"protocol"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	RCode    string    `json:"rcode"`
+	Answers  []string  `json:"answers"`
+	// Cached is set for responses served from the cache.
+	Cached   bool    `json:"cached"`
+	Duration float64 `json:"duration_ms"`
+}
+
+func NewQueryLog(out io.Writer, format string, zones []string) (*QueryLog, error) {
+	switch format {
+	case "text", "json", "csv":
+	default:
+		return nil, fmt.Errorf("invalid query log format %q, want text, json or csv", format)
+	}
+	l := &QueryLog{Format: format, out: out}
+	for _, z := range zones {
+		zone, exclude := strings.CutPrefix(z, "-")
+		zone = normalizeName(zone)
+		if exclude {
+			zone = "-" + zone
+		}
+		l.Zones = append(l.Zones, zone)
+	}
+	return l, nil
+}
+
+func (l *QueryLog) enabled(name string) bool {
+	enabled, best := true, -1
+	for _, z := range l.Zones {
+		if !strings.HasPrefix(z, "-") {
+			enabled = false
+		}
+	}
+	for _, z := range l.Zones {
+		zone, exclude := strings.CutPrefix(z, "-")
+		if inZone(name, zone) && len(zone) > best {
+			enabled, best = !exclude, len(zone)
+		}
+	}
+	return enabled
+}
+
+// newQueryLogEntry describes the response to m, which has a question;
+// resp is nil if the query was dropped.
+func newQueryLogEntry(client *server.Client, m *Message, resp *Query, cached bool, took time.Duration) queryLogEntry {
+	q := m.Questions[0]
+	e := queryLogEntry{
+		Time:     time.Now().UTC(),
+		Client:   client.IP.String(),
+		Protocol: client.Protocol,
+		Name:     fqdn(normalizeName(q.Name)),
+		Type:     dnswire.TypeString(q.QType),
+		RCode:    "DROPPED",
+		Answers:  []string{},
+		Cached:   cached,
+		Duration: float64(took.Microseconds()) / 1000,
+	}
+	if resp != nil {
+		e.RCode = dnswire.RCodeString(resp.Header.RCode)
+		e.Answers = answerSummary(resp.Answers)
+	}
+	return e
+}
+
+// text formats e as a line of the text query log.
+func (e *queryLogEntry) text() []byte {
+	answers, cache := "-", "miss"
+	if len(e.Answers) > 0 {
+		answers = strings.Join(e.Answers, ", ")
+	}
+	if e.Cached {
+		cache = "hit"
+	}
+	return fmt.Appendf(nil, "%s %s %s %s %s %s cache=%s %.3fms %s\n",
+		e.Time.Format(time.RFC3339Nano), e.Client, e.Protocol, e.Name, e.Type, e.RCode, cache, e.Duration, answers)
+}
+
+// Record logs the response to m, or that it was dropped if resp is nil.
+// Without a query log, only queries with the query-log feature are logged,
+// to the server log.
+func (l *QueryLog) Record(client *server.Client, m *Message, resp *Query, cached bool, took time.Duration) {
+	if len(m.Questions) == 0 {
+		return
+	}
+	q := m.Questions[0]
+	name := normalizeName(q.Name)
+	forced := features.Enabled(featureQueryLog, client.IP, name, time.Now())
+	if !forced && (l == nil || !l.enabled(name)) {
+		return
+	}
+	e := newQueryLogEntry(client, m, resp, cached, took)
+	if l == nil {
+		logQueryLog.Info("query", "client", e.Client, "protocol", e.Protocol, "qname", e.Name, "qtype", e.Type,
+			"rcode", e.RCode, "answers", e.Answers, "cached", e.Cached, "duration_ms", e.Duration)
+		return
+	}
+
+	var line []byte
+	switch l.Format {
+	case "json":
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{e.Time.Format(time.RFC3339Nano), e.Client, e.Protocol, e.Name, e.Type, e.RCode,
+			strings.Join(e.Answers, "; "), strconv.FormatBool(e.Cached), strconv.FormatFloat(e.Duration, 'f', 3, 64)})
+		w.Flush()
+		line = buf.Bytes()
+	default:
+		line = e.text()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		logQueryLog.Error("writing query log failed", "err", err)
+	}
+}
+
+// answerSummary describes each answer record briefly, as its type and, for
+// common types, its data.
+func answerSummary(rrs []*ResourceRecord) []string {
+	out := []string{}
+	for _, rr := range rrs {
+		s := dnswire.TypeString(rr.Type)
+		switch rr.Type {
+		case TypeA, TypeAAAA:
+			s += " " + net.IP(rr.RData).String()
+		case TypeCNAME, TypeNS, TypePTR:
+			s += " " + fqdn(rdataName(rr.RData, 0))
+		case TypeMX:
+			s += " " + fqdn(rdataName(rr.RData, 2))
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// rotatingFile is a log file that is renamed to path.1, path.2 and so on
+// once it grows past MaxSize bytes, keeping Keep old files.
+type rotatingFile struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{Path: path, MaxSize: maxSize, Keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	if r.Keep == 0 {
+		os.Remove(r.Path)
+	} else {
+		for i := r.Keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+		}
+		os.Rename(r.Path, r.Path+".1")
+	}
+	return r.open()
+}
@@ -0,0 +1,154 @@
+package dnsserver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	throttledQueries = NewCounterVec("dns_ratelimit_throttled_total", "Queries rejected by the per-client rate limiter.", "scope", "action")
+	throttledClients = NewGauge("dns_ratelimit_throttled_clients", "Clients or prefixes currently over their query rate limit.")
+)
+
+type RateLimitConfig struct {
+	ClientQPS   float64
+	ClientBurst int
+	PrefixQPS   float64
+	PrefixBurst int
+	IPv4Prefix  int
+	IPv6Prefix  int
+	// Refuse answers over-limit queries with REFUSED; otherwise they are
+	// silently dropped.
+	Refuse bool
+	// MaxBuckets bounds how many clients and how many prefixes are
+	// tracked at once; those past it share one bucket.
+	MaxBuckets int
+}
+
+type tokenBucket struct {
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimiter applies token bucket query limits per source address and per
+// source network.
+type RateLimiter struct {
+	cfg RateLimitConfig
+
+	mu        sync.Mutex
+	clients   map[string]*tokenBucket
+	prefixes  map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.ClientBurst < 1 {
+		cfg.ClientBurst = max(1, int(cfg.ClientQPS))
+	}
+	if cfg.PrefixBurst < 1 {
+		cfg.PrefixBurst = max(1, int(cfg.PrefixQPS))
+	}
+	if cfg.MaxBuckets <= 0 {
+		cfg.MaxBuckets = 100000
+	}
+	return &RateLimiter{cfg: cfg, clients: map[string]*tokenBucket{}, prefixes: map[string]*tokenBucket{}}
+}
+
+// Allow reports whether a query from ip may be processed.
+func (l *RateLimiter) Allow(ip net.IP, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	if l.cfg.ClientQPS > 0 && !l.check(l.clients, ip.String(), "client", l.cfg.ClientQPS, l.cfg.ClientBurst, now) {
+		return false
+	}
+	if l.cfg.PrefixQPS > 0 {
+		prefix := clientPrefix(ip, l.cfg.IPv4Prefix, l.cfg.IPv6Prefix)
+		if !l.check(l.prefixes, prefix, "prefix", l.cfg.PrefixQPS, l.cfg.PrefixBurst, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *RateLimiter) check(buckets map[string]*tokenBucket, key, scope string, rate float64, burst int, now time.Time) bool {
+	b := buckets[key]
+	if b == nil && len(buckets) >= l.cfg.MaxBuckets {
+		// Table full: prune it now, though at most once a second. If
+		// that frees nothing, the sources past the bound share one
+		// bucket, so a flood of spoofed ones is still limited.
+		if now.Sub(l.lastSweep) >= time.Second {
+			l.prune(now)
+		}
+		if len(buckets) >= l.cfg.MaxBuckets {
+			key = overflowKey
+			b = buckets[key]
+		}
+	}
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		buckets[key] = b
+	}
+	if b.take(rate, burst, now) {
+		if b.throttled {
+			b.throttled = false
+			throttledClients.Add(-1)
+		}
+		return true
+	}
+
+	action := "drop"
+	if l.cfg.Refuse {
+		action = "refuse"
+	}
+	throttledQueries.With(scope, action).Inc()
+	if !b.throttled {
+		b.throttled = true
+		throttledClients.Add(1)
+		logRateLimit.Warn("throttling", "scope", scope, "key", key)
+	}
+	return false
+}
+
+// overflowKey is the bucket the sources that don't fit a full table
+// share. No address or prefix is written like it.
+const overflowKey = "overflow"
+
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) >= 10*time.Second {
+		l.prune(now)
+	}
+}
+
+// prune drops buckets that have refilled completely; they hold no state a
+// fresh bucket wouldn't.
+func (l *RateLimiter) prune(now time.Time) {
+	l.lastSweep = now
+	for _, m := range []struct {
+		buckets map[string]*tokenBucket
+		rate    float64
+		burst   int
+	}{{l.clients, l.cfg.ClientQPS, l.cfg.ClientBurst}, {l.prefixes, l.cfg.PrefixQPS, l.cfg.PrefixBurst}} {
+		for key, b := range m.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*m.rate >= float64(m.burst) {
+				if b.throttled {
+					throttledClients.Add(-1)
+				}
+				delete(m.buckets, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterFullTable(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{ClientQPS: 1, ClientBurst: 1, MaxBuckets: 10})
+	now := time.Now()
+	for i := range 10 {
+		l.Allow(net.ParseIP(fmt.Sprintf("192.0.2.%d", i)), now)
+	}
+
+	// The table is full of buckets still refilling, yet new sources are
+	// limited rather than let through.
+	newcomer := net.ParseIP("198.51.100.1")
+	if !l.Allow(newcomer, now) {
+		t.Fatal("the first query from a new source was refused")
+	}
+	if l.Allow(newcomer, now) {
+		t.Error("a new source past the full table went unlimited")
+	}
+	if l.Allow(net.ParseIP("198.51.100.2"), now) {
+		t.Error("another new source didn't share the overflow bucket")
+	}
+	if n := len(l.clients); n > 11 {
+		t.Errorf("the table holds %d buckets, want at most 11", n)
+	}
+
+	// Once the buckets have refilled, new sources get their own again.
+	later := now.Add(2 * time.Second)
+	if !l.Allow(net.ParseIP("198.51.100.3"), later) || !l.Allow(newcomer, later) {
+		t.Error("new sources were still limited after the table was pruned")
+	}
+}
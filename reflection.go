@@ -0,0 +1,213 @@
+package dnsserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Reflection attacks send UDP queries with the victim's address as source
+// and rely on the response being much larger than the query. A spoofing
+// attacker can neither complete a TCP handshake nor echo back a server
+// cookie (RFC 7873), so clients that did either recently are verified.
+// Large UDP responses to anyone else are sent truncated: a real client
+// retries over TCP, an attacker gets nothing to amplify.
+
+const (
+	ednsOptionCookie = 10
+	rcodeBadCookie   = 23
+
+	// Server cookies are accepted for an hour and not from more than five
+	// minutes in the future (RFC 9018 section 4.3).
+	cookieLifetime = time.Hour
+	cookieSkew     = 5 * time.Minute
+)
+
+var reflectionLimited = NewCounterVec("dns_reflection_limited_total", "UDP responses truncated or answered with BADCOOKIE to prevent reflection.", "reason")
+
+type ReflectionGuard struct {
+	// MaxUnverified is the largest UDP response sent to a client that is
+	// not verified; 0 disables the limit.
+	MaxUnverified int
+	// MaxAnyTXT caps UDP responses to ANY and TXT queries for everyone.
+	MaxAnyTXT int
+	// Cookies enables server cookies.
+	Cookies bool
+	// RequireCookie makes only a valid server cookie verify a client, not
+	// an earlier TCP connection.
+	RequireCookie bool
+	// VerifiedFor is how long a TCP connection verifies its client for.
+	VerifiedFor time.Duration
+
+	secret []byte
+
+	mu       sync.Mutex
+	verified map[string]time.Time
+}
+
+func NewReflectionGuard() *ReflectionGuard {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &ReflectionGuard{VerifiedFor: time.Hour, secret: secret, verified: map[string]time.Time{}}
+}
+
+func (g *ReflectionGuard) markVerified(ip net.IP, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.verified[ip.String()] = now
+	// Forget stale clients now and then so the map stays bounded by the
+	// number of clients seen within VerifiedFor.
+	if len(g.verified) > 1024 && len(g.verified)%1024 == 0 {
+		for k, t := range g.verified {
+			if now.Sub(t) > g.VerifiedFor {
+				delete(g.verified, k)
+			}
+		}
+	}
+}
+
+func (g *ReflectionGuard) tcpVerified(ip net.IP, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t, ok := g.verified[ip.String()]
+	return ok && now.Sub(t) <= g.VerifiedFor
+}
+
+// parseCookie returns the client and server cookie carried by m, if any.
+func parseCookie(m *Message) (client, server []byte, ok bool) {
+	opt := findOPT(m)
+	if opt == nil {
+		return nil, nil, false
+	}
+	data := ednsOption(opt.RData, ednsOptionCookie)
+	// An 8 byte client cookie, optionally followed by an 8 to 32 byte
+	// server cookie.
+	if len(data) != 8 && (len(data) < 16 || len(data) > 40) {
+		return nil, nil, false
+	}
+	return data[:8], data[8:], true
+}
+
+// ednsOption returns the data of the first option with code in OPT rdata.
+func ednsOption(rdata []byte, code uint16) []byte {
+	for len(rdata) >= 4 {
+		c := binary.BigEndian.Uint16(rdata)
+		n := int(binary.BigEndian.Uint16(rdata[2:]))
+		if len(rdata) < 4+n {
+			return nil
+		}
+		if c == code {
+			return rdata[4 : 4+n]
+		}
+		rdata = rdata[4+n:]
+	}
+	return nil
+}
+
+// serverCookie builds a cookie in the RFC 9018 layout: version 1, three
+// reserved bytes, a timestamp and an 8 byte hash. The hash is an HMAC
+// rather than SipHash, which only matters for sharing cookies with other
+// implementations.
+func (g *ReflectionGuard) serverCookie(client []byte, ip net.IP, ts uint32) []byte {
+	cookie := []byte{1, 0, 0, 0}
+	cookie = binary.BigEndian.AppendUint32(cookie, ts)
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(client)
+	mac.Write(cookie)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac.Write(ip)
+	return mac.Sum(cookie)[:16]
+}
+
+func (g *ReflectionGuard) validCookie(client, server []byte, ip net.IP, now time.Time) bool {
+	if len(server) != 16 || server[0] != 1 {
+		return false
+	}
+	ts := binary.BigEndian.Uint32(server[4:8])
+	age := now.Sub(time.Unix(int64(ts), 0))
+	if age > cookieLifetime || age < -cookieSkew {
+		return false
+	}
+	return bytes.Equal(server, g.serverCookie(client, ip, ts))
+}
+
+// Response prepares resp, the answer to m, for client: it adds a fresh
+// server cookie if m carried a client cookie, and limits large UDP
+// responses to clients that aren't verified. compress says whether resp
+// goes out compressed, so the size limits apply to what is sent.
+func (g *ReflectionGuard) Response(resp *Query, m *Message, client *server.Client, compress bool, now time.Time) *Query {
+	if g == nil {
+		return resp
+	}
+	clientCookie, serverCookie, hasCookie := parseCookie(m)
+	hasCookie = hasCookie && g.Cookies
+	cookieValid := hasCookie && g.validCookie(clientCookie, serverCookie, client.IP, now)
+
+	var reason string
+	if client.Stream {
+		g.markVerified(client.IP, now)
+	} else if g.MaxUnverified > 0 || g.MaxAnyTXT > 0 {
+		size := encodedSize(resp, compress)
+		anyTXT := len(m.Questions) > 0 && (m.Questions[0].QType == TypeANY || m.Questions[0].QType == TypeTXT)
+		verified := cookieValid || (!g.RequireCookie && g.tcpVerified(client.IP, now))
+		switch {
+		case g.MaxAnyTXT > 0 && anyTXT && size > g.MaxAnyTXT:
+			reason = "any_txt"
+		case g.MaxUnverified > 0 && !verified && size > g.MaxUnverified:
+			reason = "unverified"
+		}
+	}
+
+	var extRCode uint8
+	switch {
+	case reason == "unverified" && g.RequireCookie && hasCookie:
+		// The client speaks cookies; hand it one to retry with over UDP.
+		resp = errorResponse(m, rcodeBadCookie&0xF)
+		extRCode = rcodeBadCookie >> 4
+		reflectionLimited.With("badcookie").Inc()
+	case reason != "":
+		resp = truncated(resp)
+		reflectionLimited.With(reason).Inc()
+	}
+
+	if hasCookie {
+		cookie := append(append([]byte(nil), clientCookie...), g.serverCookie(clientCookie, client.IP, uint32(now.Unix()))...)
+		resp = withEDNSOption(resp, ednsOptionCookie, cookie, extRCode)
+	}
+	return resp
+}
+
+// withEDNSOption returns a copy of resp whose OPT record carries the option,
+// adding an OPT record if there is none.
+func withEDNSOption(resp *Query, code uint16, data []byte, extRCode uint8) *Query {
+	out := *resp
+	out.Additionals = nil
+	var opt *ResourceRecord
+	for _, rr := range resp.Additionals {
+		if rr.Type == TypeOPT {
+			c := *rr
+			opt = &c
+			rr = opt
+		}
+		out.Additionals = append(out.Additionals, rr)
+	}
+	if opt == nil {
+		opt = newEDNS(ednsUDPSize, false)
+		out.Additionals = append(out.Additionals, opt)
+	}
+	opt.RData = binary.BigEndian.AppendUint16(append([]byte(nil), opt.RData...), code)
+	opt.RData = binary.BigEndian.AppendUint16(opt.RData, uint16(len(data)))
+	opt.RData = append(opt.RData, data...)
+	opt.TTL = opt.TTL&0x00ffffff | uint32(extRCode)<<24
+	out.Header.ARCount = uint16(len(out.Additionals))
+	return &out
+}
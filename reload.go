@@ -0,0 +1,418 @@
+package dnsserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Settings can come from the command line and from a configuration file
+// with one flag per line, written without the leading dash:
+//
+//	# comments and blank lines are ignored
+//	resolver 1.1.1.1:53
+//	zone example.com=/etc/dns/example.com.zone
+//
+// Command line flags take precedence over the file. On SIGHUP the file is
+// read again and the settings in reloadableFlags are applied; the others
+// need a restart.
+
+// reloadableFlags are the settings that take effect without a restart.
+type reloadableFlags struct {
+	resolver     string
+	family       string
+	zones        listFlag
+	keyDir       string
+	acls         map[string]*string
+	listen       listFlag
+	groupACLs    listFlag
+	certGroups   listFlag
+	blocklists   listFlag
+	allowlists   listFlag
+	blockGroups  listFlag
+	blockClients listFlag
+	blockMode    string
+	sinkholeV4   string
+	sinkholeV6   string
+	profiles     listFlag
+	dhcpLeases   string
+	schedules    listFlag
+	scheduleTZ   string
+	blockSched   listFlag
+	allowSched   listFlag
+	localRecords listFlag
+	localTTL     uint
+	localData    listFlag
+	localZones   listFlag
+	tlsCert      string
+	tlsKey       string
+	tlsClientCA  string
+	noCompress   listFlag
+	// fs is the flag set the settings were registered with.
+	fs *flag.FlagSet
+}
+
+func (f *reloadableFlags) register(fs *flag.FlagSet) {
+	f.fs = fs
+	fs.StringVar(&f.resolver, "resolver", "", "The address of DNS resolver to use: an IPv4 or IPv6 address or a host name, with an optional port; transport=tcp&conns=N queries it over N pipelined TCP connections, as addr?transport=tcp")
+	fs.StringVar(&f.family, "resolver-family", "any", "Which address of a -resolver host name to use: "+strings.Join(resolverFamilies, ", "))
+	fs.Var(&f.zones, "zone", "Serve a zone authoritatively, as origin=path/to/zonefile, or origin=scheme://... for a zone backend built in or loaded with -plugin (repeatable)")
+	fs.StringVar(&f.keyDir, "key-dir", "", "Directory with K<zone>.+alg+tag.key/.private pairs used to sign served zones")
+	fs.Var(&f.listen, "listen", "Address to serve DNS on, optionally with per-listener ACLs as addr?allow-recursion=10.0.0.0/8; tls://addr and https://addr/path serve DoT and DoH and take client-cert=request|require; rcvbuf= and sndbuf= size the socket buffers (repeatable, default 127.0.0.1:2053)")
+	fs.Var(&f.certGroups, "cert-group", "Put clients whose certificate has this common name or SAN in a group, as identity=group (repeatable); the group selects the block group of the same name")
+	fs.Var(&f.groupACLs, "group-acl", "ACL overrides for a certificate group, as group?allow-recursion=any (repeatable)")
+	fs.Var(&f.blocklists, "blocklist", "Block the domains in a hosts file or domain list, as name=path-or-URL (repeatable)")
+	fs.Var(&f.allowlists, "allowlist", "Never block the domains in this file or URL (repeatable)")
+	fs.Var(&f.blockGroups, "block-group", "Define a group of blocklists, as group=list1,list2 (repeatable)")
+	fs.Var(&f.blockClients, "block-client", "Assign client networks to a block group, as networks=group (repeatable)")
+	fs.StringVar(&f.blockMode, "block-mode", "nxdomain", "How to answer blocked names: nxdomain, null (0.0.0.0 and ::) or sinkhole")
+	fs.StringVar(&f.sinkholeV4, "sinkhole-ipv4", "", "Address returned for blocked A queries in sinkhole mode")
+	fs.StringVar(&f.sinkholeV6, "sinkhole-ipv6", "", "Address returned for blocked AAAA queries in sinkhole mode")
+	fs.Var(&f.profiles, "profile", "Client profile with its own blocklists, safe search and logging, as name?client=networks&mac=addresses&key=tsig-key&cert-group=group&blocklists=list1,list2&safe-search=on&log=on|off|debug&schedule=name (repeatable, first match wins; a profile named default applies to other clients)")
+	fs.StringVar(&f.dhcpLeases, "dhcp-leases", "", "dnsmasq, ISC dhcpd or Kea lease file telling profiles the MAC address of clients")
+	fs.Var(&f.schedules, "schedule", "Times of the week, as name=days HH:MM-HH:MM, e.g. \"work=weekdays 09:00-17:00, sat 10:00-12:00\" (repeatable); blocklists, allowlists, profiles and firewall rules can be limited to them")
+	fs.StringVar(&f.scheduleTZ, "schedule-timezone", "", "Time zone schedules are in, e.g. Europe/Berlin (default the local one)")
+	fs.Var(&f.blockSched, "blocklist-schedule", "Only apply a blocklist during a schedule, as list=schedule (repeatable)")
+	fs.Var(&f.allowSched, "allowlist-schedule", "Only apply an allowlist during a schedule, as file-or-URL=schedule (repeatable)")
+	fs.Var(&f.localRecords, "local-record", "Answer a name outside the served zones, when there is no -resolver, with these addresses, as name=addr1,addr2?ttl=seconds (repeatable); other names get NXDOMAIN")
+	fs.UintVar(&f.localTTL, "local-ttl", 60, "TTL of -local-record answers that don't set one")
+	fs.Var(&f.localData, "local-data", "Answer with this record, in zone file syntax, e.g. \"printer.lan A 192.168.1.50\", before the cache and forwarding (repeatable)")
+	fs.Var(&f.localZones, "local-zone", "How names at and below a zone are answered from -local-data, as \"zone type\" with type transparent, typetransparent, static, redirect, refuse, deny, always_transparent, always_refuse or always_nxdomain (repeatable)")
+	fs.StringVar(&f.tlsCert, "tls-cert", "", "Certificate file for tls:// and https:// listeners")
+	fs.StringVar(&f.tlsKey, "tls-key", "", "Private key file for tls:// and https:// listeners")
+	fs.StringVar(&f.tlsClientCA, "tls-client-ca", "", "CA certificates client certificates are verified against")
+	fs.Var(&f.noCompress, "no-compression", "Send responses without name compression to some clients or with some record types, as clients=networks&types=SRV,MX, or all (repeatable)")
+	f.acls = map[string]*string{}
+	for _, c := range server.Capabilities {
+		for _, verb := range []string{"allow", "deny"} {
+			name := verb + "-" + string(c)
+			usage := fmt.Sprintf("Comma separated networks denied %s, overriding -allow-%s", c, c)
+			if verb == "allow" {
+				usage = fmt.Sprintf("Comma separated networks allowed %s; also any, none, localhost, private (default %s)", c, server.DefaultACLs[c])
+			}
+			f.acls[name] = fs.String(name, "", usage)
+		}
+	}
+}
+
+// settings returns the reloadable settings by name.
+func (f *reloadableFlags) settings() map[string]string {
+	names := flag.NewFlagSet("", flag.ContinueOnError)
+	(&reloadableFlags{}).register(names)
+	out := map[string]string{}
+	names.VisitAll(func(fl *flag.Flag) {
+		out[fl.Name] = f.fs.Lookup(fl.Name).Value.String()
+	})
+	return out
+}
+
+// serverConfig is the part of the configuration a reload replaces. Queries
+// use whichever one was current when they arrived.
+type serverConfig struct {
+	resolver *net.UDPAddr
+	// resolverTCP is the number of connections to query the resolver over
+	// with transport=tcp, or 0 to query it over UDP.
+	resolverTCP int
+	zones       *ZoneSet
+	listeners   []*server.ListenerSpec
+	// tlsConfigs holds the TLS configuration of each encrypted listener.
+	tlsConfigs []*tls.Config
+	certGroups CertGroups
+	blocker    *Blocker
+	profiles   *Profiles
+	schedules  Schedules
+	local      *LocalRecords
+	localData  *LocalData
+	// noCompression lists the responses sent without name compression.
+	noCompression NoCompression
+	// settings are the reloadable settings the configuration was built
+	// from, to audit what a reload changes.
+	settings map[string]string
+}
+
+var liveConfig atomic.Pointer[serverConfig]
+
+func currentConfig() *serverConfig {
+	return liveConfig.Load()
+}
+
+// build loads everything f refers to. newSigner returns the signer for
+// a zone with keys, which uses resolver to poll the parent.
+func (f *reloadableFlags) build(minimal bool, newSigner func(keys []*SigningKey, resolver *net.UDPAddr) *ZoneSigner) (*serverConfig, error) {
+	cfg := &serverConfig{settings: f.settings()}
+	if f.resolver != "" {
+		spec, params, _ := strings.Cut(f.resolver, "?")
+		addr, err := resolveUpstream(spec, f.family)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -resolver %q: %v", f.resolver, err)
+		}
+		if cfg.resolverTCP, err = parseResolverOptions(params); err != nil {
+			return nil, fmt.Errorf("invalid -resolver %q: %v", f.resolver, err)
+		}
+		cfg.resolver = addr
+	}
+
+	acls := NewACLSet()
+	for name, list := range f.acls {
+		if *list == "" {
+			continue
+		}
+		verb, c, _ := strings.Cut(name, "-")
+		if err := acls.Set(Capability(c), verb == "deny", *list); err != nil {
+			return nil, fmt.Errorf("invalid -%s: %v", name, err)
+		}
+	}
+	listen := f.listen
+	if len(listen) == 0 {
+		listen = listFlag{"127.0.0.1:2053"}
+	}
+	var base *tls.Config
+	if f.tlsCert != "" || f.tlsKey != "" {
+		c, err := loadTLSConfig(f.tlsCert, f.tlsKey, f.tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		base = c
+	}
+	for _, spec := range listen {
+		l, err := parseListener(spec, acls)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range f.groupACLs {
+			group, params, _ := strings.Cut(spec, "?")
+			if err := l.AddGroup(group, params); err != nil {
+				return nil, fmt.Errorf("invalid -group-acl %q: %v", spec, err)
+			}
+		}
+		var tlsConfig *tls.Config
+		if l.Transport != "udp" {
+			if tlsConfig, err = listenerTLSConfig(base, l); err != nil {
+				return nil, err
+			}
+		}
+		cfg.listeners = append(cfg.listeners, l)
+		cfg.tlsConfigs = append(cfg.tlsConfigs, tlsConfig)
+	}
+	for _, spec := range f.certGroups {
+		if err := cfg.certGroups.Add(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	loc := time.Local
+	if f.scheduleTZ != "" {
+		l, err := time.LoadLocation(f.scheduleTZ)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -schedule-timezone: %v", err)
+		}
+		loc = l
+	}
+	cfg.schedules = Schedules{}
+	for _, spec := range f.schedules {
+		s, err := ParseSchedule(spec, loc)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cfg.schedules[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate schedule %q", s.Name)
+		}
+		cfg.schedules[s.Name] = s
+	}
+
+	// The blocker is needed even without lists, for domains blocked
+	// through the control socket.
+	b, err := newBlocker(BlockMode(f.blockMode), f.sinkholeV4, f.sinkholeV6,
+		f.blocklists, f.allowlists, f.blockGroups, f.blockClients)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range f.blockSched {
+		name, sched, _ := strings.Cut(spec, "=")
+		l, ok := b.listNames[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid -blocklist-schedule %q: unknown blocklist %q", spec, name)
+		}
+		if l.Schedule, err = cfg.schedules.Lookup(sched); err != nil {
+			return nil, fmt.Errorf("invalid -blocklist-schedule %q: %v", spec, err)
+		}
+	}
+	for _, spec := range f.allowSched {
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid -allowlist-schedule %q: want source=schedule", spec)
+		}
+		found := false
+		for _, l := range b.allow {
+			if l.Source == spec[:i] {
+				if l.Schedule, err = cfg.schedules.Lookup(spec[i+1:]); err != nil {
+					return nil, fmt.Errorf("invalid -allowlist-schedule %q: %v", spec, err)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid -allowlist-schedule %q: no -allowlist %q", spec, spec[:i])
+		}
+	}
+	if len(f.profiles) > 0 {
+		cfg.profiles = &Profiles{}
+		if f.dhcpLeases != "" {
+			if cfg.profiles.Leases, err = NewDHCPLeases(f.dhcpLeases); err != nil {
+				return nil, err
+			}
+		}
+		for _, spec := range f.profiles {
+			p, err := ParseProfile(spec)
+			if err != nil {
+				return nil, err
+			}
+			if p.Schedule, err = cfg.schedules.Lookup(p.scheduleName); err != nil {
+				return nil, fmt.Errorf("profile %s: %v", p.Name, err)
+			}
+			if err := cfg.profiles.Add(p); err != nil {
+				return nil, err
+			}
+			if p.Blocklists == nil {
+				continue
+			}
+			// The profile's lists make a block group of its own.
+			if _, ok := b.groups[p.Name]; ok {
+				return nil, fmt.Errorf("profile %s: a -block-group has the same name", p.Name)
+			}
+			if err := b.AddGroup(p.Name, p.Blocklists); err != nil {
+				return nil, fmt.Errorf("profile %s: %v", p.Name, err)
+			}
+		}
+	}
+	b.Load()
+	cfg.blocker = b
+
+	cfg.localData = &LocalData{}
+	for _, spec := range f.localData {
+		if err := cfg.localData.AddData(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range f.localZones {
+		if err := cfg.localData.AddZone(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.noCompression, err = ParseNoCompression(f.noCompress); err != nil {
+		return nil, err
+	}
+
+	cfg.local = &LocalRecords{TTL: uint32(f.localTTL)}
+	for _, spec := range f.localRecords {
+		if err := cfg.local.Add(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	zones, err := loadZones(f.zones, f.keyDir, func(keys []*SigningKey) *ZoneSigner {
+		return newSigner(keys, cfg.resolver)
+	})
+	if err != nil {
+		return nil, err
+	}
+	zones.Minimal = minimal
+	cfg.zones = zones
+	return cfg, nil
+}
+
+// replace makes next the current configuration if its listeners are the
+// ones already bound, which can't change without a restart. The zones of
+// the configuration replaced stop their background work, and those of
+// next start theirs; a configuration that is never used starts none.
+func (c *serverConfig) replace(next *serverConfig) error {
+	if len(next.listeners) != len(c.listeners) {
+		return fmt.Errorf("the listeners changed, which needs a restart")
+	}
+	for i, l := range next.listeners {
+		old := c.listeners[i]
+		if l.Addr != old.Addr || l.Transport != old.Transport || l.Path != old.Path {
+			return fmt.Errorf("listener %s changed, which needs a restart", old.Addr)
+		}
+	}
+	if !liveConfig.CompareAndSwap(c, next) {
+		return fmt.Errorf("the configuration changed concurrently")
+	}
+	c.zones.Retire()
+	next.zones.Start()
+	return nil
+}
+
+// applyConfigFile sets the flags in fs from the configuration file at
+// path, leaving the ones given on the command line alone.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		// unbound style "name: value" lines work too.
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "-"), ":")
+		if explicit[name] {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+		if err := fs.Set(name, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s: %v", path, n, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// ignoredFlag stands in for settings that can't be reloaded.
+type ignoredFlag bool
+
+func (ignoredFlag) String() string     { return "" }
+func (ignoredFlag) Set(string) error   { return nil }
+func (f ignoredFlag) IsBoolFlag() bool { return bool(f) }
+
+// reloadFlags reads the reloadable settings again from the command line
+// and the configuration file, if there is one.
+func reloadFlags(configPath string) (*reloadableFlags, error) {
+	f := &reloadableFlags{}
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f.register(fs)
+	flag.VisitAll(func(fl *flag.Flag) {
+		if fs.Lookup(fl.Name) == nil {
+			b, ok := fl.Value.(interface{ IsBoolFlag() bool })
+			fs.Var(ignoredFlag(ok && b.IsBoolFlag()), fl.Name, "")
+		}
+	})
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	if configPath != "" {
+		if err := applyConfigFile(fs, configPath); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,138 @@
+package dnsserver
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// buildConfig builds the configuration the reloadable flags in args
+// describe.
+func buildConfig(t *testing.T, args ...string) *serverConfig {
+	t.Helper()
+	f := &reloadableFlags{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := f.build(false, func([]*SigningKey, *net.UDPAddr) *ZoneSigner { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// writeZone writes testZoneFile to a new directory, returning the -zone
+// value and the directory.
+func writeZone(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.zone")
+	if err := os.WriteFile(path, []byte(testZoneFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return "example.com=" + path, dir
+}
+
+// writeSignedZone is writeZone with a signing key for the zone in the
+// directory, which is the key directory.
+func writeSignedZone(t *testing.T) (string, string) {
+	t.Helper()
+	spec, dir := writeZone(t)
+	k, err := GenerateSigningKey(AlgECDSAP256SHA256, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteKeyPair(dir, "example.com", k); err != nil {
+		t.Fatal(err)
+	}
+	return spec, dir
+}
+
+func TestLoadZonesDefersMaintenance(t *testing.T) {
+	spec, keyDir := writeSignedZone(t)
+	before := runtime.NumGoroutine()
+	zones, err := loadZones([]string{spec}, keyDir, func(keys []*SigningKey) *ZoneSigner {
+		return &ZoneSigner{Keys: keys}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z := zones.Find("example.com"); z == nil || z.signer == nil {
+		t.Fatal("example.com wasn't loaded signed")
+	}
+	// A configuration that fails to replace the live one is dropped, so
+	// loading it must leave nothing running.
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("loading the zones started %d goroutines", n-before)
+	}
+	zones.Start()
+	defer zones.Retire()
+	if n := runtime.NumGoroutine(); n <= before {
+		t.Error("Start didn't start key maintenance")
+	}
+}
+
+func TestReplaceConfig(t *testing.T) {
+	dir := t.TempDir()
+	zone := func(name, address string) string {
+		path := filepath.Join(dir, name)
+		data := strings.Replace(testZoneFile, "www  IN A 192.0.2.10", "www  IN A "+address, 1)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return "example.com=" + path
+	}
+	p := &Pipeline{}
+	if err := p.Build(nil); err != nil {
+		t.Fatal(err)
+	}
+	answer := func() string {
+		resp := serveQuery(t, p, "www.example.com", TypeA)
+		if len(resp.Answers) != 1 {
+			t.Fatalf("%d answers", len(resp.Answers))
+		}
+		return net.IP(resp.Answers[0].RData).String()
+	}
+
+	first := buildConfig(t, "-zone", zone("first.zone", "192.0.2.10"))
+	liveConfig.Store(first)
+	defer liveConfig.Store(nil)
+	if got := answer(); got != "192.0.2.10" {
+		t.Fatalf("answered %s from the first configuration", got)
+	}
+	second := buildConfig(t, "-zone", zone("second.zone", "192.0.2.20"))
+	if err := first.replace(second); err != nil {
+		t.Fatal(err)
+	}
+	if got := answer(); got != "192.0.2.20" {
+		t.Errorf("answered %s after the reload, want 192.0.2.20", got)
+	}
+
+	for _, tc := range []struct {
+		name string
+		from *serverConfig
+		args []string
+		err  string
+	}{
+		{"listener added", second, []string{"-listen", "127.0.0.1:2053", "-listen", "127.0.0.1:2054"}, "the listeners changed"},
+		{"listener moved", second, []string{"-listen", "127.0.0.1:2054"}, "listener 127.0.0.1:2053 changed"},
+		{"replaced already", first, nil, "changed concurrently"},
+	} {
+		next := buildConfig(t, append(tc.args, "-zone", zone(tc.name, "192.0.2.30"))...)
+		if err := tc.from.replace(next); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: replace = %v, want an error containing %q", tc.name, err, tc.err)
+		}
+		if currentConfig() != second {
+			t.Errorf("%s: the live configuration changed", tc.name)
+		}
+	}
+	if got := answer(); got != "192.0.2.20" {
+		t.Errorf("answered %s after the failed reloads, want 192.0.2.20", got)
+	}
+}
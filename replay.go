@@ -0,0 +1,417 @@
+package dnsserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// replayQuery is a query read from a query log or a capture, with the
+// response it got then, if that was recorded.
+type replayQuery struct {
+	// data is the query as captured; queries from a log are built from
+	// name and qtype.
+	data  []byte
+	name  string
+	qtype uint16
+
+	known   bool
+	rcode   string
+	answers []string
+}
+
+func (q *replayQuery) wire() ([]byte, error) {
+	if q.data != nil {
+		return append([]byte(nil), q.data...), nil
+	}
+	return dnswire.NewQuery(q.name, q.qtype).Encode()
+}
+
+// readReplayQueries reads a query log in any of its formats, or a pcap
+// file, telling them apart by their content when format is auto.
+func readReplayQueries(path, format string, port int) ([]*replayQuery, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == "auto" {
+		format = detectReplayFormat(data)
+	}
+	switch format {
+	case "pcap":
+		return readPcapQueries(data, port)
+	case "text", "json", "csv":
+		return readLogQueries(bytes.NewReader(data), format)
+	}
+	return nil, fmt.Errorf("invalid format %q, want auto, text, json, csv or pcap", format)
+}
+
+func detectReplayFormat(data []byte) string {
+	if len(data) >= 4 {
+		switch binary.LittleEndian.Uint32(data) {
+		case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+			return "pcap"
+		}
+	}
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	switch {
+	case bytes.HasPrefix(line, []byte("{")):
+		return "json"
+	case bytes.Count(line, []byte(",")) >= 8 && !bytes.Contains(line, []byte(" cache=")):
+		return "csv"
+	}
+	return "text"
+}
+
+func readLogQueries(r io.Reader, format string) ([]*replayQuery, error) {
+	var out []*replayQuery
+	add := func(n int, name, qtype, rcode string, answers []string) error {
+		t, ok := dnswire.ParseType(qtype)
+		if !ok {
+			return fmt.Errorf("line %d: unknown type %q", n, qtype)
+		}
+		q := &replayQuery{name: normalizeName(name), qtype: t}
+		if rcode != "DROPPED" {
+			q.known, q.rcode, q.answers = true, rcode, answers
+		}
+		out = append(out, q)
+		return nil
+	}
+
+	if format == "csv" {
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, rec := range records {
+			if len(rec) < 7 {
+				return nil, fmt.Errorf("line %d: want at least 7 fields", i+1)
+			}
+			var answers []string
+			if rec[6] != "" {
+				answers = strings.Split(rec[6], "; ")
+			}
+			if err := add(i+1, rec[3], rec[4], rec[5], answers); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if format == "json" {
+			var e queryLogEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			if err := add(n, e.Name, e.Type, e.RCode, e.Answers); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// time client protocol qname qtype rcode cache=... duration answers
+		fields := strings.SplitN(line, " ", 9)
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("line %d: want at least 9 fields", n)
+		}
+		var answers []string
+		if fields[8] != "-" {
+			answers = strings.Split(fields[8], ", ")
+		}
+		if err := add(n, fields[3], fields[4], fields[5], answers); err != nil {
+			return nil, err
+		}
+	}
+	return out, scanner.Err()
+}
+
+// readPcapQueries returns the DNS queries in a capture, with the responses
+// captured for them. Only UDP is read; port, if not 0, selects the server
+// port whose queries are replayed.
+func readPcapQueries(data []byte, port int) ([]*replayQuery, error) {
+	if len(data) < 24 {
+		return nil, fmt.Errorf("pcap file too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if m := binary.BigEndian.Uint32(data); m == 0xa1b2c3d4 || m == 0xa1b23c4d {
+		order = binary.BigEndian
+	}
+	linkType := order.Uint32(data[20:])
+
+	type flow struct {
+		client, server string
+		id             uint16
+	}
+	var out []*replayQuery
+	pending := map[flow]*replayQuery{}
+	for off := 24; off+16 <= len(data); {
+		caplen := int(order.Uint32(data[off+8:]))
+		off += 16
+		if off+caplen > len(data) {
+			break
+		}
+		frame := data[off : off+caplen]
+		off += caplen
+
+		src, srcPort, dst, dstPort, payload, ok := udpPayload(frame, linkType)
+		if !ok {
+			continue
+		}
+		m, err := dnswire.ParseMessage(payload)
+		if err != nil || len(m.Questions) == 0 {
+			continue
+		}
+		if !m.Header.QR {
+			if port != 0 && dstPort != port {
+				continue
+			}
+			q := &replayQuery{data: payload, name: normalizeName(m.Questions[0].Name), qtype: m.Questions[0].QType}
+			pending[flow{net.JoinHostPort(src, fmt.Sprint(srcPort)), net.JoinHostPort(dst, fmt.Sprint(dstPort)), m.Header.ID}] = q
+			out = append(out, q)
+			continue
+		}
+		key := flow{net.JoinHostPort(dst, fmt.Sprint(dstPort)), net.JoinHostPort(src, fmt.Sprint(srcPort)), m.Header.ID}
+		if q, ok := pending[key]; ok {
+			q.known, q.rcode, q.answers = true, dnswire.RCodeString(m.Header.RCode), answerSummary(m.Answers)
+			delete(pending, key)
+		}
+	}
+	return out, nil
+}
+
+// udpPayload extracts the addresses and payload of a UDP packet from a
+// frame of the given pcap link type.
+func udpPayload(frame []byte, linkType uint32) (src string, srcPort int, dst string, dstPort int, payload []byte, ok bool) {
+	switch linkType {
+	case 0: // BSD loopback
+		if len(frame) < 4 {
+			return
+		}
+		frame = frame[4:]
+	case 1: // Ethernet
+		if len(frame) < 14 {
+			return
+		}
+		etherType, n := binary.BigEndian.Uint16(frame[12:]), 14
+		if etherType == 0x8100 && len(frame) >= 18 {
+			n = 18
+		}
+		frame = frame[n:]
+	case 101: // raw IP
+	case 113: // Linux cooked capture
+		if len(frame) < 16 {
+			return
+		}
+		frame = frame[16:]
+	case 276: // Linux cooked capture v2
+		if len(frame) < 20 {
+			return
+		}
+		frame = frame[20:]
+	default:
+		return
+	}
+	if len(frame) < 1 {
+		return
+	}
+	var udp []byte
+	switch frame[0] >> 4 {
+	case 4:
+		ihl := int(frame[0]&0x0f) * 4
+		if len(frame) < ihl+8 || frame[9] != 17 {
+			return
+		}
+		src, dst = net.IP(frame[12:16]).String(), net.IP(frame[16:20]).String()
+		udp = frame[ihl:]
+	case 6:
+		if len(frame) < 48 || frame[6] != 17 {
+			return
+		}
+		src, dst = net.IP(frame[8:24]).String(), net.IP(frame[24:40]).String()
+		udp = frame[40:]
+	default:
+		return
+	}
+	srcPort, dstPort = int(binary.BigEndian.Uint16(udp)), int(binary.BigEndian.Uint16(udp[2:]))
+	return src, srcPort, dst, dstPort, udp[8:], true
+}
+
+type replayResult struct {
+	query   *replayQuery
+	err     error
+	took    time.Duration
+	rcode   string
+	answers []string
+}
+
+// matches reports whether r got the response recorded for its query.
+// Answers are compared in any order, since servers rotate them.
+func (r *replayResult) matches() bool {
+	return r.rcode == r.query.rcode && sameAnswers(r.answers, r.query.answers)
+}
+
+func sameAnswers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	sort.Strings(a)
+	sort.Strings(b)
+	return slices.Equal(a, b)
+}
+
+func replayOne(conn *net.UDPConn, q *replayQuery, timeout time.Duration) *replayResult {
+	r := &replayResult{query: q}
+	data, err := q.wire()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	id := uint16(rand.Uint32())
+	binary.BigEndian.PutUint16(data, id)
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, r.err = conn.Write(data); r.err != nil {
+		return r
+	}
+	read := server.GetBuffer(65535)
+	defer server.PutBuffer(read)
+	buf := *read
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		resp, err := dnswire.ParseMessage(buf[:n])
+		if err != nil || resp.Header.ID != id {
+			continue // late answer to an earlier query
+		}
+		r.took = time.Since(start)
+		r.rcode, r.answers = dnswire.RCodeString(resp.Header.RCode), answerSummary(resp.Answers)
+		return r
+	}
+}
+
+// runReplay sends the queries from a query log or capture to a server at
+// a steady rate and compares the responses with the recorded ones.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:53", "Server to send the queries to")
+	format := fs.String("format", "auto", "Input format: auto, text, json or csv query logs, or pcap")
+	port := fs.Int("port", 0, "For pcap input, only replay queries sent to this port (0 replays all)")
+	rate := fs.Float64("rate", 100, "Queries per second (0 sends as fast as -concurrency allows)")
+	concurrency := fs.Int("concurrency", 10, "Queries in flight at once")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for each response")
+	show := fs.Int("show", 10, "How many mismatched responses to print")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server replay [flags] file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	queries, err := readReplayQueries(fs.Arg(0), *format, *port)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", *target)
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan *replayQuery)
+	results := make(chan *replayResult)
+	var wg sync.WaitGroup
+	for range max(*concurrency, 1) {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for q := range jobs {
+				results <- replayOne(conn, q, *timeout)
+			}
+		}()
+	}
+	start := time.Now()
+	go func() {
+		for i, q := range queries {
+			if *rate > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(i) / *rate * float64(time.Second)))))
+			}
+			jobs <- q
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var answered, failed, matched, mismatched, unverified int
+	var latencies []time.Duration
+	for r := range results {
+		if r.err != nil {
+			failed++
+			continue
+		}
+		answered++
+		latencies = append(latencies, r.took)
+		switch {
+		case !r.query.known:
+			unverified++
+		case r.matches():
+			matched++
+		default:
+			mismatched++
+			if mismatched <= *show {
+				fmt.Printf("mismatch %s %s: want %s %s, got %s %s\n", fqdn(r.query.name), dnswire.TypeString(r.query.qtype),
+					r.query.rcode, strings.Join(r.query.answers, ", "), r.rcode, strings.Join(r.answers, ", "))
+			}
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("queries=%d\n", len(queries))
+	fmt.Printf("answered=%d\n", answered)
+	fmt.Printf("failed=%d\n", failed)
+	fmt.Printf("matched=%d\n", matched)
+	fmt.Printf("mismatched=%d\n", mismatched)
+	fmt.Printf("unverified=%d\n", unverified)
+	fmt.Printf("qps=%.1f\n", float64(len(queries))/elapsed.Seconds())
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		for _, p := range []int{50, 90, 99} {
+			fmt.Printf("latency.p%d=%s\n", p, latencies[(len(latencies)-1)*p/100])
+		}
+		fmt.Printf("latency.max=%s\n", latencies[len(latencies)-1])
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package dnsserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// Rewrite rules, in the spirit of CoreDNS's rewrite plugin:
+//
+//	name exact old.example.com new.example.com
+//	name suffix old.example new.example
+//	name regex (.*)\.old\.example {1}.new.example answer (.*)\.new\.example {1}.old.example
+//	ttl suffix example.com 30
+//	address 10.0.0.1 192.168.0.1
+//
+// Name rules rewrite the question before it is resolved; the client gets
+// its original question back, and answer owner names and CNAME targets are
+// mapped back too (automatically for exact and suffix rules, via the answer
+// clause for regex rules). TTL rules match the original question name.
+// Address rules replace A and AAAA data in answers.
+
+type rewriteMatch string
+
+const (
+	matchExact  rewriteMatch = "exact"
+	matchSuffix rewriteMatch = "suffix"
+	matchRegex  rewriteMatch = "regex"
+)
+
+type RewriteRule struct {
+	Kind  string
+	Match rewriteMatch
+	From  string
+	To    string
+	re    *regexp.Regexp
+
+	answerRe *regexp.Regexp
+	answerTo string
+
+	TTL    uint32
+	FromIP net.IP
+	ToIP   net.IP
+}
+
+var braceGroup = regexp.MustCompile(`\{(\d+)\}`)
+
+func compileRewriteRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?i:" + strings.TrimSuffix(pattern, "$") + ")$")
+}
+
+func ParseRewriteRule(spec string) (*RewriteRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty rewrite rule")
+	}
+	r := &RewriteRule{Kind: fields[0]}
+	switch r.Kind {
+	case "name", "ttl":
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("rewrite %q: want %s exact|suffix|regex FROM TO", spec, r.Kind)
+		}
+		r.Match = rewriteMatch(fields[1])
+		r.From, r.To = fields[2], fields[3]
+		switch r.Match {
+		case matchExact, matchSuffix:
+			r.From = normalizeName(r.From)
+			if r.Kind == "name" {
+				r.To = normalizeName(r.To)
+			}
+		case matchRegex:
+			re, err := compileRewriteRegex(r.From)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite %q: %v", spec, err)
+			}
+			r.re = re
+			r.To = braceGroup.ReplaceAllString(r.To, "$${$1}")
+		default:
+			return nil, fmt.Errorf("rewrite %q: unknown match type %q", spec, r.Match)
+		}
+		rest := fields[4:]
+		if r.Kind == "ttl" {
+			ttl, err := strconv.ParseUint(r.To, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite %q: invalid TTL %q", spec, r.To)
+			}
+			r.TTL = uint32(ttl)
+		} else if len(rest) > 0 {
+			if len(rest) != 3 || rest[0] != "answer" || r.Match != matchRegex {
+				return nil, fmt.Errorf("rewrite %q: only regex name rules take an answer clause, as answer REGEX REPLACEMENT", spec)
+			}
+			re, err := compileRewriteRegex(rest[1])
+			if err != nil {
+				return nil, fmt.Errorf("rewrite %q: %v", spec, err)
+			}
+			r.answerRe = re
+			r.answerTo = braceGroup.ReplaceAllString(rest[2], "$${$1}")
+			rest = nil
+		}
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("rewrite %q: unexpected %q", spec, strings.Join(rest, " "))
+		}
+	case "address":
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("rewrite %q: want address FROM TO", spec)
+		}
+		r.FromIP, r.ToIP = net.ParseIP(fields[1]), net.ParseIP(fields[2])
+		if r.FromIP == nil || r.ToIP == nil || (r.FromIP.To4() == nil) != (r.ToIP.To4() == nil) {
+			return nil, fmt.Errorf("rewrite %q: want two addresses of the same family", spec)
+		}
+	default:
+		return nil, fmt.Errorf("rewrite %q: unknown rule type %q", spec, r.Kind)
+	}
+	return r, nil
+}
+
+// matches reports whether name (normalized) is selected by the rule.
+func (r *RewriteRule) matches(name string) bool {
+	switch r.Match {
+	case matchExact:
+		return name == r.From
+	case matchSuffix:
+		return inZone(name, r.From)
+	case matchRegex:
+		return r.re.MatchString(name)
+	}
+	return false
+}
+
+func (r *RewriteRule) rewriteName(name string) string {
+	switch r.Match {
+	case matchExact:
+		return r.To
+	case matchSuffix:
+		return joinName(strings.TrimSuffix(strings.TrimSuffix(name, r.From), "."), r.To)
+	}
+	return normalizeName(r.re.ReplaceAllString(name, r.To))
+}
+
+// reverseName maps an answer owner name back into the client's namespace.
+func (r *RewriteRule) reverseName(name string) (string, bool) {
+	switch r.Match {
+	case matchExact:
+		return r.From, name == r.To
+	case matchSuffix:
+		if !inZone(name, r.To) {
+			return "", false
+		}
+		return joinName(strings.TrimSuffix(strings.TrimSuffix(name, r.To), "."), r.From), true
+	}
+	if r.answerRe == nil || !r.answerRe.MatchString(name) {
+		return "", false
+	}
+	return normalizeName(r.answerRe.ReplaceAllString(name, r.answerTo)), true
+}
+
+func joinName(prefix, suffix string) string {
+	switch {
+	case prefix == "":
+		return suffix
+	case suffix == "":
+		return prefix
+	}
+	return prefix + "." + suffix
+}
+
+type Rewriter struct {
+	Rules []*RewriteRule
+}
+
+func (rw *Rewriter) Add(spec string) error {
+	r, err := ParseRewriteRule(spec)
+	if err != nil {
+		return err
+	}
+	rw.Rules = append(rw.Rules, r)
+	return nil
+}
+
+// LoadFile adds the rules in path, one per line; # starts a comment.
+func (rw *Rewriter) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if err := rw.Add(text); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// rewriteState remembers what Request changed so Response can undo it.
+type rewriteState struct {
+	rw        *Rewriter
+	questions []*Question
+	original  string
+	nameRules []*RewriteRule
+	// cname, if set, is a CNAME from the client's question to the name
+	// asked instead, answered in front of that name's records.
+	cname *ResourceRecord
+}
+
+// Request applies name rules to m's questions in place. The returned state
+// must be applied to the response; it is nil when no rule can apply.
+func (rw *Rewriter) Request(m *Message) *rewriteState {
+	if rw == nil || len(rw.Rules) == 0 || len(m.Questions) == 0 {
+		return nil
+	}
+	st := &rewriteState{rw: rw, questions: m.Questions, original: normalizeName(m.Questions[0].Name)}
+	rewritten := make([]*Question, len(m.Questions))
+	for i, q := range m.Questions {
+		name := normalizeName(q.Name)
+		for _, r := range rw.Rules {
+			if r.Kind == "name" && r.matches(name) {
+				name = r.rewriteName(name)
+				if i == 0 {
+					st.nameRules = append(st.nameRules, r)
+				}
+			}
+		}
+		rewritten[i] = &Question{Name: name, QType: q.QType, QClass: q.QClass}
+		if name == normalizeName(q.Name) {
+			rewritten[i].Name = q.Name
+		}
+	}
+	m.Questions = rewritten
+	return st
+}
+
+// Response restores the client's questions and applies answer rules.
+func (st *rewriteState) Response(resp *Query) {
+	if st == nil {
+		return
+	}
+	resp.Questions = st.questions
+	if st.cname != nil {
+		resp.Answers = append([]*ResourceRecord{st.cname}, resp.Answers...)
+		resp.Header.ANCount = uint16(len(resp.Answers))
+		return
+	}
+	// Answers may be shared with zone data, so rewrite copies.
+	answers := make([]*ResourceRecord, len(resp.Answers))
+	for i, orig := range resp.Answers {
+		rr := *orig
+		answers[i] = &rr
+		if name := st.reverse(rr.Name); name != normalizeName(rr.Name) {
+			rr.Name = name
+		}
+		// Keep CNAME chains intact by mapping targets back as well.
+		if rr.Type == TypeCNAME {
+			target := normalizeName(rdataName(rr.RData, 0))
+			if name := st.reverse(target); name != target {
+				// A target the rules can't map back to a valid name is
+				// left as it was.
+				if rdata, err := dnswire.AppendName(nil, name, nil); err == nil {
+					rr.RData = rdata
+				}
+			}
+		}
+		for _, r := range st.rw.Rules {
+			switch {
+			case r.Kind == "ttl" && r.matches(st.original):
+				rr.TTL = r.TTL
+			case r.Kind == "address" && (rr.Type == TypeA || rr.Type == TypeAAAA):
+				if net.IP(rr.RData).Equal(r.FromIP) {
+					if rr.Type == TypeA {
+						rr.RData = r.ToIP.To4()
+					} else {
+						rr.RData = r.ToIP.To16()
+					}
+				}
+			}
+		}
+	}
+	resp.Answers = answers
+}
+
+func (st *rewriteState) reverse(name string) string {
+	name = normalizeName(name)
+	for i := len(st.nameRules) - 1; i >= 0; i-- {
+		if n, ok := st.nameRules[i].reverseName(name); ok {
+			name = n
+		}
+	}
+	return name
+}
@@ -0,0 +1,180 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RRLConfig struct {
+	ResponsesPerSecond int
+	NXDomainsPerSecond int
+	ErrorsPerSecond    int
+	// Window is how far back over-limit traffic is remembered.
+	Window time.Duration
+	// Slip sends every Nth limited response as an empty truncated answer
+	// so genuine clients can retry over TCP. 0 never slips.
+	Slip       int
+	IPv4Prefix int
+	IPv6Prefix int
+	LogOnly    bool
+	MaxBuckets int
+}
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+type rrlBucket struct {
+	balance float64
+	last    time.Time
+	limited int
+	logged  bool
+}
+
+// RRL implements response rate limiting in the style of BIND: responses
+// are accounted per client network and per response "tuple" (the name
+// and type answered, or the zone for negative answers) rather than per
+// query, so a spoofed victim can't be flooded with identical answers.
+type RRL struct {
+	cfg RRLConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*rrlBucket
+	lastSweep time.Time
+}
+
+func NewRRL(cfg RRLConfig) *RRL {
+	if cfg.Window <= 0 {
+		cfg.Window = 15 * time.Second
+	}
+	if cfg.MaxBuckets <= 0 {
+		cfg.MaxBuckets = 100000
+	}
+	return &RRL{cfg: cfg, buckets: map[string]*rrlBucket{}}
+}
+
+func clientPrefix(ip net.IP, v4bits, v6bits int) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(v4bits, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(v6bits, 128)).String()
+}
+
+// classify returns the accounting key and rate for a response.
+func (r *RRL) classify(resp *Query) (string, int) {
+	var qname string
+	var qtype uint16
+	if len(resp.Questions) > 0 {
+		qname, qtype = strings.ToLower(resp.Questions[0].Name), resp.Questions[0].QType
+	}
+	zone := func() string {
+		for _, rr := range resp.Authorities {
+			if rr.Type == TypeSOA || rr.Type == TypeNS {
+				return strings.ToLower(rr.Name)
+			}
+		}
+		return qname
+	}
+
+	switch {
+	case resp.Header.RCode == RCodeNameError:
+		return "nxdomain|" + zone(), r.cfg.NXDomainsPerSecond
+	case resp.Header.RCode != RCodeSuccess:
+		return "error", r.cfg.ErrorsPerSecond
+	case len(resp.Answers) > 0:
+		return fmt.Sprintf("answer|%s|%d", qname, qtype), r.cfg.ResponsesPerSecond
+	case !resp.Header.AA:
+		return "referral|" + zone(), r.cfg.ResponsesPerSecond
+	}
+	return "nodata|" + zone(), r.cfg.ResponsesPerSecond
+}
+
+// Check debits the bucket for resp sent to client and decides its fate.
+func (r *RRL) Check(client net.IP, resp *Query, now time.Time) rrlAction {
+	tuple, rate := r.classify(resp)
+	if rate <= 0 {
+		return rrlSend
+	}
+	prefix := clientPrefix(client, r.cfg.IPv4Prefix, r.cfg.IPv6Prefix)
+	key := prefix + "|" + tuple
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(now)
+
+	b := r.buckets[key]
+	if b == nil {
+		if len(r.buckets) >= r.cfg.MaxBuckets {
+			// Table full: fail open rather than punishing unrelated clients.
+			return rrlSend
+		}
+		b = &rrlBucket{balance: float64(rate), last: now}
+		r.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.balance = min(float64(rate), b.balance+elapsed*float64(rate))
+	b.last = now
+	b.balance--
+	if floor := -r.cfg.Window.Seconds() * float64(rate); b.balance < floor {
+		b.balance = floor
+	}
+	if b.balance >= 0 {
+		if b.limited > 0 {
+			logRRL.Info("stopped limiting responses", "key", key, "limited", b.limited)
+			b.limited, b.logged = 0, false
+		}
+		return rrlSend
+	}
+
+	b.limited++
+	if !b.logged {
+		logRRL.Warn("limiting responses", "key", key)
+		b.logged = true
+	}
+	if r.cfg.LogOnly {
+		return rrlSend
+	}
+	if r.cfg.Slip > 0 && b.limited%r.cfg.Slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// sweep forgets buckets that have been idle for a whole window.
+func (r *RRL) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Second {
+		return
+	}
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if now.Sub(b.last) > r.cfg.Window {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// slipResponse is the empty, truncated answer sent in place of a rate
+// limited response.
+func slipResponse(resp *Query) *Query {
+	return &Query{
+		Header: Header{
+			ID:      resp.Header.ID,
+			QR:      true,
+			Opcode:  resp.Header.Opcode,
+			AA:      resp.Header.AA,
+			TC:      true,
+			RD:      resp.Header.RD,
+			RCode:   resp.Header.RCode,
+			QDCount: uint16(len(resp.Questions)),
+		},
+		Questions: resp.Questions,
+	}
+}
@@ -0,0 +1,36 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+func TestRateLimitTransports(t *testing.T) {
+	resp := &Query{Header: Header{QR: true, AA: true}}
+	resp.SetQuestion("www.example.com", TypeA).AddAnswer(&ResourceRecord{Name: "www.example.com", Type: TypeA, Class: ClassINET, TTL: 300, RData: []byte{192, 0, 2, 10}})
+
+	for _, tc := range []struct {
+		protocol string
+		stream   bool
+		limited  bool
+	}{
+		{"udp", false, true},
+		{"tcp", true, false},
+		{"tls", true, false},
+		{"https", true, false},
+	} {
+		p := &Pipeline{RRL: NewRRL(RRLConfig{ResponsesPerSecond: 1, Slip: 2})}
+		client := &server.Client{IP: net.ParseIP("192.0.2.7"), Protocol: tc.protocol, Stream: tc.stream}
+		limited := false
+		for range 20 {
+			if p.rateLimit(client, resp) != rrlSend {
+				limited = true
+			}
+		}
+		if limited != tc.limited {
+			t.Errorf("%s: limited = %v, want %v", tc.protocol, limited, tc.limited)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package dnsserver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// Safe search is enforced the way the search engines document it: their
+// names are answered with a CNAME to the name serving the filtered
+// variant, which is then resolved as usual. YouTube's restricted mode
+// comes moderate, which safe-search=on turns on, and strict.
+
+// safeSearchTTL is the TTL of the CNAME records safe search answers with.
+const safeSearchTTL = 300
+
+type safeSearchEngine struct {
+	name string
+	// target serves the safe variant of names.
+	target string
+	names  []string
+}
+
+var safeSearchEngines = []safeSearchEngine{
+	{"google", "forcesafesearch.google.com", googleSearchNames()},
+	{"bing", "strict.bing.com", []string{"bing.com", "www.bing.com"}},
+	{"duckduckgo", "safe.duckduckgo.com", []string{"duckduckgo.com", "www.duckduckgo.com", "start.duckduckgo.com"}},
+	{"pixabay", "safesearch.pixabay.com", []string{"pixabay.com", "www.pixabay.com"}},
+	{"youtube", "restrictmoderate.youtube.com", youtubeNames},
+	{"youtube-strict", "restrict.youtube.com", youtubeNames},
+}
+
+var youtubeNames = []string{"www.youtube.com", "m.youtube.com", "youtubei.googleapis.com",
+	"youtube.googleapis.com", "www.youtube-nocookie.com"}
+
+// googleSearchNames returns google.com and the country domains Google
+// search is most used under, with and without www.
+func googleSearchNames() []string {
+	var names []string
+	for _, tld := range []string{"com", "ac", "ad", "ae", "at", "be", "bg", "ca", "ch", "cl", "cn", "co.id", "co.il",
+		"co.in", "co.jp", "co.kr", "co.nz", "co.th", "co.uk", "co.za", "com.ar", "com.au", "com.bd", "com.br",
+		"com.co", "com.eg", "com.hk", "com.mx", "com.my", "com.ng", "com.np", "com.pe", "com.ph", "com.pk",
+		"com.sa", "com.sg", "com.tr", "com.tw", "com.ua", "com.vn", "cz", "de", "dk", "es", "fi", "fr", "gr",
+		"hu", "ie", "it", "lk", "nl", "no", "pl", "pt", "ro", "rs", "ru", "se", "sk"} {
+		names = append(names, "google."+tld, "www.google."+tld)
+	}
+	return names
+}
+
+// parseSafeSearch returns the names to answer with CNAMEs to their safe
+// variants, for a list of engines; "on" is every engine, with YouTube's
+// moderate restricted mode, and "off" none.
+func parseSafeSearch(engines []string) (map[string]string, error) {
+	if len(engines) == 1 && (engines[0] == "on" || engines[0] == "off") {
+		if engines[0] == "off" {
+			return nil, nil
+		}
+		engines = []string{"google", "bing", "duckduckgo", "pixabay", "youtube"}
+	}
+	targets := map[string]string{}
+	for _, engine := range engines {
+		i := slices.IndexFunc(safeSearchEngines, func(e safeSearchEngine) bool { return e.name == engine })
+		if i < 0 {
+			var known []string
+			for _, e := range safeSearchEngines {
+				known = append(known, e.name)
+			}
+			return nil, fmt.Errorf("unknown safe search engine %q, want on, off or some of %s", engine, strings.Join(known, ", "))
+		}
+		for _, name := range safeSearchEngines[i].names {
+			targets[name] = safeSearchEngines[i].target
+		}
+	}
+	return targets, nil
+}
+
+// safeSearchRequest asks for the safe variant of m's question instead, if
+// targets has one; the state returned answers the client with a CNAME to
+// it. It returns nil for other names.
+func safeSearchRequest(m *Message, targets map[string]string) *rewriteState {
+	if len(targets) == 0 || len(m.Questions) != 1 || m.Questions[0].QClass != ClassINET {
+		return nil
+	}
+	q := m.Questions[0]
+	target, ok := targets[normalizeName(q.Name)]
+	if !ok {
+		return nil
+	}
+	rdata, err := dnswire.AppendName(nil, target, nil)
+	if err != nil {
+		return nil
+	}
+	st := &rewriteState{rw: &Rewriter{}, questions: m.Questions, original: normalizeName(q.Name),
+		cname: &ResourceRecord{Name: q.Name, Type: TypeCNAME, Class: ClassINET, TTL: safeSearchTTL, RData: rdata}}
+	m.Questions = []*Question{{Name: target, QType: q.QType, QClass: q.QClass}}
+	return st
+}
@@ -0,0 +1,116 @@
+package dnsserver
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// SandboxConfig says how to confine the server once its sockets are bound,
+// so that a bug in the code handling untrusted packets has as little as
+// possible to work with.
+type SandboxConfig struct {
+	User   string
+	Group  string
+	Chroot string
+	// Landlock limits filesystem access to ReadPaths and WritePaths (Linux
+	// only). Paths are looked up after the chroot.
+	Landlock   bool
+	ReadPaths  []string
+	WritePaths []string
+	// Seccomp makes syscalls the server never needs fail, such as execve,
+	// ptrace and mount (Linux only).
+	Seccomp bool
+}
+
+func (c *SandboxConfig) enabled() bool {
+	return c.User != "" || c.Group != "" || c.Chroot != "" || c.Landlock || c.Seccomp
+}
+
+// Apply confines the running process. It must be called after everything
+// that needs privileges, like binding port 53, and before serving queries.
+func (c *SandboxConfig) Apply() error {
+	// Look the ids up while /etc/passwd and /etc/group are still visible.
+	uid, gid := -1, -1
+	if c.User != "" {
+		u, err := lookupUser(c.User)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if c.Group != "" {
+		g, err := lookupGroup(c.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if c.Chroot != "" {
+		if err := chroot(c.Chroot); err != nil {
+			return fmt.Errorf("chroot %s: %v", c.Chroot, err)
+		}
+	}
+	if err := dropPrivileges(uid, gid); err != nil {
+		return err
+	}
+	if c.Landlock {
+		if err := restrictFilesystem(c.ReadPaths, c.WritePaths); err != nil {
+			return fmt.Errorf("landlock: %v", err)
+		}
+	}
+	if c.Seccomp {
+		if err := restrictSyscalls(); err != nil {
+			return fmt.Errorf("seccomp: %v", err)
+		}
+	}
+	if c.User != "" && os.Geteuid() == 0 {
+		return fmt.Errorf("still running as root after dropping privileges")
+	}
+	return nil
+}
+
+// writePaths returns the paths a sandboxed server writes below: extra,
+// and the directories of the query log, each tenant's query log, the trust
+// anchor state and the ACME accounts, where those are set. Rotated logs
+// are written next to the log, so the whole directory is needed.
+func writePaths(extra []string, queryLog string, tenants *Tenants, trustAnchorState, acmeAccounts string) []string {
+	paths := append([]string(nil), extra...)
+	if queryLog != "" && queryLog != "-" {
+		paths = append(paths, filepath.Dir(queryLog))
+	}
+	if tenants != nil {
+		for _, t := range tenants.list {
+			if t.queryLogPath != "" {
+				paths = append(paths, filepath.Dir(t.queryLogPath))
+			}
+		}
+	}
+	for _, path := range []string{trustAnchorState, acmeAccounts} {
+		if path != "" {
+			paths = append(paths, filepath.Dir(path))
+		}
+	}
+	return paths
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return &user.Group{Gid: name}, nil
+	}
+	return user.LookupGroup(name)
+}
@@ -0,0 +1,193 @@
+//go:build linux
+
+package dnsserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs = 38
+
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+	oPath                        = 0x200000
+
+	// Filesystem rights of Landlock ABI 1.
+	landlockExecute    = 1 << 0
+	landlockWriteFile  = 1 << 1
+	landlockReadFile   = 1 << 2
+	landlockReadDir    = 1 << 3
+	landlockAccessFSV1 = 1<<13 - 1
+)
+
+// setNoNewPrivs must precede installing a Landlock ruleset or seccomp
+// filter without CAP_SYS_ADMIN.
+func setNoNewPrivs() error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("needs a binary built with CGO_ENABLED=0")
+		}
+		return errno
+	}
+	return nil
+}
+
+// restrictFilesystem allows reading below readPaths and writing below
+// writePaths, and nothing else. Files that were already open stay usable.
+func restrictFilesystem(readPaths, writePaths []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("not supported by this kernel: %v", errno)
+	}
+	if abi < 1 {
+		return fmt.Errorf("unknown ABI version %d", abi)
+	}
+	handled := uint64(landlockAccessFSV1)
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return fmt.Errorf("creating ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	read := uint64(landlockReadFile | landlockReadDir)
+	for _, rule := range []struct {
+		paths  []string
+		access uint64
+	}{{readPaths, read}, {writePaths, landlockAccessFSV1 &^ landlockExecute}} {
+		for _, path := range rule.paths {
+			if err := landlockAllow(int(fd), path, rule.access); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+
+	if err := setNoNewPrivs(); err != nil {
+		return err
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("restricting: %v", errno)
+	}
+	return nil
+}
+
+func landlockAllow(ruleset int, path string, access uint64) error {
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		logSandbox.Warn("path does not exist, not allowing access to it", "path", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		access &= landlockReadFile | landlockWriteFile
+	}
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// struct landlock_path_beneath_attr is packed: u64 access, s32 fd.
+	var attr [12]byte
+	binary.NativeEndian.PutUint64(attr[:8], access)
+	binary.NativeEndian.PutUint32(attr[8:], uint32(fd))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	bpfLdWAbs = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfJeqK   = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+	bpfJgeK   = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+	bpfRetK   = syscall.BPF_RET | syscall.BPF_K
+)
+
+// seccompArch lists, per architecture, the audit arch value, the seccomp
+// syscall number and the syscalls to deny: running programs, debugging
+// other processes, loading kernel code, changing mounts or namespaces, and
+// the like. Everything else the Go runtime may need stays allowed.
+var seccompArch = map[string]struct {
+	audit   uint32
+	seccomp uintptr
+	x32     bool
+	denied  []uint32
+}{
+	"amd64": {0xc000003e, 317, true, []uint32{
+		59, 322, // execve, execveat
+		57, 58, // fork, vfork
+		101, 310, 311, // ptrace, process_vm_readv, process_vm_writev
+		246, 320, 175, 313, 176, // kexec_load, kexec_file_load, init_module, finit_module, delete_module
+		165, 166, 155, 161, // mount, umount2, pivot_root, chroot
+		272, 308, // unshare, setns
+		321, 298, 323, // bpf, perf_event_open, userfaultfd
+		135, 248, 249, 250, // personality, add_key, request_key, keyctl
+		167, 168, 169, // swapon, swapoff, reboot
+	}},
+	"arm64": {0xc00000b7, 277, false, []uint32{
+		221, 281, // execve, execveat
+		117, 270, 271, // ptrace, process_vm_readv, process_vm_writev
+		104, 294, 105, 273, 106, // kexec_load, kexec_file_load, init_module, finit_module, delete_module
+		40, 39, 41, 51, // mount, umount2, pivot_root, chroot
+		97, 268, // unshare, setns
+		280, 241, 282, // bpf, perf_event_open, userfaultfd
+		92, 217, 218, 219, // personality, add_key, request_key, keyctl
+		224, 225, 142, // swapon, swapoff, reboot
+	}},
+}
+
+// restrictSyscalls installs a seccomp filter on every thread that makes the
+// denied syscalls fail with EPERM.
+func restrictSyscalls() error {
+	arch, ok := seccompArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("not supported on %s", runtime.GOARCH)
+	}
+	deny := seccompRetErrno | uint32(syscall.EPERM)
+	prog := []syscall.SockFilter{
+		{Code: bpfLdWAbs, K: 4}, // seccomp_data.arch
+		{Code: bpfJeqK, Jt: 1, K: arch.audit},
+		{Code: bpfRetK, K: deny},
+		{Code: bpfLdWAbs, K: 0}, // seccomp_data.nr
+	}
+	if arch.x32 {
+		prog = append(prog, syscall.SockFilter{Code: bpfJgeK, Jf: 1, K: 0x40000000}, syscall.SockFilter{Code: bpfRetK, K: deny})
+	}
+	for _, nr := range arch.denied {
+		prog = append(prog, syscall.SockFilter{Code: bpfJeqK, Jf: 1, K: nr}, syscall.SockFilter{Code: bpfRetK, K: deny})
+	}
+	prog = append(prog, syscall.SockFilter{Code: bpfRetK, K: seccompRetAllow})
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+
+	// TSYNC applies the filter, and no_new_privs, to every thread from the
+	// one that has it set, so keep both calls on the same thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	tid, _, errno := syscall.Syscall(arch.seccomp, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return errno
+	}
+	if tid != 0 {
+		return fmt.Errorf("could not apply the filter to thread %d", tid)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package dnsserver
+
+import "fmt"
+
+func restrictFilesystem(readPaths, writePaths []string) error {
+	return fmt.Errorf("only supported on Linux")
+}
+
+func restrictSyscalls() error {
+	return fmt.Errorf("only supported on Linux")
+}
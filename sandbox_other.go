@@ -0,0 +1,16 @@
+//go:build !unix
+
+package dnsserver
+
+import "fmt"
+
+func chroot(dir string) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+func dropPrivileges(uid, gid int) error {
+	if uid >= 0 || gid >= 0 {
+		return fmt.Errorf("-user and -group are not supported on this platform")
+	}
+	return nil
+}
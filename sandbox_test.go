@@ -0,0 +1,44 @@
+package dnsserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWritePaths(t *testing.T) {
+	tenants := &Tenants{}
+	for _, spec := range []string{
+		"search?key=search-key&zones=search.example&query-log=/var/log/dns/search/queries.log",
+		"mail?key=mail-key&zones=mail.example&query-log=/srv/mail/dns.log",
+		"quiet?key=quiet-key&zones=quiet.example",
+	} {
+		tenant, err := ParseTenant(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tenants.list = append(tenants.list, tenant)
+	}
+
+	for _, tc := range []struct {
+		name                           string
+		extra                          []string
+		queryLog                       string
+		tenants                        *Tenants
+		trustAnchorState, acmeAccounts string
+		want                           []string
+	}{
+		{"nothing", nil, "", nil, "", "", nil},
+		{"stdout query log", nil, "-", nil, "", "", nil},
+		{
+			"everything",
+			[]string{"/var/lib/dns"}, "/var/log/dns/queries.log", tenants, "/var/lib/dns/anchors/root.state", "/etc/dns/acme.json",
+			[]string{"/var/lib/dns", "/var/log/dns", "/var/log/dns/search", "/srv/mail", "/var/lib/dns/anchors", "/etc/dns"},
+		},
+		{"tenants only", nil, "-", tenants, "", "", []string{"/var/log/dns/search", "/srv/mail"}},
+	} {
+		got := writePaths(tc.extra, tc.queryLog, tc.tenants, tc.trustAnchorState, tc.acmeAccounts)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
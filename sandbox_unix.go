@@ -0,0 +1,35 @@
+//go:build unix
+
+package dnsserver
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func chroot(dir string) error {
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+	return os.Chdir("/")
+}
+
+// dropPrivileges switches to gid and uid; -1 leaves an id unchanged. The
+// group goes first, as that needs privileges the user switch gives up.
+func dropPrivileges(uid, gid int) error {
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %v", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %v", uid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Schedules make blocklists, allowlists, profiles and firewall rules apply
+// only at some times of the week:
+//
+//	-schedule 'work=weekdays 09:00-17:00'
+//	-schedule 'night=daily 22:00-06:30, sat+sun 13:00-15:00'
+//	-blocklist-schedule social=work
+//	-profile 'kids?client=192.168.1.64/26&blocklists=games&schedule=night'
+//
+// A schedule is a comma separated list of windows, each days followed by
+// a time range, either of which may be left out. Days are mon to sun,
+// ranges of them like mon-fri, daily, weekdays or weekends, joined with +.
+// A range wrapping past midnight belongs to the day it starts on. Times
+// are in -schedule-timezone.
+
+type Schedule struct {
+	Name string
+	Spec string
+
+	windows []scheduleWindow
+	loc     *time.Location
+}
+
+type scheduleWindow struct {
+	days [7]bool
+	// from and to are minutes since midnight.
+	from, to int
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses a -schedule value, name=windows.
+func ParseSchedule(spec string, loc *time.Location) (*Schedule, error) {
+	name, windows, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid -schedule %q: want name=windows", spec)
+	}
+	s := &Schedule{Name: name, Spec: strings.TrimSpace(windows), loc: loc}
+	for _, w := range strings.Split(windows, ",") {
+		fields := strings.Fields(w)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid -schedule %q: want days and a time range, got %q", spec, strings.TrimSpace(w))
+		}
+		win := scheduleWindow{from: 0, to: 24 * 60}
+		if !strings.Contains(fields[0], ":") {
+			if err := win.parseDays(fields[0]); err != nil {
+				return nil, fmt.Errorf("invalid -schedule %q: %v", spec, err)
+			}
+			fields = fields[1:]
+		} else {
+			win.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		if len(fields) == 1 {
+			from, to, ok := strings.Cut(fields[0], "-")
+			var err error
+			if win.from, err = parseClock(from); err == nil && ok {
+				win.to, err = parseClock(to)
+			}
+			if err != nil || !ok {
+				return nil, fmt.Errorf("invalid -schedule %q: want a time range as HH:MM-HH:MM, got %q", spec, fields[0])
+			}
+		}
+		s.windows = append(s.windows, win)
+	}
+	return s, nil
+}
+
+func (w *scheduleWindow) parseDays(s string) error {
+	for _, part := range strings.Split(strings.ToLower(s), "+") {
+		switch part {
+		case "daily":
+			part = "sun-sat"
+		case "weekdays":
+			part = "mon-fri"
+		case "weekends":
+			w.days[time.Saturday], w.days[time.Sunday] = true, true
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		first, last := slices.Index(weekdayNames, from), slices.Index(weekdayNames, to)
+		if !isRange {
+			last = first
+		}
+		if first < 0 || last < 0 {
+			return fmt.Errorf("unknown days %q", part)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (w *scheduleWindow) active(day time.Weekday, minute int) bool {
+	if w.from < w.to {
+		return w.days[day] && minute >= w.from && minute < w.to
+	}
+	return w.days[day] && minute >= w.from || w.days[(day+6)%7] && minute < w.to
+}
+
+// Active reports whether now is within one of the schedule's windows. A
+// nil schedule is always active.
+func (s *Schedule) Active(now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	now = now.In(s.loc)
+	minute := now.Hour()*60 + now.Minute()
+	return slices.ContainsFunc(s.windows, func(w scheduleWindow) bool { return w.active(now.Weekday(), minute) })
+}
+
+// NextChange returns when the schedule next turns on or off after now, or
+// the zero time if it never does.
+func (s *Schedule) NextChange(now time.Time) time.Time {
+	active := s.Active(now)
+	t := now.Truncate(time.Minute)
+	for range 8 * 24 * 60 {
+		t = t.Add(time.Minute)
+		if s.Active(t) != active {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Schedules holds the schedules by name.
+type Schedules map[string]*Schedule
+
+// Lookup returns the schedule called name; an empty name is no schedule.
+func (ss Schedules) Lookup(name string) (*Schedule, error) {
+	if name == "" {
+		return nil, nil
+	}
+	s, ok := ss[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown schedule %q", name)
+	}
+	return s, nil
+}
+
+// scheduleStatus is what the admin API shows of a schedule.
+type scheduleStatus struct {
+	Name       string     `json:"name"`
+	Spec       string     `json:"spec"`
+	TimeZone   string     `json:"timezone"`
+	Active     bool       `json:"active"`
+	NextChange *time.Time `json:"next_change,omitempty"`
+	UsedBy     []string   `json:"used_by"`
+}
+
+// serveSchedules lists the schedules, whether they are active and what
+// they apply to.
+func serveSchedules(firewall *Firewall) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, now := currentConfig(), time.Now()
+		if cfg == nil {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		users := map[*Schedule][]string{}
+		if b := cfg.blocker; b != nil {
+			for _, l := range b.lists {
+				users[l.Schedule] = append(users[l.Schedule], "blocklist "+l.Name)
+			}
+			for _, l := range b.allow {
+				users[l.Schedule] = append(users[l.Schedule], "allowlist "+l.Source)
+			}
+		}
+		if cfg.profiles != nil {
+			for _, p := range append(slices.Clone(cfg.profiles.list), cfg.profiles.def) {
+				if p != nil {
+					users[p.Schedule] = append(users[p.Schedule], "profile "+p.Name)
+				}
+			}
+		}
+		if firewall != nil {
+			for _, rule := range firewall.Rules {
+				if s := cfg.schedules[rule.Schedule]; s != nil {
+					users[s] = append(users[s], "firewall "+rule.Spec)
+				}
+			}
+		}
+		out := []scheduleStatus{}
+		for _, s := range cfg.schedules {
+			st := scheduleStatus{Name: s.Name, Spec: s.Spec, TimeZone: s.loc.String(), Active: s.Active(now),
+				UsedBy: append([]string{}, users[s]...)}
+			if next := s.NextChange(now); !next.IsZero() {
+				st.NextChange = &next
+			}
+			out = append(out, st)
+		}
+		slices.SortFunc(out, func(a, b scheduleStatus) int { return strings.Compare(a.Name, b.Name) })
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	}
+}
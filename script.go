@@ -0,0 +1,186 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Policy scripts are Lua files defining a query function that is called
+// for every query:
+//
+//	function query(q)
+//	  -- q.name, q.type, q.class, q.client, q.edns.udp_size, q.edns.do
+//	  if q.type == "ANY" then return {action = "refuse"} end
+//	  if q.name:match("%.corp%.example$") then
+//	    return {action = "answer", answers = {q.name .. " 60 IN A 10.0.0.1"}}
+//	  end
+//	  return "pass"
+//	end
+//
+// Actions are pass, drop, refuse, block (NXDOMAIN), rewrite (with name) and
+// answer (with answers in zone file syntax and an optional rcode).
+
+var scriptDecisions = NewCounterVec("dns_script_decisions_total", "Decisions returned by the policy script.", "action")
+
+type scriptAction string
+
+const (
+	scriptPass    scriptAction = "pass"
+	scriptDrop    scriptAction = "drop"
+	scriptRefuse  scriptAction = "refuse"
+	scriptBlock   scriptAction = "block"
+	scriptRewrite scriptAction = "rewrite"
+	scriptAnswer  scriptAction = "answer"
+)
+
+type scriptDecision struct {
+	Action   scriptAction
+	Name     string
+	Response *Query
+}
+
+type ScriptHook struct {
+	Path    string
+	Timeout time.Duration
+
+	mu sync.Mutex
+	L  *lua.LState
+}
+
+func LoadScript(path string, timeout time.Duration) (*ScriptHook, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Scripts get no file, OS or module access.
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if err := L.DoFile(path); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("loading script %s: %v", path, err)
+	}
+	if L.GetGlobal("query").Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("script %s does not define a query function", path)
+	}
+	return &ScriptHook{Path: path, Timeout: timeout, L: L}, nil
+}
+
+// Run calls the script for m. Script errors are logged and treated as pass
+// so a broken policy doesn't take resolution down with it.
+func (h *ScriptHook) Run(client net.IP, m *Message) *scriptDecision {
+	if m.Header.Opcode != 0 || len(m.Questions) != 1 {
+		return &scriptDecision{Action: scriptPass}
+	}
+	d, err := h.run(client, m)
+	if err != nil {
+		logScript.Error("script failed", "script", h.Path, "err", err)
+		d = &scriptDecision{Action: scriptPass}
+	}
+	scriptDecisions.With(string(d.Action)).Inc()
+	return d
+}
+
+func (h *ScriptHook) run(client net.IP, m *Message) (*scriptDecision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	L := h.L
+
+	q := m.Questions[0]
+	arg := L.NewTable()
+	arg.RawSetString("name", lua.LString(normalizeName(q.Name)))
+	arg.RawSetString("type", lua.LString(dnswire.TypeString(q.QType)))
+	arg.RawSetString("class", lua.LNumber(q.QClass))
+	arg.RawSetString("client", lua.LString(client.String()))
+	if opt := findOPT(m); opt != nil {
+		edns := L.NewTable()
+		edns.RawSetString("udp_size", lua.LNumber(opt.Class))
+		edns.RawSetString("do", lua.LBool(opt.TTL&0x8000 != 0))
+		arg.RawSetString("edns", edns)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("query"), NRet: 1, Protect: true}, arg); err != nil {
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	d := &scriptDecision{Action: scriptPass}
+	var answers []string
+	rcode := RCodeSuccess
+	switch v := ret.(type) {
+	case *lua.LNilType:
+		return d, nil
+	case lua.LString:
+		d.Action = scriptAction(v)
+	case *lua.LTable:
+		d.Action = scriptAction(lua.LVAsString(v.RawGetString("action")))
+		d.Name = lua.LVAsString(v.RawGetString("name"))
+		if n, ok := v.RawGetString("rcode").(lua.LNumber); ok {
+			rcode = uint8(n)
+		}
+		if list, ok := v.RawGetString("answers").(*lua.LTable); ok {
+			list.ForEach(func(_, rr lua.LValue) {
+				answers = append(answers, lua.LVAsString(rr))
+			})
+		}
+	default:
+		return nil, fmt.Errorf("query returned a %s", ret.Type())
+	}
+
+	switch d.Action {
+	case scriptPass, scriptDrop:
+	case scriptRefuse:
+		d.Response = refusedResponse(m)
+	case scriptBlock:
+		d.Response = scriptResponse(m, RCodeNameError, nil)
+	case scriptRewrite:
+		if d.Name == "" {
+			return nil, fmt.Errorf("rewrite without a name")
+		}
+	case scriptAnswer:
+		rrs, err := ParseZone(strings.NewReader(strings.Join(answers, "\n")), "")
+		if err != nil {
+			return nil, fmt.Errorf("answer: %v", err)
+		}
+		d.Response = scriptResponse(m, rcode, rrs)
+	default:
+		return nil, fmt.Errorf("unknown action %q", d.Action)
+	}
+	return d, nil
+}
+
+func scriptResponse(m *Message, rcode uint8, answers []*ResourceRecord) *Query {
+	resp := new(Query).SetRcode(m, rcode).AddAnswer(answers...)
+	resp.Header.RA = true
+	return resp
+}
+
+// rewrite applies a rewrite decision to m the same way an exact name
+// rewrite rule would.
+func (d *scriptDecision) rewrite(m *Message) *rewriteState {
+	rule := &RewriteRule{Kind: "name", Match: matchExact, From: normalizeName(m.Questions[0].Name), To: normalizeName(d.Name)}
+	return (&Rewriter{Rules: []*RewriteRule{rule}}).Request(m)
+}
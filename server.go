@@ -0,0 +1,42 @@
+package dnsserver
+
+import (
+	"github.com/bibektamang7/dns-server/cache"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// The listeners, the handler interfaces, the ACLs and the registries of
+// zone backends and stages live in the server package, and the caches in
+// the cache package, so other programs can embed the server or extend
+// it. The server refers to them by these names.
+type (
+	Server         = server.Server
+	Listener       = server.Listener
+	Handler        = server.Handler
+	HandlerFunc    = server.HandlerFunc
+	ResponseWriter = server.ResponseWriter
+	Middleware     = server.Middleware
+	ServeMux       = server.ServeMux
+	Capability     = server.Capability
+	ACL            = server.ACL
+	ACLSet         = server.ACLSet
+	CertGroups     = server.CertGroups
+	QueryLimit     = server.QueryLimit
+	Cache          = cache.Cache
+	CacheRanger    = cache.Ranger
+	MemoryCache    = cache.Memory
+)
+
+const (
+	CapQuery     = server.CapQuery
+	CapRecursion = server.CapRecursion
+	CapTransfer  = server.CapTransfer
+	CapUpdate    = server.CapUpdate
+)
+
+var (
+	ErrServerClosed = server.ErrServerClosed
+	NewServeMux     = server.NewServeMux
+	NewACLSet       = server.NewACLSet
+	NewMemoryCache  = cache.NewMemory
+)
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+type Capability string
+
+const (
+	CapQuery     Capability = "query"
+	CapRecursion Capability = "recursion"
+	CapTransfer  Capability = "transfer"
+	CapUpdate    Capability = "update"
+)
+
+// Capabilities lists every capability, in the order flags are made for them.
+var Capabilities = []Capability{CapQuery, CapRecursion, CapTransfer, CapUpdate}
+
+var aclKeywords = map[string][]string{
+	"any":       {"0.0.0.0/0", "::/0"},
+	"none":      {},
+	"localhost": {"127.0.0.0/8", "::1/128"},
+	"private":   {"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", "fe80::/10"},
+}
+
+// DefaultACLs keeps recursion to local and private clients, so a server
+// bound to a public address is not an open resolver unless told to be.
+var DefaultACLs = map[Capability]string{
+	CapQuery:     "any",
+	CapRecursion: "private",
+	CapTransfer:  "none",
+	CapUpdate:    "none",
+}
+
+// ACL is a list of networks allowed to use a capability. Deny entries take
+// precedence over allow entries.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+func (a *ACL) Permits(ip net.IP) bool {
+	for _, n := range a.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, n := range a.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses a comma separated list of CIDRs, bare addresses and
+// keywords (any, none, localhost, private).
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if expanded, ok := aclKeywords[item]; ok {
+			for _, cidr := range expanded {
+				_, n, _ := net.ParseCIDR(cidr)
+				nets = append(nets, n)
+			}
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ACLSet holds the access lists for every capability of a listener.
+type ACLSet map[Capability]*ACL
+
+func NewACLSet() ACLSet {
+	set := ACLSet{}
+	for _, c := range Capabilities {
+		allow, _ := ParseNetworks(DefaultACLs[c])
+		set[c] = &ACL{Allow: allow}
+	}
+	return set
+}
+
+// Set replaces the allow or deny list of a capability.
+func (s ACLSet) Set(c Capability, deny bool, list string) error {
+	acl, ok := s[c]
+	if !ok {
+		return fmt.Errorf("unknown capability %q", c)
+	}
+	nets, err := ParseNetworks(list)
+	if err != nil {
+		return err
+	}
+	if deny {
+		acl.Deny = nets
+	} else {
+		acl.Allow = nets
+	}
+	return nil
+}
+
+func (s ACLSet) Permits(c Capability, ip net.IP) bool {
+	acl, ok := s[c]
+	return ok && acl.Permits(ip)
+}
+
+// Clone returns a copy of s whose lists can be set on their own.
+func (s ACLSet) Clone() ACLSet {
+	out := ACLSet{}
+	for c, acl := range s {
+		out[c] = &ACL{Allow: acl.Allow, Deny: acl.Deny}
+	}
+	return out
+}
+
+// Apply sets the lists given as allow-CAPABILITY and deny-CAPABILITY keys.
+func (s ACLSet) Apply(values url.Values) error {
+	for key, lists := range values {
+		verb, c, ok := strings.Cut(key, "-")
+		if !ok || (verb != "allow" && verb != "deny") {
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if err := s.Set(Capability(c), verb == "deny", strings.Join(lists, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import "sync"
+
+// Message buffers are pooled in size classes so the query path doesn't
+// allocate a fresh buffer for every read, response and upstream exchange:
+// classic DNS over UDP, EDNS over UDP, and the largest TCP message.
+var bufferSizes = [...]int{512, 4096, 65535}
+
+var bufferPools [len(bufferSizes)]sync.Pool
+
+// GetBuffer returns a pooled buffer of length size, from the smallest class
+// that fits. Sizes beyond the largest class are allocated.
+func GetBuffer(size int) *[]byte {
+	for i, class := range bufferSizes {
+		if size <= class {
+			if b, ok := bufferPools[i].Get().(*[]byte); ok {
+				*b = (*b)[:size]
+				return b
+			}
+			b := make([]byte, size, class)
+			return &b
+		}
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// PutBuffer returns b to its pool. The caller must not use b afterwards,
+// nor anything sliced from it. Buffers that don't match a class, because
+// append outgrew them or they came from elsewhere, are left to the GC.
+func PutBuffer(b *[]byte) {
+	for i, class := range bufferSizes {
+		if cap(*b) == class {
+			bufferPools[i].Put(b)
+			return
+		}
+	}
+}
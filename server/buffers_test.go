@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestGetBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		size, cap int
+	}{
+		{0, 512},
+		{12, 512},
+		{512, 512},
+		{513, 4096},
+		{4096, 4096},
+		{65535, 65535},
+		{70000, 70000},
+	} {
+		b := GetBuffer(tc.size)
+		if len(*b) != tc.size || cap(*b) != tc.cap {
+			t.Errorf("GetBuffer(%d) has length %d and capacity %d, want capacity %d", tc.size, len(*b), cap(*b), tc.cap)
+		}
+		PutBuffer(b)
+	}
+}
+
+// BenchmarkBuffers gets and puts back a buffer of each class, as a query
+// and its response do, next to allocating one each time.
+func BenchmarkBuffers(b *testing.B) {
+	for _, size := range bufferSizes {
+		b.Run("pooled/"+strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				buf := GetBuffer(size)
+				(*buf)[0] = 1
+				PutBuffer(buf)
+			}
+		})
+		b.Run("make/"+strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				buf := make([]byte, size)
+				buf[0] = 1
+				sink = buf
+			}
+		})
+	}
+}
+
+// sink keeps the compiler from putting allocations on the stack.
+var sink []byte
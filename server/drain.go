@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drain coordinates a Server's graceful stop: listeners stop accepting
+// and reading, connections finish the query they are answering, and
+// Shutdown waits for them with a bound.
+type drain struct {
+	stopping atomic.Bool
+
+	mu    sync.Mutex
+	stops []func()
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func (s *drain) Stopping() bool {
+	return s.stopping.Load()
+}
+
+// OnStop registers f, which makes a listener stop accepting or reading, to
+// run when the shutdown begins. If it already has, f runs right away.
+func (s *drain) OnStop(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Stopping() {
+		f()
+		return
+	}
+	s.stops = append(s.stops, f)
+}
+
+// Track registers a connection being served, which Wait waits for. Its
+// pending read is interrupted when the shutdown begins; done must be
+// called once the connection is closed.
+func (s *drain) Track(conn net.Conn) (done func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wg.Add(1)
+	s.conns[conn] = true
+	if s.Stopping() {
+		conn.SetReadDeadline(time.Now())
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.conns, conn)
+		s.wg.Done()
+	}
+}
+
+// Go runs f, which finishes draining something, and makes Wait wait for it.
+func (s *drain) Go(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// Begin stops the listeners and interrupts connections waiting for their
+// next query.
+func (s *drain) Begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopping.Store(true)
+	for _, f := range s.stops {
+		f()
+	}
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Wait waits for tracked connections and drains to finish.
+func (s *drain) Wait() {
+	s.wg.Wait()
+}
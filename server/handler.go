@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// Client describes where a query came from.
+type Client struct {
+	IP   net.IP
+	Port int
+	// Local is the server address the query arrived on.
+	Local net.Addr
+	ACLs  ACLSet
+	// Group is the group of a verified TLS client certificate, if any.
+	Group string
+	// Stream is set for TCP based transports, whose responses are never
+	// truncated.
+	Stream bool
+	// Protocol is the transport the query arrived over: udp, tcp, tls or
+	// https.
+	Protocol string
+	// Conn is the TCP or TLS connection zone transfers are streamed to.
+	Conn net.Conn
+}
+
+// Handler answers DNS queries, as http.Handler answers HTTP requests. The
+// query is only valid until ServeDNS returns.
+type Handler interface {
+	ServeDNS(w ResponseWriter, r *dnswire.Message)
+}
+
+// HandlerFunc lets an ordinary function serve as a Handler.
+type HandlerFunc func(w ResponseWriter, r *dnswire.Message)
+
+func (f HandlerFunc) ServeDNS(w ResponseWriter, r *dnswire.Message) {
+	f(w, r)
+}
+
+// Middleware is a stage of answering a query: it answers the query itself
+// or hands it on to next, possibly doing something with the answer after.
+type Middleware func(next Handler) Handler
+
+// ResponseWriter sends the answer to a query back over the transport it
+// arrived on. A handler that writes nothing drops the query.
+type ResponseWriter interface {
+	// Client describes who sent the query and over which transport.
+	Client() *Client
+	// Query returns the query as it was received.
+	Query() []byte
+	// MaxSize is the largest response the client accepts: 65535 bytes
+	// over streams, and over UDP its EDNS payload size, up to UDPSize, or
+	// 512 without EDNS.
+	MaxSize() int
+	// Write sends an encoded response held in a pooled buffer, which is
+	// returned to the pool.
+	Write(reply []byte) error
+}
+
+type responseWriter struct {
+	client  *Client
+	query   []byte
+	maxSize int
+	send    func(reply []byte) error
+	written bool
+	// err is the error the last write failed with.
+	err error
+}
+
+func (w *responseWriter) Client() *Client { return w.client }
+func (w *responseWriter) Query() []byte   { return w.query }
+func (w *responseWriter) MaxSize() int    { return w.maxSize }
+
+func (w *responseWriter) Write(reply []byte) error {
+	w.written = true
+	w.err = w.send(reply)
+	PutBuffer(&reply)
+	return w.err
+}
+
+// IdleTimeout is how long TCP and TLS connections may stay idle.
+const IdleTimeout = 10 * time.Second
+
+// UDPSize is the largest response sent over UDP, whatever payload size a
+// client's EDNS record offers.
+const UDPSize = 1232
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/metrics"
+)
+
+var (
+	inFlightQueries = metrics.NewGauge("dns_queries_in_flight", "Queries being answered.")
+	shedQueries     = metrics.NewCounterVec("dns_queries_shed_total", "Queries shed because too many were already being answered, per -max-in-flight and memory pressure.", "policy")
+)
+
+// QueryLimit bounds the number of queries answered at once. Over the
+// limit, queries are shed without being parsed past the header: dropped,
+// or answered REFUSED so clients try another server. A nil QueryLimit
+// doesn't limit.
+type QueryLimit struct {
+	slots  chan struct{}
+	refuse bool
+	// held is the number of slots held back under memory pressure.
+	held atomic.Int64
+}
+
+// NewQueryLimit returns a limit of max queries at once, which drops the
+// queries over it, or with refuse set answers them REFUSED. It is nil,
+// which doesn't limit, if max isn't positive.
+func NewQueryLimit(max int, refuse bool) *QueryLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &QueryLimit{slots: make(chan struct{}, max), refuse: refuse}
+}
+
+// Acquire takes a slot for a query, reporting false when they are all in
+// use. Release gives it back.
+func (l *QueryLimit) Acquire() bool {
+	if l == nil {
+		inFlightQueries.Add(1)
+		return true
+	}
+	if len(l.slots) >= cap(l.slots)-int(l.held.Load()) {
+		return false
+	}
+	select {
+	case l.slots <- struct{}{}:
+		inFlightQueries.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *QueryLimit) Release() {
+	inFlightQueries.Add(-1)
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// HoldBack stops handing out fraction of the slots, or with 0 gives them
+// all back.
+func (l *QueryLimit) HoldBack(fraction float64) {
+	if l != nil {
+		l.held.Store(int64(fraction * float64(cap(l.slots))))
+	}
+}
+
+// Shed counts a query that couldn't get a slot and returns the response
+// for it, or nil to drop it.
+func (l *QueryLimit) Shed(data []byte) []byte {
+	if !l.refuse {
+		shedQueries.With("drop").Inc()
+		return nil
+	}
+	shedQueries.With("refuse").Inc()
+	m, err := dnswire.ParseLazy(data)
+	if err != nil || m.Header.QR {
+		return nil
+	}
+	resp := new(dnswire.Query).SetRcode(&dnswire.Message{Header: m.Header}, dnswire.RCodeRefused)
+	if q, err := m.Question(0); err == nil {
+		resp.AddQuestion(q)
+	}
+	reply, err := resp.AppendTo(*GetBuffer(0))
+	if err != nil {
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListenerSpec is an address to serve on, over which transport, and the
+// ACLs of the clients that reach it there.
+type ListenerSpec struct {
+	Addr string
+	ACLs ACLSet
+	// Transport is udp, tls (DNS over TLS) or https (DNS over HTTPS).
+	Transport string
+	Path      string
+	// ClientCert is "request" or "require" to ask TLS clients for a
+	// certificate.
+	ClientCert string
+	// Groups holds the ACLs of clients whose certificate maps them to a
+	// group with its own ACL overrides.
+	Groups map[string]ACLSet
+	// ReadBuffer and WriteBuffer size the kernel socket buffers
+	// (SO_RCVBUF and SO_SNDBUF); 0 keeps the default.
+	ReadBuffer, WriteBuffer int
+}
+
+// AddGroup derives the ACLs of a certificate group from the listener's,
+// given overrides like "allow-recursion=any&allow-transfer=any".
+func (l *ListenerSpec) AddGroup(group, params string) error {
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return err
+	}
+	acls := l.ACLs.Clone()
+	if err := acls.Apply(values); err != nil {
+		return err
+	}
+	if l.Groups == nil {
+		l.Groups = map[string]ACLSet{}
+	}
+	l.Groups[group] = acls
+	return nil
+}
+
+func (l *ListenerSpec) client(protocol, addr string, local net.Addr, state *tls.ConnectionState, groups CertGroups) *Client {
+	host, port, _ := net.SplitHostPort(addr)
+	c := &Client{IP: net.ParseIP(host), Local: local, ACLs: l.ACLs, Stream: true, Protocol: protocol}
+	c.Port, _ = strconv.Atoi(port)
+	c.Group = groups.Group(state)
+	if acls, ok := l.Groups[c.Group]; ok {
+		c.ACLs = acls
+	}
+	return c
+}
+
+type certGroup struct {
+	identity string
+	group    string
+}
+
+// CertGroups maps client certificate identities to policy groups. An
+// identity is matched against the subject common name and the DNS, email
+// and URI subject alternative names.
+type CertGroups []certGroup
+
+func (g *CertGroups) Add(spec string) error {
+	identity, group, ok := strings.Cut(spec, "=")
+	if !ok || identity == "" || group == "" {
+		return fmt.Errorf("invalid -cert-group %q, want identity=group", spec)
+	}
+	*g = append(*g, certGroup{identity: strings.ToLower(identity), group: group})
+	return nil
+}
+
+// Group returns the group of the first identity in g that the verified
+// certificate state carries.
+func (g CertGroups) Group(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	ids := []string{cert.Subject.CommonName}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	for _, cg := range g {
+		for _, id := range ids {
+			if strings.ToLower(id) == cg.identity {
+				return cg.group
+			}
+		}
+	}
+	return ""
+}
+
+// SocketBuffers holds the kernel buffer sizes of a listener's sockets; 0
+// keeps the OS default.
+type SocketBuffers struct {
+	Read, Write int
+}
+
+func (b SocketBuffers) apply(conn interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}) error {
+	if b.Read > 0 {
+		if err := conn.SetReadBuffer(b.Read); err != nil {
+			return err
+		}
+	}
+	if b.Write > 0 {
+		return conn.SetWriteBuffer(b.Write)
+	}
+	return nil
+}
+
+// listener returns ln with the buffer sizes applied to each accepted
+// connection.
+func (b SocketBuffers) listener(ln net.Listener, log *slog.Logger) net.Listener {
+	if b == (SocketBuffers{}) {
+		return ln
+	}
+	return &bufferedListener{Listener: ln, bufs: b, log: log}
+}
+
+type bufferedListener struct {
+	net.Listener
+	bufs SocketBuffers
+	log  *slog.Logger
+}
+
+func (ln *bufferedListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok && err == nil {
+		if err := ln.bufs.apply(tcp); err != nil {
+			ln.log.Warn("setting socket buffers failed", "addr", ln.Addr().String(), "err", err)
+		}
+	}
+	return conn, err
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// ServeMux routes queries to the handler of the longest zone their
+// question name falls in, as http.ServeMux routes requests by path.
+// Handlers are registered before the mux serves queries.
+type ServeMux struct {
+	zones map[string]Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{zones: map[string]Handler{}}
+}
+
+// Handle registers h for names at and below zone; "." catches every name
+// no other zone does.
+func (mux *ServeMux) Handle(zone string, h Handler) {
+	mux.zones[normalizeName(zone)] = h
+}
+
+// Handler returns the handler for name and the zone it was registered
+// for, or nil if no zone covers name.
+func (mux *ServeMux) Handler(name string) (Handler, string) {
+	name = normalizeName(name)
+	for {
+		if h, ok := mux.zones[name]; ok {
+			return h, name + "."
+		}
+		if name == "" {
+			return nil, ""
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
+
+// ServeDNS hands the query to the handler for its question, answering
+// REFUSED if there is none. Queries without a question go to the root
+// handler.
+func (mux *ServeMux) ServeDNS(w ResponseWriter, r *dnswire.Message) {
+	name := ""
+	if len(r.Questions) > 0 {
+		name = r.Questions[0].Name
+	}
+	if h, _ := mux.Handler(name); h != nil {
+		h.ServeDNS(w, r)
+		return
+	}
+	if reply, err := new(dnswire.Query).SetRcode(r, dnswire.RCodeRefused).AppendTo(*GetBuffer(0)); err == nil {
+		w.Write(reply)
+	}
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/metrics"
+)
+
+// A client that gets no answer in time sends its query again, with the
+// same ID, often while the first is still waiting on the resolver. The
+// outstanding query table drops these retransmissions rather than
+// resolving each again: the answer to the original answers them too.
+// Only UDP queries are tracked, as stream clients don't retransmit.
+
+var duplicateQueries = metrics.NewCounter("dns_duplicate_queries_total", "UDP queries dropped as retransmissions of one still being answered.")
+
+type outstandingQueries struct {
+	mu      sync.Mutex
+	queries map[outstandingKey]bool
+}
+
+// outstandingKey identifies a client transaction: its source address, ID
+// and question.
+type outstandingKey struct {
+	ip     string
+	port   int
+	id     uint16
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func newOutstandingKey(client *Client, m *dnswire.Message) (outstandingKey, bool) {
+	if client.Stream || len(m.Questions) != 1 {
+		return outstandingKey{}, false
+	}
+	q := m.Questions[0]
+	return outstandingKey{ip: string(client.IP.To16()), port: client.Port, id: m.Header.ID,
+		name: strings.ToLower(q.Name), qtype: q.QType, qclass: q.QClass}, true
+}
+
+// begin records the transaction k, unless it is outstanding already.
+func (o *outstandingQueries) begin(k outstandingKey) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.queries[k] {
+		return false
+	}
+	if o.queries == nil {
+		o.queries = map[outstandingKey]bool{}
+	}
+	o.queries[k] = true
+	return true
+}
+
+func (o *outstandingQueries) end(k outstandingKey) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.queries, k)
+}
@@ -0,0 +1,37 @@
+package server
+
+import "github.com/bibektamang7/dns-server/dnswire"
+
+// Files adding zone backends and chain stages to the build, usually behind
+// a build tag so they are opt in, register them from init.
+
+// ZoneBackend returns the records of the zone at origin that source
+// describes. It is called again on every reload.
+type ZoneBackend func(origin, source string) ([]*dnswire.ResourceRecord, error)
+
+var zoneBackends = map[string]ZoneBackend{}
+
+// RegisterZoneBackend makes b serve -zone sources written scheme://...
+func RegisterZoneBackend(scheme string, b ZoneBackend) {
+	zoneBackends[scheme] = b
+}
+
+// ZoneBackendFor returns the backend registered for scheme.
+func ZoneBackendFor(scheme string) (ZoneBackend, bool) {
+	b, ok := zoneBackends[scheme]
+	return b, ok
+}
+
+var stages = map[string]Middleware{}
+
+// RegisterStage makes m available to -chain under name, next to the
+// built-in stages.
+func RegisterStage(name string, m Middleware) {
+	stages[name] = m
+}
+
+// Stage returns the stage registered as name.
+func Stage(name string) (Middleware, bool) {
+	m, ok := stages[name]
+	return m, ok
+}
@@ -0,0 +1,481 @@
+// Package server answers DNS queries over UDP, TCP, DNS over TLS and DNS
+// over HTTPS, handing each to a Handler, as net/http does for HTTP. It
+// also holds the registries that add zone backends and chain stages to
+// the dns-server build; caches register with the cache package.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/metrics"
+)
+
+// ErrServerClosed is returned by ListenAndServe once the server is told to
+// stop.
+var ErrServerClosed = errors.New("dns: server closed")
+
+var tlsHandshakeFailures = metrics.NewCounter("dns_tls_handshake_failures_total", "DNS over TLS connections whose handshake failed, including rejected client certificates.")
+
+// Server answers DNS queries on a set of listeners, as http.Server answers
+// HTTP requests. Several can run in one process.
+type Server struct {
+	// Handler answers the queries of every listener.
+	Handler Handler
+	// Log receives what the server logs about queries it can't hand to
+	// Handler and about its listeners; nil logs to slog.Default.
+	Log *slog.Logger
+	// Listeners are the addresses to serve on.
+	Listeners []*Listener
+	// Limit bounds how many queries are answered at once; nil doesn't.
+	Limit *QueryLimit
+	// Ready, if set, is called with each listener's bound address once
+	// all of them are bound, before the first query is read. An error
+	// stops the server.
+	Ready func(addrs []net.Addr) error
+
+	once  sync.Once
+	drain *drain
+	// outstanding holds the UDP queries being answered.
+	outstanding outstandingQueries
+	// mu guards closing, which Shutdown closes.
+	mu      sync.Mutex
+	closing chan struct{}
+}
+
+// Listener is an address a Server answers on, and how.
+type Listener struct {
+	// Spec gives the address, transport and ACLs. A udp listener answers
+	// over TCP on the same port too.
+	Spec *ListenerSpec
+	// CertGroups maps verified TLS client certificates to groups.
+	CertGroups CertGroups
+	// Config, if set, returns the Spec and CertGroups in effect in their
+	// place. It is called for each connection and UDP query, so the
+	// ACLs can change without binding again.
+	Config func() (*ListenerSpec, CertGroups)
+	// TLSConfig serves tls and https listeners.
+	TLSConfig *tls.Config
+	// Buffers sizes the kernel socket buffers.
+	Buffers SocketBuffers
+	// Log, if set, takes the errors accepting and reading on this
+	// listener in place of the server's Log.
+	Log *slog.Logger
+}
+
+func (l *Listener) current() (*ListenerSpec, CertGroups) {
+	if l.Config != nil {
+		return l.Config()
+	}
+	return l.Spec, l.CertGroups
+}
+
+func (s *Server) log() *slog.Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return slog.Default()
+}
+
+func (s *Server) listenerLog(l *Listener) *slog.Logger {
+	if l.Log != nil {
+		return l.Log
+	}
+	return s.log()
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.drain = &drain{conns: map[net.Conn]bool{}}
+		s.closing = make(chan struct{})
+	})
+}
+
+// ListenAndServe binds every listener and answers queries until ctx is
+// done or Shutdown is called, then stops the listeners and returns
+// ErrServerClosed. Queries being answered may still be; Shutdown waits
+// for them.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	s.init()
+	var servers []func()
+	var addrs []net.Addr
+	var bound []io.Closer
+	fail := func(err error) error {
+		for _, c := range bound {
+			c.Close()
+		}
+		return err
+	}
+	for _, l := range s.Listeners {
+		if l.Spec.Transport != "udp" {
+			tcpListener, err := net.Listen("tcp", l.Spec.Addr)
+			if err != nil {
+				return fail(err)
+			}
+			bound = append(bound, tcpListener)
+			addrs = append(addrs, tcpListener.Addr())
+			ln := tls.NewListener(l.Buffers.listener(tcpListener, s.listenerLog(l)), l.TLSConfig)
+			if l.Spec.Transport == "https" {
+				servers = append(servers, func() { s.serveHTTPS(ln, l) })
+			} else {
+				servers = append(servers, func() { s.serveTLS(ln, l) })
+			}
+			continue
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", l.Spec.Addr)
+		if err != nil {
+			return fail(err)
+		}
+		udpConn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return fail(err)
+		}
+		bound = append(bound, udpConn)
+		if err := l.Buffers.apply(udpConn); err != nil {
+			return fail(fmt.Errorf("setting socket buffers on %s: %v", l.Spec.Addr, err))
+		}
+		// Taking the port UDP got keeps the two together when the
+		// address asks for any port.
+		tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+		if err != nil {
+			return fail(err)
+		}
+		bound = append(bound, tcpListener)
+		addrs = append(addrs, udpConn.LocalAddr())
+		ln := l.Buffers.listener(tcpListener, s.listenerLog(l))
+		servers = append(servers, func() { s.serveUDP(udpConn, l) }, func() { s.serveTCP(ln, l) })
+	}
+	if s.Ready != nil {
+		if err := s.Ready(addrs); err != nil {
+			return fail(err)
+		}
+	}
+	for i, l := range s.Listeners {
+		s.log().Info("listening", "addr", addrs[i].String(), "transport", l.Spec.Transport)
+	}
+
+	// Shutdown waits for the listeners as well as the queries, unless
+	// it was called before any began.
+	stopped := make(chan struct{})
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+		s.mu.Unlock()
+		return fail(ErrServerClosed)
+	default:
+	}
+	s.drain.Go(func() { <-stopped })
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, serve := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return fmt.Errorf("all listeners failed")
+	case <-ctx.Done():
+	case <-s.closing:
+	}
+	s.drain.Begin()
+	return ErrServerClosed
+}
+
+// Shutdown stops the listeners, if ListenAndServe hasn't already, and
+// waits for the queries and connections being answered until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.init()
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+	s.mu.Unlock()
+	s.drain.Begin()
+	drained := make(chan struct{})
+	go func() {
+		s.drain.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serve parses the query w carries and hands it to the handler. A query
+// that doesn't parse is handed over with only its header, to be answered
+// FORMERR; packets too short for a header, and responses, are dropped.
+func (s *Server) serve(w *responseWriter) {
+	h, err := dnswire.ParseHeader(w.query)
+	if err == nil && h.QR {
+		err = fmt.Errorf("message is a response")
+	}
+	if err != nil {
+		s.log().Info("bad query", "client", w.client.IP.String(), "err", err)
+		return
+	}
+	m, err := dnswire.ParsePooled(w.query)
+	if err != nil {
+		s.log().Info("bad query", "client", w.client.IP.String(), "id", h.ID, "err", err)
+		m = &dnswire.Message{Header: h}
+	}
+	defer m.Release()
+	if k, ok := newOutstandingKey(w.client, m); ok {
+		if !s.outstanding.begin(k) {
+			duplicateQueries.Inc()
+			s.log().Debug("retransmitted query dropped", "client", w.client.IP.String(), "id", h.ID)
+			return
+		}
+		defer s.outstanding.end(k)
+	}
+	w.maxSize = 0xFFFF
+	if !w.client.Stream {
+		w.maxSize = 512
+		for _, rr := range m.Additionals {
+			if rr.Type == dnswire.TypeOPT && rr.Class > 512 {
+				w.maxSize = int(min(rr.Class, UDPSize))
+			}
+		}
+	}
+	s.Handler.ServeDNS(w, m)
+}
+
+// Exchange answers query as if client had sent it, without a listener,
+// as for queries made through a control API or to warm up caches.
+func (s *Server) Exchange(query []byte, client *Client) ([]byte, error) {
+	var reply []byte
+	w := &responseWriter{client: client, query: query, send: func(r []byte) error {
+		reply = bytes.Clone(r)
+		return nil
+	}}
+	s.serve(w)
+	if !w.written {
+		return nil, fmt.Errorf("query dropped")
+	}
+	return reply, nil
+}
+
+// serveLimited is serve for the stream transports, which answer every
+// connection on its own goroutine: queries over the limit are shed.
+func (s *Server) serveLimited(w *responseWriter) {
+	if !s.Limit.Acquire() {
+		if reply := s.Limit.Shed(w.query); reply != nil {
+			w.Write(reply)
+		}
+		return
+	}
+	defer s.Limit.Release()
+	s.serve(w)
+}
+
+// serveUDP reads queries and answers each on its own goroutine, up to
+// the limit at once.
+func (s *Server) serveUDP(udpConn *net.UDPConn, l *Listener) {
+	var answering sync.WaitGroup
+	defer func() {
+		answering.Wait()
+		udpConn.Close()
+	}()
+	s.drain.OnStop(func() { udpConn.SetReadDeadline(time.Now()) })
+
+	// Read whole datagrams: queries with EDNS options can be well over
+	// 512 bytes, and a short buffer silently truncates them.
+	buf := make([]byte, 65535)
+
+	for {
+		size, source, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if !s.drain.Stopping() {
+				s.listenerLog(l).Error("receiving failed", "addr", udpConn.LocalAddr().String(), "err", err)
+			}
+			return
+		}
+		send := func(reply []byte) error {
+			_, err := udpConn.WriteToUDP(reply, source)
+			return err
+		}
+		if !s.Limit.Acquire() {
+			if reply := s.Limit.Shed(buf[:size]); reply != nil {
+				(&responseWriter{send: send}).Write(reply)
+			}
+			continue
+		}
+
+		msg := GetBuffer(size)
+		copy(*msg, buf[:size])
+		spec, _ := l.current()
+		client := &Client{IP: source.IP, Port: source.Port, Local: udpConn.LocalAddr(), ACLs: spec.ACLs, Protocol: "udp"}
+		answering.Add(1)
+		s.drain.Go(func() {
+			defer answering.Done()
+			defer s.Limit.Release()
+			defer PutBuffer(msg)
+			s.serve(&responseWriter{client: client, query: *msg, send: send})
+		})
+	}
+}
+
+// serveTCP answers DNS over TCP connections on ln.
+func (s *Server) serveTCP(ln net.Listener, l *Listener) {
+	s.drain.OnStop(func() { ln.Close() })
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !s.drain.Stopping() {
+				s.listenerLog(l).Error("accepting connection failed", "addr", ln.Addr().String(), "err", err)
+			}
+			return
+		}
+		done := s.drain.Track(conn)
+		go func() {
+			defer done()
+			defer conn.Close()
+			spec, _ := l.current()
+			client := spec.client("tcp", conn.RemoteAddr().String(), conn.LocalAddr(), nil, nil)
+			s.serveStream(conn, client)
+		}()
+	}
+}
+
+// serveTLS answers DNS over TLS (RFC 7858) connections on ln.
+func (s *Server) serveTLS(ln net.Listener, l *Listener) {
+	s.drain.OnStop(func() { ln.Close() })
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !s.drain.Stopping() {
+				s.listenerLog(l).Error("accepting connection failed", "addr", ln.Addr().String(), "err", err)
+			}
+			return
+		}
+		done := s.drain.Track(conn)
+		go func() {
+			defer done()
+			defer conn.Close()
+			tc := conn.(*tls.Conn)
+			tc.SetDeadline(time.Now().Add(IdleTimeout))
+			if err := tc.Handshake(); err != nil {
+				tlsHandshakeFailures.Inc()
+				s.listenerLog(l).Debug("TLS handshake failed", "client", conn.RemoteAddr().String(), "err", err)
+				return
+			}
+			state := tc.ConnectionState()
+			spec, groups := l.current()
+			client := spec.client("tls", conn.RemoteAddr().String(), conn.LocalAddr(), &state, groups)
+			s.serveStream(tc, client)
+		}()
+	}
+}
+
+// serveStream answers length-prefixed messages on conn until the client
+// goes quiet or closes it, or the server shuts down.
+func (s *Server) serveStream(conn net.Conn, client *Client) {
+	client.Conn = conn
+	send := func(reply []byte) error {
+		framed := GetBuffer(0)
+		*framed = binary.BigEndian.AppendUint16(*framed, uint16(len(reply)))
+		*framed = append(*framed, reply...)
+		conn.SetWriteDeadline(time.Now().Add(IdleTimeout))
+		_, err := conn.Write(*framed)
+		PutBuffer(framed)
+		return err
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		if s.drain.Stopping() {
+			return
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		msg := GetBuffer(int(binary.BigEndian.Uint16(size[:])))
+		if _, err := io.ReadFull(conn, *msg); err != nil {
+			PutBuffer(msg)
+			return
+		}
+		w := &responseWriter{client: client, query: *msg, send: send}
+		s.serveLimited(w)
+		PutBuffer(msg)
+		if w.err != nil {
+			return
+		}
+	}
+}
+
+// dohHandler answers DNS over HTTPS (RFC 8484) GET and POST requests.
+func (s *Server) dohHandler(l *Listener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			msg, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			msg, err = io.ReadAll(io.LimitReader(r.Body, 65535))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil || len(msg) == 0 {
+			http.Error(w, "invalid DNS message", http.StatusBadRequest)
+			return
+		}
+		spec, groups := l.current()
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		client := spec.client("https", r.RemoteAddr, local, r.TLS, groups)
+		dw := &responseWriter{client: client, query: msg, send: func(reply []byte) error {
+			w.Header().Set("Content-Type", "application/dns-message")
+			_, err := w.Write(reply)
+			return err
+		}}
+		s.serveLimited(dw)
+		if !dw.written {
+			http.Error(w, "query dropped", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// serveHTTPS answers DNS over HTTPS on ln.
+func (s *Server) serveHTTPS(ln net.Listener, l *Listener) {
+	mux := http.NewServeMux()
+	mux.Handle(l.Spec.Path, s.dohHandler(l))
+	hs := &http.Server{Handler: mux, IdleTimeout: IdleTimeout}
+	s.drain.OnStop(func() { ln.Close() })
+	err := hs.Serve(ln)
+	if s.drain.Stopping() {
+		// Let requests being answered finish; idle connections are closed.
+		s.drain.Go(func() { hs.Shutdown(context.Background()) })
+		return
+	}
+	s.listenerLog(l).Error("serving DNS over HTTPS failed", "addr", ln.Addr().String(), "err", err)
+}
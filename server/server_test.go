@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// startServer serves h on a loopback UDP listener until the test ends,
+// returning the address it is bound to.
+func startServer(tb testing.TB, h Handler) net.Addr {
+	tb.Helper()
+	ready := make(chan net.Addr, 1)
+	s := &Server{
+		Handler:   h,
+		Log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Listeners: []*Listener{{Spec: &ListenerSpec{Addr: "127.0.0.1:0", ACLs: NewACLSet(), Transport: "udp"}}},
+		Ready: func(addrs []net.Addr) error {
+			ready <- addrs[0]
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- s.ListenAndServe(ctx) }()
+	tb.Cleanup(func() {
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	select {
+	case addr := <-ready:
+		return addr
+	case err := <-errs:
+		tb.Fatal(err)
+		return nil
+	}
+}
+
+// answerWith answers every query with an A record holding ip.
+func answerWith(ip net.IP) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *dnswire.Message) {
+		resp := new(dnswire.Query).SetReply(r)
+		resp.AddAnswer(&dnswire.ResourceRecord{Name: r.Questions[0].Name, Type: dnswire.TypeA, Class: dnswire.ClassINET, TTL: 60, RData: ip.To4()})
+		if reply, err := resp.AppendTo(*GetBuffer(0)); err == nil {
+			w.Write(reply)
+		}
+	})
+}
+
+// exchange sends a query for name over conn and returns the response.
+func exchange(tb testing.TB, conn net.Conn, id uint16, name string) *dnswire.Message {
+	tb.Helper()
+	q := new(dnswire.Query).SetQuestion(name, dnswire.TypeA)
+	q.Header.ID = id
+	data, err := q.Encode()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	m, err := dnswire.ParseMessage(buf[:n])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if m.Header.ID != id {
+		tb.Fatalf("response ID %d, want %d", m.Header.ID, id)
+	}
+	return m
+}
+
+func TestServeMux(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("example.com", answerWith(net.IPv4(192, 0, 2, 1)))
+	mux.Handle("sub.example.com.", answerWith(net.IPv4(192, 0, 2, 2)))
+	conn, err := net.Dial("udp", startServer(t, mux).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i, tc := range []struct {
+		name  string
+		rcode uint8
+		ip    string
+	}{
+		{"example.com", dnswire.RCodeSuccess, "192.0.2.1"},
+		{"www.example.com", dnswire.RCodeSuccess, "192.0.2.1"},
+		{"WWW.Sub.Example.COM", dnswire.RCodeSuccess, "192.0.2.2"},
+		{"a.b.sub.example.com", dnswire.RCodeSuccess, "192.0.2.2"},
+		{"notexample.com", dnswire.RCodeRefused, ""},
+		{"example.org", dnswire.RCodeRefused, ""},
+	} {
+		m := exchange(t, conn, uint16(i+1), tc.name)
+		if m.Header.RCode != tc.rcode {
+			t.Errorf("%s: rcode %s, want %s", tc.name, dnswire.RCodeString(m.Header.RCode), dnswire.RCodeString(tc.rcode))
+			continue
+		}
+		ip := ""
+		if len(m.Answers) == 1 {
+			ip = net.IP(m.Answers[0].RData).String()
+		}
+		if ip != tc.ip {
+			t.Errorf("%s: answered %q, want %q", tc.name, ip, tc.ip)
+		}
+	}
+}
+
+func TestShutdownWaitsForQueries(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := HandlerFunc(func(w ResponseWriter, r *dnswire.Message) {
+		close(started)
+		<-release
+		answerWith(net.IPv4(192, 0, 2, 1)).ServeDNS(w, r)
+	})
+	ready := make(chan net.Addr, 1)
+	s := &Server{
+		Handler:   h,
+		Log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Listeners: []*Listener{{Spec: &ListenerSpec{Addr: "127.0.0.1:0", ACLs: NewACLSet(), Transport: "udp"}}},
+		Ready: func(addrs []net.Addr) error {
+			ready <- addrs[0]
+			return nil
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe(context.Background()) }()
+	conn, err := net.Dial("udp", (<-ready).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	q := new(dnswire.Query).SetQuestion("www.example.com", dnswire.TypeA)
+	data, err := q.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	shut := make(chan error, 1)
+	go func() { shut <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shut:
+		t.Fatalf("Shutdown returned %v with a query being answered", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shut; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v, want ErrServerClosed", err)
+	}
+	// The answer waits in the socket for the read.
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != nil {
+		t.Errorf("the query being answered got no answer: %v", err)
+	}
+}
+
+func BenchmarkServe(b *testing.B) {
+	// The handler stands in for a forwarder with a canned upstream answer.
+	conn, err := net.Dial("udp", startServer(b, answerWith(net.IPv4(192, 0, 2, 1))).String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	q := new(dnswire.Query).SetQuestion("www.example.com", dnswire.TypeA)
+	data, err := q.Encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		// A fresh ID keeps the server from taking the query for a
+		// retransmission of the last.
+		data[0], data[1] = byte(i>>8), byte(i)
+		if _, err := conn.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Read(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
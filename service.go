@@ -0,0 +1,87 @@
+package dnsserver
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The service subcommand installs the server under the platform's service
+// manager: systemd on Linux, launchd on macOS and the service control
+// manager on Windows. All of them stop the server gracefully, with SIGTERM
+// or a stop control, and collect what it logs: systemd in the journal,
+// launchd in /var/log/<name>.log and Windows in the Application event log.
+
+const defaultServiceName = "dns-server"
+
+type serviceConfig struct {
+	Name       string
+	Executable string
+	// Args are the server flags the service runs with.
+	Args []string
+}
+
+func runService(args []string) error {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.String("name", defaultServiceName, "Name of the service")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server service [-name name] install [server flags]")
+		fmt.Fprintln(fs.Output(), "       dns-server service [-name name] uninstall|start|stop|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	s := &serviceConfig{Name: *name, Executable: exe, Args: fs.Args()[1:]}
+	action := fs.Arg(0)
+	if action != "install" && len(s.Args) > 0 {
+		return fmt.Errorf("service %s takes no arguments", action)
+	}
+	switch action {
+	case "install":
+		err = s.install()
+	case "uninstall":
+		err = s.uninstall()
+	case "start":
+		err = s.start()
+	case "stop":
+		err = s.stop()
+	case "status":
+		var status string
+		if status, err = s.status(); err == nil {
+			fmt.Println(status)
+		}
+	default:
+		return fmt.Errorf("unknown service action %q", action)
+	}
+	if err != nil {
+		return fmt.Errorf("service %s: %v", action, err)
+	}
+	return nil
+}
+
+// runServiceTool runs a service manager command, returning its output in
+// the error if it fails.
+func runServiceTool(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, msg)
+		}
+		return "", fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,95 @@
+//go:build darwin
+
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+func (s *serviceConfig) plistPath() string {
+	return "/Library/LaunchDaemons/" + s.Name + ".plist"
+}
+
+func (s *serviceConfig) target() string {
+	return "system/" + s.Name
+}
+
+func xmlString(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return "<string>" + buf.String() + "</string>"
+}
+
+func (s *serviceConfig) install() error {
+	if _, err := os.Stat(s.plistPath()); err == nil {
+		return fmt.Errorf("%s already exists", s.plistPath())
+	}
+	args := xmlString(s.Executable)
+	for _, arg := range s.Args {
+		args += "\n\t\t" + xmlString(arg)
+	}
+	logPath := "/var/log/" + s.Name + ".log"
+	// KeepAlive restarts the server when it fails, but not after a
+	// graceful stop, which exits successfully.
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	%s
+	<key>ProgramArguments</key>
+	<array>
+		%s
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	%s
+	<key>StandardErrorPath</key>
+	%s
+</dict>
+</plist>
+`, xmlString(s.Name), args, xmlString(logPath), xmlString(logPath))
+	if err := os.WriteFile(s.plistPath(), []byte(plist), 0o644); err != nil {
+		return err
+	}
+	_, err := runServiceTool("launchctl", "bootstrap", "system", s.plistPath())
+	return err
+}
+
+func (s *serviceConfig) uninstall() error {
+	runServiceTool("launchctl", "bootout", s.target())
+	return os.Remove(s.plistPath())
+}
+
+func (s *serviceConfig) start() error {
+	_, err := runServiceTool("launchctl", "kickstart", s.target())
+	return err
+}
+
+func (s *serviceConfig) stop() error {
+	_, err := runServiceTool("launchctl", "kill", "SIGTERM", s.target())
+	return err
+}
+
+var launchdState = regexp.MustCompile(`(?m)^\s*state = (\S+)`)
+
+func (s *serviceConfig) status() (string, error) {
+	out, err := runServiceTool("launchctl", "print", s.target())
+	if err != nil {
+		return "", err
+	}
+	if m := launchdState.FindStringSubmatch(out); m != nil {
+		return m[1], nil
+	}
+	return "unknown", nil
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package dnsserver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func (s *serviceConfig) unitPath() string {
+	return "/etc/systemd/system/" + s.Name + ".service"
+}
+
+// systemdQuote quotes an ExecStart argument, escaping what systemd would
+// otherwise expand.
+func systemdQuote(arg string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + r.Replace(arg) + `"`
+}
+
+func (s *serviceConfig) install() error {
+	if _, err := os.Stat(s.unitPath()); err == nil {
+		return fmt.Errorf("%s already exists", s.unitPath())
+	}
+	cmd := []string{systemdQuote(s.Executable)}
+	for _, arg := range s.Args {
+		cmd = append(cmd, systemdQuote(arg))
+	}
+	unit := fmt.Sprintf(`[Unit]
+Description=DNS server (%s)
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+KillSignal=SIGTERM
+
+[Install]
+WantedBy=multi-user.target
+`, s.Name, strings.Join(cmd, " "))
+	if err := os.WriteFile(s.unitPath(), []byte(unit), 0o644); err != nil {
+		return err
+	}
+	if _, err := runServiceTool("systemctl", "daemon-reload"); err != nil {
+		os.Remove(s.unitPath())
+		return err
+	}
+	_, err := runServiceTool("systemctl", "enable", s.Name)
+	return err
+}
+
+func (s *serviceConfig) uninstall() error {
+	runServiceTool("systemctl", "disable", "--now", s.Name)
+	if err := os.Remove(s.unitPath()); err != nil {
+		return err
+	}
+	_, err := runServiceTool("systemctl", "daemon-reload")
+	return err
+}
+
+func (s *serviceConfig) start() error {
+	_, err := runServiceTool("systemctl", "start", s.Name)
+	return err
+}
+
+func (s *serviceConfig) stop() error {
+	_, err := runServiceTool("systemctl", "stop", s.Name)
+	return err
+}
+
+func (s *serviceConfig) status() (string, error) {
+	if _, err := os.Stat(s.unitPath()); err != nil {
+		return "", fmt.Errorf("%s is not installed", s.Name)
+	}
+	out, err := runServiceTool("systemctl", "show", "--property=ActiveState", "--value", s.Name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
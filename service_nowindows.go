@@ -0,0 +1,14 @@
+//go:build !windows
+
+package dnsserver
+
+import (
+	"fmt"
+	"io"
+)
+
+func startWindowsService(name string) (io.Writer, error) {
+	return nil, fmt.Errorf("only supported on Windows")
+}
+
+func stopWindowsService() {}
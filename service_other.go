@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package dnsserver
+
+import "fmt"
+
+var errServiceUnsupported = fmt.Errorf("not supported on this platform")
+
+func (s *serviceConfig) install() error          { return errServiceUnsupported }
+func (s *serviceConfig) uninstall() error        { return errServiceUnsupported }
+func (s *serviceConfig) start() error            { return errServiceUnsupported }
+func (s *serviceConfig) stop() error             { return errServiceUnsupported }
+func (s *serviceConfig) status() (string, error) { return "", errServiceUnsupported }
@@ -0,0 +1,326 @@
+//go:build windows
+
+package dnsserver
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManager                = advapi32.NewProc("OpenSCManagerW")
+	procCreateService                = advapi32.NewProc("CreateServiceW")
+	procOpenService                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procStartService                 = advapi32.NewProc("StartServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procQueryServiceStatus           = advapi32.NewProc("QueryServiceStatus")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSource          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent                  = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx               = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx                = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKey                 = advapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	scManagerAllAccess = 0xf003f
+	serviceAllAccess   = 0xf01ff
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceControlStop     = 1
+	serviceControlShutdown = 5
+	serviceAcceptStop      = 1
+	serviceAcceptShutdown  = 4
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	eventlogErrorType       = 1
+	eventlogWarningType     = 2
+	eventlogInformationType = 4
+
+	hkeyLocalMachine = 0x80000002
+	keySetValue      = 0x2
+	regExpandSz      = 2
+	regDword         = 4
+
+	// EventCreate.exe's message table formats events 1 to 1000 as their
+	// only string, so the event log shows the text we report.
+	eventMessageFile = `%SystemRoot%\System32\EventCreate.exe`
+	eventLogKey      = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// call keeps pointers passed as uintptr alive, as proc.Call does.
+//
+//go:uintptrescapes
+func call(proc *syscall.LazyProc, args ...uintptr) (uintptr, error) {
+	r, _, err := proc.Call(args...)
+	if r == 0 {
+		return 0, fmt.Errorf("%s: %v", strings.TrimSuffix(proc.Name, "W"), err)
+	}
+	return r, nil
+}
+
+func utf16Ptr(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
+
+func openService(name string) (manager, service uintptr, err error) {
+	if manager, err = call(procOpenSCManager, 0, 0, scManagerAllAccess); err != nil {
+		return 0, 0, err
+	}
+	if service, err = call(procOpenService, manager, uintptr(unsafe.Pointer(utf16Ptr(name))), serviceAllAccess); err != nil {
+		procCloseServiceHandle.Call(manager)
+		return 0, 0, err
+	}
+	return manager, service, nil
+}
+
+func (s *serviceConfig) install() error {
+	manager, err := call(procOpenSCManager, 0, 0, scManagerAllAccess)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(manager)
+
+	cmd := []string{syscall.EscapeArg(s.Executable), "-windows-service", syscall.EscapeArg(s.Name)}
+	for _, arg := range s.Args {
+		cmd = append(cmd, syscall.EscapeArg(arg))
+	}
+	service, err := call(procCreateService, manager, uintptr(unsafe.Pointer(utf16Ptr(s.Name))), uintptr(unsafe.Pointer(utf16Ptr("DNS server ("+s.Name+")"))),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(utf16Ptr(strings.Join(cmd, " ")))), 0, 0, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	procCloseServiceHandle.Call(service)
+	return registerEventSource(s.Name)
+}
+
+func registerEventSource(name string) error {
+	var key uintptr
+	if r, _, _ := procRegCreateKeyEx.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(eventLogKey+name))), 0, 0, 0,
+		keySetValue, 0, uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return fmt.Errorf("creating event source: %v", syscall.Errno(r))
+	}
+	defer syscall.RegCloseKey(syscall.Handle(key))
+
+	file, _ := syscall.UTF16FromString(eventMessageFile)
+	if r, _, _ := procRegSetValueEx.Call(key, uintptr(unsafe.Pointer(utf16Ptr("EventMessageFile"))), 0, regExpandSz,
+		uintptr(unsafe.Pointer(&file[0])), uintptr(len(file)*2)); r != 0 {
+		return fmt.Errorf("creating event source: %v", syscall.Errno(r))
+	}
+	types := uint32(eventlogErrorType | eventlogWarningType | eventlogInformationType)
+	if r, _, _ := procRegSetValueEx.Call(key, uintptr(unsafe.Pointer(utf16Ptr("TypesSupported"))), 0, regDword,
+		uintptr(unsafe.Pointer(&types)), 4); r != 0 {
+		return fmt.Errorf("creating event source: %v", syscall.Errno(r))
+	}
+	return nil
+}
+
+func (s *serviceConfig) uninstall() error {
+	manager, service, err := openService(s.Name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(manager)
+	defer procCloseServiceHandle.Call(service)
+	if _, err := call(procDeleteService, service); err != nil {
+		return err
+	}
+	procRegDeleteKey.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(eventLogKey+s.Name))))
+	return nil
+}
+
+func (s *serviceConfig) start() error {
+	manager, service, err := openService(s.Name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(manager)
+	defer procCloseServiceHandle.Call(service)
+	_, err = call(procStartService, service, 0, 0)
+	return err
+}
+
+func (s *serviceConfig) stop() error {
+	manager, service, err := openService(s.Name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(manager)
+	defer procCloseServiceHandle.Call(service)
+	var status serviceStatus
+	_, err = call(procControlService, service, serviceControlStop, uintptr(unsafe.Pointer(&status)))
+	return err
+}
+
+func (s *serviceConfig) status() (string, error) {
+	manager, service, err := openService(s.Name)
+	if err != nil {
+		return "", err
+	}
+	defer procCloseServiceHandle.Call(manager)
+	defer procCloseServiceHandle.Call(service)
+	var status serviceStatus
+	if _, err := call(procQueryServiceStatus, service, uintptr(unsafe.Pointer(&status))); err != nil {
+		return "", err
+	}
+	switch status.CurrentState {
+	case serviceStopped:
+		return "stopped", nil
+	case serviceStartPending:
+		return "starting", nil
+	case serviceStopPending:
+		return "stopping", nil
+	case serviceRunning:
+		return "running", nil
+	}
+	return fmt.Sprintf("state %d", status.CurrentState), nil
+}
+
+// windowsService is the server running under the service control manager,
+// which asks it to stop through shutdown.Request.
+var windowsService struct {
+	name    *uint16
+	handle  uintptr
+	running chan error
+	stopped chan struct{}
+	done    chan struct{}
+}
+
+func setWindowsServiceState(state uint32) {
+	status := serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: state}
+	switch state {
+	case serviceRunning:
+		status.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	case serviceStopPending:
+		// Stopping waits up to -shutdown-timeout for in-flight queries.
+		status.WaitHint = 30000
+	}
+	procSetServiceStatus.Call(windowsService.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+func serviceMain(argc, argv uintptr) uintptr {
+	handle, err := call(procRegisterServiceCtrlHandlerEx, uintptr(unsafe.Pointer(windowsService.name)),
+		syscall.NewCallback(serviceHandler), 0)
+	if err != nil {
+		windowsService.running <- err
+		return 0
+	}
+	windowsService.handle = handle
+	setWindowsServiceState(serviceRunning)
+	windowsService.running <- nil
+	// The dispatcher returns once this does, which must wait until the
+	// server reported it has stopped.
+	<-windowsService.stopped
+	return 0
+}
+
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setWindowsServiceState(serviceStopPending)
+		shutdown.Request()
+	}
+	return 0
+}
+
+// startWindowsService connects to the service control manager, which
+// started this process as the service name. Log records written to the
+// returned writer go to the Application event log.
+func startWindowsService(name string) (io.Writer, error) {
+	var err error
+	if windowsService.name, err = syscall.UTF16PtrFromString(name); err != nil {
+		return nil, err
+	}
+	windowsService.running = make(chan error, 1)
+	windowsService.stopped = make(chan struct{})
+	windowsService.done = make(chan struct{})
+	go func() {
+		// The dispatcher runs serviceMain on its own thread and blocks
+		// this one until the service stops.
+		runtime.LockOSThread()
+		defer close(windowsService.done)
+		table := []serviceTableEntry{{windowsService.name, syscall.NewCallback(serviceMain)}, {}}
+		if _, err := call(procStartServiceCtrlDispatcher, uintptr(unsafe.Pointer(&table[0]))); err != nil {
+			windowsService.running <- err
+		}
+	}()
+	if err := <-windowsService.running; err != nil {
+		return nil, err
+	}
+
+	source, err := call(procRegisterEventSource, 0, uintptr(unsafe.Pointer(windowsService.name)))
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogWriter{source: source}, nil
+}
+
+// stopWindowsService reports the server has stopped.
+func stopWindowsService() {
+	if windowsService.stopped == nil {
+		return
+	}
+	setWindowsServiceState(serviceStopped)
+	close(windowsService.stopped)
+	<-windowsService.done
+}
+
+type eventLogWriter struct {
+	mu     sync.Mutex
+	source uintptr
+}
+
+// Write reports one log record as an event, whose type follows its level.
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	kind := eventlogInformationType
+	switch {
+	case strings.Contains(msg, "level=ERROR"), strings.Contains(msg, `"level":"ERROR"`):
+		kind = eventlogErrorType
+	case strings.Contains(msg, "level=WARN"), strings.Contains(msg, `"level":"WARN"`):
+		kind = eventlogWarningType
+	}
+	strs := []*uint16{utf16Ptr(msg)}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := call(procReportEvent, w.source, uintptr(kind), 0, 1, 0, 1, 0,
+		uintptr(unsafe.Pointer(&strs[0])), 0); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,36 @@
+package dnsserver
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// shutdown is the process's stop: Request asks main to stop, as SIGTERM
+// does, and Stopping tells readiness checks it began. Each Server drains
+// its own listeners and queries.
+var shutdown = &shutdownState{requested: make(chan struct{})}
+
+type shutdownState struct {
+	stopping  atomic.Bool
+	requested chan struct{}
+	request   sync.Once
+}
+
+func (s *shutdownState) Stopping() bool {
+	return s.stopping.Load()
+}
+
+// Request asks main to shut down as if it got SIGTERM.
+func (s *shutdownState) Request() {
+	s.request.Do(func() { close(s.requested) })
+}
+
+// Requested is closed once Request is called.
+func (s *shutdownState) Requested() <-chan struct{} {
+	return s.requested
+}
+
+// Begin marks the shutdown as begun.
+func (s *shutdownState) Begin() {
+	s.stopping.Store(true)
+}
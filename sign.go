@@ -0,0 +1,515 @@
+package dnsserver
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// SigningKey is a DNSSEC key pair plus its BIND style timing metadata.
+// A zero time means the event is unset: the key is published and active
+// from the start and never retired.
+type SigningKey struct {
+	DNSKEY  *DNSKEY
+	Private crypto.PrivateKey
+
+	Created  time.Time
+	Publish  time.Time
+	Activate time.Time
+	Inactive time.Time
+	Delete   time.Time
+}
+
+func (k *SigningKey) IsKSK() bool {
+	return k.DNSKEY.Flags&DNSKEYFlagSEP != 0
+}
+
+// Published reports whether the DNSKEY belongs in the zone at t.
+func (k *SigningKey) Published(t time.Time) bool {
+	return (k.Publish.IsZero() || !t.Before(k.Publish)) && (k.Delete.IsZero() || t.Before(k.Delete))
+}
+
+// Active reports whether the key should be signing at t.
+func (k *SigningKey) Active(t time.Time) bool {
+	return k.Published(t) && (k.Activate.IsZero() || !t.Before(k.Activate)) &&
+		(k.Inactive.IsZero() || t.Before(k.Inactive))
+}
+
+func (k *SigningKey) sign(data []byte) ([]byte, error) {
+	switch priv := k.Private.(type) {
+	case *rsa.PrivateKey:
+		hash := crypto.SHA256
+		if k.DNSKEY.Algorithm == AlgRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		return rsa.SignPKCS1v15(rand.Reader, priv, hash, h.Sum(nil))
+	case *ecdsa.PrivateKey:
+		hash := crypto.SHA256
+		if k.DNSKEY.Algorithm == AlgECDSAP384SHA384 {
+			hash = crypto.SHA384
+		}
+		h := hash.New()
+		h.Write(data)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		size := priv.Curve.Params().BitSize / 8
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(priv, data), nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", k.Private)
+}
+
+// LoadSigningKeys reads the BIND style K<zone>.+<alg>+<tag>.key/.private
+// pairs for zone from dir.
+func LoadSigningKeys(dir, zone string) ([]*SigningKey, error) {
+	pattern := filepath.Join(dir, "K"+fqdn(normalizeName(zone))+"+*.private")
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var keys []*SigningKey
+	for _, path := range paths {
+		k, err := loadKeyPair(strings.TrimSuffix(path, ".private"), zone)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func loadKeyPair(base, zone string) (*SigningKey, error) {
+	f, err := os.Open(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	records, err := ParseZone(f, zone)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s.key: %v", base, err)
+	}
+	var dnskey *DNSKEY
+	for _, rr := range records {
+		if rr.Type == TypeDNSKEY {
+			dnskey, err = parseDNSKEY(rr.RData)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if dnskey == nil {
+		return nil, fmt.Errorf("%s.key: no DNSKEY record", base)
+	}
+
+	fields, err := readPrivateKeyFile(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	priv, err := privateKeyFromFields(dnskey, fields)
+	if err != nil {
+		return nil, fmt.Errorf("%s.private: %v", base, err)
+	}
+	k := &SigningKey{DNSKEY: dnskey, Private: priv}
+	for name, t := range k.timings() {
+		if v, ok := fields[name]; ok {
+			if *t, err = time.Parse(keyTimeFormat, v); err != nil {
+				return nil, fmt.Errorf("%s.private: bad %s time %q", base, name, v)
+			}
+		}
+	}
+	return k, nil
+}
+
+const keyTimeFormat = "20060102150405"
+
+func (k *SigningKey) timings() map[string]*time.Time {
+	return map[string]*time.Time{
+		"Created":  &k.Created,
+		"Publish":  &k.Publish,
+		"Activate": &k.Activate,
+		"Inactive": &k.Inactive,
+		"Delete":   &k.Delete,
+	}
+}
+
+func readPrivateKeyFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), ":")
+		if ok {
+			fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return fields, scanner.Err()
+}
+
+func privateKeyFromFields(dnskey *DNSKEY, fields map[string]string) (crypto.PrivateKey, error) {
+	alg, _, _ := strings.Cut(fields["Algorithm"], " ")
+	if n, err := strconv.Atoi(alg); err != nil || uint8(n) != dnskey.Algorithm {
+		return nil, fmt.Errorf("algorithm %q does not match DNSKEY algorithm %d", fields["Algorithm"], dnskey.Algorithm)
+	}
+	b64 := func(name string) (*big.Int, error) {
+		raw, err := base64.StdEncoding.DecodeString(fields[name])
+		if err != nil || len(raw) == 0 {
+			return nil, fmt.Errorf("missing or invalid %s", name)
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+
+	switch dnskey.Algorithm {
+	case AlgRSASHA256, AlgRSASHA512:
+		pub, err := rsaPublicKey(dnskey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		priv := &rsa.PrivateKey{PublicKey: *pub}
+		if priv.D, err = b64("PrivateExponent"); err != nil {
+			return nil, err
+		}
+		p, err := b64("Prime1")
+		if err != nil {
+			return nil, err
+		}
+		q, err := b64("Prime2")
+		if err != nil {
+			return nil, err
+		}
+		priv.Primes = []*big.Int{p, q}
+		if err := priv.Validate(); err != nil {
+			return nil, err
+		}
+		priv.Precompute()
+		return priv, nil
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		curve := elliptic.P256()
+		if dnskey.Algorithm == AlgECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		d, err := b64("PrivateKey")
+		if err != nil {
+			return nil, err
+		}
+		priv := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: d}
+		priv.X, priv.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, curve.Params().BitSize/8)))
+		size := curve.Params().BitSize / 8
+		if len(dnskey.PublicKey) != 2*size || priv.X.Cmp(new(big.Int).SetBytes(dnskey.PublicKey[:size])) != 0 {
+			return nil, fmt.Errorf("private key does not match DNSKEY")
+		}
+		return priv, nil
+	case AlgED25519:
+		seed, err := base64.StdEncoding.DecodeString(fields["PrivateKey"])
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("missing or invalid PrivateKey")
+		}
+		priv := ed25519.NewKeyFromSeed(seed)
+		if string(priv.Public().(ed25519.PublicKey)) != string(dnskey.PublicKey) {
+			return nil, fmt.Errorf("private key does not match DNSKEY")
+		}
+		return priv, nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %d", dnskey.Algorithm)
+}
+
+type signedRRSet struct {
+	fingerprint [32]byte
+	signers     string
+	sigs        []*ResourceRecord
+	refreshAt   time.Time
+}
+
+// ZoneSigner produces RRSIGs for a zone's RRsets and keeps them fresh.
+// Signatures are cached per RRset and regenerated once they come within
+// Refresh of expiring or the RRset changes.
+type ZoneSigner struct {
+	Keys     []*SigningKey
+	Validity time.Duration
+	Refresh  time.Duration
+	Jitter   time.Duration
+	// Online signs RRsets lazily as they are queried instead of signing
+	// the whole zone up front.
+	Online bool
+	// NSEC3 selects hashed denial of existence; nil means plain NSEC.
+	NSEC3 *NSEC3Params
+	// WhiteLies answers denials with minimally covering NSEC/NSEC3
+	// records generated per query (RFC 4470, RFC 7129 appendix B).
+	WhiteLies bool
+	// PublishCDS publishes CDS and CDNSKEY records for the KSKs the parent
+	// should have DS records for.
+	PublishCDS bool
+	// ParentPoll is how often to look up the zone's DS RRset through
+	// Resolver to find out whether the parent is in sync; 0 disables it.
+	ParentPoll time.Duration
+	Resolver   *net.UDPAddr
+
+	// parentDS is the DS RRset the parent served at the last poll, nil if
+	// it hasn't been polled. It is guarded by the zone's lock.
+	parentDS []*DS
+
+	mu    sync.Mutex
+	cache map[string]*signedRRSet
+}
+
+func (s *ZoneSigner) keysFor(rrtype uint16, now time.Time) []*SigningKey {
+	var ksks, zsks []*SigningKey
+	for _, k := range s.Keys {
+		if !k.Active(now) {
+			continue
+		}
+		if k.IsKSK() {
+			ksks = append(ksks, k)
+		} else {
+			zsks = append(zsks, k)
+		}
+	}
+	// A lone key of either kind acts as a combined signing key.
+	if len(ksks) == 0 {
+		return zsks
+	}
+	if len(zsks) == 0 || rrtype == TypeDNSKEY || rrtype == TypeCDNSKEY || rrtype == TypeCDS {
+		return ksks
+	}
+	return zsks
+}
+
+func (s *ZoneSigner) sigsFor(z *Zone, rrset []*ResourceRecord) []*ResourceRecord {
+	key := rrsetKey(rrset[0].Name, rrset[0].Type)
+	fp := rrsetFingerprint(rrset)
+	now := time.Now()
+	var signers strings.Builder
+	for _, k := range s.keysFor(rrset[0].Type, now) {
+		fmt.Fprintf(&signers, "%d/%d ", k.DNSKEY.Algorithm, k.DNSKEY.KeyTag())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil {
+		s.cache = map[string]*signedRRSet{}
+	}
+	if c := s.cache[key]; c != nil && c.fingerprint == fp && c.signers == signers.String() && now.Before(c.refreshAt) {
+		return c.sigs
+	}
+
+	expiration := now.Add(s.Validity)
+	if s.Jitter > 0 {
+		expiration = expiration.Add(-time.Duration(mrand.Int64N(int64(s.Jitter))))
+	}
+	sigs, err := s.sign(z.Origin, rrset, now.Add(-time.Hour), expiration)
+	if err != nil {
+		logDNSSEC.Error("signing failed", "name", fqdn(rrset[0].Name), "type", dnswire.TypeString(rrset[0].Type), "err", err)
+		return nil
+	}
+	s.cache[key] = &signedRRSet{fingerprint: fp, signers: signers.String(), sigs: sigs, refreshAt: expiration.Add(-s.Refresh)}
+	return sigs
+}
+
+// signOnce signs records synthesized for a single response, bypassing the
+// cache so per-query denial records don't accumulate.
+func (s *ZoneSigner) signOnce(z *Zone, rrset []*ResourceRecord) []*ResourceRecord {
+	now := time.Now()
+	sigs, err := s.sign(z.Origin, rrset, now.Add(-time.Hour), now.Add(s.Validity))
+	if err != nil {
+		logDNSSEC.Error("signing failed", "name", fqdn(rrset[0].Name), "type", dnswire.TypeString(rrset[0].Type), "err", err)
+	}
+	return sigs
+}
+
+func (s *ZoneSigner) sign(origin string, rrset []*ResourceRecord, inception, expiration time.Time) ([]*ResourceRecord, error) {
+	owner := rrset[0].Name
+	labels := countLabels(owner)
+	if owner == "*" || strings.HasPrefix(owner, "*.") {
+		labels--
+	}
+
+	var out []*ResourceRecord
+	for _, k := range s.keysFor(rrset[0].Type, time.Now()) {
+		sig := &RRSIG{
+			TypeCovered: rrset[0].Type,
+			Algorithm:   k.DNSKEY.Algorithm,
+			Labels:      uint8(labels),
+			OrigTTL:     rrset[0].TTL,
+			Inception:   uint32(inception.Unix()),
+			Expiration:  uint32(expiration.Unix()),
+			KeyTag:      k.DNSKEY.KeyTag(),
+			SignerName:  origin,
+		}
+		data, err := signedData(sig, rrset)
+		if err != nil {
+			return nil, err
+		}
+		if sig.Signature, err = k.sign(data); err != nil {
+			return nil, err
+		}
+		out = append(out, &ResourceRecord{
+			Name:  owner,
+			Type:  TypeRRSIG,
+			Class: rrset[0].Class,
+			TTL:   rrset[0].TTL,
+			RData: sig.RData(),
+		})
+	}
+	return out, nil
+}
+
+func rrsetFingerprint(rrset []*ResourceRecord) [32]byte {
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdatas = append(rdatas, rr.RData)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return string(rdatas[i]) < string(rdatas[j]) })
+
+	h := sha256.New()
+	h.Write(canonicalName(rrset[0].Name))
+	binary.Write(h, binary.BigEndian, []uint32{uint32(rrset[0].Type), rrset[0].TTL})
+	for _, rdata := range rdatas {
+		binary.Write(h, binary.BigEndian, uint16(len(rdata)))
+		h.Write(rdata)
+	}
+	var fp [32]byte
+	h.Sum(fp[:0])
+	return fp
+}
+
+// SetSigner enables DNSSEC for the zone: it publishes the signer's keys,
+// builds the NSEC chain and, unless signing online, signs every RRset.
+func (z *Zone) SetSigner(s *ZoneSigner) {
+	z.mu.Lock()
+	z.signer = s
+	z.prepareSigned()
+	z.mu.Unlock()
+
+	if !s.Online {
+		z.SignAll()
+	}
+}
+
+// prepareSigned drops stale signatures and denial records and regenerates
+// the DNSKEY RRset and the NSEC or NSEC3 chain. The caller holds z.mu.
+func (z *Zone) prepareSigned() {
+	z.version.Store(zoneVersions.Add(1))
+	soa := z.rrsets[z.Origin][TypeSOA][0]
+	for name, sets := range z.rrsets {
+		delete(sets, TypeRRSIG)
+		delete(sets, TypeNSEC)
+		delete(sets, TypeNSEC3)
+		if len(sets) == 0 {
+			delete(z.rrsets, name)
+		}
+	}
+
+	// DNSKEYs of managed keys follow their publication times; any others
+	// from the zone file are left alone.
+	now := time.Now()
+	apex := z.rrsets[z.Origin]
+	managed := map[string]bool{}
+	for _, k := range z.signer.Keys {
+		managed[string(k.DNSKEY.RData())] = true
+	}
+	var dnskeys []*ResourceRecord
+	for _, rr := range apex[TypeDNSKEY] {
+		if !managed[string(rr.RData)] {
+			dnskeys = append(dnskeys, rr)
+		}
+	}
+	for _, k := range z.signer.Keys {
+		if k.Published(now) {
+			dnskeys = append(dnskeys, &ResourceRecord{
+				Name: z.Origin, Type: TypeDNSKEY, Class: ClassINET, TTL: soa.TTL, RData: k.DNSKEY.RData(),
+			})
+		}
+	}
+	apex[TypeDNSKEY] = dnskeys
+	if z.signer.PublishCDS {
+		apex[TypeCDS], apex[TypeCDNSKEY] = z.signer.cdsRecords(z.Origin, soa.TTL, now)
+		if len(apex[TypeCDS]) == 0 {
+			delete(apex, TypeCDS)
+			delete(apex, TypeCDNSKEY)
+		}
+	}
+	z.index()
+	z.buildDenialChain()
+}
+
+// SignAll makes sure every authoritative RRset has current signatures.
+func (z *Zone) SignAll() {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if z.signer == nil {
+		return
+	}
+	for _, name := range z.names {
+		for t, rrset := range z.rrsets[name] {
+			if t == TypeRRSIG || (z.isDelegation(name) && t != TypeDS && t != TypeNSEC) {
+				continue
+			}
+			z.signer.sigsFor(z, rrset)
+		}
+	}
+	for _, e := range z.nsec3 {
+		z.signer.sigsFor(z, e.rrset)
+	}
+}
+
+// keyTypes are the RRsets key timing events change.
+var keyTypes = []uint16{TypeDNSKEY, TypeCDS, TypeCDNSKEY}
+
+// RunMaintenance periodically picks up key changes from keyDir, applies
+// key timing events and refreshes signatures that are close to expiry.
+func (z *Zone) RunMaintenance(keyDir string, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if z.retired.Load() {
+			return
+		}
+		keys, err := LoadSigningKeys(keyDir, z.Origin)
+		if err != nil {
+			logDNSSEC.Error("reloading keys failed", "zone", fqdn(z.Origin), "err", err)
+		} else if len(keys) > 0 {
+			z.mu.Lock()
+			apex := map[string]map[uint16][]*ResourceRecord{z.Origin: z.rrsets[z.Origin]}
+			before := rrsetTexts(apex, keyTypes)
+			z.signer.Keys = keys
+			z.prepareSigned()
+			after := rrsetTexts(apex, keyTypes)
+			z.mu.Unlock()
+			auditRRsets("key timing", z.Origin, before, after)
+		}
+		if !z.signer.Online {
+			z.SignAll()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package dnsserver
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// queryStages records how long a query spent in each stage of handling,
+// in the order the stages first ran. Stages that run more than once, like
+// upstream for a query with several questions, add up.
+type queryStages struct {
+	names []string
+	took  []time.Duration
+}
+
+// Time starts timing stage; calling the returned function stops it.
+func (s *queryStages) Time(stage string) func() {
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		for i, name := range s.names {
+			if name == stage {
+				s.took[i] += d
+				return
+			}
+		}
+		s.names = append(s.names, stage)
+		s.took = append(s.took, d)
+	}
+}
+
+// SlowQueryLog logs queries whose handling took longer than Threshold with
+// their per-stage timing, to find where tail latency comes from without
+// logging every query.
+type SlowQueryLog struct {
+	Threshold time.Duration
+}
+
+func (l *SlowQueryLog) Record(client *server.Client, m *Message, resp *Query, stages *queryStages, took time.Duration) {
+	if l == nil || took < l.Threshold {
+		return
+	}
+	attrs := []any{"client", client.IP.String(), "protocol", client.Protocol, "took", took}
+	if len(m.Questions) > 0 {
+		q := m.Questions[0]
+		attrs = append(attrs, "qname", fqdn(normalizeName(q.Name)), "qtype", dnswire.TypeString(q.QType))
+	}
+	if resp != nil {
+		attrs = append(attrs, "rcode", dnswire.RCodeString(resp.Header.RCode))
+	} else {
+		attrs = append(attrs, "rcode", "DROPPED")
+	}
+	var timings []any
+	for i, name := range stages.names {
+		timings = append(timings, slog.Duration(name, stages.took[i]))
+	}
+	attrs = append(attrs, slog.Group("stages", timings...))
+	logSlowQuery.Warn("slow query", attrs...)
+}
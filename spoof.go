@@ -0,0 +1,149 @@
+package dnsserver
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Upstream responses that don't belong to the query they arrive for are a
+// sign of an off-path poisoning attempt: an attacker racing the real answer
+// has to guess the ID, echo the question, and with 0x20 encoding also the
+// random letter case of the name. exchange counts every such response; a
+// SpoofDetector adds 0x20 encoding, watches for a second, different answer
+// to the same query after the first one was accepted, and logs an alert when
+// an upstream sees too many anomalies.
+
+const (
+	anomalyID        = "id_mismatch"
+	anomalyQuestion  = "question_mismatch"
+	anomalyCase      = "case_mismatch"
+	anomalyConflict  = "conflicting_duplicate"
+	anomalyAlertSpan = time.Minute
+)
+
+var upstreamAnomalies = NewCounterVec("dns_upstream_anomalies_total", "Upstream responses that looked spoofed.", "upstream", "kind")
+
+type SpoofDetector struct {
+	// Use0x20 randomizes the letter case of outgoing question names and
+	// requires responses to echo it. Only use it with upstreams that
+	// preserve case.
+	Use0x20 bool
+	// Linger is how long to keep listening for conflicting duplicates
+	// after a response was accepted.
+	Linger time.Duration
+	// AlertThreshold is the number of anomalies from one upstream within a
+	// minute that triggers an alert; 0 disables alerts.
+	AlertThreshold int
+
+	mu     sync.Mutex
+	recent map[string][]time.Time
+	alerts map[string]time.Time
+}
+
+// spoofDetector is set up from the command line; nil only counts anomalies.
+var spoofDetector *SpoofDetector
+
+// record counts an anomaly seen from upstream.
+func (d *SpoofDetector) record(upstream, kind string) {
+	upstreamAnomalies.With(upstream, kind).Inc()
+	if d == nil || d.AlertThreshold <= 0 {
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.recent == nil {
+		d.recent, d.alerts = map[string][]time.Time{}, map[string]time.Time{}
+	}
+	times := d.recent[upstream]
+	for len(times) > 0 && now.Sub(times[0]) > anomalyAlertSpan {
+		times = times[1:]
+	}
+	times = append(times, now)
+	d.recent[upstream] = times
+	if len(times) >= d.AlertThreshold && now.Sub(d.alerts[upstream]) > anomalyAlertSpan {
+		d.alerts[upstream] = now
+		logUpstream.Error("ALERT: possible spoofing attempt", "upstream", upstream, "suspicious_last_minute", len(times), "latest", kind)
+	}
+}
+
+// randomizeCase applies 0x20 encoding to name.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			if rand.IntN(2) == 0 {
+				b[i] = c ^ 0x20
+			}
+		}
+	}
+	return string(b)
+}
+
+// checkResponse returns the anomaly resp shows as an answer to q, or "".
+func checkResponse(q *Query, resp *LazyMessage) string {
+	if resp.Header.ID != q.Header.ID {
+		return anomalyID
+	}
+	if int(resp.Header.QDCount) != len(q.Questions) {
+		return anomalyQuestion
+	}
+	for i, qq := range q.Questions {
+		rq, err := resp.Question(i)
+		if err != nil {
+			return anomalyQuestion
+		}
+		if rq.QType != qq.QType || rq.QClass != qq.QClass || !strings.EqualFold(fqdn(rq.Name), fqdn(qq.Name)) {
+			return anomalyQuestion
+		}
+		if fqdn(rq.Name) != fqdn(qq.Name) {
+			return anomalyCase
+		}
+	}
+	return ""
+}
+
+// answerKey summarizes the rcode and answer records of m, ignoring order
+// and TTLs, so that two responses can be compared.
+func answerKey(m *Message) string {
+	keys := []string{fmt.Sprint(m.Header.RCode)}
+	for _, rr := range m.Answers {
+		keys = append(keys, fmt.Sprintf("%s %d %x", normalizeName(rr.Name), rr.Type, rr.RData))
+	}
+	sort.Strings(keys[1:])
+	return strings.Join(keys, "\n")
+}
+
+// linger keeps reading from conn after the response with the given
+// answerKey was returned to the caller, and records responses that claim to
+// answer the same query differently. It closes conn when done.
+func (d *SpoofDetector) linger(conn *net.UDPConn, upstream string, q *Query, accepted string) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(d.Linger))
+	read := server.GetBuffer(4096)
+	defer server.PutBuffer(read)
+	buf := *read
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		lazy, err := dnswire.ParseLazy(buf[:n])
+		if err != nil {
+			continue
+		}
+		if kind := checkResponse(q, lazy); kind != "" {
+			d.record(upstream, kind)
+		} else if resp, err := lazy.Message(); err == nil && answerKey(resp) != accepted {
+			d.record(upstream, anomalyConflict)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// statsWindow is how many seconds the rolling query rate covers.
+	statsWindow = 60
+	// statsMaxKeys bounds the domains and clients counted for the top
+	// lists; past it, counts are halved and the rare ones forgotten.
+	statsMaxKeys = 10000
+)
+
+// Stats keeps the running totals and top lists served on the admin
+// address at /stats, similar to what unbound-control stats or the Pi-hole
+// dashboard show.
+type Stats struct {
+	mu      sync.Mutex
+	started time.Time
+	// perSecond counts queries in the last statsWindow seconds, indexed by
+	// Unix time modulo statsWindow; seconds records which second each
+	// bucket holds.
+	perSecond [statsWindow]uint64
+	seconds   [statsWindow]int64
+	queries   uint64
+	nxdomain  uint64
+	blocked   uint64
+	dropped   uint64
+	domains   map[string]uint64
+	clients   map[string]uint64
+}
+
+func NewStats() *Stats {
+	return &Stats{started: time.Now(), domains: map[string]uint64{}, clients: map[string]uint64{}}
+}
+
+// Record counts one query. resp is nil for dropped queries.
+func (s *Stats) Record(client net.IP, m *Message, resp *Query, blocked bool, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sec := now.Unix()
+	i := sec % statsWindow
+	if s.seconds[i] != sec {
+		s.seconds[i], s.perSecond[i] = sec, 0
+	}
+	s.perSecond[i]++
+	s.queries++
+	switch {
+	case resp == nil:
+		s.dropped++
+	case resp.Header.RCode == RCodeNameError:
+		s.nxdomain++
+	}
+	if blocked {
+		s.blocked++
+	}
+	if len(m.Questions) > 0 {
+		countKey(s.domains, fqdn(normalizeName(m.Questions[0].Name)))
+	}
+	countKey(s.clients, client.String())
+}
+
+func countKey(counts map[string]uint64, key string) {
+	counts[key]++
+	if len(counts) <= statsMaxKeys {
+		return
+	}
+	for k, n := range counts {
+		if n /= 2; n == 0 {
+			delete(counts, k)
+		} else {
+			counts[k] = n
+		}
+	}
+}
+
+type StatsEntry struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type StatsSnapshot struct {
+	Uptime        float64      `json:"uptime_seconds"`
+	Queries       uint64       `json:"queries"`
+	QPS           float64      `json:"qps"`
+	NXDomain      uint64       `json:"nxdomain"`
+	NXDomainRatio float64      `json:"nxdomain_ratio"`
+	Blocked       uint64       `json:"blocked"`
+	Dropped       uint64       `json:"dropped"`
+	TopDomains    []StatsEntry `json:"top_domains"`
+	TopClients    []StatsEntry `json:"top_clients"`
+}
+
+// Snapshot returns the current totals with the n most queried domains and
+// most active clients. QPS is averaged over the last statsWindow seconds,
+// or since the start if that is shorter.
+func (s *Stats) Snapshot(n int, now time.Time) StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := StatsSnapshot{
+		Uptime:     now.Sub(s.started).Seconds(),
+		Queries:    s.queries,
+		NXDomain:   s.nxdomain,
+		Blocked:    s.blocked,
+		Dropped:    s.dropped,
+		TopDomains: topEntries(s.domains, n),
+		TopClients: topEntries(s.clients, n),
+	}
+	var recent uint64
+	for i, sec := range s.seconds {
+		if now.Unix()-sec < statsWindow {
+			recent += s.perSecond[i]
+		}
+	}
+	if window := min(snap.Uptime, statsWindow); window > 0 {
+		snap.QPS = float64(recent) / window
+	}
+	if s.queries > 0 {
+		snap.NXDomainRatio = float64(s.nxdomain) / float64(s.queries)
+	}
+	return snap
+}
+
+func topEntries(counts map[string]uint64, n int) []StatsEntry {
+	out := make([]StatsEntry, 0, len(counts))
+	for k, c := range counts {
+		out = append(out, StatsEntry{k, c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out[:min(n, len(out))]
+}
+
+// ServeHTTP answers with a JSON snapshot; ?top= sets the length of the
+// top lists.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Snapshot(n, time.Now()))
+}
+
+// runStats prints the statistics of a running server, fetched from its
+// admin address, as name=value lines.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	addr := fs.String("admin-addr", "127.0.0.1:6060", "Admin address of the running server")
+	top := fs.Int("top", 10, "How many domains and clients to list")
+	tokenFile := fs.String("admin-token-file", "", "File holding the server's -admin-token")
+	fs.Parse(args)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/stats?top=%d", *addr, *top), nil)
+	if err != nil {
+		return err
+	}
+	if *tokenFile != "" {
+		token, err := readAdminToken(*tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stats: server answered %s", resp.Status)
+	}
+	var snap StatsSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return err
+	}
+	printStats(snap)
+	return nil
+}
+
+func printStats(snap StatsSnapshot) {
+	fmt.Printf("uptime=%.0f\n", snap.Uptime)
+	fmt.Printf("queries=%d\n", snap.Queries)
+	fmt.Printf("qps=%.2f\n", snap.QPS)
+	fmt.Printf("nxdomain=%d\n", snap.NXDomain)
+	fmt.Printf("nxdomain.ratio=%.4f\n", snap.NXDomainRatio)
+	fmt.Printf("blocked=%d\n", snap.Blocked)
+	fmt.Printf("dropped=%d\n", snap.Dropped)
+	for i, e := range snap.TopDomains {
+		fmt.Printf("top.domain.%d=%s %d\n", i+1, e.Name, e.Count)
+	}
+	for i, e := range snap.TopClients {
+		fmt.Printf("top.client.%d=%s %d\n", i+1, e.Name, e.Count)
+	}
+}
@@ -0,0 +1,290 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnsclient"
+)
+
+// Where UDP to the resolver is blocked, -resolver takes transport=tcp to
+// query it over TCP alone:
+//
+//	-resolver '192.0.2.53?transport=tcp'
+//	-resolver '[2001:db8::53]:53?transport=tcp&conns=4'
+//
+// Queries are pipelined (RFC 7766) over conns persistent connections, one
+// by default, each dialed when first needed and again after the resolver
+// closes it, it goes unused for tcpUpstreamIdle, or it stops answering.
+// After a failed dial the resolver is treated as down, failing queries at
+// once, for a second, doubling with each failure up to tcpUpstreamBackoff.
+
+const (
+	tcpUpstreamIdle    = 30 * time.Second
+	tcpUpstreamBackoff = 30 * time.Second
+)
+
+var (
+	tcpUpstreamUp    = NewGaugeVec("dns_upstream_tcp_up", "Whether the last connection attempt to a TCP resolver succeeded.", "upstream")
+	tcpUpstreamDials = NewCounterVec("dns_upstream_tcp_connects_total", "Connections dialed to TCP resolvers, by result.", "upstream", "result")
+)
+
+// errConnClosed is returned for queries that couldn't be sent because
+// the connection closed; they can go over a new one.
+var errConnClosed = errors.New("connection closed")
+
+// tcpUpstreams holds the connections to the resolvers queried over TCP.
+var tcpUpstreams = &tcpUpstreamSet{}
+
+type tcpUpstreamSet struct {
+	mu        sync.Mutex
+	upstreams map[string]*tcpUpstream
+}
+
+// tcpUpstreamFor returns the connections to addr if -resolver has it
+// queried over TCP, and nil otherwise.
+func tcpUpstreamFor(addr *net.UDPAddr) *tcpUpstream {
+	cfg := currentConfig()
+	if cfg == nil || cfg.resolverTCP == 0 || cfg.resolver.String() != addr.String() {
+		return nil
+	}
+	s := tcpUpstreams
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.upstreams[addr.String()]
+	if u == nil || len(u.conns) != cfg.resolverTCP {
+		// Connections of an upstream replaced by a reload close once idle.
+		u = &tcpUpstream{addr: addr.String(), conns: make([]*pipelinedConn, cfg.resolverTCP)}
+		if s.upstreams == nil {
+			s.upstreams = map[string]*tcpUpstream{}
+		}
+		s.upstreams[addr.String()] = u
+	}
+	return u
+}
+
+type tcpUpstream struct {
+	addr string
+	next atomic.Uint32
+
+	mu        sync.Mutex
+	conns     []*pipelinedConn
+	failures  int
+	downUntil time.Time
+}
+
+// Exchange sends query over one of the connections and returns the
+// response, with the query's ID.
+func (u *tcpUpstream) Exchange(query []byte) ([]byte, error) {
+	slot := int(u.next.Add(1)) % len(u.conns)
+	for retried := false; ; retried = true {
+		c, err := u.conn(slot)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.exchange(query)
+		if errors.Is(err, errConnClosed) && !retried {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// conn returns the connection in slot, dialing it if there is none.
+func (u *tcpUpstream) conn(slot int) (*pipelinedConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c := u.conns[slot]; c != nil && c.open() {
+		return c, nil
+	}
+	now := time.Now()
+	if now.Before(u.downUntil) {
+		return nil, fmt.Errorf("resolver %s is down, connecting again in %v", u.addr, u.downUntil.Sub(now).Round(time.Millisecond))
+	}
+	conn, err := net.DialTimeout("tcp", u.addr, exchangeTimeout)
+	if err != nil {
+		u.failures++
+		u.downUntil = now.Add(min(time.Second<<min(u.failures-1, 5), tcpUpstreamBackoff))
+		tcpUpstreamDials.With(u.addr, "failed").Inc()
+		tcpUpstreamUp.With(u.addr).Set(0)
+		logUpstream.Warn("connecting to resolver failed", "upstream", u.addr, "failures", u.failures, "err", err)
+		return nil, err
+	}
+	if u.failures > 0 {
+		logUpstream.Info("connected to resolver again", "upstream", u.addr, "failures", u.failures)
+	}
+	u.failures = 0
+	tcpUpstreamDials.With(u.addr, "ok").Inc()
+	tcpUpstreamUp.With(u.addr).Set(1)
+	c := &pipelinedConn{conn: conn, pending: map[uint16]chan []byte{}, lastRead: now}
+	go c.read()
+	u.conns[slot] = c
+	return c, nil
+}
+
+// pipelinedConn is a connection to a resolver with any number of queries
+// in flight, told apart by their IDs.
+type pipelinedConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu       sync.Mutex
+	pending  map[uint16]chan []byte
+	lastRead time.Time
+	// err is why the connection closed.
+	err error
+}
+
+func (c *pipelinedConn) open() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+func (c *pipelinedConn) exchange(query []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, errConnClosed
+	}
+	// IDs are unique on the connection rather than as the caller chose
+	// them.
+	id := uint16(rand.Uint32())
+	for c.pending[id] != nil {
+		id++
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	binary.BigEndian.PutUint16(msg[2:], id)
+	sent := time.Now()
+	dnstapWriter.ResolverQuery("tcp", c.conn.LocalAddr(), c.conn.RemoteAddr(), msg[2:], sent)
+	captureUpstream(c.conn.LocalAddr(), c.conn.RemoteAddr(), msg[2:], true)
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(sent.Add(exchangeTimeout))
+	_, err := c.conn.Write(msg)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, fmt.Errorf("%w: %v", errConnClosed, err)
+	}
+
+	timer := time.NewTimer(exchangeTimeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		dnstapWriter.ResolverResponse("tcp", c.conn.LocalAddr(), c.conn.RemoteAddr(), msg[2:], resp, sent)
+		captureUpstream(c.conn.LocalAddr(), c.conn.RemoteAddr(), resp, false)
+		copy(resp, query[:2])
+		return resp, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, id)
+		stalled := c.lastRead.Before(sent)
+		c.mu.Unlock()
+		if stalled {
+			// Nothing came back since the query went out, so the
+			// connection is likely dead without having been closed.
+			c.fail(fmt.Errorf("no response in %v", exchangeTimeout))
+		}
+		return nil, fmt.Errorf("%w over tcp from %s", dnsclient.ErrNoResponse, c.conn.RemoteAddr())
+	}
+}
+
+// read hands the responses to the queries waiting for them, until the
+// connection fails or has been idle for tcpUpstreamIdle.
+func (c *pipelinedConn) read() {
+	var lenBuf [2]byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(tcpUpstreamIdle))
+		_, err := io.ReadFull(c.conn, lenBuf[:])
+		var resp []byte
+		if err == nil {
+			resp = make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+			_, err = io.ReadFull(c.conn, resp)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if len(resp) < 12 {
+			c.fail(fmt.Errorf("%d byte response", len(resp)))
+			return
+		}
+		c.mu.Lock()
+		c.lastRead = time.Now()
+		id := binary.BigEndian.Uint16(resp)
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
+
+// fail closes the connection, failing the queries waiting on it.
+func (c *pipelinedConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for _, ch := range c.pending {
+		close(ch)
+	}
+	c.pending = nil
+	logUpstream.Debug("resolver connection closed", "upstream", c.conn.RemoteAddr().String(), "err", err)
+}
+
+// parseResolverOptions parses the options of a -resolver value and
+// returns the number of TCP connections to query it over, or 0 for UDP.
+func parseResolverOptions(params string) (int, error) {
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return 0, err
+	}
+	for key := range values {
+		if key != "transport" && key != "conns" {
+			return 0, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	switch transport := values.Get("transport"); transport {
+	case "", "udp":
+		if values.Has("conns") {
+			return 0, fmt.Errorf("conns needs transport=tcp")
+		}
+		return 0, nil
+	case "tcp":
+		if !values.Has("conns") {
+			return 1, nil
+		}
+		n, err := strconv.Atoi(values.Get("conns"))
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid conns %q", values.Get("conns"))
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unknown transport %q, want udp or tcp", transport)
+	}
+}
@@ -0,0 +1,181 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseResolverOptions(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		conns  int
+		err    string
+	}{
+		{"", 0, ""},
+		{"transport=udp", 0, ""},
+		{"transport=tcp", 1, ""},
+		{"transport=tcp&conns=4", 4, ""},
+		{"transport=tcp&conns=0", 0, "invalid conns"},
+		{"transport=tcp&conns=many", 0, "invalid conns"},
+		{"conns=2", 0, "conns needs transport=tcp"},
+		{"transport=quic", 0, "unknown transport"},
+		{"transport=tcp&timeout=1s", 0, "unknown option"},
+	} {
+		conns, err := parseResolverOptions(tc.params)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: got %d, %v; want an error containing %q", tc.params, conns, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || conns != tc.conns {
+			t.Errorf("%q: got %d, %v; want %d", tc.params, conns, err, tc.conns)
+		}
+	}
+}
+
+// tcpResolver accepts connections on a loopback port and hands each to
+// serve. It returns the address and the count of connections accepted.
+func tcpResolver(t *testing.T, serve func(conn net.Conn)) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+// readQuery reads a length-prefixed message from conn.
+func readQuery(conn net.Conn) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+// writeAnswer answers query on conn with the query itself, QR set.
+func writeAnswer(conn net.Conn, query []byte) error {
+	resp := append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	resp[4] |= 0x80
+	_, err := conn.Write(resp)
+	return err
+}
+
+// testQuery returns a query for name with id.
+func testQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	q := new(Query).SetQuestion(name, TypeA)
+	q.Header.ID = id
+	data, err := q.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTCPUpstreamPipelining(t *testing.T) {
+	const queries = 8
+	// The resolver reads every query before it answers any, then answers
+	// them in reverse, so they have to be in flight together.
+	addr, accepted := tcpResolver(t, func(conn net.Conn) {
+		var received [][]byte
+		for len(received) < queries {
+			q, err := readQuery(conn)
+			if err != nil {
+				return
+			}
+			received = append(received, q)
+		}
+		for i := len(received) - 1; i >= 0; i-- {
+			writeAnswer(conn, received[i])
+		}
+		io.Copy(io.Discard, conn)
+	})
+	u := &tcpUpstream{addr: addr, conns: make([]*pipelinedConn, 1)}
+
+	var wg sync.WaitGroup
+	for i := range queries {
+		name := "q" + string(rune('a'+i)) + ".example.com"
+		query := testQuery(t, uint16(1000+i), name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := u.Exchange(query)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			// Apart from the ID, the answer echoes what went out.
+			if binary.BigEndian.Uint16(resp) != uint16(1000+i) || string(resp[12:]) != string(query[12:]) {
+				t.Errorf("%s: got the answer to another query", name)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("the queries took %d connections, want 1", n)
+	}
+}
+
+func TestTCPUpstreamReconnects(t *testing.T) {
+	// The resolver answers one query per connection and closes it.
+	addr, accepted := tcpResolver(t, func(conn net.Conn) {
+		if q, err := readQuery(conn); err == nil {
+			writeAnswer(conn, q)
+		}
+	})
+	u := &tcpUpstream{addr: addr, conns: make([]*pipelinedConn, 1)}
+	for i := range 3 {
+		if _, err := u.Exchange(testQuery(t, uint16(i), "www.example.com")); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if n := accepted.Load(); n != 3 {
+		t.Errorf("dialed %d connections for 3 queries, want 3", n)
+	}
+}
+
+func TestTCPUpstreamDown(t *testing.T) {
+	// A port nothing listens on any more.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	u := &tcpUpstream{addr: addr, conns: make([]*pipelinedConn, 1)}
+	if _, err := u.Exchange(testQuery(t, 1, "www.example.com")); err == nil {
+		t.Fatal("exchanged with a closed port")
+	}
+	_, err = u.Exchange(testQuery(t, 2, "www.example.com"))
+	if err == nil || !strings.Contains(err.Error(), "is down") {
+		t.Errorf("second exchange: %v, want the resolver reported down", err)
+	}
+	if u.failures != 1 {
+		t.Errorf("%d failed dials, want 1", u.failures)
+	}
+}
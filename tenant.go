@@ -0,0 +1,229 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Tenants let one server serve several teams, each seeing only its own
+// zones:
+//
+//	-tenant 'payments?listener=10.0.0.53:53&zones=pay.example,pay.internal&qps=500'
+//	-tenant 'search?key=search-key&cert-group=search&zones=search.example&query-log=/var/log/dns/search.log'
+//
+// A query belongs to the first tenant whose listener it arrived on, whose
+// TSIG key signed it or whose TLS client certificate is in its group (see
+// -cert-group). It is answered from the tenant's zones alone; the zones
+// no tenant lists are served to queries belonging to none. Cached answers
+// are kept apart by tenant too. qps and burst limit the tenant's queries
+// as a whole, answering those over the quota with REFUSED, and each
+// tenant's queries are also written to its own query-log, in
+// -query-log-format, rotated as -query-log-max-size and -query-log-keep
+// say. Tenants need a restart to change; the zones they list reload as
+// usual.
+
+var (
+	tenantQueries = NewCounterVec("dns_tenant_queries_total", "Queries by tenant.", "tenant")
+	tenantRefused = NewCounterVec("dns_tenant_quota_exceeded_total", "Queries refused for being over their tenant's quota.", "tenant")
+)
+
+type Tenant struct {
+	Name       string
+	Listeners  []string
+	Keys       []string
+	CertGroups []string
+	Zones      []string
+	// QPS and Burst limit the tenant's queries; 0 is no limit.
+	QPS      float64
+	Burst    int
+	QueryLog *QueryLog
+	// queryLogPath is opened by Tenants.Add.
+	queryLogPath string
+
+	mu     sync.Mutex
+	bucket tokenBucket
+	view   atomic.Pointer[zoneView]
+}
+
+// zoneView is the part of a set of served zones a tenant sees.
+type zoneView struct {
+	from, zones *ZoneSet
+}
+
+// ParseTenant parses a -tenant value, a name followed by the queries it
+// owns and its settings in query string form.
+func ParseTenant(spec string) (*Tenant, error) {
+	name, params, _ := strings.Cut(spec, "?")
+	if name == "" {
+		return nil, fmt.Errorf("invalid -tenant %q: no name", spec)
+	}
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -tenant %q: %v", spec, err)
+	}
+	t := &Tenant{Name: name}
+	for key, vs := range values {
+		var items []string
+		for _, v := range vs {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		}
+		value := strings.Join(vs, "")
+		switch key {
+		case "listener":
+			for _, item := range items {
+				host, port, err := net.SplitHostPort(item)
+				if err != nil {
+					return nil, fmt.Errorf("invalid -tenant %q: %v", spec, err)
+				}
+				if net.ParseIP(host) == nil {
+					return nil, fmt.Errorf("invalid -tenant %q: listener %q isn't an IP address and port", spec, item)
+				}
+				t.Listeners = append(t.Listeners, net.JoinHostPort(host, port))
+			}
+		case "key":
+			for _, item := range items {
+				t.Keys = append(t.Keys, normalizeName(item))
+			}
+		case "cert-group":
+			t.CertGroups = append(t.CertGroups, items...)
+		case "zones":
+			for _, item := range items {
+				t.Zones = append(t.Zones, normalizeName(item))
+			}
+		case "qps":
+			if t.QPS, err = strconv.ParseFloat(value, 64); err != nil || t.QPS < 0 {
+				return nil, fmt.Errorf("invalid -tenant %q: invalid qps %q", spec, value)
+			}
+		case "burst":
+			if t.Burst, err = strconv.Atoi(value); err != nil || t.Burst < 1 {
+				return nil, fmt.Errorf("invalid -tenant %q: invalid burst %q", spec, value)
+			}
+		case "query-log":
+			t.queryLogPath = value
+		default:
+			return nil, fmt.Errorf("invalid -tenant %q: unknown option %q", spec, key)
+		}
+	}
+	if len(t.Listeners)+len(t.Keys)+len(t.CertGroups) == 0 {
+		return nil, fmt.Errorf("invalid -tenant %q: matches no queries; give it listener, key or cert-group", spec)
+	}
+	if t.Burst == 0 {
+		t.Burst = max(1, int(t.QPS))
+	}
+	return t, nil
+}
+
+// Allow reports whether a query of the tenant is within its quota.
+func (t *Tenant) Allow(now time.Time) bool {
+	if t.QPS == 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bucket.take(t.QPS, t.Burst, now)
+}
+
+// Tenants picks the tenant of each query and the zones it sees.
+type Tenants struct {
+	list []*Tenant
+	// owned maps each zone a tenant lists to the tenant.
+	owned map[string]*Tenant
+	// shared is the view of queries that belong to no tenant.
+	shared atomic.Pointer[zoneView]
+}
+
+// Add adds t, opening its query log with the format and rotation given.
+func (ts *Tenants) Add(t *Tenant, logFormat string, logMaxSize int64, logKeep int) error {
+	if slices.ContainsFunc(ts.list, func(o *Tenant) bool { return o.Name == t.Name }) {
+		return fmt.Errorf("duplicate tenant %q", t.Name)
+	}
+	for _, zone := range t.Zones {
+		if o := ts.owned[zone]; o != nil {
+			return fmt.Errorf("tenant %s: zone %s belongs to tenant %s", t.Name, fqdn(zone), o.Name)
+		}
+		if ts.owned == nil {
+			ts.owned = map[string]*Tenant{}
+		}
+		ts.owned[zone] = t
+	}
+	if t.queryLogPath != "" {
+		out, err := openRotatingFile(t.queryLogPath, logMaxSize, logKeep)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %v", t.Name, err)
+		}
+		if t.QueryLog, err = NewQueryLog(out, logFormat, nil); err != nil {
+			return fmt.Errorf("tenant %s: %v", t.Name, err)
+		}
+	}
+	ts.list = append(ts.list, t)
+	return nil
+}
+
+// Match returns the tenant of a query from client, signed as auth says,
+// or nil.
+func (ts *Tenants) Match(client *server.Client, auth *authResult) *Tenant {
+	if ts == nil {
+		return nil
+	}
+	for _, t := range ts.list {
+		if auth != nil && auth.RCode == RCodeSuccess && slices.Contains(t.Keys, normalizeName(auth.Signer)) ||
+			client.Group != "" && slices.Contains(t.CertGroups, client.Group) ||
+			slices.ContainsFunc(t.Listeners, func(l string) bool { return onListener(client.Local, l) }) {
+			return t
+		}
+	}
+	return nil
+}
+
+// onListener reports whether local, the address a query arrived on, is
+// that of listener; one bound to all addresses matches by port.
+func onListener(local net.Addr, listener string) bool {
+	if local == nil {
+		return false
+	}
+	host, port, _ := net.SplitHostPort(listener)
+	lhost, lport, err := net.SplitHostPort(local.String())
+	if err != nil || port != lport {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsUnspecified() || ip.Equal(net.ParseIP(lhost)))
+}
+
+// Zones returns the zones of all that tenant t, or with a nil t, no
+// tenant, sees.
+func (ts *Tenants) Zones(t *Tenant, all *ZoneSet) *ZoneSet {
+	if ts == nil {
+		return all
+	}
+	cached := &ts.shared
+	if t != nil {
+		cached = &t.view
+	}
+	if v := cached.Load(); v != nil && v.from == all {
+		return v.zones
+	}
+	// Views are built again once a reload replaced the zones.
+	zones := NewZoneSet()
+	zones.Minimal = all.Minimal
+	for _, z := range all.Zones() {
+		if ts.owned[z.Origin] == t {
+			zones.Add(z)
+		}
+	}
+	cached.Store(&zoneView{from: all, zones: zones})
+	return zones
+}
@@ -0,0 +1,249 @@
+package dnsserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Tracing follows each query through the server as a tree of spans and
+// exports them with OTLP over HTTP, in its JSON encoding, to a collector
+// such as the OpenTelemetry Collector, Jaeger or Tempo.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+var tracesDropped = NewCounter("dns_trace_spans_dropped_total", "Spans dropped because the exporter fell behind or the collector failed.")
+
+type Tracer struct {
+	// Endpoint is the collector's OTLP/HTTP traces URL, usually
+	// http://host:4318/v1/traces.
+	Endpoint string
+	Service  string
+	// SampleRate is the fraction of queries traced.
+	SampleRate float64
+
+	client *http.Client
+	spans  chan *Span
+	flush  chan chan struct{}
+}
+
+func NewTracer(endpoint, service string, sampleRate float64) *Tracer {
+	t := &Tracer{
+		Endpoint:   endpoint,
+		Service:    service,
+		SampleRate: sampleRate,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		spans:      make(chan *Span, 4*traceBatchSize),
+		flush:      make(chan chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Span is one timed step. All methods do nothing on a nil span, which is
+// what a nil Tracer or an unsampled query produces.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	err      error
+}
+
+// Start begins the root span of a trace, or returns nil if the trace is
+// not sampled.
+func (t *Tracer) Start(name string) *Span {
+	if t == nil || (t.SampleRate < 1 && mrand.Float64() >= t.SampleRate) {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: spanKindServer, start: time.Now()}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// Child begins a span nested in s.
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, name: name, kind: kind, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = map[string]any{}
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.err = err
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+		tracesDropped.Inc()
+	}
+}
+
+func (t *Tracer) run() {
+	var batch []*Span
+	tick := time.NewTicker(traceFlushInterval)
+	for {
+		var flushed chan struct{}
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case flushed = <-t.flush:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+		}
+		if len(batch) == 0 {
+			close(flushed)
+			continue
+		}
+		if err := t.export(batch); err != nil {
+			logTracing.Warn("exporting spans failed", "endpoint", t.Endpoint, "spans", len(batch), "err", err)
+			tracesDropped.Add(uint64(len(batch)))
+		}
+		batch = nil
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// Flush exports the spans that ended so far.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	done := make(chan struct{})
+	t.flush <- done
+	<-done
+}
+
+// export posts spans as an OTLP ExportTraceServiceRequest.
+func (t *Tracer) export(spans []*Span) error {
+	type attr struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	type status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type span struct {
+		TraceID      string  `json:"traceId"`
+		SpanID       string  `json:"spanId"`
+		ParentSpanID string  `json:"parentSpanId,omitempty"`
+		Name         string  `json:"name"`
+		Kind         int     `json:"kind"`
+		Start        string  `json:"startTimeUnixNano"`
+		End          string  `json:"endTimeUnixNano"`
+		Attributes   []attr  `json:"attributes,omitempty"`
+		Status       *status `json:"status,omitempty"`
+	}
+
+	var out []span
+	for _, s := range spans {
+		o := span{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, attr{k, otlpValue(v)})
+		}
+		if s.err != nil {
+			o.Status = &status{Code: 2, Message: s.err.Error()}
+		}
+		out = append(out, o)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []attr{{"service.name", otlpValue(t.Service)}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "dns-server"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
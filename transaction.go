@@ -0,0 +1,205 @@
+package dnsserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// Zone transactions let automation change the records of a served zone
+// through the admin endpoint, several at a time: the edits of a
+// transaction are made together when it is committed, or not at all, and
+// bump the SOA serial once, which secondaries then fetch as one IXFR
+// change.
+//
+//	curl -X POST localhost:8080/zones/example.com/transactions
+//	{"id": "3f9c0a7d2b1e4c68"}
+//	curl --data-binary $'www 300 A 192.0.2.10\nwww 300 A 192.0.2.11' \
+//	    localhost:8080/transactions/3f9c0a7d2b1e4c68/add
+//	curl --data-binary $'old\nmail AAAA\nwww A 192.0.2.1' \
+//	    localhost:8080/transactions/3f9c0a7d2b1e4c68/delete
+//	curl -X POST localhost:8080/transactions/3f9c0a7d2b1e4c68/commit
+//	{"serial": 2024061502}
+//
+// Records to add are zone file lines relative to the zone. Lines to
+// delete name every record at a name, an RRset, or one record. POST
+// /transactions/{id}/abandon drops a transaction, and one left idle for
+// transactionIdle is abandoned too. Like dynamic updates, the edits last
+// until the zone is reloaded from its file.
+
+const transactionIdle = 10 * time.Minute
+
+type zoneTransactions struct {
+	mu   sync.Mutex
+	open map[string]*zoneTransaction
+}
+
+type zoneTransaction struct {
+	origin string
+	edits  []ZoneEdit
+	used   time.Time
+}
+
+var transactions = &zoneTransactions{}
+
+// register serves the transaction endpoints on mux.
+func (t *zoneTransactions) register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /zones/{zone}/transactions", t.begin)
+	mux.HandleFunc("POST /transactions/{id}/add", t.edit(true))
+	mux.HandleFunc("POST /transactions/{id}/delete", t.edit(false))
+	mux.HandleFunc("POST /transactions/{id}/commit", t.commit)
+	mux.HandleFunc("POST /transactions/{id}/abandon", func(w http.ResponseWriter, r *http.Request) {
+		if t.take(r.PathValue("id")) == nil {
+			http.Error(w, "no such transaction", http.StatusNotFound)
+		}
+	})
+}
+
+func (t *zoneTransactions) begin(w http.ResponseWriter, r *http.Request) {
+	origin := normalizeName(r.PathValue("zone"))
+	if zoneFor(origin) == nil {
+		http.Error(w, fmt.Sprintf("zone %q isn't served", fqdn(origin)), http.StatusNotFound)
+		return
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	t.mu.Lock()
+	t.expire(time.Now())
+	if t.open == nil {
+		t.open = map[string]*zoneTransaction{}
+	}
+	t.open[id] = &zoneTransaction{origin: origin, used: time.Now()}
+	t.mu.Unlock()
+	writeJSON(w, map[string]string{"id": id})
+}
+
+// edit adds the records in the request body to the transaction, to be
+// added or deleted.
+func (t *zoneTransactions) edit(add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		txn := t.open[r.PathValue("id")]
+		t.mu.Unlock()
+		if txn == nil {
+			http.Error(w, "no such transaction", http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var records []*ResourceRecord
+		if add {
+			records, err = ParseZone(strings.NewReader(string(body)), txn.origin)
+		} else {
+			records, err = parseDeletions(string(body), txn.origin)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.mu.Lock()
+		for _, rr := range records {
+			txn.edits = append(txn.edits, ZoneEdit{Add: add, Record: rr})
+		}
+		txn.used = time.Now()
+		t.mu.Unlock()
+		writeJSON(w, map[string]int{"edits": len(records)})
+	}
+}
+
+func (t *zoneTransactions) commit(w http.ResponseWriter, r *http.Request) {
+	txn := t.take(r.PathValue("id"))
+	if txn == nil {
+		http.Error(w, "no such transaction", http.StatusNotFound)
+		return
+	}
+	z := zoneFor(txn.origin)
+	if z == nil {
+		http.Error(w, fmt.Sprintf("zone %q isn't served", fqdn(txn.origin)), http.StatusNotFound)
+		return
+	}
+	old := z.rrsetTexts()
+	serial, err := z.Apply(txn.edits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	auditRRsets(clientIP(r), z.Origin, old, z.rrsetTexts())
+	logServer.Info("zone transaction committed", "zone", fqdn(z.Origin), "edits", len(txn.edits), "serial", serial)
+	writeJSON(w, map[string]uint32{"serial": serial})
+}
+
+// take removes the transaction id and returns it, or nil if there is none.
+func (t *zoneTransactions) take(id string) *zoneTransaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	txn := t.open[id]
+	delete(t.open, id)
+	return txn
+}
+
+// expire abandons idle transactions. The caller holds t.mu.
+func (t *zoneTransactions) expire(now time.Time) {
+	for id, txn := range t.open {
+		if now.Sub(txn.used) > transactionIdle {
+			delete(t.open, id)
+		}
+	}
+}
+
+// zoneFor returns the served zone whose origin is origin.
+func zoneFor(origin string) *Zone {
+	cfg := currentConfig()
+	if cfg == nil {
+		return nil
+	}
+	z := cfg.zones.Find(origin)
+	if z == nil || z.Origin != origin {
+		return nil
+	}
+	return z
+}
+
+// parseDeletions parses lines of records to delete: a name, for all its
+// records, a name and a type, for an RRset, or a whole record.
+func parseDeletions(text, origin string) ([]*ResourceRecord, error) {
+	var records []*ResourceRecord
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 1:
+			records = append(records, &ResourceRecord{Name: absName(fields[0], origin)})
+			continue
+		case len(fields) == 2:
+			if t, ok := dnswire.ParseType(fields[1]); ok {
+				records = append(records, &ResourceRecord{Name: absName(fields[0], origin), Type: t})
+				continue
+			}
+		}
+		rrs, err := ParseZone(strings.NewReader(line), origin)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", strings.TrimSpace(line), err)
+		}
+		records = append(records, rrs...)
+	}
+	return records, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
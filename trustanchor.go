@@ -0,0 +1,446 @@
+package dnsserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// builtinRootAnchors are the IANA root zone KSKs (KSK-2017 and KSK-2024).
+var builtinRootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	addHoldDown    = 30 * 24 * time.Hour
+	removeHoldDown = 30 * 24 * time.Hour
+)
+
+type TrustAnchor struct {
+	Zone string
+	DS   *DS
+	Key  *DNSKEY
+}
+
+func (ta *TrustAnchor) Matches(key *DNSKEY) bool {
+	if ta.Key != nil {
+		return sameKey(ta.Key, key)
+	}
+	return ta.DS.Matches(ta.Zone, key)
+}
+
+// parseTrustAnchor reads a single DS or DNSKEY line in presentation format,
+// e.g. ". IN DS 20326 8 2 E06D...".
+func parseTrustAnchor(line string) (*TrustAnchor, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("malformed trust anchor %q", line)
+	}
+	ta := &TrustAnchor{Zone: normalizeName(fields[0])}
+	fields = fields[1:]
+	if strings.EqualFold(fields[0], "IN") {
+		fields = fields[1:]
+	}
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("malformed trust anchor %q", line)
+	}
+
+	nums := make([]int, 3)
+	for i := range nums {
+		n, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed trust anchor %q: %v", line, err)
+		}
+		nums[i] = n
+	}
+	data := strings.Join(fields[4:], "")
+
+	switch strings.ToUpper(fields[0]) {
+	case "DS":
+		digest, err := hex.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("malformed ds digest: %v", err)
+		}
+		ta.DS = &DS{KeyTag: uint16(nums[0]), Algorithm: uint8(nums[1]), DigestType: uint8(nums[2]), Digest: digest}
+	case "DNSKEY":
+		pub, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("malformed dnskey: %v", err)
+		}
+		ta.Key = &DNSKEY{Flags: uint16(nums[0]), Protocol: uint8(nums[1]), Algorithm: uint8(nums[2]), PublicKey: pub}
+	default:
+		return nil, fmt.Errorf("unsupported trust anchor type %q", fields[0])
+	}
+	return ta, nil
+}
+
+type keyState string
+
+const (
+	keyAddPend keyState = "addpend"
+	keyValid   keyState = "valid"
+	keyMissing keyState = "missing"
+	keyRevoked keyState = "revoked"
+)
+
+type trackedKey struct {
+	Flags      uint16    `json:"flags"`
+	Protocol   uint8     `json:"protocol"`
+	Algorithm  uint8     `json:"algorithm"`
+	PublicKey  []byte    `json:"public_key"`
+	State      keyState  `json:"state"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastChange time.Time `json:"last_change"`
+}
+
+func (tk *trackedKey) key() *DNSKEY {
+	return &DNSKEY{Flags: tk.Flags, Protocol: tk.Protocol, Algorithm: tk.Algorithm, PublicKey: tk.PublicKey}
+}
+
+// TrustAnchorStore holds the configured trust anchors and tracks key
+// rollovers for each anchored zone following RFC 5011.
+type TrustAnchorStore struct {
+	mu        sync.RWMutex
+	anchors   map[string][]*TrustAnchor
+	keys      map[string][]*trackedKey
+	statePath string
+}
+
+func NewTrustAnchorStore(statePath string) (*TrustAnchorStore, error) {
+	s := &TrustAnchorStore{
+		anchors:   map[string][]*TrustAnchor{},
+		keys:      map[string][]*trackedKey{},
+		statePath: statePath,
+	}
+	for _, line := range builtinRootAnchors {
+		ta, err := parseTrustAnchor(line)
+		if err != nil {
+			return nil, err
+		}
+		s.anchors[ta.Zone] = append(s.anchors[ta.Zone], ta)
+	}
+
+	if statePath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state map[string][]*trackedKey
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("trust anchor state %s: %v", statePath, err)
+	}
+	for zone, keys := range state {
+		s.keys[normalizeName(zone)] = keys
+	}
+	return s, nil
+}
+
+// LoadFile adds anchors from a file with one DS or DNSKEY record per line.
+func (s *TrustAnchorStore) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ta, err := parseTrustAnchor(line)
+		if err != nil {
+			return err
+		}
+		s.anchors[ta.Zone] = append(s.anchors[ta.Zone], ta)
+	}
+	return scanner.Err()
+}
+
+func (s *TrustAnchorStore) Zones() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	zones := make([]string, 0, len(s.anchors))
+	for zone := range s.anchors {
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// Trusted returns the DNSKEYs currently usable as trust anchors for zone.
+// Missing keys stay trusted until they are revoked, as RFC 5011 requires.
+func (s *TrustAnchorStore) Trusted(zone string) []*DNSKEY {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []*DNSKEY
+	for _, tk := range s.keys[normalizeName(zone)] {
+		if tk.State == keyValid || tk.State == keyMissing {
+			keys = append(keys, tk.key())
+		}
+	}
+	return keys
+}
+
+// Anchors returns the configured (non-tracked) anchors for zone.
+func (s *TrustAnchorStore) Anchors(zone string) []*TrustAnchor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.anchors[normalizeName(zone)]
+}
+
+// Trusts reports whether key is a trust anchor of zone.
+func (s *TrustAnchorStore) Trusts(zone string, key *DNSKEY) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return key.Flags&DNSKEYFlagRevoke == 0 && s.isTrusted(normalizeName(zone), key)
+}
+
+func (s *TrustAnchorStore) isTrusted(zone string, key *DNSKEY) bool {
+	tracked := s.keys[zone]
+	for _, tk := range tracked {
+		if (tk.State == keyValid || tk.State == keyMissing) && sameKey(tk.key(), key) {
+			return true
+		}
+	}
+	// The configured anchors only bootstrap a zone we have no state for yet.
+	if len(tracked) > 0 {
+		return false
+	}
+	for _, ta := range s.anchors[zone] {
+		if ta.Matches(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update applies a freshly fetched DNSKEY RRset (with its RRSIGs) for zone.
+// The set must be signed by a currently trusted key.
+func (s *TrustAnchorStore) Update(zone string, rrs []*ResourceRecord, now time.Time) error {
+	zone = normalizeName(zone)
+	sets, sigs := splitRRSets(rrs)
+	rrset := sets[rrsetKey(zone, TypeDNSKEY)]
+	if len(rrset) == 0 {
+		return fmt.Errorf("no DNSKEY rrset for %q", fqdn(zone))
+	}
+	var keys []*DNSKEY
+	for _, rr := range rrset {
+		if k, err := parseDNSKEY(rr.RData); err == nil {
+			keys = append(keys, k)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rrsigs := sigs[rrsetKey(zone, TypeDNSKEY)]
+	selfSigned := func(key *DNSKEY) bool {
+		for _, sig := range rrsigs {
+			if sig.ValidAt(now) && VerifyRRSIG(sig, key, rrset) == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	validated := false
+	for _, k := range keys {
+		if k.Flags&DNSKEYFlagRevoke == 0 && s.isTrusted(zone, k) && selfSigned(k) {
+			validated = true
+			break
+		}
+	}
+	if !validated {
+		return fmt.Errorf("DNSKEY rrset for %q is not signed by a trusted key", fqdn(zone))
+	}
+
+	bootstrap := len(s.keys[zone]) == 0
+	tracked := s.keys[zone]
+	seen := map[*trackedKey]bool{}
+
+	for _, k := range keys {
+		if k.Flags&DNSKEYFlagSEP == 0 {
+			continue
+		}
+		var tk *trackedKey
+		for _, t := range tracked {
+			if sameKey(t.key(), k) {
+				tk = t
+				break
+			}
+		}
+
+		if k.Flags&DNSKEYFlagRevoke != 0 {
+			if tk != nil && tk.State != keyRevoked && selfSigned(k) {
+				tk.State, tk.LastChange = keyRevoked, now
+			}
+			if tk != nil {
+				seen[tk] = true
+			}
+			continue
+		}
+
+		if tk == nil {
+			tk = &trackedKey{
+				Flags:      k.Flags,
+				Protocol:   k.Protocol,
+				Algorithm:  k.Algorithm,
+				PublicKey:  k.PublicKey,
+				State:      keyAddPend,
+				FirstSeen:  now,
+				LastChange: now,
+			}
+			if bootstrap && s.isTrusted(zone, k) {
+				tk.State = keyValid
+			}
+			tracked = append(tracked, tk)
+			logTrustAnchor.Info("new key", "zone", fqdn(zone), "key", k.KeyTag(), "state", tk.State)
+		}
+		seen[tk] = true
+
+		switch tk.State {
+		case keyAddPend:
+			if now.Sub(tk.FirstSeen) >= addHoldDown {
+				tk.State, tk.LastChange = keyValid, now
+				logTrustAnchor.Info("key is now valid", "zone", fqdn(zone), "key", k.KeyTag())
+			}
+		case keyMissing:
+			tk.State, tk.LastChange = keyValid, now
+		}
+	}
+
+	kept := tracked[:0]
+	for _, tk := range tracked {
+		if !seen[tk] {
+			switch tk.State {
+			case keyAddPend:
+				continue // never made it through the hold-down, forget it
+			case keyValid:
+				tk.State, tk.LastChange = keyMissing, now
+			}
+		}
+		if tk.State == keyRevoked && now.Sub(tk.LastChange) >= removeHoldDown {
+			continue
+		}
+		kept = append(kept, tk)
+	}
+	s.keys[zone] = kept
+
+	return s.save()
+}
+
+func (s *TrustAnchorStore) save() error {
+	if s.statePath == "" {
+		return nil
+	}
+	state := map[string][]*trackedKey{}
+	for zone, keys := range s.keys {
+		state[fqdn(zone)] = keys
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statePath)
+}
+
+// refresh fetches the DNSKEY set for zone and returns how long to wait
+// before the next active refresh (RFC 5011 section 2.3).
+func (s *TrustAnchorStore) refresh(resolver *net.UDPAddr, zone string) (time.Duration, error) {
+	q := dnswire.NewQuery(zone, TypeDNSKEY).SetEDNS(4096, true)
+	resp, err := exchange(resolver, q)
+	if err != nil {
+		return time.Hour, err
+	}
+	if err := s.Update(zone, resp.Answers, time.Now()); err != nil {
+		return time.Hour, err
+	}
+
+	interval := 15 * 24 * time.Hour
+	for _, rr := range resp.Answers {
+		if rr.Type != TypeRRSIG {
+			continue
+		}
+		if sig, err := parseRRSIG(rr.RData); err == nil {
+			if half := time.Duration(sig.OrigTTL) * time.Second / 2; half < interval {
+				interval = half
+			}
+			untilExpiry := time.Until(time.Unix(int64(sig.Expiration), 0)) / 2
+			if untilExpiry > 0 && untilExpiry < interval {
+				interval = untilExpiry
+			}
+		}
+	}
+	return max(interval, time.Hour), nil
+}
+
+// RunRefresh keeps every anchored zone's key set current, querying the
+// resolver returned by resolver. It never returns.
+func (s *TrustAnchorStore) RunRefresh(resolver func() *net.UDPAddr) {
+	next := map[string]time.Time{}
+	for {
+		now := time.Now()
+		wake := now.Add(time.Hour)
+		addr := resolver()
+		if addr == nil {
+			time.Sleep(time.Minute)
+			continue
+		}
+		for _, zone := range s.Zones() {
+			if t, ok := next[zone]; ok && now.Before(t) {
+				if t.Before(wake) {
+					wake = t
+				}
+				continue
+			}
+			wait, err := s.refresh(addr, zone)
+			if err != nil {
+				logTrustAnchor.Warn("refresh failed", "zone", fqdn(zone), "err", err)
+			}
+			next[zone] = now.Add(wait)
+			if next[zone].Before(wake) {
+				wake = next[zone]
+			}
+		}
+		time.Sleep(time.Until(wake))
+	}
+}
+
+func sameKey(a, b *DNSKEY) bool {
+	return a.Algorithm == b.Algorithm &&
+		a.Flags&^DNSKEYFlagRevoke == b.Flags&^DNSKEYFlagRevoke &&
+		bytes.Equal(a.PublicKey, b.PublicKey)
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
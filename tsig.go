@@ -0,0 +1,530 @@
+package dnsserver
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// TSIG error codes (RFC 8945 section 3).
+const (
+	TSIGErrBadSig  uint16 = 16
+	TSIGErrBadKey  uint16 = 17
+	TSIGErrBadTime uint16 = 18
+)
+
+var authFailures = NewCounterVec("dns_auth_failures_total", "Queries rejected by TSIG/SIG(0) authentication.", "reason")
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha224": sha256.New224,
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+// parseTSIGKey parses a key in dig -y form: [algorithm:]name:base64secret.
+func parseTSIGKey(s string) (*TSIGKey, error) {
+	parts := strings.Split(s, ":")
+	k := &TSIGKey{Algorithm: "hmac-sha256"}
+	switch len(parts) {
+	case 2:
+		k.Name = parts[0]
+	case 3:
+		k.Algorithm, k.Name = strings.ToLower(parts[0]), parts[1]
+	default:
+		return nil, fmt.Errorf("invalid TSIG key %q, want [algorithm:]name:secret", s)
+	}
+	if _, ok := tsigAlgorithms[k.Algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", k.Algorithm)
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret for %s: %v", k.Name, err)
+	}
+	k.Name, k.Secret = normalizeName(k.Name), secret
+	return k, nil
+}
+
+// readTSIGKeys reads keys in parseTSIGKey's form from the file at path,
+// one per line, which keeps their secrets out of the process's arguments.
+func readTSIGKeys(path string) ([]*TSIGKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys []*TSIGKey
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		k, err := parseTSIGKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, scanner.Err()
+}
+
+type tsigRecord struct {
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OrigID     uint16
+	Error      uint16
+	Other      []byte
+}
+
+func parseTSIG(rdata []byte) (*tsigRecord, error) {
+	p := dnswire.NewReader(rdata, 0)
+	alg, err := p.ReadName()
+	if err != nil {
+		return nil, err
+	}
+	t := &tsigRecord{Algorithm: normalizeName(alg)}
+	hi, err := p.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	lo, err := p.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	t.TimeSigned = uint64(hi)<<32 | uint64(lo)
+	if t.Fudge, err = p.ReadUint16(); err != nil {
+		return nil, err
+	}
+	macLen, err := p.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	if t.MAC, err = p.ReadBytes(int(macLen)); err != nil {
+		return nil, err
+	}
+	if t.OrigID, err = p.ReadUint16(); err != nil {
+		return nil, err
+	}
+	if t.Error, err = p.ReadUint16(); err != nil {
+		return nil, err
+	}
+	otherLen, err := p.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	if t.Other, err = p.ReadBytes(int(otherLen)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func appendUint48(buf []byte, v uint64) []byte {
+	return append(buf, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (t *tsigRecord) RData() []byte {
+	buf := canonicalName(t.Algorithm)
+	buf = appendUint48(buf, t.TimeSigned)
+	buf = binary.BigEndian.AppendUint16(buf, t.Fudge)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(t.MAC)))
+	buf = append(buf, t.MAC...)
+	buf = binary.BigEndian.AppendUint16(buf, t.OrigID)
+	buf = binary.BigEndian.AppendUint16(buf, t.Error)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(t.Other)))
+	return append(buf, t.Other...)
+}
+
+// variables returns the TSIG variables appended to the message when
+// computing the MAC (RFC 8945 section 4.3.3).
+func (t *tsigRecord) variables(keyName string) []byte {
+	buf := canonicalName(keyName)
+	buf = binary.BigEndian.AppendUint16(buf, ClassANY)
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = append(buf, canonicalName(t.Algorithm)...)
+	buf = appendUint48(buf, t.TimeSigned)
+	buf = binary.BigEndian.AppendUint16(buf, t.Fudge)
+	buf = binary.BigEndian.AppendUint16(buf, t.Error)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(t.Other)))
+	return append(buf, t.Other...)
+}
+
+// timers returns the TSIG timers, which alone are covered by the MACs
+// of the messages after the first in a zone transfer.
+func (t *tsigRecord) timers() []byte {
+	return binary.BigEndian.AppendUint16(appendUint48(nil, t.TimeSigned), t.Fudge)
+}
+
+func (k *TSIGKey) mac(parts ...[]byte) []byte {
+	h := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// lastRecordOffset returns where the last record of the additional section
+// starts in data.
+func lastRecordOffset(data []byte, h *Header) (int, error) {
+	p := dnswire.NewReader(data, 12)
+	for i := 0; i < int(h.QDCount); i++ {
+		if _, err := p.ReadQuestion(); err != nil {
+			return 0, err
+		}
+	}
+	records := int(h.ANCount) + int(h.NSCount) + int(h.ARCount)
+	for i := 0; i < records-1; i++ {
+		if _, err := p.ReadResourceRecord(); err != nil {
+			return 0, err
+		}
+	}
+	return p.Offset(), nil
+}
+
+// withoutLastRecord returns data with its last additional record removed
+// and ARCOUNT adjusted, and the message ID set to id.
+func withoutLastRecord(data []byte, h *Header, id uint16) ([]byte, error) {
+	off, err := lastRecordOffset(data, h)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(nil), data[:off]...)
+	binary.BigEndian.PutUint16(out[0:2], id)
+	binary.BigEndian.PutUint16(out[10:12], h.ARCount-1)
+	return out, nil
+}
+
+type authRequirement struct {
+	network *net.IPNet
+	// keys, when not empty, are the only TSIG key or SIG(0) signer names
+	// accepted from the network.
+	keys map[string]bool
+}
+
+// Authenticator verifies TSIG and SIG(0) signatures on client queries and
+// signs the responses to TSIG signed queries.
+type Authenticator struct {
+	TSIGKeys map[string]*TSIGKey
+	SIG0Keys map[string][]*DNSKEY
+
+	required []authRequirement
+}
+
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{TSIGKeys: map[string]*TSIGKey{}, SIG0Keys: map[string][]*DNSKEY{}}
+}
+
+func (a *Authenticator) AddTSIGKey(k *TSIGKey) {
+	a.TSIGKeys[k.Name] = k
+}
+
+// LoadSIG0Keys reads KEY (or DNSKEY) records in zone file syntax; the owner
+// name is the signer name clients sign with.
+func (a *Authenticator) LoadSIG0Keys(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rrs, err := ParseZone(f, "")
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, rr := range rrs {
+		if rr.Type != TypeKEY && rr.Type != TypeDNSKEY {
+			continue
+		}
+		key, err := parseDNSKEY(rr.RData)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		a.SIG0Keys[rr.Name] = append(a.SIG0Keys[rr.Name], key)
+	}
+	return nil
+}
+
+// Require makes queries from networks need a valid signature, by one of
+// keys if any are given. The spec is networks[=key1,key2].
+func (a *Authenticator) Require(spec string) error {
+	networks, names, _ := strings.Cut(spec, "=")
+	nets, err := server.ParseNetworks(networks)
+	if err != nil {
+		return err
+	}
+	keys := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		if name = normalizeName(name); name == "" {
+			continue
+		}
+		if a.TSIGKeys[name] == nil && a.SIG0Keys[name] == nil {
+			return fmt.Errorf("unknown key %q", name)
+		}
+		keys[name] = true
+	}
+	for _, n := range nets {
+		a.required = append(a.required, authRequirement{network: n, keys: keys})
+	}
+	return nil
+}
+
+// authResult is the outcome of checking a query's signature.
+type authResult struct {
+	RCode  uint8
+	Signer string
+
+	// For TSIG signed queries, what the response's TSIG record needs.
+	key     *TSIGKey
+	keyName string
+	request *tsigRecord
+	tsigErr uint16
+}
+
+// Check verifies the signature on query m (received as data) from client.
+// A nil result means the query is unsigned and needs no signature.
+func (a *Authenticator) Check(data []byte, m *Message, client net.IP, now time.Time) *authResult {
+	var res *authResult
+	if n := len(m.Additionals); n > 0 {
+		switch last := m.Additionals[n-1]; last.Type {
+		case TypeTSIG:
+			res = a.checkTSIG(data, m, last, now)
+		case TypeSIG:
+			res = a.checkSIG0(data, m, last, now)
+		}
+	}
+	if res != nil && res.RCode != RCodeSuccess {
+		return res
+	}
+
+	for _, r := range a.required {
+		if !r.network.Contains(client) {
+			continue
+		}
+		if res == nil {
+			authFailures.With("unsigned").Inc()
+			return &authResult{RCode: RCodeRefused}
+		}
+		if len(r.keys) > 0 && !r.keys[res.Signer] {
+			authFailures.With("wrong_key").Inc()
+			res.RCode = RCodeRefused
+		}
+		break
+	}
+	return res
+}
+
+func (a *Authenticator) checkTSIG(data []byte, m *Message, rr *ResourceRecord, now time.Time) *authResult {
+	res := &authResult{keyName: rr.Name}
+	t, err := parseTSIG(rr.RData)
+	if err != nil || rr.Class != ClassANY {
+		authFailures.With("malformed").Inc()
+		return &authResult{RCode: RCodeFormatError}
+	}
+	res.request = t
+
+	key := a.TSIGKeys[normalizeName(rr.Name)]
+	if key == nil || key.Algorithm != t.Algorithm {
+		authFailures.With("badkey").Inc()
+		res.RCode, res.tsigErr = RCodeNotAuth, TSIGErrBadKey
+		return res
+	}
+	unsigned, err := withoutLastRecord(data, m.Header, t.OrigID)
+	if err != nil {
+		authFailures.With("malformed").Inc()
+		return &authResult{RCode: RCodeFormatError}
+	}
+	if !hmac.Equal(t.MAC, key.mac(unsigned, t.variables(key.Name))) {
+		authFailures.With("badsig").Inc()
+		res.RCode, res.tsigErr = RCodeNotAuth, TSIGErrBadSig
+		return res
+	}
+
+	// From here on the response is signed, even when it reports an error.
+	res.key, res.Signer = key, key.Name
+	skew := int64(now.Unix()) - int64(t.TimeSigned)
+	if skew > int64(t.Fudge) || -skew > int64(t.Fudge) {
+		authFailures.With("badtime").Inc()
+		res.RCode, res.tsigErr = RCodeNotAuth, TSIGErrBadTime
+	}
+	return res
+}
+
+func (a *Authenticator) checkSIG0(data []byte, m *Message, rr *ResourceRecord, now time.Time) *authResult {
+	sig, err := parseRRSIG(rr.RData)
+	if err != nil || rr.Name != "" || rr.Class != ClassANY || sig.TypeCovered != 0 {
+		authFailures.With("malformed").Inc()
+		return &authResult{RCode: RCodeFormatError}
+	}
+	if !sig.ValidAt(now) {
+		authFailures.With("badtime").Inc()
+		return &authResult{RCode: RCodeNotAuth}
+	}
+	unsigned, err := withoutLastRecord(data, m.Header, m.Header.ID)
+	if err != nil {
+		authFailures.With("malformed").Inc()
+		return &authResult{RCode: RCodeFormatError}
+	}
+	signer := normalizeName(sig.SignerName)
+	for _, key := range a.SIG0Keys[signer] {
+		if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+			continue
+		}
+		signed := append(sig.header(), unsigned...)
+		if verifySignature(sig.Algorithm, key.PublicKey, signed, sig.Signature) == nil {
+			return &authResult{Signer: signer}
+		}
+	}
+	authFailures.With("badsig").Inc()
+	return &authResult{RCode: RCodeNotAuth}
+}
+
+// Sign appends the response TSIG record to wire when the query was TSIG
+// signed. Responses to queries that failed with BADKEY or BADSIG carry an
+// unsigned TSIG record reporting the error.
+func (r *authResult) Sign(wire []byte, now time.Time) []byte {
+	if r == nil || r.request == nil || len(wire) < 12 {
+		return wire
+	}
+	t := &tsigRecord{
+		Algorithm:  r.request.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      r.request.Fudge,
+		OrigID:     binary.BigEndian.Uint16(wire[0:2]),
+		Error:      r.tsigErr,
+	}
+	if r.tsigErr == TSIGErrBadTime {
+		// Report our clock so the client can tell how far off it is.
+		t.TimeSigned = r.request.TimeSigned
+		t.Other = appendUint48(nil, uint64(now.Unix()))
+	}
+	if r.key != nil {
+		t.MAC = r.key.mac(macField(r.request.MAC), wire, t.variables(r.key.Name))
+	}
+	return appendTSIG(wire, r.keyName, t)
+}
+
+// SignTransfer appends the TSIG record to wire, one message of a zone
+// transfer answering a TSIG signed query, and returns the message and its
+// MAC (RFC 8945 section 5.3.1). The first message, with prior nil, is
+// signed like any response. Each later one is signed on top of prior, the
+// MAC of the message before, and covers only the timers of its own TSIG
+// record. Every message is signed, so none has to be held back for the
+// next one's MAC. Transfers only start once the query's key has verified.
+func (r *authResult) SignTransfer(wire, prior []byte, now time.Time) ([]byte, []byte) {
+	t := &tsigRecord{
+		Algorithm:  r.request.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      r.request.Fudge,
+		OrigID:     binary.BigEndian.Uint16(wire[0:2]),
+	}
+	if prior == nil {
+		t.MAC = r.key.mac(macField(r.request.MAC), wire, t.variables(r.key.Name))
+	} else {
+		t.MAC = r.key.mac(macField(prior), wire, t.timers())
+	}
+	return appendTSIG(wire, r.keyName, t), t.MAC
+}
+
+// tsigLength returns the length of the TSIG record SignTransfer appends.
+func (r *authResult) tsigLength() int {
+	rdata := len(canonicalName(r.request.Algorithm)) + 16 + tsigAlgorithms[r.key.Algorithm]().Size()
+	return len(canonicalName(r.keyName)) + 10 + rdata
+}
+
+// macField returns mac prefixed with its length, as it is covered by the
+// MAC of the message signed on top of it.
+func macField(mac []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(mac))), mac...)
+}
+
+// appendTSIG appends a TSIG record owned by keyName with t as its RDATA
+// to wire, counting it in ARCOUNT.
+func appendTSIG(wire []byte, keyName string, t *tsigRecord) []byte {
+	rdata := t.RData()
+	out := append(wire, canonicalName(keyName)...)
+	out = binary.BigEndian.AppendUint16(out, TypeTSIG)
+	out = binary.BigEndian.AppendUint16(out, ClassANY)
+	out = binary.BigEndian.AppendUint32(out, 0)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(rdata)))
+	out = append(out, rdata...)
+	binary.BigEndian.PutUint16(out[10:12], binary.BigEndian.Uint16(out[10:12])+1)
+	return out
+}
+
+// tsigFudge is the clock skew allowed on messages signed here.
+const tsigFudge = 300
+
+var tsigErrors = map[uint16]string{TSIGErrBadSig: "BADSIG", TSIGErrBadKey: "BADKEY", TSIGErrBadTime: "BADTIME"}
+
+// SignQuery appends a TSIG record signed with k to q as its last record,
+// and returns the MAC the response is signed on top of.
+func (k *TSIGKey) SignQuery(q *Query, now time.Time) ([]byte, error) {
+	wire, err := q.Encode()
+	if err != nil {
+		return nil, err
+	}
+	t := &tsigRecord{Algorithm: k.Algorithm, TimeSigned: uint64(now.Unix()), Fudge: tsigFudge, OrigID: q.Header.ID}
+	t.MAC = k.mac(wire, t.variables(k.Name))
+	q.AddAdditional(&ResourceRecord{Name: k.Name, Type: TypeTSIG, Class: ClassANY, RData: t.RData()})
+	return t.MAC, nil
+}
+
+// VerifyResponse checks the TSIG record of resp, the response to a query
+// SignQuery signed with requestMAC.
+func (k *TSIGKey) VerifyResponse(resp, requestMAC []byte, now time.Time) error {
+	m, err := dnswire.ParseMessage(resp)
+	if err != nil {
+		return err
+	}
+	n := len(m.Additionals)
+	if n == 0 || m.Additionals[n-1].Type != TypeTSIG {
+		return fmt.Errorf("the response isn't signed")
+	}
+	rr := m.Additionals[n-1]
+	t, err := parseTSIG(rr.RData)
+	if err != nil {
+		return fmt.Errorf("malformed response TSIG: %v", err)
+	}
+	if t.Error != 0 {
+		name, ok := tsigErrors[t.Error]
+		if !ok {
+			name = fmt.Sprintf("error %d", t.Error)
+		}
+		return fmt.Errorf("the server rejected the TSIG signature: %s", name)
+	}
+	if normalizeName(rr.Name) != k.Name || t.Algorithm != k.Algorithm {
+		return fmt.Errorf("the response is signed with another key")
+	}
+	unsigned, err := withoutLastRecord(resp, m.Header, t.OrigID)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(t.MAC, k.mac(macField(requestMAC), unsigned, t.variables(k.Name))) {
+		return fmt.Errorf("the response TSIG signature doesn't verify")
+	}
+	if skew := now.Unix() - int64(t.TimeSigned); skew > int64(t.Fudge) || -skew > int64(t.Fudge) {
+		return fmt.Errorf("the response was signed %ds off our clock", skew)
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package dnsserver
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnsclient"
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// The update subcommand sends RFC 2136 dynamic updates, like nsupdate:
+//
+//	dns-server update -server 192.0.2.53 -key hmac-sha256:ddns:c2VjcmV0 \
+//		'add www 300 A 192.0.2.10' 'delete old.example.com. A'
+//
+// Commands come from the arguments, the -f script, or stdin. Each is one
+// line:
+//
+//	server host[:port]
+//	zone name
+//	key [algorithm:]name:secret
+//	ttl seconds
+//	prereq nxdomain|yxdomain name
+//	prereq nxrrset|yxrrset name type [data]
+//	[update] add name [ttl] [IN] type data
+//	[update] delete name [type [data]]
+//	send
+//	show
+//	answer
+//
+// Names without a final dot are relative to the zone, once one is given,
+// and data is written as in zone files. Pending changes are sent on send
+// and at the end. Without a zone, the server is asked for the zone of the
+// first name changed.
+
+// updater collects the commands of an update session.
+type updater struct {
+	server   string
+	network  string
+	timeout  time.Duration
+	zone     string
+	key      *TSIGKey
+	ttl      uint32
+	out      io.Writer
+	prereqs  []*ResourceRecord
+	updates  []*ResourceRecord
+	lastResp *Message
+}
+
+func runUpdate(args []string) error {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	u := &updater{out: os.Stdout, ttl: 3600}
+	fs.StringVar(&u.server, "server", "", "Server to send the updates to (default: the first nameserver in /etc/resolv.conf)")
+	zone := fs.String("zone", "", "Zone to update (default: the zone of the first name changed)")
+	key := fs.String("key", "", "TSIG key to sign the updates with, as [algorithm:]name:base64secret")
+	tcp := fs.Bool("tcp", false, "Send the updates over TCP")
+	script := fs.String("f", "", "Read the commands from this file, - for stdin")
+	fs.DurationVar(&u.timeout, "timeout", dnsclient.DefaultTimeout, "How long to wait for each attempt")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dns-server update [flags] [command...]")
+		fmt.Fprintln(fs.Output(), "commands: server, zone, key, ttl, prereq, add, delete, send, show, answer")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *tcp {
+		u.network = "tcp"
+	}
+	if *zone != "" {
+		u.zone = normalizeName(*zone)
+	}
+	if *key != "" {
+		if err := u.command("key " + *key); err != nil {
+			return err
+		}
+	}
+
+	var r io.Reader
+	switch {
+	case fs.NArg() > 0:
+		r = strings.NewReader(strings.Join(fs.Args(), "\n"))
+	case *script != "" && *script != "-":
+		f, err := os.Open(*script)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	default:
+		r = os.Stdin
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if err := u.command(scanner.Text()); err != nil {
+			if fs.NArg() > 0 {
+				return fmt.Errorf("update: %v", err)
+			}
+			return fmt.Errorf("update: line %d: %v", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(u.prereqs) > 0 || len(u.updates) > 0 {
+		return u.send()
+	}
+	return nil
+}
+
+func (u *updater) command(line string) error {
+	lines, err := tokenizeZone(line)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	tokens, quoted := lines[0].tokens, lines[0].quoted
+	cmd := strings.ToLower(tokens[0])
+	if cmd == "update" && len(tokens) > 1 {
+		tokens, quoted = tokens[1:], quoted[1:]
+		cmd = strings.ToLower(tokens[0])
+	}
+	args, quoted := tokens[1:], quoted[1:]
+	switch cmd {
+	case "server":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("server needs a host and an optional port")
+		}
+		u.server = args[0]
+		if len(args) == 2 {
+			u.server = net.JoinHostPort(args[0], args[1])
+		}
+	case "zone":
+		if len(args) != 1 {
+			return fmt.Errorf("zone needs a name")
+		}
+		u.zone = normalizeName(args[0])
+	case "key":
+		if len(args) != 1 {
+			return fmt.Errorf("key needs [algorithm:]name:secret")
+		}
+		k, err := parseTSIGKey(args[0])
+		if err != nil {
+			return err
+		}
+		u.key = k
+	case "ttl":
+		if len(args) != 1 {
+			return fmt.Errorf("ttl needs a value")
+		}
+		ttl, err := parseTTL(args[0])
+		if err != nil {
+			return err
+		}
+		u.ttl = ttl
+	case "prereq":
+		return u.prereq(args, quoted)
+	case "add":
+		return u.add(args, quoted)
+	case "del", "delete":
+		return u.delete(args, quoted)
+	case "send":
+		return u.send()
+	case "show":
+		q, err := u.message()
+		if err != nil {
+			return err
+		}
+		wire, err := q.Encode()
+		if err != nil {
+			return err
+		}
+		m, err := dnswire.ParseMessage(wire)
+		if err != nil {
+			return err
+		}
+		printResponse(u.out, m)
+	case "answer":
+		if u.lastResp != nil {
+			printResponse(u.out, u.lastResp)
+		}
+	default:
+		return fmt.Errorf("unknown command %q", tokens[0])
+	}
+	return nil
+}
+
+// name returns s as an absolute name, relative to the zone unless it
+// ends in a dot.
+func (u *updater) name(s string) string {
+	if u.zone == "" && !strings.HasSuffix(s, ".") {
+		// Until the zone is known, names are taken as they are.
+		return normalizeName(s)
+	}
+	return absName(s, u.zone)
+}
+
+func (u *updater) prereq(args []string, quoted []bool) error {
+	if len(args) < 2 {
+		return fmt.Errorf("prereq needs a kind and a name")
+	}
+	rr := &ResourceRecord{Name: u.name(args[1]), Type: TypeANY}
+	switch strings.ToLower(args[0]) {
+	case "yxdomain":
+		rr.Class = ClassANY
+	case "nxdomain":
+		rr.Class = ClassNONE
+	case "yxrrset", "nxrrset":
+		if len(args) < 3 {
+			return fmt.Errorf("prereq %s needs a name and a type", args[0])
+		}
+		t, ok := dnswire.ParseType(strings.ToUpper(args[2]))
+		if !ok {
+			return fmt.Errorf("unknown type %q", args[2])
+		}
+		rr.Type, rr.Class = t, ClassANY
+		if strings.EqualFold(args[0], "nxrrset") {
+			rr.Class = ClassNONE
+		} else if len(args) > 3 {
+			// A value dependent prerequisite names the records exactly.
+			rdata, err := packRData(t, args[3:], quoted[3:], u.zone)
+			if err != nil {
+				return err
+			}
+			rr.Class, rr.RData = ClassINET, rdata
+		}
+	default:
+		return fmt.Errorf("unknown prerequisite %q", args[0])
+	}
+	u.prereqs = append(u.prereqs, rr)
+	return nil
+}
+
+func (u *updater) add(args []string, quoted []bool) error {
+	if len(args) < 3 {
+		return fmt.Errorf("add needs a name, a type and data")
+	}
+	rr := &ResourceRecord{Name: u.name(args[0]), Class: ClassINET, TTL: u.ttl}
+	rest, quoted := args[1:], quoted[1:]
+	for len(rest) > 0 && rr.Type == 0 {
+		tok := rest[0]
+		if ttl, err := parseTTL(tok); err == nil && tok[0] >= '0' && tok[0] <= '9' {
+			rr.TTL = ttl
+		} else if strings.EqualFold(tok, "IN") {
+			rr.Class = ClassINET
+		} else if t, ok := dnswire.ParseType(strings.ToUpper(tok)); ok {
+			rr.Type = t
+		} else {
+			return fmt.Errorf("unexpected %q", tok)
+		}
+		rest, quoted = rest[1:], quoted[1:]
+	}
+	if rr.Type == 0 {
+		return fmt.Errorf("add needs a type")
+	}
+	rdata, err := packRData(rr.Type, rest, quoted, u.zone)
+	if err != nil {
+		return fmt.Errorf("%s: %v", dnswire.TypeString(rr.Type), err)
+	}
+	rr.RData = rdata
+	u.updates = append(u.updates, rr)
+	return nil
+}
+
+// delete removes all records at a name, an RRset, or one record.
+func (u *updater) delete(args []string, quoted []bool) error {
+	if len(args) < 1 {
+		return fmt.Errorf("delete needs a name")
+	}
+	rr := &ResourceRecord{Name: u.name(args[0]), Type: TypeANY, Class: ClassANY}
+	rest, quoted := args[1:], quoted[1:]
+	if len(rest) > 0 && strings.EqualFold(rest[0], "IN") {
+		rest, quoted = rest[1:], quoted[1:]
+	}
+	if len(rest) > 0 {
+		t, ok := dnswire.ParseType(strings.ToUpper(rest[0]))
+		if !ok {
+			return fmt.Errorf("unknown type %q", rest[0])
+		}
+		rr.Type = t
+		if len(rest) > 1 {
+			rdata, err := packRData(t, rest[1:], quoted[1:], u.zone)
+			if err != nil {
+				return fmt.Errorf("%s: %v", dnswire.TypeString(t), err)
+			}
+			rr.Class, rr.RData = ClassNONE, rdata
+		}
+	}
+	u.updates = append(u.updates, rr)
+	return nil
+}
+
+// message builds the update from the pending changes.
+func (u *updater) message() (*Query, error) {
+	if u.zone == "" {
+		return nil, fmt.Errorf("no zone given")
+	}
+	q := dnswire.NewQuery(u.zone, TypeSOA)
+	q.Header.RD = false
+	q.Header.Opcode = 5
+	q.AddAnswer(u.prereqs...).AddAuthority(u.updates...)
+	return q, nil
+}
+
+func (u *updater) send() error {
+	if len(u.prereqs) == 0 && len(u.updates) == 0 {
+		return nil
+	}
+	client, err := (&queryOptions{server: u.server, net: u.network}).client(u.timeout, "", false)
+	if err != nil {
+		return err
+	}
+	if u.zone == "" {
+		if err := u.findZone(client); err != nil {
+			return err
+		}
+	}
+	q, err := u.message()
+	if err != nil {
+		return err
+	}
+	var requestMAC, signed []byte
+	if u.key != nil {
+		if requestMAC, err = u.key.SignQuery(q, time.Now()); err != nil {
+			return err
+		}
+		client.Received = func(_ string, _, _ net.Addr, _, resp []byte, _ time.Time) {
+			signed = append(signed[:0], resp...)
+		}
+	}
+	resp, err := client.Exchange(context.Background(), q)
+	if err != nil {
+		return fmt.Errorf("sending the update: %v", err)
+	}
+	u.lastResp = resp
+	u.prereqs, u.updates = nil, nil
+	if resp.Header.RCode != RCodeSuccess {
+		return fmt.Errorf("update failed: %s", dnswire.RCodeString(resp.Header.RCode))
+	}
+	if u.key != nil {
+		return u.key.VerifyResponse(signed, requestMAC, time.Now())
+	}
+	return nil
+}
+
+// findZone asks the server for the zone of the first name changed, and
+// makes the names given so far, taken as absolute, final.
+func (u *updater) findZone(client *dnsclient.Client) error {
+	var name string
+	if len(u.prereqs) > 0 {
+		name = u.prereqs[0].Name
+	} else {
+		name = u.updates[0].Name
+	}
+	resp, err := client.Exchange(context.Background(), dnswire.NewQuery(name, TypeSOA))
+	if err != nil {
+		return fmt.Errorf("finding the zone of %s: %v", fqdn(name), err)
+	}
+	for _, rr := range append(resp.Answers, resp.Authorities...) {
+		if rr.Type == TypeSOA {
+			u.zone = normalizeName(rr.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("finding the zone of %s: no SOA record in the response", fqdn(name))
+}
@@ -0,0 +1,102 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -resolver takes an IPv4 or IPv6 address or a host name, with or without
+// a port, which defaults to 53:
+//
+//	-resolver 192.0.2.53
+//	-resolver 2001:db8::53
+//	-resolver '[2001:db8::53]:5353'
+//	-resolver 'fe80::1%eth0'
+//	-resolver dns.example.net -resolver-family prefer-ipv6
+//
+// Link-local addresses need the zone of the interface to send from. Host
+// names are looked up whenever the configuration is loaded, and the
+// address used is picked by -resolver-family: only IPv4 or only IPv6
+// addresses, or either with one family preferred, or the first of any.
+
+var resolverFamilies = []string{"any", "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6"}
+
+// resolveUpstream returns the address of the resolver spec names.
+func resolveUpstream(spec, family string) (*net.UDPAddr, error) {
+	if !slices.Contains(resolverFamilies, family) {
+		return nil, fmt.Errorf("unknown address family %q, want one of %s", family, strings.Join(resolverFamilies, ", "))
+	}
+	host, port := spec, "53"
+	if h, p, err := net.SplitHostPort(spec); err == nil {
+		host, port = h, p
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if err := checkZone(addr); err != nil {
+			return nil, err
+		}
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), uint16(n))), nil
+	}
+
+	network := "ip"
+	switch family {
+	case "ipv4":
+		network = "ip4"
+	case "ipv6":
+		network = "ip6"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no %s address", host, family)
+	}
+	if prefer, ok := strings.CutPrefix(family, "prefer-"); ok {
+		v6 := prefer == "ipv6"
+		// Sort the preferred family first, keeping the resolver's order
+		// within each.
+		slices.SortStableFunc(addrs, func(a, b netip.Addr) int {
+			pa, pb := a.Unmap().Is6() == v6, b.Unmap().Is6() == v6
+			switch {
+			case pa == pb:
+				return 0
+			case pa:
+				return -1
+			}
+			return 1
+		})
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrs[0].Unmap(), uint16(n))), nil
+}
+
+// checkZone checks that addr names an interface if, being link-local, it
+// needs one, and that the interface exists.
+func checkZone(addr netip.Addr) error {
+	zone := addr.Zone()
+	if zone == "" {
+		if addr.Is6() && (addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast()) {
+			return fmt.Errorf("link-local address %s needs the interface to use, as %s%%eth0", addr, addr)
+		}
+		return nil
+	}
+	_, err := net.InterfaceByName(zone)
+	if i, aerr := strconv.Atoi(zone); aerr == nil {
+		_, err = net.InterfaceByIndex(i)
+	}
+	if err != nil {
+		return fmt.Errorf("no interface %q for %s", zone, addr.WithZone(""))
+	}
+	return nil
+}
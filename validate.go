@@ -0,0 +1,69 @@
+package dnsserver
+
+import (
+	"fmt"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+var malformedQueries = NewCounterVec("dns_malformed_queries_total", "Queries rejected by message validation.", "rcode")
+
+// checkQuery checks that a query received from a client is something the
+// server can answer. The error it returns wraps the RCodeError m should be
+// answered with. A message that couldn't be parsed, and so holds only its
+// header, fails with a bare ErrFormat; why was logged when parsing.
+//
+// Strict mode also rejects queries RFC 1035 allows but nothing legitimate
+// sends: more or fewer than one question, records in the answer or authority
+// sections, meta types or class 0 in the question, and trailing bytes.
+// Updates, whose prerequisites and changes fill the answer and authority
+// sections, may carry records there.
+func checkQuery(m *Message, size int, strict bool) error {
+	if m.Size == 0 {
+		return rejectQuery(ErrFormat)
+	}
+	if m.Header.Opcode != 0 && m.Header.Opcode != opcodeUpdate {
+		return rejectQuery(fmt.Errorf("%w: unsupported opcode %d", ErrNotImplemented, m.Header.Opcode))
+	}
+	opts := 0
+	for _, rr := range m.Additionals {
+		if rr.Type != TypeOPT {
+			continue
+		}
+		opts++
+		if opts > 1 || rr.Name != "" {
+			return rejectQuery(fmt.Errorf("%w: invalid OPT record", ErrFormat))
+		}
+	}
+
+	if !strict {
+		return nil
+	}
+	var err error
+	switch {
+	case len(m.Questions) != 1:
+		err = fmt.Errorf("%d questions", len(m.Questions))
+	case m.Header.Opcode == 0 && (len(m.Answers) > 0 || len(m.Authorities) > 0 && m.Questions[0].QType != TypeIXFR):
+		err = fmt.Errorf("query carries answer or authority records")
+	case m.Questions[0].QClass == 0:
+		err = fmt.Errorf("question class 0")
+	case m.Questions[0].QType == 0 || m.Questions[0].QType == TypeOPT || m.Questions[0].QType == TypeTSIG:
+		err = fmt.Errorf("question type %d is not allowed", m.Questions[0].QType)
+	case m.Size != size:
+		err = fmt.Errorf("%d bytes of trailing data", size-m.Size)
+	}
+	if err != nil {
+		return rejectQuery(fmt.Errorf("%w: %v", ErrFormat, err))
+	}
+	return nil
+}
+
+func rejectQuery(err error) error {
+	malformedQueries.With(fmt.Sprint(dnswire.RCodeOf(err))).Inc()
+	return err
+}
+
+// errorResponse answers m with rcode and no records.
+func errorResponse(m *Message, rcode uint8) *Query {
+	return new(Query).SetRcode(m, rcode)
+}
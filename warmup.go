@@ -0,0 +1,171 @@
+package dnsserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// After a deploy, the first queries for popular names pay for everything
+// a running server has at hand: encoded answers from the served zones,
+// the DNSSEC keys the validator fetched, connections to a TCP resolver and
+// the resolver's own cache. -warm-up names a list of names to query at
+// startup, so they are fetched before clients ask:
+//
+//	-warm-up /etc/dns/popular.txt -warm-up-timeout 30s
+//
+// Each line is a name, optionally followed by the types to query, A and
+// AAAA by default; "rank,name" lines, as in popularity lists, are taken
+// too, and # starts a comment:
+//
+//	example.com
+//	mail.example.com MX A
+//	1,google.com
+//
+// The names are queried through the whole pipeline, -warm-up-concurrency
+// at a time, as a UDP client with a 1232 byte EDNS buffer on 127.0.0.1
+// would. /readyz reports the server not ready until they are all
+// answered or -warm-up-timeout passes, so traffic, and with
+// -anycast-prefix the route, moves over once the warm-up is done.
+
+var warmUpQueries = NewCounterVec("dns_warmup_queries_total", "Queries made to warm up the caches at startup, by result.", "result")
+
+type warmUpName struct {
+	name  string
+	types []uint16
+}
+
+// readWarmUpNames reads a -warm-up list.
+func readWarmUpNames(path string) ([]warmUpName, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []warmUpName
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		if i := strings.LastIndexByte(name, ','); i >= 0 {
+			name = name[i+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%s:%d: no name", path, n)
+		}
+		types := []uint16{TypeA, TypeAAAA}
+		if len(fields) > 1 {
+			types = nil
+			for _, field := range fields[1:] {
+				t, ok := dnswire.ParseType(field)
+				if !ok {
+					return nil, fmt.Errorf("%s:%d: unknown type %q", path, n, field)
+				}
+				types = append(types, t)
+			}
+		}
+		out = append(out, warmUpName{name: normalizeName(name), types: types})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WarmUp queries a list of names through a server at startup.
+type WarmUp struct {
+	Names       []warmUpName
+	Concurrency int
+	Timeout     time.Duration
+	Health      *Health
+}
+
+// Start queries the names through srv in the background, holding
+// readiness back until they are answered or the timeout passes.
+func (w *WarmUp) Start(srv *Server) {
+	w.Health.SetWarmingUp(true)
+	go func() {
+		defer w.Health.SetWarmingUp(false)
+		w.run(srv)
+	}()
+}
+
+func (w *WarmUp) run(srv *Server) {
+	start := time.Now()
+	jobs := make(chan *Query)
+	var answered, failed atomic.Int64
+	var wg sync.WaitGroup
+	for range max(1, w.Concurrency) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := warmUpClientInfo()
+			for q := range jobs {
+				query, err := q.Encode()
+				if err == nil {
+					_, err = srv.Exchange(query, client)
+				}
+				if err != nil {
+					failed.Add(1)
+					warmUpQueries.With("failed").Inc()
+					logServer.Debug("warm-up query failed", "name", fqdn(q.Questions[0].Name), "err", err)
+					continue
+				}
+				answered.Add(1)
+				warmUpQueries.With("answered").Inc()
+			}
+		}()
+	}
+
+	deadline := time.After(w.Timeout)
+	timedOut := false
+send:
+	for _, n := range w.Names {
+		for _, t := range n.types {
+			select {
+			case jobs <- dnswire.NewQuery(n.name, t).SetEDNS(ednsUDPSize, false):
+			case <-deadline:
+				timedOut = true
+				break send
+			}
+		}
+	}
+	close(jobs)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if !timedOut {
+		select {
+		case <-done:
+		case <-deadline:
+			timedOut = true
+		}
+	}
+	if timedOut {
+		// Queries still in flight finish in the background.
+		logServer.Warn("cache warm-up timed out", "timeout", w.Timeout, "answered", answered.Load(), "failed", failed.Load())
+		return
+	}
+	logServer.Info("cache warm-up finished", "names", len(w.Names), "answered", answered.Load(), "failed", failed.Load(), "took", time.Since(start).Round(time.Millisecond))
+}
+
+// warmUpClientInfo is the client warm-up queries come from; the default
+// ACLs let it recurse.
+func warmUpClientInfo() *server.Client {
+	return &server.Client{IP: net.IPv4(127, 0, 0, 1), ACLs: NewACLSet(), Protocol: "warmup"}
+}
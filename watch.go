@@ -0,0 +1,109 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// A QueryWatch follows the queries the server answers as they are
+// answered, for the console's watch command. Entries a slow watcher
+// hasn't taken yet are dropped rather than holding up the query.
+type QueryWatch struct {
+	// QName limits the watch to queries for this name or names below it.
+	QName string
+	// Client limits the watch to these clients.
+	Client *net.IPNet
+	// Type and RCode, if set, limit the watch to queries of this type and
+	// responses with this RCODE.
+	Type  uint16
+	RCode string
+
+	C chan queryLogEntry
+}
+
+// maxQueryWatches bounds how many watches run at once.
+const maxQueryWatches = 8
+
+var queryWatches struct {
+	mu      sync.Mutex
+	watches []*QueryWatch
+	// active spares answering queries the lock while nobody watches.
+	active atomic.Bool
+}
+
+// WatchQueries starts a watch; qtype and rcode are names like AAAA and
+// NXDOMAIN. Stop it with Stop.
+func WatchQueries(qname, client, qtype, rcode string) (*QueryWatch, error) {
+	w := &QueryWatch{QName: normalizeName(qname), RCode: strings.ToUpper(rcode), C: make(chan queryLogEntry, 256)}
+	if client != "" {
+		nets, err := server.ParseNetworks(client)
+		if err != nil || len(nets) != 1 {
+			return nil, fmt.Errorf("invalid client filter %q, want an address or network", client)
+		}
+		w.Client = nets[0]
+	}
+	if qtype != "" {
+		t, ok := dnswire.ParseType(strings.ToUpper(qtype))
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", qtype)
+		}
+		w.Type = t
+	}
+	if w.RCode != "" && w.RCode != "DROPPED" {
+		if _, ok := dnswire.ParseRCode(w.RCode); !ok {
+			return nil, fmt.Errorf("unknown rcode %q", rcode)
+		}
+	}
+
+	queryWatches.mu.Lock()
+	defer queryWatches.mu.Unlock()
+	if len(queryWatches.watches) >= maxQueryWatches {
+		return nil, fmt.Errorf("already %d watches running", maxQueryWatches)
+	}
+	queryWatches.watches = append(queryWatches.watches, w)
+	queryWatches.active.Store(true)
+	return w, nil
+}
+
+func (w *QueryWatch) Stop() {
+	queryWatches.mu.Lock()
+	defer queryWatches.mu.Unlock()
+	queryWatches.watches = slices.DeleteFunc(queryWatches.watches, func(o *QueryWatch) bool { return o == w })
+	queryWatches.active.Store(len(queryWatches.watches) > 0)
+}
+
+// notifyQueryWatches hands the response to m to the watches it matches.
+func notifyQueryWatches(client *server.Client, m *Message, resp *Query, cached bool, took time.Duration) {
+	if !queryWatches.active.Load() || len(m.Questions) == 0 {
+		return
+	}
+	var e *queryLogEntry
+	queryWatches.mu.Lock()
+	defer queryWatches.mu.Unlock()
+	for _, w := range queryWatches.watches {
+		q := m.Questions[0]
+		if !inZone(normalizeName(q.Name), w.QName) || (w.Client != nil && !w.Client.Contains(client.IP)) ||
+			(w.Type != 0 && q.QType != w.Type) {
+			continue
+		}
+		if e == nil {
+			entry := newQueryLogEntry(client, m, resp, cached, took)
+			e = &entry
+		}
+		if w.RCode != "" && e.RCode != w.RCode {
+			continue
+		}
+		select {
+		case w.C <- *e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Operational events sent to webhooks.
+const (
+	eventUpstreamDown    = "upstream-down"
+	eventUpstreamUp      = "upstream-up"
+	eventServfailSpike   = "servfail-spike"
+	eventBlocklistFailed = "blocklist-refresh-failed"
+	eventReloadFailed    = "reload-failed"
+	eventDGASuspect      = "dga-suspect"
+	eventTransferFailed  = "transfer-failed"
+)
+
+const (
+	webhookAttempts        = 3
+	webhookCooldown        = 5 * time.Minute
+	defaultWebhookTemplate = `{"event":{{json .Event}},"time":{{json .Time}},"host":{{json .Host}},"subject":{{json .Subject}},"message":{{json .Message}},"details":{{json .Details}}}`
+)
+
+var webhookEvents = []string{eventUpstreamDown, eventUpstreamUp, eventServfailSpike, eventBlocklistFailed, eventReloadFailed, eventDGASuspect, eventTransferFailed}
+
+var (
+	webhookFailures = NewCounterVec("dns_webhook_failures_total", "Webhook notifications that could not be delivered.", "event")
+	webhooks        *Webhooks
+)
+
+// Webhook posts a JSON payload, rendered from Template, to URL for each of
+// Events, or for every event if Events is empty.
+type Webhook struct {
+	URL      string
+	Events   map[string]bool
+	Template *template.Template
+}
+
+// webhookEvent is what the payload template is executed on.
+type webhookEvent struct {
+	Event string
+	Time  time.Time
+	Host  string
+	// Subject is what the event is about, such as the upstream address.
+	Subject string
+	Message string
+	Details map[string]string
+}
+
+// Webhooks notifies operators of events without them having to scrape
+// logs. Delivery happens in the background and is retried a few times;
+// an event about the same subject is sent at most once per cooldown so a
+// flapping condition doesn't flood the receiver.
+type Webhooks struct {
+	hooks  []*Webhook
+	client *http.Client
+	host   string
+	queue  chan webhookEvent
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// NewWebhooks parses specs, each a URL optionally preceded by the events
+// it wants, as upstream-down,servfail-spike=https://example.com/hook.
+// templatePath, if set, holds a text/template for the payload; its json
+// function encodes a value as JSON.
+func NewWebhooks(specs []string, templatePath string) (*Webhooks, error) {
+	text := defaultWebhookTemplate
+	if templatePath != "" {
+		b, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %v", err)
+	}
+
+	w := &Webhooks{
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan webhookEvent, 64),
+		sent:   map[string]time.Time{},
+	}
+	w.host, _ = os.Hostname()
+	for _, spec := range specs {
+		hook := &Webhook{URL: spec, Template: tmpl, Events: map[string]bool{}}
+		if events, url, ok := strings.Cut(spec, "="); ok && !strings.Contains(events, ":") {
+			hook.URL = url
+			for _, e := range strings.Split(events, ",") {
+				if !contains(webhookEvents, e) {
+					return nil, fmt.Errorf("invalid -webhook %q: unknown event %q, want one of %s", spec, e, strings.Join(webhookEvents, ", "))
+				}
+				hook.Events[e] = true
+			}
+		}
+		if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+			return nil, fmt.Errorf("invalid -webhook %q: want an http or https URL", spec)
+		}
+		w.hooks = append(w.hooks, hook)
+	}
+	go w.run()
+	return w, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Fire queues event for delivery. details are key, value pairs.
+func (w *Webhooks) Fire(event, subject, message string, details ...string) {
+	if w == nil {
+		return
+	}
+	e := webhookEvent{Event: event, Time: time.Now().UTC(), Host: w.host, Subject: subject, Message: message, Details: map[string]string{}}
+	for i := 0; i+1 < len(details); i += 2 {
+		e.Details[details[i]] = details[i+1]
+	}
+
+	key := event + " " + subject
+	w.mu.Lock()
+	if last, ok := w.sent[key]; ok && e.Time.Sub(last) < webhookCooldown {
+		w.mu.Unlock()
+		return
+	}
+	w.sent[key] = e.Time
+	w.mu.Unlock()
+
+	select {
+	case w.queue <- e:
+	default:
+		webhookFailures.With(event).Inc()
+	}
+}
+
+func (w *Webhooks) run() {
+	for e := range w.queue {
+		for _, hook := range w.hooks {
+			if len(hook.Events) > 0 && !hook.Events[e.Event] {
+				continue
+			}
+			if err := w.deliver(hook, e); err != nil {
+				logWebhook.Warn("sending webhook failed", "event", e.Event, "url", hook.URL, "err", err)
+				webhookFailures.With(e.Event).Inc()
+			}
+		}
+	}
+}
+
+func (w *Webhooks) deliver(hook *Webhook, e webhookEvent) error {
+	var body bytes.Buffer
+	if err := hook.Template.Execute(&body, e); err != nil {
+		return err
+	}
+	var err error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		var resp *http.Response
+		resp, err = w.client.Post(hook.URL, "application/json", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		err = fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return err
+}
+
+// ServfailMonitor fires servfail-spike when, over a window, at least
+// Ratio of at least MinQueries responses were SERVFAIL.
+type ServfailMonitor struct {
+	Window     time.Duration
+	Ratio      float64
+	MinQueries int
+
+	mu              sync.Mutex
+	total, servfail int
+}
+
+func (m *ServfailMonitor) Record(resp *Query) {
+	if m == nil || resp == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total++
+	if resp.Header.RCode == RCodeServerFailure {
+		m.servfail++
+	}
+}
+
+func (m *ServfailMonitor) Run() {
+	for range time.Tick(m.Window) {
+		m.mu.Lock()
+		total, servfail := m.total, m.servfail
+		m.total, m.servfail = 0, 0
+		m.mu.Unlock()
+		if total < m.MinQueries || float64(servfail) < m.Ratio*float64(total) {
+			continue
+		}
+		ratio := float64(servfail) / float64(total)
+		webhooks.Fire(eventServfailSpike, "",
+			fmt.Sprintf("%.0f%% of the last %d responses were SERVFAIL", ratio*100, total),
+			"ratio", fmt.Sprintf("%.3f", ratio), "responses", fmt.Sprint(total), "window", m.Window.String())
+	}
+}
+
+// upstreamChanges compares two rounds of upstream checks and returns the
+// upstreams that went down and came back up, sorted.
+func upstreamChanges(before, after map[string]error) (down, up []string) {
+	for addr, err := range after {
+		prev, known := before[addr]
+		switch {
+		case err != nil && (!known || prev == nil):
+			down = append(down, addr)
+		case err == nil && known && prev != nil:
+			up = append(up, addr)
+		}
+	}
+	sort.Strings(down)
+	sort.Strings(up)
+	return down, up
+}
@@ -0,0 +1,64 @@
+package dnsserver
+
+import "github.com/bibektamang7/dns-server/dnswire"
+
+// The message codec lives in the dnswire package, so other programs can
+// use it. The server refers to its types and constants by these names.
+type (
+	Query          = dnswire.Query
+	Header         = dnswire.Header
+	Question       = dnswire.Question
+	ResourceRecord = dnswire.ResourceRecord
+	Message        = dnswire.Message
+	LazyMessage    = dnswire.LazyMessage
+	Encoder        = dnswire.Encoder
+)
+
+const (
+	TypeA          = dnswire.TypeA
+	TypeNS         = dnswire.TypeNS
+	TypeCNAME      = dnswire.TypeCNAME
+	TypeSOA        = dnswire.TypeSOA
+	TypePTR        = dnswire.TypePTR
+	TypeMX         = dnswire.TypeMX
+	TypeTXT        = dnswire.TypeTXT
+	TypeSIG        = dnswire.TypeSIG
+	TypeKEY        = dnswire.TypeKEY
+	TypeAAAA       = dnswire.TypeAAAA
+	TypeSRV        = dnswire.TypeSRV
+	TypeOPT        = dnswire.TypeOPT
+	TypeDS         = dnswire.TypeDS
+	TypeRRSIG      = dnswire.TypeRRSIG
+	TypeNSEC       = dnswire.TypeNSEC
+	TypeDNSKEY     = dnswire.TypeDNSKEY
+	TypeNSEC3      = dnswire.TypeNSEC3
+	TypeNSEC3PARAM = dnswire.TypeNSEC3PARAM
+	TypeCDS        = dnswire.TypeCDS
+	TypeCDNSKEY    = dnswire.TypeCDNSKEY
+	TypeTSIG       = dnswire.TypeTSIG
+	TypeIXFR       = dnswire.TypeIXFR
+	TypeAXFR       = dnswire.TypeAXFR
+	TypeANY        = dnswire.TypeANY
+
+	ClassINET = dnswire.ClassINET
+	ClassNONE = dnswire.ClassNONE
+	ClassANY  = dnswire.ClassANY
+
+	RCodeSuccess        = dnswire.RCodeSuccess
+	RCodeFormatError    = dnswire.RCodeFormatError
+	RCodeServerFailure  = dnswire.RCodeServerFailure
+	RCodeNameError      = dnswire.RCodeNameError
+	RCodeNotImplemented = dnswire.RCodeNotImplemented
+	RCodeRefused        = dnswire.RCodeRefused
+	RCodeYXDomain       = dnswire.RCodeYXDomain
+	RCodeYXRRSet        = dnswire.RCodeYXRRSet
+	RCodeNXRRSet        = dnswire.RCodeNXRRSet
+	RCodeNotAuth        = dnswire.RCodeNotAuth
+	RCodeNotZone        = dnswire.RCodeNotZone
+
+	ErrFormat         = dnswire.ErrFormat
+	ErrServFail       = dnswire.ErrServFail
+	ErrNXDomain       = dnswire.ErrNXDomain
+	ErrNotImplemented = dnswire.ErrNotImplemented
+	ErrRefused        = dnswire.ErrRefused
+)
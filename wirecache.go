@@ -0,0 +1,193 @@
+package dnsserver
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+var wireCacheLookups = NewCounterVec("dns_wire_cache_lookups_total", "Authoritative answers looked up in the encoded response cache.", "result")
+
+// wireCacheMaxAge bounds how long an encoded response is reused, so
+// signatures refreshed in place are picked up.
+const wireCacheMaxAge = time.Minute
+
+// WireCache keeps encoded authoritative responses for repeated questions,
+// so answering them again skips the zone lookup and the encoding. Only
+// responses that depend on nothing but the question, the EDNS payload size
+// and the DO bit are cached; the ID, RD bit and the case of the question
+// name are patched in per query. The entries are kept in a Cache. A nil
+// WireCache caches nothing.
+type WireCache struct {
+	store Cache
+}
+
+// NewWireCache returns a cache keeping its responses in store, or nil if
+// store is nil.
+func NewWireCache(store Cache) *WireCache {
+	if store == nil {
+		return nil
+	}
+	return &WireCache{store: store}
+}
+
+// Key returns the cache key for an authoritative answer to m, or false if
+// the answer can't be cached. Queries with EDNS options, such as cookies
+// or client subnets, get answers of their own. The key names the zone's
+// version, so changes to the zone make it miss.
+func (c *WireCache) Key(zones *ZoneSet, m *Message, stream bool) (string, bool) {
+	if c == nil || len(m.Questions) != 1 || m.Header.Opcode != 0 || len(m.Additionals) > 1 {
+		return "", false
+	}
+	opt := findOPT(m)
+	if len(m.Additionals) == 1 && (opt == nil || len(opt.RData) > 0) {
+		return "", false
+	}
+	q := m.Questions[0]
+	z := zones.Find(q.Name)
+	if z == nil {
+		return "", false
+	}
+	// limit is the payload size the response is truncated to.
+	limit := 0xFFFF
+	if !stream {
+		limit = 512
+		if opt != nil && opt.Class > 512 {
+			limit = int(min(opt.Class, ednsUDPSize))
+		}
+	}
+	flags := "-"
+	switch {
+	case opt != nil && opt.TTL&(1<<15) != 0:
+		flags = "do"
+	case opt != nil:
+		flags = "edns"
+	}
+	key := make([]byte, 0, 64)
+	key = strconv.AppendUint(key, z.version.Load(), 10)
+	key = append(key, ' ')
+	key = append(key, normalizeName(q.Name)...)
+	key = append(key, ' ')
+	key = strconv.AppendUint(key, uint64(q.QType), 10)
+	key = append(key, ' ')
+	key = strconv.AppendUint(key, uint64(q.QClass), 10)
+	key = append(key, ' ')
+	key = append(key, flags...)
+	key = append(key, ' ')
+	key = strconv.AppendInt(key, int64(limit), 10)
+	return string(key), true
+}
+
+// Get returns the cached response for key, and it encoded as the answer
+// to m in a pooled buffer, or nil.
+func (c *WireCache) Get(key string, m *Message, now time.Time) (*Query, []byte) {
+	stored, ok := c.store.Get(key, now)
+	var parsed *Message
+	if ok {
+		parsed, _ = dnswire.ParseMessage(stored)
+	}
+	if parsed == nil {
+		wireCacheLookups.With("miss").Inc()
+		return nil, nil
+	}
+	wireCacheLookups.With("hit").Inc()
+	resp := &Query{Header: *parsed.Header, Questions: m.Questions, Answers: parsed.Answers,
+		Authorities: parsed.Authorities, Additionals: parsed.Additionals}
+	resp.Header.ID, resp.Header.RD = m.Header.ID, m.Header.RD
+
+	buf := server.GetBuffer(len(stored))
+	wire := *buf
+	copy(wire, stored)
+	wire[0], wire[1] = byte(m.Header.ID>>8), byte(m.Header.ID)
+	wire[2] &^= 1
+	if m.Header.RD {
+		wire[2] |= 1
+	}
+	// The question name starts at offset 12 and, apart from its first
+	// length octet, lines up with the presentation form: dots fall on the
+	// length octets of the following labels.
+	name := strings.TrimSuffix(m.Questions[0].Name, ".")
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			wire[13+i] = name[i]
+		}
+	}
+	return resp, wire
+}
+
+// Put caches the encoded response wire for key.
+func (c *WireCache) Put(key string, wire []byte, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.store.Put(key, bytes.Clone(wire), wireCacheMaxAge, now)
+}
+
+// Flush empties the cache and returns how many responses it held.
+func (c *WireCache) Flush() int {
+	if c == nil {
+		return 0
+	}
+	return c.store.Flush()
+}
+
+// wireCacheEntry describes a cached response, for the control socket.
+type wireCacheEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Flags is "-" for queries without EDNS, "edns" or "do".
+	Flags   string   `json:"flags"`
+	Limit   int      `json:"limit"`
+	RCode   string   `json:"rcode"`
+	Answers []string `json:"answers"`
+	TTL     float64  `json:"ttl"`
+}
+
+// Entries lists the cached responses for names at or below name, if the
+// store can list them.
+func (c *WireCache) Entries(name string, now time.Time) []wireCacheEntry {
+	r, ok := c.store.(CacheRanger)
+	if !ok {
+		return nil
+	}
+	name = normalizeName(name)
+	var out []wireCacheEntry
+	r.Range(now, func(key string, value []byte, expires time.Time) bool {
+		// version qname qtype qclass flags limit
+		f := strings.Fields(key)
+		if len(f) != 6 || !inZone(f[1], name) {
+			return true
+		}
+		qtype, _ := strconv.ParseUint(f[2], 10, 16)
+		limit, _ := strconv.Atoi(f[5])
+		e := wireCacheEntry{Name: fqdn(f[1]), Type: dnswire.TypeString(uint16(qtype)), Flags: f[4], Limit: limit,
+			TTL: expires.Sub(now).Seconds()}
+		if m, err := dnswire.ParseMessage(value); err == nil {
+			e.RCode, e.Answers = dnswire.RCodeString(m.Header.RCode), answerSummary(m.Answers)
+		}
+		out = append(out, e)
+		return true
+	})
+	slices.SortFunc(out, func(a, b wireCacheEntry) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.Type, b.Type),
+			strings.Compare(a.Flags, b.Flags), cmp.Compare(a.Limit, b.Limit))
+	})
+	return out
+}
+
+// Shrink evicts fraction of the cached responses, if they are held in
+// memory.
+func (c *WireCache) Shrink(fraction float64) {
+	if c == nil {
+		return
+	}
+	if s, ok := c.store.(interface{ Shrink(float64) }); ok {
+		s.Shrink(fraction)
+	}
+}
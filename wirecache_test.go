@@ -0,0 +1,114 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// testCache is a Cache that counts what is asked of it.
+type testCache struct {
+	entries    map[string][]byte
+	gets, hits int
+	puts       []string
+}
+
+func (c *testCache) Get(key string, now time.Time) ([]byte, bool) {
+	c.gets++
+	value, ok := c.entries[key]
+	if ok {
+		c.hits++
+	}
+	return value, ok
+}
+
+func (c *testCache) Put(key string, value []byte, ttl time.Duration, now time.Time) {
+	c.puts = append(c.puts, key)
+	c.entries[key] = value
+}
+
+func (c *testCache) Flush() int {
+	n := len(c.entries)
+	clear(c.entries)
+	return n
+}
+
+func (c *testCache) Len() int { return len(c.entries) }
+
+func TestWireCacheStore(t *testing.T) {
+	spec, _ := writeZone(t)
+	liveConfig.Store(buildConfig(t, "-zone", spec))
+	defer liveConfig.Store(nil)
+	store := &testCache{entries: map[string][]byte{}}
+	p := &Pipeline{WireCache: NewWireCache(store)}
+	if err := p.Build(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		gets, hits int
+		puts       int
+	}{
+		// The first query misses and stores the answer, the second is
+		// answered from it, and a name in another case too.
+		{"www.example.com", 1, 0, 1},
+		{"www.example.com", 2, 1, 1},
+		{"WWW.Example.COM", 3, 2, 1},
+		{"ns1.example.com", 4, 2, 2},
+		// Names outside the zones aren't cached.
+		{"www.example.org", 4, 2, 2},
+	} {
+		resp := serveQuery(t, p, tc.name, TypeA)
+		if store.gets != tc.gets || store.hits != tc.hits || len(store.puts) != tc.puts {
+			t.Errorf("%s: %d gets, %d hits, %d puts; want %d, %d, %d", tc.name, store.gets, store.hits, len(store.puts), tc.gets, tc.hits, tc.puts)
+		}
+		if tc.name == "www.example.org" {
+			continue
+		}
+		if len(resp.Questions) != 1 || resp.Questions[0].Name != tc.name || len(resp.Answers) != 1 {
+			t.Errorf("%s: answered %+v", tc.name, resp)
+			continue
+		}
+		if tc.name != "ns1.example.com" && net.IP(resp.Answers[0].RData).String() != "192.0.2.10" {
+			t.Errorf("%s: answered %s", tc.name, net.IP(resp.Answers[0].RData))
+		}
+	}
+	if n := p.WireCache.Flush(); n != 2 || store.Len() != 0 {
+		t.Errorf("Flush() = %d, leaving %d", n, store.Len())
+	}
+}
+
+// BenchmarkWireCache answers a repeated question from the wire cache,
+// patching the stored response for each query.
+func BenchmarkWireCache(b *testing.B) {
+	c := NewWireCache(NewMemoryCache(100))
+	q := new(Query).SetQuestion("www.example.com", TypeA)
+	q.Header.RD = true
+	query, err := q.Encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	m, err := dnswire.ParseMessage(query)
+	if err != nil {
+		b.Fatal(err)
+	}
+	resp := new(Query).SetReply(m).AddAnswer(&ResourceRecord{Name: "www.example.com", Type: TypeA, Class: ClassINET, TTL: 300, RData: []byte{192, 0, 2, 10}})
+	wire, err := resp.Encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+	c.Put("www.example.com", wire, now)
+	b.ReportAllocs()
+	for range b.N {
+		resp, wire := c.Get("www.example.com", m, now)
+		if resp == nil {
+			b.Fatal("miss")
+		}
+		server.PutBuffer(&wire)
+	}
+}
@@ -0,0 +1,266 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+	"github.com/bibektamang7/dns-server/server"
+)
+
+// Zone transfers (AXFR, RFC 5936) are streamed: records are encoded into
+// one reused buffer, which is sent whenever it holds transferBatchSize
+// bytes, so a transfer takes the memory of a message rather than of the
+// zone.
+//
+// Incremental transfers (IXFR, RFC 1995) are served from a journal of the
+// last maxJournal changes made to the zone since it was loaded, each
+// taking it from one serial to the next. A client further behind, or
+// asking for a signed zone, whose signatures change with every edit, gets
+// the whole zone instead.
+const (
+	transferBatchSize = 16 << 10
+	maxJournal        = 100
+)
+
+var zoneTransfers = NewCounterVec("dns_zone_transfers_total", "AXFR and IXFR zone transfers served.", "result")
+
+// zoneDelta is one change to a zone: the SOA before and after, and the
+// records deleted and added.
+type zoneDelta struct {
+	from, to       *ResourceRecord
+	deleted, added []*ResourceRecord
+}
+
+// bumpSerial sets the SOA serial to serial and journals delta as the
+// change to it. The caller holds z.mu.
+func (z *Zone) bumpSerial(serial uint32, delta zoneDelta) uint32 {
+	delta.from = z.rrsets[z.Origin][TypeSOA][0]
+	z.setSerial(serial)
+	delta.to = z.rrsets[z.Origin][TypeSOA][0]
+	if len(z.journal) == maxJournal {
+		z.journal = slices.Delete(z.journal, 0, 1)
+	}
+	z.journal = append(z.journal, delta)
+	return serial
+}
+
+// Transfer calls send with every record of the zone in AXFR order: the
+// SOA, the other records owner by owner in canonical order, each RRset
+// followed by its RRSIGs when the zone is signed, and the SOA again. Only
+// the owner names are copied up front, and each owner's records are
+// looked up as it comes, so a slow receiver doesn't hold the zone locked.
+// A transfer the zone changed under fails rather than mix two versions.
+func (z *Zone) Transfer(send func(*ResourceRecord) error) error {
+	z.mu.RLock()
+	version := z.version.Load()
+	soa := z.rrsets[z.Origin][TypeSOA][0]
+	owners := z.sortedOwners()
+	z.mu.RUnlock()
+
+	if err := send(soa); err != nil {
+		return err
+	}
+	var rrs []*ResourceRecord
+	for _, name := range owners {
+		rrs = z.ownerRecords(name, rrs[:0])
+		if z.version.Load() != version {
+			return fmt.Errorf("zone %q changed during the transfer", fqdn(z.Origin))
+		}
+		for _, rr := range rrs {
+			if rr == soa {
+				continue
+			}
+			if err := send(rr); err != nil {
+				return err
+			}
+		}
+	}
+	return send(soa)
+}
+
+// TransferIncremental calls send with the records of an IXFR answer to a
+// client at serial: the current SOA, then for each change since, the old
+// SOA, the records deleted, the new SOA and the records added, and the
+// current SOA again. A client that is up to date gets the current SOA
+// alone. It returns false, without sending anything, if the journal
+// doesn't reach back to serial.
+func (z *Zone) TransferIncremental(serial uint32, send func(*ResourceRecord) error) (bool, error) {
+	z.mu.RLock()
+	soa := z.rrsets[z.Origin][TypeSOA][0]
+	if int32(serial-z.serial()) >= 0 {
+		z.mu.RUnlock()
+		return true, send(soa)
+	}
+	start := slices.IndexFunc(z.journal, func(d zoneDelta) bool { return soaSerial(d.from) == serial })
+	if start < 0 || z.signer != nil {
+		z.mu.RUnlock()
+		return false, nil
+	}
+	// Deltas are never changed once journaled, so they are sent unlocked.
+	deltas := slices.Clone(z.journal[start:])
+	z.mu.RUnlock()
+
+	if err := send(soa); err != nil {
+		return true, err
+	}
+	for _, d := range deltas {
+		for _, part := range [][]*ResourceRecord{{d.from}, d.deleted, {d.to}, d.added} {
+			for _, rr := range part {
+				if err := send(rr); err != nil {
+					return true, err
+				}
+			}
+		}
+	}
+	return true, send(soa)
+}
+
+// ownerRecords appends the records owned by name, with their signatures,
+// to rrs.
+func (z *Zone) ownerRecords(name string, rrs []*ResourceRecord) []*ResourceRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	sets := z.rrsets[name]
+	for _, rrtype := range sortedTypes(sets) {
+		rrs = append(rrs, sets[rrtype]...)
+		if z.signer != nil && rrtype != TypeRRSIG {
+			rrs = append(rrs, z.signer.sigsFor(z, sets[rrtype])...)
+		}
+	}
+	return rrs
+}
+
+// transferWriter packs records into length-prefixed messages answering
+// query and writes them to conn. When the query was TSIG signed, auth
+// signs each message and mac is the MAC of the last one sent.
+type transferWriter struct {
+	conn     net.Conn
+	query    *Message
+	auth     *authResult
+	mac      []byte
+	buf      []byte
+	c        *dnswire.Compression
+	count    int
+	messages int
+}
+
+// streamTransfer sends z over conn as the answer to the AXFR query m,
+// signed as auth says, and returns the number of records sent.
+func streamTransfer(conn net.Conn, m *Message, auth *authResult, z *Zone) (int, error) {
+	return streamRecords(conn, m, auth, z.Transfer)
+}
+
+// streamIncremental sends the changes to z since serial over conn as the
+// answer to the IXFR query m, or the whole zone if they aren't journaled,
+// signed as auth says, and returns the number of records sent.
+func streamIncremental(conn net.Conn, m *Message, auth *authResult, z *Zone, serial uint32) (int, error) {
+	return streamRecords(conn, m, auth, func(send func(*ResourceRecord) error) error {
+		ok, err := z.TransferIncremental(serial, send)
+		if !ok {
+			return z.Transfer(send)
+		}
+		return err
+	})
+}
+
+// streamRecords sends the records transfer produces over conn as the
+// answer to m. Only TSIG signed queries get signed answers; those to
+// SIG(0) signed ones go unsigned, like other responses.
+func streamRecords(conn net.Conn, m *Message, auth *authResult, transfer func(send func(*ResourceRecord) error) error) (int, error) {
+	t := &transferWriter{conn: conn, query: m}
+	if auth != nil && auth.key != nil {
+		t.auth = auth
+	}
+	pooled := server.GetBuffer(65535)
+	defer server.PutBuffer(pooled)
+	t.buf = (*pooled)[:0]
+	if err := t.start(); err != nil {
+		return 0, err
+	}
+	defer func() { t.c.Release() }()
+
+	records := 0
+	err := transfer(func(rr *ResourceRecord) error {
+		records++
+		return t.add(rr)
+	})
+	if err == nil {
+		err = t.flush()
+	}
+	return records, err
+}
+
+// start begins a message. Only the first one repeats the question.
+func (t *transferWriter) start() error {
+	if t.c != nil {
+		t.c.Release()
+	}
+	t.c = dnswire.NewCompression(2)
+	t.count = 0
+	h := Header{ID: t.query.Header.ID, QR: true, AA: true, RD: t.query.Header.RD}
+	if t.messages == 0 {
+		h.QDCount = 1
+	}
+	buf, err := h.AppendTo(t.buf[:2])
+	if err == nil && t.messages == 0 {
+		buf, err = t.query.Questions[0].AppendTo(buf, t.c)
+	}
+	t.buf = buf
+	return err
+}
+
+func (t *transferWriter) add(rr *ResourceRecord) error {
+	if len(t.buf)-2 >= transferBatchSize {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	}
+	mark := len(t.buf)
+	buf, err := rr.AppendTo(t.buf, t.c)
+	if err != nil {
+		return err
+	}
+	if len(buf)-2+t.tsigLength() > 0xFFFF {
+		if t.count == 0 {
+			return fmt.Errorf("%s %s doesn't fit in a message", fqdn(rr.Name), dnswire.TypeString(rr.Type))
+		}
+		// Send what came before and start over with rr.
+		t.buf = buf[:mark]
+		if err := t.flush(); err != nil {
+			return err
+		}
+		return t.add(rr)
+	}
+	t.buf = buf
+	t.count++
+	return nil
+}
+
+// tsigLength returns the room a message needs for its TSIG record.
+func (t *transferWriter) tsigLength() int {
+	if t.auth == nil {
+		return 0
+	}
+	return t.auth.tsigLength()
+}
+
+// flush sends the message so far and starts the next one.
+func (t *transferWriter) flush() error {
+	binary.BigEndian.PutUint16(t.buf[2+6:], uint16(t.count))
+	if t.auth != nil {
+		var signed []byte
+		signed, t.mac = t.auth.SignTransfer(t.buf[2:], t.mac, time.Now())
+		t.buf = append(t.buf[:2], signed...)
+	}
+	binary.BigEndian.PutUint16(t.buf, uint16(len(t.buf)-2))
+	t.conn.SetWriteDeadline(time.Now().Add(server.IdleTimeout))
+	if _, err := t.conn.Write(t.buf); err != nil {
+		return err
+	}
+	t.messages++
+	return t.start()
+}
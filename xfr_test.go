@@ -0,0 +1,152 @@
+package dnsserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+// bigZone returns example.com with enough records that a transfer of it
+// takes several messages.
+func bigZone(t *testing.T) *Zone {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString(testZoneFile)
+	for i := range 1000 {
+		fmt.Fprintf(&b, "host%d IN TXT %q\n", i, strings.Repeat("x", 100))
+	}
+	records, err := ParseZone(strings.NewReader(b.String()), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := NewZone("example.com", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+// transfer runs an AXFR of z, checked with a, and returns the messages
+// sent. With key set the query is signed with it, and the MAC it was
+// signed with is returned as well.
+func transfer(t *testing.T, z *Zone, a *Authenticator, key *TSIGKey) ([][]byte, []byte) {
+	t.Helper()
+	q := new(Query).SetQuestion("example.com", TypeAXFR)
+	q.Header.ID = 7
+	var requestMAC []byte
+	if key != nil {
+		var err error
+		if requestMAC, err = key.SignQuery(q, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := q.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := dnswire.ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := a.Check(data, m, net.IPv4(192, 0, 2, 7), time.Now())
+	if auth != nil && auth.RCode != RCodeSuccess {
+		t.Fatalf("query signature: rcode %d", auth.RCode)
+	}
+
+	conn, peer := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := streamTransfer(conn, m, auth, z)
+		conn.Close()
+		done <- err
+	}()
+	var messages [][]byte
+	for {
+		msg, err := readQuery(peer)
+		if err != nil {
+			break
+		}
+		messages = append(messages, msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return messages, requestMAC
+}
+
+func TestTransferTSIG(t *testing.T) {
+	z := bigZone(t)
+	key, err := parseTSIGKey("hmac-sha256:xfr.example.:c2VjcmV0LXhmci1rZXktZm9yLXRlc3Rz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuthenticator()
+	a.AddTSIGKey(key)
+
+	messages, requestMAC := transfer(t, z, a, key)
+	if len(messages) < 2 {
+		t.Fatalf("the transfer took %d messages, want several", len(messages))
+	}
+	records := 0
+	prior := requestMAC
+	for i, msg := range messages {
+		m, err := dnswire.ParseMessage(msg)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		records += len(m.Answers)
+		n := len(m.Additionals)
+		if n == 0 || m.Additionals[n-1].Type != TypeTSIG {
+			t.Fatalf("message %d isn't signed", i)
+		}
+		tsig, err := parseTSIG(m.Additionals[n-1].RData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := key.VerifyResponse(msg, requestMAC, time.Now()); err != nil {
+				t.Fatalf("first message: %v", err)
+			}
+		} else {
+			// RFC 8945 section 5.3.1: the prior MAC, the message without
+			// its TSIG record, and the TSIG timers.
+			unsigned, err := withoutLastRecord(msg, m.Header, tsig.OrigID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := hmac.New(sha256.New, key.Secret)
+			h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prior))))
+			h.Write(prior)
+			h.Write(unsigned)
+			h.Write([]byte{byte(tsig.TimeSigned >> 40), byte(tsig.TimeSigned >> 32), byte(tsig.TimeSigned >> 24), byte(tsig.TimeSigned >> 16), byte(tsig.TimeSigned >> 8), byte(tsig.TimeSigned)})
+			h.Write(binary.BigEndian.AppendUint16(nil, tsig.Fudge))
+			if !hmac.Equal(tsig.MAC, h.Sum(nil)) {
+				t.Fatalf("message %d of %d doesn't verify", i, len(messages))
+			}
+		}
+		prior = tsig.MAC
+	}
+	if want := len(z.Records()) + 1; records != want {
+		t.Errorf("transferred %d records, want %d", records, want)
+	}
+}
+
+func TestTransferUnsigned(t *testing.T) {
+	messages, _ := transfer(t, bigZone(t), NewAuthenticator(), nil)
+	for i, msg := range messages {
+		m, err := dnswire.ParseMessage(msg)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if len(m.Additionals) != 0 {
+			t.Errorf("message %d carries %d additional records", i, len(m.Additionals))
+		}
+	}
+}
@@ -0,0 +1,745 @@
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+type Zone struct {
+	Origin string
+
+	mu     sync.RWMutex
+	rrsets map[string]map[uint16][]*ResourceRecord
+	// exists holds every name in the zone including empty non-terminals.
+	exists map[string]bool
+	// names is the sorted list of authoritative owner names (the NSEC chain).
+	names []string
+	// nsec3 is the hashed chain, sorted by hash, when signing with NSEC3.
+	nsec3  []*nsec3Entry
+	signer *ZoneSigner
+	// retired is set once a reload replaced the zone, which stops its
+	// maintenance goroutines.
+	retired atomic.Bool
+	// version changes with the records, which invalidates encoded
+	// responses. Versions are unique across zones and reloads, so cache
+	// keys can name a version rather than hold the zone.
+	version atomic.Uint64
+	// journal holds the changes behind the latest serials, oldest first,
+	// for incremental transfers.
+	journal []zoneDelta
+}
+
+var zoneVersions atomic.Uint64
+
+func LoadZone(origin, path string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := ParseZone(f, origin)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return NewZone(origin, records)
+}
+
+func NewZone(origin string, records []*ResourceRecord) (*Zone, error) {
+	z := &Zone{Origin: normalizeName(origin)}
+	if err := z.setRecords(records); err != nil {
+		return nil, err
+	}
+	z.version.Store(zoneVersions.Add(1))
+	return z, nil
+}
+
+func (z *Zone) setRecords(records []*ResourceRecord) error {
+	rrsets := map[string]map[uint16][]*ResourceRecord{}
+	for _, rr := range records {
+		name := dnswire.Intern(normalizeName(rr.Name))
+		if !inZone(name, z.Origin) {
+			return fmt.Errorf("zone %q: %q is out of zone", fqdn(z.Origin), fqdn(name))
+		}
+		rr.Name = name
+		if rrsets[name] == nil {
+			rrsets[name] = map[uint16][]*ResourceRecord{}
+		}
+		rrsets[name][rr.Type] = append(rrsets[name][rr.Type], rr)
+	}
+
+	apex := rrsets[z.Origin]
+	if len(apex[TypeSOA]) != 1 {
+		return fmt.Errorf("zone %q: apex must have exactly one SOA", fqdn(z.Origin))
+	}
+	if len(apex[TypeNS]) == 0 {
+		return fmt.Errorf("zone %q: apex has no NS records", fqdn(z.Origin))
+	}
+	for name, sets := range rrsets {
+		if len(sets[TypeCNAME]) == 0 {
+			continue
+		}
+		for t := range sets {
+			if t != TypeCNAME && t != TypeRRSIG && t != TypeNSEC {
+				return fmt.Errorf("zone %q: CNAME at %q must be alone", fqdn(z.Origin), fqdn(name))
+			}
+		}
+	}
+
+	z.rrsets = rrsets
+	z.index()
+	return nil
+}
+
+// index rebuilds the existence set and the canonical name order.
+func (z *Zone) index() {
+	z.exists = map[string]bool{}
+	z.names = z.names[:0]
+	for name := range z.rrsets {
+		for n := name; ; n = parentName(n) {
+			z.exists[n] = true
+			if n == z.Origin {
+				break
+			}
+		}
+		if !z.occluded(name) {
+			z.names = append(z.names, name)
+		}
+	}
+	sort.Slice(z.names, func(i, j int) bool { return canonicalLess(z.names[i], z.names[j]) })
+}
+
+// occluded reports whether name sits below a delegation point.
+func (z *Zone) occluded(name string) bool {
+	for n := parentName(name); n != z.Origin && inZone(n, z.Origin); n = parentName(n) {
+		if len(z.rrsets[n][TypeNS]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *Zone) isDelegation(name string) bool {
+	return name != z.Origin && len(z.rrsets[name][TypeNS]) > 0
+}
+
+func (z *Zone) SOA() *ResourceRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.rrsets[z.Origin][TypeSOA][0]
+}
+
+func (z *Zone) Serial() uint32 {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.serial()
+}
+
+// Records returns a snapshot of all records in the zone.
+func (z *Zone) Records() []*ResourceRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	var out []*ResourceRecord
+	for _, name := range z.sortedOwners() {
+		for _, rrtype := range sortedTypes(z.rrsets[name]) {
+			out = append(out, z.rrsets[name][rrtype]...)
+		}
+	}
+	return out
+}
+
+// SetRRset replaces the rrtype records at name with rrset, or removes
+// them if rrset is empty, and bumps the SOA serial. Signed zones get their
+// denial chain rebuilt and, unless signing online, the new RRset signed.
+func (z *Zone) SetRRset(name string, rrtype uint16, rrset []*ResourceRecord) error {
+	edits := []ZoneEdit{{Record: &ResourceRecord{Name: name, Type: rrtype}}}
+	for _, rr := range rrset {
+		edits = append(edits, ZoneEdit{Add: true, Record: rr})
+	}
+	_, err := z.Apply(edits)
+	return err
+}
+
+// ZoneEdit is one change to a zone. Record is added if Add is set, and
+// deleted otherwise; a deletion without RData deletes the whole RRset, and
+// one with type 0 every record at the name.
+type ZoneEdit struct {
+	Add    bool
+	Record *ResourceRecord
+}
+
+// Apply makes all of edits, or none if one of them can't be made, and
+// bumps the SOA serial once if they changed anything. It returns the
+// serial.
+func (z *Zone) Apply(edits []ZoneEdit) (uint32, error) {
+	return z.applyIf(nil, edits)
+}
+
+// applyIf is Apply, but makes none of edits unless check, called with z.mu
+// held, returns nil.
+func (z *Zone) applyIf(check func() error, edits []ZoneEdit) (uint32, error) {
+	z.mu.Lock()
+	if check != nil {
+		if err := check(); err != nil {
+			z.mu.Unlock()
+			return 0, err
+		}
+	}
+	// sets holds the RRsets of the names edited, as they will be.
+	sets := map[string]map[uint16][]*ResourceRecord{}
+	for _, e := range edits {
+		rr := e.Record
+		name := dnswire.Intern(normalizeName(rr.Name))
+		if err := z.checkEdit(name, rr.Type, e.Add); err != nil {
+			z.mu.Unlock()
+			return 0, err
+		}
+		if _, ok := sets[name]; !ok {
+			sets[name] = maps.Clone(z.rrsets[name])
+			if sets[name] == nil {
+				sets[name] = map[uint16][]*ResourceRecord{}
+			}
+		}
+		owner := sets[name]
+		if e.Add {
+			if !slices.ContainsFunc(owner[rr.Type], func(o *ResourceRecord) bool { return bytes.Equal(o.RData, rr.RData) }) {
+				added := *rr
+				added.Name, added.Class = name, ClassINET
+				owner[rr.Type] = append(slices.Clip(owner[rr.Type]), &added)
+			}
+			continue
+		}
+		for t, rrset := range owner {
+			if rr.Type != 0 && t != rr.Type || name == z.Origin && (t == TypeSOA || t == TypeNS) {
+				continue
+			}
+			kept := slices.DeleteFunc(slices.Clone(rrset), func(o *ResourceRecord) bool {
+				return len(rr.RData) == 0 || bytes.Equal(o.RData, rr.RData)
+			})
+			if len(kept) == 0 {
+				delete(owner, t)
+			} else {
+				owner[t] = kept
+			}
+		}
+	}
+	var delta zoneDelta
+	for name, owner := range sets {
+		if err := z.checkOwner(name, owner); err != nil {
+			z.mu.Unlock()
+			return 0, err
+		}
+		delta.deleted = append(delta.deleted, missingRecords(z.rrsets[name], owner)...)
+		delta.added = append(delta.added, missingRecords(owner, z.rrsets[name])...)
+	}
+	if len(delta.deleted)+len(delta.added) == 0 {
+		serial := z.serial()
+		z.mu.Unlock()
+		return serial, nil
+	}
+	for name, owner := range sets {
+		if len(owner) == 0 {
+			delete(z.rrsets, name)
+		} else {
+			z.rrsets[name] = owner
+		}
+	}
+	serial := z.bumpSerial(z.serial()+1, delta)
+	resign := z.changed()
+	z.mu.Unlock()
+	if resign {
+		z.SignAll()
+	}
+	return serial, nil
+}
+
+// missingRecords returns the records of sets that others doesn't have.
+func missingRecords(sets, others map[uint16][]*ResourceRecord) []*ResourceRecord {
+	var out []*ResourceRecord
+	for t, rrset := range sets {
+		for _, rr := range rrset {
+			if !slices.ContainsFunc(others[t], func(o *ResourceRecord) bool { return bytes.Equal(o.RData, rr.RData) }) {
+				out = append(out, rr)
+			}
+		}
+	}
+	return out
+}
+
+// RaiseSerial makes the SOA serial follow floor, in serial number
+// arithmetic (RFC 1982), if it doesn't already.
+func (z *Zone) RaiseSerial(floor uint32) {
+	z.mu.Lock()
+	if int32(z.serial()-floor) > 0 {
+		z.mu.Unlock()
+		return
+	}
+	z.bumpSerial(floor+1, zoneDelta{})
+	resign := z.changed()
+	z.mu.Unlock()
+	if resign {
+		z.SignAll()
+	}
+}
+
+// changed brings the index and the denial chain up to date after the
+// records changed, and reports whether the zone has to be signed again,
+// which is done once z.mu, which the caller holds, is released.
+func (z *Zone) changed() bool {
+	if z.signer == nil {
+		z.index()
+		z.version.Store(zoneVersions.Add(1))
+		return false
+	}
+	z.prepareSigned()
+	return !z.signer.Online
+}
+
+// serial and setSerial read and change the SOA serial. The caller holds
+// z.mu.
+func (z *Zone) serial() uint32 {
+	return soaSerial(z.rrsets[z.Origin][TypeSOA][0])
+}
+
+func soaSerial(soa *ResourceRecord) uint32 {
+	return rdataUint32(soa.RData, len(soa.RData)-20)
+}
+
+func (z *Zone) setSerial(serial uint32) {
+	// Records are shared with answers in flight, so the SOA is replaced
+	// rather than changed in place.
+	soa := *z.rrsets[z.Origin][TypeSOA][0]
+	soa.RData = bytes.Clone(soa.RData)
+	binary.BigEndian.PutUint32(soa.RData[len(soa.RData)-20:], serial)
+	z.rrsets[z.Origin][TypeSOA] = []*ResourceRecord{&soa}
+}
+
+// checkEdit reports why records of rrtype can't be added at name, or
+// deleted there, if they can't. The caller holds z.mu.
+func (z *Zone) checkEdit(name string, rrtype uint16, add bool) error {
+	switch {
+	case !inZone(name, z.Origin):
+		return fmt.Errorf("zone %q: %q is out of zone", fqdn(z.Origin), fqdn(name))
+	case name == z.Origin && (rrtype == TypeSOA || rrtype == TypeNS):
+		return fmt.Errorf("zone %q: the apex %s records can't be set", fqdn(z.Origin), dnswire.TypeString(rrtype))
+	case add && rrtype == 0:
+		return fmt.Errorf("zone %q: no type for a record added at %q", fqdn(z.Origin), fqdn(name))
+	}
+	return nil
+}
+
+// checkOwner reports why name can't have the RRsets in sets, if it
+// can't. The caller holds z.mu.
+func (z *Zone) checkOwner(name string, sets map[uint16][]*ResourceRecord) error {
+	if len(sets) == 0 {
+		return nil
+	}
+	if z.occluded(name) {
+		return fmt.Errorf("zone %q: %q is below a delegation", fqdn(z.Origin), fqdn(name))
+	}
+	if len(sets[TypeCNAME]) > 0 {
+		for t := range sets {
+			if t != TypeCNAME && t != TypeRRSIG && t != TypeNSEC {
+				return fmt.Errorf("zone %q: CNAME at %q must be alone", fqdn(z.Origin), fqdn(name))
+			}
+		}
+	}
+	return nil
+}
+
+func (z *Zone) sortedOwners() []string {
+	owners := make([]string, 0, len(z.rrsets))
+	for name := range z.rrsets {
+		owners = append(owners, name)
+	}
+	sort.Slice(owners, func(i, j int) bool { return canonicalLess(owners[i], owners[j]) })
+	return owners
+}
+
+func sortedTypes(sets map[uint16][]*ResourceRecord) []uint16 {
+	types := make([]uint16, 0, len(sets))
+	for t := range sets {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+type zoneAnswer struct {
+	RCode         uint8
+	Authoritative bool
+	Answers       []*ResourceRecord
+	Authorities   []*ResourceRecord
+	Additionals   []*ResourceRecord
+}
+
+func (z *Zone) Lookup(qname string, qtype uint16, dnssec bool) *zoneAnswer {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	dnssec = dnssec && z.signer != nil
+	ans := &zoneAnswer{Authoritative: true}
+	name := normalizeName(qname)
+
+	for i := 0; i < 8; i++ {
+		if ref := z.referral(name, qtype, dnssec); ref != nil {
+			if len(ans.Answers) > 0 {
+				// CNAME chain led into a delegation, the client follows it.
+				return ans
+			}
+			return ref
+		}
+
+		sets, exists := z.rrsets[name]
+		wildcard := ""
+		if !exists && !z.exists[name] {
+			wildcard = z.wildcardFor(name)
+			if wildcard == "" {
+				ans.RCode = RCodeNameError
+				if len(ans.Answers) > 0 {
+					ans.RCode = RCodeSuccess // NXDOMAIN only applies to the original name
+				}
+				z.negative(ans, dnssec)
+				if dnssec {
+					ans.Authorities = append(ans.Authorities, z.proveNXDomain(name)...)
+				}
+				return ans
+			}
+			sets = z.rrsets[wildcard]
+		}
+
+		var rrsets [][]*ResourceRecord
+		if qtype == TypeANY {
+			for _, t := range sortedTypes(sets) {
+				if t != TypeRRSIG {
+					rrsets = append(rrsets, sets[t])
+				}
+			}
+		} else if rrs := sets[qtype]; len(rrs) > 0 {
+			rrsets = append(rrsets, rrs)
+		}
+
+		if len(rrsets) > 0 {
+			for _, rrset := range rrsets {
+				ans.Answers = append(ans.Answers, z.withSigs(rrset, name, dnssec)...)
+			}
+			if wildcard != "" && dnssec {
+				ans.Authorities = append(ans.Authorities, z.proveWildcardAnswer(name)...)
+			}
+			z.addGlue(ans, rrsets)
+			return ans
+		}
+
+		if cname := sets[TypeCNAME]; len(cname) > 0 && qtype != TypeCNAME {
+			ans.Answers = append(ans.Answers, z.withSigs(cname, name, dnssec)...)
+			if wildcard != "" && dnssec {
+				ans.Authorities = append(ans.Authorities, z.proveWildcardAnswer(name)...)
+			}
+			target := normalizeName(rdataName(cname[0].RData, 0))
+			if !inZone(target, z.Origin) {
+				return ans
+			}
+			name = target
+			continue
+		}
+
+		z.negative(ans, dnssec)
+		if dnssec {
+			ans.Authorities = append(ans.Authorities, z.proveNoData(name, wildcard)...)
+		}
+		return ans
+	}
+	return ans
+}
+
+// referral returns a delegation response if name is at or below a zone cut.
+func (z *Zone) referral(name string, qtype uint16, dnssec bool) *zoneAnswer {
+	var cut string
+	for n := name; n != z.Origin && inZone(n, z.Origin); n = parentName(n) {
+		if len(z.rrsets[n][TypeNS]) > 0 {
+			cut = n
+		}
+	}
+	if cut == "" || (cut == name && qtype == TypeDS) {
+		return nil
+	}
+
+	ans := &zoneAnswer{}
+	ns := z.rrsets[cut][TypeNS]
+	ans.Authorities = append(ans.Authorities, ns...)
+	if dnssec {
+		if ds := z.rrsets[cut][TypeDS]; len(ds) > 0 {
+			ans.Authorities = append(ans.Authorities, z.withSigs(ds, cut, true)...)
+		} else {
+			ans.Authorities = append(ans.Authorities, z.proveNoDS(cut)...)
+		}
+	}
+	z.addGlue(ans, [][]*ResourceRecord{ns})
+	return ans
+}
+
+// wildcardFor returns the wildcard owner that synthesizes name, if any.
+func (z *Zone) wildcardFor(name string) string {
+	wild := wildcardName(z.closestEncloser(name))
+	if _, ok := z.rrsets[wild]; ok {
+		return wild
+	}
+	return ""
+}
+
+func (z *Zone) negative(ans *zoneAnswer, dnssec bool) {
+	soa := *z.rrsets[z.Origin][TypeSOA][0]
+	soa.TTL = z.negativeTTL()
+	ans.Authorities = append(ans.Authorities, &soa)
+	if !dnssec {
+		return
+	}
+	for _, sig := range z.signer.sigsFor(z, z.rrsets[z.Origin][TypeSOA]) {
+		s := *sig
+		s.TTL = soa.TTL
+		ans.Authorities = append(ans.Authorities, &s)
+	}
+}
+
+// negativeTTL is min(SOA TTL, SOA minimum) as in RFC 2308 section 5.
+func (z *Zone) negativeTTL() uint32 {
+	soa := z.rrsets[z.Origin][TypeSOA][0]
+	return min(soa.TTL, rdataUint32(soa.RData, len(soa.RData)-4))
+}
+
+func (z *Zone) closestEncloser(name string) string {
+	ce := parentName(name)
+	for !z.exists[ce] && ce != z.Origin {
+		ce = parentName(ce)
+	}
+	return ce
+}
+
+// withSigs returns rrset, renamed to owner for wildcard synthesis, followed
+// by its RRSIGs when dnssec is requested.
+func (z *Zone) withSigs(rrset []*ResourceRecord, owner string, dnssec bool) []*ResourceRecord {
+	out := make([]*ResourceRecord, 0, len(rrset)+1)
+	synthesized := owner != rrset[0].Name
+	for _, rr := range rrset {
+		if synthesized {
+			c := *rr
+			c.Name = owner
+			rr = &c
+		}
+		out = append(out, rr)
+	}
+	if !dnssec || z.signer == nil {
+		return out
+	}
+	for _, sig := range z.signer.sigsFor(z, rrset) {
+		if synthesized {
+			c := *sig
+			c.Name = owner
+			sig = &c
+		}
+		out = append(out, sig)
+	}
+	return out
+}
+
+// addGlue adds in-zone addresses for NS, MX and SRV targets.
+func (z *Zone) addGlue(ans *zoneAnswer, rrsets [][]*ResourceRecord) {
+	seen := map[string]bool{}
+	for _, rrset := range rrsets {
+		for _, rr := range rrset {
+			var target string
+			switch rr.Type {
+			case TypeNS:
+				target = rdataName(rr.RData, 0)
+			case TypeMX:
+				target = rdataName(rr.RData, 2)
+			case TypeSRV:
+				target = rdataName(rr.RData, 6)
+			default:
+				continue
+			}
+			target = normalizeName(target)
+			if seen[target] || !inZone(target, z.Origin) {
+				continue
+			}
+			seen[target] = true
+			ans.Additionals = append(ans.Additionals, z.rrsets[target][TypeA]...)
+			ans.Additionals = append(ans.Additionals, z.rrsets[target][TypeAAAA]...)
+		}
+	}
+}
+
+type ZoneSet struct {
+	// Minimal leaves out additional data that positive answers don't
+	// need, such as addresses of MX and NS targets. Referral glue and
+	// DNSSEC proofs are always included.
+	Minimal bool
+	// keyDir is where the signed zones pick up key changes.
+	keyDir string
+
+	mu    sync.RWMutex
+	zones map[string]*Zone
+}
+
+func NewZoneSet() *ZoneSet {
+	return &ZoneSet{zones: map[string]*Zone{}}
+}
+
+func (zs *ZoneSet) Add(z *Zone) {
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+	zs.zones[z.Origin] = z
+}
+
+// Find returns the most specific zone containing qname.
+func (zs *ZoneSet) Find(qname string) *Zone {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+	for name := normalizeName(qname); ; name = parentName(name) {
+		if z, ok := zs.zones[name]; ok {
+			return z
+		}
+		if name == "" {
+			return nil
+		}
+	}
+}
+
+// Start begins the background work of the signed zones in the set: key
+// maintenance and, if enabled, polling the parent for DS records.
+func (zs *ZoneSet) Start() {
+	for _, z := range zs.Zones() {
+		if z.signer == nil {
+			continue
+		}
+		go z.RunMaintenance(zs.keyDir, time.Hour)
+		if z.signer.ParentPoll > 0 {
+			go z.PollParent()
+		}
+	}
+}
+
+// Retire stops the background work of every zone in the set.
+func (zs *ZoneSet) Retire() {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+	for _, z := range zs.zones {
+		z.retired.Store(true)
+	}
+}
+
+// Zones returns the zones in the set, sorted by origin.
+func (zs *ZoneSet) Zones() []*Zone {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+	out := make([]*Zone, 0, len(zs.zones))
+	for _, z := range zs.zones {
+		out = append(out, z)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Origin < out[j].Origin })
+	return out
+}
+
+func (zs *ZoneSet) Len() int {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+	return len(zs.zones)
+}
+
+// Answer builds an authoritative response for message if its question
+// falls inside one of the served zones.
+func (zs *ZoneSet) Answer(message *Message) (*Query, bool) {
+	if len(message.Questions) != 1 {
+		return nil, false
+	}
+	q := message.Questions[0]
+	z := zs.Find(q.Name)
+	if z == nil {
+		return nil, false
+	}
+
+	opt := findOPT(message)
+	dnssec := opt != nil && opt.TTL&(1<<15) != 0
+	ans := z.Lookup(q.Name, q.QType, dnssec)
+	if zs.Minimal && ans.RCode == RCodeSuccess && len(ans.Answers) > 0 {
+		ans.Additionals = nil
+	}
+
+	resp := new(Query).SetRcode(message, ans.RCode).
+		AddAnswer(ans.Answers...).
+		AddAuthority(ans.Authorities...).
+		AddAdditional(ans.Additionals...)
+	resp.Header.AA = ans.Authoritative
+	if opt != nil {
+		resp.SetEDNS(ednsUDPSize, dnssec)
+	}
+	return resp, true
+}
+
+func inZone(name, origin string) bool {
+	return origin == "" || name == origin || strings.HasSuffix(name, "."+origin)
+}
+
+func wildcardName(parent string) string {
+	if parent == "" {
+		return "*"
+	}
+	return "*." + parent
+}
+
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// canonicalLess orders names as in RFC 4034 section 6.1: label by label
+// from the right, case-insensitively.
+func canonicalLess(a, b string) bool {
+	la := strings.Split(strings.ToLower(a), ".")
+	lb := strings.Split(strings.ToLower(b), ".")
+	if a == "" {
+		la = nil
+	}
+	if b == "" {
+		lb = nil
+	}
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// rdataName decodes an uncompressed name embedded in rdata at off.
+func rdataName(rdata []byte, off int) string {
+	if off >= len(rdata) {
+		return ""
+	}
+	p := dnswire.NewReader(rdata, off)
+	name, err := p.ReadName()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func rdataUint32(rdata []byte, off int) uint32 {
+	if off < 0 || off+4 > len(rdata) {
+		return 0
+	}
+	return uint32(rdata[off])<<24 | uint32(rdata[off+1])<<16 | uint32(rdata[off+2])<<8 | uint32(rdata[off+3])
+}
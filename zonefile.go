@@ -0,0 +1,455 @@
+package dnsserver
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bibektamang7/dns-server/dnswire"
+)
+
+type zoneLine struct {
+	tokens     []string
+	quoted     []bool
+	blankOwner bool
+	lineno     int
+}
+
+// tokenizeZone splits master file data into logical lines, joining
+// parenthesised continuations and dropping comments.
+func tokenizeZone(data string) ([]zoneLine, error) {
+	var lines []zoneLine
+	cur := zoneLine{lineno: 1}
+	depth := 0
+	lineno := 1
+	startOfLine := true
+
+	var tok strings.Builder
+	inTok, inQuote := false, false
+	flush := func(quoted bool) {
+		if inTok || quoted {
+			cur.tokens = append(cur.tokens, tok.String())
+			cur.quoted = append(cur.quoted, quoted)
+		}
+		tok.Reset()
+		inTok = false
+	}
+	endLine := func() {
+		if len(cur.tokens) > 0 {
+			lines = append(lines, cur)
+		}
+		cur = zoneLine{lineno: lineno}
+		startOfLine = true
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inQuote {
+			switch c {
+			case '"':
+				inQuote = false
+				flush(true)
+			case '\\':
+				if i+1 < len(data) {
+					i++
+					tok.WriteByte(data[i])
+				}
+			case '\n':
+				lineno++
+				tok.WriteByte(c)
+			default:
+				tok.WriteByte(c)
+			}
+			continue
+		}
+
+		switch c {
+		case ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i--
+		case '"':
+			flush(false)
+			inQuote = true
+			startOfLine = false
+		case '(':
+			flush(false)
+			depth++
+		case ')':
+			flush(false)
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced )", lineno)
+			}
+			depth--
+		case ' ', '\t', '\r':
+			if startOfLine && len(cur.tokens) == 0 && !inTok {
+				cur.blankOwner = true
+			}
+			flush(false)
+		case '\n':
+			flush(false)
+			lineno++
+			if depth == 0 {
+				endLine()
+			}
+		case '\\':
+			inTok = true
+			tok.WriteByte(c)
+			if i+1 < len(data) {
+				i++
+				tok.WriteByte(data[i])
+			}
+		default:
+			inTok = true
+			tok.WriteByte(c)
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			startOfLine = false
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("line %d: unterminated string", lineno)
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced (", lineno)
+	}
+	flush(false)
+	endLine()
+	return lines, nil
+}
+
+// ParseZone reads an RFC 1035 master file. Owner names are returned
+// lowercased and without the trailing dot.
+func ParseZone(r io.Reader, origin string) ([]*ResourceRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := tokenizeZone(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	origin = normalizeName(origin)
+	var defaultTTL uint32 = 3600
+	lastOwner := origin
+	var records []*ResourceRecord
+
+	for _, line := range lines {
+		tokens := line.tokens
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("line %d: $ORIGIN needs a name", line.lineno)
+			}
+			origin = absName(tokens[1], origin)
+			continue
+		case "$TTL":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("line %d: $TTL needs a value", line.lineno)
+			}
+			ttl, err := parseTTL(tokens[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.lineno, err)
+			}
+			defaultTTL = ttl
+			continue
+		case "$INCLUDE", "$GENERATE":
+			return nil, fmt.Errorf("line %d: %s is not supported", line.lineno, tokens[0])
+		}
+
+		owner := lastOwner
+		rest, quoted := tokens, line.quoted
+		if !line.blankOwner {
+			owner = absName(tokens[0], origin)
+			rest, quoted = tokens[1:], line.quoted[1:]
+		}
+		lastOwner = owner
+
+		rr := &ResourceRecord{Name: owner, Class: ClassINET, TTL: defaultTTL}
+		rrtype, found := uint16(0), false
+		for len(rest) > 0 && !found {
+			tok := rest[0]
+			if ttl, err := parseTTL(tok); err == nil && tok[0] >= '0' && tok[0] <= '9' {
+				rr.TTL = ttl
+			} else if strings.EqualFold(tok, "IN") {
+				rr.Class = ClassINET
+			} else if t, ok := dnswire.ParseType(tok); ok {
+				rrtype, found = t, true
+			} else {
+				return nil, fmt.Errorf("line %d: unexpected %q", line.lineno, tok)
+			}
+			rest, quoted = rest[1:], quoted[1:]
+		}
+		if !found {
+			return nil, fmt.Errorf("line %d: missing record type", line.lineno)
+		}
+		rr.Type = rrtype
+
+		rdata, err := packRData(rrtype, rest, quoted, origin)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", line.lineno, dnswire.TypeString(rrtype), err)
+		}
+		rr.RData = rdata
+		records = append(records, rr)
+	}
+	return records, nil
+}
+
+func absName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return normalizeName(name)
+	}
+	if origin == "" {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name) + "." + origin
+}
+
+// parseTTL accepts plain seconds or BIND style units such as 1h30m.
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	var total, cur uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			cur = cur*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("invalid ttl %q", s)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			cur *= 60
+		case 'h':
+			cur *= 3600
+		case 'd':
+			cur *= 86400
+		case 'w':
+			cur *= 604800
+		default:
+			return 0, fmt.Errorf("invalid ttl %q", s)
+		}
+		total += cur
+		cur, digits = 0, false
+	}
+	if digits || total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("invalid ttl %q", s)
+	}
+	return uint32(total), nil
+}
+
+// appendName appends name in uncompressed wire form, preserving case. The
+// name has to have passed checkName; dnswire.AppendName checks as it goes.
+func appendName(buf []byte, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0)
+}
+
+func checkName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return fmt.Errorf("name too long: %q", name)
+	}
+	if name == "" {
+		return nil
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("bad label in %q", name)
+		}
+	}
+	return nil
+}
+
+func packRData(rrtype uint16, fields []string, quoted []bool, origin string) ([]byte, error) {
+	if len(fields) > 0 && fields[0] == `\#` && !quoted[0] {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("generic rdata needs a length")
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		data, err := hex.DecodeString(strings.Join(fields[2:], ""))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != n {
+			return nil, fmt.Errorf("generic rdata length mismatch")
+		}
+		return data, nil
+	}
+
+	need := func(n int) error {
+		if len(fields) < n {
+			return fmt.Errorf("expected %d fields, got %d", n, len(fields))
+		}
+		return nil
+	}
+	name := func(s string) ([]byte, error) {
+		n := absName(s, origin)
+		if err := checkName(n); err != nil {
+			return nil, err
+		}
+		return appendName(nil, n), nil
+	}
+	uint16s := func(buf []byte, fs ...string) ([]byte, error) {
+		for _, f := range fs {
+			n, err := strconv.ParseUint(f, 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		}
+		return buf, nil
+	}
+
+	switch rrtype {
+	case TypeA:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", fields[0])
+		}
+		return []byte(ip), nil
+	case TypeAAAA:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", fields[0])
+		}
+		return []byte(ip.To16()), nil
+	case TypeNS, TypeCNAME, TypePTR:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		return name(fields[0])
+	case TypeMX:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		buf, err := uint16s(nil, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		n, err := name(fields[1])
+		return append(buf, n...), err
+	case TypeSRV:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		buf, err := uint16s(nil, fields[0:3]...)
+		if err != nil {
+			return nil, err
+		}
+		n, err := name(fields[3])
+		return append(buf, n...), err
+	case TypeSOA:
+		if err := need(7); err != nil {
+			return nil, err
+		}
+		mname, err := name(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rname, err := name(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		buf := append(mname, rname...)
+		for _, f := range fields[2:7] {
+			v, err := parseTTL(f)
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.BigEndian.AppendUint32(buf, v)
+		}
+		return buf, nil
+	case TypeTXT:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		var buf []byte
+		for _, f := range fields {
+			for {
+				chunk := f
+				if len(chunk) > 255 {
+					chunk = f[:255]
+				}
+				buf = append(buf, byte(len(chunk)))
+				buf = append(buf, chunk...)
+				f = f[len(chunk):]
+				if f == "" {
+					break
+				}
+			}
+		}
+		return buf, nil
+	case TypeDS, TypeCDS:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		buf, err := uint16s(nil, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields[1:3] {
+			n, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, byte(n))
+		}
+		digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, digest...), nil
+	case TypeDNSKEY, TypeCDNSKEY, TypeKEY:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		buf, err := uint16s(nil, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields[1:3] {
+			n, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, byte(n))
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, key...), nil
+	}
+	return nil, fmt.Errorf("presentation format not supported, use \\# generic syntax")
+}